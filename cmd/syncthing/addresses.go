@@ -0,0 +1,113 @@
+// Copyright (C) 2014 The Syncthing Authors.
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for
+// more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// How the addresses of a device are found: by discovery, from its static
+// addresses, or both. For our own device, these are the addresses we
+// announce.
+const (
+	addressModeDynamic = "dynamic"
+	addressModeStatic  = "static"
+	addressModeBoth    = "both"
+)
+
+// addressMode returns the mode of the address list of a device, and its
+// static addresses.
+func addressMode(addrs []string) (string, []string) {
+	dynamic := false
+	static := []string{}
+	for _, addr := range addrs {
+		if addr == "dynamic" {
+			dynamic = true
+		} else {
+			static = append(static, addr)
+		}
+	}
+	switch {
+	case dynamic && len(static) > 0:
+		return addressModeBoth, static
+	case len(static) > 0:
+		return addressModeStatic, static
+	default:
+		return addressModeDynamic, static
+	}
+}
+
+// deviceAddresses returns the address list of a device for the mode and
+// static addresses, which are checked and normalized.
+func deviceAddresses(mode string, static []string) ([]string, error) {
+	var addrs []string
+	switch mode {
+	case addressModeDynamic:
+		return []string{"dynamic"}, nil
+	case addressModeBoth:
+		addrs = []string{"dynamic"}
+	case addressModeStatic:
+	default:
+		return nil, fmt.Errorf("unknown address mode %q", mode)
+	}
+	if len(static) == 0 {
+		return nil, errors.New("no static addresses given")
+	}
+	for _, addr := range static {
+		addr, err := checkDeviceAddress(addr)
+		if err != nil {
+			return nil, err
+		}
+		addrs = append(addrs, addr)
+	}
+	return addrs, nil
+}
+
+// announceAddresses returns the address list of our own device in the form
+// announced by the discoverer.
+func announceAddresses(addrs []string) []string {
+	res := make([]string, len(addrs))
+	for i, addr := range addrs {
+		if addr == "dynamic" {
+			res[i] = addr
+		} else {
+			res[i] = deviceAddress(addr)
+		}
+	}
+	return res
+}
+
+// checkDeviceAddress returns the static address in the form it's kept in the
+// configuration, or an error if it's not a host and port. The host may be
+// left out, and the port defaults to 22000.
+func checkDeviceAddress(addr string) (string, error) {
+	norm := deviceAddress(addr)
+	_, port, err := net.SplitHostPort(norm)
+	if err != nil {
+		return "", fmt.Errorf("invalid address %q: %v", addr, err)
+	}
+	if p, err := strconv.Atoi(port); err != nil || p < 1 || p > 65535 {
+		return "", fmt.Errorf("invalid address %q: bad port", addr)
+	}
+	if strings.ContainsAny(norm, "/?#") {
+		return "", fmt.Errorf("invalid address %q", addr)
+	}
+	return norm, nil
+}
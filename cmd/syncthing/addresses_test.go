@@ -0,0 +1,71 @@
+// Copyright (C) 2014 The Syncthing Authors.
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for
+// more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestAddressMode(t *testing.T) {
+	cases := []struct {
+		addrs  []string
+		mode   string
+		static []string
+	}{
+		{[]string{"dynamic"}, addressModeDynamic, []string{}},
+		{nil, addressModeDynamic, []string{}},
+		{[]string{"1.2.3.4:22000"}, addressModeStatic, []string{"1.2.3.4:22000"}},
+		{[]string{"dynamic", "vpn.example:22000"}, addressModeBoth, []string{"vpn.example:22000"}},
+	}
+	for _, tc := range cases {
+		mode, static := addressMode(tc.addrs)
+		if mode != tc.mode || !reflect.DeepEqual(static, tc.static) {
+			t.Errorf("%v: unexpected mode %q, static %v", tc.addrs, mode, static)
+		}
+	}
+}
+
+func TestDeviceAddresses(t *testing.T) {
+	addrs, err := deviceAddresses(addressModeStatic, []string{"tcp://vpn.example:22000", "10.0.0.1", ":22001"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exp := []string{"vpn.example:22000", "10.0.0.1:22000", ":22001"}; !reflect.DeepEqual(addrs, exp) {
+		t.Errorf("Unexpected addresses %v != %v", addrs, exp)
+	}
+
+	addrs, err = deviceAddresses(addressModeBoth, []string{"[fe80::1]:22000"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exp := []string{"dynamic", "[fe80::1]:22000"}; !reflect.DeepEqual(addrs, exp) {
+		t.Errorf("Unexpected addresses %v != %v", addrs, exp)
+	}
+
+	if addrs, err := deviceAddresses(addressModeDynamic, []string{"1.2.3.4"}); err != nil || !reflect.DeepEqual(addrs, []string{"dynamic"}) {
+		t.Errorf("Unexpected addresses %v, %v", addrs, err)
+	}
+
+	for _, bad := range [][]string{nil, {"1.2.3.4:http"}, {"1.2.3.4:70000"}, {"http://1.2.3.4:80/x"}, {"a:b:c"}} {
+		if _, err := deviceAddresses(addressModeStatic, bad); err == nil {
+			t.Errorf("Unexpected nil error for %v", bad)
+		}
+	}
+	if _, err := deviceAddresses("sometimes", []string{"1.2.3.4"}); err == nil {
+		t.Error("Unexpected nil error for unknown mode")
+	}
+}
@@ -0,0 +1,142 @@
+// Copyright (C) 2014 The Syncthing Authors.
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for
+// more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/syncthing/syncthing/internal/protocol"
+)
+
+// A connection is kept for at least this long before it can be dropped to
+// make room for another device, and a device that was disconnected isn't
+// readmitted in place of another for this long either.
+var minConnectionAge = 10 * time.Minute
+
+// The parts of the model the connection limiter needs.
+type connectionRanker interface {
+	ConnectedDevices() []protocol.DeviceID
+	OutOfSync(protocol.DeviceID) float64
+	DropConnection(protocol.DeviceID)
+}
+
+// A connectionLimiter keeps the number of connected devices within
+// Options.MaxConnections. When at the limit, a new device is let in in
+// place of the connected device most in sync that has been connected for at
+// least minConnectionAge, which is then dropped. What we have of the index of
+// a device that isn't connected may be stale, so it counts as completely out
+// of sync, unless it was connected less than minConnectionAge ago. This
+// cycles devices that are in sync out in favour of those not seen for a
+// while.
+type connectionLimiter struct {
+	max     int
+	ranker  connectionRanker
+	since   map[protocol.DeviceID]time.Time // device -> when it was admitted
+	seen    map[protocol.DeviceID]time.Time // device -> when it was last connected
+	dropped map[protocol.DeviceID]bool      // devices dropped but not yet disconnected
+	mut     sync.Mutex
+}
+
+func newConnectionLimiter(ranker connectionRanker, max int) *connectionLimiter {
+	return &connectionLimiter{
+		max:     max,
+		ranker:  ranker,
+		since:   make(map[protocol.DeviceID]time.Time),
+		seen:    make(map[protocol.DeviceID]time.Time),
+		dropped: make(map[protocol.DeviceID]bool),
+	}
+}
+
+// allowed returns whether a connection to the device would be admitted, so
+// that we don't dial devices we would drop anyway.
+func (c *connectionLimiter) allowed(device protocol.DeviceID) bool {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	_, _, ok := c.pick(device, time.Now())
+	return ok
+}
+
+// admit returns whether the device may be connected, dropping another
+// device's connection to make room for it if necessary.
+func (c *connectionLimiter) admit(device protocol.DeviceID) bool {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+
+	now := time.Now()
+	victim, drop, ok := c.pick(device, now)
+	if !ok {
+		return false
+	}
+	if drop {
+		l.Infof("Dropping connection to %s to make room for %s (at most %d connections)", victim, device, c.max)
+		delete(c.since, victim)
+		c.seen[victim] = now
+		c.dropped[victim] = true
+		c.ranker.DropConnection(victim)
+	}
+	c.since[device] = now
+	return true
+}
+
+// pick returns whether the device may be connected, and whether victim
+// must be dropped first. It forgets the devices no longer connected.
+func (c *connectionLimiter) pick(device protocol.DeviceID, now time.Time) (victim protocol.DeviceID, drop, ok bool) {
+	if c.max <= 0 {
+		return victim, false, true
+	}
+
+	var connected []protocol.DeviceID
+	isConnected := make(map[protocol.DeviceID]bool)
+	for _, dev := range c.ranker.ConnectedDevices() {
+		isConnected[dev] = true
+		if !c.dropped[dev] {
+			connected = append(connected, dev)
+		}
+	}
+	for dev := range c.since {
+		if !isConnected[dev] {
+			delete(c.since, dev)
+			c.seen[dev] = now
+		}
+	}
+	for dev := range c.dropped {
+		if !isConnected[dev] {
+			delete(c.dropped, dev)
+		}
+	}
+
+	if len(connected) < c.max {
+		return victim, false, true
+	}
+	if seen, ok := c.seen[device]; ok && now.Sub(seen) < minConnectionAge {
+		return victim, false, false
+	}
+
+	var lowest float64
+	for _, dev := range connected {
+		if since, ok := c.since[dev]; ok && now.Sub(since) < minConnectionAge {
+			continue
+		}
+		if score := c.ranker.OutOfSync(dev); !drop || score < lowest {
+			victim, lowest, drop = dev, score, true
+		}
+	}
+	if !drop {
+		return victim, false, false
+	}
+	return victim, true, true
+}
@@ -0,0 +1,116 @@
+// Copyright (C) 2014 The Syncthing Authors.
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for
+// more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/syncthing/syncthing/internal/protocol"
+)
+
+type fakeRanker struct {
+	connected map[protocol.DeviceID]bool
+	outOfSync map[protocol.DeviceID]float64
+	dropped   []protocol.DeviceID
+}
+
+func (r *fakeRanker) ConnectedDevices() []protocol.DeviceID {
+	var res []protocol.DeviceID
+	for dev := range r.connected {
+		res = append(res, dev)
+	}
+	return res
+}
+
+func (r *fakeRanker) OutOfSync(dev protocol.DeviceID) float64 {
+	return r.outOfSync[dev]
+}
+
+func (r *fakeRanker) DropConnection(dev protocol.DeviceID) {
+	r.dropped = append(r.dropped, dev)
+}
+
+func TestConnectionLimiter(t *testing.T) {
+	device1, _ := protocol.DeviceIDFromString("AIR6LPZ-7K4PTTV-UXQSMUU-CPQ5YWH-OEDFIIQ-JUG777G-2YQXXR5-YD6AWQR")
+	device2, _ := protocol.DeviceIDFromString("GYRZZQB-IRNPV4Z-T7TC52W-EQYJ3TT-FDQW6MW-DFLMU42-SSSU6EM-FBK2VAY")
+	device3, _ := protocol.DeviceIDFromString("LGFPDIT-7SKNNJL-VJZA4FC-7QNCRKA-CE753K7-2BW5QDK-2FOZ7FR-FEP57QJ")
+
+	r := &fakeRanker{
+		connected: make(map[protocol.DeviceID]bool),
+		outOfSync: map[protocol.DeviceID]float64{device1: 0, device2: 50, device3: 100},
+	}
+	c := newConnectionLimiter(r, 2)
+
+	for _, dev := range []protocol.DeviceID{device1, device2} {
+		if !c.admit(dev) {
+			t.Fatalf("%s should be admitted below the limit", dev)
+		}
+		r.connected[dev] = true
+	}
+
+	// The connections are too new to be dropped.
+	if c.allowed(device3) || c.admit(device3) {
+		t.Error("Device admitted while all connections are new")
+	}
+
+	defer func(age time.Duration) { minConnectionAge = age }(minConnectionAge)
+	minConnectionAge = 0
+
+	if !c.allowed(device3) {
+		t.Error("Device further out of sync should be allowed")
+	}
+	if len(r.dropped) != 0 {
+		t.Error("Checking whether a device is allowed should not drop anything")
+	}
+	if !c.admit(device3) {
+		t.Fatal("Device further out of sync should be admitted")
+	}
+	if len(r.dropped) != 1 || r.dropped[0] != device1 {
+		t.Fatalf("Expected the device most in sync to be dropped, got %v", r.dropped)
+	}
+
+	// device1 is still connected until the model notices the close, but it
+	// no longer counts. Having just been dropped, it may not take the place
+	// of device2 either.
+	r.connected[device3] = true
+	minConnectionAge = time.Hour
+	c.since[device2] = time.Now().Add(-2 * time.Hour)
+	if c.allowed(device1) {
+		t.Error("Device dropped recently should not be allowed")
+	}
+	if len(r.dropped) != 1 {
+		t.Errorf("Unexpected drops %v", r.dropped)
+	}
+
+	// Once it hasn't been seen for a while it counts as completely out of
+	// sync, whatever its stale index says.
+	delete(r.connected, device1)
+	c.seen[device1] = time.Now().Add(-2 * time.Hour)
+	if !c.admit(device1) || len(r.dropped) != 2 || r.dropped[1] != device2 {
+		t.Errorf("Expected device2 to make room for device1, got %v", r.dropped)
+	}
+}
+
+func TestConnectionLimiterUnlimited(t *testing.T) {
+	device1, _ := protocol.DeviceIDFromString("AIR6LPZ-7K4PTTV-UXQSMUU-CPQ5YWH-OEDFIIQ-JUG777G-2YQXXR5-YD6AWQR")
+
+	r := &fakeRanker{connected: map[protocol.DeviceID]bool{device1: true}}
+	c := newConnectionLimiter(r, 0)
+	if !c.admit(device1) || len(r.dropped) != 0 {
+		t.Error("Devices should always be admitted without a limit")
+	}
+}
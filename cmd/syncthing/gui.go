@@ -16,9 +16,12 @@
 package main
 
 import (
+	"bytes"
 	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"mime"
 	"net"
@@ -31,15 +34,16 @@ import (
 	"sync"
 	"time"
 
-	"github.com/calmh/logger"
 	"github.com/syncthing/syncthing/internal/auto"
 	"github.com/syncthing/syncthing/internal/config"
 	"github.com/syncthing/syncthing/internal/discover"
 	"github.com/syncthing/syncthing/internal/events"
 	"github.com/syncthing/syncthing/internal/files"
+	"github.com/syncthing/syncthing/internal/logger"
 	"github.com/syncthing/syncthing/internal/model"
 	"github.com/syncthing/syncthing/internal/osutil"
 	"github.com/syncthing/syncthing/internal/protocol"
+	"github.com/syncthing/syncthing/internal/scanner"
 	"github.com/syncthing/syncthing/internal/upgrade"
 	"github.com/vitrun/qart/qr"
 	"golang.org/x/crypto/bcrypt"
@@ -56,8 +60,12 @@ var (
 	guiErrorsMut sync.Mutex
 	modt         = time.Now().UTC().Format(http.TimeFormat)
 	eventSub     *events.BufferedSubscription
+	// The path of the Unix socket the GUI listens on, if any
+	guiSocketPath string
 )
 
+const unixSocketPrefix = "unix://"
+
 func init() {
 	l.AddHandler(logger.LevelWarn, showGuiError)
 	sub := events.Default.Subscribe(events.AllEvents)
@@ -104,9 +112,21 @@ func startGUI(cfg config.GUIConfiguration, assetDir string, m *model.Model) erro
 		},
 	}
 
-	rawListener, err := net.Listen("tcp", cfg.Address)
-	if err != nil {
-		return err
+	var rawListener net.Listener
+	if path, ok := guiUnixSocketPath(cfg.Address); ok {
+		// Access to the socket is controlled by file permissions, so the
+		// allowed networks don't apply.
+		rawListener, err = listenUnixSocket(path, cfg.UnixSocketMode)
+		if err != nil {
+			return err
+		}
+		guiSocketPath = path
+	} else {
+		rawListener, err = net.Listen("tcp", cfg.Address)
+		if err != nil {
+			return err
+		}
+		rawListener = &FilteringListener{rawListener, parseNetworks(cfg.AllowedNetworks)}
 	}
 	listener := &DowngradingListener{rawListener, tlsCfg}
 
@@ -116,18 +136,37 @@ func startGUI(cfg config.GUIConfiguration, assetDir string, m *model.Model) erro
 	getRestMux.HandleFunc("/rest/completion", withModel(m, restGetCompletion))
 	getRestMux.HandleFunc("/rest/config", restGetConfig)
 	getRestMux.HandleFunc("/rest/config/sync", restGetConfigInSync)
+	getRestMux.HandleFunc("/rest/config/export", restGetConfigExport)
 	getRestMux.HandleFunc("/rest/connections", withModel(m, restGetConnections))
 	getRestMux.HandleFunc("/rest/autocomplete/directory", restGetAutocompleteDirectory)
 	getRestMux.HandleFunc("/rest/discovery", restGetDiscovery)
 	getRestMux.HandleFunc("/rest/errors", restGetErrors)
+	getRestMux.HandleFunc("/rest/folder/errors", withModel(m, restGetFolderErrors))
 	getRestMux.HandleFunc("/rest/events", restGetEvents)
+	getRestMux.HandleFunc("/rest/events/disk", withModel(m, restGetDiskEvents))
 	getRestMux.HandleFunc("/rest/ignores", withModel(m, restGetIgnores))
+	getRestMux.HandleFunc("/rest/pins", withModel(m, restGetPins))
+	getRestMux.HandleFunc("/rest/folder/file", withModel(m, restGetFolderFile))
+	getRestMux.HandleFunc("/rest/folder/deletions", withModel(m, restGetFolderDeletions))
+	getRestMux.HandleFunc("/rest/folder/health", withModel(m, restGetFolderHealth))
+	getRestMux.HandleFunc("/rest/folder/divergence", withModel(m, restGetFolderDivergence))
 	getRestMux.HandleFunc("/rest/lang", restGetLang)
 	getRestMux.HandleFunc("/rest/model", withModel(m, restGetModel))
 	getRestMux.HandleFunc("/rest/need", withModel(m, restGetNeed))
+	getRestMux.HandleFunc("/rest/db/need", withModel(m, restGetNeed))
+	getRestMux.HandleFunc("/rest/db/transfers", withModel(m, restGetTransfers))
+	getRestMux.HandleFunc("/rest/db/versions", withModel(m, restGetFileVersions))
+	getRestMux.HandleFunc("/rest/db/why", withModel(m, restGetWhyNeeded))
+	getRestMux.HandleFunc("/rest/db/index-export", withModel(m, restGetIndexExport))
+	getRestMux.HandleFunc("/rest/cluster/pending", withModel(m, restGetPending))
+	getRestMux.HandleFunc("/rest/cluster/device/", withModel(m, restGetClusterDevice))
 	getRestMux.HandleFunc("/rest/deviceid", restGetDeviceID)
+	getRestMux.HandleFunc("/rest/device/addresses", restGetDeviceAddresses)
 	getRestMux.HandleFunc("/rest/report", withModel(m, restGetReport))
 	getRestMux.HandleFunc("/rest/system", restGetSystem)
+	getRestMux.HandleFunc("/rest/system/externaladdress", restGetExternalAddress)
+	getRestMux.HandleFunc("/rest/system/hashperf", restGetHashPerf)
+	getRestMux.HandleFunc("/rest/system/pause", withModel(m, restGetPause))
 	getRestMux.HandleFunc("/rest/upgrade", restGetUpgrade)
 	getRestMux.HandleFunc("/rest/version", restGetVersion)
 	getRestMux.HandleFunc("/rest/stats/device", withModel(m, restGetDeviceStats))
@@ -140,22 +179,45 @@ func startGUI(cfg config.GUIConfiguration, assetDir string, m *model.Model) erro
 	postRestMux := http.NewServeMux()
 	postRestMux.HandleFunc("/rest/ping", restPing)
 	postRestMux.HandleFunc("/rest/config", withModel(m, restPostConfig))
+	postRestMux.HandleFunc("/rest/config/import", withModel(m, restPostConfigImport))
 	postRestMux.HandleFunc("/rest/discovery/hint", restPostDiscoveryHint)
+	postRestMux.HandleFunc("/rest/device/addresses", restPostDeviceAddresses)
 	postRestMux.HandleFunc("/rest/error", restPostError)
 	postRestMux.HandleFunc("/rest/error/clear", restClearErrors)
+	postRestMux.HandleFunc("/rest/events/disk/clear", withModel(m, restPostDiskEventsClear))
+	postRestMux.HandleFunc("/rest/folder/retry", withModel(m, restPostFolderRetry))
+	postRestMux.HandleFunc("/rest/folder/deletions/cancel", withModel(m, restPostFolderDeletionsCancel))
 	postRestMux.HandleFunc("/rest/ignores", withModel(m, restPostIgnores))
+	postRestMux.HandleFunc("/rest/pins", withModel(m, restPostPins))
 	postRestMux.HandleFunc("/rest/model/override", withModel(m, restPostOverride))
+	postRestMux.HandleFunc("/rest/cluster/pending/accept", withModel(m, restPostPendingAccept))
+	postRestMux.HandleFunc("/rest/cluster/pending/dismiss", withModel(m, restPostPendingDismiss))
 	postRestMux.HandleFunc("/rest/reset", restPostReset)
 	postRestMux.HandleFunc("/rest/restart", restPostRestart)
 	postRestMux.HandleFunc("/rest/shutdown", restPostShutdown)
+	postRestMux.HandleFunc("/rest/system/pause", withModel(m, restPostPause))
+	postRestMux.HandleFunc("/rest/system/ping-device", restPostPingDevice)
+	postRestMux.HandleFunc("/rest/system/resume", withModel(m, restPostResume))
 	postRestMux.HandleFunc("/rest/upgrade", restPostUpgrade)
 	postRestMux.HandleFunc("/rest/scan", withModel(m, restPostScan))
 	postRestMux.HandleFunc("/rest/bump", withModel(m, restPostBump))
+	postRestMux.HandleFunc("/rest/db/materialize", withModel(m, restPostMaterialize))
+	postRestMux.HandleFunc("/rest/db/drop", withModel(m, restPostDropIndex))
+	postRestMux.HandleFunc("/rest/db/flush", withModel(m, restPostFlushIndex))
+	postRestMux.HandleFunc("/rest/db/freeze", withModel(m, restPostFreeze))
+	postRestMux.HandleFunc("/rest/db/unfreeze", withModel(m, restPostUnfreeze))
+	postRestMux.HandleFunc("/rest/db/index-import", withModel(m, restPostIndexImport))
+	postRestMux.HandleFunc("/rest/db/prio-folder", withModel(m, restPostPrioFolder))
 
 	// A handler that splits requests between the two above and disables
 	// caching
 	restMux := noCacheMiddleware(getPostHandler(getRestMux, postRestMux))
 
+	// For an observe only instance, refuse everything that changes state
+	if readOnlyAPI {
+		restMux = readOnlyMiddleware(restMux)
+	}
+
 	// The main routing handler
 	mux := http.NewServeMux()
 	mux.Handle("/rest/", restMux)
@@ -172,10 +234,22 @@ func startGUI(cfg config.GUIConfiguration, assetDir string, m *model.Model) erro
 	handler = withVersionMiddleware(handler)
 
 	// Wrap everything in basic auth, if user/password is set.
-	if len(cfg.User) > 0 && len(cfg.Password) > 0 {
-		handler = basicAuthAndSessionMiddleware(cfg, handler)
+	setGUIAuth(cfg)
+	handler = basicAuthAndSessionMiddleware(cfg.APIKey, handler)
+
+	// Allow cross origin requests from the configured origins. This must
+	// come before authentication as preflight requests carry no credentials.
+	if len(cfg.AllowedOrigins) > 0 {
+		handler = corsMiddleware(cfg.AllowedOrigins, cfg.APIKey, handler)
 	}
 
+	// Health checks bypass authentication, and so must not expose anything
+	// sensitive.
+	noAuthMux := http.NewServeMux()
+	noAuthMux.HandleFunc("/rest/noauth/health", restGetHealth)
+	noAuthMux.HandleFunc("/rest/noauth/ready", restGetReady)
+	handler = noAuthMiddleware("/rest/noauth/", noCacheMiddleware(withVersionMiddleware(noAuthMux)), handler)
+
 	// Redirect to HTTPS if we are supposed to
 	if cfg.UseTLS {
 		handler = redirectToHTTPSMiddleware(handler)
@@ -195,6 +269,49 @@ func startGUI(cfg config.GUIConfiguration, assetDir string, m *model.Model) erro
 	return nil
 }
 
+// guiUnixSocketPath returns the socket path and true if the GUI address is
+// on the form unix:///path/to/socket.
+func guiUnixSocketPath(addr string) (string, bool) {
+	if !strings.HasPrefix(addr, unixSocketPrefix) {
+		return "", false
+	}
+	return addr[len(unixSocketPrefix):], true
+}
+
+// listenUnixSocket listens on the Unix socket at path, replacing any stale
+// socket left behind by an earlier instance, and sets the given file mode
+// (octal string) on it.
+func listenUnixSocket(path, mode string) (net.Listener, error) {
+	perm, err := strconv.ParseUint(mode, 8, 32)
+	if err != nil {
+		return nil, fmt.Errorf("unix socket mode %q: %v", mode, err)
+	}
+
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+
+	err = os.Chmod(path, os.FileMode(perm))
+	if err != nil {
+		listener.Close()
+		return nil, err
+	}
+
+	return listener, nil
+}
+
+// removeGUISocket removes the GUI Unix socket, if there is one.
+func removeGUISocket() {
+	if guiSocketPath != "" {
+		os.Remove(guiSocketPath)
+	}
+}
+
 func getPostHandler(get, post http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		switch r.Method {
@@ -208,6 +325,24 @@ func getPostHandler(get, post http.Handler) http.Handler {
 	})
 }
 
+// readOnlyPosts are the POST calls that don't change any state, and are
+// allowed by the read only API.
+var readOnlyPosts = map[string]bool{
+	"/rest/ping": true,
+}
+
+// readOnlyMiddleware refuses all requests that may change state, that is
+// all but GET requests and the POST requests in readOnlyPosts.
+func readOnlyMiddleware(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" || r.Method == "POST" && readOnlyPosts[r.URL.Path] {
+			h.ServeHTTP(w, r)
+			return
+		}
+		http.Error(w, "Read only API", http.StatusForbidden)
+	})
+}
+
 func redirectToHTTPSMiddleware(h http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// Add a generous access-control-allow-origin header since we may be
@@ -225,6 +360,58 @@ func redirectToHTTPSMiddleware(h http.Handler) http.Handler {
 	})
 }
 
+// corsMiddleware answers CORS preflight requests and sets the
+// Access-Control-Allow-Origin header for requests from the allowed origins.
+// Cross origin requests other than preflights must carry the API key.
+func corsMiddleware(allowed []string, apiKey string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin == "" || !originAllowed(origin, allowed) {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		w.Header().Add("Vary", "Origin")
+
+		if r.Method == "OPTIONS" && r.Header.Get("Access-Control-Request-Method") != "" {
+			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
+			w.Header().Set("Access-Control-Allow-Headers", "Content-Type, X-API-Key")
+			w.Header().Set("Access-Control-Max-Age", "600")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		if apiKey == "" || r.Header.Get("X-API-Key") != apiKey {
+			http.Error(w, "Not Authorized", http.StatusForbidden)
+			return
+		}
+
+		h.ServeHTTP(w, r)
+	})
+}
+
+func originAllowed(origin string, allowed []string) bool {
+	for _, a := range allowed {
+		if a == "*" || strings.EqualFold(a, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// noAuthMiddleware sends requests under the prefix to noAuth, and all others
+// to h.
+func noAuthMiddleware(prefix string, noAuth, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, prefix) {
+			noAuth.ServeHTTP(w, r)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
 func noCacheMiddleware(h http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Cache-Control", "no-cache")
@@ -287,6 +474,13 @@ func restGetModel(m *model.Model, w http.ResponseWriter, r *http.Request) {
 	var res = make(map[string]interface{})
 
 	res["invalid"] = cfg.Folders()[folder].Invalid
+	res["paused"] = cfg.Folders()[folder].Paused
+	if until := cfg.Folders()[folder].PausedUntil; until != nil {
+		res["pausedUntil"] = until
+	}
+	if caps, ok := m.FolderCapabilities(folder); ok {
+		res["capabilities"] = caps
+	}
 
 	globalFiles, globalDeleted, globalBytes := m.GlobalSize(folder)
 	res["globalFiles"], res["globalDeleted"], res["globalBytes"] = globalFiles, globalDeleted, globalBytes
@@ -298,30 +492,122 @@ func restGetModel(m *model.Model, w http.ResponseWriter, r *http.Request) {
 	res["needFiles"], res["needBytes"] = needFiles, needBytes
 
 	res["inSyncFiles"], res["inSyncBytes"] = globalFiles-needFiles, globalBytes-needBytes
+	if eta, ok := m.ETA(folder); ok {
+		res["etaS"] = int(eta.Seconds())
+	}
 
 	res["state"], res["stateChanged"] = m.State(folder)
+	if next := m.NextScan(folder); !next.IsZero() {
+		res["nextScan"] = next
+	}
 	res["version"] = m.CurrentLocalVersion(folder) + m.RemoteLocalVersion(folder)
+	if stats := m.ScanStats(folder); stats.Scans > 0 {
+		res["lastScan"] = stats
+	}
+	if locked, err := m.LockedFiles(folder); err == nil && len(locked) > 0 {
+		res["lockedFiles"] = locked
+	}
+	if unreadable, err := m.UnreadableFiles(folder); err == nil && len(unreadable) > 0 {
+		res["unreadableFiles"] = unreadable
+	}
 
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
 	json.NewEncoder(w).Encode(res)
 }
 
+// restGetFolderFile serves the contents of a file, as we have it locally.
+// Ranges are supported. As this gives access to the data itself, the API key
+// is always required.
+func restGetFolderFile(m *model.Model, w http.ResponseWriter, r *http.Request) {
+	if apiKey := cfg.GUI().APIKey; apiKey == "" || r.Header.Get("X-API-Key") != apiKey {
+		http.Error(w, "API key required", http.StatusForbidden)
+		return
+	}
+
+	qs := r.URL.Query()
+	name := qs.Get("file")
+	fd, file, err := m.OpenFile(qs.Get("folder"), name)
+	switch {
+	case err == model.ErrInvalidPath:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	case err == model.ErrNoSuchFile || err == model.ErrInvalid || os.IsNotExist(err):
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	defer fd.Close()
+
+	http.ServeContent(w, r, filepath.Base(file.Name), time.Unix(file.Modified, 0), fd)
+}
+
 func restPostOverride(m *model.Model, w http.ResponseWriter, r *http.Request) {
 	var qs = r.URL.Query()
 	var folder = qs.Get("folder")
 	go m.Override(folder)
 }
 
+func restGetTransfers(m *model.Model, w http.ResponseWriter, r *http.Request) {
+	qs := r.URL.Query()
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(m.Transfers(qs.Get("folder")))
+}
+
+func restGetFileVersions(m *model.Model, w http.ResponseWriter, r *http.Request) {
+	qs := r.URL.Query()
+	versions, err := m.FileVersions(qs.Get("folder"), qs.Get("file"))
+	if err != nil {
+		http.Error(w, err.Error(), 404)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(versions)
+}
+
+func restGetWhyNeeded(m *model.Model, w http.ResponseWriter, r *http.Request) {
+	qs := r.URL.Query()
+	reason, err := m.WhyNeeded(qs.Get("folder"), qs.Get("file"))
+	if err != nil {
+		http.Error(w, err.Error(), 404)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(reason)
+}
+
 func restGetNeed(m *model.Model, w http.ResponseWriter, r *http.Request) {
 	var qs = r.URL.Query()
 	var folder = qs.Get("folder")
 
-	progress, queued, rest := m.NeedFolderFiles(folder, 100)
-	// Convert the struct to a more loose structure, and inject the size.
-	output := map[string][]map[string]interface{}{
-		"progress": toNeedSlice(progress),
-		"queued":   toNeedSlice(queued),
-		"rest":     toNeedSlice(rest),
+	page, err := strconv.Atoi(qs.Get("page"))
+	if err != nil || page < 1 {
+		page = 1
+	}
+	perpage, err := strconv.Atoi(qs.Get("perpage"))
+	if err != nil || perpage < 1 {
+		perpage = 100
+	}
+
+	progress, queued, rest, total := m.NeedFolderFiles(folder, page, perpage)
+	mimeType := mimeTyper(m, folder, qs.Get("mime") == "content")
+
+	// Convert the struct to a more loose structure, and inject the size and
+	// the progress of the files being pulled.
+	progressSlice := toNeedSlice(progress, mimeType)
+	for i, file := range progress {
+		if done, ok := m.FileProgress(folder, file.Name); ok {
+			progressSlice[i]["BytesDone"] = done
+		}
+	}
+	output := map[string]interface{}{
+		"progress": progressSlice,
+		"queued":   toNeedSlice(queued, mimeType),
+		"rest":     toNeedSlice(rest, mimeType),
+		"total":    total,
+		"page":     page,
+		"perpage":  perpage,
 	}
 
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
@@ -346,6 +632,25 @@ func restGetFolderStats(m *model.Model, w http.ResponseWriter, r *http.Request)
 	json.NewEncoder(w).Encode(res)
 }
 
+func restGetHealth(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+}
+
+// restGetReady returns 200 once startup is complete, i.e. the configuration
+// is loaded, the database is open and the folders are started, and 503
+// until then.
+func restGetReady(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	select {
+	case <-startupDone:
+		json.NewEncoder(w).Encode(map[string]string{"status": "ready"})
+	default:
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(map[string]string{"status": "starting"})
+	}
+}
+
 func restGetConfig(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
 	json.NewEncoder(w).Encode(cfg.Raw())
@@ -360,6 +665,11 @@ func restPostConfig(m *model.Model, w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if err := checkMaxFolders(newCfg); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
 	if newCfg.GUI.Password != cfg.GUI().Password {
 		if newCfg.GUI.Password != "" {
 			hash, err := bcrypt.GenerateFromPassword([]byte(newCfg.GUI.Password), 0)
@@ -373,8 +683,15 @@ func restPostConfig(m *model.Model, w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	// Start or stop usage reporting as appropriate
+	err = replaceConfig(m, newCfg)
+	if err != nil {
+		l.Warnln("saving config:", err)
+	}
+}
 
+// replaceConfig activates and saves a new configuration, starting or stopping
+// usage reporting as appropriate.
+func replaceConfig(m *model.Model, newCfg config.Configuration) error {
 	if curAcc := cfg.Options().URAccepted; newCfg.Options.URAccepted > curAcc {
 		// UR was enabled
 		newCfg.Options.URAccepted = usageReportVersion
@@ -395,7 +712,65 @@ func restPostConfig(m *model.Model, w http.ResponseWriter, r *http.Request) {
 
 	configInSync = !config.ChangeRequiresRestart(cfg.Raw(), newCfg)
 	cfg.Replace(newCfg)
-	cfg.Save()
+	return cfg.Save()
+}
+
+// restGetConfigExport returns the complete configuration. The API key and
+// GUI password hash are left out unless secrets=true is given.
+func restGetConfigExport(w http.ResponseWriter, r *http.Request) {
+	exported := cfg.Raw()
+	if r.URL.Query().Get("secrets") == "true" {
+		l.Infoln("Exporting configuration including API key and GUI password hash")
+	} else {
+		exported.GUI.APIKey = ""
+		exported.GUI.Password = ""
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(exported)
+}
+
+// restPostConfigImport replaces the configuration with a previously exported
+// one. The API key and GUI password are kept as they are if the imported
+// configuration doesn't contain them.
+func restPostConfigImport(m *model.Model, w http.ResponseWriter, r *http.Request) {
+	bs, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	// The secrets must be checked before parsing, as that generates a new
+	// API key if there is none.
+	var secrets struct {
+		GUI struct {
+			APIKey   string
+			Password string
+		}
+	}
+	json.Unmarshal(bs, &secrets)
+
+	newCfg, err := config.ReadJSON(bytes.NewReader(bs), myID)
+	if err != nil {
+		l.Infoln("Importing config:", err)
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	curGUI := cfg.GUI()
+	if secrets.GUI.APIKey == "" {
+		newCfg.GUI.APIKey = curGUI.APIKey
+	}
+	if secrets.GUI.Password == "" {
+		newCfg.GUI.Password = curGUI.Password
+	}
+
+	err = replaceConfig(m, newCfg)
+	if err != nil {
+		l.Warnln("saving config:", err)
+		http.Error(w, err.Error(), 500)
+		return
+	}
 }
 
 func restGetConfigInSync(w http.ResponseWriter, r *http.Request) {
@@ -439,7 +814,7 @@ func restGetSystem(w http.ResponseWriter, r *http.Request) {
 	res["alloc"] = m.Alloc
 	res["sys"] = m.Sys - m.HeapReleased
 	res["tilde"] = tilde
-	if cfg.Options().GlobalAnnEnabled && discoverer != nil {
+	if opts := cfg.Options(); opts.GlobalAnnEnabled && !opts.GlobalAnnLookupOnly && discoverer != nil {
 		res["extAnnounceOK"] = discoverer.ExtAnnounceOK()
 	}
 	cpuUsageLock.RLock()
@@ -455,6 +830,41 @@ func restGetSystem(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(res)
 }
 
+func restGetExternalAddress(w http.ResponseWriter, r *http.Request) {
+	var addrs []discover.AnnouncedAddress
+	if discoverer != nil {
+		addrs = discoverer.AnnouncedAddresses()
+	}
+
+	igdMut.Lock()
+	dev := igd
+	igdMut.Unlock()
+
+	for i := range addrs {
+		if addrs[i].Source != discover.SourceUPnP || dev == nil {
+			continue
+		}
+		// The gateway knows the IP the mapped port is reachable on.
+		ip, err := dev.GetExternalIPAddress()
+		if err != nil {
+			l.Infoln("UPnP external address:", err)
+			continue
+		}
+		if ip != nil {
+			_, port, _ := net.SplitHostPort(addrs[i].Address)
+			addrs[i].Address = net.JoinHostPort(ip.String(), port)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(map[string][]discover.AnnouncedAddress{"addresses": addrs})
+}
+
+func restGetHashPerf(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(scanner.MeasuredHash())
+}
+
 func restGetErrors(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
 	guiErrorsMut.Lock()
@@ -550,6 +960,43 @@ func restPostIgnores(m *model.Model, w http.ResponseWriter, r *http.Request) {
 	restGetIgnores(m, w, r)
 }
 
+func restGetPins(m *model.Model, w http.ResponseWriter, r *http.Request) {
+	qs := r.URL.Query()
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+
+	pins, patterns, err := m.GetPins(qs.Get("folder"))
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string][]string{
+		"pin":      pins,
+		"patterns": patterns,
+	})
+}
+
+func restPostPins(m *model.Model, w http.ResponseWriter, r *http.Request) {
+	qs := r.URL.Query()
+
+	var data map[string][]string
+	err := json.NewDecoder(r.Body).Decode(&data)
+	r.Body.Close()
+
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	err = m.SetPins(qs.Get("folder"), data["pin"])
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	restGetPins(m, w, r)
+}
+
 func restGetEvents(w http.ResponseWriter, r *http.Request) {
 	qs := r.URL.Query()
 	sinceStr := qs.Get("since")
@@ -607,6 +1054,84 @@ func restGetDeviceID(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// addressesDevice returns the device named by the request, which is our own
+// unless given.
+func addressesDevice(r *http.Request) (config.DeviceConfiguration, error) {
+	id := myID
+	if idStr := r.URL.Query().Get("device"); idStr != "" {
+		var err error
+		if id, err = protocol.DeviceIDFromString(idStr); err != nil {
+			return config.DeviceConfiguration{}, err
+		}
+	}
+	devCfg, ok := cfg.Devices()[id]
+	if !ok {
+		return config.DeviceConfiguration{}, errors.New("no such device")
+	}
+	return devCfg, nil
+}
+
+func restGetDeviceAddresses(w http.ResponseWriter, r *http.Request) {
+	devCfg, err := addressesDevice(r)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	writeDeviceAddresses(w, devCfg)
+}
+
+func restPostDeviceAddresses(w http.ResponseWriter, r *http.Request) {
+	devCfg, err := addressesDevice(r)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	var data struct {
+		Mode      string
+		Addresses []string
+	}
+	err = json.NewDecoder(r.Body).Decode(&data)
+	r.Body.Close()
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	if data.Mode == "" && len(data.Addresses) > 0 {
+		data.Mode = addressModeStatic
+	} else if data.Mode == "" {
+		data.Mode = addressModeDynamic
+	}
+
+	addrs, err := deviceAddresses(data.Mode, data.Addresses)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	devCfg.Addresses = addrs
+	cfg.SetDevice(devCfg)
+	if err := cfg.Save(); err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	// Other devices are dialed at the new addresses from now on; ours are
+	// announced at once.
+	if devCfg.DeviceID == myID && discoverer != nil {
+		discoverer.SetAnnounceAddresses(announceAddresses(addrs))
+	}
+	writeDeviceAddresses(w, devCfg)
+}
+
+func writeDeviceAddresses(w http.ResponseWriter, devCfg config.DeviceConfiguration) {
+	mode, static := addressMode(devCfg.Addresses)
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"mode":      mode,
+		"addresses": static,
+	})
+}
+
 func restGetLang(w http.ResponseWriter, r *http.Request) {
 	lang := r.Header.Get("Accept-Language")
 	var langs []string
@@ -658,6 +1183,358 @@ func restPostBump(m *model.Model, w http.ResponseWriter, r *http.Request) {
 	restGetNeed(m, w, r)
 }
 
+// restPostPrioFolder boosts the folder's share of the block requests by the
+// given weight, for the given duration or an hour. A weight of one clears
+// the boost.
+func restPostPrioFolder(m *model.Model, w http.ResponseWriter, r *http.Request) {
+	qs := r.URL.Query()
+
+	weight, err := strconv.Atoi(qs.Get("weight"))
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	dur := model.DefaultBoostDuration
+	if ds := qs.Get("duration"); ds != "" {
+		dur, err = time.ParseDuration(ds)
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+	}
+
+	err = m.BoostFolder(qs.Get("folder"), weight, time.Now().Add(dur))
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+	}
+}
+
+func restPostMaterialize(m *model.Model, w http.ResponseWriter, r *http.Request) {
+	qs := r.URL.Query()
+	folder := qs.Get("folder")
+	file := qs.Get("file")
+	err := m.Materialize(folder, file)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+	}
+}
+
+func restGetFolderErrors(m *model.Model, w http.ResponseWriter, r *http.Request) {
+	qs := r.URL.Query()
+	errs, err := m.FolderErrors(qs.Get("folder"))
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(map[string][]model.FileError{
+		"errors": errs,
+	})
+}
+
+func restPostFolderRetry(m *model.Model, w http.ResponseWriter, r *http.Request) {
+	qs := r.URL.Query()
+	err := m.RetryFolderErrors(qs.Get("folder"))
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+	}
+}
+
+func restGetFolderHealth(m *model.Model, w http.ResponseWriter, r *http.Request) {
+	qs := r.URL.Query()
+	health, err := m.FolderHealth(qs.Get("folder"), myID)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(health)
+}
+
+func restGetFolderDivergence(m *model.Model, w http.ResponseWriter, r *http.Request) {
+	qs := r.URL.Query()
+	diverged, err := m.FolderDivergence(qs.Get("folder"))
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"differing": len(diverged),
+		"files":     diverged,
+	})
+}
+
+func restGetFolderDeletions(m *model.Model, w http.ResponseWriter, r *http.Request) {
+	qs := r.URL.Query()
+	names, err := m.HeldDeletions(qs.Get("folder"))
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(names)
+}
+
+func restPostFolderDeletionsCancel(m *model.Model, w http.ResponseWriter, r *http.Request) {
+	qs := r.URL.Query()
+	err := m.CancelDeletions(qs.Get("folder"))
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+	}
+}
+
+func restPostDropIndex(m *model.Model, w http.ResponseWriter, r *http.Request) {
+	qs := r.URL.Query()
+	device, err := protocol.DeviceIDFromString(qs.Get("device"))
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	err = m.DropDeviceIndex(device, qs.Get("folder"))
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+	}
+}
+
+func restPostFlushIndex(m *model.Model, w http.ResponseWriter, r *http.Request) {
+	if err := m.FlushIndex(); err != nil {
+		http.Error(w, err.Error(), 500)
+	}
+}
+
+func restPostFreeze(m *model.Model, w http.ResponseWriter, r *http.Request) {
+	qs := r.URL.Query()
+	if err := m.FreezeFolder(qs.Get("folder")); err != nil {
+		http.Error(w, err.Error(), 500)
+	}
+}
+
+func restPostUnfreeze(m *model.Model, w http.ResponseWriter, r *http.Request) {
+	qs := r.URL.Query()
+	if err := m.UnfreezeFolder(qs.Get("folder")); err != nil {
+		http.Error(w, err.Error(), 500)
+	}
+}
+
+func restGetIndexExport(m *model.Model, w http.ResponseWriter, r *http.Request) {
+	folder := r.URL.Query().Get("folder")
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", folder+".stindex.gz"))
+	if err := m.ExportIndex(folder, w); err != nil {
+		http.Error(w, err.Error(), 500)
+	}
+}
+
+func restPostIndexImport(m *model.Model, w http.ResponseWriter, r *http.Request) {
+	n, err := m.ImportIndex(r.URL.Query().Get("folder"), r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(map[string]int{
+		"files": n,
+	})
+}
+
+func restGetPause(m *model.Model, w http.ResponseWriter, r *http.Request) {
+	devices, folders := m.Paused()
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"devices": devices,
+		"folders": folders,
+	})
+}
+
+func restPostPause(m *model.Model, w http.ResponseWriter, r *http.Request) {
+	qs := r.URL.Query()
+
+	// The pause lasts for the given duration, until the given time, or until
+	// resumed if neither is given.
+	var until time.Time
+	if dur := qs.Get("duration"); dur != "" {
+		d, err := time.ParseDuration(dur)
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		until = time.Now().Add(d)
+	} else if ts := qs.Get("until"); ts != "" {
+		t, err := time.Parse(time.RFC3339, ts)
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		until = t
+	}
+
+	var err error
+	if dev := qs.Get("device"); dev != "" {
+		var device protocol.DeviceID
+		device, err = protocol.DeviceIDFromString(dev)
+		if err == nil {
+			err = m.PauseDevice(device, until)
+		}
+	} else {
+		err = m.PauseFolder(qs.Get("folder"), until)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+	}
+}
+
+func restPostResume(m *model.Model, w http.ResponseWriter, r *http.Request) {
+	qs := r.URL.Query()
+
+	var err error
+	if dev := qs.Get("device"); dev != "" {
+		var device protocol.DeviceID
+		device, err = protocol.DeviceIDFromString(dev)
+		if err == nil {
+			err = m.ResumeDevice(device)
+		}
+	} else {
+		err = m.ResumeFolder(qs.Get("folder"))
+	}
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+	}
+}
+
+func restPostPingDevice(w http.ResponseWriter, r *http.Request) {
+	qs := r.URL.Query()
+	var device protocol.DeviceID
+	if id := qs.Get("device"); id != "" {
+		var err error
+		device, err = protocol.DeviceIDFromString(id)
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+	}
+	addr := qs.Get("addr")
+	if device == (protocol.DeviceID{}) && addr == "" {
+		http.Error(w, "a device or an address is required", 500)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(map[string][]probeResult{
+		"results": probeDevice(device, addr),
+	})
+}
+
+// restGetClusterDevice serves /rest/cluster/device/<id>/folders, the folders
+// the device shares with us and whether we've accepted them.
+func restGetClusterDevice(m *model.Model, w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/rest/cluster/device/"), "/")
+	if len(parts) != 2 || parts[1] != "folders" {
+		http.NotFound(w, r)
+		return
+	}
+	device, err := protocol.DeviceIDFromString(parts[0])
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	folders := m.DeviceFolders(device)
+	var notAccepted int
+	for _, f := range folders {
+		if !f.Accepted {
+			notAccepted++
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"folders":     folders,
+		"notAccepted": notAccepted,
+	})
+}
+
+func restGetPending(m *model.Model, w http.ResponseWriter, r *http.Request) {
+	res := map[string]interface{}{
+		"devices": m.PendingDevices(),
+		"folders": m.PendingFolders(),
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(res)
+}
+
+// restPostPendingAccept adds the pending device to the configuration, or
+// shares the pending folder with the device offering it. A folder that
+// doesn't exist yet is added at the given path.
+func restPostPendingAccept(m *model.Model, w http.ResponseWriter, r *http.Request) {
+	qs := r.URL.Query()
+	device, err := protocol.DeviceIDFromString(qs.Get("device"))
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	newCfg := cfg.Raw()
+	folder := qs.Get("folder")
+	if folder == "" {
+		acceptPendingDevice(&newCfg, device)
+	} else {
+		err = acceptPendingFolder(&newCfg, folder, device, qs.Get("path"))
+	}
+	if err == nil {
+		err = replaceConfig(m, newCfg)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	if folder == "" {
+		m.DismissPendingDevice(device)
+	} else {
+		m.DismissPendingFolder(folder, device)
+	}
+}
+
+func restPostPendingDismiss(m *model.Model, w http.ResponseWriter, r *http.Request) {
+	qs := r.URL.Query()
+	device, err := protocol.DeviceIDFromString(qs.Get("device"))
+	if err == nil {
+		if folder := qs.Get("folder"); folder != "" {
+			err = m.DismissPendingFolder(folder, device)
+		} else {
+			err = m.DismissPendingDevice(device)
+		}
+	}
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+	}
+}
+
+// restGetDiskEvents returns the latest changes to files on disk, optionally
+// limited in number and to a folder.
+func restGetDiskEvents(m *model.Model, w http.ResponseWriter, r *http.Request) {
+	qs := r.URL.Query()
+	limit, _ := strconv.Atoi(qs.Get("limit"))
+
+	changes := m.DiskChanges(qs.Get("folder"), limit)
+	for i := range changes {
+		if changes[i].Modifier == protocol.LocalDeviceID {
+			changes[i].Modifier = myID
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(changes)
+}
+
+func restPostDiskEventsClear(m *model.Model, w http.ResponseWriter, r *http.Request) {
+	if err := m.ClearDiskChanges(r.URL.Query().Get("folder")); err != nil {
+		http.Error(w, err.Error(), 500)
+	}
+}
+
 func getQR(w http.ResponseWriter, r *http.Request) {
 	var qs = r.URL.Query()
 	var text = qs.Get("text")
@@ -784,7 +1661,7 @@ func mimeTypeForFile(file string) string {
 	}
 }
 
-func toNeedSlice(fs []files.FileInfoTruncated) []map[string]interface{} {
+func toNeedSlice(fs []files.FileInfoTruncated, mimeType func(files.FileInfoTruncated) string) []map[string]interface{} {
 	output := make([]map[string]interface{}, len(fs))
 	for i, file := range fs {
 		output[i] = map[string]interface{}{
@@ -795,7 +1672,29 @@ func toNeedSlice(fs []files.FileInfoTruncated) []map[string]interface{} {
 			"LocalVersion": file.LocalVersion,
 			"NumBlocks":    file.NumBlocks,
 			"Size":         files.BlocksToSize(file.NumBlocks),
+			"Mime":         mimeType(file),
 		}
 	}
 	return output
 }
+
+// mimeTyper returns a function guessing the MIME type of files in the
+// folder from their extension. With content set, it's detected from the
+// contents of the local copy instead, where there is one. Files that aren't
+// regular files have no type.
+func mimeTyper(m *model.Model, folder string, content bool) func(files.FileInfoTruncated) string {
+	return func(file files.FileInfoTruncated) string {
+		if file.IsDeleted() || file.IsDirectory() || file.IsSymlink() {
+			return ""
+		}
+		if content {
+			if fd, _, err := m.OpenFile(folder, file.Name); err == nil {
+				buf := make([]byte, 512)
+				n, _ := io.ReadFull(fd, buf)
+				fd.Close()
+				return http.DetectContentType(buf[:n])
+			}
+		}
+		return mime.TypeByExtension(filepath.Ext(file.Name))
+	}
+}
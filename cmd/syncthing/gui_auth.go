@@ -31,11 +31,52 @@ import (
 var (
 	sessions    = make(map[string]bool)
 	sessionsMut sync.Mutex
+
+	// The GUI user and password hash in effect. They are looked up for each
+	// request, so that changing them doesn't require a restart.
+	guiUser     string
+	guiPassword string
+	guiAuthMut  sync.RWMutex
 )
 
-func basicAuthAndSessionMiddleware(cfg config.GUIConfiguration, next http.Handler) http.Handler {
+func setGUIAuth(cfg config.GUIConfiguration) {
+	guiAuthMut.Lock()
+	guiUser, guiPassword = cfg.User, cfg.Password
+	guiAuthMut.Unlock()
+}
+
+// guiAuthHandler keeps the GUI user and password up to date with the
+// configuration, unless they are overridden on the command line.
+type guiAuthHandler struct{}
+
+func (guiAuthHandler) Changed(cfg config.Configuration) error {
+	if guiAuthentication == "" {
+		setGUIAuth(cfg.GUI)
+	}
+	return nil
+}
+
+func (h guiAuthHandler) ConfigChanged(cfg config.Configuration, changes config.Changes) error {
+	if !changes.GUIAuth {
+		return nil
+	}
+	return h.Changed(cfg)
+}
+
+// basicAuthAndSessionMiddleware requires basic authentication or a session
+// cookie, as long as a user and password are set.
+func basicAuthAndSessionMiddleware(apiKey string, next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if cfg.APIKey != "" && r.Header.Get("X-API-Key") == cfg.APIKey {
+		guiAuthMut.RLock()
+		user, password := guiUser, guiPassword
+		guiAuthMut.RUnlock()
+
+		if len(user) == 0 || len(password) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if apiKey != "" && r.Header.Get("X-API-Key") == apiKey {
 			next.ServeHTTP(w, r)
 			return
 		}
@@ -76,12 +117,12 @@ func basicAuthAndSessionMiddleware(cfg config.GUIConfiguration, next http.Handle
 			return
 		}
 
-		if string(fields[0]) != cfg.User {
+		if string(fields[0]) != user {
 			error()
 			return
 		}
 
-		if err := bcrypt.CompareHashAndPassword([]byte(cfg.Password), fields[1]); err != nil {
+		if err := bcrypt.CompareHashAndPassword([]byte(password), fields[1]); err != nil {
 			error()
 			return
 		}
@@ -25,7 +25,7 @@ import (
 	"sync"
 	"time"
 
-	"github.com/syncthing/syncthing/internal/osutil"
+	"github.com/syncthing/syncthing/internal/fs"
 )
 
 var csrfTokens []string
@@ -122,7 +122,7 @@ func saveCsrfTokens() {
 		return
 	}
 
-	osutil.Rename(tmp, name)
+	fs.Rename(fs.DefaultFilesystem, tmp, name)
 }
 
 func loadCsrfTokens() {
@@ -0,0 +1,288 @@
+// Copyright (C) 2014 The Syncthing Authors.
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for
+// more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/syncthing/syncthing/internal/config"
+	"github.com/syncthing/syncthing/internal/files"
+	"github.com/syncthing/syncthing/internal/model"
+	"github.com/syncthing/syncthing/internal/protocol"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestGUIUnixSocketPath(t *testing.T) {
+	if path, ok := guiUnixSocketPath("unix:///var/run/syncthing.sock"); !ok || path != "/var/run/syncthing.sock" {
+		t.Errorf("Incorrect socket path %q (%v)", path, ok)
+	}
+	if _, ok := guiUnixSocketPath("127.0.0.1:8080"); ok {
+		t.Error("TCP address mistaken for a socket")
+	}
+}
+
+func TestListenUnixSocket(t *testing.T) {
+	path := filepath.Join(os.TempDir(), "syncthing-gui-test.sock")
+	os.Remove(path)
+	defer os.Remove(path)
+
+	// Leave a stale socket behind, as after a crash
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Skip("Unix sockets unavailable:", err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	listener, err := listenUnixSocket(path, "0600")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := fi.Mode().Perm(); perm != 0600 {
+		t.Errorf("Incorrect socket mode %o, expected 0600", perm)
+	}
+
+	if _, err := listenUnixSocket(path+"2", "bogus"); err == nil {
+		t.Error("Unexpected nil error for invalid mode")
+	}
+}
+
+func TestPostConfigMaxFolders(t *testing.T) {
+	newCfg := config.Configuration{
+		Folders: []config.FolderConfiguration{{ID: "a"}, {ID: "b"}, {ID: "c", Paused: true}},
+		Options: config.OptionsConfiguration{MaxFolders: 2},
+	}
+	bs, _ := json.Marshal(newCfg)
+	req, _ := http.NewRequest("POST", "/rest/config", bytes.NewReader(bs))
+	rec := httptest.NewRecorder()
+	restPostConfig(nil, rec, req)
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("Config with too many folders, counting the paused one, got status %d", rec.Code)
+	}
+	if !strings.Contains(rec.Body.String(), "maximum of 2") {
+		t.Errorf("Unclear error %q", rec.Body.String())
+	}
+}
+
+func TestCORSMiddleware(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	h := corsMiddleware([]string{"http://dashboard:3000"}, "abc123", ok)
+
+	// Preflight from an allowed origin
+	req, _ := http.NewRequest("OPTIONS", "/rest/system", nil)
+	req.Header.Set("Origin", "http://dashboard:3000")
+	req.Header.Set("Access-Control-Request-Method", "GET")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusNoContent {
+		t.Errorf("Preflight got status %d", rec.Code)
+	}
+	if o := rec.Header().Get("Access-Control-Allow-Origin"); o != "http://dashboard:3000" {
+		t.Errorf("Incorrect allowed origin %q", o)
+	}
+
+	// Cross origin request without the API key
+	req, _ = http.NewRequest("GET", "/rest/system", nil)
+	req.Header.Set("Origin", "http://dashboard:3000")
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("Request without API key got status %d", rec.Code)
+	}
+
+	// ... and with it
+	req.Header.Set("X-API-Key", "abc123")
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Errorf("Request with API key got status %d", rec.Code)
+	}
+
+	// Origins not in the list get no CORS headers
+	req, _ = http.NewRequest("GET", "/rest/system", nil)
+	req.Header.Set("Origin", "http://evil:3000")
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if o := rec.Header().Get("Access-Control-Allow-Origin"); o != "" {
+		t.Errorf("Unexpected allowed origin %q", o)
+	}
+}
+
+func TestReadiness(t *testing.T) {
+	get := func(handler http.HandlerFunc) int {
+		req, _ := http.NewRequest("GET", "/", nil)
+		rec := httptest.NewRecorder()
+		handler(rec, req)
+		return rec.Code
+	}
+
+	if code := get(restGetHealth); code != http.StatusOK {
+		t.Errorf("Health check got status %d", code)
+	}
+
+	startupDone = make(chan struct{})
+	if code := get(restGetReady); code != http.StatusServiceUnavailable {
+		t.Errorf("Readiness check before startup got status %d", code)
+	}
+	close(startupDone)
+	if code := get(restGetReady); code != http.StatusOK {
+		t.Errorf("Readiness check after startup got status %d", code)
+	}
+}
+
+func TestNoAuthMiddleware(t *testing.T) {
+	noAuth := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	auth := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "Not Authorized", http.StatusUnauthorized)
+	})
+	h := noAuthMiddleware("/rest/noauth/", noAuth, auth)
+
+	for path, code := range map[string]int{
+		"/rest/noauth/health": http.StatusOK,
+		"/rest/system":        http.StatusUnauthorized,
+		"/rest/noauthx":       http.StatusUnauthorized,
+	} {
+		req, _ := http.NewRequest("GET", path, nil)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != code {
+			t.Errorf("%s got status %d, expected %d", path, rec.Code, code)
+		}
+	}
+}
+
+func TestReadOnlyMiddleware(t *testing.T) {
+	h := readOnlyMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	for _, tc := range []struct {
+		method, path string
+		code         int
+	}{
+		{"GET", "/rest/system", http.StatusOK},
+		{"GET", "/rest/events", http.StatusOK},
+		{"POST", "/rest/ping", http.StatusOK},
+		{"POST", "/rest/config", http.StatusForbidden},
+		{"POST", "/rest/scan", http.StatusForbidden},
+		{"POST", "/rest/restart", http.StatusForbidden},
+		{"POST", "/rest/model/override", http.StatusForbidden},
+		{"DELETE", "/rest/system", http.StatusForbidden},
+	} {
+		req, _ := http.NewRequest(tc.method, tc.path, nil)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != tc.code {
+			t.Errorf("%s %s got status %d, expected %d", tc.method, tc.path, rec.Code, tc.code)
+		}
+	}
+}
+
+func TestBasicAuthFollowsConfig(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	h := basicAuthAndSessionMiddleware("", ok)
+	defer setGUIAuth(config.GUIConfiguration{})
+
+	get := func(user, password string) int {
+		req, _ := http.NewRequest("GET", "/", nil)
+		if user != "" {
+			req.SetBasicAuth(user, password)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	if code := get("", ""); code != http.StatusOK {
+		t.Errorf("Request without authentication configured got status %d", code)
+	}
+
+	hash, _ := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	guiAuthHandler{}.ConfigChanged(config.Configuration{GUI: config.GUIConfiguration{User: "user", Password: string(hash)}}, config.Changes{GUIAuth: true})
+	if code := get("", ""); code != http.StatusUnauthorized {
+		t.Errorf("Request without credentials got status %d", code)
+	}
+	if code := get("user", "wrong"); code != http.StatusUnauthorized {
+		t.Errorf("Request with the wrong password got status %d", code)
+	}
+	if code := get("user", "secret"); code != http.StatusOK {
+		t.Errorf("Request with the new credentials got status %d", code)
+	}
+}
+
+func TestMimeTyper(t *testing.T) {
+	dir, err := ioutil.TempDir("", "syncthing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// A PNG image with the wrong extension.
+	png := []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR")
+	if err := ioutil.WriteFile(filepath.Join(dir, "photo.jpg"), png, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	fcfg := config.FolderConfiguration{ID: "default", Path: dir}
+	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	m := model.NewModel(config.Wrap("/tmp/test", config.Configuration{Folders: []config.FolderConfiguration{fcfg}}), "device", "syncthing", "dev", db)
+	m.AddFolder(fcfg)
+	m.ScanFolder("default")
+
+	local := files.FileInfoTruncated{Name: "photo.jpg"}
+	remote := files.FileInfoTruncated{Name: "remote.jpg"}
+	dirEntry := files.FileInfoTruncated{Name: "photos.jpg", Flags: protocol.FlagDirectory}
+
+	byExt := mimeTyper(m, "default", false)
+	byContent := mimeTyper(m, "default", true)
+	for _, tc := range []struct {
+		mimeType func(files.FileInfoTruncated) string
+		file     files.FileInfoTruncated
+		expected string
+	}{
+		{byExt, local, "image/jpeg"},
+		{byContent, local, "image/png"},
+		{byContent, remote, "image/jpeg"},
+		{byExt, dirEntry, ""},
+	} {
+		if mt := tc.mimeType(tc.file); mt != tc.expected {
+			t.Errorf("%s has type %q, expected %q", tc.file.Name, mt, tc.expected)
+		}
+	}
+}
@@ -24,11 +24,12 @@ import (
 type limitedReader struct {
 	r      io.Reader
 	bucket *ratelimit.Bucket
+	exempt func() bool // if set and true, reads aren't limited for now
 }
 
 func (r *limitedReader) Read(buf []byte) (int, error) {
 	n, err := r.r.Read(buf)
-	if r.bucket != nil {
+	if r.bucket != nil && (r.exempt == nil || !r.exempt()) {
 		r.bucket.Wait(int64(n))
 	}
 	return n, err
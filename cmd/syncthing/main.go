@@ -17,6 +17,7 @@ package main
 
 import (
 	"crypto/tls"
+	"encoding/xml"
 	"flag"
 	"fmt"
 	"io"
@@ -31,19 +32,24 @@ import (
 	"runtime"
 	"runtime/debug"
 	"runtime/pprof"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
-	"github.com/calmh/logger"
 	"github.com/juju/ratelimit"
 	"github.com/syncthing/syncthing/internal/config"
+	"github.com/syncthing/syncthing/internal/dialer"
 	"github.com/syncthing/syncthing/internal/discover"
 	"github.com/syncthing/syncthing/internal/events"
 	"github.com/syncthing/syncthing/internal/files"
+	"github.com/syncthing/syncthing/internal/fs"
+	"github.com/syncthing/syncthing/internal/logger"
 	"github.com/syncthing/syncthing/internal/model"
 	"github.com/syncthing/syncthing/internal/osutil"
 	"github.com/syncthing/syncthing/internal/protocol"
+	"github.com/syncthing/syncthing/internal/scanner"
 	"github.com/syncthing/syncthing/internal/symlinks"
 	"github.com/syncthing/syncthing/internal/upgrade"
 	"github.com/syncthing/syncthing/internal/upnp"
@@ -109,10 +115,13 @@ var (
 	writeRateLimit *ratelimit.Bucket
 	readRateLimit  *ratelimit.Bucket
 	stop           = make(chan int)
+	startupDone    = make(chan struct{}) // Closed when the database is open and folders are started
 	discoverer     *discover.Discoverer
 	externalPort   int
-	igd            *upnp.IGD
+	igd            *upnp.IGD // protected by igdMut
+	igdMut         sync.Mutex
 	cert           tls.Certificate
+	deviceTLSCfg   *tls.Config // for connections to other devices
 )
 
 const (
@@ -184,6 +193,7 @@ var (
 	doUpgradeCheck    bool
 	upgradeTo         string
 	noBrowser         bool
+	readOnlyAPI       bool
 	noConsole         bool
 	generateDir       string
 	logFile           string
@@ -220,6 +230,7 @@ func main() {
 	flag.StringVar(&guiAddress, "gui-address", guiAddress, "Override GUI address")
 	flag.StringVar(&guiAuthentication, "gui-authentication", guiAuthentication, "Override GUI authentication; username:password")
 	flag.StringVar(&guiAPIKey, "gui-apikey", guiAPIKey, "Override GUI API key")
+	flag.BoolVar(&readOnlyAPI, "read-only-api", false, "Refuse REST calls that change state")
 	flag.StringVar(&confDir, "home", "", "Set configuration directory")
 	flag.IntVar(&logFlags, "logflags", logFlags, "Select information in log line prefix")
 	flag.BoolVar(&noBrowser, "no-browser", false, "Do not start browser")
@@ -255,6 +266,9 @@ func main() {
 	}
 
 	l.SetFlags(logFlags)
+	if configuredLogFormat(filepath.Join(confDir, "config.xml")) == config.LogFormatJSON {
+		l.SetFormatter(logger.JSONFormatter{})
+	}
 
 	if generateDir != "" {
 		dir, err := osutil.ExpandTilde(generateDir)
@@ -401,6 +415,12 @@ func syncthingMain() {
 	l.Infoln(LongVersion)
 	l.Infoln("My ID:", myID)
 
+	if perf := scanner.MeasureHash(); perf.CPUExtensions {
+		l.Infof("Hashing: %.0f MiB/s (CPU supports SHA extensions)", perf.MiBps)
+	} else {
+		l.Infof("Hashing: %.0f MiB/s", perf.MiBps)
+	}
+
 	// Prepare to be able to save configuration
 
 	cfgFile := filepath.Join(confDir, "config.xml")
@@ -437,7 +457,7 @@ func syncthingMain() {
 	if cfg.Raw().OriginalVersion != config.CurrentVersion {
 		l.Infoln("Archiving a copy of old config file format")
 		// Archive a copy
-		osutil.Rename(cfgFile, cfgFile+fmt.Sprintf(".v%d", cfg.Raw().OriginalVersion))
+		fs.Rename(fs.DefaultFilesystem, cfgFile, cfgFile+fmt.Sprintf(".v%d", cfg.Raw().OriginalVersion))
 		// Save the new version
 		cfg.Save()
 	}
@@ -472,22 +492,39 @@ func syncthingMain() {
 			tls.TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA,
 		},
 	}
+	deviceTLSCfg = tlsCfg
 
 	// If the read or write rate should be limited, set up a rate limiter for it.
 	// This will be used on connections created in the connect and listen routines.
 
 	opts := cfg.Options()
 
+	if err := dialer.SetProxy(opts.OutboundProxy); err != nil {
+		l.Warnln("Outbound proxy:", err)
+	} else if dialer.Proxied() {
+		l.Infoln("Making outgoing connections through a proxy")
+	}
+
 	if !opts.SymlinksEnabled {
 		symlinks.Supported = false
 	}
 
 	if opts.MaxSendKbps > 0 {
-		writeRateLimit = ratelimit.NewBucketWithRate(float64(1000*opts.MaxSendKbps), int64(5*1000*opts.MaxSendKbps))
+		writeRateLimit = rateLimitBucket(opts.MaxSendKbps)
 	}
 	if opts.MaxRecvKbps > 0 {
-		readRateLimit = ratelimit.NewBucketWithRate(float64(1000*opts.MaxRecvKbps), int64(5*1000*opts.MaxRecvKbps))
+		readRateLimit = rateLimitBucket(opts.MaxRecvKbps)
+	}
+
+	protocol.DefaultRequestLimits = protocol.RequestLimits{
+		MaxBytes:    opts.MaxRequestKiB * 1024,
+		MaxRequests: opts.MaxConcurrentRequests,
 	}
+	protocol.DefaultRequestTimeouts = protocol.RequestTimeouts{
+		Min: time.Duration(opts.RequestTimeoutMinS) * time.Second,
+		Max: time.Duration(opts.RequestTimeoutMaxS) * time.Second,
+	}
+	protocol.DefaultIndexBuffer = protocol.NewIndexBuffer(opts.IndexReceiveBufferKiB * 1024)
 
 	db, err := leveldb.OpenFile(filepath.Join(confDir, "index"), &opt.Options{OpenFilesCacheCapacity: 100})
 	if err != nil {
@@ -505,6 +542,7 @@ func syncthingMain() {
 
 	m := model.NewModel(cfg, myName, "syncthing", Version, db)
 
+	limitFolders(cfg, opts.MaxFolders)
 	sanityCheckFolders(cfg, m)
 
 	// GUI
@@ -535,14 +573,17 @@ func syncthingMain() {
 	externalPort = addr.Port
 
 	// UPnP
+	igdMut.Lock()
 	igd = nil
+	igdMut.Unlock()
 
+	mapped := false
 	if opts.UPnPEnabled {
-		setupUPnP()
+		mapped = setupUPnP()
 	}
 
 	// Routine to connect out to configured devices
-	discoverer = discovery(externalPort)
+	discoverer = discovery(externalPort, mapped)
 	go listenConnect(myID, m, tlsCfg)
 
 	for _, folder := range cfg.Folders() {
@@ -552,7 +593,10 @@ func syncthingMain() {
 
 		// Routine to pull blocks from other devices to synchronize the local
 		// folder. Does not run when we are in read only (publish only) mode.
-		if folder.ReadOnly {
+		if folder.Type == config.FolderTypeAudit {
+			l.Okf("Ready to audit %s (only differences to other devices are reported)", folder.ID)
+			m.StartFolderRO(folder.ID)
+		} else if folder.ReadOnly {
 			l.Okf("Ready to synchronize %s (read only; no external updates accepted)", folder.ID)
 			m.StartFolderRO(folder.ID)
 		} else {
@@ -561,6 +605,18 @@ func syncthingMain() {
 		}
 	}
 
+	if opts.StallWatchdogTimeoutM > 0 {
+		var dumpDir string
+		if opts.StallWatchdogDumpFile {
+			dumpDir = confDir
+		}
+		m.StartStallWatchdog(time.Duration(opts.StallWatchdogTimeoutM)*time.Minute, dumpDir, opts.StallWatchdogRestart)
+	}
+
+	if opts.ConnectionIdleTimeoutM > 0 {
+		m.StartIdleReaper(time.Duration(opts.ConnectionIdleTimeoutM) * time.Minute)
+	}
+
 	if cpuProfile {
 		f, err := os.Create(fmt.Sprintf("cpu-%d.pprof", os.Getpid()))
 		if err != nil {
@@ -604,6 +660,10 @@ func syncthingMain() {
 		go standbyMonitor()
 	}
 
+	if opts.BatteryPausePct > 0 {
+		go powerMonitor(m, opts.BatteryPausePct)
+	}
+
 	if opts.AutoUpgradeIntervalH > 0 {
 		if noUpgrade {
 			l.Infof("No automatic upgrades; STNOUPGRADE environment variable defined.")
@@ -614,11 +674,14 @@ func syncthingMain() {
 		}
 	}
 
+	close(startupDone)
 	events.Default.Log(events.StartupComplete, nil)
 	go generateEvents()
 
 	code := <-stop
 
+	removeGUISocket()
+
 	l.Okln("Exiting")
 	os.Exit(code)
 }
@@ -626,8 +689,20 @@ func syncthingMain() {
 func setupGUI(cfg *config.Wrapper, m *model.Model) {
 	opts := cfg.Options()
 	guiCfg := overrideGUIConfig(cfg.GUI(), guiAddress, guiAuthentication, guiAPIKey)
+	cfg.Subscribe(guiAuthHandler{})
 
 	if guiCfg.Enabled && guiCfg.Address != "" {
+		if path, ok := guiUnixSocketPath(guiCfg.Address); ok {
+			// There's no URL to open a browser on for a socket; it's meant
+			// to be used behind a reverse proxy.
+			l.Infoln("Starting web GUI on unix socket", path)
+			err := startGUI(guiCfg, guiAssets, m)
+			if err != nil {
+				l.Fatalln("Cannot start GUI:", err)
+			}
+			return
+		}
+
 		addr, err := net.ResolveTCPAddr("tcp", guiCfg.Address)
 		if err != nil {
 			l.Fatalf("Cannot start GUI on %q: %v", guiCfg.Address, err)
@@ -664,6 +739,38 @@ func setupGUI(cfg *config.Wrapper, m *model.Model) {
 	}
 }
 
+// limitFolders stops the folders beyond the first max by ID, if max is above
+// zero, so that a mistakenly large configuration doesn't overwhelm us.
+// Paused folders are counted, as they are started and may be resumed.
+func limitFolders(cfg *config.Wrapper, max int) {
+	if max <= 0 {
+		return
+	}
+	var ids []string
+	for id, folder := range cfg.Folders() {
+		if folder.Invalid == "" {
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) <= max {
+		return
+	}
+	sort.Strings(ids)
+	l.Warnf("%d folders are configured, more than the maximum of %d; stopping the other %d", len(ids), max, len(ids)-max)
+	for _, id := range ids[max:] {
+		cfg.InvalidateFolder(id, fmt.Sprintf("more than the maximum of %d folders configured", max))
+	}
+}
+
+// checkMaxFolders returns an error if the configuration has more folders
+// than the maximum it allows, paused or not.
+func checkMaxFolders(newCfg config.Configuration) error {
+	if max := newCfg.Options.MaxFolders; max > 0 && len(newCfg.Folders) > max {
+		return fmt.Errorf("%d folders are configured, more than the maximum of %d", len(newCfg.Folders), max)
+	}
+	return nil
+}
+
 func sanityCheckFolders(cfg *config.Wrapper, m *model.Model) {
 nextFolder:
 	for id, folder := range cfg.Folders() {
@@ -673,6 +780,16 @@ nextFolder:
 		m.AddFolder(folder)
 
 		fi, err := os.Stat(folder.Path)
+		if folder.RemovableDrive {
+			// The drive isn't attached when its mount point is missing or
+			// empty. The folder waits for it, and nothing is created in its
+			// place, where a later mount would hide it.
+			mounted, _ := osutil.IsMountpoint(folder.Path)
+			if !mounted || (!folder.HasMarker() && m.CurrentLocalVersion(id) > 0) {
+				l.Infof("Folder %q is on a removable drive, which is missing; waiting for it", folder.ID)
+				continue nextFolder
+			}
+		}
 		if m.CurrentLocalVersion(id) > 0 {
 			// Safety check. If the cached index contains files but the
 			// folder doesn't exist, we have a problem. We would assume
@@ -757,7 +874,9 @@ func generateEvents() {
 	}
 }
 
-func setupUPnP() {
+// setupUPnP maps an external port to the listen port on the first UPnP
+// device found, returning whether it did.
+func setupUPnP() bool {
 	if opts := cfg.Options(); len(opts.ListenAddress) == 1 {
 		_, portStr, err := net.SplitHostPort(opts.ListenAddress[0])
 		if err != nil {
@@ -769,23 +888,28 @@ func setupUPnP() {
 			if len(igds) > 0 {
 				// Configure the first discovered IGD only. This is a work-around until we have a better mechanism
 				// for handling multiple IGDs, which will require changes to the global discovery service
-				igd = &igds[0]
+				dev := &igds[0]
+				igdMut.Lock()
+				igd = dev
+				igdMut.Unlock()
 
-				externalPort = setupExternalPort(igd, port)
+				externalPort = setupExternalPort(dev, port)
 				if externalPort == 0 {
 					l.Warnln("Failed to create UPnP port mapping")
 				} else {
-					l.Infof("Created UPnP port mapping for external port %d on UPnP device %s.", externalPort, igd.FriendlyIdentifier())
+					l.Infof("Created UPnP port mapping for external port %d on UPnP device %s.", externalPort, dev.FriendlyIdentifier())
 
 					if opts.UPnPRenewal > 0 {
 						go renewUPnP(port)
 					}
+					return true
 				}
 			}
 		}
 	} else {
 		l.Warnln("Multiple listening addresses; not attempting UPnP port mapping")
 	}
+	return false
 }
 
 func setupExternalPort(igd *upnp.IGD, port int) int {
@@ -809,7 +933,10 @@ func renewUPnP(port int) {
 		time.Sleep(time.Duration(opts.UPnPRenewal) * time.Minute)
 
 		// Make sure our IGD reference isn't nil
-		if igd == nil {
+		igdMut.Lock()
+		dev := igd
+		igdMut.Unlock()
+		if dev == nil {
 			if debugNet {
 				l.Debugln("Undefined IGD during UPnP port renewal. Re-discovering...")
 			}
@@ -817,7 +944,10 @@ func renewUPnP(port int) {
 			if len(igds) > 0 {
 				// Configure the first discovered IGD only. This is a work-around until we have a better mechanism
 				// for handling multiple IGDs, which will require changes to the global discovery service
-				igd = &igds[0]
+				dev = &igds[0]
+				igdMut.Lock()
+				igd = dev
+				igdMut.Unlock()
 			} else {
 				if debugNet {
 					l.Debugln("Failed to discover IGD during UPnP port mapping renewal.")
@@ -828,11 +958,11 @@ func renewUPnP(port int) {
 
 		// Just renew the same port that we already have
 		if externalPort != 0 {
-			err := igd.AddPortMapping(upnp.TCP, externalPort, port, "syncthing", opts.UPnPLease*60)
+			err := dev.AddPortMapping(upnp.TCP, externalPort, port, "syncthing", opts.UPnPLease*60)
 			if err != nil {
-				l.Warnf("Error renewing UPnP port mapping for external port %d on device %s: %s", externalPort, igd.FriendlyIdentifier(), err.Error())
+				l.Warnf("Error renewing UPnP port mapping for external port %d on device %s: %s", externalPort, dev.FriendlyIdentifier(), err.Error())
 			} else if debugNet {
-				l.Debugf("Renewed UPnP port mapping for external port %d on device %s.", externalPort, igd.FriendlyIdentifier())
+				l.Debugf("Renewed UPnP port mapping for external port %d on device %s.", externalPort, dev.FriendlyIdentifier())
 			}
 
 			continue
@@ -845,16 +975,17 @@ func renewUPnP(port int) {
 			l.Debugln("No UPnP port mapping defined, updating...")
 		}
 
-		forwardedPort := setupExternalPort(igd, port)
+		forwardedPort := setupExternalPort(dev, port)
 		if forwardedPort != 0 {
 			externalPort = forwardedPort
 			discoverer.StopGlobal()
+			discoverer.SetExternalPortMapped(true)
 			discoverer.StartGlobal(opts.GlobalAnnServers, uint16(forwardedPort))
 			if debugNet {
-				l.Debugf("Updated UPnP port mapping for external port %d on device %s.", forwardedPort, igd.FriendlyIdentifier())
+				l.Debugf("Updated UPnP port mapping for external port %d on device %s.", forwardedPort, dev.FriendlyIdentifier())
 			}
 		} else {
-			l.Warnf("Failed to update UPnP port mapping for external port on device " + igd.FriendlyIdentifier() + ".")
+			l.Warnf("Failed to update UPnP port mapping for external port on device " + dev.FriendlyIdentifier() + ".")
 		}
 	}
 }
@@ -893,8 +1024,35 @@ func shutdown() {
 	stop <- exitSuccess
 }
 
+// A sourcedConn is an established connection and how its address was
+// found; one of the model.Address* constants.
+type sourcedConn struct {
+	conn    *tls.Conn
+	source  string
+	relayed bool // made through a proxy rather than directly to the device
+}
+
+// A relayedConn is a connection going through a proxy, which the model
+// tells by its implementing model.RelayedConn.
+type relayedConn struct {
+	*tls.Conn
+}
+
+func (relayedConn) Relayed() bool {
+	return true
+}
+
+// modelConn returns the connection to hand to the model.
+func (sc sourcedConn) modelConn() io.Closer {
+	if sc.relayed {
+		return relayedConn{sc.conn}
+	}
+	return sc.conn
+}
+
 func listenConnect(myID protocol.DeviceID, m *model.Model, tlsCfg *tls.Config) {
-	var conns = make(chan *tls.Conn)
+	var conns = make(chan sourcedConn)
+	limiter := newConnectionLimiter(m, cfg.Options().MaxConnections)
 
 	// Listen
 	for _, addr := range cfg.Options().ListenAddress {
@@ -902,10 +1060,11 @@ func listenConnect(myID protocol.DeviceID, m *model.Model, tlsCfg *tls.Config) {
 	}
 
 	// Connect
-	go dialTLS(m, conns, tlsCfg)
+	go dialTLS(m, conns, tlsCfg, limiter)
 
 next:
-	for conn := range conns {
+	for sc := range conns {
+		conn := sc.conn
 		certs := conn.ConnectionState().PeerCertificates
 		if cl := len(certs); cl != 1 {
 			l.Infof("Got peer certificate list of length %d != 1 from %s; protocol error", cl, conn.RemoteAddr())
@@ -927,6 +1086,12 @@ next:
 			continue
 		}
 
+		if m.DevicePaused(remoteID) {
+			l.Infof("Connection from paused device (%s) rejected", remoteID)
+			conn.Close()
+			continue
+		}
+
 		for deviceID, deviceCfg := range cfg.Devices() {
 			if deviceID == remoteID {
 				// Verify the name on the certificate. By default we set it to
@@ -946,16 +1111,26 @@ next:
 					continue next
 				}
 
+				if !limiter.admit(remoteID) {
+					l.Infof("Connection from %s rejected; already connected to the maximum of %d devices", remoteID, cfg.Options().MaxConnections)
+					conn.Close()
+					continue next
+				}
+
 				// If rate limiting is set, we wrap the connection in a
-				// limiter.
+				// limiter. Receiving isn't limited while a folder shared
+				// with the device is in its initial sync.
+				sendLimit, recvLimit := deviceRateLimits(deviceCfg)
 				wr := io.Writer(conn)
-				if writeRateLimit != nil {
-					wr = &limitedWriter{conn, writeRateLimit}
+				if sendLimit != nil {
+					wr = &limitedWriter{conn, sendLimit}
 				}
 
 				rd := io.Reader(conn)
-				if readRateLimit != nil {
-					rd = &limitedReader{conn, readRateLimit}
+				if recvLimit != nil {
+					rd = &limitedReader{conn, recvLimit, func() bool {
+						return m.InitialSync(remoteID)
+					}}
 				}
 
 				name := fmt.Sprintf("%s-%s", conn.LocalAddr(), conn.RemoteAddr())
@@ -970,7 +1145,8 @@ next:
 					"addr": conn.RemoteAddr().String(),
 				})
 
-				m.AddConnection(conn, protoConn)
+				m.ObserveAddress(remoteID, conn.RemoteAddr().String(), sc.source)
+				m.AddConnection(sc.modelConn(), protoConn)
 				continue next
 			}
 		}
@@ -981,6 +1157,7 @@ next:
 				"address": conn.RemoteAddr().String(),
 			})
 			l.Infof("Connection from %s with unknown device ID %s", conn.RemoteAddr(), remoteID)
+			m.AddPendingDevice(remoteID, conn.RemoteAddr().String())
 		} else {
 			l.Infof("Connection from %s with ignored device ID %s", conn.RemoteAddr(), remoteID)
 		}
@@ -989,7 +1166,7 @@ next:
 	}
 }
 
-func listenTLS(conns chan *tls.Conn, addr string, tlsCfg *tls.Config) {
+func listenTLS(conns chan sourcedConn, addr string, tlsCfg *tls.Config) {
 	if debugNet {
 		l.Debugln("listening on", addr)
 	}
@@ -998,10 +1175,21 @@ func listenTLS(conns chan *tls.Conn, addr string, tlsCfg *tls.Config) {
 	if err != nil {
 		l.Fatalln("listen (BEP):", err)
 	}
-	listener, err := net.ListenTCP("tcp", tcaddr)
+	tcpListener, err := net.ListenTCP("tcp", tcaddr)
 	if err != nil {
 		l.Fatalln("listen (BEP):", err)
 	}
+	opts := cfg.Options()
+	listener := &FilteringListener{tcpListener, parseNetworks(opts.AllowedNetworks)}
+	timeout := time.Duration(opts.ConnectionHandshakeTimeoutS) * time.Second
+
+	// Handshakes happen in separate routines, so that a slow or stalled
+	// peer doesn't hold up everyone else. The number of routines is capped
+	// so that a flood of connections can't exhaust resources.
+	var pending chan struct{}
+	if opts.MaxPendingHandshakes > 0 {
+		pending = make(chan struct{}, opts.MaxPendingHandshakes)
+	}
 
 	for {
 		conn, err := listener.Accept()
@@ -1014,23 +1202,40 @@ func listenTLS(conns chan *tls.Conn, addr string, tlsCfg *tls.Config) {
 			l.Debugln("connect from", conn.RemoteAddr())
 		}
 
+		if pending != nil {
+			select {
+			case pending <- struct{}{}:
+			default:
+				if debugNet {
+					l.Debugln("too many pending handshakes; dropping connection from", conn.RemoteAddr())
+				}
+				conn.Close()
+				continue
+			}
+		}
+
 		tcpConn := conn.(*net.TCPConn)
 		setTCPOptions(tcpConn)
 
-		tc := tls.Server(conn, tlsCfg)
-		err = tc.Handshake()
-		if err != nil {
-			l.Infoln("TLS handshake:", err)
-			tc.Close()
-			continue
-		}
+		go func() {
+			tc := tls.Server(tcpConn, tlsCfg)
+			err := tlsTimeoutHandshake(tc, timeout)
+			if pending != nil {
+				<-pending
+			}
+			if err != nil {
+				l.Infoln("TLS handshake:", err)
+				tc.Close()
+				return
+			}
 
-		conns <- tc
+			conns <- sourcedConn{tc, model.AddressIncoming, false}
+		}()
 	}
 
 }
 
-func dialTLS(m *model.Model, conns chan *tls.Conn, tlsCfg *tls.Config) {
+func dialTLS(m *model.Model, conns chan sourcedConn, tlsCfg *tls.Config, limiter *connectionLimiter) {
 	delay := time.Second
 	for {
 	nextDevice:
@@ -1039,11 +1244,11 @@ func dialTLS(m *model.Model, conns chan *tls.Conn, tlsCfg *tls.Config) {
 				continue
 			}
 
-			if m.ConnectedTo(deviceID) {
+			if m.ConnectedTo(deviceID) || m.DevicePaused(deviceID) || !limiter.allowed(deviceID) || m.IdleClosed(deviceID) {
 				continue
 			}
 
-			var addrs []string
+			var addrs, sources []string
 			for _, addr := range deviceCfg.Addresses {
 				if addr == "dynamic" {
 					if discoverer != nil {
@@ -1051,53 +1256,34 @@ func dialTLS(m *model.Model, conns chan *tls.Conn, tlsCfg *tls.Config) {
 						if len(t) == 0 {
 							continue
 						}
-						addrs = append(addrs, t...)
+						for _, addr := range t {
+							addrs = append(addrs, addr)
+							sources = append(sources, model.AddressDiscovery)
+						}
 					}
 				} else {
 					addrs = append(addrs, addr)
+					sources = append(sources, model.AddressStatic)
 				}
 			}
 
-			for _, addr := range addrs {
-				host, port, err := net.SplitHostPort(addr)
-				if err != nil && strings.HasPrefix(err.Error(), "missing port") {
-					// addr is on the form "1.2.3.4"
-					addr = net.JoinHostPort(addr, "22000")
-				} else if err == nil && port == "" {
-					// addr is on the form "1.2.3.4:"
-					addr = net.JoinHostPort(host, "22000")
-				}
+			for i, addr := range addrs {
+				addr = deviceAddress(addr)
 				if debugNet {
 					l.Debugln("dial", deviceCfg.DeviceID, addr)
 				}
 
-				raddr, err := net.ResolveTCPAddr("tcp", addr)
-				if err != nil {
-					if debugNet {
-						l.Debugln(err)
-					}
-					continue
-				}
-
-				conn, err := net.DialTCP("tcp", nil, raddr)
+				sc, err := dialSourced(addr, sources[i], tlsCfg, time.Duration(cfg.Options().ConnectionHandshakeTimeoutS)*time.Second)
 				if err != nil {
-					if debugNet {
+					if de, ok := err.(*dialError); ok && de.stage == dialStageHandshake {
+						l.Infoln("TLS handshake:", de.err)
+					} else if debugNet {
 						l.Debugln(err)
 					}
 					continue
 				}
 
-				setTCPOptions(conn)
-
-				tc := tls.Client(conn, tlsCfg)
-				err = tc.Handshake()
-				if err != nil {
-					l.Infoln("TLS handshake:", err)
-					tc.Close()
-					continue
-				}
-
-				conns <- tc
+				conns <- sc
 				continue nextDevice
 			}
 		}
@@ -1110,6 +1296,79 @@ func dialTLS(m *model.Model, conns chan *tls.Conn, tlsCfg *tls.Config) {
 	}
 }
 
+// deviceAddress returns addr with the default port added, if it has none,
+// and without a "tcp://" prefix.
+func deviceAddress(addr string) string {
+	addr = strings.TrimPrefix(addr, "tcp://")
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil && strings.Contains(err.Error(), "missing port") {
+		// addr is on the form "1.2.3.4"
+		return net.JoinHostPort(addr, "22000")
+	} else if err == nil && port == "" {
+		// addr is on the form "1.2.3.4:"
+		return net.JoinHostPort(host, "22000")
+	}
+	return addr
+}
+
+const (
+	dialStageResolve   = "resolve"
+	dialStageConnect   = "connect"
+	dialStageHandshake = "handshake"
+)
+
+// A dialError is an error from dialDevice, telling at which stage it
+// failed.
+type dialError struct {
+	stage string
+	err   error
+}
+
+func (e *dialError) Error() string {
+	return e.stage + ": " + e.err.Error()
+}
+
+// dialSourced connects to the device at addr, found by source. The
+// connection is relayed if it's made through a proxy.
+func dialSourced(addr, source string, tlsCfg *tls.Config, handshakeTimeout time.Duration) (sourcedConn, error) {
+	relayed := dialer.Proxied()
+	tc, err := dialDevice(addr, tlsCfg, 0, handshakeTimeout)
+	if err != nil {
+		return sourcedConn{}, err
+	}
+	return sourcedConn{tc, source, relayed}, nil
+}
+
+// dialDevice connects to addr and performs the TLS handshake. Zero timeouts
+// mean no timeout.
+func dialDevice(addr string, tlsCfg *tls.Config, dialTimeout, handshakeTimeout time.Duration) (*tls.Conn, error) {
+	// A proxy resolves the address itself, as we might not be able to.
+	if !dialer.Proxied() {
+		raddr, err := net.ResolveTCPAddr("tcp", addr)
+		if err != nil {
+			return nil, &dialError{dialStageResolve, err}
+		}
+		addr = raddr.String()
+	}
+
+	conn, err := dialer.DialTimeout("tcp", addr, dialTimeout)
+	if err != nil {
+		return nil, &dialError{dialStageConnect, err}
+	}
+
+	if tcpConn, ok := conn.(*net.TCPConn); ok {
+		setTCPOptions(tcpConn)
+	}
+
+	tc := tls.Client(conn, tlsCfg)
+	err = tlsTimeoutHandshake(tc, handshakeTimeout)
+	if err != nil {
+		tc.Close()
+		return nil, &dialError{dialStageHandshake, err}
+	}
+	return tc, nil
+}
+
 func setTCPOptions(conn *net.TCPConn) {
 	var err error
 	if err = conn.SetLinger(0); err != nil {
@@ -1126,9 +1385,11 @@ func setTCPOptions(conn *net.TCPConn) {
 	}
 }
 
-func discovery(extPort int) *discover.Discoverer {
+func discovery(extPort int, mapped bool) *discover.Discoverer {
 	opts := cfg.Options()
 	disc := discover.NewDiscoverer(myID, opts.ListenAddress)
+	disc.SetAnnounceAddresses(announceAddresses(cfg.Devices()[myID].Addresses))
+	disc.SetExternalPortMapped(mapped)
 
 	if opts.LocalAnnEnabled {
 		l.Infoln("Starting local discovery announcements")
@@ -1136,7 +1397,12 @@ func discovery(extPort int) *discover.Discoverer {
 	}
 
 	if opts.GlobalAnnEnabled {
-		l.Infoln("Starting global discovery announcements")
+		if opts.GlobalAnnLookupOnly {
+			l.Infoln("Starting global discovery in lookup only mode; not announcing our addresses")
+		} else {
+			l.Infoln("Starting global discovery announcements")
+		}
+		disc.SetGlobalAnnounce(opts.GlobalAnnLookupOnly, time.Duration(opts.GlobalAnnIntervalS)*time.Second)
 		disc.StartGlobal(opts.GlobalAnnServers, uint16(extPort))
 	}
 
@@ -1200,7 +1466,9 @@ func overrideGUIConfig(cfg config.GUIConfiguration, address, authentication, api
 	if address != "" {
 		cfg.Enabled = true
 
-		if !strings.Contains(address, "//") {
+		if strings.HasPrefix(address, unixSocketPrefix) {
+			cfg.Address = address
+		} else if !strings.Contains(address, "//") {
 			// Assume just an IP was given. Don't touch he TLS setting.
 			cfg.Address = address
 		} else {
@@ -1238,6 +1506,27 @@ func overrideGUIConfig(cfg config.GUIConfiguration, address, authentication, api
 	return cfg
 }
 
+// configuredLogFormat returns the log format set in the configuration file,
+// if any. It's read before the configuration is loaded, so that all that's
+// logged, also by the monitor process, is in the same format.
+func configuredLogFormat(path string) string {
+	fd, err := os.Open(path)
+	if err != nil {
+		return ""
+	}
+	defer fd.Close()
+
+	var cfg struct {
+		Options struct {
+			LogFormat string `xml:"logFormat"`
+		} `xml:"options"`
+	}
+	if err := xml.NewDecoder(fd).Decode(&cfg); err != nil {
+		return ""
+	}
+	return cfg.Options.LogFormat
+}
+
 func standbyMonitor() {
 	restartDelay := time.Duration(60 * time.Second)
 	now := time.Now()
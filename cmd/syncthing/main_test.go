@@ -16,10 +16,18 @@
 package main
 
 import (
+	"bufio"
+	"crypto/tls"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
 	"os"
 	"testing"
+	"time"
 
 	"github.com/syncthing/syncthing/internal/config"
+	"github.com/syncthing/syncthing/internal/dialer"
 	"github.com/syncthing/syncthing/internal/files"
 	"github.com/syncthing/syncthing/internal/model"
 	"github.com/syncthing/syncthing/internal/protocol"
@@ -117,3 +125,135 @@ func TestSanityCheck(t *testing.T) {
 		t.Error("Incorrect error")
 	}
 }
+
+func TestLimitFolders(t *testing.T) {
+	cfg := config.Wrap("/tmp/test", config.Configuration{
+		Folders: []config.FolderConfiguration{
+			{ID: "c"}, {ID: "a"}, {ID: "b"}, {ID: "d", Invalid: "folder path missing"}, {ID: "0", Paused: true},
+		},
+	})
+
+	limitFolders(cfg, 2)
+
+	folders := cfg.Folders()
+	// Paused folders are started too, so they count.
+	for id, invalid := range map[string]bool{"0": false, "a": false, "b": true, "c": true} {
+		if (folders[id].Invalid != "") != invalid {
+			t.Errorf("Folder %q has error %q", id, folders[id].Invalid)
+		}
+	}
+	if folders["d"].Invalid != "folder path missing" {
+		t.Errorf("Error of invalid folder replaced by %q", folders["d"].Invalid)
+	}
+}
+
+func TestConfiguredLogFormat(t *testing.T) {
+	if f := configuredLogFormat("../../internal/config/testdata/overridenvalues.xml"); f != config.LogFormatJSON {
+		t.Errorf("Unexpected log format %q", f)
+	}
+	if f := configuredLogFormat("testdata/nonexistent.xml"); f != "" {
+		t.Errorf("Unexpected log format %q without a configuration", f)
+	}
+}
+
+// connectProxy returns a minimal HTTP proxy handling CONNECT requests.
+func connectProxy(t *testing.T) net.Listener {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				br := bufio.NewReader(conn)
+				req, err := http.ReadRequest(br)
+				if err != nil || req.Method != "CONNECT" {
+					return
+				}
+				dst, err := net.Dial("tcp", req.Host)
+				if err != nil {
+					return
+				}
+				defer dst.Close()
+				io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+				go io.Copy(dst, br)
+				io.Copy(conn, dst)
+			}()
+		}
+	}()
+	return ln
+}
+
+func TestDialRelayed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "relayed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	newCertificate(dir, "", tlsDefaultCommonName)
+	srvCert, err := loadCert(dir, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srvID := protocol.NewDeviceID(srvCert.Certificate[0])
+
+	// The device completes the handshake and keeps the connection open.
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{srvCert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				conn.(*tls.Conn).Handshake()
+				ioutil.ReadAll(conn)
+				conn.Close()
+			}()
+		}
+	}()
+	addr := listener.Addr().String()
+
+	proxy := connectProxy(t)
+	defer proxy.Close()
+	defer dialer.SetProxy("")
+
+	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	m := model.NewModel(config.Wrap("/tmp/test", config.Configuration{}), "device", "syncthing", "dev", db)
+	clientCfg := &tls.Config{InsecureSkipVerify: true}
+
+	for _, proxied := range []bool{false, true} {
+		proxyURL := ""
+		if proxied {
+			proxyURL = "http://" + proxy.Addr().String()
+		}
+		if err := dialer.SetProxy(proxyURL); err != nil {
+			t.Fatal(err)
+		}
+
+		sc, err := dialSourced(addr, model.AddressStatic, clientCfg, time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sc.relayed != proxied {
+			t.Errorf("Connection relayed %v, expected %v", sc.relayed, proxied)
+		}
+
+		protoConn := protocol.NewConnection(srvID, sc.conn, sc.conn, m, "test", false)
+		m.AddConnection(sc.modelConn(), protoConn)
+		if ci := m.ConnectionStats()[srvID.String()]; ci.Relayed != proxied {
+			t.Errorf("Model sees connection relayed %v, expected %v", ci.Relayed, proxied)
+		}
+		m.Close(srvID, io.EOF)
+	}
+}
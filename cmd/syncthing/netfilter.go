@@ -0,0 +1,115 @@
+// Copyright (C) 2014 The Syncthing Authors.
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for
+// more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"net"
+	"strings"
+)
+
+// parseNetworks parses a list of networks in CIDR notation. Plain IP
+// addresses are accepted as networks containing only that address. Invalid
+// entries are logged and skipped.
+func parseNetworks(nets []string) []*net.IPNet {
+	var res []*net.IPNet
+	for _, s := range nets {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				l.Warnf("Ignoring invalid allowed network %q", s)
+				continue
+			}
+			if ip4 := ip.To4(); ip4 != nil {
+				res = append(res, &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)})
+			} else {
+				res = append(res, &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)})
+			}
+			continue
+		}
+		_, ipnet, err := net.ParseCIDR(s)
+		if err != nil {
+			l.Warnf("Ignoring invalid allowed network %q: %v", s, err)
+			continue
+		}
+		res = append(res, ipnet)
+	}
+	return res
+}
+
+// addrAllowed returns true if the address is within one of the given
+// networks, or if the list of networks is empty.
+func addrAllowed(addr net.Addr, nets []*net.IPNet) bool {
+	if len(nets) == 0 {
+		return true
+	}
+
+	var ip net.IP
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		ip = a.IP
+	case *net.UDPAddr:
+		ip = a.IP
+	default:
+		host, _, err := net.SplitHostPort(addr.String())
+		if err != nil {
+			return false
+		}
+		ip = net.ParseIP(host)
+	}
+	if ip == nil {
+		return false
+	}
+
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// FilteringListener is a net.Listener that closes any accepted connection
+// whose remote address is not within the allowed networks, before anything
+// is read from or written to it. An empty list of networks allows all
+// connections. The check is against the address of the immediate peer, so
+// for a connection through a proxy or relay it's the address of the proxy
+// or relay that must be allowed.
+type FilteringListener struct {
+	net.Listener
+	Allowed []*net.IPNet
+}
+
+func (f *FilteringListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := f.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+
+		if addrAllowed(conn.RemoteAddr(), f.Allowed) {
+			return conn, nil
+		}
+
+		if debugNet {
+			l.Debugln("rejecting connection from disallowed address", conn.RemoteAddr())
+		}
+		conn.Close()
+	}
+}
@@ -0,0 +1,56 @@
+// Copyright (C) 2014 The Syncthing Authors.
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for
+// more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+func TestAddrAllowed(t *testing.T) {
+	nets := parseNetworks([]string{"192.168.0.0/16", "10.1.2.3", "2001:db8::/32", "bogus", "300.0.0.0/8"})
+	if len(nets) != 3 {
+		t.Fatalf("Expected three valid networks, got %d", len(nets))
+	}
+
+	cases := []struct {
+		addr    string
+		allowed bool
+	}{
+		{"192.168.1.10:22000", true},
+		{"192.169.1.10:22000", false},
+		{"10.1.2.3:1234", true},
+		{"10.1.2.4:1234", false},
+		{"[2001:db8::1]:22000", true},
+		{"[2001:db9::1]:22000", false},
+		{"[::ffff:192.168.3.4]:22000", true},
+	}
+
+	for _, tc := range cases {
+		addr, err := net.ResolveTCPAddr("tcp", tc.addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res := addrAllowed(addr, nets); res != tc.allowed {
+			t.Errorf("addrAllowed(%s) = %v, expected %v", tc.addr, res, tc.allowed)
+		}
+	}
+
+	addr, _ := net.ResolveTCPAddr("tcp", "1.2.3.4:5")
+	if !addrAllowed(addr, nil) {
+		t.Error("Empty network list should allow all addresses")
+	}
+}
@@ -0,0 +1,95 @@
+// Copyright (C) 2014 The Syncthing Authors.
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for
+// more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"errors"
+
+	"github.com/syncthing/syncthing/internal/config"
+	"github.com/syncthing/syncthing/internal/protocol"
+)
+
+// acceptPendingDevice adds the device to the configuration, the same way as
+// a device added by hand in the GUI, unless it is already there.
+func acceptPendingDevice(cfg *config.Configuration, device protocol.DeviceID) {
+	for _, dev := range cfg.Devices {
+		if dev.DeviceID == device {
+			return
+		}
+	}
+
+	cfg.Devices = append(append([]config.DeviceConfiguration(nil), cfg.Devices...), config.DeviceConfiguration{
+		DeviceID:    device,
+		Addresses:   []string{"dynamic"},
+		Compression: true,
+	})
+
+	ignored := make([]protocol.DeviceID, 0, len(cfg.IgnoredDevices))
+	for _, id := range cfg.IgnoredDevices {
+		if id != device {
+			ignored = append(ignored, id)
+		}
+	}
+	cfg.IgnoredDevices = ignored
+}
+
+// acceptPendingFolder shares the folder with the configured device offering
+// it. A folder that doesn't exist yet is added at path.
+func acceptPendingFolder(cfg *config.Configuration, folder string, device protocol.DeviceID, path string) error {
+	known := false
+	for _, dev := range cfg.Devices {
+		if dev.DeviceID == device {
+			known = true
+			break
+		}
+	}
+	if !known {
+		return errors.New("device is not configured")
+	}
+
+	// The folders are copied, so as not to modify the running configuration
+	// they are shared with.
+	cfg.Folders = append([]config.FolderConfiguration(nil), cfg.Folders...)
+	for i, fcfg := range cfg.Folders {
+		if fcfg.ID != folder {
+			continue
+		}
+		for _, dev := range fcfg.Devices {
+			if dev.DeviceID == device {
+				return nil
+			}
+		}
+		fcfg.Devices = append(append([]config.FolderDeviceConfiguration(nil), fcfg.Devices...), config.FolderDeviceConfiguration{DeviceID: device})
+		cfg.Folders[i] = fcfg
+		return nil
+	}
+
+	if path == "" {
+		return errors.New("no such folder; a path is required to add it")
+	}
+	cfg.Folders = append(cfg.Folders, config.FolderConfiguration{
+		ID:              folder,
+		Path:            path,
+		RescanIntervalS: 60,
+		Copiers:         1,
+		Pullers:         16,
+		Devices: []config.FolderDeviceConfiguration{
+			{DeviceID: myID},
+			{DeviceID: device},
+		},
+	})
+	return nil
+}
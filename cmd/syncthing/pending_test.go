@@ -0,0 +1,70 @@
+// Copyright (C) 2014 The Syncthing Authors.
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for
+// more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"testing"
+
+	"github.com/syncthing/syncthing/internal/config"
+	"github.com/syncthing/syncthing/internal/protocol"
+)
+
+func TestAcceptPending(t *testing.T) {
+	device1, _ := protocol.DeviceIDFromString("AIR6LPZ-7K4PTTV-UXQSMUU-CPQ5YWH-OEDFIIQ-JUG777G-2YQXXR5-YD6AWQR")
+	device2, _ := protocol.DeviceIDFromString("GYRZZQB-IRNPV4Z-T7TC52W-EQYJ3TT-FDQW6MW-DFLMU42-SSSU6EM-FBK2VAY")
+
+	orig := config.Configuration{
+		Folders: []config.FolderConfiguration{
+			{ID: "default", Path: "/tmp/default"},
+		},
+		IgnoredDevices: []protocol.DeviceID{device1},
+	}
+	cfg := orig
+
+	if err := acceptPendingFolder(&cfg, "default", device1, ""); err == nil {
+		t.Error("Unexpected nil error for unknown device")
+	}
+
+	acceptPendingDevice(&cfg, device1)
+	acceptPendingDevice(&cfg, device1)
+	if len(cfg.Devices) != 1 || cfg.Devices[0].DeviceID != device1 || len(cfg.IgnoredDevices) != 0 {
+		t.Errorf("Unexpected devices %v, ignored %v", cfg.Devices, cfg.IgnoredDevices)
+	}
+
+	if err := acceptPendingFolder(&cfg, "default", device1, ""); err != nil {
+		t.Fatal(err)
+	}
+	if devs := cfg.Folders[0].Devices; len(devs) != 1 || devs[0].DeviceID != device1 {
+		t.Errorf("Folder not shared with device: %v", devs)
+	}
+	if len(orig.Folders[0].Devices) != 0 {
+		t.Error("Original configuration was modified")
+	}
+
+	if err := acceptPendingFolder(&cfg, "new", device1, ""); err == nil {
+		t.Error("Unexpected nil error for new folder without path")
+	}
+	if err := acceptPendingFolder(&cfg, "new", device1, "/tmp/new"); err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.Folders) != 2 || cfg.Folders[1].ID != "new" || cfg.Folders[1].Path != "/tmp/new" || len(cfg.Folders[1].Devices) != 2 {
+		t.Errorf("Folder not added: %v", cfg.Folders)
+	}
+
+	if err := acceptPendingFolder(&cfg, "default", device2, ""); err == nil {
+		t.Error("Unexpected nil error for unknown device")
+	}
+}
@@ -0,0 +1,62 @@
+// Copyright (C) 2014 The Syncthing Authors.
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for
+// more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"time"
+
+	"github.com/syncthing/syncthing/internal/model"
+	"github.com/syncthing/syncthing/internal/osutil"
+)
+
+const powerCheckInterval = time.Minute
+
+// batteryPause returns whether syncing should be paused with the given power
+// status, when it's paused on battery below pausePct charge.
+func batteryPause(s osutil.PowerStatus, pausePct int) bool {
+	return s.OnBattery && s.ChargePct < pausePct
+}
+
+// powerMonitor pauses syncing while running on battery with less than
+// pausePct charge left, and resumes it when back on AC or above the
+// threshold. It returns straight away when the power status isn't known.
+func powerMonitor(m *model.Model, pausePct int) {
+	status, err := osutil.GetPowerStatus()
+	if err != nil {
+		l.Infoln("Not pausing on battery:", err)
+		return
+	}
+
+	var paused bool
+	for {
+		if pause := batteryPause(status, pausePct); pause != paused {
+			if pause {
+				l.Infof("Running on battery with %d%% charge left; pausing syncing", status.ChargePct)
+			} else {
+				l.Infoln("No longer running on low battery; resuming syncing")
+			}
+			m.SetPowerPaused(pause)
+			paused = pause
+		}
+
+		time.Sleep(powerCheckInterval)
+		status, err = osutil.GetPowerStatus()
+		if err != nil {
+			// The battery was removed.
+			status = osutil.PowerStatus{}
+		}
+	}
+}
@@ -0,0 +1,41 @@
+// Copyright (C) 2014 The Syncthing Authors.
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for
+// more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"testing"
+
+	"github.com/syncthing/syncthing/internal/osutil"
+)
+
+func TestBatteryPause(t *testing.T) {
+	cases := []struct {
+		status osutil.PowerStatus
+		pct    int
+		pause  bool
+	}{
+		{osutil.PowerStatus{OnBattery: true, ChargePct: 19}, 20, true},
+		{osutil.PowerStatus{OnBattery: true, ChargePct: 20}, 20, false},
+		{osutil.PowerStatus{OnBattery: false, ChargePct: 5}, 20, false},
+		{osutil.PowerStatus{OnBattery: true, ChargePct: 99}, 100, true},
+		{osutil.PowerStatus{OnBattery: true, ChargePct: 5}, 0, false},
+	}
+	for i, tc := range cases {
+		if pause := batteryPause(tc.status, tc.pct); pause != tc.pause {
+			t.Errorf("%d: batteryPause(%+v, %d) = %v, expected %v", i, tc.status, tc.pct, pause, tc.pause)
+		}
+	}
+}
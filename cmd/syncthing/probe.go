@@ -0,0 +1,164 @@
+// Copyright (C) 2014 The Syncthing Authors.
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for
+// more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"crypto/tls"
+	"net"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/syncthing/syncthing/internal/protocol"
+)
+
+// The reasons given by a probe. Anything but probeOK is a failure.
+const (
+	probeOK               = "ok"
+	probeNoAddress        = "no-address"
+	probeResolveFailed    = "resolve-failed"
+	probeRefused          = "refused"
+	probeUnreachable      = "unreachable"
+	probeTimeout          = "timeout"
+	probeNetworkError     = "network-error"
+	probeTLSError         = "tls-error"
+	probeDeviceIDMismatch = "device-id-mismatch"
+	probeCertNameMismatch = "certificate-name-mismatch"
+)
+
+const defaultProbeTimeout = 10 * time.Second
+
+// A probeResult is the outcome of a diagnostic connection attempt.
+type probeResult struct {
+	Address  string `json:"address"`
+	OK       bool   `json:"ok"`
+	Reason   string `json:"reason"`
+	Error    string `json:"error,omitempty"`
+	DeviceID string `json:"deviceID,omitempty"` // of the certificate presented, if any
+}
+
+// probeDevice attempts a connection to each address of the device, or to
+// addr if given, and reports how each attempt went. Either the device or
+// addr may be empty. The connections are closed once the handshake is
+// done, so the connection state of the device is left alone.
+func probeDevice(device protocol.DeviceID, addr string) []probeResult {
+	var addrs []string
+	certName := tlsDefaultCommonName
+	if device != (protocol.DeviceID{}) {
+		deviceCfg, ok := cfg.Devices()[device]
+		if ok && deviceCfg.CertName != "" {
+			certName = deviceCfg.CertName
+		}
+		if addr == "" {
+			for _, addr := range deviceCfg.Addresses {
+				if addr == "dynamic" {
+					if discoverer != nil {
+						addrs = append(addrs, discoverer.Lookup(device)...)
+					}
+				} else {
+					addrs = append(addrs, addr)
+				}
+			}
+		}
+	}
+	if addr != "" {
+		addrs = []string{addr}
+	}
+	if len(addrs) == 0 {
+		return []probeResult{{Reason: probeNoAddress}}
+	}
+
+	timeout := defaultProbeTimeout
+	if t := cfg.Options().ConnectionHandshakeTimeoutS; t > 0 {
+		timeout = time.Duration(t) * time.Second
+	}
+
+	results := make([]probeResult, len(addrs))
+	for i, addr := range addrs {
+		results[i] = probeAddress(deviceAddress(addr), device, certName, deviceTLSCfg, timeout)
+	}
+	return results
+}
+
+// probeAddress connects to addr and checks that the device found there is
+// the expected one, unless that is empty.
+func probeAddress(addr string, expected protocol.DeviceID, certName string, tlsCfg *tls.Config, timeout time.Duration) probeResult {
+	res := probeResult{Address: addr}
+
+	tc, err := dialDevice(addr, tlsCfg, timeout, timeout)
+	if err != nil {
+		res.Error = err.Error()
+		de := err.(*dialError)
+		switch de.stage {
+		case dialStageResolve:
+			res.Reason = probeResolveFailed
+		case dialStageConnect:
+			res.Reason = connectFailure(de.err)
+		default:
+			res.Reason = probeTLSError
+			if ne, ok := de.err.(net.Error); ok && ne.Timeout() {
+				res.Reason = probeTimeout
+			}
+		}
+		return res
+	}
+	defer tc.Close()
+
+	certs := tc.ConnectionState().PeerCertificates
+	if len(certs) != 1 {
+		res.Reason = probeTLSError
+		res.Error = "remote did not present exactly one certificate"
+		return res
+	}
+	remoteID := protocol.NewDeviceID(certs[0].Raw)
+	res.DeviceID = remoteID.String()
+
+	if expected != (protocol.DeviceID{}) && remoteID != expected {
+		res.Reason = probeDeviceIDMismatch
+		res.Error = "expected device " + expected.String()
+		return res
+	}
+	if err := certs[0].VerifyHostname(certName); err != nil {
+		res.Reason = probeCertNameMismatch
+		res.Error = err.Error()
+		return res
+	}
+
+	res.OK = true
+	res.Reason = probeOK
+	return res
+}
+
+// connectFailure returns the reason a TCP connection attempt failed with
+// err.
+func connectFailure(err error) string {
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return probeTimeout
+	}
+	if oe, ok := err.(*net.OpError); ok {
+		err = oe.Err
+		if se, ok := err.(*os.SyscallError); ok {
+			err = se.Err
+		}
+	}
+	switch err {
+	case syscall.ECONNREFUSED:
+		return probeRefused
+	case syscall.ENETUNREACH, syscall.EHOSTUNREACH:
+		return probeUnreachable
+	}
+	return probeNetworkError
+}
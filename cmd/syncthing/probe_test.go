@@ -0,0 +1,106 @@
+// Copyright (C) 2014 The Syncthing Authors.
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for
+// more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/syncthing/syncthing/internal/protocol"
+)
+
+func TestProbeAddress(t *testing.T) {
+	dir, err := ioutil.TempDir("", "probe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	newCertificate(dir, "", tlsDefaultCommonName)
+	srvCert, err := loadCert(dir, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srvID := protocol.NewDeviceID(srvCert.Certificate[0])
+
+	// Newer Go versions only verify names against the alternative names of
+	// certificates, which ours don't have.
+	leaf, err := x509.ParseCertificate(srvCert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	okReason := probeOK
+	if leaf.VerifyHostname(tlsDefaultCommonName) != nil {
+		okReason = probeCertNameMismatch
+	}
+
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{srvCert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				conn.(*tls.Conn).Handshake()
+				conn.Close()
+			}()
+		}
+	}()
+	addr := listener.Addr().String()
+
+	// An address nothing listens on
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closedAddr := closed.Addr().String()
+	closed.Close()
+
+	otherID, _ := protocol.DeviceIDFromString("AIR6LPZ-7K4PTTV-UXQSMUU-CPQ5YWH-OEDFIIQ-JUG777G-2YQXXR5-YD6AWQR")
+	clientCfg := &tls.Config{InsecureSkipVerify: true}
+	cases := []struct {
+		addr     string
+		expected protocol.DeviceID
+		certName string
+		reason   string
+	}{
+		{addr, srvID, tlsDefaultCommonName, okReason},
+		{addr, protocol.DeviceID{}, tlsDefaultCommonName, okReason},
+		{addr, otherID, tlsDefaultCommonName, probeDeviceIDMismatch},
+		{addr, srvID, "other", probeCertNameMismatch},
+		{closedAddr, srvID, tlsDefaultCommonName, probeRefused},
+		{"nonexistent.invalid:22000", srvID, tlsDefaultCommonName, probeResolveFailed},
+	}
+	for _, tc := range cases {
+		res := probeAddress(tc.addr, tc.expected, tc.certName, clientCfg, time.Second)
+		if res.Reason != tc.reason {
+			t.Errorf("probe %s for %s: reason %q (%s), expected %q", tc.addr, tc.expected, res.Reason, res.Error, tc.reason)
+		}
+		if res.OK != (tc.reason == probeOK) {
+			t.Errorf("probe %s for %s: unexpected ok %v", tc.addr, tc.expected, res.OK)
+		}
+	}
+}
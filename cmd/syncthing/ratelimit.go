@@ -0,0 +1,41 @@
+// Copyright (C) 2014 The Syncthing Authors.
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for
+// more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"github.com/juju/ratelimit"
+	"github.com/syncthing/syncthing/internal/config"
+)
+
+// rateLimitBucket returns a bucket limiting traffic to the given rate,
+// allowing bursts of five seconds worth of it.
+func rateLimitBucket(kbps int) *ratelimit.Bucket {
+	return ratelimit.NewBucketWithRate(float64(1000*kbps), int64(5*1000*kbps))
+}
+
+// deviceRateLimits returns the buckets limiting the traffic sent to and
+// received from the device. Limits set for the device apply to its
+// connections alone, instead of the global limits shared by all devices.
+func deviceRateLimits(deviceCfg config.DeviceConfiguration) (send, recv *ratelimit.Bucket) {
+	send, recv = writeRateLimit, readRateLimit
+	if deviceCfg.MaxSendKbps > 0 {
+		send = rateLimitBucket(deviceCfg.MaxSendKbps)
+	}
+	if deviceCfg.MaxRecvKbps > 0 {
+		recv = rateLimitBucket(deviceCfg.MaxRecvKbps)
+	}
+	return send, recv
+}
@@ -0,0 +1,52 @@
+// Copyright (C) 2014 The Syncthing Authors.
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for
+// more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"testing"
+
+	"github.com/syncthing/syncthing/internal/config"
+)
+
+func TestDeviceRateLimits(t *testing.T) {
+	defer func() {
+		writeRateLimit, readRateLimit = nil, nil
+	}()
+
+	// Without any limits, nothing is limited.
+	if send, recv := deviceRateLimits(config.DeviceConfiguration{}); send != nil || recv != nil {
+		t.Errorf("Unexpected limits %v, %v", send, recv)
+	}
+
+	// The global limits apply, unless the device has its own.
+	writeRateLimit, readRateLimit = rateLimitBucket(100), rateLimitBucket(200)
+	if send, recv := deviceRateLimits(config.DeviceConfiguration{}); send != writeRateLimit || recv != readRateLimit {
+		t.Errorf("Unexpected limits %v, %v; expected the global ones", send, recv)
+	}
+
+	send, recv := deviceRateLimits(config.DeviceConfiguration{MaxSendKbps: 10})
+	if send == writeRateLimit || send.Rate() != 10000 {
+		t.Errorf("Unexpected send limit %v", send)
+	}
+	if recv != readRateLimit {
+		t.Errorf("Unexpected receive limit %v; expected the global one", recv)
+	}
+
+	send, recv = deviceRateLimits(config.DeviceConfiguration{MaxSendKbps: 10, MaxRecvKbps: 20})
+	if send.Rate() != 10000 || recv.Rate() != 20000 {
+		t.Errorf("Unexpected rates %v, %v", send.Rate(), recv.Rate())
+	}
+}
@@ -99,6 +99,17 @@ func newCertificate(dir, prefix, name string) {
 	}
 }
 
+// tlsTimeoutHandshake runs the TLS handshake on the connection and fails if
+// it hasn't completed within the timeout. A zero timeout means no limit.
+func tlsTimeoutHandshake(tc *tls.Conn, timeout time.Duration) error {
+	if timeout > 0 {
+		tc.SetDeadline(time.Now().Add(timeout))
+	}
+	err := tc.Handshake()
+	tc.SetDeadline(time.Time{})
+	return err
+}
+
 type DowngradingListener struct {
 	net.Listener
 	TLSConfig *tls.Config
@@ -25,6 +25,7 @@ import (
 	"runtime"
 	"time"
 
+	"github.com/syncthing/syncthing/internal/dialer"
 	"github.com/syncthing/syncthing/internal/model"
 )
 
@@ -89,12 +90,12 @@ func sendUsageReport(m *model.Model) error {
 	var b bytes.Buffer
 	json.NewEncoder(&b).Encode(d)
 
-	var client = http.DefaultClient
+	var client = dialer.HTTPClient
 	if BuildEnv == "android" {
 		// This works around the lack of DNS resolution on Android... :(
 		tr := &http.Transport{
 			Dial: func(network, addr string) (net.Conn, error) {
-				return net.Dial(network, "194.126.249.13:443")
+				return dialer.Dial(network, "194.126.249.13:443")
 			},
 		}
 		client = &http.Client{Transport: tr}
@@ -17,6 +17,7 @@ angular.module('syncthing.core')
             refreshConnectionStats();
             refreshDeviceStats();
             refreshFolderStats();
+            refreshPending();
 
             $http.get(urlbase + '/version').success(function (data) {
                 $scope.version = data.version;
@@ -203,6 +204,7 @@ angular.module('syncthing.core')
 
         $scope.$on('ConfigSaved', function (event, arg) {
             updateLocalConfig(arg.data);
+            refreshPending();
 
             $http.get(urlbase + '/config/sync').success(function (data) {
                 $scope.configInSync = data.configInSync;
@@ -393,8 +395,38 @@ angular.module('syncthing.core')
             }).error($scope.emitHTTPError);
         }
 
+        function refreshPending() {
+            // The pending devices and folders are kept in the same form as
+            // the rejection events, so the notifications look the same.
+            $http.get(urlbase + '/cluster/pending').success(function (data) {
+                $scope.deviceRejections = {};
+                (data.devices || []).forEach(function (d) {
+                    $scope.deviceRejections[d.DeviceID] = {
+                        time: d.Time,
+                        data: {
+                            device: d.DeviceID,
+                            address: d.Address
+                        }
+                    };
+                });
+                $scope.folderRejections = {};
+                (data.folders || []).forEach(function (f) {
+                    $scope.folderRejections[f.Folder + "-" + f.DeviceID] = {
+                        time: f.Time,
+                        data: {
+                            folder: f.Folder,
+                            device: f.DeviceID
+                        }
+                    };
+                });
+                console.log("refreshPending", data);
+            }).error($scope.emitHTTPError);
+        }
+
         function refreshNeed(folder) {
-            $http.get(urlbase + "/need?folder=" + encodeURIComponent(folder)).success(function (data) {
+            var url = urlbase + "/db/need?folder=" + encodeURIComponent(folder);
+            url += "&page=" + $scope.neededCurrentPage + "&perpage=" + $scope.neededPageSize;
+            $http.get(url).success(function (data) {
                 if ($scope.neededFolder == folder) {
                     console.log("refreshNeed", folder, data);
                     $scope.needed = data;
@@ -823,6 +855,7 @@ angular.module('syncthing.core')
 
         $scope.dismissDeviceRejection = function (device) {
             delete $scope.deviceRejections[device];
+            $http.post(urlbase + '/cluster/pending/dismiss?device=' + encodeURIComponent(device));
         };
 
         $scope.ignoreRejectedDevice = function (device) {
@@ -1019,6 +1052,7 @@ angular.module('syncthing.core')
 
         $scope.dismissFolderRejection = function (folder, device) {
             delete $scope.folderRejections[folder + "-" + device];
+            $http.post(urlbase + '/cluster/pending/dismiss?folder=' + encodeURIComponent(folder) + '&device=' + encodeURIComponent(device));
         };
 
         $scope.sharesFolder = function (folderCfg) {
@@ -1123,6 +1157,7 @@ angular.module('syncthing.core')
 
         $scope.showNeed = function (folder) {
             $scope.neededFolder = folder;
+            $scope.neededCurrentPage = 1;
             refreshNeed(folder);
             $('#needed').modal().on('hidden.bs.modal', function () {
                 $scope.neededFolder = undefined;
@@ -1130,6 +1165,24 @@ angular.module('syncthing.core')
             });
         };
 
+        $scope.neededPageSize = 100;
+
+        $scope.neededPages = function () {
+            if (!$scope.needed) {
+                return 1;
+            }
+            return Math.max(1, Math.ceil($scope.needed.total / $scope.neededPageSize));
+        };
+
+        $scope.neededPageChange = function (delta) {
+            var page = $scope.neededCurrentPage + delta;
+            if (page < 1 || page > $scope.neededPages()) {
+                return;
+            }
+            $scope.neededCurrentPage = page;
+            refreshNeed($scope.neededFolder);
+        };
+
         $scope.needAction = function (file) {
             var fDelete = 4096;
             var fDirectory = 16384;
@@ -1162,7 +1215,9 @@ angular.module('syncthing.core')
         };
 
         $scope.bumpFile = function (folder, file) {
-            $http.post(urlbase + "/bump?folder=" + encodeURIComponent(folder) + "&file=" + encodeURIComponent(file)).success(function (data) {
+            var url = urlbase + "/bump?folder=" + encodeURIComponent(folder) + "&file=" + encodeURIComponent(file);
+            url += "&page=" + $scope.neededCurrentPage + "&perpage=" + $scope.neededPageSize;
+            $http.post(url).success(function (data) {
                 if ($scope.neededFolder == folder) {
                     console.log("bumpFile", folder, data);
                     $scope.needed = data;
@@ -0,0 +1,18 @@
+angular.module('syncthing.core')
+    .filter('duration', function () {
+        return function (input) {
+            if (input === undefined || input < 60) {
+                return 'less than a minute';
+            }
+            if (input < 60 * 60) {
+                input = Math.round(input / 60);
+                return input + (input === 1 ? ' minute' : ' minutes');
+            }
+            if (input < 24 * 60 * 60) {
+                input = Math.round(input / (60 * 60));
+                return input + (input === 1 ? ' hour' : ' hours');
+            }
+            input = Math.round(input / (24 * 60 * 60));
+            return input + (input === 1 ? ' day' : ' days');
+        };
+    });
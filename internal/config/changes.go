@@ -0,0 +1,144 @@
+// Copyright (C) 2014 The Syncthing Authors.
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for
+// more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package config
+
+import (
+	"reflect"
+
+	"github.com/syncthing/syncthing/internal/protocol"
+)
+
+// Changes describes which parts of the configuration differ between two
+// versions of it. Folders and devices are identified by their IDs.
+type Changes struct {
+	FoldersAdded   []string
+	FoldersRemoved []string
+	FoldersChanged []string
+	FoldersTuned   []string // Only the copiers, pullers, hashers or selected directories differ
+	DevicesAdded   []protocol.DeviceID
+	DevicesRemoved []protocol.DeviceID
+	DevicesChanged []protocol.DeviceID
+	Options        bool // Any of the generic options
+	OptionsTuned   bool // Only options that are read again at each use differ
+	GUI            bool // The GUI settings, other than the credentials
+	GUIAuth        bool // The GUI user or password
+	IgnoredDevices bool
+}
+
+// Diff returns the changes needed to go from one configuration to the other.
+func Diff(from, to Configuration) Changes {
+	var ch Changes
+
+	fromFolders := make(map[string]FolderConfiguration, len(from.Folders))
+	for _, folder := range from.Folders {
+		fromFolders[folder.ID] = from.resolveGroups(folder)
+	}
+	toFolders := make(map[string]bool, len(to.Folders))
+	for _, folder := range to.Folders {
+		// Tagging a device changes the folders shared with its groups.
+		folder = to.resolveGroups(folder)
+		toFolders[folder.ID] = true
+		if old, ok := fromFolders[folder.ID]; !ok {
+			ch.FoldersAdded = append(ch.FoldersAdded, folder.ID)
+		} else if !reflect.DeepEqual(old, folder) {
+			tuned := old
+			tuned.Copiers, tuned.Pullers, tuned.Hashers = folder.Copiers, folder.Pullers, folder.Hashers
+			tuned.SelectedDirs = folder.SelectedDirs
+			if reflect.DeepEqual(tuned, folder) {
+				ch.FoldersTuned = append(ch.FoldersTuned, folder.ID)
+			} else {
+				ch.FoldersChanged = append(ch.FoldersChanged, folder.ID)
+			}
+		}
+	}
+	for _, folder := range from.Folders {
+		if !toFolders[folder.ID] {
+			ch.FoldersRemoved = append(ch.FoldersRemoved, folder.ID)
+		}
+	}
+
+	fromDevices := make(map[protocol.DeviceID]DeviceConfiguration, len(from.Devices))
+	for _, device := range from.Devices {
+		fromDevices[device.DeviceID] = device
+	}
+	toDevices := make(map[protocol.DeviceID]bool, len(to.Devices))
+	for _, device := range to.Devices {
+		toDevices[device.DeviceID] = true
+		if old, ok := fromDevices[device.DeviceID]; !ok {
+			ch.DevicesAdded = append(ch.DevicesAdded, device.DeviceID)
+		} else if !reflect.DeepEqual(old, device) {
+			ch.DevicesChanged = append(ch.DevicesChanged, device.DeviceID)
+		}
+	}
+	for _, device := range from.Devices {
+		if !toDevices[device.DeviceID] {
+			ch.DevicesRemoved = append(ch.DevicesRemoved, device.DeviceID)
+		}
+	}
+
+	if !reflect.DeepEqual(from.Options, to.Options) {
+		ch.Options = true
+		tuned := from.Options
+		// The progress emitter is only started when enabled at startup.
+		if from.Options.ProgressUpdateIntervalS > -1 && to.Options.ProgressUpdateIntervalS > -1 {
+			tuned.ProgressUpdateIntervalS = to.Options.ProgressUpdateIntervalS
+		}
+		tuned.ReconnectIntervalS = to.Options.ReconnectIntervalS
+		tuned.KeepTemporariesH = to.Options.KeepTemporariesH
+		tuned.ScanIOPriority = to.Options.ScanIOPriority
+		tuned.MinClientVersion = to.Options.MinClientVersion
+		tuned.AutoAcceptFolderPath = to.Options.AutoAcceptFolderPath
+		tuned.URAccepted, tuned.URUniqueID = to.Options.URAccepted, to.Options.URUniqueID
+		ch.OptionsTuned = reflect.DeepEqual(tuned, to.Options)
+	}
+
+	fromGUI, toGUI := from.GUI, to.GUI
+	ch.GUIAuth = fromGUI.User != toGUI.User || fromGUI.Password != toGUI.Password
+	fromGUI.User, fromGUI.Password = toGUI.User, toGUI.Password
+	ch.GUI = !reflect.DeepEqual(fromGUI, toGUI)
+
+	ch.IgnoredDevices = len(from.IgnoredDevices) != len(to.IgnoredDevices)
+	for i := 0; !ch.IgnoredDevices && i < len(to.IgnoredDevices); i++ {
+		ch.IgnoredDevices = from.IgnoredDevices[i] != to.IgnoredDevices[i]
+	}
+
+	return ch
+}
+
+// Empty returns true if nothing changed.
+func (ch Changes) Empty() bool {
+	return !ch.Folders() && !ch.Devices() && !ch.Options && !ch.GUI && !ch.GUIAuth && !ch.IgnoredDevices
+}
+
+// Folders returns true if any folder was added, removed, changed or tuned.
+func (ch Changes) Folders() bool {
+	return len(ch.FoldersAdded)+len(ch.FoldersRemoved)+len(ch.FoldersChanged)+len(ch.FoldersTuned) > 0
+}
+
+// Devices returns true if any device was added, removed or changed.
+func (ch Changes) Devices() bool {
+	return len(ch.DevicesAdded)+len(ch.DevicesRemoved)+len(ch.DevicesChanged) > 0
+}
+
+// RequiresRestart returns true if the changes can't all be applied to a
+// running instance. Devices can be added and changed, folders and options
+// can be tuned, and the GUI credentials are checked against the current
+// configuration on each request.
+func (ch Changes) RequiresRestart() bool {
+	folders := len(ch.FoldersAdded)+len(ch.FoldersRemoved)+len(ch.FoldersChanged) > 0
+	options := ch.Options && !ch.OptionsTuned
+	return folders || len(ch.DevicesRemoved) > 0 || options || ch.GUI
+}
@@ -17,6 +17,7 @@
 package config
 
 import (
+	"encoding/json"
 	"encoding/xml"
 	"fmt"
 	"io"
@@ -26,8 +27,11 @@ import (
 	"reflect"
 	"sort"
 	"strconv"
+	"strings"
+	"time"
 
-	"github.com/calmh/logger"
+	"github.com/syncthing/syncthing/internal/cron"
+	"github.com/syncthing/syncthing/internal/logger"
 	"github.com/syncthing/syncthing/internal/osutil"
 	"github.com/syncthing/syncthing/internal/protocol"
 	"golang.org/x/crypto/bcrypt"
@@ -52,17 +56,49 @@ type Configuration struct {
 }
 
 type FolderConfiguration struct {
-	ID              string                      `xml:"id,attr"`
-	Path            string                      `xml:"path,attr"`
-	Devices         []FolderDeviceConfiguration `xml:"device"`
-	ReadOnly        bool                        `xml:"ro,attr"`
-	RescanIntervalS int                         `xml:"rescanIntervalS,attr" default:"60"`
-	IgnorePerms     bool                        `xml:"ignorePerms,attr"`
-	Versioning      VersioningConfiguration     `xml:"versioning"`
-	LenientMtimes   bool                        `xml:"lenientMtimes"`
-	Copiers         int                         `xml:"copiers" default:"1"`  // This defines how many files are handled concurrently.
-	Pullers         int                         `xml:"pullers" default:"16"` // Defines how many blocks are fetched at the same time, possibly between separate copier routines.
-	Hashers         int                         `xml:"hashers" default:"0"`  // Less than one sets the value to the number of cores. These are CPU bound due to hashing.
+	ID                          string                      `xml:"id,attr"`
+	Path                        string                      `xml:"path,attr"`
+	Devices                     []FolderDeviceConfiguration `xml:"device"`
+	ReadOnly                    bool                        `xml:"ro,attr"`
+	ReceiveOnly                 bool                        `xml:"receiveOnly,attr"`    // Local changes are not announced to other devices and are reverted to the global version of the file.
+	Type                        string                      `xml:"type,attr,omitempty"` // One of the FolderType* constants
+	RescanIntervalS             int                         `xml:"rescanIntervalS,attr" default:"60"`
+	RescanSchedule              string                      `xml:"rescanSchedule,attr,omitempty"` // Cron expression; overrides RescanIntervalS when set
+	IgnorePerms                 bool                        `xml:"ignorePerms,attr"`
+	Versioning                  VersioningConfiguration     `xml:"versioning"`
+	LenientMtimes               bool                        `xml:"lenientMtimes"`
+	Copiers                     int                         `xml:"copiers" default:"1"`         // This defines how many files are handled concurrently.
+	Pullers                     int                         `xml:"pullers" default:"16"`        // Defines how many blocks are fetched at the same time, possibly between separate copier routines.
+	Hashers                     int                         `xml:"hashers" default:"0"`         // Less than one sets the value to the number of cores. These are CPU bound due to hashing.
+	PlaceholderMode             bool                        `xml:"placeholderMode"`             // Create empty placeholder files instead of pulling contents, until materialized on demand.
+	Priorities                  []FolderPriority            `xml:"priority"`                    // Pull order of files; the first matching pattern decides.
+	SyncXattrs                  bool                        `xml:"syncXattrs"`                  // Sync extended attributes of files and directories, where supported.
+	SyncOwnership               bool                        `xml:"syncOwnership"`               // Sync the numeric uid/gid of files and directories; applied only when running as root. Ids are not mapped between systems.
+	PreserveHardlinks           bool                        `xml:"preserveHardlinks"`           // Recreate files that are hard linked with each other within the folder as hard links, where supported.
+	RequireDirectConnection     bool                        `xml:"requireDirectConnection"`     // Don't sync the folder with devices connected through a relay.
+	AppendOnlyHashing           bool                        `xml:"appendOnlyHashing"`           // Only hash the appended data of files that have grown, checking just the last previously hashed block.
+	UseLongPaths                bool                        `xml:"useLongPaths"`                // Access files with paths in a form not subject to the length limit of the operating system (Windows only).
+	TempDir                     string                      `xml:"tempDir,omitempty"`           // Keep temporary files here while pulling, instead of next to the files. Should be on the same filesystem as the folder.
+	DisableDefaultIgnores       bool                        `xml:"disableDefaultIgnores"`       // Don't apply Options.DefaultIgnores to this folder.
+	DeletionGracePeriodS        int                         `xml:"deletionGracePeriodS"`        // Hold back local deletions this long before announcing them to other devices; 0 to announce them at once.
+	AllowAbsoluteSymlinks       bool                        `xml:"allowAbsoluteSymlinks"`       // Create symlinks with absolute targets. Symlinks with relative targets outside the folder are never created.
+	SelectedDirs                []string                    `xml:"selectedDir"`                 // Only pull the files in these top level directories; all of them when empty. Other devices still see the folder as shared with us.
+	AtomicReplace               bool                        `xml:"atomicReplace"`               // Never write to the existing file while pulling; the new version is built and verified in the temporary file, then renamed into place.
+	SkipUnreadable              bool                        `xml:"skipUnreadable"`              // Skip files and directories that can't be read for lack of permission without warning about them; they are listed in the folder status either way, and never taken as deleted.
+	SyncCreationTime            bool                        `xml:"syncCreationTime"`            // Sync the creation time of files and directories, where the operating system keeps one (Windows and Mac OS X).
+	MinConnectedDevices         int                         `xml:"minConnectedDevices"`         // Only pull once at least this many of the devices sharing the folder are connected; it's scanned regardless.
+	ScanTimeBudgetMs            int                         `xml:"scanTimeBudgetMs"`            // Let scans run this long at a time before pulling the changes that came in meanwhile; 0 to scan without interruption.
+	SharedGroups                []string                    `xml:"sharedGroup"`                 // Also share the folder with all devices tagged with any of these groups.
+	RemovableDrive              bool                        `xml:"removableDrive"`              // The folder is the mount point of a removable drive. While its path isn't a mount point or has no marker the folder waits for the drive, instead of being stopped, and its files are never taken as deleted.
+	SyncFileAttributes          bool                        `xml:"syncFileAttributes"`          // Sync the hidden, system, read only and immutable attributes of files and directories, where the operating system keeps them.
+	InitialSyncUnlimited        bool                        `xml:"initialSyncUnlimited"`        // Receive from the devices sharing the folder without rate limits until it has been in sync once.
+	VerifyAssembledFiles        bool                        `xml:"verifyAssembledFiles"`        // Hash each pulled file once more when it's complete, and pull it again instead of renaming it into place if it doesn't match; always done with AtomicReplace.
+	ConflictDir                 string                      `xml:"conflictDir,omitempty"`       // Write conflict copies into this directory, relative to the folder and mirroring the paths of the files, instead of beside them. Its contents are never synced.
+	ScanFilesPerSecond          int                         `xml:"scanFilesPerSecond"`          // Look at no more than this many files and directories per second while scanning, to limit the load on the file system; 0 for no limit.
+	SyncDirMtimes               bool                        `xml:"syncDirMtimes"`               // Sync the modification times of directories; they're set again once the contents of a directory have been pulled.
+	AutoPauseChangeThresholdPct int                         `xml:"autoPauseChangeThresholdPct"` // Pause the folder, instead of pulling, when the other devices change or delete more than this percentage of our files before we're in sync again; 0 to never pause.
+	Paused                      bool                        `xml:"paused,attr"`
+	PausedUntil                 *time.Time                  `xml:"pausedUntil,attr,omitempty"` // Resume automatically at this time, if set
 
 	Invalid string `xml:"-"` // Set at runtime when there is an error, not saved
 
@@ -94,6 +130,39 @@ func (f *FolderConfiguration) HasMarker() bool {
 	return true
 }
 
+// FilesystemPath returns the path to access the files in the folder by. It
+// is the configured path, unless long paths are used.
+func (f *FolderConfiguration) FilesystemPath() string {
+	if f.UseLongPaths {
+		return osutil.LongPath(f.Path)
+	}
+	return f.Path
+}
+
+// Pulls returns whether changes from other devices are pulled into the
+// folder.
+func (f *FolderConfiguration) Pulls() bool {
+	return !f.ReadOnly && f.Type != FolderTypeAudit
+}
+
+// Selected returns whether the file of the given name, relative to the folder,
+// is in one of the selected top level directories, or there is no selection.
+func (f *FolderConfiguration) Selected(name string) bool {
+	if len(f.SelectedDirs) == 0 {
+		return true
+	}
+	top := filepath.ToSlash(name)
+	if i := strings.IndexByte(top, '/'); i >= 0 {
+		top = top[:i]
+	}
+	for _, dir := range f.SelectedDirs {
+		if top == strings.Trim(filepath.ToSlash(dir), "/") {
+			return true
+		}
+	}
+	return false
+}
+
 func (f *FolderConfiguration) DeviceIDs() []protocol.DeviceID {
 	if f.deviceIDs == nil {
 		for _, n := range f.Devices {
@@ -103,6 +172,64 @@ func (f *FolderConfiguration) DeviceIDs() []protocol.DeviceID {
 	return f.deviceIDs
 }
 
+// HasTag returns whether the device is in the given group.
+func (d DeviceConfiguration) HasTag(tag string) bool {
+	for _, t := range d.Tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// resolveGroups returns the folder with the devices in its shared groups
+// added to the devices it's shared with. The added devices have Group set.
+func (cfg *Configuration) resolveGroups(folder FolderConfiguration) FolderConfiguration {
+	if len(folder.SharedGroups) == 0 {
+		return folder
+	}
+
+	present := make(map[protocol.DeviceID]bool, len(folder.Devices))
+	for _, dev := range folder.Devices {
+		present[dev.DeviceID] = true
+	}
+	devices := append([]FolderDeviceConfiguration(nil), folder.Devices...)
+	for _, group := range folder.SharedGroups {
+		for _, dev := range cfg.Devices {
+			if present[dev.DeviceID] || !dev.HasTag(group) {
+				continue
+			}
+			devices = append(devices, FolderDeviceConfiguration{DeviceID: dev.DeviceID, Group: group})
+			present[dev.DeviceID] = true
+		}
+	}
+	sort.Sort(FolderDeviceConfigurationList(devices))
+
+	folder.Devices = devices
+	folder.deviceIDs = nil
+	return folder
+}
+
+// explicitDevices returns the devices a folder is shared with, other than
+// through its shared groups.
+func explicitDevices(devices []FolderDeviceConfiguration) []FolderDeviceConfiguration {
+	var explicit []FolderDeviceConfiguration
+	for _, dev := range devices {
+		if dev.Group == "" {
+			explicit = append(explicit, dev)
+		}
+	}
+	return explicit
+}
+
+// A FolderPriority gives files matching the pattern a pull priority. Files
+// with higher priority are pulled first; the default priority is zero. The
+// pattern syntax is the same as in ignore files.
+type FolderPriority struct {
+	Pattern  string `xml:"pattern,attr"`
+	Priority int    `xml:"priority,attr"`
+}
+
 type VersioningConfiguration struct {
 	Type   string `xml:"type,attr"`
 	Params map[string]string
@@ -145,43 +272,81 @@ func (c *VersioningConfiguration) UnmarshalXML(d *xml.Decoder, start xml.StartEl
 }
 
 type DeviceConfiguration struct {
-	DeviceID    protocol.DeviceID `xml:"id,attr"`
-	Name        string            `xml:"name,attr,omitempty"`
-	Addresses   []string          `xml:"address,omitempty"`
-	Compression bool              `xml:"compression,attr"`
-	CertName    string            `xml:"certName,attr,omitempty"`
-	Introducer  bool              `xml:"introducer,attr"`
+	DeviceID          protocol.DeviceID `xml:"id,attr"`
+	Name              string            `xml:"name,attr,omitempty"`
+	Addresses         []string          `xml:"address,omitempty"`
+	Compression       bool              `xml:"compression,attr"`
+	CertName          string            `xml:"certName,attr,omitempty"`
+	Introducer        bool              `xml:"introducer,attr"`
+	AutoAcceptFolders bool              `xml:"autoAcceptFolders,attr"`     // Add the folders offered by the device under AutoAcceptFolderPath
+	MaxSendKbps       int               `xml:"maxSendKbps,attr,omitempty"` // Overrides Options.MaxSendKbps for connections to the device, when set
+	MaxRecvKbps       int               `xml:"maxRecvKbps,attr,omitempty"` // Overrides Options.MaxRecvKbps for connections to the device, when set
+	Paused            bool              `xml:"paused,attr"`
+	PausedUntil       *time.Time        `xml:"pausedUntil,attr,omitempty"` // Resume automatically at this time, if set
+	Tags              []string          `xml:"tag,omitempty"`              // The groups the device is in, for folders shared by group
 }
 
 type FolderDeviceConfiguration struct {
 	DeviceID protocol.DeviceID `xml:"id,attr"`
+	Observer bool              `xml:"observer,attr"` // The device only receives the folder; its index is ignored and nothing is pulled from it.
+	Override bool              `xml:"override,attr"` // With Observer, our version of the files the device changes is announced again, so that its changes are reverted.
+	Group    string            `xml:"-" json:"-"`    // Set at runtime when the device shares the folder through this group, not saved
 
 	Deprecated_Name      string   `xml:"name,attr,omitempty" json:"-"`
 	Deprecated_Addresses []string `xml:"address,omitempty" json:"-"`
 }
 
 type OptionsConfiguration struct {
-	ListenAddress           []string `xml:"listenAddress" default:"0.0.0.0:22000"`
-	GlobalAnnServers        []string `xml:"globalAnnounceServer" default:"udp4://announce.syncthing.net:22026"`
-	GlobalAnnEnabled        bool     `xml:"globalAnnounceEnabled" default:"true"`
-	LocalAnnEnabled         bool     `xml:"localAnnounceEnabled" default:"true"`
-	LocalAnnPort            int      `xml:"localAnnouncePort" default:"21025"`
-	LocalAnnMCAddr          string   `xml:"localAnnounceMCAddr" default:"[ff32::5222]:21026"`
-	MaxSendKbps             int      `xml:"maxSendKbps"`
-	MaxRecvKbps             int      `xml:"maxRecvKbps"`
-	ReconnectIntervalS      int      `xml:"reconnectionIntervalS" default:"60"`
-	StartBrowser            bool     `xml:"startBrowser" default:"true"`
-	UPnPEnabled             bool     `xml:"upnpEnabled" default:"true"`
-	UPnPLease               int      `xml:"upnpLeaseMinutes" default:"0"`
-	UPnPRenewal             int      `xml:"upnpRenewalMinutes" default:"30"`
-	URAccepted              int      `xml:"urAccepted"` // Accepted usage reporting version; 0 for off (undecided), -1 for off (permanently)
-	URUniqueID              string   `xml:"urUniqueID"` // Unique ID for reporting purposes, regenerated when UR is turned on.
-	RestartOnWakeup         bool     `xml:"restartOnWakeup" default:"true"`
-	AutoUpgradeIntervalH    int      `xml:"autoUpgradeIntervalH" default:"12"` // 0 for off
-	KeepTemporariesH        int      `xml:"keepTemporariesH" default:"24"`     // 0 for off
-	CacheIgnoredFiles       bool     `xml:"cacheIgnoredFiles" default:"true"`
-	ProgressUpdateIntervalS int      `xml:"progressUpdateIntervalS" default:"5"`
-	SymlinksEnabled         bool     `xml:"symlinksEnabled" default:"true"`
+	ListenAddress               []string `xml:"listenAddress" default:"0.0.0.0:22000"`
+	GlobalAnnServers            []string `xml:"globalAnnounceServer" default:"udp4://announce.syncthing.net:22026"`
+	GlobalAnnEnabled            bool     `xml:"globalAnnounceEnabled" default:"true"`
+	GlobalAnnLookupOnly         bool     `xml:"globalAnnounceLookupOnly"` // Only look up other devices; never announce our own addresses, so they must find us some other way
+	GlobalAnnIntervalS          int      `xml:"globalAnnounceIntervalS" default:"1800"`
+	LocalAnnEnabled             bool     `xml:"localAnnounceEnabled" default:"true"`
+	LocalAnnPort                int      `xml:"localAnnouncePort" default:"21025"`
+	LocalAnnMCAddr              string   `xml:"localAnnounceMCAddr" default:"[ff32::5222]:21026"`
+	MaxSendKbps                 int      `xml:"maxSendKbps"`
+	MaxRecvKbps                 int      `xml:"maxRecvKbps"`
+	ReconnectIntervalS          int      `xml:"reconnectionIntervalS" default:"60"`
+	StartBrowser                bool     `xml:"startBrowser" default:"true"`
+	UPnPEnabled                 bool     `xml:"upnpEnabled" default:"true"`
+	UPnPLease                   int      `xml:"upnpLeaseMinutes" default:"0"`
+	UPnPRenewal                 int      `xml:"upnpRenewalMinutes" default:"30"`
+	URAccepted                  int      `xml:"urAccepted"` // Accepted usage reporting version; 0 for off (undecided), -1 for off (permanently)
+	URUniqueID                  string   `xml:"urUniqueID"` // Unique ID for reporting purposes, regenerated when UR is turned on.
+	RestartOnWakeup             bool     `xml:"restartOnWakeup" default:"true"`
+	AutoUpgradeIntervalH        int      `xml:"autoUpgradeIntervalH" default:"12"` // 0 for off
+	KeepTemporariesH            int      `xml:"keepTemporariesH" default:"24"`     // 0 for off
+	CacheIgnoredFiles           bool     `xml:"cacheIgnoredFiles" default:"true"`
+	ProgressUpdateIntervalS     int      `xml:"progressUpdateIntervalS" default:"5"`
+	SymlinksEnabled             bool     `xml:"symlinksEnabled" default:"true"`
+	AllowedNetworks             []string `xml:"allowedNetwork"`                                                 // Networks (CIDR) that may connect to us; empty allows all
+	ConnectionHandshakeTimeoutS int      `xml:"connectionHandshakeTimeoutS" default:"10"`                       // 0 for no timeout
+	MaxPendingHandshakes        int      `xml:"maxPendingHandshakes" default:"64"`                              // 0 for unlimited
+	PullRetryBackoffS           int      `xml:"pullRetryBackoffS" default:"10"`                                 // Delay before retrying a failed file, doubled for each further failure
+	PullMaxAttempts             int      `xml:"pullMaxAttempts" default:"10"`                                   // Failed attempts before a file is given up on until the next scan; 0 for unlimited
+	MultiSourcePull             bool     `xml:"multiSourcePull"`                                                // Spread block requests over the devices that have a file by measured transfer rate
+	MaxRequestKiB               int      `xml:"maxRequestKiB" default:"16384"`                                  // Total size of the requests served to each device at once; 0 for unlimited
+	MaxConcurrentRequests       int      `xml:"maxConcurrentRequests" default:"64"`                             // Requests served to each device at once; 0 for unlimited
+	MaxConcurrentScans          int      `xml:"maxConcurrentScans"`                                             // Folders scanned at once; 0 for unlimited
+	AutoAcceptFolderPath        string   `xml:"autoAcceptFolderPath" default:"~"`                               // Automatically accepted folders are created here, named by their ID
+	FsyncMode                   string   `xml:"fsyncMode" default:"never"`                                      // What is flushed to disk when a pulled file is finished; one of the Fsync* constants
+	ScanIOPriority              string   `xml:"scanIOPriority"`                                                 // I/O priority of the threads hashing files when scanning; one of the IOPriority* constants
+	OutboundProxy               string   `xml:"outboundProxy"`                                                  // Make outgoing connections through this SOCKS5 or HTTP proxy URL; the all_proxy environment variable is used when empty
+	MaxConnections              int      `xml:"maxConnections"`                                                 // Devices connected at once, the most out of sync first; 0 for unlimited
+	StallWatchdogTimeoutM       int      `xml:"stallWatchdogTimeoutM"`                                          // Minutes a scanning or syncing folder may make no progress before all goroutines are dumped to the log; 0 for off
+	StallWatchdogDumpFile       bool     `xml:"stallWatchdogDumpFile"`                                          // Also write the dump of a stall to a file in the configuration directory
+	StallWatchdogRestart        bool     `xml:"stallWatchdogRestart"`                                           // Restart a stalled folder after dumping; the new runner starts once the stuck one returns
+	MinClientVersion            string   `xml:"minClientVersion"`                                               // Connected syncthing devices older than this are warned about; empty for no minimum
+	RequestTimeoutMinS          int      `xml:"requestTimeoutMinS" default:"10"`                                // Shortest time a block request is waited for, for devices that answer quickly; the time adapts to each device's response times
+	RequestTimeoutMaxS          int      `xml:"requestTimeoutMaxS" default:"120"`                               // Longest time a block request is waited for before it's retried from another device; 0 for no timeout
+	ConnectionIdleTimeoutM      int      `xml:"connectionIdleTimeoutM"`                                         // Minutes a connection may have nothing to do before it's closed; it's reestablished when a folder shared with the device changes, or after as long again. 0 for never
+	Preallocate                 string   `xml:"preallocate" default:"auto"`                                     // Whether the space of a pulled file is allocated when its temporary file is created; one of the Preallocate* constants
+	IndexReceiveBufferKiB       int      `xml:"indexReceiveBufferKiB" default:"16384"`                          // Index data received from all devices that's processed at once; devices wait to send more until it's committed to the database. 0 for unlimited
+	BatteryPausePct             int      `xml:"batteryPausePct"`                                                // Pause all devices and folders while running on battery with less charge than this left, until back on AC; 0 to never pause, 100 to always pause on battery
+	LogFormat                   string   `xml:"logFormat" default:"text"`                                       // How log lines are written; one of the LogFormat* constants. Takes effect on restart
+	MaxFolders                  int      `xml:"maxFolders"`                                                     // Folders started at most; the others are stopped with an error at startup. 0 for unlimited
+	DefaultIgnores              []string `xml:"defaultIgnore" default:".DS_Store,Thumbs.db,desktop.ini,@eaDir"` // Ignore patterns applied to all folders in addition to their .stignore
 
 	Deprecated_RescanIntervalS int    `xml:"rescanIntervalS,omitempty" json:"-"`
 	Deprecated_UREnabled       bool   `xml:"urEnabled,omitempty" json:"-"`
@@ -191,13 +356,74 @@ type OptionsConfiguration struct {
 	Deprecated_GUIAddress      string `xml:"guiAddress,omitempty" json:"-"`
 }
 
+// The values of OptionsConfiguration.FsyncMode. With FsyncAlways a pulled
+// file is on disk, under its final name, before it's recorded as synced. With
+// FsyncMetadata the rename is made durable but the data may still be in the
+// OS cache, and after a crash or power loss the file may be truncated or
+// contain garbage. With FsyncNever both are left to the OS, which is the
+// fastest but may also lose or revert recently pulled files, and is the
+// default as nothing was flushed before the option existed. The latter two
+// are safe only when the storage keeps its cache across power loss.
+const (
+	FsyncAlways   = "always"
+	FsyncMetadata = "metadata"
+	FsyncNever    = "never"
+)
+
+// The values of OptionsConfiguration.Preallocate. A preallocated temporary
+// file is laid out in one piece where the filesystem can, and a lack of space
+// fails the file before anything is pulled instead of halfway through. With
+// PreallocateAuto files with all-zero blocks are left sparse instead, and
+// with PreallocateAlways they're allocated as well. Where the filesystem
+// can't preallocate, files are pulled as without.
+const (
+	PreallocateAuto   = "auto"
+	PreallocateAlways = "always"
+	PreallocateNever  = "never"
+)
+
+// The values of OptionsConfiguration.LogFormat. With LogFormatJSON each line
+// is a JSON object with the time, level, facility and message.
+const (
+	LogFormatText = "text"
+	LogFormatJSON = "json"
+)
+
+// The values of FolderConfiguration.Type. An audit folder is scanned and
+// exchanges indexes like any other, but only reports how it differs from the
+// other devices: nothing is pulled into it, and other devices can't pull
+// from it.
+const (
+	FolderTypeNormal = ""
+	FolderTypeAudit  = "audit"
+)
+
+// The values of OptionsConfiguration.ScanIOPriority. Scans at a lower
+// priority leave the disk to other programs when they need it, and take
+// longer while they do. The priority is only changed on Linux.
+const (
+	IOPriorityNormal = ""
+	IOPriorityLow    = "low"
+	IOPriorityIdle   = "idle"
+)
+
+// The number of copier and puller routines of a folder configured with zero
+// of them.
+const (
+	DefaultCopiers = 1
+	DefaultPullers = 16
+)
+
 type GUIConfiguration struct {
-	Enabled  bool   `xml:"enabled,attr" default:"true"`
-	Address  string `xml:"address" default:"127.0.0.1:8080"`
-	User     string `xml:"user,omitempty"`
-	Password string `xml:"password,omitempty"`
-	UseTLS   bool   `xml:"tls,attr"`
-	APIKey   string `xml:"apikey,omitempty"`
+	Enabled         bool     `xml:"enabled,attr" default:"true"`
+	Address         string   `xml:"address" default:"127.0.0.1:8080"`
+	User            string   `xml:"user,omitempty"`
+	Password        string   `xml:"password,omitempty"`
+	UseTLS          bool     `xml:"tls,attr"`
+	APIKey          string   `xml:"apikey,omitempty"`
+	AllowedNetworks []string `xml:"allowedNetwork,omitempty"`      // Networks (CIDR) that may connect to the GUI; empty allows all
+	UnixSocketMode  string   `xml:"unixSocketMode" default:"0660"` // File mode (octal) of the socket, when Address is unix:///path/to/socket
+	AllowedOrigins  []string `xml:"allowedOrigin,omitempty"`       // Origins that may make cross origin REST requests with the API key; "*" allows any and is not recommended
 }
 
 func New(myID protocol.DeviceID) Configuration {
@@ -228,6 +454,28 @@ func ReadXML(r io.Reader, myID protocol.DeviceID) (Configuration, error) {
 	return cfg, err
 }
 
+// ReadJSON reads a configuration in the JSON form used by the REST API. The
+// configuration is upgraded and validated the same way as by ReadXML.
+func ReadJSON(r io.Reader, myID protocol.DeviceID) (Configuration, error) {
+	var cfg Configuration
+
+	setDefaults(&cfg)
+	setDefaults(&cfg.Options)
+	setDefaults(&cfg.GUI)
+
+	err := json.NewDecoder(r).Decode(&cfg)
+	if err != nil {
+		return Configuration{}, err
+	}
+	if cfg.Version < 1 || cfg.Version > CurrentVersion {
+		return Configuration{}, fmt.Errorf("unsupported configuration version %d", cfg.Version)
+	}
+	cfg.OriginalVersion = cfg.Version
+
+	cfg.prepare(myID)
+	return cfg, nil
+}
+
 func (cfg *Configuration) WriteXML(w io.Writer) error {
 	e := xml.NewEncoder(w)
 	e.Indent("", "    ")
@@ -239,6 +487,15 @@ func (cfg *Configuration) WriteXML(w io.Writer) error {
 	return err
 }
 
+// copy returns a copy of the configuration that doesn't share the lists of
+// folders and devices, which are updated in place by the Wrapper.
+func (cfg Configuration) copy() Configuration {
+	cfg.Folders = append([]FolderConfiguration(nil), cfg.Folders...)
+	cfg.Devices = append([]DeviceConfiguration(nil), cfg.Devices...)
+	cfg.IgnoredDevices = append([]protocol.DeviceID(nil), cfg.IgnoredDevices...)
+	return cfg
+}
+
 func (cfg *Configuration) prepare(myID protocol.DeviceID) {
 	fillNilSlices(&cfg.Options)
 
@@ -319,14 +576,7 @@ func (cfg *Configuration) prepare(myID protocol.DeviceID) {
 	}
 
 	// Hash old cleartext passwords
-	if len(cfg.GUI.Password) > 0 && cfg.GUI.Password[0] != '$' {
-		hash, err := bcrypt.GenerateFromPassword([]byte(cfg.GUI.Password), 0)
-		if err != nil {
-			l.Warnln("bcrypting password:", err)
-		} else {
-			cfg.GUI.Password = string(hash)
-		}
-	}
+	cfg.hashPassword()
 
 	// Build a list of available devices
 	existingDevices := make(map[protocol.DeviceID]bool)
@@ -353,10 +603,29 @@ func (cfg *Configuration) prepare(myID protocol.DeviceID) {
 		cfg.Folders[i].Devices = ensureExistingDevices(cfg.Folders[i].Devices, existingDevices)
 		cfg.Folders[i].Devices = ensureNoDuplicates(cfg.Folders[i].Devices)
 		if cfg.Folders[i].Copiers == 0 {
-			cfg.Folders[i].Copiers = 1
+			cfg.Folders[i].Copiers = DefaultCopiers
 		}
 		if cfg.Folders[i].Pullers == 0 {
-			cfg.Folders[i].Pullers = 16
+			cfg.Folders[i].Pullers = DefaultPullers
+		}
+		switch cfg.Folders[i].Type {
+		case FolderTypeNormal, FolderTypeAudit:
+		default:
+			l.Warnf("Folder %q: invalid folder type %q; using a normal folder", cfg.Folders[i].ID, cfg.Folders[i].Type)
+			cfg.Folders[i].Type = FolderTypeNormal
+		}
+		if sched := cfg.Folders[i].RescanSchedule; sched != "" {
+			if _, err := cron.Parse(sched); err != nil {
+				l.Warnf("Folder %q: invalid rescan schedule (%v); using rescan interval instead", cfg.Folders[i].ID, err)
+			}
+		}
+		if dir := cfg.Folders[i].ConflictDir; dir != "" {
+			dir = filepath.Clean(dir)
+			if filepath.IsAbs(dir) || dir == "." || dir == ".." || strings.HasPrefix(dir, ".."+string(filepath.Separator)) {
+				l.Warnf("Folder %q: conflict directory %q is not within the folder; writing conflict copies beside the files", cfg.Folders[i].ID, cfg.Folders[i].ConflictDir)
+				dir = ""
+			}
+			cfg.Folders[i].ConflictDir = dir
 		}
 		sort.Sort(FolderDeviceConfigurationList(cfg.Folders[i].Devices))
 	}
@@ -369,6 +638,34 @@ func (cfg *Configuration) prepare(myID protocol.DeviceID) {
 		}
 	}
 
+	switch cfg.Options.FsyncMode {
+	case FsyncAlways, FsyncMetadata, FsyncNever:
+	default:
+		l.Warnf("Invalid fsync mode %q; using %q", cfg.Options.FsyncMode, FsyncNever)
+		cfg.Options.FsyncMode = FsyncNever
+	}
+
+	switch cfg.Options.Preallocate {
+	case PreallocateAuto, PreallocateAlways, PreallocateNever:
+	default:
+		l.Warnf("Invalid preallocation mode %q; using %q", cfg.Options.Preallocate, PreallocateAuto)
+		cfg.Options.Preallocate = PreallocateAuto
+	}
+
+	switch cfg.Options.LogFormat {
+	case LogFormatText, LogFormatJSON:
+	default:
+		l.Warnf("Invalid log format %q; using %q", cfg.Options.LogFormat, LogFormatText)
+		cfg.Options.LogFormat = LogFormatText
+	}
+
+	switch cfg.Options.ScanIOPriority {
+	case IOPriorityNormal, IOPriorityLow, IOPriorityIdle:
+	default:
+		l.Warnf("Invalid scan I/O priority %q; using normal priority", cfg.Options.ScanIOPriority)
+		cfg.Options.ScanIOPriority = IOPriorityNormal
+	}
+
 	cfg.Options.ListenAddress = uniqueStrings(cfg.Options.ListenAddress)
 	cfg.Options.GlobalAnnServers = uniqueStrings(cfg.Options.GlobalAnnServers)
 
@@ -377,35 +674,26 @@ func (cfg *Configuration) prepare(myID protocol.DeviceID) {
 	}
 }
 
-// ChangeRequiresRestart returns true if updating the configuration requires a
-// complete restart.
-func ChangeRequiresRestart(from, to Configuration) bool {
-	// Adding, removing or changing folders requires restart
-	if !reflect.DeepEqual(from.Folders, to.Folders) {
-		return true
-	}
-
-	// Removing a device requres restart
-	toDevs := make(map[protocol.DeviceID]bool, len(from.Devices))
-	for _, dev := range to.Devices {
-		toDevs[dev.DeviceID] = true
-	}
-	for _, dev := range from.Devices {
-		if _, ok := toDevs[dev.DeviceID]; !ok {
-			return true
+// hashPassword replaces a cleartext GUI password with its bcrypt hash.
+func (cfg *Configuration) hashPassword() {
+	if len(cfg.GUI.Password) > 0 && cfg.GUI.Password[0] != '$' {
+		hash, err := bcrypt.GenerateFromPassword([]byte(cfg.GUI.Password), 0)
+		if err != nil {
+			l.Warnln("bcrypting password:", err)
+		} else {
+			cfg.GUI.Password = string(hash)
 		}
 	}
+}
 
+// ChangeRequiresRestart returns true if updating the configuration requires a
+// complete restart.
+func ChangeRequiresRestart(from, to Configuration) bool {
 	// Changing usage reporting to on or off does not require a restart.
 	to.Options.URAccepted = from.Options.URAccepted
 	to.Options.URUniqueID = from.Options.URUniqueID
 
-	// All of the generic options require restart
-	if !reflect.DeepEqual(from.Options, to.Options) || !reflect.DeepEqual(from.GUI, to.GUI) {
-		return true
-	}
-
-	return false
+	return Diff(from, to).RequiresRestart()
 }
 
 func convertV6V7(cfg *Configuration) {
@@ -586,9 +874,8 @@ func fillNilSlices(data interface{}) error {
 			switch f.Interface().(type) {
 			case []string:
 				if f.IsNil() {
-					rv := reflect.MakeSlice(reflect.TypeOf([]string{}), 1, 1)
-					rv.Index(0).SetString(v)
-					f.Set(rv)
+					// Multiple default values are separated by commas.
+					f.Set(reflect.ValueOf(strings.Split(v, ",")))
 				}
 			}
 		}
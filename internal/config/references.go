@@ -0,0 +1,124 @@
+// Copyright (C) 2014 The Syncthing Authors.
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for
+// more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"regexp"
+	"strings"
+)
+
+// A configuration value on the form ${env:NAME} or ${file:/path} is a
+// reference to the value of an environment variable or the contents of a
+// file. References are resolved when the configuration is loaded, and the
+// reference rather than the resolved value is written back on save, so that
+// secrets can be kept out of the configuration file.
+var referenceExp = regexp.MustCompile(`^\$\{(env|file):(.+)\}$`)
+
+type reference struct {
+	section  int // index into referenceSections
+	field    int
+	ref      string
+	resolved string
+}
+
+// referenceSections returns the parts of the configuration where references
+// are allowed. All string fields in them may be references.
+func referenceSections(cfg *Configuration) []reflect.Value {
+	return []reflect.Value{
+		reflect.ValueOf(&cfg.GUI).Elem(),
+		reflect.ValueOf(&cfg.Options).Elem(),
+	}
+}
+
+// expandReferences replaces all references in the configuration with their
+// resolved values, and returns the references so that they can be restored
+// when saving.
+func expandReferences(cfg *Configuration) ([]reference, error) {
+	var refs []reference
+	for si, s := range referenceSections(cfg) {
+		t := s.Type()
+		for i := 0; i < s.NumField(); i++ {
+			f := s.Field(i)
+			if f.Kind() != reflect.String {
+				continue
+			}
+
+			match := referenceExp.FindStringSubmatch(f.String())
+			if match == nil {
+				continue
+			}
+
+			resolved, err := resolveReference(match[1], match[2])
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", t.Field(i).Name, err)
+			}
+
+			refs = append(refs, reference{
+				section:  si,
+				field:    i,
+				ref:      match[0],
+				resolved: resolved,
+			})
+			f.SetString(resolved)
+		}
+	}
+	return refs, nil
+}
+
+func resolveReference(kind, name string) (string, error) {
+	switch kind {
+	case "env":
+		val, ok := os.LookupEnv(name)
+		if !ok {
+			return "", fmt.Errorf("environment variable %s is not set", name)
+		}
+		return val, nil
+
+	case "file":
+		bs, err := ioutil.ReadFile(name)
+		if err != nil {
+			return "", err
+		}
+		// Secrets files commonly end with a newline that isn't part of the
+		// value.
+		return strings.TrimRight(string(bs), "\r\n"), nil
+
+	default:
+		return "", fmt.Errorf("unknown reference type %q", kind)
+	}
+}
+
+// value returns the current value of the referencing field.
+func (r reference) value(cfg *Configuration) string {
+	return referenceSections(cfg)[r.section].Field(r.field).String()
+}
+
+// restoreReferences puts back the references for all fields that still hold
+// the value the reference resolved to. Fields that were changed since are
+// left with their new value.
+func restoreReferences(cfg *Configuration, refs []reference) {
+	sections := referenceSections(cfg)
+	for _, r := range refs {
+		f := sections[r.section].Field(r.field)
+		if f.String() == r.resolved {
+			f.SetString(r.ref)
+		}
+	}
+}
@@ -16,16 +16,24 @@
 package config
 
 import (
+	"bytes"
+	"encoding/xml"
 	"io/ioutil"
 	"os"
 	"path/filepath"
 	"sync"
+	"time"
 
 	"github.com/syncthing/syncthing/internal/events"
+	"github.com/syncthing/syncthing/internal/fs"
 	"github.com/syncthing/syncthing/internal/osutil"
 	"github.com/syncthing/syncthing/internal/protocol"
 )
 
+// The suffix of the copy of the last known good configuration, kept next to
+// the configuration file itself.
+const backupSuffix = ".backup"
+
 // An interface to handle configuration changes, and a wrapper type á la
 // http.Handler
 
@@ -39,6 +47,14 @@ func (fn HandlerFunc) Changed(cfg Configuration) error {
 	return fn(cfg)
 }
 
+// A ChangeHandler is a Handler that is also told which parts of the
+// configuration changed, so that it can leave everything else alone. It's
+// not called for replaces that don't change anything.
+type ChangeHandler interface {
+	Handler
+	ConfigChanged(cfg Configuration, changes Changes) error
+}
+
 // A wrapper around a Configuration that manages loads, saves and published
 // notifications of changes to registered Handlers
 
@@ -46,6 +62,8 @@ type Wrapper struct {
 	cfg  Configuration
 	path string
 
+	refs []reference
+
 	deviceMap map[protocol.DeviceID]DeviceConfiguration
 	folderMap map[string]FolderConfiguration
 	replaces  chan Configuration
@@ -53,32 +71,62 @@ type Wrapper struct {
 
 	subs []Handler
 	sMut sync.Mutex
+
+	last Configuration // the configuration last sent to handlers; only used by Serve
 }
 
 // Wrap wraps an existing Configuration structure and ties it to a file on
 // disk.
 func Wrap(path string, cfg Configuration) *Wrapper {
-	w := &Wrapper{cfg: cfg, path: path}
+	w := &Wrapper{cfg: cfg, path: path, last: cfg.copy()}
 	w.replaces = make(chan Configuration)
 	go w.Serve()
 	return w
 }
 
 // Load loads an existing file on disk and returns a new configuration
-// wrapper.
+// wrapper. If the file exists but cannot be parsed, the backup of the last
+// known good configuration is loaded instead. References to environment
+// variables and files in the configuration are resolved.
 func Load(path string, myID protocol.DeviceID) (*Wrapper, error) {
-	fd, err := os.Open(path)
-	if err != nil {
+	cfg, err := readFile(path, myID)
+	if os.IsNotExist(err) {
 		return nil, err
 	}
-	defer fd.Close()
+	if err != nil {
+		// The file may have been truncated by a crash or power loss during
+		// save. Try to recover the last known good version.
+		bcfg, berr := readFile(path+backupSuffix, myID)
+		if berr != nil {
+			return nil, err
+		}
+		l.Warnf("Configuration file %s is corrupt (%v); using backup %s", path, err, path+backupSuffix)
+		cfg = bcfg
+	}
 
-	cfg, err := ReadXML(fd, myID)
+	refs, err := expandReferences(&cfg)
 	if err != nil {
 		return nil, err
 	}
+	// A referenced password may be in cleartext; it's hashed in memory only.
+	cfg.hashPassword()
+	for i := range refs {
+		refs[i].resolved = refs[i].value(&cfg)
+	}
 
-	return Wrap(path, cfg), nil
+	w := Wrap(path, cfg)
+	w.refs = refs
+	return w, nil
+}
+
+func readFile(path string, myID protocol.DeviceID) (Configuration, error) {
+	fd, err := os.Open(path)
+	if err != nil {
+		return Configuration{}, err
+	}
+	defer fd.Close()
+
+	return ReadXML(fd, myID)
 }
 
 // Serve handles configuration replace events and calls any interested
@@ -86,10 +134,19 @@ func Load(path string, myID protocol.DeviceID) (*Wrapper, error) {
 // be run manually.
 func (w *Wrapper) Serve() {
 	for cfg := range w.replaces {
+		changes := Diff(w.last, cfg)
+		w.last = cfg
+
 		w.sMut.Lock()
 		subs := w.subs
 		w.sMut.Unlock()
 		for _, h := range subs {
+			if ch, ok := h.(ChangeHandler); ok {
+				if !changes.Empty() {
+					ch.ConfigChanged(cfg, changes)
+				}
+				continue
+			}
 			h.Changed(cfg)
 		}
 	}
@@ -122,7 +179,7 @@ func (w *Wrapper) Replace(cfg Configuration) {
 	w.cfg = cfg
 	w.deviceMap = nil
 	w.folderMap = nil
-	w.replaces <- cfg
+	w.replaces <- cfg.copy()
 }
 
 // Devices returns a map of devices. Device structures should not be changed,
@@ -146,17 +203,19 @@ func (w *Wrapper) SetDevice(dev DeviceConfiguration) {
 	defer w.mut.Unlock()
 
 	w.deviceMap = nil
+	// The shared groups of the folders may include the device.
+	w.folderMap = nil
 
 	for i := range w.cfg.Devices {
 		if w.cfg.Devices[i].DeviceID == dev.DeviceID {
 			w.cfg.Devices[i] = dev
-			w.replaces <- w.cfg
+			w.replaces <- w.cfg.copy()
 			return
 		}
 	}
 
 	w.cfg.Devices = append(w.cfg.Devices, dev)
-	w.replaces <- w.cfg
+	w.replaces <- w.cfg.copy()
 }
 
 // Devices returns a map of folders. Folder structures should not be changed,
@@ -173,30 +232,33 @@ func (w *Wrapper) Folders() map[string]FolderConfiguration {
 				continue
 			}
 			fld.Path = path
-			w.folderMap[fld.ID] = fld
+			w.folderMap[fld.ID] = w.cfg.resolveGroups(fld)
 		}
 	}
 	return w.folderMap
 }
 
 // SetFolder adds a new folder to the configuration, or overwrites an existing
-// folder with the same ID.
+// folder with the same ID. Devices sharing the folder through one of its
+// groups, as returned by Folders(), are not stored with it.
 func (w *Wrapper) SetFolder(fld FolderConfiguration) {
 	w.mut.Lock()
 	defer w.mut.Unlock()
 
 	w.folderMap = nil
+	fld.Devices = explicitDevices(fld.Devices)
+	fld.deviceIDs = nil
 
 	for i := range w.cfg.Folders {
 		if w.cfg.Folders[i].ID == fld.ID {
 			w.cfg.Folders[i] = fld
-			w.replaces <- w.cfg
+			w.replaces <- w.cfg.copy()
 			return
 		}
 	}
 
 	w.cfg.Folders = append(w.cfg.Folders, fld)
-	w.replaces <- w.cfg
+	w.replaces <- w.cfg.copy()
 }
 
 // Options returns the current options configuration object.
@@ -211,7 +273,7 @@ func (w *Wrapper) SetOptions(opts OptionsConfiguration) {
 	w.mut.Lock()
 	defer w.mut.Unlock()
 	w.cfg.Options = opts
-	w.replaces <- w.cfg
+	w.replaces <- w.cfg.copy()
 }
 
 // GUI returns the current GUI configuration object.
@@ -226,7 +288,7 @@ func (w *Wrapper) SetGUI(gui GUIConfiguration) {
 	w.mut.Lock()
 	defer w.mut.Unlock()
 	w.cfg.GUI = gui
-	w.replaces <- w.cfg
+	w.replaces <- w.cfg.copy()
 }
 
 // InvalidateFolder sets the invalid marker on the given folder.
@@ -239,7 +301,43 @@ func (w *Wrapper) InvalidateFolder(id string, err string) {
 	for i := range w.cfg.Folders {
 		if w.cfg.Folders[i].ID == id {
 			w.cfg.Folders[i].Invalid = err
-			w.replaces <- w.cfg
+			w.replaces <- w.cfg.copy()
+			return
+		}
+	}
+}
+
+// SetDevicePause pauses or resumes the given device. A paused device with a
+// non nil until is to be resumed at that time.
+func (w *Wrapper) SetDevicePause(id protocol.DeviceID, paused bool, until *time.Time) {
+	w.mut.Lock()
+	defer w.mut.Unlock()
+
+	w.deviceMap = nil
+
+	for i := range w.cfg.Devices {
+		if w.cfg.Devices[i].DeviceID == id {
+			w.cfg.Devices[i].Paused = paused
+			w.cfg.Devices[i].PausedUntil = until
+			w.replaces <- w.cfg.copy()
+			return
+		}
+	}
+}
+
+// SetFolderPause pauses or resumes the given folder. A paused folder with a
+// non nil until is to be resumed at that time.
+func (w *Wrapper) SetFolderPause(id string, paused bool, until *time.Time) {
+	w.mut.Lock()
+	defer w.mut.Unlock()
+
+	w.folderMap = nil
+
+	for i := range w.cfg.Folders {
+		if w.cfg.Folders[i].ID == id {
+			w.cfg.Folders[i].Paused = paused
+			w.cfg.Folders[i].PausedUntil = until
+			w.replaces <- w.cfg.copy()
 			return
 		}
 	}
@@ -259,24 +357,67 @@ func (w *Wrapper) IgnoredDevice(id protocol.DeviceID) bool {
 }
 
 // Save writes the configuration to disk, and generates a ConfigSaved event.
+// The previous configuration is kept as a backup, as long as it is valid.
 func (w *Wrapper) Save() error {
-	fd, err := ioutil.TempFile(filepath.Dir(w.path), "cfg")
+	// References are saved as such, not as the values they resolve to.
+	w.mut.Lock()
+	saved := w.cfg
+	restoreReferences(&saved, w.refs)
+	w.mut.Unlock()
+
+	var buf bytes.Buffer
+	err := saved.WriteXML(&buf)
+	if err != nil {
+		return err
+	}
+
+	if cur, err := ioutil.ReadFile(w.path); err == nil && isValidXML(cur) {
+		if err := writeFileAtomic(w.path+backupSuffix, cur); err != nil {
+			l.Warnln("Saving configuration backup:", err)
+		}
+	}
+
+	err = writeFileAtomic(w.path, buf.Bytes())
 	if err != nil {
 		return err
 	}
 
-	err = w.cfg.WriteXML(fd)
+	events.Default.Log(events.ConfigSaved, w.cfg)
+
+	return nil
+}
+
+// writeFileAtomic writes data to a temporary file next to path and syncs it
+// to disk before renaming it into place, then syncs the directory so that
+// the rename is durable too. The file at path is thus either the old or the
+// new version, never a partial one, and stays the new one after a crash.
+func writeFileAtomic(path string, data []byte) error {
+	fd, err := ioutil.TempFile(filepath.Dir(path), "cfg")
 	if err != nil {
-		fd.Close()
 		return err
 	}
 
-	err = fd.Close()
+	_, err = fd.Write(data)
+	if err == nil {
+		err = fd.Sync()
+	}
+	if cerr := fd.Close(); err == nil {
+		err = cerr
+	}
 	if err != nil {
+		os.Remove(fd.Name())
 		return err
 	}
 
-	events.Default.Log(events.ConfigSaved, w.cfg)
+	if err := fs.Rename(fs.DefaultFilesystem, fd.Name(), path); err != nil {
+		return err
+	}
+	return osutil.SyncDir(filepath.Dir(path))
+}
 
-	return osutil.Rename(fd.Name(), w.path)
+// isValidXML returns true if the given data is a complete configuration
+// document, as opposed to for example a truncated one.
+func isValidXML(data []byte) bool {
+	var cfg Configuration
+	return xml.Unmarshal(data, &cfg) == nil
 }
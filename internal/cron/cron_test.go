@@ -0,0 +1,74 @@
+// Copyright (C) 2014 The Syncthing Authors.
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for
+// more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package cron
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNext(t *testing.T) {
+	base := time.Date(2014, 11, 20, 14, 37, 12, 0, time.UTC) // A Thursday
+
+	cases := []struct {
+		expr string
+		next time.Time
+	}{
+		{"* * * * *", time.Date(2014, 11, 20, 14, 38, 0, 0, time.UTC)},
+		{"0 3 * * *", time.Date(2014, 11, 21, 3, 0, 0, 0, time.UTC)},
+		{"*/15 * * * *", time.Date(2014, 11, 20, 14, 45, 0, 0, time.UTC)},
+		{"30 14-16 * * *", time.Date(2014, 11, 20, 15, 30, 0, 0, time.UTC)},
+		{"0 0 1 * *", time.Date(2014, 12, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 0 * * 0", time.Date(2014, 11, 23, 0, 0, 0, 0, time.UTC)},
+		{"0 0 * * 7", time.Date(2014, 11, 23, 0, 0, 0, 0, time.UTC)},
+		{"0 12 1 1 *", time.Date(2015, 1, 1, 12, 0, 0, 0, time.UTC)},
+		{"0 0 25 * 1", time.Date(2014, 11, 24, 0, 0, 0, 0, time.UTC)}, // Monday before the 25th
+		{"5,10 * * * *", time.Date(2014, 11, 20, 15, 5, 0, 0, time.UTC)},
+		{"0 0 29 2 *", time.Date(2016, 2, 29, 0, 0, 0, 0, time.UTC)},
+		{"0 0 30 2 *", time.Time{}},
+	}
+
+	for _, tc := range cases {
+		s, err := Parse(tc.expr)
+		if err != nil {
+			t.Errorf("Parse(%q): %v", tc.expr, err)
+			continue
+		}
+		if next := s.Next(base); !next.Equal(tc.next) {
+			t.Errorf("Next for %q is %v, expected %v", tc.expr, next, tc.next)
+		}
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	for _, expr := range []string{
+		"",
+		"* * * *",
+		"* * * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"5-1 * * * *",
+		"*/0 * * * *",
+		"a * * * *",
+	} {
+		if _, err := Parse(expr); err == nil {
+			t.Errorf("Unexpected nil error for %q", expr)
+		}
+	}
+}
@@ -0,0 +1,154 @@
+// Copyright (C) 2014 The Syncthing Authors.
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for
+// more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package dialer
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+)
+
+var (
+	proxy    *url.URL
+	proxyMut sync.RWMutex
+)
+
+// HTTPClient is an HTTP client making its connections with Dial. When
+// those aren't made through a proxy, the HTTP proxy from the environment is
+// used as for any other HTTP client.
+var HTTPClient = &http.Client{
+	Transport: &http.Transport{
+		Proxy:               httpProxy,
+		Dial:                Dial,
+		TLSHandshakeTimeout: 10 * time.Second,
+	},
+}
+
+// The proxy for HTTP requests when Dial connects directly.
+var envProxy = http.ProxyFromEnvironment
+
+func httpProxy(req *http.Request) (*url.URL, error) {
+	if currentProxy() != nil {
+		// Dial connects through it already.
+		return nil, nil
+	}
+	return envProxy(req)
+}
+
+// SetProxy sets the proxy that outgoing connections are made through. When
+// proxyURL is empty the all_proxy environment variable is used instead, and
+// when that isn't set either connections are made directly.
+func SetProxy(proxyURL string) error {
+	if proxyURL == "" {
+		proxyURL = os.Getenv("all_proxy")
+	}
+	if proxyURL == "" {
+		proxyURL = os.Getenv("ALL_PROXY")
+	}
+
+	var u *url.URL
+	if proxyURL != "" {
+		var err error
+		u, err = url.Parse(proxyURL)
+		if err != nil {
+			return err
+		}
+
+		var port string
+		switch u.Scheme {
+		case "socks5", "socks5h":
+			port = "1080"
+		case "http":
+			port = "8080"
+		default:
+			return fmt.Errorf("unsupported proxy type %q", u.Scheme)
+		}
+		if u.Host == "" {
+			return fmt.Errorf("proxy %q has no address", proxyURL)
+		}
+		if _, _, err := net.SplitHostPort(u.Host); err != nil {
+			u.Host = net.JoinHostPort(u.Host, port)
+		}
+	}
+
+	if debug {
+		l.Debugln("dialer: using proxy", u)
+	}
+	proxyMut.Lock()
+	proxy = u
+	proxyMut.Unlock()
+	return nil
+}
+
+// Proxied returns true if connections are made through a proxy.
+func Proxied() bool {
+	return currentProxy() != nil
+}
+
+func currentProxy() *url.URL {
+	proxyMut.RLock()
+	defer proxyMut.RUnlock()
+	return proxy
+}
+
+// Dial connects to the address on the named network. Only TCP connections
+// can be made through a proxy.
+func Dial(network, addr string) (net.Conn, error) {
+	return DialTimeout(network, addr, 0)
+}
+
+// DialTimeout is like Dial, but gives up after the timeout. A zero timeout
+// means no timeout.
+func DialTimeout(network, addr string, timeout time.Duration) (net.Conn, error) {
+	p := currentProxy()
+	if p == nil {
+		return net.DialTimeout(network, addr, timeout)
+	}
+
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, fmt.Errorf("cannot dial %s through a proxy", network)
+	}
+
+	if debug {
+		l.Debugln("dialer: connecting to", addr, "through", p.Host)
+	}
+	conn, err := net.DialTimeout("tcp", p.Host, timeout)
+	if err != nil {
+		return nil, err
+	}
+	if timeout > 0 {
+		conn.SetDeadline(time.Now().Add(timeout))
+	}
+
+	if p.Scheme == "http" {
+		err = httpConnect(conn, p, addr)
+	} else {
+		_, err = socksRequest(conn, p, socksConnect, addr)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
@@ -0,0 +1,303 @@
+// Copyright (C) 2014 The Syncthing Authors.
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for
+// more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package dialer
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// echoServer returns the address of a TCP server echoing what it reads.
+func echoServer(t *testing.T) net.Listener {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+	return ln
+}
+
+// socksServer returns a minimal SOCKS5 proxy requiring the given user name
+// and password. UDP packets sent through it are returned as if they were
+// answered by the address they were sent to.
+func socksServer(t *testing.T, user, password string) net.Listener {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go serveSocks(conn, user, password)
+		}
+	}()
+	return ln
+}
+
+func serveSocks(conn net.Conn, user, password string) {
+	defer conn.Close()
+
+	var hdr [2]byte
+	io.ReadFull(conn, hdr[:])
+	methods := make([]byte, hdr[1])
+	io.ReadFull(conn, methods)
+	if !bytes.Contains(methods, []byte{socksAuthPassword}) {
+		conn.Write([]byte{socksVersion, 0xff})
+		return
+	}
+	conn.Write([]byte{socksVersion, socksAuthPassword})
+
+	io.ReadFull(conn, hdr[:])
+	u := make([]byte, hdr[1])
+	io.ReadFull(conn, u)
+	io.ReadFull(conn, hdr[:1])
+	p := make([]byte, hdr[0])
+	io.ReadFull(conn, p)
+	if string(u) != user || string(p) != password {
+		conn.Write([]byte{socksPasswordVersion, 1})
+		return
+	}
+	conn.Write([]byte{socksPasswordVersion, 0})
+
+	var req [3]byte
+	io.ReadFull(conn, req[:])
+	addr, err := readSocksAddr(conn)
+	if err != nil {
+		return
+	}
+
+	switch req[1] {
+	case socksConnect:
+		target, err := net.Dial("tcp", addr)
+		if err != nil {
+			conn.Write([]byte{socksVersion, 5, 0, socksIPv4, 0, 0, 0, 0, 0, 0})
+			return
+		}
+		defer target.Close()
+		reply, _ := appendSocksAddr([]byte{socksVersion, 0, 0}, target.LocalAddr().String())
+		conn.Write(reply)
+		go io.Copy(target, conn)
+		io.Copy(conn, target)
+
+	case socksUDPAssociate:
+		relay, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			return
+		}
+		defer relay.Close()
+		reply, _ := appendSocksAddr([]byte{socksVersion, 0, 0}, relay.LocalAddr().String())
+		conn.Write(reply)
+		go func() {
+			buf := make([]byte, 2048)
+			for {
+				n, from, err := relay.ReadFromUDP(buf)
+				if err != nil {
+					return
+				}
+				// Echo the packet back, header and all, as if it came
+				// from its destination.
+				relay.WriteToUDP(buf[:n], from)
+			}
+		}()
+		io.Copy(ioutil.Discard, conn)
+	}
+}
+
+// httpProxyServer returns a minimal HTTP proxy handling CONNECT requests
+// with the given credentials.
+func httpProxyServer(t *testing.T, user, password string) net.Listener {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth := "Basic " + base64.StdEncoding.EncodeToString([]byte(user+":"+password))
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				req, err := http.ReadRequest(bufio.NewReader(conn))
+				if err != nil {
+					return
+				}
+				if req.Method != "CONNECT" || req.Header.Get("Proxy-Authorization") != auth {
+					conn.Write([]byte("HTTP/1.1 407 Proxy Authentication Required\r\n\r\n"))
+					return
+				}
+				target, err := net.Dial("tcp", req.Host)
+				if err != nil {
+					conn.Write([]byte("HTTP/1.1 502 Bad Gateway\r\n\r\n"))
+					return
+				}
+				defer target.Close()
+				conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+				go io.Copy(target, conn)
+				io.Copy(conn, target)
+			}()
+		}
+	}()
+	return ln
+}
+
+func testEcho(t *testing.T, addr string) {
+	conn, err := DialTimeout("tcp", addr, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 5)
+	conn.SetDeadline(time.Now().Add(time.Second))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "hello" {
+		t.Errorf("Unexpected echo %q", buf)
+	}
+}
+
+func TestSetProxy(t *testing.T) {
+	defer SetProxy("")
+
+	for _, bad := range []string{"ftp://proxy:21", "socks5://", "%zz"} {
+		if err := SetProxy(bad); err == nil {
+			t.Errorf("Proxy %q should be rejected", bad)
+		}
+	}
+
+	if err := SetProxy("socks5://proxy"); err != nil {
+		t.Fatal(err)
+	}
+	if p := currentProxy(); p.Host != "proxy:1080" {
+		t.Errorf("Unexpected proxy address %q", p.Host)
+	}
+}
+
+func TestHTTPProxy(t *testing.T) {
+	defer SetProxy("")
+	defer func(f func(*http.Request) (*url.URL, error)) { envProxy = f }(envProxy)
+	env, _ := url.Parse("http://envproxy:3128")
+	envProxy = func(*http.Request) (*url.URL, error) { return env, nil }
+
+	req, _ := http.NewRequest("GET", "http://example.com/", nil)
+	if p, err := httpProxy(req); err != nil || p != env {
+		t.Errorf("Expected the proxy from the environment, not %v, %v", p, err)
+	}
+
+	if err := SetProxy("socks5://proxy"); err != nil {
+		t.Fatal(err)
+	}
+	if p, err := httpProxy(req); err != nil || p != nil {
+		t.Errorf("Expected no HTTP proxy when dialing through one, not %v, %v", p, err)
+	}
+}
+
+func TestDialSOCKS(t *testing.T) {
+	echo := echoServer(t)
+	defer echo.Close()
+	proxy := socksServer(t, "user", "secret")
+	defer proxy.Close()
+	defer SetProxy("")
+
+	if err := SetProxy("socks5://user:secret@" + proxy.Addr().String()); err != nil {
+		t.Fatal(err)
+	}
+	testEcho(t, echo.Addr().String())
+
+	SetProxy("socks5://user:wrong@" + proxy.Addr().String())
+	if _, err := DialTimeout("tcp", echo.Addr().String(), time.Second); err == nil {
+		t.Error("Unexpected success with the wrong password")
+	}
+}
+
+func TestDialHTTP(t *testing.T) {
+	echo := echoServer(t)
+	defer echo.Close()
+	proxy := httpProxyServer(t, "user", "secret")
+	defer proxy.Close()
+	defer SetProxy("")
+
+	if err := SetProxy("http://user:secret@" + proxy.Addr().String()); err != nil {
+		t.Fatal(err)
+	}
+	testEcho(t, echo.Addr().String())
+
+	SetProxy("http://" + proxy.Addr().String())
+	if _, err := DialTimeout("tcp", echo.Addr().String(), time.Second); err == nil {
+		t.Error("Unexpected success without credentials")
+	}
+}
+
+func TestListenPacketSOCKS(t *testing.T) {
+	proxy := socksServer(t, "user", "secret")
+	defer proxy.Close()
+	defer SetProxy("")
+
+	if err := SetProxy("socks5://user:secret@" + proxy.Addr().String()); err != nil {
+		t.Fatal(err)
+	}
+	conn, err := ListenPacket("udp4", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	dst := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 22026}
+	if _, err := conn.WriteTo([]byte("hello"), dst); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 16)
+	conn.SetDeadline(time.Now().Add(time.Second))
+	n, from, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != "hello" {
+		t.Errorf("Unexpected packet %q", buf[:n])
+	}
+	if from.String() != dst.String() {
+		t.Errorf("Unexpected source %v", from)
+	}
+}
@@ -0,0 +1,188 @@
+// Copyright (C) 2014 The Syncthing Authors.
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for
+// more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package dialer
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+)
+
+// The parts of the SOCKS5 protocol (RFC 1928) and its password
+// authentication (RFC 1929) that we use
+const (
+	socksVersion         = 5
+	socksAuthNone        = 0
+	socksAuthPassword    = 2
+	socksPasswordVersion = 1
+	socksConnect         = 1
+	socksUDPAssociate    = 3
+	socksIPv4            = 1
+	socksDomain          = 3
+	socksIPv6            = 4
+)
+
+var socksReplies = []string{
+	"succeeded",
+	"general SOCKS server failure",
+	"connection not allowed by ruleset",
+	"network unreachable",
+	"host unreachable",
+	"connection refused",
+	"TTL expired",
+	"command not supported",
+	"address type not supported",
+}
+
+// socksRequest performs the SOCKS5 handshake on conn, authenticating with
+// the user name and password of the proxy URL if it has them, and sends the
+// command for addr. It returns the address bound by the proxy for the
+// command.
+func socksRequest(conn net.Conn, proxy *url.URL, cmd byte, addr string) (string, error) {
+	methods := []byte{socksAuthNone}
+	if proxy.User != nil {
+		methods = append(methods, socksAuthPassword)
+	}
+	greeting := append([]byte{socksVersion, byte(len(methods))}, methods...)
+	if _, err := conn.Write(greeting); err != nil {
+		return "", err
+	}
+
+	var resp [2]byte
+	if _, err := io.ReadFull(conn, resp[:]); err != nil {
+		return "", err
+	}
+	if resp[0] != socksVersion {
+		return "", errors.New("socks5: unexpected protocol version")
+	}
+
+	switch resp[1] {
+	case socksAuthNone:
+	case socksAuthPassword:
+		user := proxy.User.Username()
+		password, _ := proxy.User.Password()
+		if len(user) > 255 || len(password) > 255 {
+			return "", errors.New("socks5: user name or password too long")
+		}
+		auth := []byte{socksPasswordVersion, byte(len(user))}
+		auth = append(auth, user...)
+		auth = append(auth, byte(len(password)))
+		auth = append(auth, password...)
+		if _, err := conn.Write(auth); err != nil {
+			return "", err
+		}
+		if _, err := io.ReadFull(conn, resp[:]); err != nil {
+			return "", err
+		}
+		if resp[1] != 0 {
+			return "", errors.New("socks5: authentication failed")
+		}
+	default:
+		return "", errors.New("socks5: no acceptable authentication method")
+	}
+
+	req, err := appendSocksAddr([]byte{socksVersion, cmd, 0}, addr)
+	if err != nil {
+		return "", err
+	}
+	if _, err := conn.Write(req); err != nil {
+		return "", err
+	}
+
+	var reply [3]byte
+	if _, err := io.ReadFull(conn, reply[:]); err != nil {
+		return "", err
+	}
+	if reply[1] != 0 {
+		if int(reply[1]) < len(socksReplies) {
+			return "", fmt.Errorf("socks5: %s", socksReplies[reply[1]])
+		}
+		return "", fmt.Errorf("socks5: unknown error %d", reply[1])
+	}
+	return readSocksAddr(conn)
+}
+
+// appendSocksAddr appends the host and port of addr to b, in the form used
+// in SOCKS5 requests. Host names are left for the proxy to resolve.
+func appendSocksAddr(b []byte, addr string) ([]byte, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("socks5: invalid port %q", portStr)
+	}
+
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			b = append(b, socksIPv4)
+			b = append(b, ip4...)
+		} else {
+			b = append(b, socksIPv6)
+			b = append(b, ip.To16()...)
+		}
+	} else {
+		if len(host) > 255 {
+			return nil, fmt.Errorf("socks5: host name %q too long", host)
+		}
+		b = append(b, socksDomain, byte(len(host)))
+		b = append(b, host...)
+	}
+	return append(b, byte(port>>8), byte(port)), nil
+}
+
+// readSocksAddr reads an address in the form used in SOCKS5 replies.
+func readSocksAddr(r io.Reader) (string, error) {
+	var typ [1]byte
+	if _, err := io.ReadFull(r, typ[:]); err != nil {
+		return "", err
+	}
+
+	var host string
+	switch typ[0] {
+	case socksIPv4, socksIPv6:
+		ip := make(net.IP, net.IPv4len)
+		if typ[0] == socksIPv6 {
+			ip = make(net.IP, net.IPv6len)
+		}
+		if _, err := io.ReadFull(r, ip); err != nil {
+			return "", err
+		}
+		host = ip.String()
+	case socksDomain:
+		var n [1]byte
+		if _, err := io.ReadFull(r, n[:]); err != nil {
+			return "", err
+		}
+		name := make([]byte, n[0])
+		if _, err := io.ReadFull(r, name); err != nil {
+			return "", err
+		}
+		host = string(name)
+	default:
+		return "", fmt.Errorf("socks5: unknown address type %d", typ[0])
+	}
+
+	var port [2]byte
+	if _, err := io.ReadFull(r, port[:]); err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(port[0])<<8|int(port[1]))), nil
+}
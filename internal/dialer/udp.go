@@ -0,0 +1,142 @@
+// Copyright (C) 2014 The Syncthing Authors.
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for
+// more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package dialer
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"time"
+)
+
+// How long to wait for a SOCKS5 proxy to set up a UDP relay
+const socksUDPTimeout = 10 * time.Second
+
+// ListenPacket returns a socket for sending and receiving UDP packets on
+// laddr. When connections are made through a SOCKS5 proxy the packets are
+// relayed by the proxy instead, and laddr is not used.
+func ListenPacket(network string, laddr *net.UDPAddr) (net.PacketConn, error) {
+	p := currentProxy()
+	if p == nil || p.Scheme == "http" {
+		return net.ListenUDP(network, laddr)
+	}
+
+	ctrl, err := net.DialTimeout("tcp", p.Host, socksUDPTimeout)
+	if err != nil {
+		return nil, err
+	}
+	ctrl.SetDeadline(time.Now().Add(socksUDPTimeout))
+
+	// We don't know the address the proxy will see our packets coming
+	// from, so we leave it unspecified.
+	bound, err := socksRequest(ctrl, p, socksUDPAssociate, "0.0.0.0:0")
+	if err != nil {
+		ctrl.Close()
+		return nil, err
+	}
+	relay, err := net.ResolveUDPAddr("udp", bound)
+	if err != nil {
+		ctrl.Close()
+		return nil, err
+	}
+	if relay.IP.IsUnspecified() {
+		relay.IP = ctrl.RemoteAddr().(*net.TCPAddr).IP
+	}
+	ctrl.SetDeadline(time.Time{})
+
+	conn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		ctrl.Close()
+		return nil, err
+	}
+
+	if debug {
+		l.Debugln("dialer: relaying UDP through", relay)
+	}
+	return &socksPacketConn{conn: conn, ctrl: ctrl, relay: relay}, nil
+}
+
+// A socksPacketConn sends and receives UDP packets through a SOCKS5 proxy.
+// The relay lasts as long as the control connection stays open.
+type socksPacketConn struct {
+	conn  *net.UDPConn
+	ctrl  net.Conn
+	relay *net.UDPAddr
+}
+
+func (c *socksPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	pkt, err := appendSocksAddr([]byte{0, 0, 0}, addr.String())
+	if err != nil {
+		return 0, err
+	}
+	pkt = append(pkt, b...)
+	if _, err := c.conn.WriteTo(pkt, c.relay); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *socksPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	// Room for the longest header, with a host name of 255 bytes
+	buf := make([]byte, len(b)+262)
+	for {
+		n, from, err := c.conn.ReadFromUDP(buf)
+		if err != nil {
+			return 0, nil, err
+		}
+		if !from.IP.Equal(c.relay.IP) {
+			// Not relayed by the proxy
+			continue
+		}
+
+		r := bytes.NewReader(buf[:n])
+		var hdr [3]byte
+		if _, err := io.ReadFull(r, hdr[:]); err != nil || hdr[2] != 0 {
+			// Too short, or a fragment, which we don't support
+			continue
+		}
+		src, err := readSocksAddr(r)
+		if err != nil {
+			continue
+		}
+		addr, err := net.ResolveUDPAddr("udp", src)
+		if err != nil {
+			continue
+		}
+		return copy(b, buf[n-r.Len():n]), addr, nil
+	}
+}
+
+func (c *socksPacketConn) Close() error {
+	c.ctrl.Close()
+	return c.conn.Close()
+}
+
+func (c *socksPacketConn) LocalAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+func (c *socksPacketConn) SetDeadline(t time.Time) error {
+	return c.conn.SetDeadline(t)
+}
+
+func (c *socksPacketConn) SetReadDeadline(t time.Time) error {
+	return c.conn.SetReadDeadline(t)
+}
+
+func (c *socksPacketConn) SetWriteDeadline(t time.Time) error {
+	return c.conn.SetWriteDeadline(t)
+}
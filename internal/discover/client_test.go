@@ -225,3 +225,44 @@ func TestUDP4Failure(t *testing.T) {
 
 	client.Stop()
 }
+
+func TestUDP4LookupOnly(t *testing.T) {
+	conn, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	port := conn.LocalAddr().(*net.UDPAddr).Port
+
+	address := fmt.Sprintf("udp4://127.0.0.1:%d", port)
+
+	client, err := New(address, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// We should not get any announcement
+	buf := make([]byte, 2048)
+	conn.SetDeadline(time.Now().Add(time.Millisecond * 100))
+	_, err = conn.Read(buf)
+	if err == nil {
+		t.Fatal("Unexpected announcement in lookup only mode")
+	}
+
+	// Lookups should still be sent
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	go func() {
+		client.Lookup(device)
+		wg.Done()
+	}()
+
+	conn.SetDeadline(time.Now().Add(time.Millisecond * 100))
+	_, _, err = conn.ReadFromUDP(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wg.Wait()
+	client.Stop()
+}
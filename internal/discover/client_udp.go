@@ -24,6 +24,7 @@ import (
 	"sync"
 	"time"
 
+	"github.com/syncthing/syncthing/internal/dialer"
 	"github.com/syncthing/syncthing/internal/protocol"
 )
 
@@ -56,9 +57,10 @@ type UDPClient struct {
 	mut    sync.RWMutex
 }
 
+// Start prepares the client for lookups and starts announcing pkt to the
+// server. A nil pkt makes the client lookup only; nothing is announced.
 func (d *UDPClient) Start(uri *url.URL, pkt *Announce) error {
 	d.url = uri
-	d.id = protocol.DeviceIDFromBytes(pkt.This.ID)
 	d.stop = make(chan struct{})
 
 	params := uri.Query()
@@ -84,6 +86,14 @@ func (d *UDPClient) Start(uri *url.URL, pkt *Announce) error {
 		d.errorRetryInterval = time.Duration(retrySeconds) * time.Second
 	}
 
+	if pkt == nil {
+		if debug {
+			l.Debugf("discover %s: lookup only, not announcing", d.url)
+		}
+		return nil
+	}
+
+	d.id = protocol.DeviceIDFromBytes(pkt.This.ID)
 	d.wg.Add(1)
 	go d.broadcast(pkt.MustMarshalXDR())
 	return nil
@@ -92,7 +102,7 @@ func (d *UDPClient) Start(uri *url.URL, pkt *Announce) error {
 func (d *UDPClient) broadcast(pkt []byte) {
 	defer d.wg.Done()
 
-	conn, err := net.ListenUDP(d.url.Scheme, d.listenAddress)
+	conn, err := dialer.ListenPacket(d.url.Scheme, d.listenAddress)
 	for err != nil {
 		l.Warnf("discover %s: broadcast: %v; trying again in %v", d.url, err, d.errorRetryInterval)
 		select {
@@ -100,7 +110,7 @@ func (d *UDPClient) broadcast(pkt []byte) {
 			return
 		case <-time.After(d.errorRetryInterval):
 		}
-		conn, err = net.ListenUDP(d.url.Scheme, d.listenAddress)
+		conn, err = dialer.ListenPacket(d.url.Scheme, d.listenAddress)
 	}
 	defer conn.Close()
 
@@ -168,7 +178,7 @@ func (d *UDPClient) Lookup(device protocol.DeviceID) []string {
 		return nil
 	}
 
-	conn, err := net.DialUDP(d.url.Scheme, d.listenAddress, extIP)
+	conn, err := dialer.ListenPacket(d.url.Scheme, d.listenAddress)
 	if err != nil {
 		if debug {
 			l.Debugf("discover %s: Lookup(%s): %s", d.url, device, err)
@@ -186,7 +196,7 @@ func (d *UDPClient) Lookup(device protocol.DeviceID) []string {
 	}
 
 	buf := Query{QueryMagic, device[:]}.MustMarshalXDR()
-	_, err = conn.Write(buf)
+	_, err = conn.WriteTo(buf, extIP)
 	if err != nil {
 		if debug {
 			l.Debugf("discover %s: Lookup(%s): %s", d.url, device, err)
@@ -195,7 +205,7 @@ func (d *UDPClient) Lookup(device protocol.DeviceID) []string {
 	}
 
 	buf = make([]byte, 2048)
-	n, err := conn.Read(buf)
+	n, _, err := conn.ReadFrom(buf)
 	if err != nil {
 		if err, ok := err.(net.Error); ok && err.Timeout() {
 			// Expected if the server doesn't know about requested device ID
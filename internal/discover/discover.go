@@ -21,6 +21,7 @@ import (
 	"errors"
 	"io"
 	"net"
+	"net/url"
 	"strconv"
 	"sync"
 	"time"
@@ -31,18 +32,24 @@ import (
 )
 
 type Discoverer struct {
-	myID            protocol.DeviceID
-	listenAddrs     []string
-	localBcastIntv  time.Duration
-	localBcastStart time.Time
-	cacheLifetime   time.Duration
-	broadcastBeacon beacon.Interface
-	multicastBeacon beacon.Interface
-	registry        map[protocol.DeviceID][]CacheEntry
-	registryLock    sync.RWMutex
-	extPort         uint16
-	localBcastTick  <-chan time.Time
-	forcedBcastTick chan time.Time
+	myID             protocol.DeviceID
+	listenAddrs      []string
+	localBcastIntv   time.Duration
+	localBcastStart  time.Time
+	cacheLifetime    time.Duration
+	broadcastBeacon  beacon.Interface
+	multicastBeacon  beacon.Interface
+	registry         map[protocol.DeviceID][]CacheEntry
+	registryLock     sync.RWMutex
+	extPort          uint16
+	extPortMapped    bool // extPort was mapped with UPnP, rather than being the listen port
+	localBcastTick   <-chan time.Time
+	forcedBcastTick  chan time.Time
+	globalBcastIntv  time.Duration
+	globalLookupOnly bool
+	globalServers    []string
+	staticAddrs      []string // announced in addition to, or instead of, listenAddrs
+	noDynamicAddrs   bool     // only staticAddrs are announced
 
 	clients []Client
 	mut     sync.RWMutex
@@ -53,6 +60,23 @@ type CacheEntry struct {
 	Seen    time.Time
 }
 
+// The ways in which an announced address is determined.
+const (
+	SourceStatic = "static" // configured as an address of this device
+	SourceListen = "listen" // a listen address
+	SourceUPnP   = "upnp"   // the external port mapped with UPnP
+	SourceGlobal = "global" // as registered by a global discovery server
+)
+
+// An AnnouncedAddress is an address we're known under, and how it was
+// determined. An address without IP has it filled in by the receiver of the
+// announcement.
+type AnnouncedAddress struct {
+	Address string
+	Source  string
+	Server  string `json:",omitempty"` // The global discovery server, for SourceGlobal
+}
+
 var (
 	ErrIncorrectMagic = errors.New("incorrect magic number")
 )
@@ -104,6 +128,51 @@ func (d *Discoverer) StartLocal(localPort int, localMCAddr string) {
 	}
 }
 
+// SetGlobalAnnounce sets how the global discovery clients created by
+// StartGlobal behave. In lookup only mode our own addresses are never sent to
+// the global discovery servers, so other devices must be able to find us by
+// some other means (local discovery or static addresses). Otherwise we
+// announce ourselves every interval, or at the client's default interval if
+// it's zero.
+func (d *Discoverer) SetGlobalAnnounce(lookupOnly bool, interval time.Duration) {
+	d.mut.Lock()
+	d.globalLookupOnly = lookupOnly
+	d.globalBcastIntv = interval
+	d.mut.Unlock()
+}
+
+// SetAnnounceAddresses sets the addresses we announce. They are those in the
+// list; when it contains "dynamic" or is empty, also the listen addresses or
+// the external port, as if it had not been set. Running global discovery
+// clients are restarted to announce the new ones.
+func (d *Discoverer) SetAnnounceAddresses(addrs []string) {
+	d.mut.Lock()
+	defer d.mut.Unlock()
+
+	d.staticAddrs = nil
+	d.noDynamicAddrs = len(addrs) > 0
+	for _, addr := range addrs {
+		if addr == "dynamic" {
+			d.noDynamicAddrs = false
+		} else {
+			d.staticAddrs = append(d.staticAddrs, addr)
+		}
+	}
+
+	if len(d.clients) > 0 {
+		d.stopGlobal()
+		d.startGlobal(d.globalServers, d.extPort)
+	}
+}
+
+// SetExternalPortMapped sets whether the external port given to StartGlobal
+// was mapped with UPnP, which is reported by AnnouncedAddresses.
+func (d *Discoverer) SetExternalPortMapped(mapped bool) {
+	d.mut.Lock()
+	d.extPortMapped = mapped
+	d.mut.Unlock()
+}
+
 func (d *Discoverer) StartGlobal(servers []string, extPort uint16) {
 	d.mut.Lock()
 	defer d.mut.Unlock()
@@ -111,16 +180,23 @@ func (d *Discoverer) StartGlobal(servers []string, extPort uint16) {
 	if len(d.clients) > 0 {
 		d.stopGlobal()
 	}
+	d.startGlobal(servers, extPort)
+}
 
+func (d *Discoverer) startGlobal(servers []string, extPort uint16) {
+	d.globalServers = servers
 	d.extPort = extPort
-	pkt := d.announcementPkt()
+	var pkt *Announce
+	if !d.globalLookupOnly {
+		pkt = d.announcementPkt()
+	}
 	wg := sync.WaitGroup{}
 	clients := make(chan Client, len(servers))
 	for _, address := range servers {
 		wg.Add(1)
 		go func(addr string) {
 			defer wg.Done()
-			client, err := New(addr, pkt)
+			client, err := New(d.withBroadcastInterval(addr), pkt)
 			if err != nil {
 				l.Infoln("Error creating discovery client", addr, err)
 				return
@@ -137,6 +213,26 @@ func (d *Discoverer) StartGlobal(servers []string, extPort uint16) {
 	}
 }
 
+// withBroadcastInterval returns the server address with the configured
+// global announcement interval set, unless the address already specifies one.
+func (d *Discoverer) withBroadcastInterval(addr string) string {
+	if d.globalBcastIntv <= 0 {
+		return addr
+	}
+	uri, err := url.Parse(addr)
+	if err != nil {
+		// Let New() report the error
+		return addr
+	}
+	params := uri.Query()
+	if params.Get("broadcast") != "" {
+		return addr
+	}
+	params.Set("broadcast", strconv.Itoa(int(d.globalBcastIntv/time.Second)))
+	uri.RawQuery = params.Encode()
+	return uri.String()
+}
+
 func (d *Discoverer) StopGlobal() {
 	d.mut.Lock()
 	defer d.mut.Unlock()
@@ -161,6 +257,39 @@ func (d *Discoverer) ExtAnnounceOK() map[string]bool {
 	return ret
 }
 
+// AnnouncedAddresses returns the addresses we announce, and those the global
+// discovery servers have registered for us. The latter are looked up at
+// each call.
+func (d *Discoverer) AnnouncedAddresses() []AnnouncedAddress {
+	d.mut.RLock()
+	var res []AnnouncedAddress
+	if d.noDynamicAddrs {
+		// Static addresses only
+	} else if d.extPort != 0 {
+		source := SourceListen
+		if d.extPortMapped {
+			source = SourceUPnP
+		}
+		res = append(res, AnnouncedAddress{Address: Address{Port: d.extPort}.String(), Source: source})
+	} else {
+		for _, addr := range announceAddrs(nil, d.listenAddrs) {
+			res = append(res, AnnouncedAddress{Address: addr.String(), Source: SourceListen})
+		}
+	}
+	for _, addr := range announceAddrs(nil, d.staticAddrs) {
+		res = append(res, AnnouncedAddress{Address: addr.String(), Source: SourceStatic})
+	}
+	clients := append([]Client(nil), d.clients...)
+	d.mut.RUnlock()
+
+	for _, client := range clients {
+		for _, addr := range client.Lookup(d.myID) {
+			res = append(res, AnnouncedAddress{Address: addr, Source: SourceGlobal, Server: client.Address()})
+		}
+	}
+	return res
+}
+
 func (d *Discoverer) Lookup(device protocol.DeviceID) []string {
 	d.registryLock.RLock()
 	cached := d.filterCached(d.registry[device])
@@ -241,42 +370,59 @@ func (d *Discoverer) All() map[protocol.DeviceID][]CacheEntry {
 
 func (d *Discoverer) announcementPkt() *Announce {
 	var addrs []Address
-	if d.extPort != 0 {
+	if d.noDynamicAddrs {
+		// Static addresses only
+	} else if d.extPort != 0 {
 		addrs = []Address{{Port: d.extPort}}
 	} else {
-		for _, astr := range d.listenAddrs {
-			addr, err := net.ResolveTCPAddr("tcp", astr)
-			if err != nil {
-				l.Warnln("discover: %v: not announcing %s", err, astr)
-				continue
-			} else if debug {
-				l.Debugf("discover: resolved %s as %#v", astr, addr)
-			}
-			if len(addr.IP) == 0 || addr.IP.IsUnspecified() {
-				addrs = append(addrs, Address{Port: uint16(addr.Port)})
-			} else if bs := addr.IP.To4(); bs != nil {
-				addrs = append(addrs, Address{IP: bs, Port: uint16(addr.Port)})
-			} else if bs := addr.IP.To16(); bs != nil {
-				addrs = append(addrs, Address{IP: bs, Port: uint16(addr.Port)})
-			}
-		}
+		addrs = announceAddrs(addrs, d.listenAddrs)
 	}
+	addrs = announceAddrs(addrs, d.staticAddrs)
 	return &Announce{
 		Magic: AnnouncementMagic,
 		This:  Device{d.myID[:], addrs},
 	}
 }
 
-func (d *Discoverer) sendLocalAnnouncements() {
-	var addrs = resolveAddrs(d.listenAddrs)
-
-	var pkt = Announce{
-		Magic: AnnouncementMagic,
-		This:  Device{d.myID[:], addrs},
+// announceAddrs appends the given addresses to addrs, resolved for
+// announcing. An unspecified IP is filled in by the receiver, from the
+// source of the announcement.
+func announceAddrs(addrs []Address, astrs []string) []Address {
+	for _, astr := range astrs {
+		addr, err := net.ResolveTCPAddr("tcp", astr)
+		if err != nil {
+			l.Warnf("discover: %v: not announcing %s", err, astr)
+			continue
+		} else if debug {
+			l.Debugf("discover: resolved %s as %#v", astr, addr)
+		}
+		if len(addr.IP) == 0 || addr.IP.IsUnspecified() {
+			addrs = append(addrs, Address{Port: uint16(addr.Port)})
+		} else if bs := addr.IP.To4(); bs != nil {
+			addrs = append(addrs, Address{IP: bs, Port: uint16(addr.Port)})
+		} else if bs := addr.IP.To16(); bs != nil {
+			addrs = append(addrs, Address{IP: bs, Port: uint16(addr.Port)})
+		}
 	}
-	msg := pkt.MustMarshalXDR()
+	return addrs
+}
 
+func (d *Discoverer) sendLocalAnnouncements() {
 	for {
+		d.mut.RLock()
+		astrs := d.staticAddrs
+		if !d.noDynamicAddrs {
+			astrs = append(d.listenAddrs[:len(d.listenAddrs):len(d.listenAddrs)], astrs...)
+		}
+		d.mut.RUnlock()
+		addrs := resolveAddrs(astrs)
+
+		var pkt = Announce{
+			Magic: AnnouncementMagic,
+			This:  Device{d.myID[:], addrs},
+		}
+		msg := pkt.MustMarshalXDR()
+
 		if d.multicastBeacon != nil {
 			d.multicastBeacon.Send(msg)
 		}
@@ -389,6 +535,16 @@ func (d *Discoverer) filterCached(c []CacheEntry) []CacheEntry {
 	return c
 }
 
+// String returns the address in host:port form, with an empty host when
+// there's no IP.
+func (a Address) String() string {
+	host := ""
+	if len(a.IP) > 0 {
+		host = net.IP(a.IP).String()
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(a.Port)))
+}
+
 func addrToAddr(addr *net.TCPAddr) Address {
 	if len(addr.IP) == 0 || addr.IP.IsUnspecified() {
 		return Address{Port: uint16(addr.Port)}
@@ -16,7 +16,10 @@
 package discover
 
 import (
+	"net"
 	"net/url"
+	"reflect"
+	"sync"
 	"time"
 
 	"testing"
@@ -146,3 +149,96 @@ func TestGlobalDiscovery(t *testing.T) {
 		}
 	}
 }
+
+func TestGlobalDiscoveryAnnounceSettings(t *testing.T) {
+	var mut sync.Mutex
+	intervals := make(map[string]string)
+	Register("test3", func(uri *url.URL, pkt *Announce) (Client, error) {
+		if pkt != nil {
+			t.Error("Announcement packet given to client in lookup only mode")
+		}
+		mut.Lock()
+		intervals[uri.Host] = uri.Query().Get("broadcast")
+		mut.Unlock()
+		return &DummyClient{url: uri}, nil
+	})
+
+	d := NewDiscoverer(device, []string{})
+	d.SetGlobalAnnounce(true, 10*time.Minute)
+	d.StartGlobal([]string{"test3://1.2.3.4:22026", "test3://2.3.4.5:22026/?broadcast=60"}, 1234)
+	d.StopGlobal()
+
+	if len(intervals) != 2 {
+		t.Fatal("Wrong number of clients")
+	}
+	if b := intervals["1.2.3.4:22026"]; b != "600" {
+		t.Errorf("Incorrect broadcast interval %q, expected configured one", b)
+	}
+	if b := intervals["2.3.4.5:22026"]; b != "60" {
+		t.Errorf("Incorrect broadcast interval %q, expected explicit one", b)
+	}
+}
+
+func TestAnnounceAddresses(t *testing.T) {
+	d := NewDiscoverer(device, []string{":22000"})
+
+	// Static addresses only; unless "dynamic" is included.
+	d.SetAnnounceAddresses([]string{"10.0.0.1:22001"})
+	addrs := d.announcementPkt().This.Addresses
+	if len(addrs) != 1 || net.IP(addrs[0].IP).String() != "10.0.0.1" || addrs[0].Port != 22001 {
+		t.Errorf("Unexpected announced addresses %v", addrs)
+	}
+
+	d.SetAnnounceAddresses([]string{"dynamic", "10.0.0.1:22001"})
+	addrs = d.announcementPkt().This.Addresses
+	if len(addrs) != 2 || len(addrs[0].IP) != 0 || addrs[0].Port != 22000 || addrs[1].Port != 22001 {
+		t.Errorf("Unexpected announced addresses %v", addrs)
+	}
+
+	d.SetAnnounceAddresses(nil)
+	addrs = d.announcementPkt().This.Addresses
+	if len(addrs) != 1 || addrs[0].Port != 22000 {
+		t.Errorf("Unexpected announced addresses %v", addrs)
+	}
+}
+
+func TestAnnouncedAddresses(t *testing.T) {
+	d := NewDiscoverer(device, []string{":22000"})
+	d.SetAnnounceAddresses([]string{"dynamic", "10.0.0.1:22001"})
+
+	addrs := d.AnnouncedAddresses()
+	expected := []AnnouncedAddress{
+		{Address: ":22000", Source: SourceListen},
+		{Address: "10.0.0.1:22001", Source: SourceStatic},
+	}
+	if !reflect.DeepEqual(addrs, expected) {
+		t.Errorf("Incorrect addresses %v, expected %v", addrs, expected)
+	}
+
+	c := &DummyClient{lookupRet: []string{"203.0.113.5:22345"}}
+	Register("test4", func(uri *url.URL, pkt *Announce) (Client, error) {
+		c.url = uri
+		return c, nil
+	})
+	d.StartGlobal([]string{"test4://192.0.2.1:22026"}, 22345)
+
+	// The port is only said to be mapped with UPnP when it was.
+	if addrs = d.AnnouncedAddresses(); addrs[0].Source != SourceListen {
+		t.Errorf("Unmapped external port announced as %q", addrs[0].Source)
+	}
+	c.lookups = nil
+	d.SetExternalPortMapped(true)
+
+	addrs = d.AnnouncedAddresses()
+	expected = []AnnouncedAddress{
+		{Address: ":22345", Source: SourceUPnP},
+		{Address: "10.0.0.1:22001", Source: SourceStatic},
+		{Address: "203.0.113.5:22345", Source: SourceGlobal, Server: "test4://192.0.2.1:22026"},
+	}
+	if !reflect.DeepEqual(addrs, expected) {
+		t.Errorf("Incorrect addresses %v, expected %v", addrs, expected)
+	}
+	if len(c.lookups) != 1 || c.lookups[0] != device {
+		t.Errorf("Incorrect lookups %v", c.lookups)
+	}
+}
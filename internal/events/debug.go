@@ -19,7 +19,7 @@ import (
 	"os"
 	"strings"
 
-	"github.com/calmh/logger"
+	"github.com/syncthing/syncthing/internal/logger"
 )
 
 var (
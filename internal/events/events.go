@@ -39,6 +39,9 @@ const (
 	FolderRejected
 	ConfigSaved
 	DownloadProgress
+	DeviceAddressChanged
+	FolderAutoPaused
+	SourceQuarantined
 
 	AllEvents = (1 << iota) - 1
 )
@@ -73,6 +76,12 @@ func (t EventType) String() string {
 		return "ConfigSaved"
 	case DownloadProgress:
 		return "DownloadProgress"
+	case DeviceAddressChanged:
+		return "DeviceAddressChanged"
+	case FolderAutoPaused:
+		return "FolderAutoPaused"
+	case SourceQuarantined:
+		return "SourceQuarantined"
 	default:
 		return "Unknown"
 	}
@@ -155,6 +155,15 @@ func (f *BlockFinder) Changed(cfg config.Configuration) error {
 	return nil
 }
 
+// Implements the config.ChangeHandler interface. Only the set of folders is
+// of interest.
+func (f *BlockFinder) ConfigChanged(cfg config.Configuration, changes config.Changes) error {
+	if len(changes.FoldersAdded) == 0 && len(changes.FoldersRemoved) == 0 {
+		return nil
+	}
+	return f.Changed(cfg)
+}
+
 // An iterator function which iterates over all matching blocks for the given
 // hash. The iterator function has to return either true (if they are happy with
 // the block) or false to continue iterating for whatever reason.
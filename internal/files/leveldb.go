@@ -420,7 +420,7 @@ func ldbInsert(batch dbWriter, folder, device []byte, file protocol.FileInfo) ui
 	if debugDB {
 		l.Debugf("batch.Put %p %x", batch, nk)
 	}
-	batch.Put(nk, file.MustMarshalXDR())
+	batch.Put(nk, marshalFile(file))
 
 	return file.LocalVersion
 }
@@ -603,7 +603,7 @@ func ldbGet(db *leveldb.DB, folder, device, file []byte) (protocol.FileInfo, boo
 	}
 
 	var f protocol.FileInfo
-	err = f.UnmarshalXDR(bs)
+	err = unmarshalFile(bs, &f)
 	if err != nil {
 		panic(err)
 	}
@@ -942,11 +942,38 @@ func unmarshalTrunc(bs []byte, truncate bool) (FileIntf, error) {
 		return tf, err
 	} else {
 		var tf protocol.FileInfo
-		err := tf.UnmarshalXDR(bs)
+		err := unmarshalFile(bs, &tf)
 		return tf, err
 	}
 }
 
+// marshalFile returns the database representation of a file: the FileInfo
+// followed by its metadata, if it has any.
+func marshalFile(f protocol.FileInfo) []byte {
+	bs := f.MustMarshalXDR()
+	if md, ok := f.Metadata(); ok {
+		bs = append(bs, md.MustMarshalXDR()...)
+	}
+	return bs
+}
+
+// unmarshalFile is the inverse of marshalFile. Entries without metadata,
+// including those written by earlier versions, decode as before.
+func unmarshalFile(bs []byte, f *protocol.FileInfo) error {
+	br := bytes.NewReader(bs)
+	if err := f.DecodeXDR(br); err != nil {
+		return err
+	}
+	if br.Len() > 0 {
+		var md protocol.FileMetadata
+		if err := md.DecodeXDR(br); err != nil {
+			return err
+		}
+		f.SetMetadata(md)
+	}
+	return nil
+}
+
 func ldbCheckGlobals(db *leveldb.DB, folder []byte) {
 	defer runtime.GC()
 
@@ -17,7 +17,10 @@ package files
 
 import (
 	"bytes"
+	"reflect"
 	"testing"
+
+	"github.com/syncthing/syncthing/internal/protocol"
 )
 
 func TestDeviceKey(t *testing.T) {
@@ -56,3 +59,38 @@ func TestGlobalKey(t *testing.T) {
 		t.Errorf("wrong name %q != %q", name2, name)
 	}
 }
+
+func TestMarshalFileMetadata(t *testing.T) {
+	f := protocol.FileInfo{
+		Name:    "name",
+		Version: 42,
+		Blocks:  []protocol.BlockInfo{{Size: 128, Hash: []byte("hash")}},
+		Xattrs:  []protocol.Xattr{{Name: "user.test", Value: []byte("value")}},
+		Owner:   &protocol.FileOwner{UID: 1000, GID: 1000},
+	}
+
+	var f2 protocol.FileInfo
+	if err := unmarshalFile(marshalFile(f), &f2); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(f, f2) {
+		t.Errorf("incorrect round trip %v != %v", f2, f)
+	}
+
+	// Entries written without metadata should still be readable.
+	var f3 protocol.FileInfo
+	if err := unmarshalFile(f.MustMarshalXDR(), &f3); err != nil {
+		t.Fatal(err)
+	}
+	if f3.Xattrs != nil || f3.Owner != nil || f3.Name != f.Name {
+		t.Errorf("unexpected result %v", f3)
+	}
+
+	var tf FileInfoTruncated
+	if err := tf.UnmarshalXDR(marshalFile(f)); err != nil {
+		t.Fatal(err)
+	}
+	if tf.Name != f.Name || tf.NumBlocks != 1 {
+		t.Errorf("unexpected truncated result %v", tf)
+	}
+}
@@ -28,6 +28,7 @@ import (
 	"github.com/syncthing/syncthing/internal/osutil"
 	"github.com/syncthing/syncthing/internal/protocol"
 	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
 )
 
 type Set struct {
@@ -36,6 +37,7 @@ type Set struct {
 	folder       string
 	db           *leveldb.DB
 	blockmap     *BlockMap
+	changed      bool // written to since the last TakeChanged
 }
 
 // FileIntf is the set of methods implemented by both protocol.FileInfo and
@@ -88,6 +90,7 @@ func (s *Set) Replace(device protocol.DeviceID, fs []protocol.FileInfo) {
 	normalizeFilenames(fs)
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
+	s.changed = true
 	s.localVersion[device] = ldbReplace(s.db, []byte(s.folder), device[:], fs)
 	if len(fs) == 0 {
 		// Reset the local version if all files were removed.
@@ -106,6 +109,7 @@ func (s *Set) ReplaceWithDelete(device protocol.DeviceID, fs []protocol.FileInfo
 	normalizeFilenames(fs)
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
+	s.changed = true
 	if lv := ldbReplaceWithDelete(s.db, []byte(s.folder), device[:], fs); lv > s.localVersion[device] {
 		s.localVersion[device] = lv
 	}
@@ -122,6 +126,7 @@ func (s *Set) Update(device protocol.DeviceID, fs []protocol.FileInfo) {
 	normalizeFilenames(fs)
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
+	s.changed = true
 	if device == protocol.LocalDeviceID {
 		discards := make([]protocol.FileInfo, 0, len(fs))
 		updates := make([]protocol.FileInfo, 0, len(fs))
@@ -218,6 +223,24 @@ func (s *Set) LocalVersion(device protocol.DeviceID) uint64 {
 	return s.localVersion[device]
 }
 
+// TakeChanged returns whether the set has been written to since the last
+// call.
+func (s *Set) TakeChanged() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	changed := s.changed
+	s.changed = false
+	return changed
+}
+
+// Flush makes everything written to the database durable, compacting it so
+// that nothing needs to be recovered from its journal when it's opened next.
+// Writes in progress are completed first. This may take a while for a large
+// database.
+func Flush(db *leveldb.DB) error {
+	return db.CompactRange(util.Range{})
+}
+
 // ListFolders returns the folder IDs seen in the database.
 func ListFolders(db *leveldb.DB) []string {
 	return ldbListFolders(db)
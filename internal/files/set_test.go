@@ -757,6 +757,33 @@ func TestLocalVersion(t *testing.T) {
 	}
 }
 
+func TestFlush(t *testing.T) {
+	db, err := leveldb.Open(storage.NewMemStorage(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := files.NewSet("test", db)
+	if m.TakeChanged() {
+		t.Error("New set should not be changed")
+	}
+
+	m.Update(protocol.LocalDeviceID, []protocol.FileInfo{{Name: "a", Version: 1000}})
+	if !m.TakeChanged() {
+		t.Error("Updated set should be changed")
+	}
+	if m.TakeChanged() {
+		t.Error("Set should not be changed after taking the change")
+	}
+
+	if err := files.Flush(db); err != nil {
+		t.Fatal(err)
+	}
+	if f, ok := m.Get(protocol.LocalDeviceID, "a"); !ok || f.Version != 1000 {
+		t.Errorf("Unexpected file after flush %v, %v", f, ok)
+	}
+}
+
 func TestListDropFolder(t *testing.T) {
 	db, err := leveldb.Open(storage.NewMemStorage(), nil)
 	if err != nil {
@@ -0,0 +1,130 @@
+// Copyright (C) 2014 The Syncthing Authors.
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for
+// more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package fs
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"time"
+
+	"github.com/syncthing/syncthing/internal/symlinks"
+)
+
+// The BasicFilesystem implements the Filesystem interface on top of the
+// local file system, using the functions in package os.
+type BasicFilesystem struct{}
+
+func NewBasicFilesystem() *BasicFilesystem {
+	return &BasicFilesystem{}
+}
+
+func (f *BasicFilesystem) Chmod(name string, mode os.FileMode) error {
+	return os.Chmod(name, mode)
+}
+
+func (f *BasicFilesystem) Chtimes(name string, atime time.Time, mtime time.Time) error {
+	return os.Chtimes(name, atime, mtime)
+}
+
+func (f *BasicFilesystem) Create(name string) (File, error) {
+	fd, err := os.Create(name)
+	if err != nil {
+		// Avoid returning a non-nil File holding a nil *os.File
+		return nil, err
+	}
+	return fd, nil
+}
+
+func (f *BasicFilesystem) Glob(pattern string) ([]string, error) {
+	return filepath.Glob(pattern)
+}
+
+func (f *BasicFilesystem) Lchown(name string, uid, gid int) error {
+	return os.Lchown(name, uid, gid)
+}
+
+func (f *BasicFilesystem) Link(oldname, newname string) error {
+	return os.Link(oldname, newname)
+}
+
+func (f *BasicFilesystem) Lstat(name string) (os.FileInfo, error) {
+	return os.Lstat(name)
+}
+
+func (f *BasicFilesystem) Mkdir(name string, perm os.FileMode) error {
+	return os.Mkdir(name, perm)
+}
+
+func (f *BasicFilesystem) MkdirAll(name string, perm os.FileMode) error {
+	return os.MkdirAll(name, perm)
+}
+
+func (f *BasicFilesystem) Open(name string) (File, error) {
+	fd, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return fd, nil
+}
+
+func (f *BasicFilesystem) OpenFile(name string, flags int, mode os.FileMode) (File, error) {
+	fd, err := os.OpenFile(name, flags, mode)
+	if err != nil {
+		return nil, err
+	}
+	return fd, nil
+}
+
+func (f *BasicFilesystem) Remove(name string) error {
+	return os.Remove(name)
+}
+
+func (f *BasicFilesystem) Rename(oldname, newname string) error {
+	// On Windows, make sure the destination file is writeable (or we can't delete it)
+	if runtime.GOOS == "windows" {
+		os.Chmod(newname, 0666)
+		err := os.Remove(newname)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return os.Rename(oldname, newname)
+}
+
+func (f *BasicFilesystem) Stat(name string) (os.FileInfo, error) {
+	return os.Stat(name)
+}
+
+func (f *BasicFilesystem) Walk(root string, walkFn filepath.WalkFunc) error {
+	return filepath.Walk(root, walkFn)
+}
+
+func (f *BasicFilesystem) SymlinksSupported() bool {
+	return symlinks.Supported
+}
+
+func (f *BasicFilesystem) ReadSymlink(name string) (string, uint32, error) {
+	return symlinks.Read(name)
+}
+
+func (f *BasicFilesystem) CreateSymlink(name, target string, flags uint32) error {
+	return symlinks.Create(name, target, flags)
+}
+
+func (f *BasicFilesystem) ChangeSymlinkType(name string, flags uint32) error {
+	return symlinks.ChangeType(name, flags)
+}
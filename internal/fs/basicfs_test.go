@@ -0,0 +1,190 @@
+// Copyright (C) 2014 The Syncthing Authors.
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for
+// more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package fs
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestBasicFilesystem(t *testing.T) {
+	dir, err := ioutil.TempDir("", "syncthing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var f Filesystem = NewBasicFilesystem()
+
+	if err := f.MkdirAll(filepath.Join(dir, "a", "b"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	fd, err := f.Create(filepath.Join(dir, "a", "file"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fd.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fd.WriteAt([]byte("J"), 0); err != nil {
+		t.Fatal(err)
+	}
+	fd.Close()
+
+	fd, err = f.Open(filepath.Join(dir, "a", "file"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	bs, err := ioutil.ReadAll(fd)
+	fd.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(bs) != "Jello" {
+		t.Errorf("Incorrect contents %q", bs)
+	}
+
+	if runtime.GOOS != "windows" {
+		// Giving the file to ourselves needs no privileges.
+		if err := f.Lchown(filepath.Join(dir, "a", "file"), os.Getuid(), os.Getgid()); err != nil {
+			t.Error(err)
+		}
+	}
+
+	if err := f.Link(filepath.Join(dir, "a", "file"), filepath.Join(dir, "a", "link")); err != nil {
+		t.Fatal(err)
+	}
+	info, _ := f.Lstat(filepath.Join(dir, "a", "file"))
+	if linkInfo, err := f.Lstat(filepath.Join(dir, "a", "link")); err != nil || !os.SameFile(info, linkInfo) {
+		t.Errorf("Link is not the same file: %v", err)
+	}
+	if err := f.Remove(filepath.Join(dir, "a", "link")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := f.Rename(filepath.Join(dir, "a", "file"), filepath.Join(dir, "a", "b", "renamed")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Lstat(filepath.Join(dir, "a", "file")); !os.IsNotExist(err) {
+		t.Errorf("Renamed file still exists: %v", err)
+	}
+
+	mtime := time.Unix(1234567890, 0)
+	name := filepath.Join(dir, "a", "b", "renamed")
+	if err := f.Chtimes(name, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := f.Stat(name); err != nil {
+		t.Fatal(err)
+	} else if !info.ModTime().Equal(mtime) || info.Size() != 5 {
+		t.Errorf("Incorrect file info %v, %d", info.ModTime(), info.Size())
+	}
+
+	if matches, err := f.Glob(filepath.Join(dir, "a", "b", "re*")); err != nil || len(matches) != 1 || matches[0] != name {
+		t.Errorf("Incorrect glob result %v, %v", matches, err)
+	}
+
+	var walked []string
+	err = f.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(dir, path)
+		walked = append(walked, filepath.ToSlash(rel))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(walked)
+	if expected := []string{".", "a", "a/b", "a/b/renamed"}; !reflect.DeepEqual(walked, expected) {
+		t.Errorf("Incorrect walk %v != %v", walked, expected)
+	}
+
+	if err := f.Remove(name); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Open(name); !os.IsNotExist(err) {
+		t.Errorf("Removed file can be opened: %v", err)
+	}
+}
+
+func TestBasicFilesystemSymlinks(t *testing.T) {
+	f := NewBasicFilesystem()
+	if !f.SymlinksSupported() {
+		t.Skip("symlinks unsupported")
+	}
+
+	dir, err := ioutil.TempDir("", "syncthing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	name := filepath.Join(dir, "link")
+	if err := f.CreateSymlink(name, "target", 0); err != nil {
+		t.Fatal(err)
+	}
+
+	if info, err := f.Lstat(name); err != nil || info.Mode()&os.ModeSymlink == 0 {
+		t.Errorf("Not a symlink: %v", err)
+	}
+	if target, _, err := f.ReadSymlink(name); err != nil || target != "target" {
+		t.Errorf("Incorrect target %q, %v", target, err)
+	}
+}
+
+func TestRename(t *testing.T) {
+	dir, err := ioutil.TempDir("", "syncthing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	f := NewBasicFilesystem()
+	from, to := filepath.Join(dir, "temp"), filepath.Join(dir, "file")
+	for name, contents := range map[string]string{from: "new", to: "old"} {
+		if err := ioutil.WriteFile(name, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The destination is replaced, on all platforms.
+	if err := Rename(f, from, to); err != nil {
+		t.Fatal(err)
+	}
+	if bs, err := ioutil.ReadFile(to); err != nil || string(bs) != "new" {
+		t.Errorf("Incorrect contents %q, %v", bs, err)
+	}
+
+	// A failed rename doesn't leave the temporary file behind.
+	if err := ioutil.WriteFile(from, []byte("new"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := Rename(f, from, filepath.Join(dir, "nonexistent", "file")); err == nil {
+		t.Error("Unexpected nil error renaming into a nonexistent directory")
+	}
+	if _, err := f.Lstat(from); !os.IsNotExist(err) {
+		t.Errorf("Temporary file left behind: %v", err)
+	}
+}
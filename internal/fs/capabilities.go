@@ -0,0 +1,82 @@
+// Copyright (C) 2014 The Syncthing Authors.
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for
+// more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package fs
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/syncthing/syncthing/internal/osutil"
+	"github.com/syncthing/syncthing/internal/protocol"
+)
+
+// Capabilities describes what the file system holding a folder supports.
+type Capabilities struct {
+	CaseSensitive bool // names differing only in case are different files
+	Permissions   bool // permission bits are kept as set
+	Symlinks      bool // symlinks can be created
+	Xattrs        bool // extended attributes can be set
+}
+
+// Probe finds the capabilities of the file system holding dir, by creating,
+// inspecting and removing a temporary file and symlink in it. Extended
+// attributes are only probed on the local file system.
+func Probe(filesystem Filesystem, dir string) (Capabilities, error) {
+	var caps Capabilities
+
+	name := filepath.Join(dir, fmt.Sprintf(".syncthing.probe-%d", rand.Int63()))
+	fd, err := filesystem.Create(name)
+	if err != nil {
+		return caps, err
+	}
+	fd.Close()
+	defer filesystem.Remove(name)
+
+	// The name is lower case, so an upper case variant of it exists only if
+	// the file system ignores case.
+	_, err = filesystem.Lstat(filepath.Join(dir, strings.ToUpper(filepath.Base(name))))
+	caps.CaseSensitive = os.IsNotExist(err)
+
+	caps.Permissions = true
+	for _, mode := range []os.FileMode{0640, 0604} {
+		if err := filesystem.Chmod(name, mode); err != nil {
+			caps.Permissions = false
+			break
+		}
+		if info, err := filesystem.Lstat(name); err != nil || info.Mode().Perm() != mode {
+			caps.Permissions = false
+			break
+		}
+	}
+
+	if filesystem.SymlinksSupported() {
+		link := name + ".link"
+		if err := filesystem.CreateSymlink(link, filepath.Base(name), 0); err == nil {
+			caps.Symlinks = true
+			filesystem.Remove(link)
+		}
+	}
+
+	if _, ok := filesystem.(*BasicFilesystem); ok {
+		err := osutil.SetXattrs(name, []protocol.Xattr{{Name: "user.syncthing.probe", Value: []byte("1")}})
+		caps.Xattrs = err == nil
+	}
+
+	return caps, nil
+}
@@ -0,0 +1,48 @@
+// Copyright (C) 2014 The Syncthing Authors.
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for
+// more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package fs
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestProbe(t *testing.T) {
+	dir, err := ioutil.TempDir("", "syncthing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	caps, err := Probe(NewBasicFilesystem(), dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if runtime.GOOS == "linux" && (!caps.CaseSensitive || !caps.Permissions || !caps.Symlinks) {
+		t.Errorf("Unexpected capabilities %+v of the temporary directory", caps)
+	}
+
+	if names, err := ioutil.ReadDir(dir); err != nil || len(names) != 0 {
+		t.Errorf("Probe left files behind, %v", err)
+	}
+
+	if _, err := Probe(NewBasicFilesystem(), filepath.Join(dir, "nonexistent")); err == nil {
+		t.Error("Unexpected nil error probing a nonexistent directory")
+	}
+}
@@ -0,0 +1,104 @@
+// Copyright (C) 2014 The Syncthing Authors.
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for
+// more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program. If not, see <http://www.gnu.org/licenses/>.
+
+// Package fs provides an abstraction of the file system operations used to
+// scan, sync and version the files of a folder, so that folders can be kept
+// on other kinds of storage than the local disk.
+package fs
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// The Filesystem interface abstracts access to the file system. The names
+// passed to the methods are paths in the native format, as given to the
+// corresponding functions in package os.
+type Filesystem interface {
+	Chmod(name string, mode os.FileMode) error
+	Chtimes(name string, atime time.Time, mtime time.Time) error
+	Create(name string) (File, error)
+	Glob(pattern string) ([]string, error)
+	Lchown(name string, uid, gid int) error
+	Link(oldname, newname string) error
+	Lstat(name string) (os.FileInfo, error)
+	Mkdir(name string, perm os.FileMode) error
+	MkdirAll(name string, perm os.FileMode) error
+	Open(name string) (File, error)
+	OpenFile(name string, flags int, mode os.FileMode) (File, error)
+	Remove(name string) error
+	Rename(oldname, newname string) error
+	Stat(name string) (os.FileInfo, error)
+	Walk(root string, walkFn filepath.WalkFunc) error
+
+	// SymlinksSupported returns whether symlinks can be read and created.
+	SymlinksSupported() bool
+	// ReadSymlink returns the target of the symlink and its protocol flags
+	// describing the type of the target.
+	ReadSymlink(name string) (string, uint32, error)
+	// CreateSymlink creates a symlink to target, of the type given by the
+	// protocol flags.
+	CreateSymlink(name, target string, flags uint32) error
+	// ChangeSymlinkType changes the type of the symlink to the one given by
+	// the protocol flags.
+	ChangeSymlinkType(name string, flags uint32) error
+}
+
+// The File interface abstracts access to an open file. It's the subset of
+// the methods of *os.File that is used by the callers of a Filesystem.
+type File interface {
+	io.Reader
+	io.ReaderAt
+	io.Writer
+	io.WriterAt
+	io.Seeker
+	io.Closer
+	Name() string
+	Readdirnames(n int) ([]string, error)
+	Stat() (os.FileInfo, error)
+	Sync() error
+	Truncate(size int64) error
+}
+
+// DefaultFilesystem is the local file system, used unless another
+// Filesystem is given.
+var DefaultFilesystem Filesystem = NewBasicFilesystem()
+
+// Try to keep this entire operation atomic-like. We shouldn't be doing this
+// often enough that there is any contention on this lock.
+var renameLock sync.Mutex
+
+// Rename renames a file on the filesystem, while trying hard to succeed by
+// temporarily tweaking directory permissions. Will make sure to delete the
+// from file if the operation fails, so use only for situations like
+// committing a temp file to its final location.
+func Rename(filesystem Filesystem, from, to string) error {
+	renameLock.Lock()
+	defer renameLock.Unlock()
+
+	// Make sure the destination directory is writeable
+	toDir := filepath.Dir(to)
+	if info, err := filesystem.Stat(toDir); err == nil && info.IsDir() && info.Mode()&0200 == 0 {
+		filesystem.Chmod(toDir, 0755)
+		defer filesystem.Chmod(toDir, info.Mode())
+	}
+
+	// Don't leave a dangling temp file in case of rename error
+	defer filesystem.Remove(from)
+	return filesystem.Rename(from, to)
+}
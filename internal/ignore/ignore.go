@@ -46,6 +46,7 @@ func (p Pattern) String() string {
 
 type Matcher struct {
 	patterns  []Pattern
+	defaults  []Pattern
 	withCache bool
 	matches   *cache
 	curHash   string
@@ -78,6 +79,16 @@ func (m *Matcher) Load(file string) error {
 	return m.Parse(fd, file)
 }
 
+// SetDefaults sets patterns that apply in addition to those from the ignore
+// file, taking effect on the next Load or Parse.
+func (m *Matcher) SetDefaults(lines []string) error {
+	patterns, err := parseIgnoreFile(strings.NewReader(strings.Join(lines, "\n")), "", make(map[string]bool))
+	m.mut.Lock()
+	m.defaults = patterns
+	m.mut.Unlock()
+	return err
+}
+
 func (m *Matcher) Parse(r io.Reader, file string) error {
 	m.mut.Lock()
 	defer m.mut.Unlock()
@@ -87,6 +98,10 @@ func (m *Matcher) Parse(r io.Reader, file string) error {
 	// Error is saved and returned at the end. We process the patterns
 	// (possibly blank) anyway.
 
+	// The defaults come last, so that the patterns from the file can
+	// override them by negation.
+	patterns = append(patterns, m.defaults...)
+
 	newHash := hashPatterns(patterns)
 	if newHash == m.curHash {
 		// We've already loaded exactly these patterns.
@@ -146,6 +161,42 @@ func (m *Matcher) Patterns() []string {
 	return patterns
 }
 
+// IgnoresMore returns whether the patterns new, as returned by Patterns,
+// ignore at least all the files that the patterns old do. As the first
+// matching pattern decides, this is the case when the patterns kept are in
+// the same order, those added ignore files, and those removed exclude files
+// from being ignored. Other changes may ignore more files too, but that's
+// not determined.
+func IgnoresMore(old, new []string) bool {
+	i := 0
+	for _, pat := range new {
+		// Patterns of old skipped to get to this one must have been
+		// removed.
+		j := i
+		for j < len(old) && old[j] != pat && isExcludePattern(old[j]) {
+			j++
+		}
+		if j < len(old) && old[j] == pat {
+			i = j + 1
+			continue
+		}
+		if isExcludePattern(pat) {
+			// An added exclusion
+			return false
+		}
+	}
+	for ; i < len(old); i++ {
+		if !isExcludePattern(old[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func isExcludePattern(pat string) bool {
+	return strings.HasPrefix(pat, "(?exclude)")
+}
+
 func (m *Matcher) Hash() string {
 	m.mut.Lock()
 	defer m.mut.Unlock()
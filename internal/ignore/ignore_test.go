@@ -518,3 +518,58 @@ func TestHashOfEmpty(t *testing.T) {
 		t.Error("there are more than zero patterns")
 	}
 }
+
+func TestDefaults(t *testing.T) {
+	pats := New(false)
+	if err := pats.SetDefaults([]string{".DS_Store", "@eaDir"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The defaults apply even without an ignore file.
+	pats.Load("testdata/does-not-exist")
+	if !pats.Match(".DS_Store") || !pats.Match(filepath.Join("dir", ".DS_Store")) || !pats.Match("@eaDir") {
+		t.Error("Default pattern should match without an ignore file")
+	}
+
+	// The patterns from the file take precedence.
+	err := pats.Parse(bytes.NewBufferString("!.DS_Store\nafile\n"), ".stignore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pats.Match(".DS_Store") {
+		t.Error("Negated default pattern should not match")
+	}
+	if !pats.Match("afile") || !pats.Match("@eaDir") {
+		t.Error("Patterns from both the file and the defaults should match")
+	}
+}
+
+func TestIgnoresMore(t *testing.T) {
+	patterns := func(lines string) []string {
+		m := New(false)
+		if err := m.Parse(bytes.NewBufferString(lines), ".stignore"); err != nil {
+			t.Fatal(err)
+		}
+		return m.Patterns()
+	}
+
+	cases := []struct {
+		old, new string
+		more     bool
+	}{
+		{"a\nb\n", "a\nb\n", true},
+		{"", "a\n", true},
+		{"a\n", "x\na\ny\n", true},
+		{"!a\nb*\n", "b*\n", true},
+		{"!a\nb*\n", "c\n!a\nb*\n", true},
+		{"a\n", "", false},
+		{"a\n", "!a2\na\n", false},
+		{"!a\nb*\n", "b*\n!a\n", false},
+		{"a\nb\n", "b\n", false},
+	}
+	for _, tc := range cases {
+		if more := IgnoresMore(patterns(tc.old), patterns(tc.new)); more != tc.more {
+			t.Errorf("%q -> %q: unexpected %v", tc.old, tc.new, more)
+		}
+	}
+}
@@ -1,15 +1,21 @@
 // Copyright (C) 2014 Jakob Borg. All rights reserved. Use of this source code
 // is governed by an MIT-style license that can be found in the LICENSE file.
 
-// Package logger implements a standardized logger with callback functionality
+// Package logger implements a standardized logger with callback
+// functionality. It started out as github.com/calmh/logger, and is kept here
+// since gaining formatters.
 package logger
 
 import (
+	"encoding/json"
 	"fmt"
+	"io"
 	"log"
 	"os"
+	"runtime"
 	"strings"
 	"sync"
+	"time"
 )
 
 type LogLevel int
@@ -23,13 +29,60 @@ const (
 	NumLevels
 )
 
+var levelNames = [NumLevels]string{"DEBUG", "INFO", "OK", "WARNING", "FATAL"}
+
+func (l LogLevel) String() string {
+	if l < 0 || l >= NumLevels {
+		return fmt.Sprintf("LogLevel(%d)", int(l))
+	}
+	return levelNames[l]
+}
+
 // A MessageHandler is called with the log level and message text.
 type MessageHandler func(l LogLevel, msg string)
 
+// A Message is a log message about to be written.
+type Message struct {
+	Time     time.Time
+	Level    LogLevel
+	Facility string // The package that logged the message
+	Prefix   string // As set by SetPrefix
+	Text     string
+}
+
+// A Formatter turns messages into the lines written to the log. Without a
+// Formatter, messages are written as text prefixed as set by SetFlags.
+type Formatter interface {
+	Format(m Message) []byte
+}
+
+// JSONFormatter writes each message as a JSON object on a line of its own.
+type JSONFormatter struct{}
+
+func (JSONFormatter) Format(m Message) []byte {
+	bs, _ := json.Marshal(struct {
+		Time     string `json:"time"`
+		Level    string `json:"level"`
+		Facility string `json:"facility"`
+		Prefix   string `json:"prefix,omitempty"`
+		Message  string `json:"message"`
+	}{
+		Time:     m.Time.Format(time.RFC3339Nano),
+		Level:    m.Level.String(),
+		Facility: m.Facility,
+		Prefix:   strings.TrimSpace(m.Prefix),
+		Message:  m.Text,
+	})
+	return append(bs, '\n')
+}
+
 type Logger struct {
-	logger   *log.Logger
-	handlers [NumLevels][]MessageHandler
-	mut      sync.Mutex
+	logger    *log.Logger
+	out       io.Writer
+	prefix    string
+	formatter Formatter
+	handlers  [NumLevels][]MessageHandler
+	mut       sync.Mutex
 }
 
 // The default logger logs to standard output with a time prefix.
@@ -38,6 +91,7 @@ var DefaultLogger = New()
 func New() *Logger {
 	return &Logger{
 		logger: log.New(os.Stdout, "", log.Ltime),
+		out:    os.Stdout,
 	}
 }
 
@@ -56,22 +110,71 @@ func (l *Logger) SetFlags(flag int) {
 
 // See log.SetPrefix
 func (l *Logger) SetPrefix(prefix string) {
+	l.mut.Lock()
+	defer l.mut.Unlock()
+	l.prefix = prefix
 	l.logger.SetPrefix(prefix)
 }
 
+// SetFormatter sets the Formatter for the messages written from now on. A
+// nil Formatter writes text, as by default.
+func (l *Logger) SetFormatter(f Formatter) {
+	l.mut.Lock()
+	defer l.mut.Unlock()
+	l.formatter = f
+}
+
 func (l *Logger) callHandlers(level LogLevel, s string) {
 	for _, h := range l.handlers[level] {
 		h(level, strings.TrimSpace(s))
 	}
 }
 
+// output writes the message and calls the handlers. It's called with the
+// lock held, directly from the exported logging methods.
+func (l *Logger) output(level LogLevel, s string) {
+	if l.formatter == nil {
+		l.logger.Output(3, levelNames[level]+": "+s)
+	} else {
+		l.out.Write(l.formatter.Format(Message{
+			Time:     time.Now(),
+			Level:    level,
+			Facility: callerPackage(3),
+			Prefix:   l.prefix,
+			Text:     strings.TrimSpace(s),
+		}))
+	}
+	l.callHandlers(level, s)
+}
+
+// callerPackage returns the name of the package of the function calldepth
+// frames up the stack, such as "model" for
+// "github.com/syncthing/syncthing/internal/model.(*Model).Index".
+func callerPackage(calldepth int) string {
+	pc, _, _, ok := runtime.Caller(calldepth)
+	if !ok {
+		return ""
+	}
+	fn := runtime.FuncForPC(pc)
+	if fn == nil {
+		return ""
+	}
+	name := fn.Name()
+	if i := strings.LastIndex(name, "/"); i >= 0 {
+		name = name[i+1:]
+	}
+	if i := strings.Index(name, "."); i >= 0 {
+		name = name[:i]
+	}
+	return name
+}
+
 // Debugln logs a line with a DEBUG prefix.
 func (l *Logger) Debugln(vals ...interface{}) {
 	l.mut.Lock()
 	defer l.mut.Unlock()
 	s := fmt.Sprintln(vals...)
-	l.logger.Output(2, "DEBUG: "+s)
-	l.callHandlers(LevelDebug, s)
+	l.output(LevelDebug, s)
 }
 
 // Debugf logs a formatted line with a DEBUG prefix.
@@ -79,8 +182,7 @@ func (l *Logger) Debugf(format string, vals ...interface{}) {
 	l.mut.Lock()
 	defer l.mut.Unlock()
 	s := fmt.Sprintf(format, vals...)
-	l.logger.Output(2, "DEBUG: "+s)
-	l.callHandlers(LevelDebug, s)
+	l.output(LevelDebug, s)
 }
 
 // Infoln logs a line with an INFO prefix.
@@ -88,8 +190,7 @@ func (l *Logger) Infoln(vals ...interface{}) {
 	l.mut.Lock()
 	defer l.mut.Unlock()
 	s := fmt.Sprintln(vals...)
-	l.logger.Output(2, "INFO: "+s)
-	l.callHandlers(LevelInfo, s)
+	l.output(LevelInfo, s)
 }
 
 // Infof logs a formatted line with an INFO prefix.
@@ -97,8 +198,7 @@ func (l *Logger) Infof(format string, vals ...interface{}) {
 	l.mut.Lock()
 	defer l.mut.Unlock()
 	s := fmt.Sprintf(format, vals...)
-	l.logger.Output(2, "INFO: "+s)
-	l.callHandlers(LevelInfo, s)
+	l.output(LevelInfo, s)
 }
 
 // Okln logs a line with an OK prefix.
@@ -106,8 +206,7 @@ func (l *Logger) Okln(vals ...interface{}) {
 	l.mut.Lock()
 	defer l.mut.Unlock()
 	s := fmt.Sprintln(vals...)
-	l.logger.Output(2, "OK: "+s)
-	l.callHandlers(LevelOK, s)
+	l.output(LevelOK, s)
 }
 
 // Okf logs a formatted line with an OK prefix.
@@ -115,8 +214,7 @@ func (l *Logger) Okf(format string, vals ...interface{}) {
 	l.mut.Lock()
 	defer l.mut.Unlock()
 	s := fmt.Sprintf(format, vals...)
-	l.logger.Output(2, "OK: "+s)
-	l.callHandlers(LevelOK, s)
+	l.output(LevelOK, s)
 }
 
 // Warnln logs a formatted line with a WARNING prefix.
@@ -124,8 +222,7 @@ func (l *Logger) Warnln(vals ...interface{}) {
 	l.mut.Lock()
 	defer l.mut.Unlock()
 	s := fmt.Sprintln(vals...)
-	l.logger.Output(2, "WARNING: "+s)
-	l.callHandlers(LevelWarn, s)
+	l.output(LevelWarn, s)
 }
 
 // Warnf logs a formatted line with a WARNING prefix.
@@ -133,8 +230,7 @@ func (l *Logger) Warnf(format string, vals ...interface{}) {
 	l.mut.Lock()
 	defer l.mut.Unlock()
 	s := fmt.Sprintf(format, vals...)
-	l.logger.Output(2, "WARNING: "+s)
-	l.callHandlers(LevelWarn, s)
+	l.output(LevelWarn, s)
 }
 
 // Fatalln logs a line with a FATAL prefix and exits the process with exit
@@ -143,8 +239,7 @@ func (l *Logger) Fatalln(vals ...interface{}) {
 	l.mut.Lock()
 	defer l.mut.Unlock()
 	s := fmt.Sprintln(vals...)
-	l.logger.Output(2, "FATAL: "+s)
-	l.callHandlers(LevelFatal, s)
+	l.output(LevelFatal, s)
 	os.Exit(1)
 }
 
@@ -154,7 +249,6 @@ func (l *Logger) Fatalf(format string, vals ...interface{}) {
 	l.mut.Lock()
 	defer l.mut.Unlock()
 	s := fmt.Sprintf(format, vals...)
-	l.logger.Output(2, "FATAL: "+s)
-	l.callHandlers(LevelFatal, s)
+	l.output(LevelFatal, s)
 	os.Exit(1)
 }
@@ -4,8 +4,11 @@
 package logger
 
 import (
+	"bytes"
+	"encoding/json"
 	"strings"
 	"testing"
+	"time"
 )
 
 func TestAPI(t *testing.T) {
@@ -56,3 +59,39 @@ func checkFunc(t *testing.T, expectl LogLevel, expectmsg string, counter *int) f
 		}
 	}
 }
+
+func TestJSONFormatter(t *testing.T) {
+	l := New()
+	var buf bytes.Buffer
+	l.out = &buf
+	l.SetPrefix("[ABCDE] ")
+	l.SetFormatter(JSONFormatter{})
+
+	l.Infof("line one\nline \"two\"\t%d", 2)
+	l.Warnln("second", "message")
+
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Expected two lines, got %q", buf.String())
+	}
+
+	var m struct {
+		Time     time.Time
+		Level    string
+		Facility string
+		Prefix   string
+		Message  string
+	}
+	if err := json.Unmarshal([]byte(lines[0]), &m); err != nil {
+		t.Fatal(err)
+	}
+	if m.Time.IsZero() || m.Level != "INFO" || m.Facility != "logger" || m.Prefix != "[ABCDE]" || m.Message != "line one\nline \"two\"\t2" {
+		t.Errorf("Unexpected message %+v", m)
+	}
+	if err := json.Unmarshal([]byte(lines[1]), &m); err != nil {
+		t.Fatal(err)
+	}
+	if m.Level != "WARNING" || m.Message != "second message" {
+		t.Errorf("Unexpected message %+v", m)
+	}
+}
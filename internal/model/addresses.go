@@ -0,0 +1,78 @@
+// Copyright (C) 2014 The Syncthing Authors.
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for
+// more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package model
+
+import (
+	"net"
+
+	"github.com/syncthing/syncthing/internal/events"
+	"github.com/syncthing/syncthing/internal/protocol"
+)
+
+// The address sources passed to ObserveAddress.
+const (
+	AddressIncoming  = "incoming"  // the device connected to us
+	AddressStatic    = "static"    // we connected to a configured address
+	AddressDiscovery = "discovery" // we connected to a discovered address
+)
+
+// deviceAddress is the address a device was last connected at.
+type deviceAddress struct {
+	address  string
+	source   string
+	previous string // the address before the latest change
+}
+
+// ObserveAddress records the address a device is being connected at, and
+// how that address was found. A DeviceAddressChanged event is generated the
+// first time a device is seen and whenever the host differs from the one it
+// was last connected at. Ports aren't compared, as the port of an incoming
+// connection is usually picked at random.
+func (m *Model) ObserveAddress(deviceID protocol.DeviceID, address, source string) {
+	m.pmut.Lock()
+	cur, ok := m.deviceAddrs[deviceID]
+	changed := !ok || addressHost(cur.address) != addressHost(address)
+	if changed {
+		m.deviceAddrs[deviceID] = deviceAddress{address, source, cur.address}
+	} else {
+		cur.address, cur.source = address, source
+		m.deviceAddrs[deviceID] = cur
+	}
+	m.pmut.Unlock()
+
+	if !changed {
+		return
+	}
+	if debug {
+		l.Debugf("%v address of %s changed from %q to %q (%s)", m, deviceID, cur.address, address, source)
+	}
+	events.Default.Log(events.DeviceAddressChanged, map[string]string{
+		"device":   deviceID.String(),
+		"address":  address,
+		"previous": cur.address,
+		"source":   source,
+	})
+}
+
+// addressHost returns the host part of addr, or addr itself if it has no
+// port.
+func addressHost(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
@@ -0,0 +1,135 @@
+// Copyright (C) 2014 The Syncthing Authors.
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for
+// more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package model
+
+import (
+	"errors"
+	"sort"
+
+	"github.com/syncthing/syncthing/internal/config"
+	"github.com/syncthing/syncthing/internal/files"
+	"github.com/syncthing/syncthing/internal/protocol"
+)
+
+// The ways in which a file can differ from the global state, in a
+// FileDivergence.
+const (
+	DivergenceMissing  = "missing"  // others have the file, we don't
+	DivergenceModified = "modified" // others have a newer version of the file
+	DivergenceDeleted  = "deleted"  // others have deleted the file, we still have it
+	DivergenceLocal    = "local"    // our version of the file is newer than what any other device has
+)
+
+// A FileDivergence is a file that is different locally from the global
+// state.
+type FileDivergence struct {
+	Name          string
+	Kind          string // one of the Divergence* constants
+	LocalVersion  uint64 // zero if we don't have the file
+	GlobalVersion uint64 // the newest version, of any device
+}
+
+// folderAudited returns whether the folder is only audited.
+func (m *Model) folderAudited(folder string) bool {
+	m.fmut.RLock()
+	defer m.fmut.RUnlock()
+	return m.folderCfgs[folder].Type == config.FolderTypeAudit
+}
+
+// FolderDivergence returns the files of the folder that differ from the
+// other devices, by name. It can be used on any folder, but is what audit
+// folders are for.
+func (m *Model) FolderDivergence(folder string) ([]FileDivergence, error) {
+	m.fmut.RLock()
+	rf, ok := m.folderFiles[folder]
+	devices := m.folderDevices[folder]
+	m.fmut.RUnlock()
+	if !ok {
+		return nil, errors.New("no such folder")
+	}
+
+	var res []FileDivergence
+
+	// Whatever we need is newer elsewhere.
+	rf.WithNeedTruncated(protocol.LocalDeviceID, func(fi files.FileIntf) bool {
+		f := fi.(files.FileInfoTruncated)
+		d := FileDivergence{Name: f.Name, GlobalVersion: f.Version}
+		lf, have := rf.Get(protocol.LocalDeviceID, f.Name)
+		if have && lf.IsDeleted() && f.IsDeleted() {
+			// Deleted everywhere, only at different times.
+			return true
+		}
+		switch {
+		case !have || lf.IsDeleted() && !f.IsDeleted():
+			d.Kind = DivergenceMissing
+		case f.IsDeleted():
+			d.Kind = DivergenceDeleted
+		default:
+			d.Kind = DivergenceModified
+		}
+		if have {
+			d.LocalVersion = lf.Version
+		}
+		res = append(res, d)
+		return true
+	})
+
+	// What we have as the global version but no one else does has changed
+	// here.
+	rf.WithHaveTruncated(protocol.LocalDeviceID, func(fi files.FileIntf) bool {
+		f := fi.(files.FileInfoTruncated)
+		if f.IsInvalid() {
+			return true
+		}
+		if gf, ok := rf.GetGlobalTruncated(f.Name); !ok || gf.Version != f.Version {
+			return true
+		}
+		if avail := rf.Availability(f.Name); len(avail) != 1 || avail[0] != protocol.LocalDeviceID {
+			return true
+		}
+		if f.IsDeleted() && !othersHave(rf, devices, f.Name) {
+			// Deleted here, and never had or also deleted elsewhere.
+			return true
+		}
+		res = append(res, FileDivergence{
+			Name:          f.Name,
+			Kind:          DivergenceLocal,
+			LocalVersion:  f.Version,
+			GlobalVersion: f.Version,
+		})
+		return true
+	})
+
+	sort.Sort(divergencesByName(res))
+	return res, nil
+}
+
+// othersHave returns whether any of the devices has a file of the name that
+// isn't deleted.
+func othersHave(rf *files.Set, devices []protocol.DeviceID, name string) bool {
+	for _, device := range devices {
+		if f, ok := rf.Get(device, name); ok && !f.IsDeleted() {
+			return true
+		}
+	}
+	return false
+}
+
+type divergencesByName []FileDivergence
+
+func (l divergencesByName) Len() int           { return len(l) }
+func (l divergencesByName) Less(a, b int) bool { return l[a].Name < l[b].Name }
+func (l divergencesByName) Swap(a, b int)      { l[a], l[b] = l[b], l[a] }
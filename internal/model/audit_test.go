@@ -0,0 +1,126 @@
+// Copyright (C) 2014 The Syncthing Authors.
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for
+// more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package model
+
+import (
+	"testing"
+
+	"github.com/syncthing/syncthing/internal/config"
+	"github.com/syncthing/syncthing/internal/protocol"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+)
+
+func TestFolderDivergence(t *testing.T) {
+	fcfg := config.FolderConfiguration{
+		ID:      "default",
+		Path:    "testdata",
+		Type:    config.FolderTypeAudit,
+		Devices: []config.FolderDeviceConfiguration{{DeviceID: device1}},
+	}
+	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	m := NewModel(config.Wrap("/tmp/test", config.Configuration{Folders: []config.FolderConfiguration{fcfg}}), "device", "syncthing", "dev", db)
+	m.AddFolder(fcfg)
+
+	if _, ok := m.FolderCapabilities("default"); ok {
+		t.Error("An audit folder should not be probed, as that writes to it")
+	}
+
+	m.folderFiles["default"].Update(protocol.LocalDeviceID, []protocol.FileInfo{
+		{Name: "same", Version: 1},
+		{Name: "modified", Version: 1},
+		{Name: "deleted", Version: 1},
+		{Name: "local", Version: 2},
+		{Name: "new", Version: 1},
+		{Name: "gone", Version: 2, Flags: protocol.FlagDeleted},
+		{Name: "removed", Version: 2, Flags: protocol.FlagDeleted},
+		{Name: "bothdeleted", Version: 1, Flags: protocol.FlagDeleted},
+	})
+	m.folderFiles["default"].Replace(device1, []protocol.FileInfo{
+		{Name: "same", Version: 1},
+		{Name: "missing", Version: 2},
+		{Name: "modified", Version: 2},
+		{Name: "deleted", Version: 2, Flags: protocol.FlagDeleted},
+		{Name: "local", Version: 1},
+		{Name: "removed", Version: 1},
+		{Name: "bothdeleted", Version: 2, Flags: protocol.FlagDeleted},
+	})
+
+	res, err := m.FolderDivergence("default")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []FileDivergence{
+		{"deleted", DivergenceDeleted, 1, 2},
+		{"local", DivergenceLocal, 2, 2},
+		{"missing", DivergenceMissing, 0, 2},
+		{"modified", DivergenceModified, 1, 2},
+		{"new", DivergenceLocal, 1, 1},
+		{"removed", DivergenceLocal, 2, 2},
+	}
+	if len(res) != len(expected) {
+		t.Fatalf("Expected %d differing files, not %v", len(expected), res)
+	}
+	for i := range expected {
+		if res[i] != expected[i] {
+			t.Errorf("Expected %v, not %v", expected[i], res[i])
+		}
+	}
+
+	if _, err := m.FolderDivergence("nonexistent"); err == nil {
+		t.Error("Unexpected nil error for a nonexistent folder")
+	}
+
+	// Audit folders never serve their files, so they are announced as
+	// invalid, which keeps them out of the global version elsewhere.
+	if _, err := m.Request(device1, "default", "same", 0, 1); err != ErrAuditOnly {
+		t.Errorf("Expected ErrAuditOnly, not %v", err)
+	}
+	conn := &indexRecorder{FakeConnection: FakeConnection{id: device1}}
+	if _, err := sendIndexTo(true, 0, conn, "default", m.folderFiles["default"], nil, true); err != nil {
+		t.Fatal(err)
+	}
+	if len(conn.files) != 8 {
+		t.Errorf("Expected the whole index to be sent, not %v", conn.files)
+	}
+	for _, f := range conn.files {
+		if !f.IsInvalid() {
+			t.Errorf("File %q of an audit folder announced as valid", f.Name)
+		}
+	}
+
+	// Nor are their changes overridden.
+	m.Override("default")
+	if f, _ := m.CurrentFolderFile("default", "modified"); f.Version != 1 {
+		t.Errorf("Audit folder overridden, got %v", f)
+	}
+}
+
+// An indexRecorder is a connection that keeps the index sent to it.
+type indexRecorder struct {
+	FakeConnection
+	files []protocol.FileInfo
+}
+
+func (c *indexRecorder) Index(folder string, fs []protocol.FileInfo) error {
+	c.files = append(c.files, fs...)
+	return nil
+}
+
+func (c *indexRecorder) IndexUpdate(folder string, fs []protocol.FileInfo) error {
+	c.files = append(c.files, fs...)
+	return nil
+}
@@ -0,0 +1,98 @@
+// Copyright (C) 2014 The Syncthing Authors.
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for
+// more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package model
+
+import (
+	"time"
+
+	"github.com/syncthing/syncthing/internal/events"
+	"github.com/syncthing/syncthing/internal/files"
+	"github.com/syncthing/syncthing/internal/protocol"
+)
+
+// A folder is only paused automatically when at least this many of its
+// files are changed, so that small folders aren't paused by everyday
+// changes.
+const autoPauseMinFiles = 10
+
+// checkIncoming counts the local files that the index from deviceID changes
+// or deletes, towards those changed since the folder was last in sync. When
+// they are more than the folder's threshold percentage of its files, the
+// folder is paused and FolderAutoPaused is logged, so that the changes are
+// reviewed before they are pulled. It's called before the index is stored.
+func (m *Model) checkIncoming(deviceID protocol.DeviceID, folder string, fs *files.Set, incoming []protocol.FileInfo) {
+	m.fmut.RLock()
+	pct := m.folderCfgs[folder].AutoPauseChangeThresholdPct
+	m.fmut.RUnlock()
+	if pct <= 0 || m.folderPaused(folder) {
+		return
+	}
+
+	// Files from observers are invalid, and never pulled.
+	var names []string
+	for _, f := range incoming {
+		if f.IsInvalid() {
+			continue
+		}
+		if cur, ok := fs.Get(protocol.LocalDeviceID, f.Name); ok && !cur.IsDeleted() && !cur.IsInvalid() && f.Version > cur.Version {
+			names = append(names, f.Name)
+		}
+	}
+	if len(names) == 0 {
+		return
+	}
+
+	// A file changed again, or by another device, is counted once.
+	m.incomingMut.Lock()
+	set, ok := m.incoming[folder]
+	if !ok {
+		set = make(map[string]bool)
+		m.incoming[folder] = set
+	}
+	for _, name := range names {
+		set[name] = true
+	}
+	changed := len(set)
+	m.incomingMut.Unlock()
+
+	if changed < autoPauseMinFiles {
+		return
+	}
+	nfiles, _, _ := m.LocalSize(folder)
+	if changed*100 <= pct*nfiles {
+		return
+	}
+
+	l.Warnf("Folder %q: device %s changes or deletes %d of our %d files, more than the %d%% threshold; pausing the folder. Review the changes and resume it to pull them.", folder, deviceID, changed, nfiles, pct)
+	if err := m.PauseFolder(folder, time.Time{}); err != nil {
+		l.Warnln("Pausing folder:", err)
+	}
+	events.Default.Log(events.FolderAutoPaused, map[string]interface{}{
+		"folder":  folder,
+		"device":  deviceID.String(),
+		"changed": changed,
+		"files":   nfiles,
+	})
+	m.resetIncoming(folder)
+}
+
+// resetIncoming forgets the changes counted towards pausing the folder. It's
+// called when the folder is in sync.
+func (m *Model) resetIncoming(folder string) {
+	m.incomingMut.Lock()
+	delete(m.incoming, folder)
+	m.incomingMut.Unlock()
+}
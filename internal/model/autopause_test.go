@@ -0,0 +1,99 @@
+// Copyright (C) 2014 The Syncthing Authors.
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for
+// more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package model
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/syncthing/syncthing/internal/config"
+	"github.com/syncthing/syncthing/internal/protocol"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+)
+
+func TestAutoPause(t *testing.T) {
+	// Saving the configuration leaves a backup beside it.
+	dir, err := ioutil.TempDir("", "syncthing-autopause")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fcfg := config.FolderConfiguration{
+		ID:                          "default",
+		Path:                        "testdata",
+		Devices:                     []config.FolderDeviceConfiguration{{DeviceID: device1}, {DeviceID: device2, Observer: true}},
+		AutoPauseChangeThresholdPct: 50,
+	}
+	cfg := config.Wrap(filepath.Join(dir, "config.xml"), config.Configuration{
+		Devices: []config.DeviceConfiguration{{DeviceID: device1}, {DeviceID: device2}},
+		Folders: []config.FolderConfiguration{fcfg},
+	})
+	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	m := NewModel(cfg, "device", "syncthing", "dev", db)
+	m.AddFolder(fcfg)
+
+	var local []protocol.FileInfo
+	for i := 0; i < 40; i++ {
+		local = append(local, protocol.FileInfo{Name: fmt.Sprintf("file%d", i), Version: 10})
+	}
+	m.folderFiles["default"].Update(protocol.LocalDeviceID, local)
+
+	deleted := func(from, to int) []protocol.FileInfo {
+		var fs []protocol.FileInfo
+		for i := from; i < to; i++ {
+			fs = append(fs, protocol.FileInfo{Name: fmt.Sprintf("file%d", i), Version: 20, Flags: protocol.FlagDeleted})
+		}
+		return fs
+	}
+
+	// Deleting half of the files, over two updates, doesn't exceed the
+	// threshold. Older versions than ours don't count, nor do files
+	// already counted.
+	m.IndexUpdate(device1, "default", deleted(0, 10))
+	m.IndexUpdate(device1, "default", deleted(10, 20))
+	m.IndexUpdate(device1, "default", deleted(5, 15))
+	m.IndexUpdate(device1, "default", []protocol.FileInfo{{Name: "file30", Version: 5}})
+	if m.folderPaused("default") {
+		t.Fatal("Folder paused at the threshold")
+	}
+
+	m.IndexUpdate(device1, "default", deleted(20, 21))
+	if !m.folderPaused("default") {
+		t.Fatal("Folder not paused above the threshold")
+	}
+
+	// After resuming, and once in sync, what was changed before is not
+	// counted.
+	if err := m.ResumeFolder("default"); err != nil {
+		t.Fatal(err)
+	}
+	m.resetIncoming("default")
+	m.IndexUpdate(device1, "default", deleted(0, 9))
+	if m.folderPaused("default") {
+		t.Fatal("Folder paused for fewer than the minimum of changes")
+	}
+
+	// Changes from an observer are never pulled, and don't count.
+	m.IndexUpdate(device2, "default", deleted(10, 40))
+	if m.folderPaused("default") {
+		t.Fatal("Folder paused for the changes of an observer")
+	}
+}
@@ -0,0 +1,213 @@
+// Copyright (C) 2014 The Syncthing Authors.
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for
+// more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package model
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// A boosted folder gets a larger share of the block requests than the other
+// folders, for a limited time. While any folder is boosted, the block
+// requests of all folders go through the pullScheduler, which divides as
+// many outstanding requests as the pullers of all folders together make
+// between the folders in proportion to their weights. A folder may have as
+// many requests outstanding as its share, and more when other folders leave
+// theirs unused, unless a folder with a higher weight is waiting for them. So
+// the folders that aren't boosted, whose weight is one, are held back below
+// their own number of pullers only while a boosted folder has requests to
+// make. Without any boost the folders pull independently of each other, as
+// before.
+
+// DefaultBoostDuration is how long a boost lasts unless told otherwise.
+const DefaultBoostDuration = time.Hour
+
+type folderBoost struct {
+	weight int
+	until  time.Time
+}
+
+type pullScheduler struct {
+	slots   int                    // outstanding requests of all folders while boosted
+	pullers map[string]int         // folder -> pullers, when last boosted
+	boosts  map[string]folderBoost // folder -> boost
+	inUse   map[string]int         // folder -> outstanding requests
+	waiting map[string]int         // folder -> routines waiting for a slot
+	timer   *time.Timer            // wakes the waiters when the last boost expires
+	mut     sync.Mutex
+	cond    *sync.Cond
+}
+
+func newPullScheduler() *pullScheduler {
+	s := &pullScheduler{
+		boosts:  make(map[string]folderBoost),
+		inUse:   make(map[string]int),
+		waiting: make(map[string]int),
+	}
+	s.cond = sync.NewCond(&s.mut)
+	return s
+}
+
+// boost sets the weight of the folder until the given time, sharing the
+// requests that the pullers of the folders make between them. A weight of
+// one or less clears the boost.
+func (s *pullScheduler) boost(folder string, weight int, pullers map[string]int, until time.Time) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	if weight <= 1 {
+		delete(s.boosts, folder)
+	} else {
+		s.boosts[folder] = folderBoost{weight, until}
+	}
+	s.pullers = pullers
+	s.slots = 0
+	for _, n := range pullers {
+		s.slots += n
+	}
+
+	var last time.Time
+	for _, b := range s.boosts {
+		if b.until.After(last) {
+			last = b.until
+		}
+	}
+	if s.timer != nil {
+		s.timer.Stop()
+		s.timer = nil
+	}
+	if !last.IsZero() {
+		s.timer = time.AfterFunc(last.Sub(time.Now()), s.expire)
+	}
+	s.cond.Broadcast()
+}
+
+// expire forgets the expired boosts and wakes the waiters.
+func (s *pullScheduler) expire() {
+	s.mut.Lock()
+	s.active(time.Now())
+	s.cond.Broadcast()
+	s.mut.Unlock()
+}
+
+// active returns whether any folder is boosted, forgetting the expired
+// boosts.
+func (s *pullScheduler) active(now time.Time) bool {
+	for folder, b := range s.boosts {
+		if !now.Before(b.until) {
+			delete(s.boosts, folder)
+		}
+	}
+	return len(s.boosts) > 0
+}
+
+func (s *pullScheduler) weight(folder string) int {
+	if b, ok := s.boosts[folder]; ok {
+		return b.weight
+	}
+	return 1
+}
+
+// share returns how many requests the folder may have outstanding while
+// boosted; at least one, so that no folder stops entirely.
+func (s *pullScheduler) share(folder string) int {
+	total := 0
+	for f := range s.pullers {
+		total += s.weight(f)
+	}
+	if _, ok := s.pullers[folder]; !ok {
+		total += s.weight(folder)
+	}
+	if share := s.slots * s.weight(folder) / total; share > 1 {
+		return share
+	}
+	return 1
+}
+
+// acquire waits until the folder may make a block request.
+func (s *pullScheduler) acquire(folder string) {
+	s.mut.Lock()
+	s.waiting[folder]++
+	for !s.mayRun(folder) {
+		s.cond.Wait()
+	}
+	s.waiting[folder]--
+	s.inUse[folder]++
+	s.mut.Unlock()
+}
+
+// release returns the slot taken by acquire.
+func (s *pullScheduler) release(folder string) {
+	s.mut.Lock()
+	s.inUse[folder]--
+	s.cond.Broadcast()
+	s.mut.Unlock()
+}
+
+// mayRun returns whether a routine of the folder may take a slot, which it
+// may while no folder is boosted or the folder has fewer requests
+// outstanding than its share. Beyond its share it may take a slot left
+// unused by the other folders, when no folder with a higher weight is
+// waiting for one.
+func (s *pullScheduler) mayRun(folder string) bool {
+	if !s.active(time.Now()) {
+		return true
+	}
+	if s.inUse[folder] < s.share(folder) {
+		return true
+	}
+
+	used := 0
+	for _, n := range s.inUse {
+		used += n
+	}
+	if used >= s.slots {
+		return false
+	}
+	weight := s.weight(folder)
+	for f, n := range s.waiting {
+		if n > 0 && s.weight(f) > weight {
+			return false
+		}
+	}
+	return true
+}
+
+// BoostFolder makes the folder get weight times the share of block requests
+// of the other folders until the given time. A weight of one or less
+// clears the boost.
+func (m *Model) BoostFolder(folder string, weight int, until time.Time) error {
+	m.fmut.RLock()
+	_, ok := m.folderCfgs[folder]
+	pullers := make(map[string]int, len(m.folderCfgs))
+	for id, cfg := range m.folderCfgs {
+		pullers[id] = cfg.Pullers
+	}
+	m.fmut.RUnlock()
+
+	if !ok {
+		return errors.New("no such folder")
+	}
+
+	if weight > 1 {
+		l.Infof("Boosting folder %q by %d until %s", folder, weight, until.Format(time.RFC3339))
+	} else {
+		l.Infof("Clearing boost of folder %q", folder)
+	}
+	m.pullSched.boost(folder, weight, pullers, until)
+	return nil
+}
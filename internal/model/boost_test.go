@@ -0,0 +1,169 @@
+// Copyright (C) 2014 The Syncthing Authors.
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for
+// more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package model
+
+import (
+	"testing"
+	"time"
+
+	"github.com/syncthing/syncthing/internal/config"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+)
+
+func TestPullSchedulerUnboosted(t *testing.T) {
+	s := newPullScheduler()
+	for i := 0; i < 100; i++ {
+		s.acquire("a")
+	}
+	for i := 0; i < 100; i++ {
+		s.release("a")
+	}
+}
+
+func TestPullSchedulerExpiry(t *testing.T) {
+	s := newPullScheduler()
+	s.boost("a", 4, map[string]int{"a": 1, "b": 2}, time.Now().Add(100*time.Millisecond))
+	s.acquire("a")
+	s.acquire("a")
+	s.acquire("b")
+
+	done := make(chan struct{})
+	go func() {
+		s.acquire("b")
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("Folder got more than its share of slots")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Folder should get a slot once the boost expires")
+	}
+}
+
+func TestPullSchedulerLending(t *testing.T) {
+	s := newPullScheduler()
+	pullers := map[string]int{"a": 2, "b": 2, "c": 2}
+	s.boost("a", 3, pullers, time.Now().Add(time.Hour))
+	s.boost("c", 2, pullers, time.Now().Add(time.Hour))
+
+	acquireAsync := func(folder string) chan struct{} {
+		done := make(chan struct{})
+		go func() {
+			s.acquire(folder)
+			close(done)
+		}()
+		return done
+	}
+	expectBlocked := func(done chan struct{}) {
+		select {
+		case <-done:
+			t.Fatal("Folder got a slot it should wait for")
+		case <-time.After(20 * time.Millisecond):
+		}
+	}
+	expectAcquired := func(done chan struct{}) {
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatal("Folder should get a slot")
+		}
+	}
+
+	// The slots of the boosted folders may be used by the other folder
+	// while they're idle.
+	for i := 0; i < 3; i++ {
+		expectAcquired(acquireAsync("b"))
+	}
+	s.release("b")
+	s.release("b")
+
+	// Once all are used, a released slot goes to the waiting folder with
+	// the higher weight.
+	for i := 0; i < 3; i++ {
+		expectAcquired(acquireAsync("a"))
+	}
+	for i := 0; i < 2; i++ {
+		expectAcquired(acquireAsync("c"))
+	}
+	c := acquireAsync("c")
+	b := acquireAsync("b")
+	expectBlocked(c)
+	expectBlocked(b)
+	s.release("a")
+	expectAcquired(c)
+	expectBlocked(b)
+}
+
+func TestBoostFolder(t *testing.T) {
+	fcfg := config.FolderConfiguration{ID: "default", Path: "testdata", Pullers: 8}
+	other := config.FolderConfiguration{ID: "other", Path: "testdata", Pullers: 4}
+	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	m := NewModel(config.Wrap("/tmp/test", config.Configuration{Folders: []config.FolderConfiguration{fcfg, other}}), "device", "syncthing", "dev", db)
+	m.AddFolder(fcfg)
+	m.AddFolder(other)
+	s := m.pullSched
+
+	if err := m.BoostFolder("nonexistent", 2, time.Now().Add(time.Hour)); err == nil {
+		t.Error("Unexpected nil error for unknown folder")
+	}
+	if err := m.BoostFolder("default", 4, time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	// The twelve requests of both folders' pullers are shared four to one,
+	// so while the boosted folder uses all the requests it can, the other
+	// is held back to two of its four.
+	for i := 0; i < fcfg.Pullers+2; i++ {
+		s.acquire("default")
+	}
+	s.acquire("other")
+	s.acquire("other")
+
+	done := make(chan struct{})
+	go func() {
+		s.acquire("other")
+		close(done)
+	}()
+	select {
+	case <-done:
+		t.Fatal("Folder that isn't boosted got more than its share of requests")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	s.release("other")
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Folder should get a slot once one of its own is released")
+	}
+
+	if err := m.BoostFolder("default", 1, time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	s.mut.Lock()
+	free := s.mayRun("other")
+	s.mut.Unlock()
+	if !free {
+		t.Error("Folders should run freely once the boost is cleared")
+	}
+}
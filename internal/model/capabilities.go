@@ -0,0 +1,62 @@
+// Copyright (C) 2014 The Syncthing Authors.
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for
+// more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package model
+
+import (
+	"runtime"
+
+	"github.com/syncthing/syncthing/internal/config"
+	"github.com/syncthing/syncthing/internal/fs"
+)
+
+// probeFolder finds the capabilities of the file system holding the folder
+// and adjusts the folder configuration to them. Permissions are ignored on
+// file systems that don't keep them, such as FAT, as they would otherwise
+// be seen as changed on every scan. On Windows they are never kept, and are
+// handled as before.
+func probeFolder(cfg *config.FolderConfiguration) (fs.Capabilities, bool) {
+	caps, err := fs.Probe(fs.DefaultFilesystem, cfg.FilesystemPath())
+	if err != nil {
+		if debug {
+			l.Debugf("probing folder %q: %v", cfg.ID, err)
+		}
+		return caps, false
+	}
+	if debug {
+		l.Debugf("folder %q capabilities: %+v", cfg.ID, caps)
+	}
+
+	if !caps.Permissions && !cfg.IgnorePerms && runtime.GOOS != "windows" {
+		l.Infof("The file system of folder %q doesn't keep permissions; ignoring them", cfg.ID)
+		cfg.IgnorePerms = true
+	}
+	if !caps.CaseSensitive {
+		l.Infof("The file system of folder %q is case insensitive; files whose names differ only in case are not created, and renames that only change the case are made without deleting the file", cfg.ID)
+	}
+	if cfg.SyncXattrs && !caps.Xattrs {
+		l.Infof("The file system of folder %q doesn't support extended attributes; they are not synced", cfg.ID)
+	}
+	return caps, true
+}
+
+// FolderCapabilities returns the capabilities of the file system holding the
+// folder, as found at startup, and false if they are unknown.
+func (m *Model) FolderCapabilities(folder string) (fs.Capabilities, bool) {
+	m.fmut.RLock()
+	caps, ok := m.folderCaps[folder]
+	m.fmut.RUnlock()
+	return caps, ok
+}
@@ -0,0 +1,115 @@
+// Copyright (C) 2014 The Syncthing Authors.
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for
+// more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package model
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Local deletions found by a scan are held back for the deletion grace
+// period of the folder, instead of being recorded and announced to the other
+// devices at once. The first scan after the grace period that still finds
+// the file missing records the deletion, while a file that reappears is
+// forgotten about. Deleting more than bulkDeletionThreshold files at once
+// raises a warning, so that the deletions can be cancelled before they
+// reach the other devices.
+const bulkDeletionThreshold = 100
+
+type heldDeletions struct {
+	mut   sync.Mutex
+	since map[string]time.Time
+}
+
+func newHeldDeletions() *heldDeletions {
+	return &heldDeletions{
+		since: make(map[string]time.Time),
+	}
+}
+
+// hold notes the file as deleted at now, unless it already was, and returns
+// whether the deletion should still be held back and whether it was noted
+// for the first time.
+func (h *heldDeletions) hold(name string, grace time.Duration, now time.Time) (wait, first bool) {
+	h.mut.Lock()
+	defer h.mut.Unlock()
+
+	since, ok := h.since[name]
+	if !ok {
+		h.since[name] = now
+		return true, true
+	}
+	if now.Sub(since) < grace {
+		return true, false
+	}
+	delete(h.since, name)
+	return false, false
+}
+
+// forget drops any deletion held for the file.
+func (h *heldDeletions) forget(name string) {
+	h.mut.Lock()
+	delete(h.since, name)
+	h.mut.Unlock()
+}
+
+// names returns the files with held deletions, in order.
+func (h *heldDeletions) names() []string {
+	h.mut.Lock()
+	names := make([]string, 0, len(h.since))
+	for name := range h.since {
+		names = append(names, name)
+	}
+	h.mut.Unlock()
+
+	sort.Strings(names)
+	return names
+}
+
+// HeldDeletions returns the names of the deleted files of the folder that
+// haven't been announced to other devices yet.
+func (m *Model) HeldDeletions(folder string) ([]string, error) {
+	m.fmut.RLock()
+	held, ok := m.folderHeld[folder]
+	m.fmut.RUnlock()
+
+	if !ok {
+		return nil, errors.New("no such folder")
+	}
+	return held.names(), nil
+}
+
+// CancelDeletions gives up the held deletions of the folder. Instead of
+// being deleted on the other devices, the files are pulled back from them.
+func (m *Model) CancelDeletions(folder string) error {
+	m.fmut.RLock()
+	held, ok := m.folderHeld[folder]
+	m.fmut.RUnlock()
+
+	if !ok {
+		return errors.New("no such folder")
+	}
+
+	for _, name := range held.names() {
+		held.forget(name)
+		if cur, ok := m.CurrentFolderFile(folder, name); ok && !cur.IsDeleted() && !cur.IsInvalid() {
+			m.invalidateLocal(folder, cur)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,104 @@
+// Copyright (C) 2014 The Syncthing Authors.
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for
+// more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package model
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/syncthing/syncthing/internal/config"
+	"github.com/syncthing/syncthing/internal/protocol"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+)
+
+func TestHeldDeletions(t *testing.T) {
+	h := newHeldDeletions()
+	now := time.Unix(1000000, 0)
+	grace := time.Minute
+
+	if wait, first := h.hold("a", grace, now); !wait || !first {
+		t.Errorf("New deletion should be held, got wait %v first %v", wait, first)
+	}
+	if wait, first := h.hold("a", grace, now.Add(30*time.Second)); !wait || first {
+		t.Errorf("Deletion within the grace period should be held, got wait %v first %v", wait, first)
+	}
+	h.hold("b", grace, now)
+	h.forget("b")
+	if names := h.names(); !reflect.DeepEqual(names, []string{"a"}) {
+		t.Errorf("Unexpected held deletions %v", names)
+	}
+	if wait, _ := h.hold("a", grace, now.Add(grace)); wait {
+		t.Error("Deletion after the grace period should not be held")
+	}
+	if names := h.names(); len(names) != 0 {
+		t.Errorf("Unexpected held deletions %v", names)
+	}
+}
+
+func TestDeletionGracePeriod(t *testing.T) {
+	dir, err := ioutil.TempDir("", "syncthing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, "file"), []byte("contents"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	fcfg := config.FolderConfiguration{
+		ID:                   "default",
+		Path:                 dir,
+		DeletionGracePeriodS: 3600,
+		Devices:              []config.FolderDeviceConfiguration{{DeviceID: device1}},
+	}
+	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	m := NewModel(config.Wrap("/tmp/test", config.Configuration{Folders: []config.FolderConfiguration{fcfg}}), "device", "syncthing", "dev", db)
+	m.AddFolder(fcfg)
+	m.ScanFolder("default")
+
+	cur, _ := m.CurrentFolderFile("default", "file")
+	m.Index(device1, "default", []protocol.FileInfo{cur})
+
+	if err := os.Remove(filepath.Join(dir, "file")); err != nil {
+		t.Fatal(err)
+	}
+	m.ScanFolder("default")
+
+	if cur, _ := m.CurrentFolderFile("default", "file"); cur.IsDeleted() {
+		t.Error("Deletion was not held back")
+	}
+	if names, _ := m.HeldDeletions("default"); !reflect.DeepEqual(names, []string{"file"}) {
+		t.Errorf("Unexpected held deletions %v", names)
+	}
+
+	if err := m.CancelDeletions("default"); err != nil {
+		t.Fatal(err)
+	}
+	if names, _ := m.HeldDeletions("default"); len(names) != 0 {
+		t.Errorf("Unexpected held deletions %v after cancelling", names)
+	}
+	if cur, _ := m.CurrentFolderFile("default", "file"); cur.IsDeleted() || !cur.IsInvalid() {
+		t.Errorf("Cancelled deletion should be recorded as invalid, not %v", cur)
+	}
+	if n, _ := m.NeedSize("default"); n != 1 {
+		t.Error("The file should be needed from the other device after cancelling the deletion")
+	}
+}
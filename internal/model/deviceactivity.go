@@ -17,21 +17,28 @@ package model
 
 import (
 	"sync"
+	"time"
 
 	"github.com/syncthing/syncthing/internal/protocol"
 )
 
-// deviceActivity tracks the number of outstanding requests per device and can
-// answer which device is least busy. It is safe for use from multiple
-// goroutines.
+// The weight of a new measurement in the moving average of a device's
+// transfer rate.
+const rateWeight = 0.25
+
+// deviceActivity tracks the number of outstanding requests and the transfer
+// rate per device and can answer which device is least busy or expected to
+// be fastest. It is safe for use from multiple goroutines.
 type deviceActivity struct {
-	act map[protocol.DeviceID]int
-	mut sync.Mutex
+	act  map[protocol.DeviceID]int
+	rate map[protocol.DeviceID]float64 // bytes per second
+	mut  sync.Mutex
 }
 
 func newDeviceActivity() *deviceActivity {
 	return &deviceActivity{
-		act: make(map[protocol.DeviceID]int),
+		act:  make(map[protocol.DeviceID]int),
+		rate: make(map[protocol.DeviceID]float64),
 	}
 }
 
@@ -49,6 +56,56 @@ func (m *deviceActivity) leastBusy(availability []protocol.DeviceID) protocol.De
 	return selected
 }
 
+// fastest returns the device expected to answer another request the
+// soonest, given its measured transfer rate and its outstanding requests.
+// Devices that haven't been measured yet are assumed to be as fast as the
+// fastest one, so that they get a chance.
+func (m *deviceActivity) fastest(availability []protocol.DeviceID) protocol.DeviceID {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+
+	var maxRate float64
+	for _, device := range availability {
+		if rate := m.rate[device]; rate > maxRate {
+			maxRate = rate
+		}
+	}
+	if maxRate == 0 {
+		maxRate = 1
+	}
+
+	var selected protocol.DeviceID
+	var low float64
+	for i, device := range availability {
+		rate := m.rate[device]
+		if rate == 0 {
+			rate = maxRate
+		}
+		if cost := float64(m.act[device]+1) / rate; i == 0 || cost < low {
+			low = cost
+			selected = device
+		}
+	}
+	return selected
+}
+
+// transferred records that a request of the given size to the device
+// completed in the given time.
+func (m *deviceActivity) transferred(device protocol.DeviceID, bytes int, d time.Duration) {
+	if d <= 0 {
+		return
+	}
+	sample := float64(bytes) / d.Seconds()
+
+	m.mut.Lock()
+	if rate, ok := m.rate[device]; ok {
+		m.rate[device] = (1-rateWeight)*rate + rateWeight*sample
+	} else {
+		m.rate[device] = sample
+	}
+	m.mut.Unlock()
+}
+
 func (m *deviceActivity) using(device protocol.DeviceID) {
 	m.mut.Lock()
 	m.act[device]++
@@ -17,6 +17,7 @@ package model
 
 import (
 	"testing"
+	"time"
 
 	"github.com/syncthing/syncthing/internal/protocol"
 )
@@ -65,3 +66,41 @@ func TestDeviceActivity(t *testing.T) {
 		t.Errorf("Least busy device should be n0 (%v) not %v", n0, lb)
 	}
 }
+
+func TestDeviceActivityFastest(t *testing.T) {
+	n0 := protocol.DeviceID([32]byte{1, 2, 3, 4})
+	n1 := protocol.DeviceID([32]byte{5, 6, 7, 8})
+	n2 := protocol.DeviceID([32]byte{9, 10, 11, 12})
+	devices := []protocol.DeviceID{n0, n1, n2}
+	na := newDeviceActivity()
+
+	if f := na.fastest(devices); f != n0 {
+		t.Errorf("Fastest device should be n0 (%v) not %v", n0, f)
+	}
+
+	// n1 is four times as fast as n0; n2 is unmeasured and assumed to be as
+	// fast as n1.
+	na.transferred(n0, 128<<10, time.Second)
+	na.transferred(n1, 512<<10, time.Second)
+	if f := na.fastest(devices); f != n1 {
+		t.Errorf("Fastest device should be n1 (%v) not %v", n1, f)
+	}
+
+	na.using(n1)
+	if f := na.fastest(devices); f != n2 {
+		t.Errorf("Fastest device should be n2 (%v) not %v", n2, f)
+	}
+
+	// With two requests outstanding, n1 is still expected to answer sooner
+	// than an idle n0, but not with four.
+	na.using(n1)
+	if f := na.fastest(devices[:2]); f != n1 {
+		t.Errorf("Fastest device should be n1 (%v) not %v", n1, f)
+	}
+
+	na.using(n1)
+	na.using(n1)
+	if f := na.fastest(devices[:2]); f != n0 {
+		t.Errorf("Fastest device should be n0 (%v) not %v", n0, f)
+	}
+}
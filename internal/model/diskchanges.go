@@ -0,0 +1,71 @@
+// Copyright (C) 2014 The Syncthing Authors.
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for
+// more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package model
+
+import (
+	"time"
+
+	"github.com/syncthing/syncthing/internal/protocol"
+	"github.com/syncthing/syncthing/internal/stats"
+)
+
+// The number of disk changes kept, across all folders
+const maxDiskChanges = 1000
+
+// DiskChanges returns at most limit of the latest changes to the files in the
+// folder, or in all folders if folder is empty, newest first. Changes found
+// by scanning have protocol.LocalDeviceID as the modifier.
+func (m *Model) DiskChanges(folder string, limit int) []stats.DiskChange {
+	return m.diskChanges.Changes(folder, limit)
+}
+
+// ClearDiskChanges forgets the changes to the files in the folder, or in all
+// folders if folder is empty.
+func (m *Model) ClearDiskChanges(folder string) error {
+	return m.diskChanges.Clear(folder)
+}
+
+// addDiskChanges records the scanned files as changed locally. Files that
+// were merely marked invalid are not changes on disk.
+func (m *Model) addDiskChanges(folder string, fs []protocol.FileInfo) {
+	changes := make([]stats.DiskChange, 0, len(fs))
+	for _, f := range fs {
+		if !f.IsInvalid() {
+			changes = append(changes, diskChange(folder, f, protocol.LocalDeviceID))
+		}
+	}
+	m.diskChanges.Add(changes)
+}
+
+func diskChange(folder string, f protocol.FileInfo, modifier protocol.DeviceID) stats.DiskChange {
+	c := stats.DiskChange{
+		Folder:   folder,
+		Path:     f.Name,
+		Action:   stats.DiskChangeModified,
+		Type:     stats.DiskChangeFile,
+		Modifier: modifier,
+		Time:     time.Now(),
+	}
+	if f.IsDeleted() {
+		c.Action = stats.DiskChangeDeleted
+	}
+	if f.IsDirectory() {
+		c.Type = stats.DiskChangeDir
+	} else if f.IsSymlink() {
+		c.Type = stats.DiskChangeSymlink
+	}
+	return c
+}
@@ -0,0 +1,115 @@
+// Copyright (C) 2014 The Syncthing Authors.
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for
+// more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package model
+
+import (
+	"errors"
+	"sync"
+)
+
+var ErrFrozen = errors.New("folder is frozen")
+
+// folderFreeze keeps the files of a folder from changing while it is frozen.
+type folderFreeze struct {
+	work   sync.RWMutex // read locked while the folder is scanned or pulled
+	frozen bool         // protected by Model.freezeMut
+}
+
+// FreezeFolder stops the folder from being scanned or pulled, and returns
+// once no scan or pull of it is in progress. Index information is still
+// exchanged with other devices, but nothing in the folder is changed until
+// it's unfrozen, so that a consistent copy of it can be taken. Files being
+// pulled when the folder is frozen are finished first; no temporary files
+// are being written to when it returns. Folders are unfrozen on restart.
+func (m *Model) FreezeFolder(folder string) error {
+	f, err := m.freeze(folder)
+	if err != nil {
+		return err
+	}
+
+	m.freezeMut.Lock()
+	f.frozen = true
+	m.freezeMut.Unlock()
+
+	l.Infof("Freezing folder %q", folder)
+	f.work.Lock()
+	f.work.Unlock()
+	l.Infof("Folder %q is frozen", folder)
+	return nil
+}
+
+// UnfreezeFolder lets the folder be scanned and pulled again.
+func (m *Model) UnfreezeFolder(folder string) error {
+	f, err := m.freeze(folder)
+	if err != nil {
+		return err
+	}
+
+	m.freezeMut.Lock()
+	f.frozen = false
+	m.freezeMut.Unlock()
+
+	l.Infof("Unfreezing folder %q", folder)
+	return nil
+}
+
+// folderFrozen returns whether the folder is frozen.
+func (m *Model) folderFrozen(folder string) bool {
+	m.freezeMut.Lock()
+	defer m.freezeMut.Unlock()
+	f, ok := m.folderFreezes[folder]
+	return ok && f.frozen
+}
+
+// startWork returns ErrFrozen if the folder is frozen. Otherwise it may be
+// changed until endWork is called, and freezing it waits until then.
+func (m *Model) startWork(folder string) error {
+	f, err := m.freeze(folder)
+	if err != nil {
+		return err
+	}
+
+	f.work.RLock()
+	if m.folderFrozen(folder) {
+		f.work.RUnlock()
+		return ErrFrozen
+	}
+	return nil
+}
+
+func (m *Model) endWork(folder string) {
+	if f, err := m.freeze(folder); err == nil {
+		f.work.RUnlock()
+	}
+}
+
+func (m *Model) freeze(folder string) (*folderFreeze, error) {
+	m.fmut.RLock()
+	_, ok := m.folderCfgs[folder]
+	m.fmut.RUnlock()
+	if !ok {
+		return nil, errors.New("no such folder")
+	}
+
+	m.freezeMut.Lock()
+	defer m.freezeMut.Unlock()
+	f, ok := m.folderFreezes[folder]
+	if !ok {
+		f = &folderFreeze{}
+		m.folderFreezes[folder] = f
+	}
+	return f, nil
+}
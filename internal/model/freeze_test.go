@@ -0,0 +1,83 @@
+// Copyright (C) 2014 The Syncthing Authors.
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for
+// more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package model
+
+import (
+	"testing"
+	"time"
+
+	"github.com/syncthing/syncthing/internal/config"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+)
+
+func TestFreezeFolder(t *testing.T) {
+	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	m := NewModel(config.Wrap("/tmp/test", config.Configuration{}), "device", "syncthing", "dev", db)
+	m.AddFolder(config.FolderConfiguration{ID: "default", Path: "testdata"})
+
+	if err := m.FreezeFolder("nonexistent"); err == nil {
+		t.Error("Unexpected nil error freezing a nonexistent folder")
+	}
+
+	// Freezing waits for the work in progress.
+	if err := m.startWork("default"); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error)
+	go func() {
+		done <- m.FreezeFolder("default")
+	}()
+	select {
+	case <-done:
+		t.Fatal("Folder frozen while being worked on")
+	case <-time.After(100 * time.Millisecond):
+	}
+	m.endWork("default")
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Folder not frozen after the work was done")
+	}
+
+	// Nothing is changed while frozen.
+	if err := m.ScanFolder("default"); err != ErrFrozen {
+		t.Errorf("Unexpected scan result %v while frozen", err)
+	}
+	if err := m.SetIgnores("default", []string{"foo"}); err != ErrFrozen {
+		t.Errorf("Unexpected result %v setting ignores while frozen", err)
+	}
+	var paused bool
+	if !m.checkPaused("default", &paused) {
+		t.Error("Frozen folder should be paused for the runners")
+	}
+	if state, _ := m.State("default"); state != "frozen" {
+		t.Errorf("Unexpected state %q", state)
+	}
+
+	if err := m.UnfreezeFolder("default"); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.ScanFolder("default"); err != nil {
+		t.Errorf("Unexpected scan error %v after unfreezing", err)
+	}
+	if m.checkPaused("default", &paused) {
+		t.Error("Unfrozen folder should not be paused")
+	}
+}
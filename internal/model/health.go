@@ -0,0 +1,200 @@
+// Copyright (C) 2014 The Syncthing Authors.
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for
+// more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package model
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/syncthing/syncthing/internal/config"
+	"github.com/syncthing/syncthing/internal/ignore"
+	"github.com/syncthing/syncthing/internal/osutil"
+	"github.com/syncthing/syncthing/internal/protocol"
+)
+
+// The severities of a HealthCheck, from the least to the most severe
+const (
+	HealthOK      = "ok"
+	HealthInfo    = "info"
+	HealthWarning = "warning"
+	HealthError   = "error"
+)
+
+var healthSeverities = map[string]int{
+	HealthOK:      0,
+	HealthInfo:    1,
+	HealthWarning: 2,
+	HealthError:   3,
+}
+
+// Free space below these percentages of the disk holding a folder is a
+// warning and an error, respectively.
+const (
+	diskFreeWarningPct = 5
+	diskFreeErrorPct   = 1
+)
+
+// A HealthCheck is the outcome of checking one aspect of a folder.
+type HealthCheck struct {
+	Check    string
+	Severity string
+	Message  string
+}
+
+// FolderHealth is a summary of the problems that keep a folder from
+// syncing, with the most severe outcome of its checks as its severity.
+type FolderHealth struct {
+	Folder   string
+	Severity string
+	Checks   []HealthCheck
+}
+
+func (h *FolderHealth) add(check, severity, format string, args ...interface{}) {
+	h.Checks = append(h.Checks, HealthCheck{
+		Check:    check,
+		Severity: severity,
+		Message:  fmt.Sprintf(format, args...),
+	})
+	if healthSeverities[severity] > healthSeverities[h.Severity] {
+		h.Severity = severity
+	}
+}
+
+// FolderHealth checks the folder for common problems. The folder is shared
+// by the device myID, the one we are running as, with the other devices.
+func (m *Model) FolderHealth(folder string, myID protocol.DeviceID) (FolderHealth, error) {
+	m.fmut.RLock()
+	cfg, ok := m.folderCfgs[folder]
+	devices := m.folderDevices[folder]
+	m.fmut.RUnlock()
+
+	if !ok {
+		return FolderHealth{}, errors.New("no such folder")
+	}
+
+	h := FolderHealth{Folder: folder, Severity: HealthOK}
+
+	if cfg.Invalid != "" {
+		h.add("folder", HealthError, "The folder is stopped: %s", cfg.Invalid)
+	}
+
+	if cfg.HasMarker() {
+		h.add("marker", HealthOK, "The folder marker is present")
+	} else if cfg.RemovableDrive {
+		h.add("marker", HealthWarning, "The folder marker .stfolder is missing from %s; the folder waits for its drive to be attached", cfg.Path)
+	} else {
+		h.add("marker", HealthError, "The folder marker .stfolder is missing from %s; the folder is not synced until it is recreated", cfg.Path)
+	}
+
+	if cfg.Type == config.FolderTypeAudit {
+		h.add("writable", HealthOK, "The folder is only audited and never written to")
+	} else if fd, err := ioutil.TempFile(cfg.Path, ".syncthing-health-"); err != nil {
+		if cfg.ReadOnly {
+			h.add("writable", HealthInfo, "The folder path is not writable, which is fine for a master folder: %v", err)
+		} else {
+			h.add("writable", HealthError, "The folder path is not writable: %v", err)
+		}
+	} else {
+		fd.Close()
+		os.Remove(fd.Name())
+		h.add("writable", HealthOK, "The folder path is writable")
+	}
+
+	if free, total, err := osutil.DiskFree(cfg.Path); err != nil {
+		h.add("diskFree", HealthInfo, "The free disk space is unknown: %v", err)
+	} else if total > 0 {
+		pct := float64(free) / float64(total) * 100
+		switch {
+		case pct < diskFreeErrorPct:
+			h.add("diskFree", HealthError, "The disk is %.0f%% full, with %d MiB free", 100-pct, free>>20)
+		case pct < diskFreeWarningPct:
+			h.add("diskFree", HealthWarning, "The disk is %.0f%% full, with %d MiB free", 100-pct, free>>20)
+		default:
+			h.add("diskFree", HealthOK, "The disk has %d MiB free", free>>20)
+		}
+	}
+
+	// A missing .stignore is fine, but not a missing file included by it.
+	ignores := filepath.Join(cfg.Path, ".stignore")
+	if _, err := os.Lstat(ignores); err != nil && os.IsNotExist(err) {
+		h.add("ignores", HealthOK, "There are no ignore patterns")
+	} else if err := ignore.New(false).Load(ignores); err != nil {
+		h.add("ignores", HealthError, "The .stignore file can't be used: %v", err)
+	} else {
+		h.add("ignores", HealthOK, "The ignore patterns are valid")
+	}
+
+	if m.folderPaused(folder) {
+		h.add("paused", HealthWarning, "The folder is paused")
+	}
+
+	var disconnected, paused []string
+	m.pmut.RLock()
+	for _, device := range devices {
+		if device == myID {
+			continue
+		}
+		if _, ok := m.protoConn[device]; !ok {
+			disconnected = append(disconnected, m.displayName(device))
+			continue
+		}
+		for _, f := range m.peerPaused[device] {
+			if f == folder {
+				paused = append(paused, m.displayName(device))
+			}
+		}
+	}
+	m.pmut.RUnlock()
+
+	switch {
+	case len(devices) <= 1:
+		h.add("devices", HealthWarning, "The folder is not shared with any other device")
+	case len(disconnected) > 0:
+		h.add("devices", HealthWarning, "Not connected to %s", strings.Join(disconnected, ", "))
+	default:
+		h.add("devices", HealthOK, "All devices sharing the folder are connected")
+	}
+	if len(paused) > 0 {
+		h.add("peerPaused", HealthWarning, "The folder is paused on %s", strings.Join(paused, ", "))
+	}
+
+	if files, bytes := m.NeedSize(folder); files > 0 {
+		h.add("needed", HealthInfo, "%d items, %d MiB, are out of sync", files, bytes>>20)
+	} else {
+		h.add("needed", HealthOK, "The folder is in sync")
+	}
+
+	if errs, _ := m.FolderErrors(folder); len(errs) > 0 {
+		h.add("errors", HealthWarning, "%d items keep failing to sync, the last one with: %s", len(errs), errs[len(errs)-1].Error)
+	} else {
+		h.add("errors", HealthOK, "No items are failing to sync")
+	}
+
+	return h, nil
+}
+
+// displayName returns the configured name of the device, or its ID if it has
+// no name.
+func (m *Model) displayName(device protocol.DeviceID) string {
+	if name := m.cfg.Devices()[device].Name; name != "" {
+		return name
+	}
+	return device.String()
+}
@@ -0,0 +1,107 @@
+// Copyright (C) 2014 The Syncthing Authors.
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for
+// more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package model
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/syncthing/syncthing/internal/config"
+	"github.com/syncthing/syncthing/internal/protocol"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+)
+
+func healthCheck(h FolderHealth, check string) HealthCheck {
+	for _, c := range h.Checks {
+		if c.Check == check {
+			return c
+		}
+	}
+	return HealthCheck{}
+}
+
+func TestFolderHealth(t *testing.T) {
+	dir, err := ioutil.TempDir("", "syncthing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fcfg := config.FolderConfiguration{
+		ID:      "default",
+		Path:    dir,
+		Devices: []config.FolderDeviceConfiguration{{DeviceID: device1}, {DeviceID: device2}},
+	}
+	cfg := config.Configuration{
+		Folders: []config.FolderConfiguration{fcfg},
+		Devices: []config.DeviceConfiguration{{DeviceID: device1}, {DeviceID: device2, Name: "peer"}},
+	}
+	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	m := NewModel(config.Wrap("/tmp/test", cfg), "device", "syncthing", "dev", db)
+	m.AddFolder(fcfg)
+
+	if _, err := m.FolderHealth("nonexistent", device1); err == nil {
+		t.Error("Unexpected health of a nonexistent folder")
+	}
+
+	h, err := m.FolderHealth("default", device1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.Severity != HealthError {
+		t.Errorf("Unexpected severity %q", h.Severity)
+	}
+	if c := healthCheck(h, "marker"); c.Severity != HealthError {
+		t.Errorf("Missing marker not reported: %+v", c)
+	}
+	if c := healthCheck(h, "devices"); c.Severity != HealthWarning || c.Message != "Not connected to peer" {
+		t.Errorf("Disconnected device not reported: %+v", c)
+	}
+	for _, check := range []string{"writable", "ignores", "needed", "errors"} {
+		if c := healthCheck(h, check); c.Severity != HealthOK {
+			t.Errorf("Unexpected outcome of %s check: %+v", check, c)
+		}
+	}
+
+	fcfg.CreateMarker()
+	if err := ioutil.WriteFile(filepath.Join(dir, ".stignore"), []byte("#include nonexistent\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	fc := &FakeConnection{id: device2}
+	m.AddConnection(fc, fc)
+	m.ClusterConfig(device2, protocol.ClusterConfigMessage{
+		Options: []protocol.Option{{Key: "paused", Value: "other,default"}},
+	})
+	defer m.Close(device2, errors.New("test done"))
+
+	h, _ = m.FolderHealth("default", device1)
+	if c := healthCheck(h, "marker"); c.Severity != HealthOK {
+		t.Errorf("Unexpected outcome of marker check: %+v", c)
+	}
+	if c := healthCheck(h, "devices"); c.Severity != HealthOK {
+		t.Errorf("Unexpected outcome of devices check: %+v", c)
+	}
+	if c := healthCheck(h, "peerPaused"); c.Severity != HealthWarning || c.Message != "The folder is paused on peer" {
+		t.Errorf("Folder paused on the other device not reported: %+v", c)
+	}
+	if c := healthCheck(h, "ignores"); c.Severity != HealthError {
+		t.Errorf("Broken ignore file not reported: %+v", c)
+	}
+}
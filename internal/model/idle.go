@@ -0,0 +1,200 @@
+// Copyright (C) 2014 The Syncthing Authors.
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for
+// more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package model
+
+import (
+	"errors"
+	"time"
+
+	"github.com/syncthing/syncthing/internal/protocol"
+)
+
+var errIdle = errors.New("connection idle")
+
+// The activity on a connection, as far as telling whether it's idle goes.
+type connActivity struct {
+	at       time.Time         // when index or file data was last exchanged, or a shared folder last changed
+	versions map[string]uint64 // folder -> local version of the shared folders as of at
+}
+
+// A connection closed for being idle.
+type idleClose struct {
+	at       time.Time         // when it was closed
+	versions map[string]uint64 // folder -> local version of the shared folders when it was closed
+}
+
+// An idleReaper closes the connections to devices that have had nothing to
+// do for longer than the timeout: no index or file data was exchanged with
+// them, none of the folders shared with them changed, and neither side needs
+// anything from the other in those folders. Such devices aren't dialed again
+// until one of the folders shared with them changes or for the timeout. Their
+// own connections are accepted, as they may have changes of their own.
+type idleReaper struct {
+	model   *Model
+	timeout time.Duration
+}
+
+// StartIdleReaper starts closing connections that have been idle for longer
+// than the timeout.
+func (m *Model) StartIdleReaper(timeout time.Duration) {
+	m.idleMut.Lock()
+	m.idleTimeout = timeout
+	m.idleMut.Unlock()
+
+	r := &idleReaper{
+		model:   m,
+		timeout: timeout,
+	}
+	go r.serve()
+}
+
+func (r *idleReaper) serve() {
+	for {
+		time.Sleep(r.timeout / 4)
+		for _, deviceID := range r.idle(time.Now()) {
+			r.model.closeIdle(deviceID)
+		}
+	}
+}
+
+// idle returns the connected devices that have been idle since timeout
+// before now.
+func (r *idleReaper) idle(now time.Time) []protocol.DeviceID {
+	m := r.model
+
+	m.pmut.RLock()
+	var connected []protocol.DeviceID
+	for deviceID := range m.protoConn {
+		connected = append(connected, deviceID)
+	}
+	m.pmut.RUnlock()
+
+	var idle []protocol.DeviceID
+	for _, deviceID := range connected {
+		versions := m.localVersions(deviceID)
+		m.idleMut.Lock()
+		act, ok := m.connActs[deviceID]
+		if ok && !versionsEqual(act.versions, versions) {
+			act.at = now
+			act.versions = versions
+		}
+		var at time.Time
+		if ok {
+			at = act.at
+		}
+		m.idleMut.Unlock()
+
+		if ok && now.Sub(at) > r.timeout && !m.hasWork(deviceID) {
+			idle = append(idle, deviceID)
+		}
+	}
+	return idle
+}
+
+// markActive records that index or file data was just exchanged with the
+// device.
+func (m *Model) markActive(deviceID protocol.DeviceID) {
+	m.idleMut.Lock()
+	if act, ok := m.connActs[deviceID]; ok {
+		act.at = time.Now()
+	}
+	m.idleMut.Unlock()
+}
+
+// hasWork returns whether any of the folders shared with the device is busy,
+// or is out of sync with us or the device.
+func (m *Model) hasWork(deviceID protocol.DeviceID) bool {
+	m.fmut.RLock()
+	folders := m.deviceFolders[deviceID]
+	m.fmut.RUnlock()
+
+	for _, folder := range folders {
+		m.smut.RLock()
+		state := m.folderState[folder]
+		m.smut.RUnlock()
+		switch state {
+		case FolderScanning, FolderSyncing, FolderCleaning:
+			return true
+		}
+		if files, _ := m.NeedSize(folder); files > 0 {
+			return true
+		}
+		if m.Completion(deviceID, folder) < 100 {
+			return true
+		}
+	}
+	return false
+}
+
+// closeIdle closes the connection to the device, which has been idle, and
+// keeps us from dialing it again until a folder shared with it changes or the
+// idle timeout has passed.
+func (m *Model) closeIdle(deviceID protocol.DeviceID) {
+	versions := m.localVersions(deviceID)
+	m.idleMut.Lock()
+	m.idleClosed[deviceID] = idleClose{
+		at:       time.Now(),
+		versions: versions,
+	}
+	m.idleMut.Unlock()
+
+	m.Close(deviceID, errIdle)
+}
+
+// IdleClosed returns whether the connection to the device was closed for
+// being idle less than the idle timeout ago, with none of the folders shared
+// with it having changed since. Such a device isn't dialed, so that we don't
+// reconnect right away. Once the timeout has passed it's dialed again, in
+// case it has changes it couldn't tell us about.
+func (m *Model) IdleClosed(deviceID protocol.DeviceID) bool {
+	versions := m.localVersions(deviceID)
+	m.idleMut.Lock()
+	defer m.idleMut.Unlock()
+
+	closed, ok := m.idleClosed[deviceID]
+	if ok && (!versionsEqual(closed.versions, versions) || time.Since(closed.at) > m.idleTimeout) {
+		delete(m.idleClosed, deviceID)
+		return false
+	}
+	return ok
+}
+
+// localVersions returns the local version of each folder shared with the
+// device.
+func (m *Model) localVersions(deviceID protocol.DeviceID) map[string]uint64 {
+	m.fmut.RLock()
+	defer m.fmut.RUnlock()
+
+	versions := make(map[string]uint64)
+	for _, folder := range m.deviceFolders[deviceID] {
+		if fs, ok := m.folderFiles[folder]; ok {
+			versions[folder] = fs.LocalVersion(protocol.LocalDeviceID)
+		}
+	}
+	return versions
+}
+
+func versionsEqual(a, b map[string]uint64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for folder, v := range a {
+		if bv, ok := b[folder]; !ok || bv != v {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,94 @@
+// Copyright (C) 2014 The Syncthing Authors.
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for
+// more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package model
+
+import (
+	"testing"
+	"time"
+
+	"github.com/syncthing/syncthing/internal/config"
+	"github.com/syncthing/syncthing/internal/protocol"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+)
+
+func TestIdleReaper(t *testing.T) {
+	fcfg := config.FolderConfiguration{
+		ID:      "default",
+		Path:    "testdata",
+		Devices: []config.FolderDeviceConfiguration{{DeviceID: device1}},
+	}
+	cfg := config.Configuration{
+		Folders: []config.FolderConfiguration{fcfg},
+		Devices: []config.DeviceConfiguration{{DeviceID: device1}},
+	}
+	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	m := NewModel(config.Wrap("/tmp/test", cfg), "device", "syncthing", "dev", db)
+	m.AddFolder(fcfg)
+	m.idleTimeout = time.Hour
+	r := &idleReaper{model: m, timeout: time.Minute}
+
+	fc := FakeConnection{id: device1}
+	m.AddConnection(fc, fc)
+
+	now := time.Now()
+	if idle := r.idle(now); len(idle) != 0 {
+		t.Errorf("Nothing should be idle yet, not %v", idle)
+	}
+	later := now.Add(2 * time.Minute)
+	if idle := r.idle(later); len(idle) != 1 || idle[0] != device1 {
+		t.Errorf("Expected the device to be idle, not %v", idle)
+	}
+
+	// A busy folder keeps the connection open.
+	m.setState("default", FolderSyncing)
+	if idle := r.idle(later); len(idle) != 0 {
+		t.Errorf("Nothing should be idle while syncing, not %v", idle)
+	}
+	m.setState("default", FolderIdle)
+
+	// So does a change to the folder, for the timeout.
+	f := protocol.FileInfo{Name: "foo", Version: 1}
+	m.updateLocal("default", f)
+	m.Index(device1, "default", []protocol.FileInfo{f})
+	if idle := r.idle(later); len(idle) != 0 {
+		t.Errorf("Nothing should be idle after a change, not %v", idle)
+	}
+	if idle := r.idle(later.Add(2 * time.Minute)); len(idle) != 1 {
+		t.Errorf("Expected the device to be idle again, not %v", idle)
+	}
+
+	// Once closed, the device isn't connected until the folder changes.
+	m.closeIdle(device1)
+	if m.ConnectedTo(device1) || !m.IdleClosed(device1) {
+		t.Error("Expected the device to be closed for being idle")
+	}
+	m.updateLocal("default", protocol.FileInfo{Name: "bar", Version: 1})
+	if m.IdleClosed(device1) {
+		t.Error("The device should be connected after a change")
+	}
+
+	// Or until the timeout has passed.
+	m.closeIdle(device1)
+	m.idleMut.Lock()
+	closed := m.idleClosed[device1]
+	closed.at = closed.at.Add(-2 * time.Hour)
+	m.idleClosed[device1] = closed
+	m.idleMut.Unlock()
+	if m.IdleClosed(device1) {
+		t.Error("The device should be connected after the timeout")
+	}
+}
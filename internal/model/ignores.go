@@ -0,0 +1,70 @@
+// Copyright (C) 2014 The Syncthing Authors.
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for
+// more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package model
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/syncthing/syncthing/internal/events"
+	"github.com/syncthing/syncthing/internal/files"
+	"github.com/syncthing/syncthing/internal/protocol"
+)
+
+// invalidateIgnored marks the files of the folder that are ignored now, but
+// weren't when they were scanned, as invalid in the index. When the ignore
+// patterns were changed to only ignore more files, that's all a scan would
+// change, and there's no need for one.
+func (m *Model) invalidateIgnored(folder string) {
+	m.fmut.RLock()
+	fs := m.folderFiles[folder]
+	ignores := m.folderIgnores[folder]
+	m.fmut.RUnlock()
+
+	batchSize := 100
+	batch := make([]protocol.FileInfo, 0, batchSize)
+	fs.WithHaveTruncated(protocol.LocalDeviceID, func(fi files.FileIntf) bool {
+		f := fi.(files.FileInfoTruncated)
+		if f.IsDeleted() || f.IsInvalid() || !ignores.Match(f.Name) {
+			return true
+		}
+
+		if len(batch) == batchSize {
+			fs.Update(protocol.LocalDeviceID, batch)
+			m.addDiskChanges(folder, batch)
+			batch = batch[:0]
+		}
+		nf := protocol.FileInfo{
+			Name:     f.Name,
+			Flags:    f.Flags | protocol.FlagInvalid,
+			Modified: f.Modified,
+			Version:  f.Version, // The file is still the same, so don't bump version
+		}
+		events.Default.Log(events.LocalIndexUpdated, map[string]interface{}{
+			"folder":   folder,
+			"name":     f.Name,
+			"modified": time.Unix(f.Modified, 0),
+			"flags":    fmt.Sprintf("0%o", f.Flags),
+			"size":     f.Size(),
+		})
+		batch = append(batch, nf)
+		return true
+	})
+	if len(batch) > 0 {
+		fs.Update(protocol.LocalDeviceID, batch)
+		m.addDiskChanges(folder, batch)
+	}
+}
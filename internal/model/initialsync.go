@@ -0,0 +1,59 @@
+// Copyright (C) 2014 The Syncthing Authors.
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for
+// more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package model
+
+import (
+	"time"
+
+	"github.com/syncthing/syncthing/internal/protocol"
+)
+
+// InitialSync returns whether a folder shared with the device is in its
+// initial sync, during which what's received from the device isn't rate
+// limited, as the folder is configured to.
+func (m *Model) InitialSync(device protocol.DeviceID) bool {
+	m.fmut.RLock()
+	defer m.fmut.RUnlock()
+	for _, folder := range m.deviceFolders[device] {
+		if m.initialSync[folder] && m.folderCfgs[folder].InitialSyncUnlimited {
+			return true
+		}
+	}
+	return false
+}
+
+// folderInSync records when the folder is first in sync, ending its initial
+// sync. It's called by the puller whenever there is nothing left to pull.
+// The time is recorded for every folder, so that enabling unlimited initial
+// syncs doesn't lift the rate limits of folders that were synced before.
+func (m *Model) folderInSync(folder string) {
+	m.fmut.RLock()
+	initial := m.initialSync[folder]
+	unlimited := m.folderCfgs[folder].InitialSyncUnlimited
+	m.fmut.RUnlock()
+	if !initial {
+		return
+	}
+
+	if unlimited {
+		l.Infof("Folder %q is in sync for the first time; rate limits apply from now on", folder)
+	}
+	m.folderStatRef(folder).SetFirstSynced(time.Now())
+
+	m.fmut.Lock()
+	delete(m.initialSync, folder)
+	m.fmut.Unlock()
+}
@@ -0,0 +1,78 @@
+// Copyright (C) 2014 The Syncthing Authors.
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for
+// more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package model
+
+import (
+	"testing"
+
+	"github.com/syncthing/syncthing/internal/config"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+)
+
+func TestInitialSync(t *testing.T) {
+	cfg := config.Configuration{
+		Folders: []config.FolderConfiguration{
+			{
+				ID:                   "default",
+				Path:                 "testdata",
+				Devices:              []config.FolderDeviceConfiguration{{DeviceID: device1}},
+				InitialSyncUnlimited: true,
+			},
+			{
+				ID:      "limited",
+				Path:    "testdata",
+				Devices: []config.FolderDeviceConfiguration{{DeviceID: device2}},
+			},
+		},
+	}
+	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	newModel := func() *Model {
+		m := NewModel(config.Wrap("/tmp/test", cfg), "device", "syncthing", "dev", db)
+		m.AddFolder(cfg.Folders[0])
+		m.AddFolder(cfg.Folders[1])
+		return m
+	}
+
+	m := newModel()
+	if !m.InitialSync(device1) {
+		t.Error("new folder should be in its initial sync")
+	}
+	if m.InitialSync(device2) {
+		t.Error("folder without the option should not be in an initial sync")
+	}
+
+	m.folderInSync("default")
+	if m.InitialSync(device1) {
+		t.Error("initial sync should end when in sync")
+	}
+	if m.folderStatRef("default").GetStatistics().FirstSynced == nil {
+		t.Error("first sync not recorded")
+	}
+
+	// The initial sync stays over after a restart.
+	if m := newModel(); m.InitialSync(device1) {
+		t.Error("initial sync should not restart")
+	}
+
+	// A folder synced without the option is not in an initial sync when
+	// it's enabled later.
+	m.folderInSync("limited")
+	cfg.Folders[1].InitialSyncUnlimited = true
+	if m := newModel(); m.InitialSync(device2) {
+		t.Error("folder synced before enabling the option should not be in an initial sync")
+	}
+}
@@ -0,0 +1,135 @@
+// Copyright (C) 2014 The Syncthing Authors.
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for
+// more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package model
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Files locked by another program are tried again after lockedRetryIntv,
+// doubled for every further attempt that finds them locked, up to
+// lockedRetryMax.
+var (
+	lockedRetryIntv = time.Minute
+	lockedRetryMax  = time.Hour
+)
+
+// A LockedFile is a file that couldn't be scanned, as another program has it
+// locked. It keeps its previous state in the index until it can be.
+type LockedFile struct {
+	Name        string
+	Since       time.Time // when it was first found locked
+	Attempts    int
+	NextAttempt time.Time
+}
+
+// lockedFiles tracks the locked files of a folder for the scanner, which
+// leaves them alone until their next attempt is due.
+type lockedFiles struct {
+	folder string
+	files  map[string]*LockedFile
+	mut    sync.Mutex
+}
+
+func newLockedFiles(folder string) *lockedFiles {
+	return &lockedFiles{
+		folder: folder,
+		files:  make(map[string]*LockedFile),
+	}
+}
+
+// Locked implements scanner.LockedFiles. Each further attempt that finds the
+// file locked doubles the time until the next one.
+func (l *lockedFiles) Locked(name string) {
+	l.mut.Lock()
+	defer l.mut.Unlock()
+
+	now := time.Now()
+	f, ok := l.files[name]
+	if !ok {
+		f = &LockedFile{Name: name, Since: now}
+		l.files[name] = f
+		logLocked(l.folder, name)
+	}
+	f.Attempts++
+
+	wait := lockedRetryIntv
+	for i := 1; i < f.Attempts && wait < lockedRetryMax; i++ {
+		wait *= 2
+	}
+	if wait > lockedRetryMax {
+		wait = lockedRetryMax
+	}
+	f.NextAttempt = now.Add(wait)
+}
+
+// Hashed implements scanner.LockedFiles; the file is no longer locked.
+func (l *lockedFiles) Hashed(name string) {
+	l.mut.Lock()
+	delete(l.files, name)
+	l.mut.Unlock()
+}
+
+// Deferred implements scanner.LockedFiles. It's true until the next attempt
+// for a locked file is due.
+func (l *lockedFiles) Deferred(name string) bool {
+	l.mut.Lock()
+	defer l.mut.Unlock()
+	f, ok := l.files[name]
+	return ok && time.Now().Before(f.NextAttempt)
+}
+
+func logLocked(folder, name string) {
+	l.Infof("File %q in folder %q is locked by another program; it is skipped and scanned again later", name, folder)
+}
+
+// LockedFiles returns the files of the folder that are skipped by scans as
+// another program has them locked, by name.
+func (m *Model) LockedFiles(folder string) ([]LockedFile, error) {
+	m.fmut.RLock()
+	lf, ok := m.folderLocked[folder]
+	cfg := m.folderCfgs[folder]
+	m.fmut.RUnlock()
+	if !ok {
+		return nil, errors.New("no such folder")
+	}
+
+	lf.mut.Lock()
+	defer lf.mut.Unlock()
+
+	res := make([]LockedFile, 0, len(lf.files))
+	for name, f := range lf.files {
+		if _, err := os.Lstat(filepath.Join(cfg.FilesystemPath(), name)); os.IsNotExist(err) {
+			// Deleted while it was locked; the scan sees it's gone.
+			delete(lf.files, name)
+			continue
+		}
+		res = append(res, *f)
+	}
+	sort.Sort(lockedFilesByName(res))
+	return res, nil
+}
+
+type lockedFilesByName []LockedFile
+
+func (l lockedFilesByName) Len() int           { return len(l) }
+func (l lockedFilesByName) Less(a, b int) bool { return l[a].Name < l[b].Name }
+func (l lockedFilesByName) Swap(a, b int)      { l[a], l[b] = l[b], l[a] }
@@ -0,0 +1,96 @@
+// Copyright (C) 2014 The Syncthing Authors.
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for
+// more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package model
+
+import (
+	"testing"
+	"time"
+
+	"github.com/syncthing/syncthing/internal/config"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+)
+
+func TestLockedFilesBackoff(t *testing.T) {
+	l := newLockedFiles("default")
+
+	if l.Deferred("file") {
+		t.Error("Unlocked file should not be deferred")
+	}
+
+	var last time.Duration
+	for i := 1; i <= 10; i++ {
+		l.Locked("file")
+		f := l.files["file"]
+		if f.Attempts != i {
+			t.Fatalf("Unexpected attempts %d != %d", f.Attempts, i)
+		}
+		wait := f.NextAttempt.Sub(time.Now())
+		if wait < last-time.Second || wait > lockedRetryMax {
+			t.Errorf("Unexpected wait %v after %d attempts", wait, i)
+		}
+		last = wait
+	}
+	if last < lockedRetryMax-time.Second {
+		t.Errorf("Wait %v should have reached the maximum", last)
+	}
+
+	if !l.Deferred("file") {
+		t.Error("Locked file should be deferred")
+	}
+	l.files["file"].NextAttempt = time.Now().Add(-time.Second)
+	if l.Deferred("file") {
+		t.Error("File should not be deferred once its attempt is due")
+	}
+
+	l.Hashed("file")
+	if _, ok := l.files["file"]; ok {
+		t.Error("Hashed file should not be tracked")
+	}
+}
+
+func TestLockedFilesList(t *testing.T) {
+	fcfg := config.FolderConfiguration{
+		ID:      "default",
+		Path:    "testdata",
+		Devices: []config.FolderDeviceConfiguration{{DeviceID: device1}},
+	}
+	cfg := config.Configuration{
+		Folders: []config.FolderConfiguration{fcfg},
+		Devices: []config.DeviceConfiguration{{DeviceID: device1}},
+	}
+	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	m := NewModel(config.Wrap("/tmp/test", cfg), "device", "syncthing", "dev", db)
+	m.AddFolder(fcfg)
+
+	m.folderLocked["default"].Locked("foo")
+	m.folderLocked["default"].Locked("nonexistent")
+
+	files, err := m.LockedFiles("default")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || files[0].Name != "foo" || files[0].Attempts != 1 {
+		t.Errorf("Unexpected locked files %+v", files)
+	}
+	if _, ok := m.folderLocked["default"].files["nonexistent"]; ok {
+		t.Error("Nonexistent file should have been pruned")
+	}
+
+	if _, err := m.LockedFiles("nosuchfolder"); err == nil {
+		t.Error("Unexpected nil error for unknown folder")
+	}
+}
@@ -17,7 +17,6 @@ package model
 
 import (
 	"bufio"
-	"crypto/tls"
 	"errors"
 	"fmt"
 	"io"
@@ -33,6 +32,7 @@ import (
 	"github.com/syncthing/syncthing/internal/config"
 	"github.com/syncthing/syncthing/internal/events"
 	"github.com/syncthing/syncthing/internal/files"
+	"github.com/syncthing/syncthing/internal/fs"
 	"github.com/syncthing/syncthing/internal/ignore"
 	"github.com/syncthing/syncthing/internal/lamport"
 	"github.com/syncthing/syncthing/internal/osutil"
@@ -40,6 +40,7 @@ import (
 	"github.com/syncthing/syncthing/internal/scanner"
 	"github.com/syncthing/syncthing/internal/stats"
 	"github.com/syncthing/syncthing/internal/symlinks"
+	"github.com/syncthing/syncthing/internal/upgrade"
 	"github.com/syncthing/syncthing/internal/versioner"
 	"github.com/syndtr/goleveldb/leveldb"
 )
@@ -51,6 +52,10 @@ const (
 	FolderScanning
 	FolderSyncing
 	FolderCleaning
+	FolderPaused
+	FolderFrozen
+	FolderWaiting
+	FolderWaitingDrive
 )
 
 func (s folderState) String() string {
@@ -63,6 +68,14 @@ func (s folderState) String() string {
 		return "cleaning"
 	case FolderSyncing:
 		return "syncing"
+	case FolderPaused:
+		return "paused"
+	case FolderFrozen:
+		return "frozen"
+	case FolderWaiting:
+		return "waiting for devices"
+	case FolderWaitingDrive:
+		return "waiting for drive"
 	default:
 		return "unknown"
 	}
@@ -76,6 +89,16 @@ const (
 	indexBatchSize    = 1000       // Either way, don't include more files than this
 )
 
+// Clock differences beyond this are reported to the user, since they make
+// the modification times of synced files misleading.
+const maxClockSkew = time.Minute
+
+// Folder runners started at once, and the time between the batches.
+const (
+	runnerBatchSize     = 16
+	runnerBatchInterval = time.Second
+)
+
 type service interface {
 	Serve()
 	Stop()
@@ -86,6 +109,8 @@ type service interface {
 type Model struct {
 	cfg             *config.Wrapper
 	db              *leveldb.DB
+	flushMut        sync.Mutex
+	flushPending    bool // the index has changed since it was last flushed
 	finder          *files.BlockFinder
 	progressEmitter *ProgressEmitter
 
@@ -99,26 +124,79 @@ type Model struct {
 	deviceFolders  map[protocol.DeviceID][]string                         // deviceID -> folders
 	deviceStatRefs map[protocol.DeviceID]*stats.DeviceStatisticsReference // deviceID -> statsRef
 	folderIgnores  map[string]*ignore.Matcher                             // folder -> matcher object
+	folderPins     map[string]*ignore.Matcher                             // folder -> matcher for the files never to be replaced or deleted
+	folderHeld     map[string]*heldDeletions                              // folder -> local deletions not yet announced
+	folderCaps     map[string]fs.Capabilities                             // folder -> capabilities of its file system, if known
+	folderLocked   map[string]*lockedFiles                                // folder -> files locked by other programs
+	folderDenied   map[string]*unreadableFiles                            // folder -> files that can't be read for lack of permission
+	folderSeeds    map[string]seedFiles                                   // folder -> files of an imported index, until the next full scan
 	folderRunners  map[string]service                                     // folder -> puller or scanner
+	runnerDone     map[string]chan struct{}                               // folder -> closed when the Serve of its runner returns
+	restarting     map[string]bool                                        // folders whose runner has been told to stop by restartFolder
 	folderStatRefs map[string]*stats.FolderStatisticsReference            // folder -> statsRef
 	fmut           sync.RWMutex                                           // protects the above
 
 	folderState        map[string]folderState // folder -> state
 	folderStateChanged map[string]time.Time   // folder -> time when state changed
+	folderNextScan     map[string]time.Time   // folder -> time of next scheduled scan
+	folderScanStats    map[string]ScanStats   // folder -> statistics of the last scan
 	smut               sync.RWMutex
 
-	protoConn map[protocol.DeviceID]protocol.Connection
-	rawConn   map[protocol.DeviceID]io.Closer
-	deviceVer map[protocol.DeviceID]string
-	pmut      sync.RWMutex // protects protoConn and rawConn
+	folderActivity map[string]time.Time // folder -> time of the last progress scanning or pulling
+	actMut         sync.Mutex           // protects folderActivity
+
+	protoConn   map[protocol.DeviceID]protocol.Connection
+	rawConn     map[protocol.DeviceID]io.Closer
+	deviceVer   map[protocol.DeviceID]string
+	deviceHello map[protocol.DeviceID]clientInfo    // device -> client it announced in its cluster config
+	deviceSkew  map[protocol.DeviceID]time.Duration // device -> clock offset relative to ours
+	peerPaused  map[protocol.DeviceID][]string      // device -> folders it has paused, as of connecting
+	deviceAddrs map[protocol.DeviceID]deviceAddress // device -> latest observed address, kept across disconnects
+	pmut        sync.RWMutex                        // protects protoConn and rawConn
+
+	connActs    map[protocol.DeviceID]*connActivity // device -> activity on its connection, while connected
+	idleClosed  map[protocol.DeviceID]idleClose     // device -> its connection closed for being idle
+	idleTimeout time.Duration                       // how long such a connection stays closed, at most
+	idleMut     sync.Mutex                          // protects connActs, idleClosed and idleTimeout
+
+	pauseTimers map[string]*time.Timer // "device:ID" or "folder:ID" -> resume timer
+	pauseMut    sync.Mutex             // protects pauseTimers
+
+	folderFreezes map[string]*folderFreeze // folder -> whether it's frozen, and the scans and pulls in progress
+	freezeMut     sync.Mutex               // protects folderFreezes and their frozen flags
+
+	incoming    map[string]map[string]bool // folder -> names of local files changed by the other devices since it was last in sync
+	incomingMut sync.Mutex                 // protects incoming
+
+	initialSync map[string]bool // folders not yet in sync for the first time; protected by fmut
+
+	powerPaused bool         // all devices and folders are paused while on battery
+	powerMut    sync.RWMutex // protects powerPaused
+
+	scanSlots chan struct{}  // limits the number of folders scanned at once, if not nil
+	runnerAt  time.Time      // when the latest batch of folder runners starts; protected by fmut
+	runnerLen int            // folder runners in the latest batch; protected by fmut
+	pullSched *pullScheduler // shares the block requests between the folders while any is boosted
+
+	pending     *stats.PendingReference // devices and folders waiting to be accepted
+	offered     *stats.OfferedReference // folders each device shares with us
+	diskChanges *stats.DiskChangeLog    // the latest changes to the folders on disk
+
+	recvBytes map[string]map[protocol.DeviceID]int64 // folder -> device -> data pulled but not yet added to the statistics
+	pullRates map[string]*rateTracker                // folder -> recent rate of data pulled
+	recvMut   sync.Mutex                             // protects recvBytes and its flushing, and pullRates
 
 	addedFolder bool
 	started     bool
 }
 
 var (
-	ErrNoSuchFile = errors.New("no such file")
-	ErrInvalid    = errors.New("file is invalid")
+	ErrNoSuchFile     = errors.New("no such file")
+	ErrInvalid        = errors.New("file is invalid")
+	ErrNotPlaceholder = errors.New("file is not a placeholder")
+	ErrDirectOnly     = errors.New("folder requires a direct connection")
+	ErrInvalidPath    = errors.New("path is outside of the folder")
+	ErrAuditOnly      = errors.New("folder is only audited, its files are not served")
 
 	SymlinkWarning = sync.Once{}
 )
@@ -139,19 +217,51 @@ func NewModel(cfg *config.Wrapper, deviceName, clientName, clientVersion string,
 		deviceFolders:      make(map[protocol.DeviceID][]string),
 		deviceStatRefs:     make(map[protocol.DeviceID]*stats.DeviceStatisticsReference),
 		folderIgnores:      make(map[string]*ignore.Matcher),
+		folderPins:         make(map[string]*ignore.Matcher),
+		folderHeld:         make(map[string]*heldDeletions),
+		folderCaps:         make(map[string]fs.Capabilities),
+		folderLocked:       make(map[string]*lockedFiles),
+		folderDenied:       make(map[string]*unreadableFiles),
+		folderSeeds:        make(map[string]seedFiles),
 		folderRunners:      make(map[string]service),
+		runnerDone:         make(map[string]chan struct{}),
+		restarting:         make(map[string]bool),
 		folderStatRefs:     make(map[string]*stats.FolderStatisticsReference),
+		initialSync:        make(map[string]bool),
 		folderState:        make(map[string]folderState),
 		folderStateChanged: make(map[string]time.Time),
+		folderNextScan:     make(map[string]time.Time),
+		folderScanStats:    make(map[string]ScanStats),
+		folderActivity:     make(map[string]time.Time),
 		protoConn:          make(map[protocol.DeviceID]protocol.Connection),
 		rawConn:            make(map[protocol.DeviceID]io.Closer),
 		deviceVer:          make(map[protocol.DeviceID]string),
+		deviceHello:        make(map[protocol.DeviceID]clientInfo),
+		deviceSkew:         make(map[protocol.DeviceID]time.Duration),
+		connActs:           make(map[protocol.DeviceID]*connActivity),
+		idleClosed:         make(map[protocol.DeviceID]idleClose),
+		peerPaused:         make(map[protocol.DeviceID][]string),
+		deviceAddrs:        make(map[protocol.DeviceID]deviceAddress),
+		pauseTimers:        make(map[string]*time.Timer),
+		folderFreezes:      make(map[string]*folderFreeze),
+		incoming:           make(map[string]map[string]bool),
 		finder:             files.NewBlockFinder(db, cfg),
 		progressEmitter:    NewProgressEmitter(cfg),
+		pending:            stats.NewPendingReference(db),
+		offered:            stats.NewOfferedReference(db),
+		diskChanges:        stats.NewDiskChangeLog(db, maxDiskChanges),
+		recvBytes:          make(map[string]map[protocol.DeviceID]int64),
+		pullRates:          make(map[string]*rateTracker),
+		pullSched:          newPullScheduler(),
+	}
+	if n := cfg.Options().MaxConcurrentScans; n > 0 {
+		m.scanSlots = make(chan struct{}, n)
 	}
 	if cfg.Options().ProgressUpdateIntervalS > -1 {
 		go m.progressEmitter.Serve()
 	}
+	m.resumePaused()
+	cfg.Subscribe(m)
 
 	var timeout = 20 * 60 // seconds
 	if t := os.Getenv("STDEADLOCKTIMEOUT"); len(t) > 0 {
@@ -180,10 +290,13 @@ func (m *Model) StartFolderRW(folder string) {
 	if ok {
 		panic("cannot start already running folder " + folder)
 	}
+	caps, probed := m.folderCaps[folder]
 	p := &Puller{
 		folder:          folder,
-		dir:             cfg.Path,
+		dir:             cfg.FilesystemPath(),
+		stop:            make(chan struct{}),
 		scanIntv:        time.Duration(cfg.RescanIntervalS) * time.Second,
+		scanSchedule:    scanSchedule(cfg),
 		model:           m,
 		ignorePerms:     cfg.IgnorePerms,
 		lenientMtimes:   cfg.LenientMtimes,
@@ -191,7 +304,25 @@ func (m *Model) StartFolderRW(folder string) {
 		copiers:         cfg.Copiers,
 		pullers:         cfg.Pullers,
 		queue:           newJobQueue(),
-	}
+		placeholderMode: cfg.PlaceholderMode,
+		priorities:      newFilePriorities(folder, cfg.Priorities),
+		syncXattrs:      cfg.SyncXattrs,
+		syncOwnership:   cfg.SyncOwnership,
+		creationTime:    cfg.SyncCreationTime,
+		attributes:      cfg.SyncFileAttributes,
+		hardlinks:       cfg.PreserveHardlinks,
+		absSymlinks:     cfg.AllowAbsoluteSymlinks,
+		caseInsensitive: probed && !caps.CaseSensitive,
+		multiSource:     m.cfg.Options().MultiSourcePull,
+		longPaths:       cfg.UseLongPaths,
+		fsyncMode:       m.cfg.Options().FsyncMode,
+		preallocate:     m.cfg.Options().Preallocate,
+		atomicReplace:   cfg.AtomicReplace,
+		verifyAssembled: cfg.VerifyAssembledFiles,
+		conflictDir:     cfg.ConflictDir,
+		dirMtimes:       cfg.SyncDirMtimes,
+	}
+	p.queue.SetRetry(time.Duration(m.cfg.Options().PullRetryBackoffS)*time.Second, m.cfg.Options().PullMaxAttempts)
 	m.folderRunners[folder] = p
 	m.fmut.Unlock()
 
@@ -200,14 +331,26 @@ func (m *Model) StartFolderRW(folder string) {
 		if !ok {
 			l.Fatalf("Requested versioning type %q that does not exist", cfg.Versioning.Type)
 		}
-		p.versioner = factory(folder, cfg.Path, cfg.Versioning.Params)
+		p.versioner = factory(folder, cfg.FilesystemPath(), cfg.Versioning.Params)
 	}
 
 	if cfg.LenientMtimes {
 		l.Infof("Folder %q is running with LenientMtimes workaround. Syncing may not work properly.", folder)
 	}
 
-	go p.Serve()
+	if cfg.PlaceholderMode && cfg.AtomicReplace {
+		// Placeholders are created over the existing file.
+		l.Warnf("Folder %q: placeholder mode is not possible with atomic replace; pulling file contents in full.", folder)
+		p.placeholderMode = false
+	} else if cfg.PlaceholderMode {
+		l.Infof("Folder %q is running in placeholder mode. File contents are only pulled on request.", folder)
+	}
+
+	if cfg.TempDir != "" {
+		p.setTempDir(cfg.TempDir)
+	}
+
+	m.serveRunner(folder, p)
 }
 
 // StartRO starts read only processing on the current model. When in
@@ -227,38 +370,113 @@ func (m *Model) StartFolderRO(folder string) {
 	s := &Scanner{
 		folder: folder,
 		intv:   time.Duration(cfg.RescanIntervalS) * time.Second,
+		sched:  scanSchedule(cfg),
 		model:  m,
+		stop:   make(chan struct{}),
 	}
 	m.folderRunners[folder] = s
 	m.fmut.Unlock()
 
-	go s.Serve()
+	m.serveRunner(folder, s)
+}
+
+// serveRunner starts serving the folder runner. Runners are started in
+// batches a while apart, so that many folders started at once don't all
+// scan and spawn their routines at the same time.
+func (m *Model) serveRunner(folder string, s service) {
+	done := make(chan struct{})
+	serve := func() {
+		s.Serve()
+		close(done)
+	}
+
+	m.fmut.Lock()
+	m.runnerDone[folder] = done
+	now := time.Now()
+	if now.After(m.runnerAt.Add(runnerBatchInterval)) {
+		m.runnerAt, m.runnerLen = now, 0
+	} else if m.runnerLen == runnerBatchSize {
+		m.runnerAt, m.runnerLen = m.runnerAt.Add(runnerBatchInterval), 0
+	}
+	m.runnerLen++
+	delay := m.runnerAt.Sub(now)
+	m.fmut.Unlock()
+
+	if delay > 0 {
+		time.AfterFunc(delay, serve)
+	} else {
+		go serve()
+	}
+}
+
+// ScanStats describes the last completed scan of a folder.
+type ScanStats struct {
+	scanner.Stats
+	Start     time.Time
+	End       time.Time
+	DurationS float64
+	Scans     int // completed since startup
 }
 
 type ConnectionInfo struct {
 	protocol.Statistics
-	Address       string
-	ClientVersion string
+	Address         string
+	AddressSource   string // how the address was found; "incoming", "static" or "discovery"
+	PreviousAddress string // the address the device was connected at before, if different
+	ClientVersion   string
+	ClientName      string
+	ProtocolVersion int
+	OutdatedClient  bool // the client is older than Options.MinClientVersion
+	Relayed         bool
+	ClockSkewS      float64 // remote clock minus ours, in seconds
+}
+
+// clientInfo is the client a device runs, as announced when connecting.
+type clientInfo struct {
+	name    string
+	version string
+}
+
+// outdated returns whether the client is a syncthing older than the minimum
+// version. Other clients have their own versions, and are never outdated.
+func (c clientInfo) outdated(minVersion string) bool {
+	if minVersion == "" || c.name != "syncthing" {
+		return false
+	}
+	return upgrade.CompareVersions(c.version, minVersion) < upgrade.Equal
+}
+
+type remoteAddrer interface {
+	RemoteAddr() net.Addr
 }
 
 // ConnectionStats returns a map with connection statistics for each connected device.
 func (m *Model) ConnectionStats() map[string]ConnectionInfo {
-	type remoteAddrer interface {
-		RemoteAddr() net.Addr
-	}
+	minVersion := m.cfg.Options().MinClientVersion
 
 	m.pmut.RLock()
 	m.fmut.RLock()
 
 	var res = make(map[string]ConnectionInfo)
 	for device, conn := range m.protoConn {
+		hello := m.deviceHello[device]
 		ci := ConnectionInfo{
 			Statistics:    conn.Statistics(),
 			ClientVersion: m.deviceVer[device],
+			ClientName:    hello.name,
+			// Connections speaking any other version are refused.
+			ProtocolVersion: protocol.Version,
+			OutdatedClient:  hello.outdated(minVersion),
+			ClockSkewS:      m.deviceSkew[device].Seconds(),
 		}
 		if nc, ok := m.rawConn[device].(remoteAddrer); ok {
 			ci.Address = nc.RemoteAddr().String()
 		}
+		ci.Relayed = isRelayed(m.rawConn[device])
+		if da, ok := m.deviceAddrs[device]; ok {
+			ci.AddressSource = da.source
+			ci.PreviousAddress = da.previous
+		}
 
 		res[device.String()] = ci
 	}
@@ -304,12 +522,16 @@ func (m *Model) Completion(device protocol.DeviceID, folder string) float64 {
 
 	m.fmut.RLock()
 	rf, ok := m.folderFiles[folder]
+	folderCfg := m.folderCfgs[folder]
 	m.fmut.RUnlock()
 	if !ok {
 		return 0 // Folder doesn't exist, so we hardly have any of it
 	}
 
 	rf.WithGlobalTruncated(func(f files.FileIntf) bool {
+		if device == protocol.LocalDeviceID && !folderCfg.Selected(f.(files.FileInfoTruncated).Name) {
+			return true
+		}
 		if !f.IsDeleted() {
 			tot += f.Size()
 		}
@@ -322,6 +544,10 @@ func (m *Model) Completion(device protocol.DeviceID, folder string) float64 {
 
 	var need int64
 	rf.WithNeedTruncated(device, func(f files.FileIntf) bool {
+		if device == protocol.LocalDeviceID && !folderCfg.Selected(f.(files.FileInfoTruncated).Name) {
+			// We don't need what we haven't selected.
+			return true
+		}
 		if !f.IsDeleted() {
 			need += f.Size()
 		}
@@ -336,6 +562,23 @@ func (m *Model) Completion(device protocol.DeviceID, folder string) float64 {
 	return res
 }
 
+// OutOfSync returns how far out of sync we and the device are in the
+// folders we share with it, as the sum of the percentages of each folder
+// missing on either side. The index we have of a device that isn't
+// connected may be stale, so its result is only meaningful for connected
+// devices.
+func (m *Model) OutOfSync(device protocol.DeviceID) float64 {
+	m.fmut.RLock()
+	folders := m.deviceFolders[device]
+	m.fmut.RUnlock()
+
+	var res float64
+	for _, folder := range folders {
+		res += 200 - m.Completion(device, folder) - m.Completion(protocol.LocalDeviceID, folder)
+	}
+	return res
+}
+
 func sizeOf(fs []protocol.FileInfo) (files, deleted int, bytes int64) {
 	for _, f := range fs {
 		fs, de, by := sizeOfFile(f)
@@ -404,7 +647,11 @@ func (m *Model) NeedSize(folder string) (nfiles int, bytes int64) {
 	m.fmut.RLock()
 	defer m.fmut.RUnlock()
 	if rf, ok := m.folderFiles[folder]; ok {
+		folderCfg := m.folderCfgs[folder]
 		rf.WithNeedTruncated(protocol.LocalDeviceID, func(f files.FileIntf) bool {
+			if !folderCfg.Selected(f.(files.FileInfoTruncated).Name) {
+				return true
+			}
 			fs, de, by := sizeOfFile(f)
 			nfiles += fs + de
 			bytes += by
@@ -418,54 +665,104 @@ func (m *Model) NeedSize(folder string) (nfiles int, bytes int64) {
 	return
 }
 
-// NeedFiles returns the list of currently needed files in progress, queued,
-// and to be queued on next puller iteration. Also takes a soft cap which is
-// only respected when adding files from the model rather than the runner queue.
-func (m *Model) NeedFolderFiles(folder string, max int) ([]files.FileInfoTruncated, []files.FileInfoTruncated, []files.FileInfoTruncated) {
+// NeedFolderFiles returns the given page of currently needed files in
+// progress, queued, and to be queued on next puller iteration, along with the
+// total number of needed files. Pages are numbered from one.
+func (m *Model) NeedFolderFiles(folder string, page, perpage int) ([]files.FileInfoTruncated, []files.FileInfoTruncated, []files.FileInfoTruncated, int) {
 	defer m.leveldbPanicWorkaround()
 
 	m.fmut.RLock()
 	defer m.fmut.RUnlock()
-	if rf, ok := m.folderFiles[folder]; ok {
-		var progress, queued, rest []files.FileInfoTruncated
-		var seen map[string]bool
+	rf, ok := m.folderFiles[folder]
+	if !ok {
+		return nil, nil, nil, 0
+	}
 
-		runner, ok := m.folderRunners[folder]
-		if ok {
-			progressNames, queuedNames := runner.Jobs()
+	// The pages are taken from the in progress, queued and remaining files,
+	// in that order.
+	skip, get := (page-1)*perpage, perpage
+	if skip < 0 {
+		skip = 0
+	}
+	total := 0
 
-			progress = make([]files.FileInfoTruncated, len(progressNames))
-			queued = make([]files.FileInfoTruncated, len(queuedNames))
-			seen = make(map[string]bool, len(progressNames)+len(queuedNames))
+	var progress, queued, rest []files.FileInfoTruncated
+	var seen map[string]bool
 
-			for i, name := range progressNames {
-				if f, ok := rf.GetGlobalTruncated(name); ok {
-					progress[i] = f
-					seen[name] = true
-				}
+	if runner, ok := m.folderRunners[folder]; ok {
+		allProgressNames, allQueuedNames := runner.Jobs()
+		seen = make(map[string]bool, len(allProgressNames)+len(allQueuedNames))
+		for _, name := range allProgressNames {
+			seen[name] = true
+		}
+		for _, name := range allQueuedNames {
+			seen[name] = true
+		}
+		total = len(allProgressNames) + len(allQueuedNames)
+
+		var progressNames, queuedNames []string
+		progressNames, skip, get = getChunk(allProgressNames, skip, get)
+		queuedNames, skip, get = getChunk(allQueuedNames, skip, get)
+
+		progress = make([]files.FileInfoTruncated, 0, len(progressNames))
+		for _, name := range progressNames {
+			if f, ok := rf.GetGlobalTruncated(name); ok {
+				progress = append(progress, f)
 			}
+		}
 
-			for i, name := range queuedNames {
-				if f, ok := rf.GetGlobalTruncated(name); ok {
-					queued[i] = f
-					seen[name] = true
-				}
+		queued = make([]files.FileInfoTruncated, 0, len(queuedNames))
+		for _, name := range queuedNames {
+			if f, ok := rf.GetGlobalTruncated(name); ok {
+				queued = append(queued, f)
 			}
 		}
-		left := max - len(progress) - len(queued)
-		if max < 1 || left > 0 {
-			rf.WithNeedTruncated(protocol.LocalDeviceID, func(f files.FileIntf) bool {
-				left--
-				ft := f.(files.FileInfoTruncated)
-				if !seen[ft.Name] {
-					rest = append(rest, ft)
-				}
-				return max < 1 || left > 0
-			})
+	}
+
+	// Walk the complete need list to count it, but only keep the files on
+	// the requested page.
+	rest = make([]files.FileInfoTruncated, 0, get)
+	folderCfg := m.folderCfgs[folder]
+	rf.WithNeedTruncated(protocol.LocalDeviceID, func(f files.FileIntf) bool {
+		ft := f.(files.FileInfoTruncated)
+		if seen[ft.Name] || !folderCfg.Selected(ft.Name) {
+			return true
+		}
+		total++
+		if skip > 0 {
+			skip--
+		} else if get > 0 {
+			rest = append(rest, ft)
+			get--
 		}
-		return progress, queued, rest
+		return true
+	})
+
+	return progress, queued, rest, total
+}
+
+// getChunk returns the part of data selected by skip and get, and the skip
+// and get values remaining for the data following it.
+func getChunk(data []string, skip, get int) ([]string, int, int) {
+	n := len(data)
+	if n <= skip {
+		return nil, skip - n, get
+	} else if n < skip+get {
+		return data[skip:], 0, get - (n - skip)
 	}
-	return nil, nil, nil
+	return data[skip : skip+get], 0, 0
+}
+
+// FileProgress returns the number of bytes completed for the given file, if
+// it is currently being pulled.
+func (m *Model) FileProgress(folder, file string) (int64, bool) {
+	return m.progressEmitter.FileBytesCompleted(folder, file)
+}
+
+// Transfers returns the files currently being pulled in the folder, or in
+// all folders if folder is empty.
+func (m *Model) Transfers(folder string) []Transfer {
+	return m.progressEmitter.Transfers(folder)
 }
 
 // Index is called when a new device is connected and we receive their full index.
@@ -474,6 +771,7 @@ func (m *Model) Index(deviceID protocol.DeviceID, folder string, fs []protocol.F
 	if debug {
 		l.Debugf("IDX(in): %s %q: %d files", deviceID, folder, len(fs))
 	}
+	m.markActive(deviceID)
 
 	if !m.folderSharedWith(folder, deviceID) {
 		events.Default.Log(events.FolderRejected, map[string]string{
@@ -484,6 +782,11 @@ func (m *Model) Index(deviceID protocol.DeviceID, folder string, fs []protocol.F
 		return
 	}
 
+	if m.folderRequiresDirect(folder) && m.deviceRelayed(deviceID) {
+		l.Infof("Ignoring index for folder %q from device %q, as the folder requires a direct connection and the device is connected through a relay.", folder, deviceID)
+		return
+	}
+
 	m.fmut.RLock()
 	files, ok := m.folderFiles[folder]
 	m.fmut.RUnlock()
@@ -505,6 +808,14 @@ func (m *Model) Index(deviceID protocol.DeviceID, folder string, fs []protocol.F
 		}
 	}
 
+	if dev := m.folderDevice(folder, deviceID); dev.Observer {
+		invalidateAll(fs)
+		if dev.Override {
+			overrideObserved(files, fs)
+		}
+	}
+
+	m.checkIncoming(deviceID, folder, files, fs)
 	files.Replace(deviceID, fs)
 
 	events.Default.Log(events.RemoteIndexUpdated, map[string]interface{}{
@@ -521,12 +832,20 @@ func (m *Model) IndexUpdate(deviceID protocol.DeviceID, folder string, fs []prot
 	if debug {
 		l.Debugf("%v IDXUP(in): %s / %q: %d files", m, deviceID, folder, len(fs))
 	}
+	m.markActive(deviceID)
 
 	if !m.folderSharedWith(folder, deviceID) {
 		l.Infof("Update for unexpected folder ID %q sent from device %q; ensure that the folder exists and that this device is selected under \"Share With\" in the folder configuration.", folder, deviceID)
 		return
 	}
 
+	if m.folderRequiresDirect(folder) && m.deviceRelayed(deviceID) {
+		if debug {
+			l.Debugf("%v IDXUP(in): %s / %q: ignored, folder requires a direct connection", m, deviceID, folder)
+		}
+		return
+	}
+
 	m.fmut.RLock()
 	files, ok := m.folderFiles[folder]
 	m.fmut.RUnlock()
@@ -548,6 +867,14 @@ func (m *Model) IndexUpdate(deviceID protocol.DeviceID, folder string, fs []prot
 		}
 	}
 
+	if dev := m.folderDevice(folder, deviceID); dev.Observer {
+		invalidateAll(fs)
+		if dev.Override {
+			overrideObserved(files, fs)
+		}
+	}
+
+	m.checkIncoming(deviceID, folder, files, fs)
 	files.Update(deviceID, fs)
 
 	events.Default.Log(events.RemoteIndexUpdated, map[string]interface{}{
@@ -569,6 +896,85 @@ func (m *Model) folderSharedWith(folder string, deviceID protocol.DeviceID) bool
 	return false
 }
 
+// A RelayedConn is a connection to a device that goes through a relay
+// rather than directly to it. Connections that don't implement it are
+// direct.
+type RelayedConn interface {
+	Relayed() bool
+}
+
+func isRelayed(conn io.Closer) bool {
+	rc, ok := conn.(RelayedConn)
+	return ok && rc.Relayed()
+}
+
+// deviceRelayed returns whether the current connection to the device is
+// relayed.
+func (m *Model) deviceRelayed(deviceID protocol.DeviceID) bool {
+	m.pmut.RLock()
+	defer m.pmut.RUnlock()
+	return isRelayed(m.rawConn[deviceID])
+}
+
+// folderRequiresDirect returns whether the folder must not be synced with
+// devices connected through a relay.
+func (m *Model) folderRequiresDirect(folder string) bool {
+	m.fmut.RLock()
+	defer m.fmut.RUnlock()
+	return m.folderCfgs[folder].RequireDirectConnection
+}
+
+// folderDevice returns the configuration of the device for the folder, such
+// as whether it's an observer, i.e. only receives the folder.
+func (m *Model) folderDevice(folder string, deviceID protocol.DeviceID) config.FolderDeviceConfiguration {
+	m.fmut.RLock()
+	defer m.fmut.RUnlock()
+	for _, dev := range m.folderCfgs[folder].Devices {
+		if dev.DeviceID == deviceID {
+			return dev
+		}
+	}
+	return config.FolderDeviceConfiguration{}
+}
+
+// invalidateAll sets the invalid bit on the files, keeping them out of the
+// global version of the folder. The versions are left as they are, so that
+// the device is still seen as up to date with the files it has in common
+// with us.
+func invalidateAll(fs []protocol.FileInfo) {
+	for i := range fs {
+		fs[i].Flags |= protocol.FlagInvalid
+	}
+}
+
+// overrideObserved announces our version of the files an observer has
+// changed again, newer than its, so that it pulls them back. Files it has
+// created are announced as deleted. Files we are about to pull from other
+// devices are left alone.
+func overrideObserved(set *files.Set, fs []protocol.FileInfo) {
+	var batch []protocol.FileInfo
+	for _, f := range fs {
+		global, hasGlobal := set.GetGlobal(f.Name)
+		if hasGlobal && global.Version >= f.Version {
+			continue
+		}
+		have, ok := set.Get(protocol.LocalDeviceID, f.Name)
+		switch {
+		case ok && !have.IsInvalid() && (!hasGlobal || have.Version == global.Version):
+		case !ok && !hasGlobal && !f.IsDeleted():
+			have = protocol.FileInfo{Name: f.Name, Flags: f.Flags&^protocol.FlagInvalid | protocol.FlagDeleted, Modified: f.Modified}
+		default:
+			continue
+		}
+		have.Version = lamport.Default.Tick(f.Version)
+		have.LocalVersion = 0
+		batch = append(batch, have)
+	}
+	if len(batch) > 0 {
+		set.Update(protocol.LocalDeviceID, batch)
+	}
+}
+
 func (m *Model) ClusterConfig(deviceID protocol.DeviceID, cm protocol.ClusterConfigMessage) {
 	m.pmut.Lock()
 	if cm.ClientName == "syncthing" {
@@ -576,6 +982,18 @@ func (m *Model) ClusterConfig(deviceID protocol.DeviceID, cm protocol.ClusterCon
 	} else {
 		m.deviceVer[deviceID] = cm.ClientName + " " + cm.ClientVersion
 	}
+	hello := clientInfo{cm.ClientName, cm.ClientVersion}
+	m.deviceHello[deviceID] = hello
+
+	skew, hasSkew := clockSkew(cm.GetOption("time"), time.Now())
+	if hasSkew {
+		m.deviceSkew[deviceID] = skew
+	}
+	if paused := cm.GetOption("paused"); paused != "" {
+		m.peerPaused[deviceID] = strings.Split(paused, ",")
+	} else {
+		delete(m.peerPaused, deviceID)
+	}
 
 	event := map[string]string{
 		"id":            deviceID.String(),
@@ -583,7 +1001,7 @@ func (m *Model) ClusterConfig(deviceID protocol.DeviceID, cm protocol.ClusterCon
 		"clientVersion": cm.ClientVersion,
 	}
 
-	if conn, ok := m.rawConn[deviceID].(*tls.Conn); ok {
+	if conn, ok := m.rawConn[deviceID].(remoteAddrer); ok {
 		event["addr"] = conn.RemoteAddr().String()
 	}
 
@@ -593,6 +1011,14 @@ func (m *Model) ClusterConfig(deviceID protocol.DeviceID, cm protocol.ClusterCon
 
 	l.Infof(`Device %s client is "%s %s"`, deviceID, cm.ClientName, cm.ClientVersion)
 
+	if minVersion := m.cfg.Options().MinClientVersion; hello.outdated(minVersion) {
+		l.Warnf("Device %s runs syncthing %s, older than the minimum of %s; please upgrade it.", deviceID, cm.ClientVersion, minVersion)
+	}
+
+	if hasSkew && (skew > maxClockSkew || skew < -maxClockSkew) {
+		l.Warnf("The clock of device %s differs from ours by %v. Modification times of files changed on either device will be off by the same amount; please correct the system time.", deviceID, skew)
+	}
+
 	var changed bool
 
 	if name := cm.GetOption("name"); name != "" {
@@ -605,6 +1031,28 @@ func (m *Model) ClusterConfig(deviceID protocol.DeviceID, cm protocol.ClusterCon
 		}
 	}
 
+	// Remember the folders offered to us that we don't share with the
+	// device, so that they can be accepted later, unless we trust the device
+	// to have them accepted right away.
+	autoAccept := m.cfg.Devices()[deviceID].AutoAcceptFolders
+	var accepted bool
+	offered := make([]string, len(cm.Folders))
+	for i, folder := range cm.Folders {
+		offered[i] = folder.ID
+	}
+	m.offered.SetFolders(deviceID, offered)
+	for _, folder := range cm.Folders {
+		if m.folderSharedWith(folder.ID, deviceID) {
+			continue
+		}
+		if autoAccept && m.autoAcceptFolder(folder.ID, deviceID) {
+			accepted = true
+			changed = true
+			continue
+		}
+		m.pending.AddFolder(folder.ID, deviceID)
+	}
+
 	if m.cfg.Devices()[deviceID].Introducer {
 		// This device is an introducer. Go through the announced lists of folders
 		// and devices and add what we are missing.
@@ -672,6 +1120,19 @@ func (m *Model) ClusterConfig(deviceID protocol.DeviceID, cm protocol.ClusterCon
 	if changed {
 		m.cfg.Save()
 	}
+
+	if accepted {
+		// The device has already sent, or is about to send, the indexes of
+		// the folders it shares with us. Reconnect to have them sent again,
+		// now that we share the accepted folders.
+		m.pmut.RLock()
+		conn, ok := m.rawConn[deviceID]
+		m.pmut.RUnlock()
+		if ok {
+			// Close is called by the protocol layer when the reader notices.
+			conn.Close()
+		}
+	}
 }
 
 // Close removes the peer from the model and closes the underlying connection if possible.
@@ -692,7 +1153,9 @@ func (m *Model) Close(device protocol.DeviceID, err error) {
 
 	conn, ok := m.rawConn[device]
 	if ok {
-		if conn, ok := conn.(*tls.Conn); ok {
+		if conn, ok := conn.(interface {
+			SetWriteDeadline(time.Time) error
+		}); ok {
 			// If the underlying connection is a *tls.Conn, Close() does more
 			// than it says on the tin. Specifically, it sends a TLS alert
 			// message, which might block forever if the connection is dead
@@ -704,12 +1167,61 @@ func (m *Model) Close(device protocol.DeviceID, err error) {
 	delete(m.protoConn, device)
 	delete(m.rawConn, device)
 	delete(m.deviceVer, device)
+	delete(m.deviceHello, device)
+	delete(m.deviceSkew, device)
+	delete(m.peerPaused, device)
 	m.pmut.Unlock()
+
+	m.idleMut.Lock()
+	delete(m.connActs, device)
+	m.idleMut.Unlock()
+}
+
+// DropDeviceIndex removes the index data of the given device, for the given
+// folder or for all folders when folder is empty, and recalculates the
+// global state. A connected device is disconnected, so that the indexes are
+// exchanged in full when it reconnects.
+func (m *Model) DropDeviceIndex(device protocol.DeviceID, folder string) error {
+	if device == protocol.LocalDeviceID {
+		return errors.New("cannot drop the local index")
+	}
+
+	m.fmut.RLock()
+	var sets []*files.Set
+	if folder == "" {
+		for _, fs := range m.folderFiles {
+			sets = append(sets, fs)
+		}
+	} else if fs, ok := m.folderFiles[folder]; ok {
+		sets = append(sets, fs)
+	}
+	m.fmut.RUnlock()
+
+	if len(sets) == 0 {
+		return errors.New("no such folder")
+	}
+
+	l.Infof("Dropping index data of device %s (folder %q)", device, folder)
+	for _, fs := range sets {
+		fs.Replace(device, nil)
+	}
+
+	m.pmut.RLock()
+	conn, ok := m.rawConn[device]
+	m.pmut.RUnlock()
+	if ok {
+		// Close is called by the protocol layer when the reader notices.
+		conn.Close()
+	}
+
+	return nil
 }
 
 // Request returns the specified data segment by reading it from local disk.
 // Implements the protocol.Model interface.
 func (m *Model) Request(deviceID protocol.DeviceID, folder, name string, offset int64, size int) ([]byte, error) {
+	m.markActive(deviceID)
+
 	// Verify that the requested file exists in the local model.
 	m.fmut.RLock()
 	r, ok := m.folderFiles[folder]
@@ -720,6 +1232,20 @@ func (m *Model) Request(deviceID protocol.DeviceID, folder, name string, offset
 		return nil, ErrNoSuchFile
 	}
 
+	if m.folderRequiresDirect(folder) && m.deviceRelayed(deviceID) {
+		if debug {
+			l.Debugf("%v REQ(in): %s: %q / %q; refused, folder requires a direct connection", m, deviceID, folder, name)
+		}
+		return nil, ErrDirectOnly
+	}
+
+	if m.folderAudited(folder) {
+		if debug {
+			l.Debugf("%v REQ(in): %s: %q / %q; refused, folder is only audited", m, deviceID, folder, name)
+		}
+		return nil, ErrAuditOnly
+	}
+
 	lf, ok := r.Get(protocol.LocalDeviceID, name)
 	if !ok {
 		return nil, ErrNoSuchFile
@@ -743,8 +1269,9 @@ func (m *Model) Request(deviceID protocol.DeviceID, folder, name string, offset
 		l.Debugf("%v REQ(in): %s: %q / %q o=%d s=%d", m, deviceID, folder, name, offset, size)
 	}
 	m.fmut.RLock()
-	fn := filepath.Join(m.folderCfgs[folder].Path, name)
+	folderCfg := m.folderCfgs[folder]
 	m.fmut.RUnlock()
+	fn := filepath.Join(folderCfg.FilesystemPath(), name)
 
 	var reader io.ReaderAt
 	var err error
@@ -772,6 +1299,38 @@ func (m *Model) Request(deviceID protocol.DeviceID, folder, name string, offset
 	return buf, nil
 }
 
+// OpenFile opens the local copy of the file for reading. Only files that we
+// have an up to date copy of can be opened; it doesn't wait for or fetch
+// files that are out of sync.
+func (m *Model) OpenFile(folder, name string) (*os.File, protocol.FileInfo, error) {
+	name = filepath.Clean(filepath.FromSlash(name))
+	if filepath.IsAbs(name) || name == ".." || strings.HasPrefix(name, ".."+string(os.PathSeparator)) {
+		return nil, protocol.FileInfo{}, ErrInvalidPath
+	}
+
+	m.fmut.RLock()
+	fs, ok := m.folderFiles[folder]
+	folderCfg := m.folderCfgs[folder]
+	m.fmut.RUnlock()
+	if !ok {
+		return nil, protocol.FileInfo{}, ErrNoSuchFile
+	}
+
+	lf, ok := fs.Get(protocol.LocalDeviceID, name)
+	if !ok || lf.IsDeleted() || lf.IsDirectory() || lf.IsSymlink() {
+		return nil, protocol.FileInfo{}, ErrNoSuchFile
+	}
+	if lf.IsInvalid() {
+		return nil, protocol.FileInfo{}, ErrInvalid
+	}
+
+	fd, err := os.Open(filepath.Join(folderCfg.FilesystemPath(), name))
+	if err != nil {
+		return nil, protocol.FileInfo{}, err
+	}
+	return fd, lf, nil
+}
+
 // ReplaceLocal replaces the local folder index with the given list of files.
 func (m *Model) ReplaceLocal(folder string, fs []protocol.FileInfo) {
 	m.fmut.RLock()
@@ -814,7 +1373,39 @@ func (m *Model) ConnectedTo(deviceID protocol.DeviceID) bool {
 	return ok
 }
 
+// ConnectedDevices returns the devices currently connected.
+func (m *Model) ConnectedDevices() []protocol.DeviceID {
+	m.pmut.RLock()
+	devices := make([]protocol.DeviceID, 0, len(m.protoConn))
+	for device := range m.protoConn {
+		devices = append(devices, device)
+	}
+	m.pmut.RUnlock()
+	return devices
+}
+
+// DropConnection closes the connection to the device, if any. The device
+// may connect again later.
+func (m *Model) DropConnection(device protocol.DeviceID) {
+	m.pmut.RLock()
+	conn, ok := m.rawConn[device]
+	m.pmut.RUnlock()
+	if ok {
+		conn.Close()
+	}
+}
+
 func (m *Model) GetIgnores(folder string) ([]string, []string, error) {
+	return m.getPatterns(folder, ".stignore", m.folderIgnores)
+}
+
+func (m *Model) SetIgnores(folder string, content []string) error {
+	return m.setPatterns(folder, ".stignore", content)
+}
+
+// getPatterns returns the lines of the pattern file in the root of the
+// folder, and the patterns currently in effect from it.
+func (m *Model) getPatterns(folder, name string, matchers map[string]*ignore.Matcher) ([]string, []string, error) {
 	var lines []string
 
 	m.fmut.RLock()
@@ -824,12 +1415,12 @@ func (m *Model) GetIgnores(folder string) ([]string, []string, error) {
 		return lines, nil, fmt.Errorf("Folder %s does not exist", folder)
 	}
 
-	fd, err := os.Open(filepath.Join(cfg.Path, ".stignore"))
+	fd, err := os.Open(filepath.Join(cfg.Path, name))
 	if err != nil {
 		if os.IsNotExist(err) {
 			return lines, nil, nil
 		}
-		l.Warnln("Loading .stignore:", err)
+		l.Warnf("Loading %s: %v", name, err)
 		return lines, nil, err
 	}
 	defer fd.Close()
@@ -841,7 +1432,7 @@ func (m *Model) GetIgnores(folder string) ([]string, []string, error) {
 
 	m.fmut.RLock()
 	var patterns []string
-	if matcher := m.folderIgnores[folder]; matcher != nil {
+	if matcher := matchers[folder]; matcher != nil {
 		patterns = matcher.Patterns()
 	}
 	m.fmut.RUnlock()
@@ -849,15 +1440,20 @@ func (m *Model) GetIgnores(folder string) ([]string, []string, error) {
 	return lines, patterns, nil
 }
 
-func (m *Model) SetIgnores(folder string, content []string) error {
+// setPatterns replaces the pattern file in the root of the folder and
+// rescans the folder, which loads the new patterns.
+func (m *Model) setPatterns(folder, name string, content []string) error {
 	cfg, ok := m.folderCfgs[folder]
 	if !ok {
 		return fmt.Errorf("Folder %s does not exist", folder)
 	}
+	if m.folderFrozen(folder) {
+		return ErrFrozen
+	}
 
-	fd, err := ioutil.TempFile(cfg.Path, ".syncthing.stignore-"+folder)
+	fd, err := ioutil.TempFile(cfg.Path, ".syncthing"+name+"-"+folder)
 	if err != nil {
-		l.Warnln("Saving .stignore:", err)
+		l.Warnf("Saving %s: %v", name, err)
 		return err
 	}
 	defer os.Remove(fd.Name())
@@ -865,24 +1461,38 @@ func (m *Model) SetIgnores(folder string, content []string) error {
 	for _, line := range content {
 		_, err = fmt.Fprintln(fd, line)
 		if err != nil {
-			l.Warnln("Saving .stignore:", err)
+			l.Warnf("Saving %s: %v", name, err)
 			return err
 		}
 	}
 
 	err = fd.Close()
 	if err != nil {
-		l.Warnln("Saving .stignore:", err)
+		l.Warnf("Saving %s: %v", name, err)
 		return err
 	}
 
-	file := filepath.Join(cfg.Path, ".stignore")
-	err = osutil.Rename(fd.Name(), file)
+	m.fmut.RLock()
+	ignores := m.folderIgnores[folder]
+	m.fmut.RUnlock()
+	oldPatterns := ignores.Patterns()
+
+	file := filepath.Join(cfg.Path, name)
+	err = fs.Rename(fs.DefaultFilesystem, fd.Name(), file)
 	if err != nil {
-		l.Warnln("Saving .stignore:", err)
+		l.Warnf("Saving %s: %v", name, err)
 		return err
 	}
 
+	// When more files are ignored than before, those already in the index
+	// are invalidated instead of scanning the folder.
+	if name == ".stignore" {
+		if err := ignores.Load(file); err == nil && ignore.IgnoresMore(oldPatterns, ignores.Patterns()) {
+			m.invalidateIgnored(folder)
+			return nil
+		}
+	}
+
 	return m.ScanFolder(folder)
 }
 
@@ -905,14 +1515,29 @@ func (m *Model) AddConnection(rawConn io.Closer, protoConn protocol.Connection)
 	cm := m.clusterConfig(deviceID)
 	protoConn.ClusterConfig(cm)
 
+	relayed := isRelayed(rawConn)
 	m.fmut.RLock()
 	for _, folder := range m.deviceFolders[deviceID] {
+		if relayed && m.folderCfgs[folder].RequireDirectConnection {
+			l.Infof("Not syncing folder %q with device %s, as the folder requires a direct connection and the device is connected through a relay.", folder, deviceID)
+			continue
+		}
 		fs := m.folderFiles[folder]
-		go sendIndexes(protoConn, folder, fs, m.folderIgnores[folder])
+		invalid := m.folderCfgs[folder].Type == config.FolderTypeAudit
+		go sendIndexes(protoConn, folder, fs, m.folderIgnores[folder], invalid)
 	}
 	m.fmut.RUnlock()
 	m.pmut.Unlock()
 
+	act := &connActivity{
+		at:       time.Now(),
+		versions: m.localVersions(deviceID),
+	}
+	m.idleMut.Lock()
+	m.connActs[deviceID] = act
+	delete(m.idleClosed, deviceID)
+	m.idleMut.Unlock()
+
 	m.deviceWasSeen(deviceID)
 }
 
@@ -947,9 +1572,65 @@ func (m *Model) folderStatRef(folder string) *stats.FolderStatisticsReference {
 
 func (m *Model) receivedFile(folder, filename string) {
 	m.folderStatRef(folder).ReceivedFile(filename)
+	m.flushReceivedBytes(folder)
+}
+
+// receivedBytes counts the data pulled from the device for the folder. The
+// counts are added to the statistics as files are finished, rather than for
+// every block.
+func (m *Model) receivedBytes(folder string, device protocol.DeviceID, n int) {
+	m.recvMut.Lock()
+	recv, ok := m.recvBytes[folder]
+	if !ok {
+		recv = make(map[protocol.DeviceID]int64)
+		m.recvBytes[folder] = recv
+	}
+	recv[device] += int64(n)
+	rate, ok := m.pullRates[folder]
+	if !ok {
+		rate = &rateTracker{}
+		m.pullRates[folder] = rate
+	}
+	m.recvMut.Unlock()
+	rate.add(int64(n), time.Now())
 }
 
-func sendIndexes(conn protocol.Connection, folder string, fs *files.Set, ignores *ignore.Matcher) {
+// ETA returns the estimated time until the folder is in sync, given the
+// data still needed and the recent rate of pulling it. The boolean is false
+// when nothing is needed or the transfer is stalled.
+func (m *Model) ETA(folder string) (time.Duration, bool) {
+	m.recvMut.Lock()
+	rate, ok := m.pullRates[folder]
+	m.recvMut.Unlock()
+	if !ok {
+		return 0, false
+	}
+
+	bps := rate.rate(time.Now())
+	if bps < minETARate {
+		return 0, false
+	}
+	_, need := m.NeedSize(folder)
+	if need == 0 {
+		return 0, false
+	}
+	return time.Duration(float64(need) / bps * float64(time.Second)), true
+}
+
+func (m *Model) flushReceivedBytes(folder string) {
+	m.recvMut.Lock()
+	defer m.recvMut.Unlock()
+	if recv, ok := m.recvBytes[folder]; ok {
+		delete(m.recvBytes, folder)
+		m.folderStatRef(folder).AddReceivedBytes(recv)
+	}
+}
+
+// sendIndexes sends the index of the folder to the device, and the updates to
+// it for as long as the connection lasts. With invalid set, all files are
+// announced as invalid, so that the device never takes our versions for the
+// global ones or requests them from us; audit folders don't serve files.
+func sendIndexes(conn protocol.Connection, folder string, fs *files.Set, ignores *ignore.Matcher, invalid bool) {
 	deviceID := conn.ID()
 	name := conn.Name()
 	var err error
@@ -958,7 +1639,7 @@ func sendIndexes(conn protocol.Connection, folder string, fs *files.Set, ignores
 		l.Debugf("sendIndexes for %s-%s/%q starting", deviceID, name, folder)
 	}
 
-	minLocalVer, err := sendIndexTo(true, 0, conn, folder, fs, ignores)
+	minLocalVer, err := sendIndexTo(true, 0, conn, folder, fs, ignores, invalid)
 
 	for err == nil {
 		time.Sleep(5 * time.Second)
@@ -966,7 +1647,7 @@ func sendIndexes(conn protocol.Connection, folder string, fs *files.Set, ignores
 			continue
 		}
 
-		minLocalVer, err = sendIndexTo(false, minLocalVer, conn, folder, fs, ignores)
+		minLocalVer, err = sendIndexTo(false, minLocalVer, conn, folder, fs, ignores, invalid)
 	}
 
 	if debug {
@@ -974,7 +1655,7 @@ func sendIndexes(conn protocol.Connection, folder string, fs *files.Set, ignores
 	}
 }
 
-func sendIndexTo(initial bool, minLocalVer uint64, conn protocol.Connection, folder string, fs *files.Set, ignores *ignore.Matcher) (uint64, error) {
+func sendIndexTo(initial bool, minLocalVer uint64, conn protocol.Connection, folder string, fs *files.Set, ignores *ignore.Matcher, invalid bool) (uint64, error) {
 	deviceID := conn.ID()
 	name := conn.Name()
 	batch := make([]protocol.FileInfo, 0, indexBatchSize)
@@ -1021,6 +1702,10 @@ func sendIndexTo(initial bool, minLocalVer uint64, conn protocol.Connection, fol
 			currentBatchSize = 0
 		}
 
+		if invalid {
+			f.Flags |= protocol.FlagInvalid
+		}
+		f.Flags &^= protocol.FlagPlaceholder
 		batch = append(batch, f)
 		currentBatchSize += indexPerFileSize + len(f.Blocks)*IndexPerBlockSize
 		return true
@@ -1046,6 +1731,11 @@ func (m *Model) updateLocal(folder string, f protocol.FileInfo) {
 	m.fmut.RLock()
 	m.folderFiles[folder].Update(protocol.LocalDeviceID, []protocol.FileInfo{f})
 	m.fmut.RUnlock()
+	var modifier protocol.DeviceID
+	if devices := m.availability(folder, f.Name); len(devices) > 0 {
+		modifier = devices[0]
+	}
+	m.diskChanges.Add([]stats.DiskChange{diskChange(folder, f, modifier)})
 	events.Default.Log(events.LocalIndexUpdated, map[string]interface{}{
 		"folder":   folder,
 		"name":     f.Name,
@@ -1068,6 +1758,7 @@ func (m *Model) requestGlobal(deviceID protocol.DeviceID, folder, name string, o
 		l.Debugf("%v REQ(out): %s: %q / %q o=%d s=%d h=%x", m, deviceID, folder, name, offset, size, hash)
 	}
 
+	m.markActive(deviceID)
 	return nc.Request(folder, name, offset, size)
 }
 
@@ -1079,9 +1770,27 @@ func (m *Model) AddFolder(cfg config.FolderConfiguration) {
 		panic("cannot add empty folder id")
 	}
 
+	var caps fs.Capabilities
+	var probed bool
+	if cfg.Type != config.FolderTypeAudit {
+		// Probing writes to the folder, and audit folders are never
+		// written to.
+		caps, probed = probeFolder(&cfg)
+	}
+
+	initialSync := m.folderStatRef(cfg.ID).GetFirstSynced().IsZero()
+
 	m.fmut.Lock()
 	m.folderCfgs[cfg.ID] = cfg
+	if initialSync {
+		m.initialSync[cfg.ID] = true
+	}
+	if probed {
+		m.folderCaps[cfg.ID] = caps
+	}
 	m.folderFiles[cfg.ID] = files.NewSet(cfg.ID, m.db)
+	m.folderLocked[cfg.ID] = newLockedFiles(cfg.ID)
+	m.folderDenied[cfg.ID] = newUnreadableFiles(cfg.ID, cfg.SkipUnreadable)
 
 	m.folderDevices[cfg.ID] = make([]protocol.DeviceID, len(cfg.Devices))
 	for i, device := range cfg.Devices {
@@ -1090,9 +1799,17 @@ func (m *Model) AddFolder(cfg config.FolderConfiguration) {
 	}
 
 	ignores := ignore.New(m.cfg.Options().CacheIgnoredFiles)
+	if !cfg.DisableDefaultIgnores {
+		ignores.SetDefaults(m.cfg.Options().DefaultIgnores)
+	}
 	_ = ignores.Load(filepath.Join(cfg.Path, ".stignore")) // Ignore error, there might not be an .stignore
 	m.folderIgnores[cfg.ID] = ignores
 
+	pins := ignore.New(false)
+	_ = pins.Load(filepath.Join(cfg.Path, ".stpin")) // Ignore error, there might not be an .stpin
+	m.folderPins[cfg.ID] = pins
+	m.folderHeld[cfg.ID] = newHeldDeletions()
+
 	m.addedFolder = true
 	m.fmut.Unlock()
 }
@@ -1111,7 +1828,7 @@ func (m *Model) ScanFolders() {
 		folder := folder
 		go func() {
 			err := m.ScanFolder(folder)
-			if err != nil {
+			if err != nil && err != errDriveMissing {
 				m.cfg.InvalidateFolder(folder, err.Error())
 			}
 			wg.Done()
@@ -1125,6 +1842,12 @@ func (m *Model) ScanFolder(folder string) error {
 }
 
 func (m *Model) ScanFolderSub(folder, sub string) error {
+	return m.scanFolderSub(folder, sub, nil)
+}
+
+// scanFolderSub scans the folder, calling yield whenever the scan has used up
+// the folder's time budget, if there is one and yield is not nil.
+func (m *Model) scanFolderSub(folder, sub string, yield func()) error {
 	if p := filepath.Clean(filepath.Join(folder, sub)); !strings.HasPrefix(p, folder) {
 		return errors.New("invalid subpath")
 	}
@@ -1133,26 +1856,65 @@ func (m *Model) ScanFolderSub(folder, sub string) error {
 	fs, ok := m.folderFiles[folder]
 	folderCfg := m.folderCfgs[folder]
 	ignores := m.folderIgnores[folder]
+	pins := m.folderPins[folder]
+	held := m.folderHeld[folder]
+	locked := m.folderLocked[folder]
+	unreadable := m.folderDenied[folder]
+	seeds := m.folderSeeds[folder]
 	m.fmut.Unlock()
 
 	if !ok {
 		return errors.New("no such folder")
 	}
 
-	_ = ignores.Load(filepath.Join(folderCfg.Path, ".stignore")) // Ignore error, there might not be an .stignore
+	if err := m.startWork(folder); err != nil {
+		return err
+	}
+	defer m.endWork(folder)
 
-	w := &scanner.Walker{
-		Dir:          folderCfg.Path,
-		Sub:          sub,
-		Matcher:      ignores,
-		BlockSize:    protocol.BlockSize,
-		TempNamer:    defTempNamer,
-		TempLifetime: time.Duration(m.cfg.Options().KeepTemporariesH) * time.Hour,
-		CurrentFiler: cFiler{m, folder},
-		IgnorePerms:  folderCfg.IgnorePerms,
-		Hashers:      folderCfg.Hashers,
+	if driveMissing(folderCfg) {
+		return errDriveMissing
 	}
 
+	_ = ignores.Load(filepath.Join(folderCfg.Path, ".stignore")) // Ignore error, there might not be an .stignore
+	_ = pins.Load(filepath.Join(folderCfg.Path, ".stpin"))       // Ignore error, there might not be an .stpin
+
+	w := &scanner.Walker{
+		Dir:            folderCfg.FilesystemPath(),
+		Sub:            sub,
+		Matcher:        ignores,
+		BlockSize:      protocol.BlockSize,
+		TempNamer:      defTempNamer,
+		TempLifetime:   time.Duration(m.cfg.Options().KeepTemporariesH) * time.Hour,
+		CurrentFiler:   cFiler{m, folder},
+		IgnorePerms:    folderCfg.IgnorePerms,
+		Hashers:        folderCfg.Hashers,
+		Xattrs:         folderCfg.SyncXattrs,
+		Ownership:      folderCfg.SyncOwnership && canChown(), // else we keep announcing the owner we were given
+		Hardlinks:      folderCfg.PreserveHardlinks,
+		CreationTime:   folderCfg.SyncCreationTime,
+		Attributes:     folderCfg.SyncFileAttributes,
+		AppendOnly:     folderCfg.AppendOnlyHashing,
+		IOPriority:     scanIOPriority(m.cfg.Options().ScanIOPriority),
+		Stats:          &scanner.Stats{},
+		LockedFiles:    locked,
+		Unreadable:     unreadable,
+		ConflictDir:    folderCfg.ConflictDir,
+		FilesPerSecond: folderCfg.ScanFilesPerSecond,
+		DirMtimes:      folderCfg.SyncDirMtimes,
+	}
+	if seeds != nil {
+		w.Seeds = seeds
+	}
+
+	// Wait for our turn, if only a limited number of folders may be
+	// scanned at once.
+	if m.scanSlots != nil {
+		m.scanSlots <- struct{}{}
+		defer func() { <-m.scanSlots }()
+	}
+
+	start := time.Now()
 	m.setState(folder, FolderScanning)
 	fchan, err := w.Walk()
 
@@ -1161,7 +1923,25 @@ func (m *Model) ScanFolderSub(folder, sub string) error {
 	}
 	batchSize := 100
 	batch := make([]protocol.FileInfo, 0, batchSize)
+	budget := newScanBudget(time.Duration(folderCfg.ScanTimeBudgetMs)*time.Millisecond, yield)
 	for f := range fchan {
+		if budget.exceeded() {
+			// Make what has been scanned so far known before pulling.
+			if len(batch) > 0 {
+				fs.Update(protocol.LocalDeviceID, batch)
+				m.addDiskChanges(folder, batch)
+				batch = batch[:0]
+			}
+			budget.yield(fs)
+			m.setState(folder, FolderScanning)
+		}
+		if budget.pulled(fs, f.Name) {
+			// The file was changed by a pull since it was looked at, so
+			// what we have seen of it may be stale. The next scan picks up
+			// any local change.
+			continue
+		}
+		m.folderProgressed(folder)
 		events.Default.Log(events.LocalIndexUpdated, map[string]interface{}{
 			"folder":   folder,
 			"name":     f.Name,
@@ -1171,15 +1951,40 @@ func (m *Model) ScanFolderSub(folder, sub string) error {
 		})
 		if len(batch) == batchSize {
 			fs.Update(protocol.LocalDeviceID, batch)
+			m.addDiskChanges(folder, batch)
 			batch = batch[:0]
 		}
+		if folderCfg.ReceiveOnly {
+			// Local changes are kept out of the global version, so that
+			// we need, and pull, the file as it is on the other devices.
+			f.Flags |= protocol.FlagInvalid
+		}
+		if seeds != nil {
+			f = seeded(seeds, fs, f)
+		}
 		batch = append(batch, f)
 	}
 	if len(batch) > 0 {
 		fs.Update(protocol.LocalDeviceID, batch)
+		m.addDiskChanges(folder, batch)
+	}
+	unreadable.done(sub)
+	if seeds != nil && sub == "" {
+		m.fmut.Lock()
+		delete(m.folderSeeds, folder)
+		m.fmut.Unlock()
+	}
+
+	if driveMissing(folderCfg) {
+		// The drive went away during the scan. The files we didn't see
+		// are not deleted.
+		return errDriveMissing
 	}
 
 	batch = batch[:0]
+	grace := time.Duration(folderCfg.DeletionGracePeriodS) * time.Second
+	newlyHeld := 0
+	now := time.Now()
 	// TODO: We should limit the Have scanning to start at sub
 	seenPrefix := false
 	fs.WithHaveTruncated(protocol.LocalDeviceID, func(fi files.FileIntf) bool {
@@ -1199,6 +2004,7 @@ func (m *Model) ScanFolderSub(folder, sub string) error {
 
 			if len(batch) == batchSize {
 				fs.Update(protocol.LocalDeviceID, batch)
+				m.addDiskChanges(folder, batch)
 				batch = batch[:0]
 			}
 
@@ -1221,14 +2027,35 @@ func (m *Model) ScanFolderSub(folder, sub string) error {
 					"size":     f.Size(),
 				})
 				batch = append(batch, nf)
-			} else if _, err := os.Lstat(filepath.Join(folderCfg.Path, f.Name)); err != nil && os.IsNotExist(err) {
+				return true
+			}
+
+			if unreadable.covers(f.Name) {
+				// The file or a directory above it can't be read, so we
+				// can't tell whether it still exists. Keep it as it was.
+				return true
+			}
+
+			if _, err := os.Lstat(filepath.Join(folderCfg.FilesystemPath(), f.Name)); err != nil && os.IsNotExist(err) {
 				// File has been deleted
+				if grace > 0 {
+					wait, first := held.hold(f.Name, grace, now)
+					if first {
+						newlyHeld++
+					}
+					if wait {
+						return true
+					}
+				}
 				nf := protocol.FileInfo{
 					Name:     f.Name,
 					Flags:    f.Flags | protocol.FlagDeleted,
 					Modified: f.Modified,
 					Version:  lamport.Default.Tick(f.Version),
 				}
+				if folderCfg.ReceiveOnly {
+					nf.Flags |= protocol.FlagInvalid
+				}
 				events.Default.Log(events.LocalIndexUpdated, map[string]interface{}{
 					"folder":   folder,
 					"name":     f.Name,
@@ -1237,18 +2064,42 @@ func (m *Model) ScanFolderSub(folder, sub string) error {
 					"size":     f.Size(),
 				})
 				batch = append(batch, nf)
+			} else if grace > 0 {
+				held.forget(f.Name)
 			}
 		}
 		return true
 	})
 	if len(batch) > 0 {
 		fs.Update(protocol.LocalDeviceID, batch)
+		m.addDiskChanges(folder, batch)
+	}
+
+	if newlyHeld > bulkDeletionThreshold {
+		l.Warnf("Folder %q: %d files were deleted. The deletions are held back for %v before they are announced to other devices; restore the files or cancel the deletions to keep them.", folder, newlyHeld, grace)
+	} else if newlyHeld > 0 && debug {
+		l.Debugf("folder %q: holding %d deletions for %v", folder, newlyHeld, grace)
 	}
 
+	m.setScanStats(folder, start, w.Stats)
 	m.setState(folder, FolderIdle)
 	return nil
 }
 
+// clockSkew returns the difference between the remote clock, given as the
+// "time" cluster config option in seconds since the epoch, and now. The
+// boolean is false if the peer did not send a usable time.
+func clockSkew(remote string, now time.Time) (time.Duration, bool) {
+	if remote == "" {
+		return 0, false
+	}
+	secs, err := strconv.ParseInt(remote, 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return time.Unix(secs, 0).Sub(now.Truncate(time.Second)), true
+}
+
 // clusterConfig returns a ClusterConfigMessage that is correct for the given peer device
 func (m *Model) clusterConfig(device protocol.DeviceID) protocol.ClusterConfigMessage {
 	cm := protocol.ClusterConfigMessage{
@@ -1259,11 +2110,26 @@ func (m *Model) clusterConfig(device protocol.DeviceID) protocol.ClusterConfigMe
 				Key:   "name",
 				Value: m.deviceName,
 			},
+			{
+				Key:   "time",
+				Value: strconv.FormatInt(time.Now().Unix(), 10),
+			},
 		},
 	}
 
+	// Folders requiring a direct connection are left out when the device
+	// is connected through a relay. The caller holds pmut, if needed.
+	relayed := isRelayed(m.rawConn[device])
+
+	var paused []string
 	m.fmut.RLock()
 	for _, folder := range m.deviceFolders[device] {
+		if relayed && m.folderCfgs[folder].RequireDirectConnection {
+			continue
+		}
+		if m.folderPaused(folder) {
+			paused = append(paused, folder)
+		}
 		cr := protocol.Folder{
 			ID: folder,
 		}
@@ -1285,10 +2151,21 @@ func (m *Model) clusterConfig(device protocol.DeviceID) protocol.ClusterConfigMe
 	}
 	m.fmut.RUnlock()
 
+	// Let the device know which of the folders it won't get any changes
+	// for.
+	if len(paused) > 0 {
+		cm.Options = append(cm.Options, protocol.Option{
+			Key:   "paused",
+			Value: strings.Join(paused, ","),
+		})
+	}
+
 	return cm
 }
 
 func (m *Model) setState(folder string, state folderState) {
+	m.folderProgressed(folder)
+
 	m.smut.Lock()
 	oldState := m.folderState[folder]
 	changed, ok := m.folderStateChanged[folder]
@@ -1316,7 +2193,48 @@ func (m *Model) State(folder string) (string, time.Time) {
 	return state.String(), changed
 }
 
+func (m *Model) setNextScan(folder string, t time.Time) {
+	m.smut.Lock()
+	m.folderNextScan[folder] = t
+	m.smut.Unlock()
+}
+
+// NextScan returns the time of the next scheduled scan of the folder, or the
+// zero time if there is none.
+func (m *Model) NextScan(folder string) time.Time {
+	m.smut.RLock()
+	defer m.smut.RUnlock()
+	return m.folderNextScan[folder]
+}
+
+func (m *Model) setScanStats(folder string, start time.Time, stats *scanner.Stats) {
+	end := time.Now()
+	m.smut.Lock()
+	m.folderScanStats[folder] = ScanStats{
+		Stats:     *stats,
+		Start:     start,
+		End:       end,
+		DurationS: end.Sub(start).Seconds(),
+		Scans:     m.folderScanStats[folder].Scans + 1,
+	}
+	m.smut.Unlock()
+}
+
+// ScanStats returns the statistics of the last completed scan of the
+// folder. The number of scans is zero if there has been none.
+func (m *Model) ScanStats(folder string) ScanStats {
+	m.smut.RLock()
+	defer m.smut.RUnlock()
+	return m.folderScanStats[folder]
+}
+
 func (m *Model) Override(folder string) {
+	if m.folderAudited(folder) {
+		// Our versions of the files are never served.
+		l.Infof("Not overriding changes in folder %q, as it's only audited", folder)
+		return
+	}
+
 	m.fmut.RLock()
 	fs := m.folderFiles[folder]
 	m.fmut.RUnlock()
@@ -1350,6 +2268,34 @@ func (m *Model) Override(folder string) {
 	m.setState(folder, FolderIdle)
 }
 
+// FlushIndex makes the index durable on disk, so that it's quickly opened
+// again at the next startup. It does nothing unless the index has changed
+// since it was last flushed.
+func (m *Model) FlushIndex() error {
+	m.fmut.RLock()
+	sets := make([]*files.Set, 0, len(m.folderFiles))
+	for _, fs := range m.folderFiles {
+		sets = append(sets, fs)
+	}
+	m.fmut.RUnlock()
+
+	m.flushMut.Lock()
+	defer m.flushMut.Unlock()
+	for _, fs := range sets {
+		if fs.TakeChanged() {
+			m.flushPending = true
+		}
+	}
+	if !m.flushPending {
+		return nil
+	}
+	if err := files.Flush(m.db); err != nil {
+		return err
+	}
+	m.flushPending = false
+	return nil
+}
+
 // CurrentLocalVersion returns the change version for the given folder.
 // This is guaranteed to increment if the contents of the local folder has
 // changed.
@@ -1422,6 +2368,68 @@ func (m *Model) BringToFront(folder, file string) {
 	}
 }
 
+// Materialize requests that the full contents of the given placeholder file
+// be pulled.
+func (m *Model) Materialize(folder, file string) error {
+	m.fmut.RLock()
+	cfg, ok := m.folderCfgs[folder]
+	runner := m.folderRunners[folder]
+	m.fmut.RUnlock()
+
+	if !ok {
+		return errors.New("no such folder")
+	}
+
+	p, ok := runner.(*Puller)
+	if !ok || !cfg.PlaceholderMode {
+		return errors.New("folder is not in placeholder mode")
+	}
+
+	if f, ok := m.CurrentFolderFile(folder, file); !ok || !isPlaceholder(f) {
+		return ErrNotPlaceholder
+	}
+
+	p.Materialize(file)
+	return nil
+}
+
+// FolderErrors returns the files in the folder that have failed to sync too
+// many times, and are not attempted again until the next scan or an explicit
+// retry.
+func (m *Model) FolderErrors(folder string) ([]FileError, error) {
+	m.fmut.RLock()
+	runner, ok := m.folderRunners[folder]
+	m.fmut.RUnlock()
+
+	if !ok {
+		return nil, errors.New("no such folder")
+	}
+
+	p, ok := runner.(*Puller)
+	if !ok {
+		// Read only folders don't pull anything, so nothing can fail.
+		return nil, nil
+	}
+	return p.queue.Errors(), nil
+}
+
+// RetryFolderErrors forgets the failures of files in the folder, so that
+// they are attempted again on the next pull.
+func (m *Model) RetryFolderErrors(folder string) error {
+	m.fmut.RLock()
+	runner, ok := m.folderRunners[folder]
+	m.fmut.RUnlock()
+
+	if !ok {
+		return errors.New("no such folder")
+	}
+
+	if p, ok := runner.(*Puller); ok {
+		p.queue.ResetFailures()
+	}
+	return nil
+}
+
 func (m *Model) String() string {
 	return fmt.Sprintf("model@%p", m)
 }
@@ -1456,3 +2464,16 @@ func symlinkInvalid(isLink bool) bool {
 	}
 	return false
 }
+
+// scanIOPriority returns the I/O priority for the given value of the
+// ScanIOPriority option.
+func scanIOPriority(s string) osutil.IOPriority {
+	switch s {
+	case config.IOPriorityLow:
+		return osutil.IOPriorityLow
+	case config.IOPriorityIdle:
+		return osutil.IOPriorityIdle
+	default:
+		return osutil.IOPriorityNormal
+	}
+}
@@ -17,13 +17,20 @@ package model
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
 	"testing"
 	"time"
 
 	"github.com/syncthing/syncthing/internal/config"
+	"github.com/syncthing/syncthing/internal/events"
 	"github.com/syncthing/syncthing/internal/protocol"
+	"github.com/syncthing/syncthing/internal/stats"
 	"github.com/syndtr/goleveldb/leveldb"
 	"github.com/syndtr/goleveldb/leveldb/storage"
 )
@@ -103,6 +110,167 @@ func genFiles(n int) []protocol.FileInfo {
 	return files
 }
 
+func TestDropDeviceIndex(t *testing.T) {
+	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	m := NewModel(config.Wrap("/tmp/test", config.Configuration{}), "device", "syncthing", "dev", db)
+	for _, folder := range []string{"default", "other"} {
+		m.AddFolder(config.FolderConfiguration{
+			ID:      folder,
+			Path:    "testdata",
+			Devices: []config.FolderDeviceConfiguration{{DeviceID: device1}},
+		})
+	}
+	files := genFiles(10)
+	m.Index(device1, "default", files)
+	m.Index(device1, "other", files)
+
+	if n, _, _ := m.GlobalSize("default"); n != 10 {
+		t.Fatalf("unexpected global size %d", n)
+	}
+
+	if err := m.DropDeviceIndex(device1, "nonexistent"); err == nil {
+		t.Error("unexpected nil error for nonexistent folder")
+	}
+	if err := m.DropDeviceIndex(protocol.LocalDeviceID, ""); err == nil {
+		t.Error("unexpected nil error for the local device")
+	}
+
+	if err := m.DropDeviceIndex(device1, "default"); err != nil {
+		t.Fatal(err)
+	}
+	if n, _, _ := m.GlobalSize("default"); n != 0 {
+		t.Errorf("unexpected global size %d after drop", n)
+	}
+	if n, _, _ := m.GlobalSize("other"); n != 10 {
+		t.Errorf("unexpected global size %d in untouched folder", n)
+	}
+
+	if err := m.DropDeviceIndex(device1, ""); err != nil {
+		t.Fatal(err)
+	}
+	if n, _, _ := m.GlobalSize("other"); n != 0 {
+		t.Errorf("unexpected global size %d after drop", n)
+	}
+}
+
+func TestNeedFolderFilesPaging(t *testing.T) {
+	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	m := NewModel(config.Wrap("/tmp/test", config.Configuration{}), "device", "syncthing", "dev", db)
+	m.AddFolder(config.FolderConfiguration{
+		ID:      "default",
+		Path:    "testdata",
+		Devices: []config.FolderDeviceConfiguration{{DeviceID: device1}},
+	})
+	m.Index(device1, "default", genFiles(25))
+
+	seen := make(map[string]bool)
+	for page := 1; page <= 3; page++ {
+		progress, queued, rest, total := m.NeedFolderFiles("default", page, 10)
+		if total != 25 {
+			t.Errorf("page %d: unexpected total %d", page, total)
+		}
+		if len(progress) != 0 || len(queued) != 0 {
+			t.Errorf("page %d: unexpected progress or queued files", page)
+		}
+		exp := 10
+		if page == 3 {
+			exp = 5
+		}
+		if len(rest) != exp {
+			t.Errorf("page %d: unexpected %d files, expected %d", page, len(rest), exp)
+		}
+		for _, f := range rest {
+			if seen[f.Name] {
+				t.Errorf("page %d: file %q already seen", page, f.Name)
+			}
+			seen[f.Name] = true
+		}
+	}
+
+	if _, _, rest, _ := m.NeedFolderFiles("default", 4, 10); len(rest) != 0 {
+		t.Errorf("unexpected %d files past the last page", len(rest))
+	}
+}
+
+func TestGetChunk(t *testing.T) {
+	data := []string{"a", "b", "c", "d"}
+	cases := []struct {
+		skip, get   int
+		chunk       []string
+		skip2, get2 int
+	}{
+		{0, 2, []string{"a", "b"}, 0, 0},
+		{1, 2, []string{"b", "c"}, 0, 0},
+		{3, 2, []string{"d"}, 0, 1},
+		{4, 2, nil, 0, 2},
+		{6, 2, nil, 2, 2},
+		{0, 10, []string{"a", "b", "c", "d"}, 0, 6},
+	}
+	for _, tc := range cases {
+		chunk, skip, get := getChunk(data, tc.skip, tc.get)
+		if fmt.Sprint(chunk) != fmt.Sprint(tc.chunk) || skip != tc.skip2 || get != tc.get2 {
+			t.Errorf("getChunk(%d, %d) = %v, %d, %d; expected %v, %d, %d", tc.skip, tc.get, chunk, skip, get, tc.chunk, tc.skip2, tc.get2)
+		}
+	}
+}
+
+func TestPauseAndResume(t *testing.T) {
+	// Saving the configuration leaves a backup beside it.
+	dir, err := ioutil.TempDir("", "syncthing-pause")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := config.Wrap(filepath.Join(dir, "config.xml"), config.Configuration{
+		Devices: []config.DeviceConfiguration{{DeviceID: device1}},
+		Folders: []config.FolderConfiguration{{ID: "default", Path: "testdata"}},
+	})
+	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	m := NewModel(cfg, "device", "syncthing", "dev", db)
+
+	if err := m.PauseFolder("nonexistent", time.Time{}); err == nil {
+		t.Error("unexpected nil error for nonexistent folder")
+	}
+	if err := m.PauseDevice(device2, time.Time{}); err == nil {
+		t.Error("unexpected nil error for unknown device")
+	}
+
+	if err := m.PauseDevice(device1, time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.PauseFolder("default", time.Now().Add(100*time.Millisecond)); err != nil {
+		t.Fatal(err)
+	}
+	if !m.DevicePaused(device1) || !m.folderPaused("default") {
+		t.Fatal("device and folder should be paused")
+	}
+	devices, folders := m.Paused()
+	if len(devices) != 1 || devices[device1.String()].Until != nil {
+		t.Errorf("unexpected paused devices %v", devices)
+	}
+	if len(folders) != 1 || folders["default"].Until == nil {
+		t.Errorf("unexpected paused folders %v", folders)
+	}
+
+	// The folder resumes by itself, the device stays paused until resumed.
+	for deadline := time.Now().Add(10 * time.Second); m.folderPaused("default"); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("folder should have been resumed")
+		}
+	}
+	if !m.DevicePaused(device1) {
+		t.Error("device should still be paused")
+	}
+
+	if err := m.ResumeDevice(device1); err != nil {
+		t.Fatal(err)
+	}
+	if m.DevicePaused(device1) {
+		t.Error("device should have been resumed")
+	}
+}
+
 func BenchmarkIndex10000(b *testing.B) {
 	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
 	m := NewModel(nil, "device", "syncthing", "dev", db)
@@ -216,6 +384,69 @@ func (FakeConnection) Statistics() protocol.Statistics {
 	return protocol.Statistics{}
 }
 
+type relayedConnection struct {
+	FakeConnection
+}
+
+func (relayedConnection) Relayed() bool {
+	return true
+}
+
+func TestRequireDirectConnection(t *testing.T) {
+	cfg := config.Configuration{
+		Folders: []config.FolderConfiguration{
+			{
+				ID:      "open",
+				Path:    "testdata",
+				Devices: []config.FolderDeviceConfiguration{{DeviceID: device1}},
+			},
+			{
+				ID:                      "direct",
+				Path:                    "testdata",
+				Devices:                 []config.FolderDeviceConfiguration{{DeviceID: device1}},
+				RequireDirectConnection: true,
+			},
+		},
+	}
+
+	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	m := NewModel(config.Wrap("/tmp/test", cfg), "device", "syncthing", "dev", db)
+	m.AddFolder(cfg.Folders[0])
+	m.AddFolder(cfg.Folders[1])
+	m.ScanFolder("direct")
+
+	fc := relayedConnection{FakeConnection{id: device1}}
+	m.AddConnection(fc, fc)
+
+	cm := m.clusterConfig(device1)
+	if len(cm.Folders) != 1 || cm.Folders[0].ID != "open" {
+		t.Errorf("Unexpected folders %v in cluster config", cm.Folders)
+	}
+
+	files := genFiles(10)
+	m.Index(device1, "open", files)
+	m.Index(device1, "direct", files)
+	if n, _, _ := m.GlobalSize("open"); n != 10 {
+		t.Errorf("Unexpected global size %d for open folder", n)
+	}
+	// Only the local files are known in the direct only folder.
+	local, _, _ := m.LocalSize("direct")
+	if n, _, _ := m.GlobalSize("direct"); n != local {
+		t.Errorf("Unexpected global size %d != %d for direct only folder", n, local)
+	}
+
+	if _, err := m.Request(device1, "direct", "foo", 0, 6); err != ErrDirectOnly {
+		t.Errorf("Unexpected error %v for request over relay", err)
+	}
+	if _, err := m.Request(protocol.LocalDeviceID, "direct", "foo", 0, 6); err != nil {
+		t.Errorf("Unexpected error %v for local request", err)
+	}
+
+	if stats := m.ConnectionStats(); !stats[device1.String()].Relayed {
+		t.Error("Connection should be reported as relayed")
+	}
+}
+
 func BenchmarkRequest(b *testing.B) {
 	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
 	m := NewModel(nil, "device", "syncthing", "dev", db)
@@ -475,3 +706,1046 @@ func TestIgnores(t *testing.T) {
 		t.Errorf("Expected no ignores, got: %v", ignores)
 	}
 }
+
+func TestNextScanDelay(t *testing.T) {
+	if d := nextScanDelay(0, nil); d != 0 {
+		t.Errorf("Expected no rescan without interval or schedule, got %v", d)
+	}
+
+	intv := time.Hour
+	for i := 0; i < 100; i++ {
+		if d := nextScanDelay(intv, nil); d < intv*3/4 || d > intv*5/4 {
+			t.Fatalf("Delay %v out of range for interval %v", d, intv)
+		}
+	}
+
+	// The schedule wins over the interval
+	sched := scanSchedule(config.FolderConfiguration{RescanIntervalS: 3600, RescanSchedule: "* * * * *"})
+	if sched == nil {
+		t.Fatal("Unexpected nil schedule")
+	}
+	if d := nextScanDelay(intv, sched); d <= 0 || d > time.Minute {
+		t.Errorf("Delay %v out of range for schedule", d)
+	}
+
+	if sched := scanSchedule(config.FolderConfiguration{RescanSchedule: "bogus"}); sched != nil {
+		t.Error("Expected nil schedule for invalid expression")
+	}
+}
+
+func TestScanStats(t *testing.T) {
+	dir, err := ioutil.TempDir("", "scanstats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, name := range []string{"a", "b"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte("data"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	m := NewModel(config.Wrap("/tmp/test", config.Configuration{}), "device", "syncthing", "dev", db)
+	m.AddFolder(config.FolderConfiguration{ID: "default", Path: dir})
+
+	if stats := m.ScanStats("default"); stats.Scans != 0 {
+		t.Errorf("Unexpected stats before scanning: %+v", stats)
+	}
+
+	m.ScanFolder("default")
+	stats := m.ScanStats("default")
+	if stats.Scans != 1 || stats.FilesHashed != 2 || stats.BytesHashed != 8 || stats.FilesSkipped != 0 {
+		t.Errorf("Unexpected stats after first scan: %+v", stats)
+	}
+	if stats.End.Before(stats.Start) || stats.DurationS < 0 {
+		t.Errorf("Unexpected scan times: %+v", stats)
+	}
+
+	// Nothing changed, so nothing is hashed.
+	m.ScanFolder("default")
+	stats = m.ScanStats("default")
+	if stats.Scans != 2 || stats.FilesHashed != 0 || stats.BytesHashed != 0 || stats.FilesSkipped != 2 {
+		t.Errorf("Unexpected stats after second scan: %+v", stats)
+	}
+}
+
+func TestMaxConcurrentScans(t *testing.T) {
+	cfg := config.New(device1)
+	cfg.Options.MaxConcurrentScans = 1
+	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	m := NewModel(config.Wrap("/tmp/test", cfg), "device", "syncthing", "dev", db)
+	m.AddFolder(config.FolderConfiguration{ID: "default", Path: "testdata"})
+
+	// With the only slot taken, the scan has to wait for it.
+	m.scanSlots <- struct{}{}
+	done := make(chan struct{})
+	go func() {
+		m.ScanFolder("default")
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("Scan did not wait for a free slot")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	<-m.scanSlots
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Scan did not finish after the slot was freed")
+	}
+	if len(m.scanSlots) != 0 {
+		t.Error("Scan slot was not released")
+	}
+}
+
+func TestPending(t *testing.T) {
+	cfg := config.Configuration{
+		Devices: []config.DeviceConfiguration{{DeviceID: device1}},
+		Folders: []config.FolderConfiguration{
+			{
+				ID:      "default",
+				Path:    "testdata",
+				Devices: []config.FolderDeviceConfiguration{{DeviceID: device1}},
+			},
+			{
+				ID:   "unshared",
+				Path: "testdata",
+			},
+		},
+	}
+	w := config.Wrap("/tmp/test", cfg)
+
+	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	m := NewModel(w, "device", "syncthing", "dev", db)
+	m.AddFolder(cfg.Folders[0])
+	m.AddFolder(cfg.Folders[1])
+
+	m.AddPendingDevice(device2, "192.0.2.42:22000")
+	devices := m.PendingDevices()
+	if len(devices) != 1 || devices[0].DeviceID != device2 || devices[0].Address != "192.0.2.42:22000" || devices[0].Time.IsZero() {
+		t.Errorf("Unexpected pending devices %v", devices)
+	}
+
+	// Only the folders not shared with the device are pending.
+	m.ClusterConfig(device1, protocol.ClusterConfigMessage{
+		Folders: []protocol.Folder{{ID: "default"}, {ID: "unshared"}, {ID: "new"}},
+	})
+	folders := m.PendingFolders()
+	if len(folders) != 2 || folders[0].Folder != "new" || folders[1].Folder != "unshared" || folders[0].DeviceID != device1 {
+		t.Errorf("Unexpected pending folders %v", folders)
+	}
+
+	if err := m.DismissPendingFolder("new", device1); err != nil {
+		t.Fatal(err)
+	}
+	if folders := m.PendingFolders(); len(folders) != 1 || folders[0].Folder != "unshared" {
+		t.Errorf("Unexpected pending folders %v after dismissal", folders)
+	}
+
+	// Accepting through the configuration removes the pending entries.
+	cfg.Devices = append(cfg.Devices, config.DeviceConfiguration{DeviceID: device2})
+	cfg.Folders[1].Devices = []config.FolderDeviceConfiguration{{DeviceID: device1}}
+	w.Replace(cfg)
+	if devices := m.PendingDevices(); len(devices) != 0 {
+		t.Errorf("Unexpected pending devices %v after accepting", devices)
+	}
+	if folders := m.PendingFolders(); len(folders) != 0 {
+		t.Errorf("Unexpected pending folders %v after accepting", folders)
+	}
+}
+
+func TestDeviceFolders(t *testing.T) {
+	cfg := config.Configuration{
+		Devices: []config.DeviceConfiguration{{DeviceID: device1}},
+		Folders: []config.FolderConfiguration{
+			{
+				ID:      "default",
+				Path:    "testdata",
+				Devices: []config.FolderDeviceConfiguration{{DeviceID: device1}},
+			},
+		},
+	}
+	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	m := NewModel(config.Wrap("/tmp/test", cfg), "device", "syncthing", "dev", db)
+	m.AddFolder(cfg.Folders[0])
+
+	m.ClusterConfig(device1, protocol.ClusterConfigMessage{
+		Folders: []protocol.Folder{{ID: "photos"}, {ID: "default"}, {ID: "backup"}},
+	})
+	folders := m.DeviceFolders(device1)
+	if len(folders) != 3 ||
+		folders[0].Folder != "backup" || folders[0].Accepted ||
+		folders[1].Folder != "default" || !folders[1].Accepted ||
+		folders[2].Folder != "photos" || folders[2].Accepted || folders[2].Time.IsZero() {
+		t.Errorf("Unexpected device folders %v", folders)
+	}
+
+	// A folder no longer offered is forgotten.
+	m.ClusterConfig(device1, protocol.ClusterConfigMessage{
+		Folders: []protocol.Folder{{ID: "default"}},
+	})
+	if folders := m.DeviceFolders(device1); len(folders) != 1 || folders[0].Folder != "default" {
+		t.Errorf("Unexpected device folders %v after the second cluster config", folders)
+	}
+	if folders := m.DeviceFolders(device2); len(folders) != 0 {
+		t.Errorf("Unexpected folders %v for a device that offered none", folders)
+	}
+}
+
+func TestAutoAcceptFolders(t *testing.T) {
+	dir, err := ioutil.TempDir("", "autoaccept")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := os.Mkdir(filepath.Join(dir, "taken"), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := config.New(device1)
+	cfg.Options.AutoAcceptFolderPath = dir
+	cfg.Devices = []config.DeviceConfiguration{
+		{DeviceID: device1, AutoAcceptFolders: true},
+		{DeviceID: device2},
+	}
+	cfg.Folders = []config.FolderConfiguration{
+		{ID: "default", Path: "testdata", Devices: []config.FolderDeviceConfiguration{{DeviceID: device2}}},
+	}
+	w := config.Wrap(filepath.Join(dir, "config.xml"), cfg)
+
+	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	m := NewModel(w, "device", "syncthing", "dev", db)
+	m.AddFolder(cfg.Folders[0])
+
+	m.ClusterConfig(device1, protocol.ClusterConfigMessage{
+		Folders: []protocol.Folder{{ID: "default"}, {ID: "new"}, {ID: "taken"}, {ID: "../evil"}},
+	})
+	m.ClusterConfig(device2, protocol.ClusterConfigMessage{
+		Folders: []protocol.Folder{{ID: "other"}},
+	})
+
+	fcfg, ok := w.Folders()["new"]
+	if !ok || fcfg.Path != filepath.Join(dir, "new") || !m.folderSharedWith("new", device1) {
+		t.Fatalf("Folder not accepted: %+v", fcfg)
+	}
+	if !fcfg.HasMarker() {
+		t.Error("Accepted folder has no marker")
+	}
+
+	// Folders colliding with existing ones, with bad IDs, or offered by
+	// devices that aren't trusted are left pending.
+	var pending []string
+	for _, f := range m.PendingFolders() {
+		pending = append(pending, f.Folder+"@"+f.DeviceID.String()[:7])
+	}
+	expected := []string{"../evil@AIR6LPZ", "default@AIR6LPZ", "taken@AIR6LPZ", "other@GYRZZQB"}
+	if fmt.Sprint(pending) != fmt.Sprint(expected) {
+		t.Errorf("Unexpected pending folders %v, expected %v", pending, expected)
+	}
+	for _, id := range []string{"taken", "other"} {
+		if _, ok := w.Folders()[id]; ok {
+			t.Errorf("Folder %q unexpectedly accepted", id)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "other")); err == nil {
+		t.Error("Folder from untrusted device was created")
+	}
+}
+
+func TestDiskChanges(t *testing.T) {
+	dir, err := ioutil.TempDir("", "diskchanges")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, name := range []string{"a", "b"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte("data"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	m := NewModel(config.Wrap("/tmp/test", config.Configuration{}), "device", "syncthing", "dev", db)
+	m.AddFolder(config.FolderConfiguration{ID: "default", Path: dir})
+	m.AddFolder(config.FolderConfiguration{ID: "other", Path: dir})
+
+	m.ScanFolder("default")
+	if err := os.Remove(filepath.Join(dir, "a")); err != nil {
+		t.Fatal(err)
+	}
+	m.ScanFolder("default")
+	m.updateLocal("other", protocol.FileInfo{Name: "c", Flags: protocol.FlagDirectory | 0755, Version: 1})
+
+	changes := m.DiskChanges("", 0)
+	if len(changes) != 4 {
+		t.Fatalf("Expected four changes, got %v", changes)
+	}
+	expected := []struct {
+		folder, path, action, typ string
+	}{
+		{"other", "c", stats.DiskChangeModified, stats.DiskChangeDir},
+		{"default", "a", stats.DiskChangeDeleted, stats.DiskChangeFile},
+		{"default", "b", stats.DiskChangeModified, stats.DiskChangeFile},
+		{"default", "a", stats.DiskChangeModified, stats.DiskChangeFile},
+	}
+	for i, e := range expected {
+		c := changes[i]
+		if c.Folder != e.folder || c.Path != e.path || c.Action != e.action || c.Type != e.typ {
+			t.Errorf("Change %d: unexpected %+v", i, c)
+		}
+	}
+	if changes[1].Modifier != protocol.LocalDeviceID {
+		t.Errorf("Scanned change not attributed to the local device: %v", changes[1].Modifier)
+	}
+
+	if changes := m.DiskChanges("default", 2); len(changes) != 2 || changes[0].Action != stats.DiskChangeDeleted {
+		t.Errorf("Unexpected limited changes for folder: %+v", changes)
+	}
+
+	// The changes are kept in the database, up to the maximum.
+	log := stats.NewDiskChangeLog(db, 4)
+	log.Add([]stats.DiskChange{{Folder: "other", Path: "d"}})
+	changes = log.Changes("", 0)
+	if len(changes) != 4 || changes[0].Path != "d" || changes[3].Path != "b" {
+		t.Errorf("Unexpected changes after adding beyond the maximum: %+v", changes)
+	}
+
+	if err := log.Clear("other"); err != nil {
+		t.Fatal(err)
+	}
+	if changes := log.Changes("", 0); len(changes) != 2 || changes[0].Folder != "default" {
+		t.Errorf("Unexpected changes after clearing a folder: %+v", changes)
+	}
+	if err := log.Clear(""); err != nil {
+		t.Fatal(err)
+	}
+	if changes := log.Changes("", 0); len(changes) != 0 {
+		t.Errorf("Unexpected changes after clearing: %+v", changes)
+	}
+}
+
+func TestReceivedBytesStatistics(t *testing.T) {
+	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	fcfg := config.FolderConfiguration{ID: "default", Path: "testdata"}
+	cfg := config.Wrap("/tmp/test", config.Configuration{Folders: []config.FolderConfiguration{fcfg}})
+	m := NewModel(cfg, "device", "syncthing", "dev", db)
+	m.AddFolder(fcfg)
+
+	m.receivedBytes("default", device1, 100)
+	m.receivedBytes("default", device2, 50)
+	m.receivedBytes("default", device1, 100)
+	if recv := m.FolderStatistics()["default"].ReceivedBytes; len(recv) != 0 {
+		t.Errorf("Received bytes stored before finishing a file: %v", recv)
+	}
+
+	m.receivedFile("default", "file")
+	expected := map[string]int64{device1.String(): 200, device2.String(): 50}
+	if recv := m.FolderStatistics()["default"].ReceivedBytes; !reflect.DeepEqual(recv, expected) {
+		t.Errorf("Incorrect received bytes %v != %v", recv, expected)
+	}
+
+	// The counts are kept in the database, and keep adding up.
+	m = NewModel(cfg, "device", "syncthing", "dev", db)
+	m.AddFolder(fcfg)
+	m.receivedBytes("default", device2, 25)
+	m.receivedFile("default", "file")
+	expected[device2.String()] = 75
+	if recv := m.FolderStatistics()["default"].ReceivedBytes; !reflect.DeepEqual(recv, expected) {
+		t.Errorf("Incorrect received bytes after restart %v != %v", recv, expected)
+	}
+}
+
+func TestClockSkew(t *testing.T) {
+	cfg := config.Configuration{
+		Devices: []config.DeviceConfiguration{{DeviceID: device1}},
+	}
+	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	m := NewModel(config.Wrap("/tmp/test", cfg), "device", "syncthing", "dev", db)
+
+	fc := FakeConnection{id: device1}
+	m.AddConnection(fc, fc)
+
+	remote := time.Now().Add(-2 * time.Hour).Unix()
+	m.ClusterConfig(device1, protocol.ClusterConfigMessage{
+		Options: []protocol.Option{{Key: "time", Value: strconv.FormatInt(remote, 10)}},
+	})
+
+	skew := m.ConnectionStats()[device1.String()].ClockSkewS
+	if skew > -7199 || skew < -7201 {
+		t.Errorf("Unexpected clock skew %v, expected about -7200", skew)
+	}
+
+	m.Close(device1, errors.New("test"))
+	if _, ok := m.deviceSkew[device1]; ok {
+		t.Error("Clock skew should be forgotten on disconnect")
+	}
+
+	if _, ok := clockSkew("", time.Now()); ok {
+		t.Error("Missing time option should not produce a skew")
+	}
+	if _, ok := clockSkew("garbage", time.Now()); ok {
+		t.Error("Invalid time option should not produce a skew")
+	}
+}
+
+func TestConnectionClient(t *testing.T) {
+	cfg := config.Configuration{
+		Devices: []config.DeviceConfiguration{{DeviceID: device1}, {DeviceID: device2}},
+		Options: config.OptionsConfiguration{MinClientVersion: "v0.10.0"},
+	}
+	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	m := NewModel(config.Wrap("/tmp/test", cfg), "device", "syncthing", "dev", db)
+
+	for _, dev := range []protocol.DeviceID{device1, device2} {
+		fc := FakeConnection{id: dev}
+		m.AddConnection(fc, fc)
+	}
+	m.ClusterConfig(device1, protocol.ClusterConfigMessage{ClientName: "syncthing", ClientVersion: "v0.9.19"})
+	m.ClusterConfig(device2, protocol.ClusterConfigMessage{ClientName: "syncthing", ClientVersion: "v0.10.2"})
+
+	stats := m.ConnectionStats()
+	if ci := stats[device1.String()]; ci.ClientName != "syncthing" || ci.ClientVersion != "v0.9.19" || ci.ProtocolVersion != protocol.Version || !ci.OutdatedClient {
+		t.Errorf("Expected an outdated syncthing v0.9.19, not %+v", ci)
+	}
+	if ci := stats[device2.String()]; ci.OutdatedClient {
+		t.Errorf("Client v0.10.2 should not be outdated, %+v", ci)
+	}
+
+	for _, c := range []clientInfo{{"syncthing", "v0.10.0"}, {"other", "v0.1.0"}} {
+		if c.outdated("v0.10.0") {
+			t.Errorf("%v should not be outdated", c)
+		}
+	}
+	if (clientInfo{"syncthing", "v0.9.0"}).outdated("") {
+		t.Error("Nothing should be outdated without a minimum version")
+	}
+}
+
+func TestObserverDevice(t *testing.T) {
+	fcfg := config.FolderConfiguration{
+		ID:   "default",
+		Path: "testdata",
+		Devices: []config.FolderDeviceConfiguration{
+			{DeviceID: device1, Observer: true},
+			{DeviceID: device2},
+		},
+	}
+	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	m := NewModel(config.Wrap("/tmp/test", config.Configuration{Folders: []config.FolderConfiguration{fcfg}}), "device", "syncthing", "dev", db)
+	m.AddFolder(fcfg)
+
+	m.Index(device1, "default", []protocol.FileInfo{{Name: "observed", Version: 10}})
+	m.IndexUpdate(device1, "default", []protocol.FileInfo{{Name: "observed2", Version: 11}})
+	m.Index(device2, "default", []protocol.FileInfo{{Name: "shared", Version: 12}})
+
+	for _, name := range []string{"observed", "observed2"} {
+		if _, ok := m.CurrentGlobalFile("default", name); ok {
+			t.Errorf("File %q from observer should not be in the global version", name)
+		}
+	}
+	if _, ok := m.CurrentGlobalFile("default", "shared"); !ok {
+		t.Error("File from other device should be in the global version")
+	}
+	if n, _ := m.NeedSize("default"); n != 1 {
+		t.Errorf("Expected to need one file, not %d", n)
+	}
+}
+
+func TestObserverOverride(t *testing.T) {
+	fcfg := config.FolderConfiguration{
+		ID:   "default",
+		Path: "testdata",
+		Devices: []config.FolderDeviceConfiguration{
+			{DeviceID: device1, Observer: true, Override: true},
+			{DeviceID: device2},
+		},
+	}
+	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	m := NewModel(config.Wrap("/tmp/test", config.Configuration{Folders: []config.FolderConfiguration{fcfg}}), "device", "syncthing", "dev", db)
+	m.AddFolder(fcfg)
+
+	m.updateLocal("default", protocol.FileInfo{Name: "changed", Version: 5})
+	m.updateLocal("default", protocol.FileInfo{Name: "same", Version: 6})
+	m.Index(device2, "default", []protocol.FileInfo{{Name: "pulled", Version: 20}})
+	m.Index(device1, "default", []protocol.FileInfo{
+		{Name: "changed", Version: 10},
+		{Name: "same", Version: 6},
+		{Name: "created", Version: 11},
+		{Name: "pulled", Version: 21},
+	})
+
+	// Our version of the changed file wins, and the created file is
+	// announced as deleted.
+	if f, _ := m.CurrentFolderFile("default", "changed"); f.Version <= 10 || f.IsDeleted() {
+		t.Errorf("Changed file should be announced again in our version, not %v", f)
+	}
+	if f, ok := m.CurrentFolderFile("default", "created"); !ok || f.Version <= 11 || !f.IsDeleted() {
+		t.Errorf("Created file should be announced as deleted, not %v", f)
+	}
+	if f, _ := m.CurrentFolderFile("default", "same"); f.Version != 6 {
+		t.Errorf("Unchanged file should be left alone, not %v", f)
+	}
+
+	// A file still to be pulled from another device is not overridden.
+	if _, ok := m.CurrentFolderFile("default", "pulled"); ok {
+		t.Error("File still to be pulled should not be announced")
+	}
+	if n, _ := m.NeedSize("default"); n != 1 {
+		t.Errorf("Expected to need one file, not %d", n)
+	}
+}
+
+func TestReceiveOnlyFolder(t *testing.T) {
+	dir, err := ioutil.TempDir("", "receiveonly")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, "file"), []byte("changed locally"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	fcfg := config.FolderConfiguration{
+		ID:          "default",
+		Path:        dir,
+		ReceiveOnly: true,
+		Devices:     []config.FolderDeviceConfiguration{{DeviceID: device1}},
+	}
+	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	m := NewModel(config.Wrap("/tmp/test", config.Configuration{Folders: []config.FolderConfiguration{fcfg}}), "device", "syncthing", "dev", db)
+	m.AddFolder(fcfg)
+
+	global := protocol.FileInfo{Name: "file", Version: 1, Flags: 0644, Blocks: []protocol.BlockInfo{{Size: 8, Hash: []byte("remote")}}}
+	m.Index(device1, "default", []protocol.FileInfo{global})
+	m.ScanFolder("default")
+
+	cur, ok := m.CurrentFolderFile("default", "file")
+	if !ok || !cur.IsInvalid() {
+		t.Fatalf("Local change should be recorded as invalid, not %v", cur)
+	}
+	if gf, ok := m.CurrentGlobalFile("default", "file"); !ok || gf.Version != global.Version {
+		t.Errorf("Global version should be the remote one, not %v", gf)
+	}
+	if n, _ := m.NeedSize("default"); n != 1 {
+		t.Errorf("The remote version should be needed, to revert the local change")
+	}
+
+	if err := os.Remove(filepath.Join(dir, "file")); err != nil {
+		t.Fatal(err)
+	}
+	m.updateLocal("default", global)
+	m.ScanFolder("default")
+	if cur, _ := m.CurrentFolderFile("default", "file"); !cur.IsDeleted() || !cur.IsInvalid() {
+		t.Errorf("Local deletion should be recorded as invalid, not %v", cur)
+	}
+	if n, _ := m.NeedSize("default"); n != 1 {
+		t.Errorf("The remote version should be needed, to revert the local deletion")
+	}
+}
+
+func TestETA(t *testing.T) {
+	fcfg := config.FolderConfiguration{
+		ID:      "default",
+		Path:    "testdata",
+		Devices: []config.FolderDeviceConfiguration{{DeviceID: device1}},
+	}
+	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	m := NewModel(config.Wrap("/tmp/test", config.Configuration{Folders: []config.FolderConfiguration{fcfg}}), "device", "syncthing", "dev", db)
+	m.AddFolder(fcfg)
+
+	// Ten MiB in blocks of 128 KiB
+	blocks := make([]protocol.BlockInfo, 80)
+	for i := range blocks {
+		blocks[i].Size = protocol.BlockSize
+	}
+	m.Index(device1, "default", []protocol.FileInfo{{Name: "large", Version: 1, Blocks: blocks}})
+	if _, ok := m.ETA("default"); ok {
+		t.Error("Unexpected ETA before pulling anything")
+	}
+
+	m.receivedBytes("default", device1, 1<<20)
+	eta, ok := m.ETA("default")
+	if !ok {
+		t.Fatal("Expected an ETA while pulling")
+	}
+	if eta < 5*time.Second || eta > 10*time.Second {
+		t.Errorf("Unexpected ETA %v, expected at most ten seconds", eta)
+	}
+}
+
+func TestOpenFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "openfile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := os.Mkdir(filepath.Join(dir, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "sub", "file"), []byte("content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	m := NewModel(config.Wrap("/tmp/test", config.Configuration{}), "device", "syncthing", "dev", db)
+	m.AddFolder(config.FolderConfiguration{ID: "default", Path: dir})
+	m.ScanFolder("default")
+
+	fd, f, err := m.OpenFile("default", "sub/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bs, _ := ioutil.ReadAll(fd)
+	fd.Close()
+	if string(bs) != "content" || f.Name != filepath.Join("sub", "file") {
+		t.Errorf("Incorrect file %v with content %q", f, bs)
+	}
+
+	for _, tc := range []struct {
+		folder, name string
+		err          error
+	}{
+		{"default", "../file", ErrInvalidPath},
+		{"default", "sub/../../file", ErrInvalidPath},
+		{"default", "/etc/passwd", ErrInvalidPath},
+		{"default", "sub", ErrNoSuchFile},
+		{"default", "missing", ErrNoSuchFile},
+		{"missing", "sub/file", ErrNoSuchFile},
+	} {
+		if _, _, err := m.OpenFile(tc.folder, tc.name); err != tc.err {
+			t.Errorf("Opening %q in %q: got error %v, expected %v", tc.name, tc.folder, err, tc.err)
+		}
+	}
+}
+
+func TestDefaultIgnores(t *testing.T) {
+	dir, err := ioutil.TempDir("", "defaultignores")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, name := range []string{".DS_Store", "file"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte("data"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cfg := config.New(device1)
+	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	m := NewModel(config.Wrap("/tmp/test", cfg), "device", "syncthing", "dev", db)
+	m.AddFolder(config.FolderConfiguration{ID: "default", Path: dir})
+	m.AddFolder(config.FolderConfiguration{ID: "optout", Path: dir, DisableDefaultIgnores: true})
+	m.ScanFolder("default")
+	m.ScanFolder("optout")
+
+	if _, ok := m.CurrentFolderFile("default", ".DS_Store"); ok {
+		t.Error("Default ignored file was scanned")
+	}
+	if _, ok := m.CurrentFolderFile("default", "file"); !ok {
+		t.Error("Regular file was not scanned")
+	}
+	if _, ok := m.CurrentFolderFile("optout", ".DS_Store"); !ok {
+		t.Error("File should be scanned in folder without default ignores")
+	}
+}
+
+func TestFolderTuning(t *testing.T) {
+	fcfg := config.FolderConfiguration{
+		ID:      "default",
+		Path:    "testdata",
+		Copiers: 1,
+		Pullers: 16,
+		Devices: []config.FolderDeviceConfiguration{{DeviceID: device1}},
+	}
+	w := config.Wrap("/tmp/test", config.Configuration{Folders: []config.FolderConfiguration{fcfg}})
+	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	m := NewModel(w, "device", "syncthing", "dev", db)
+	m.AddFolder(fcfg)
+
+	// A puller that isn't running, so that the test doesn't pull anything.
+	p := &Puller{folder: "default", copiers: fcfg.Copiers, pullers: fcfg.Pullers}
+	m.fmut.Lock()
+	m.folderRunners["default"] = p
+	m.fmut.Unlock()
+
+	fcfg.Copiers, fcfg.Pullers, fcfg.Hashers = 4, 2, 3
+	w.SetFolder(fcfg)
+
+	for i := 0; ; i++ {
+		m.fmut.RLock()
+		hashers := m.folderCfgs["default"].Hashers
+		m.fmut.RUnlock()
+		if hashers == 3 {
+			break
+		}
+		if i == 100 {
+			t.Fatal("Folder was not tuned")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	p.concMut.Lock()
+	copiers, pullers := p.copiers, p.pullers
+	p.concMut.Unlock()
+	if copiers != 4 || pullers != 2 {
+		t.Errorf("Puller has %d copiers and %d pullers, expected 4 and 2", copiers, pullers)
+	}
+
+	p.setConcurrency(0, 0)
+	p.concMut.Lock()
+	copiers, pullers = p.copiers, p.pullers
+	p.concMut.Unlock()
+	if copiers != config.DefaultCopiers || pullers != config.DefaultPullers {
+		t.Errorf("Puller has %d copiers and %d pullers, expected the defaults", copiers, pullers)
+	}
+
+	p.setConcurrency(-1, -2)
+	p.concMut.Lock()
+	copiers, pullers = p.copiers, p.pullers
+	p.concMut.Unlock()
+	if copiers != 1 || pullers != 1 {
+		t.Errorf("Puller has %d copiers and %d pullers, expected 1 and 1", copiers, pullers)
+	}
+}
+
+func TestObserveAddress(t *testing.T) {
+	cfg := config.Configuration{
+		Devices: []config.DeviceConfiguration{{DeviceID: device1}},
+	}
+	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	m := NewModel(config.Wrap("/tmp/test", cfg), "device", "syncthing", "dev", db)
+
+	sub := events.Default.Subscribe(events.DeviceAddressChanged)
+	defer events.Default.Unsubscribe(sub)
+	expect := func(address, previous, source string) {
+		ev, err := sub.Poll(time.Second)
+		if err != nil {
+			t.Fatalf("No event for %s: %v", address, err)
+		}
+		data := ev.Data.(map[string]string)
+		if data["device"] != device1.String() || data["address"] != address || data["previous"] != previous || data["source"] != source {
+			t.Errorf("Unexpected event data %v", data)
+		}
+	}
+
+	m.ObserveAddress(device1, "192.0.2.1:22000", AddressStatic)
+	expect("192.0.2.1:22000", "", AddressStatic)
+
+	// Only the port differs, which is not a change.
+	m.ObserveAddress(device1, "192.0.2.1:51234", AddressIncoming)
+	if _, err := sub.Poll(50 * time.Millisecond); err != events.ErrTimeout {
+		t.Errorf("Unexpected event or error %v for a changed port", err)
+	}
+
+	m.ObserveAddress(device1, "198.51.100.7:22000", AddressDiscovery)
+	expect("198.51.100.7:22000", "192.0.2.1:51234", AddressDiscovery)
+
+	fc := FakeConnection{id: device1}
+	m.AddConnection(fc, fc)
+	if ci := m.ConnectionStats()[device1.String()]; ci.AddressSource != AddressDiscovery || ci.PreviousAddress != "192.0.2.1:51234" {
+		t.Errorf("Unexpected connection info %+v", ci)
+	}
+}
+
+func TestSelectedDirs(t *testing.T) {
+	fcfg := config.FolderConfiguration{
+		ID:           "default",
+		Path:         "testdata",
+		SelectedDirs: []string{"d3"},
+		Devices:      []config.FolderDeviceConfiguration{{DeviceID: device1}},
+	}
+	w := config.Wrap("/tmp/test", config.Configuration{Folders: []config.FolderConfiguration{fcfg}})
+	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	m := NewModel(w, "device", "syncthing", "dev", db)
+	m.AddFolder(fcfg)
+
+	files := genFiles(10)
+	for i := range files {
+		files[i].Name = filepath.Join(fmt.Sprintf("d%d", i), "file")
+	}
+	m.Index(device1, "default", files)
+
+	if n, _ := m.NeedSize("default"); n != 1 {
+		t.Errorf("Need %d files; expected only the selected one", n)
+	}
+	if _, _, rest, total := m.NeedFolderFiles("default", 1, 100); total != 1 || rest[0].Name != files[3].Name {
+		t.Errorf("Unexpected needed files %v", rest)
+	}
+	if c := m.Completion(protocol.LocalDeviceID, "default"); c != 0 {
+		t.Errorf("Unexpected completion %v of the selection", c)
+	}
+
+	// Expanding the selection takes effect without a restart.
+	fcfg.SelectedDirs = []string{"d3", "d4"}
+	w.SetFolder(fcfg)
+	for i := 0; ; i++ {
+		if n, _ := m.NeedSize("default"); n == 2 {
+			break
+		}
+		if i == 100 {
+			t.Fatal("Selection was not expanded")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestFlushIndex(t *testing.T) {
+	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	m := NewModel(config.Wrap("/tmp/test", config.Configuration{}), "device", "syncthing", "dev", db)
+	m.AddFolder(config.FolderConfiguration{ID: "default", Path: "testdata"})
+
+	if err := m.FlushIndex(); err != nil || m.flushPending {
+		t.Fatalf("Unexpected flush result %v, pending %v", err, m.flushPending)
+	}
+
+	m.updateLocal("default", protocol.FileInfo{Name: "foo", Version: 1})
+	if err := m.FlushIndex(); err != nil || m.flushPending {
+		t.Fatalf("Unexpected flush result %v, pending %v", err, m.flushPending)
+	}
+	if f, ok := m.CurrentFolderFile("default", "foo"); !ok || f.Version != 1 {
+		t.Errorf("Unexpected file after flush %v, %v", f, ok)
+	}
+}
+
+func TestSetIgnoresWithoutScan(t *testing.T) {
+	dir, err := ioutil.TempDir("", "setignores")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, name := range []string{"a", "b"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte("data"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	m := NewModel(config.Wrap("/tmp/test", config.Configuration{}), "device", "syncthing", "dev", db)
+	m.AddFolder(config.FolderConfiguration{ID: "default", Path: dir})
+	m.ScanFolder("default")
+	b, _ := m.CurrentFolderFile("default", "b")
+
+	// A change a scan would pick up, to tell whether there was one.
+	if err := ioutil.WriteFile(filepath.Join(dir, "b"), []byte("changed"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	future := time.Now().Add(time.Hour)
+	os.Chtimes(filepath.Join(dir, "b"), future, future)
+
+	if err := m.SetIgnores("default", []string{"a"}); err != nil {
+		t.Fatal(err)
+	}
+	if f, _ := m.CurrentFolderFile("default", "a"); !f.IsInvalid() {
+		t.Error("Newly ignored file was not invalidated")
+	}
+	if f, _ := m.CurrentFolderFile("default", "b"); f.Version != b.Version {
+		t.Error("Folder was rescanned after only adding a pattern")
+	}
+
+	// Removing the pattern needs a scan to take the file back.
+	if err := m.SetIgnores("default", nil); err != nil {
+		t.Fatal(err)
+	}
+	if f, _ := m.CurrentFolderFile("default", "a"); f.IsInvalid() {
+		t.Error("Unignored file is still invalid")
+	}
+	if f, _ := m.CurrentFolderFile("default", "b"); f.Version == b.Version {
+		t.Error("Folder was not rescanned after removing a pattern")
+	}
+}
+
+func TestMinConnectedDevices(t *testing.T) {
+	fcfg := config.FolderConfiguration{
+		ID:                  "default",
+		Path:                "testdata",
+		Devices:             []config.FolderDeviceConfiguration{{DeviceID: device1}, {DeviceID: device2}},
+		MinConnectedDevices: 2,
+	}
+	cfg := config.Configuration{
+		Folders: []config.FolderConfiguration{fcfg},
+		Devices: []config.DeviceConfiguration{{DeviceID: device1}, {DeviceID: device2}},
+	}
+	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	m := NewModel(config.Wrap("/tmp/test", cfg), "device", "syncthing", "dev", db)
+	m.AddFolder(fcfg)
+
+	var waiting bool
+	fc1 := FakeConnection{id: device1}
+	m.AddConnection(fc1, fc1)
+	if !m.checkConnected("default", &waiting) {
+		t.Error("Folder should wait for the second device")
+	}
+	if state, _ := m.State("default"); state != "waiting for devices" {
+		t.Errorf("Unexpected state %q", state)
+	}
+
+	fc2 := FakeConnection{id: device2}
+	m.AddConnection(fc2, fc2)
+	if m.checkConnected("default", &waiting) {
+		t.Error("Folder should not wait with both devices connected")
+	}
+	if state, _ := m.State("default"); state != "idle" {
+		t.Errorf("Unexpected state %q", state)
+	}
+
+	m.Close(device2, errors.New("test"))
+	if !m.checkConnected("default", &waiting) {
+		t.Error("Folder should wait again after a disconnect")
+	}
+}
+
+func TestPowerPaused(t *testing.T) {
+	cfg := config.Wrap("/tmp/test", config.Configuration{
+		Devices: []config.DeviceConfiguration{{DeviceID: device1}, {DeviceID: device2}},
+		Folders: []config.FolderConfiguration{{ID: "default", Path: "testdata"}},
+	})
+	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	m := NewModel(cfg, "device", "syncthing", "dev", db)
+	m.AddFolder(cfg.Folders()["default"])
+
+	cfg.SetDevicePause(device2, true, nil)
+
+	m.SetPowerPaused(true)
+	if !m.DevicePaused(device1) || !m.folderPaused("default") {
+		t.Error("device and folder should be paused on battery")
+	}
+	if devices, folders := m.Paused(); len(devices) != 1 || len(folders) != 0 {
+		t.Errorf("pausing on battery should not be configured, got %v, %v", devices, folders)
+	}
+
+	// A device paused by itself stays paused.
+	m.SetPowerPaused(false)
+	if m.DevicePaused(device1) || m.folderPaused("default") {
+		t.Error("device and folder should have been resumed")
+	}
+	if !m.DevicePaused(device2) {
+		t.Error("paused device should still be paused")
+	}
+}
+
+func TestRemovableDrive(t *testing.T) {
+	dir, err := ioutil.TempDir("", "syncthing-drive-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	mounted := true
+	defer func(fn func(string) (bool, error)) { isMountpoint = fn }(isMountpoint)
+	isMountpoint = func(path string) (bool, error) {
+		if _, err := os.Stat(path); err != nil {
+			return false, err
+		}
+		return mounted, nil
+	}
+
+	fcfg := config.FolderConfiguration{
+		ID:             "default",
+		Path:           dir,
+		Devices:        []config.FolderDeviceConfiguration{{DeviceID: device1}},
+		RemovableDrive: true,
+	}
+	if err := fcfg.CreateMarker(); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "file"), []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg := config.Configuration{
+		Folders: []config.FolderConfiguration{fcfg},
+		Devices: []config.DeviceConfiguration{{DeviceID: device1}},
+	}
+	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	m := NewModel(config.Wrap("/tmp/test", cfg), "device", "syncthing", "dev", db)
+	m.AddFolder(fcfg)
+
+	var missing bool
+	if m.checkDrive("default", &missing) {
+		t.Error("Drive taken as missing with the marker present")
+	}
+	if err := m.ScanFolder("default"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The drive is unplugged, leaving the empty mount point.
+	os.Remove(filepath.Join(dir, "file"))
+	os.Remove(filepath.Join(dir, ".stfolder"))
+
+	if !m.checkDrive("default", &missing) {
+		t.Error("Drive not taken as missing without the marker")
+	}
+	if state, _ := m.State("default"); state != "waiting for drive" {
+		t.Errorf("Unexpected state %q", state)
+	}
+	if err := m.ScanFolder("default"); err != errDriveMissing {
+		t.Errorf("Unexpected scan error %v", err)
+	}
+	if f, ok := m.CurrentFolderFile("default", "file"); !ok || f.IsDeleted() {
+		t.Error("File on the missing drive taken as deleted")
+	}
+
+	if err := fcfg.CreateMarker(); err != nil {
+		t.Fatal(err)
+	}
+	if m.checkDrive("default", &missing) {
+		t.Error("Drive taken as missing after it is back")
+	}
+	if state, _ := m.State("default"); state != "idle" {
+		t.Errorf("Unexpected state %q", state)
+	}
+
+	// A marker left behind on the mount point doesn't make up for the
+	// drive, nor does the path when the mount point is gone.
+	mounted = false
+	if !m.checkDrive("default", &missing) {
+		t.Error("Drive not taken as missing when not mounted")
+	}
+	mounted = true
+	os.RemoveAll(dir)
+	if !m.checkDrive("default", &missing) {
+		t.Error("Drive not taken as missing without its path")
+	}
+}
+
+type fakeService struct {
+	started chan struct{}
+}
+
+func (s fakeService) Serve()                   { s.started <- struct{}{} }
+func (fakeService) Stop()                      {}
+func (fakeService) Jobs() ([]string, []string) { return nil, nil }
+func (fakeService) BringToFront(string)        {}
+
+func TestServeRunnerBatches(t *testing.T) {
+	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	m := NewModel(config.Wrap("/tmp/test", config.Configuration{}), "device", "syncthing", "dev", db)
+
+	s := fakeService{make(chan struct{}, runnerBatchSize+1)}
+	for i := 0; i < runnerBatchSize+1; i++ {
+		m.serveRunner("default", s)
+	}
+
+	// The first batch starts at once, the rest a while later.
+	timeout := time.After(runnerBatchInterval / 2)
+	for i := 0; i < runnerBatchSize; i++ {
+		select {
+		case <-s.started:
+		case <-timeout:
+			t.Fatalf("Only %d runners of the first batch started", i)
+		}
+	}
+	select {
+	case <-s.started:
+		t.Fatal("Runner of the next batch started with the first")
+	case <-timeout:
+	}
+	select {
+	case <-s.started:
+	case <-time.After(runnerBatchInterval):
+		t.Fatal("Runner of the next batch not started")
+	}
+}
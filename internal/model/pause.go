@@ -0,0 +1,291 @@
+// Copyright (C) 2014 The Syncthing Authors.
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for
+// more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package model
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/syncthing/syncthing/internal/config"
+	"github.com/syncthing/syncthing/internal/protocol"
+)
+
+// errDriveMissing is returned by scans of a folder on a removable drive that
+// is missing.
+var errDriveMissing = errors.New("folder drive is missing")
+
+// PauseInfo describes a paused device or folder. Until is nil when it is
+// paused until resumed by hand.
+type PauseInfo struct {
+	Until *time.Time
+}
+
+// PauseDevice pauses the device until the given time, or until resumed if
+// until is zero. A paused device is disconnected, and not connected to or
+// accepted connections from.
+func (m *Model) PauseDevice(device protocol.DeviceID, until time.Time) error {
+	if _, ok := m.cfg.Devices()[device]; !ok {
+		return errors.New("no such device")
+	}
+
+	l.Infof("Pausing device %s%s", device, untilString(until))
+	m.cfg.SetDevicePause(device, true, timePtr(until))
+	m.schedulePause("device:"+device.String(), until, func() {
+		m.ResumeDevice(device)
+	})
+
+	m.DropConnection(device)
+
+	return m.cfg.Save()
+}
+
+// ResumeDevice resumes a paused device.
+func (m *Model) ResumeDevice(device protocol.DeviceID) error {
+	if _, ok := m.cfg.Devices()[device]; !ok {
+		return errors.New("no such device")
+	}
+
+	l.Infof("Resuming device %s", device)
+	m.cfg.SetDevicePause(device, false, nil)
+	m.schedulePause("device:"+device.String(), time.Time{}, nil)
+	return m.cfg.Save()
+}
+
+// DevicePaused returns whether the device is paused, by itself or while on
+// battery.
+func (m *Model) DevicePaused(device protocol.DeviceID) bool {
+	return m.cfg.Devices()[device].Paused || m.PowerPaused()
+}
+
+// PauseFolder pauses the folder until the given time, or until resumed if
+// until is zero. A paused folder is neither scanned nor pulled.
+func (m *Model) PauseFolder(folder string, until time.Time) error {
+	if _, ok := m.cfg.Folders()[folder]; !ok {
+		return errors.New("no such folder")
+	}
+
+	l.Infof("Pausing folder %q%s", folder, untilString(until))
+	m.cfg.SetFolderPause(folder, true, timePtr(until))
+	m.schedulePause("folder:"+folder, until, func() {
+		m.ResumeFolder(folder)
+	})
+	return m.cfg.Save()
+}
+
+// ResumeFolder resumes a paused folder.
+func (m *Model) ResumeFolder(folder string) error {
+	if _, ok := m.cfg.Folders()[folder]; !ok {
+		return errors.New("no such folder")
+	}
+
+	l.Infof("Resuming folder %q", folder)
+	m.cfg.SetFolderPause(folder, false, nil)
+	m.schedulePause("folder:"+folder, time.Time{}, nil)
+	return m.cfg.Save()
+}
+
+// folderPaused returns whether the folder is paused, by itself or while on
+// battery.
+func (m *Model) folderPaused(folder string) bool {
+	return m.cfg.Folders()[folder].Paused || m.PowerPaused()
+}
+
+// SetPowerPaused pauses or resumes all devices and folders, as while
+// running on battery. Unlike pausing them one by one this isn't saved in the
+// configuration, and devices and folders paused by themselves stay paused
+// when resumed.
+func (m *Model) SetPowerPaused(paused bool) {
+	m.powerMut.Lock()
+	m.powerPaused = paused
+	m.powerMut.Unlock()
+
+	if paused {
+		for _, device := range m.ConnectedDevices() {
+			m.DropConnection(device)
+		}
+	}
+}
+
+// PowerPaused returns whether all devices and folders are paused by
+// SetPowerPaused.
+func (m *Model) PowerPaused() bool {
+	m.powerMut.RLock()
+	defer m.powerMut.RUnlock()
+	return m.powerPaused
+}
+
+// checkPaused returns whether the folder is paused or frozen, setting the
+// folder state when it changes compared to wasPaused. It is called by the
+// folder runners.
+func (m *Model) checkPaused(folder string, wasPaused *bool) bool {
+	frozen := m.folderFrozen(folder)
+	paused := m.folderPaused(folder) || frozen
+	if paused != *wasPaused {
+		if frozen {
+			m.setState(folder, FolderFrozen)
+		} else if paused {
+			m.setState(folder, FolderPaused)
+		} else {
+			m.setState(folder, FolderIdle)
+		}
+		*wasPaused = paused
+	}
+	return paused
+}
+
+// checkConnected returns whether fewer of the devices sharing the folder are
+// connected than it requires to be pulled, setting the folder state while
+// it is, and when it no longer is compared to wasWaiting. It is called by
+// the puller.
+func (m *Model) checkConnected(folder string, wasWaiting *bool) bool {
+	waiting := m.connectedDevices(folder) < m.cfg.Folders()[folder].MinConnectedDevices
+	if waiting {
+		// Set every time, as scanning in between changes the state too.
+		m.setState(folder, FolderWaiting)
+	} else if *wasWaiting {
+		m.setState(folder, FolderIdle)
+	}
+	*wasWaiting = waiting
+	return waiting
+}
+
+// checkDrive returns whether the folder is on a removable drive that is
+// missing, setting the folder state while it is, and when it no longer is
+// compared to wasMissing. It is called by the folder runners.
+func (m *Model) checkDrive(folder string, wasMissing *bool) bool {
+	m.fmut.RLock()
+	cfg, ok := m.folderCfgs[folder]
+	m.fmut.RUnlock()
+
+	missing := ok && driveMissing(cfg)
+	if missing {
+		if !*wasMissing {
+			l.Infof("Folder %q: the drive is missing (%s is not a mounted folder with a folder marker); waiting for it", folder, cfg.Path)
+		}
+		// Set every time, as the state may have been changed in between.
+		m.setState(folder, FolderWaitingDrive)
+	} else if *wasMissing {
+		l.Infof("Folder %q: the drive is back; resuming", folder)
+		m.setState(folder, FolderIdle)
+	}
+	*wasMissing = missing
+	return missing
+}
+
+// driveMissing returns whether the folder is on a removable drive that isn't
+// attached: its path doesn't exist, isn't a mountpoint, or has no folder
+// marker.
+func driveMissing(cfg config.FolderConfiguration) bool {
+	if !cfg.RemovableDrive {
+		return false
+	}
+	if mounted, err := isMountpoint(cfg.Path); err != nil || !mounted {
+		return true
+	}
+	return !cfg.HasMarker()
+}
+
+// connectedDevices returns the number of devices sharing the folder that are
+// connected.
+func (m *Model) connectedDevices(folder string) int {
+	m.fmut.RLock()
+	devices := m.folderDevices[folder]
+	m.fmut.RUnlock()
+
+	m.pmut.RLock()
+	defer m.pmut.RUnlock()
+	n := 0
+	for _, deviceID := range devices {
+		if _, ok := m.protoConn[deviceID]; ok {
+			n++
+		}
+	}
+	return n
+}
+
+// Paused returns the paused devices and folders.
+func (m *Model) Paused() (devices map[string]PauseInfo, folders map[string]PauseInfo) {
+	devices = make(map[string]PauseInfo)
+	for id, dev := range m.cfg.Devices() {
+		if dev.Paused {
+			devices[id.String()] = PauseInfo{Until: dev.PausedUntil}
+		}
+	}
+	folders = make(map[string]PauseInfo)
+	for id, fld := range m.cfg.Folders() {
+		if fld.Paused {
+			folders[id] = PauseInfo{Until: fld.PausedUntil}
+		}
+	}
+	return
+}
+
+// resumePaused arms the timers resuming the devices and folders that were
+// paused for a limited time, resuming those whose time has already passed.
+func (m *Model) resumePaused() {
+	for id, dev := range m.cfg.Devices() {
+		if dev.Paused && dev.PausedUntil != nil {
+			id := id
+			m.schedulePause("device:"+id.String(), *dev.PausedUntil, func() {
+				m.ResumeDevice(id)
+			})
+		}
+	}
+	for id, fld := range m.cfg.Folders() {
+		if fld.Paused && fld.PausedUntil != nil {
+			id := id
+			m.schedulePause("folder:"+id, *fld.PausedUntil, func() {
+				m.ResumeFolder(id)
+			})
+		}
+	}
+}
+
+// schedulePause replaces the resume timer for the given key with one calling
+// resume at until, or removes it if until is zero.
+func (m *Model) schedulePause(key string, until time.Time, resume func()) {
+	m.pauseMut.Lock()
+	defer m.pauseMut.Unlock()
+
+	if t, ok := m.pauseTimers[key]; ok {
+		t.Stop()
+		delete(m.pauseTimers, key)
+	}
+	if until.IsZero() {
+		return
+	}
+
+	d := until.Sub(time.Now())
+	if d < 0 {
+		d = 0
+	}
+	m.pauseTimers[key] = time.AfterFunc(d, resume)
+}
+
+func timePtr(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+func untilString(until time.Time) string {
+	if until.IsZero() {
+		return ""
+	}
+	return fmt.Sprintf(" until %s", until.Format(time.RFC3339))
+}
@@ -0,0 +1,162 @@
+// Copyright (C) 2014 The Syncthing Authors.
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for
+// more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package model
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/syncthing/syncthing/internal/config"
+	"github.com/syncthing/syncthing/internal/osutil"
+	"github.com/syncthing/syncthing/internal/protocol"
+	"github.com/syncthing/syncthing/internal/stats"
+)
+
+// AddPendingDevice records that the unknown device tried to connect from the
+// given address, so that it can be accepted or dismissed later.
+func (m *Model) AddPendingDevice(device protocol.DeviceID, address string) {
+	m.pending.AddDevice(device, address)
+}
+
+// PendingDevices returns the devices that have tried to connect without
+// being configured. Devices that have since been configured or ignored are
+// forgotten.
+func (m *Model) PendingDevices() []stats.PendingDevice {
+	devices := m.cfg.Devices()
+	var res []stats.PendingDevice
+	for _, d := range m.pending.Devices() {
+		if _, ok := devices[d.DeviceID]; ok || m.cfg.IgnoredDevice(d.DeviceID) {
+			m.pending.RemoveDevice(d.DeviceID)
+			continue
+		}
+		res = append(res, d)
+	}
+	return res
+}
+
+// PendingFolders returns the folders offered by configured devices that we
+// don't share with them. Folders that have since been shared, or that were
+// offered by devices no longer configured, are forgotten.
+func (m *Model) PendingFolders() []stats.PendingFolder {
+	devices := m.cfg.Devices()
+	folders := m.cfg.Folders()
+	var res []stats.PendingFolder
+	for _, f := range m.pending.Folders() {
+		fcfg := folders[f.Folder]
+		if _, ok := devices[f.DeviceID]; !ok || sharedWith(fcfg.DeviceIDs(), f.DeviceID) {
+			m.pending.RemoveFolder(f.Folder, f.DeviceID)
+			continue
+		}
+		res = append(res, f)
+	}
+	return res
+}
+
+// A DeviceFolder is a folder offered to us by a device, and whether we
+// share it with the device.
+type DeviceFolder struct {
+	stats.OfferedFolder
+	Accepted bool
+}
+
+// DeviceFolders returns the folders the device shared with us in the last
+// cluster config it sent, including those we haven't accepted.
+func (m *Model) DeviceFolders(device protocol.DeviceID) []DeviceFolder {
+	folders := m.cfg.Folders()
+	var res []DeviceFolder
+	for _, f := range m.offered.Folders(device) {
+		fcfg, ok := folders[f.Folder]
+		res = append(res, DeviceFolder{
+			OfferedFolder: f,
+			Accepted:      ok && sharedWith(fcfg.DeviceIDs(), device),
+		})
+	}
+	return res
+}
+
+// DismissPendingDevice forgets about the pending device, until it tries to
+// connect again.
+func (m *Model) DismissPendingDevice(device protocol.DeviceID) error {
+	return m.pending.RemoveDevice(device)
+}
+
+// DismissPendingFolder forgets about the folder offered by the device, until
+// it is offered again.
+func (m *Model) DismissPendingFolder(folder string, device protocol.DeviceID) error {
+	return m.pending.RemoveFolder(folder, device)
+}
+
+func sharedWith(devices []protocol.DeviceID, device protocol.DeviceID) bool {
+	for _, d := range devices {
+		if d == device {
+			return true
+		}
+	}
+	return false
+}
+
+// autoAcceptFolder adds the folder offered by the device and shares it back,
+// for a device trusted to have its folders accepted without asking. The
+// folder is created in the configured path, named by its ID. It is not
+// accepted if a folder with the same ID or a file at the same path already
+// exists, or if the path can't be written to.
+func (m *Model) autoAcceptFolder(folder string, device protocol.DeviceID) bool {
+	if _, ok := m.cfg.Folders()[folder]; ok {
+		l.Infof("Not accepting folder %q from device %s automatically; a folder with that ID already exists", folder, device)
+		return false
+	}
+	if folder == "" || folder == "." || folder == ".." || strings.ContainsAny(folder, `/\:`) {
+		l.Infof("Not accepting folder %q from device %s automatically; the ID is not a valid directory name", folder, device)
+		return false
+	}
+
+	base, err := osutil.ExpandTilde(m.cfg.Options().AutoAcceptFolderPath)
+	if err != nil {
+		l.Infof("Not accepting folder %q from device %s automatically: %v", folder, device, err)
+		return false
+	}
+	path := filepath.Join(base, folder)
+	if _, err := os.Lstat(path); err == nil {
+		l.Infof("Not accepting folder %q from device %s automatically; %s already exists", folder, device, path)
+		return false
+	}
+
+	fcfg := config.FolderConfiguration{
+		ID:              folder,
+		Path:            path,
+		RescanIntervalS: 60,
+		Copiers:         config.DefaultCopiers,
+		Pullers:         config.DefaultPullers,
+		Devices:         []config.FolderDeviceConfiguration{{DeviceID: device}},
+	}
+	// Creating the folder marker makes sure that we can write to the path.
+	if err := os.MkdirAll(path, 0700); err != nil {
+		l.Infof("Not accepting folder %q from device %s automatically: %v", folder, device, err)
+		return false
+	}
+	if err := fcfg.CreateMarker(); err != nil {
+		os.Remove(path)
+		l.Infof("Not accepting folder %q from device %s automatically: %v", folder, device, err)
+		return false
+	}
+
+	l.Infof("Accepted folder %q from device %s automatically, at %s", folder, device, path)
+	m.cfg.SetFolder(fcfg)
+	m.AddFolder(fcfg)
+	m.StartFolderRW(folder)
+	return true
+}
@@ -0,0 +1,60 @@
+// Copyright (C) 2014 The Syncthing Authors.
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for
+// more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package model
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/syncthing/syncthing/internal/events"
+	"github.com/syncthing/syncthing/internal/protocol"
+)
+
+// Pinned files are listed in the .stpin file in the root of the folder, in
+// the same format as .stignore. The local copy of a pinned file is never
+// replaced, deleted or versioned by the puller. Pinned files that we don't
+// have are pulled as usual.
+
+// GetPins returns the lines of the .stpin file of the folder and the
+// patterns in effect.
+func (m *Model) GetPins(folder string) ([]string, []string, error) {
+	return m.getPatterns(folder, ".stpin", m.folderPins)
+}
+
+// SetPins replaces the .stpin file of the folder.
+func (m *Model) SetPins(folder string, content []string) error {
+	return m.setPatterns(folder, ".stpin", content)
+}
+
+// invalidateLocal records the local copy of a file as invalid, without
+// changing its version. It's kept out of the global version of the folder
+// for as long as it differs from the file on the other devices.
+func (m *Model) invalidateLocal(folder string, f protocol.FileInfo) {
+	f.Flags |= protocol.FlagInvalid
+	f.LocalVersion = 0
+
+	m.fmut.RLock()
+	m.folderFiles[folder].Update(protocol.LocalDeviceID, []protocol.FileInfo{f})
+	m.fmut.RUnlock()
+
+	events.Default.Log(events.LocalIndexUpdated, map[string]interface{}{
+		"folder":   folder,
+		"name":     f.Name,
+		"modified": time.Unix(f.Modified, 0),
+		"flags":    fmt.Sprintf("0%o", f.Flags),
+		"size":     f.Size(),
+	})
+}
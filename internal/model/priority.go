@@ -0,0 +1,76 @@
+// Copyright (C) 2014 The Syncthing Authors.
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for
+// more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package model
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/syncthing/syncthing/internal/config"
+	"github.com/syncthing/syncthing/internal/fnmatch"
+)
+
+type filePriority struct {
+	exps     []*regexp.Regexp
+	priority int
+}
+
+// filePriorities decides the pull priority of files from an ordered list of
+// patterns. The first pattern matching a file gives its priority.
+type filePriorities []filePriority
+
+// newFilePriorities compiles the configured priority patterns. A pattern
+// starting with "/" matches from the folder root only, others match at any
+// depth, as in ignore files. Invalid patterns are logged and skipped.
+func newFilePriorities(folder string, cfgs []config.FolderPriority) filePriorities {
+	var prios filePriorities
+	for _, cfg := range cfgs {
+		var pats []string
+		if strings.HasPrefix(cfg.Pattern, "/") {
+			pats = []string{cfg.Pattern[1:]}
+		} else {
+			pats = []string{cfg.Pattern, "**/" + cfg.Pattern}
+		}
+
+		prio := filePriority{priority: cfg.Priority}
+		for _, pat := range pats {
+			exp, err := fnmatch.Convert(pat, fnmatch.FNM_PATHNAME)
+			if err != nil {
+				l.Warnf("Folder %q: invalid priority pattern %q: %v", folder, cfg.Pattern, err)
+				prio.exps = nil
+				break
+			}
+			prio.exps = append(prio.exps, exp)
+		}
+		if prio.exps != nil {
+			prios = append(prios, prio)
+		}
+	}
+	return prios
+}
+
+// Priority returns the priority of the named file, or zero if no pattern
+// matches it.
+func (p filePriorities) Priority(name string) int {
+	for _, prio := range p {
+		for _, exp := range prio.exps {
+			if exp.MatchString(name) {
+				return prio.priority
+			}
+		}
+	}
+	return 0
+}
@@ -18,6 +18,7 @@ package model
 import (
 	"path/filepath"
 	"reflect"
+	"sort"
 	"sync"
 	"time"
 
@@ -25,6 +26,15 @@ import (
 	"github.com/syncthing/syncthing/internal/events"
 )
 
+// A Transfer is a file currently being pulled.
+type Transfer struct {
+	Folder         string
+	Name           string
+	BytesDone      int64
+	BytesTotal     int64
+	BytesPerSecond float64 // averaged over the last minute
+}
+
 type ProgressEmitter struct {
 	registry map[string]*sharedPullerState
 	interval time.Duration
@@ -101,6 +111,15 @@ func (t *ProgressEmitter) Changed(cfg config.Configuration) error {
 	return nil
 }
 
+// Implements the config.ChangeHandler interface. Only the options are of
+// interest.
+func (t *ProgressEmitter) ConfigChanged(cfg config.Configuration, changes config.Changes) error {
+	if !changes.Options {
+		return nil
+	}
+	return t.Changed(cfg)
+}
+
 // Stops the emitter.
 func (t *ProgressEmitter) Stop() {
 	t.stop <- struct{}{}
@@ -145,3 +164,52 @@ func (t *ProgressEmitter) BytesCompleted(folder string) (bytes int64) {
 	}
 	return
 }
+
+// FileBytesCompleted returns the number of bytes completed for the given
+// file, if it is being pulled.
+func (t *ProgressEmitter) FileBytesCompleted(folder, file string) (int64, bool) {
+	t.mut.Lock()
+	defer t.mut.Unlock()
+
+	s, ok := t.registry[filepath.Join(folder, file)]
+	if !ok {
+		return 0, false
+	}
+	return s.Progress().BytesDone, true
+}
+
+// Transfers returns the files currently being pulled, in the given folder
+// or in all folders if folder is empty, ordered by folder and name.
+func (t *ProgressEmitter) Transfers(folder string) []Transfer {
+	t.mut.Lock()
+	defer t.mut.Unlock()
+
+	now := time.Now()
+	transfers := make([]Transfer, 0, len(t.registry))
+	for _, s := range t.registry {
+		if folder != "" && s.folder != folder {
+			continue
+		}
+		progress := s.Progress()
+		transfers = append(transfers, Transfer{
+			Folder:         s.folder,
+			Name:           s.file.Name,
+			BytesDone:      progress.BytesDone,
+			BytesTotal:     progress.BytesTotal,
+			BytesPerSecond: s.rate.rate(now),
+		})
+	}
+	sort.Sort(transferList(transfers))
+	return transfers
+}
+
+type transferList []Transfer
+
+func (l transferList) Len() int      { return len(l) }
+func (l transferList) Swap(a, b int) { l[a], l[b] = l[b], l[a] }
+func (l transferList) Less(a, b int) bool {
+	if l[a].Folder != l[b].Folder {
+		return l[a].Folder < l[b].Folder
+	}
+	return l[a].Name < l[b].Name
+}
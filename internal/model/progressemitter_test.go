@@ -21,6 +21,8 @@ import (
 
 	"github.com/syncthing/syncthing/internal/config"
 	"github.com/syncthing/syncthing/internal/events"
+	"github.com/syncthing/syncthing/internal/files"
+	"github.com/syncthing/syncthing/internal/protocol"
 )
 
 var timeout = 10 * time.Millisecond
@@ -91,3 +93,38 @@ func TestProgressEmitter(t *testing.T) {
 	expectTimeout(w, t)
 
 }
+
+func TestTransfers(t *testing.T) {
+	p := NewProgressEmitter(config.Wrap("/tmp/test", config.Configuration{}))
+
+	if transfers := p.Transfers(""); len(transfers) != 0 {
+		t.Fatalf("Unexpected transfers %v", transfers)
+	}
+
+	a := &sharedPullerState{folder: "default", file: protocol.FileInfo{Name: "b"}, copyTotal: 2, copyNeeded: 2}
+	b := &sharedPullerState{folder: "default", file: protocol.FileInfo{Name: "a"}, copyTotal: 1, copyNeeded: 1}
+	c := &sharedPullerState{folder: "other", file: protocol.FileInfo{Name: "c"}, copyTotal: 1, copyNeeded: 1}
+	p.Register(a)
+	p.Register(b)
+	p.Register(c)
+	a.copyDone()
+
+	transfers := p.Transfers("default")
+	if len(transfers) != 2 || transfers[0].Name != "a" || transfers[1].Name != "b" {
+		t.Fatalf("Unexpected transfers %v", transfers)
+	}
+	if tr := transfers[1]; tr.BytesDone >= tr.BytesTotal || tr.BytesTotal != files.BlocksToSize(2) || tr.BytesPerSecond <= 0 {
+		t.Errorf("Unexpected progress %+v", tr)
+	}
+	if tr := transfers[0]; tr.BytesPerSecond != 0 {
+		t.Errorf("Unexpected rate %+v without any blocks done", tr)
+	}
+	if transfers := p.Transfers(""); len(transfers) != 3 {
+		t.Errorf("Unexpected transfers %v", transfers)
+	}
+
+	p.Deregister(a)
+	if transfers := p.Transfers("default"); len(transfers) != 1 {
+		t.Errorf("Unexpected transfers %v after deregistering", transfers)
+	}
+}
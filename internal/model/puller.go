@@ -16,25 +16,30 @@
 package model
 
 import (
+	"bytes"
+	"crypto/sha256"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
-	"math/rand"
 	"os"
 	"path/filepath"
+	"runtime"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/AudriusButkevicius/lfu-go"
 
 	"github.com/syncthing/syncthing/internal/config"
+	"github.com/syncthing/syncthing/internal/cron"
 	"github.com/syncthing/syncthing/internal/events"
 	"github.com/syncthing/syncthing/internal/files"
+	"github.com/syncthing/syncthing/internal/fs"
 	"github.com/syncthing/syncthing/internal/ignore"
 	"github.com/syncthing/syncthing/internal/osutil"
 	"github.com/syncthing/syncthing/internal/protocol"
 	"github.com/syncthing/syncthing/internal/scanner"
-	"github.com/syncthing/syncthing/internal/symlinks"
 	"github.com/syncthing/syncthing/internal/versioner"
 )
 
@@ -58,26 +63,73 @@ type pullBlockState struct {
 type copyBlocksState struct {
 	*sharedPullerState
 	blocks []protocol.BlockInfo
+	origin []protocol.BlockInfo // blocks of the current local version of the file
 }
 
 var (
-	activity    = newDeviceActivity()
-	errNoDevice = errors.New("no available source device")
+	activity        = newDeviceActivity()
+	errNoDevice     = errors.New("no available source device")
+	errQuarantined  = errors.New("all source devices served corrupt data for the file")
+	errTempMismatch = errors.New("finished temporary file does not match the expected blocks")
+
+	// Replaced in tests
+	syncDir      = osutil.SyncDir
+	canChown     = osutil.CanChown
+	isMountpoint = osutil.IsMountpoint
 )
 
 type Puller struct {
 	folder          string
 	dir             string
 	scanIntv        time.Duration
+	scanSchedule    *cron.Schedule
 	model           *Model
 	stop            chan struct{}
 	versioner       versioner.Versioner
 	ignorePerms     bool
 	lenientMtimes   bool
 	progressEmitter *ProgressEmitter
-	copiers         int
-	pullers         int
+	copiers         int // protected by concMut
+	pullers         int // protected by concMut
 	queue           *jobQueue
+	placeholderMode bool
+	priorities      filePriorities
+	syncXattrs      bool
+	xattrsOnce      sync.Once // logs that extended attributes are unsupported
+	syncOwnership   bool
+	ownershipOnce   sync.Once // logs that we can't change ownership
+	creationTime    bool      // set the creation time of files
+	creationOnce    sync.Once // logs that creation times are unsupported
+	attributes      bool      // set the file attributes of files
+	attributesOnce  sync.Once // logs that file attributes are unsupported
+	attrPermOnce    sync.Once // logs that we may not change file attributes
+	hardlinks       bool      // recreate hard linked files as hard links
+	absSymlinks     bool      // create symlinks with absolute targets
+	caseInsensitive bool      // names differing only in case are the same file
+	multiSource     bool      // select block sources by transfer rate
+	longPaths       bool      // dir is in a form not subject to path length limits
+	filesystem      fs.Filesystem
+	fsyncMode       string // one of the config.Fsync* constants
+	preallocate     string // one of the config.Preallocate* constants
+	tempDir         string // where temporary files are kept, if not next to the files
+	tempCopy        bool   // tempDir is on another filesystem, so files are copied into place
+	atomicReplace   bool   // the real file is never written, only replaced by a verified temporary file
+	verifyAssembled bool   // the temporary file is verified before it's renamed into place
+	conflictDir     string // conflict copies are written here, relative to the folder, instead of beside the files
+	dirMtimes       bool   // the modification times of directories are set once their contents have been pulled
+
+	protect map[string]bool // directories to set the attributes of once their contents have been pulled
+	protMut sync.Mutex      // protects the above
+
+	materialize map[string]struct{} // files requested to be pulled in full despite placeholderMode
+	matMut      sync.Mutex          // protects the above
+
+	caseCollisions map[string]string // file -> file it differs from only in case, to be pulled as a conflict copy
+	collMut        sync.Mutex        // protects the above
+
+	quarantine sourceQuarantine // devices no longer asked for files they served corrupt data for
+
+	concMut sync.Mutex
 }
 
 // Serve will run scans and pulls. It will return when Stop()ed or on a
@@ -88,8 +140,6 @@ func (p *Puller) Serve() {
 		defer l.Debugln(p, "exiting")
 	}
 
-	p.stop = make(chan struct{})
-
 	pullTimer := time.NewTimer(checkPullIntv)
 	scanTimer := time.NewTimer(time.Millisecond) // The first scan should be done immediately.
 
@@ -106,6 +156,12 @@ func (p *Puller) Serve() {
 	// We don't start pulling files until a scan has been completed.
 	initialScanCompleted := false
 
+	// Whether the folder was paused, or waiting for devices to connect, when
+	// last checked.
+	paused := false
+	waiting := false
+	missing := false
+
 loop:
 	for {
 		select {
@@ -118,6 +174,19 @@ loop:
 		// repeatable benchmark of how long it takes to sync a change from
 		// device A to device B, so we have something to work against.
 		case <-pullTimer.C:
+			if p.model.checkPaused(p.folder, &paused) {
+				pullTimer.Reset(checkPullIntv)
+				continue
+			}
+			if p.model.checkDrive(p.folder, &missing) {
+				pullTimer.Reset(checkPullIntv)
+				continue
+			}
+			if p.model.checkConnected(p.folder, &waiting) {
+				pullTimer.Reset(checkPullIntv)
+				continue
+			}
+
 			if !initialScanCompleted {
 				// How did we even get here?
 				if debug {
@@ -129,18 +198,40 @@ loop:
 
 			p.model.fmut.RLock()
 			curIgnores := p.model.folderIgnores[p.folder]
+			curPins := p.model.folderPins[p.folder]
+			curSelection := p.model.folderCfgs[p.folder].SelectedDirs
 			p.model.fmut.RUnlock()
 
-			if newHash := curIgnores.Hash(); newHash != prevIgnoreHash {
-				// The ignore patterns have changed. We need to re-evaluate if
-				// there are files we need now that were ignored before.
+			if newHash := curIgnores.Hash() + curPins.Hash() + strings.Join(curSelection, "\x00"); newHash != prevIgnoreHash {
+				// The ignore or pin patterns, or the selected directories,
+				// have changed. We need to re-evaluate if there are files
+				// we need now that were ignored, pinned or not selected
+				// before.
 				if debug {
-					l.Debugln(p, "ignore patterns have changed, resetting prevVer")
+					l.Debugln(p, "ignore patterns or selection have changed, resetting prevVer")
 				}
 				prevVer = 0
 				prevIgnoreHash = newHash
 			}
 
+			if p.materializePending() {
+				// Placeholders have been requested to be materialized. This
+				// doesn't change any versions, so we can't wait for that.
+				if debug {
+					l.Debugln(p, "materialization requested, resetting prevVer")
+				}
+				prevVer = 0
+			}
+
+			if p.queue.RetryRequested() {
+				// Failed files have been reset and should be attempted
+				// again, even though no versions have changed.
+				if debug {
+					l.Debugln(p, "retry requested, resetting prevVer")
+				}
+				prevVer = 0
+			}
+
 			// RemoteLocalVersion() is a fast call, doesn't touch the database.
 			curVer := p.model.RemoteLocalVersion(p.folder)
 			if curVer == prevVer {
@@ -154,6 +245,11 @@ loop:
 			if debug {
 				l.Debugln(p, "pulling", prevVer, curVer)
 			}
+			if err := p.model.startWork(p.folder); err != nil {
+				// Frozen since checked above.
+				pullTimer.Reset(checkPullIntv)
+				continue
+			}
 			p.model.setState(p.folder, FolderSyncing)
 			tries := 0
 			for {
@@ -164,10 +260,19 @@ loop:
 					l.Debugln(p, "changed", changed)
 				}
 
+				if p.model.folderFrozen(p.folder) {
+					// The iteration was cut short. What's left is pulled
+					// once the folder is unfrozen.
+					pullTimer.Reset(checkPullIntv)
+					break
+				}
+
 				if changed == 0 {
 					// No files were changed by the puller, so we are in
 					// sync. Remember the local version number and
 					// schedule a resync a little bit into the future.
+					p.model.resetIncoming(p.folder)
+					p.model.folderInSync(p.folder)
 
 					if lv := p.model.RemoteLocalVersion(p.folder); lv < curVer {
 						// There's a corner case where the device we needed
@@ -182,6 +287,12 @@ loop:
 						curVer = lv
 					}
 					prevVer = curVer
+					if p.queue.RetryPending() {
+						// There are failed files to retry once their
+						// backoff has expired, even if nothing else
+						// changes.
+						prevVer = 0
+					}
 					if debug {
 						l.Debugln(p, "next pull in", nextPullIntv)
 					}
@@ -203,28 +314,47 @@ loop:
 				}
 			}
 			p.model.setState(p.folder, FolderIdle)
+			p.model.endWork(p.folder)
 
 		// The reason for running the scanner from within the puller is that
 		// this is the easiest way to make sure we are not doing both at the
 		// same time.
 		case <-scanTimer.C:
+			if p.model.checkPaused(p.folder, &paused) {
+				scanTimer.Reset(checkPullIntv)
+				continue
+			}
+			if p.model.checkDrive(p.folder, &missing) {
+				scanTimer.Reset(checkPullIntv)
+				continue
+			}
+
 			if debug {
 				l.Debugln(p, "rescan")
 			}
 			p.model.setState(p.folder, FolderScanning)
-			if err := p.model.ScanFolder(p.folder); err != nil {
+			var yield func()
+			if initialScanCompleted {
+				yield = p.scanYielder(&prevVer)
+			}
+			if err := p.model.scanFolderSub(p.folder, "", yield); err == ErrFrozen || err == errDriveMissing {
+				// Frozen, or the drive went away, since checked above.
+				p.model.setState(p.folder, FolderIdle)
+				scanTimer.Reset(checkPullIntv)
+				continue
+			} else if err != nil {
 				p.model.cfg.InvalidateFolder(p.folder, err.Error())
 				break loop
 			}
 			p.model.setState(p.folder, FolderIdle)
-			if p.scanIntv > 0 {
-				// Sleep a random time between 3/4 and 5/4 of the configured interval.
-				sleepNanos := (p.scanIntv.Nanoseconds()*3 + rand.Int63n(2*p.scanIntv.Nanoseconds())) / 4
-				intv := time.Duration(sleepNanos) * time.Nanosecond
-
+			// Files that have been given up on get another chance after
+			// every full scan.
+			p.queue.ResetParked()
+			if intv := nextScanDelay(p.scanIntv, p.scanSchedule); intv > 0 {
 				if debug {
 					l.Debugln(p, "next rescan in", intv)
 				}
+				p.model.setNextScan(p.folder, time.Now().Add(intv))
 				scanTimer.Reset(intv)
 			}
 			if !initialScanCompleted {
@@ -239,6 +369,28 @@ func (p *Puller) Stop() {
 	close(p.stop)
 }
 
+// setConcurrency changes the number of copier and puller routines used from
+// the next puller iteration on. Zero means the default, as when the
+// configuration is loaded, and values below zero are raised to one.
+func (p *Puller) setConcurrency(copiers, pullers int) {
+	if copiers == 0 {
+		copiers = config.DefaultCopiers
+	} else if copiers < 0 {
+		l.Warnf("Folder %q: invalid copier count %d; using 1", p.folder, copiers)
+		copiers = 1
+	}
+	if pullers == 0 {
+		pullers = config.DefaultPullers
+	} else if pullers < 0 {
+		l.Warnf("Folder %q: invalid puller count %d; using 1", p.folder, pullers)
+		pullers = 1
+	}
+	p.concMut.Lock()
+	p.copiers = copiers
+	p.pullers = pullers
+	p.concMut.Unlock()
+}
+
 func (p *Puller) String() string {
 	return fmt.Sprintf("puller/%s@%p", p.folder, p)
 }
@@ -248,6 +400,8 @@ func (p *Puller) String() string {
 // might have failed). One puller iteration handles all files currently
 // flagged as needed in the folder.
 func (p *Puller) pullerIteration(ignores *ignore.Matcher) int {
+	p.model.folderProgressed(p.folder)
+
 	pullChan := make(chan pullBlockState)
 	copyChan := make(chan copyBlocksState)
 	finisherChan := make(chan *sharedPullerState)
@@ -256,11 +410,15 @@ func (p *Puller) pullerIteration(ignores *ignore.Matcher) int {
 	var pullWg sync.WaitGroup
 	var doneWg sync.WaitGroup
 
+	p.concMut.Lock()
+	copiers, pullers := p.copiers, p.pullers
+	p.concMut.Unlock()
+
 	if debug {
-		l.Debugln(p, "c", p.copiers, "p", p.pullers)
+		l.Debugln(p, "c", copiers, "p", pullers)
 	}
 
-	for i := 0; i < p.copiers; i++ {
+	for i := 0; i < copiers; i++ {
 		copyWg.Add(1)
 		go func() {
 			// copierRoutine finishes when copyChan is closed
@@ -269,7 +427,7 @@ func (p *Puller) pullerIteration(ignores *ignore.Matcher) int {
 		}()
 	}
 
-	for i := 0; i < p.pullers; i++ {
+	for i := 0; i < pullers; i++ {
 		pullWg.Add(1)
 		go func() {
 			// pullerRoutine finishes when pullChan is closed
@@ -287,6 +445,8 @@ func (p *Puller) pullerIteration(ignores *ignore.Matcher) int {
 
 	p.model.fmut.RLock()
 	folderFiles := p.model.folderFiles[p.folder]
+	pins := p.model.folderPins[p.folder]
+	folderCfg := p.model.folderCfgs[p.folder]
 	p.model.fmut.RUnlock()
 
 	// !!!
@@ -298,8 +458,29 @@ func (p *Puller) pullerIteration(ignores *ignore.Matcher) int {
 	changed := 0
 
 	var deletions []protocol.FileInfo
+	pulling := make(map[string]bool)
+	// Files about to be deleted, by the hash of their current blocks
+	renamable := make(map[string][]protocol.FileInfo)
+	renamed := make(map[string]bool)
+	// Needed files that aren't deleted, by their case folded names, and
+	// those differing only in case from another one, on case insensitive
+	// file systems
+	present := make(map[string]string)
+	collisions := make(map[string]string)
+	deleting := make(map[string]bool)
+	// Directories created or changed, or with changed contents, when
+	// syncing their modification times
+	touched := make(map[string]bool)
+	// Directories checked for files differing in case from needed ones
+	listings := make(dirListings)
+	// Files still to be pulled, whether or not they're retried this time
+	needed := make(map[string]bool)
 
 	folderFiles.WithNeed(protocol.LocalDeviceID, func(intf files.FileIntf) bool {
+		if p.model.folderFrozen(p.folder) {
+			// Nothing more is changed once the folder is frozen.
+			return false
+		}
 
 		// Needed items are delivered sorted lexicographically. This isn't
 		// really optimal from a performance point of view - it would be
@@ -310,8 +491,67 @@ func (p *Puller) pullerIteration(ignores *ignore.Matcher) int {
 
 		file := intf.(protocol.FileInfo)
 
-		if ignores.Match(file.Name) {
-			// This is an ignored file. Skip it, continue iteration.
+		if ignores.Match(file.Name) || p.inConflictDir(file.Name) {
+			// This is an ignored file, or a conflict copy, which is kept
+			// to the device that made it. Skip it, continue iteration.
+			return true
+		}
+
+		if !folderCfg.Selected(file.Name) {
+			// Outside the selected directories. Known, but not pulled.
+			return true
+		}
+
+		if pins != nil && pins.Match(file.Name) {
+			if cur, ok := p.model.CurrentFolderFile(p.folder, file.Name); ok && !cur.IsDeleted() {
+				// A pinned file that we have. Keep our copy, and keep it to
+				// ourselves.
+				if debug {
+					l.Debugln(p, "keeping pinned", file.Name)
+				}
+				if !cur.IsInvalid() {
+					p.model.invalidateLocal(p.folder, cur)
+				}
+				return true
+			}
+		}
+
+		needed[file.Name] = true
+
+		if !p.queue.Retryable(file.Name) {
+			// This file has failed recently and is backing off, or has
+			// failed too many times and waits for the next scan.
+			return true
+		}
+
+		if p.caseInsensitive && !file.IsDeleted() {
+			fold := strings.ToLower(file.Name)
+			if other, ok := present[fold]; ok && other != file.Name {
+				// Both would be the same file on disk, and would keep
+				// replacing each other. Files are kept as conflict
+				// copies; anything else is refused.
+				if file.IsDirectory() || file.IsSymlink() {
+					l.Infof("Puller (folder %q, file %q): name differs only in case from %q", p.folder, file.Name, other)
+					p.queue.Rejected(file.Name, &caseCollisionError{file.Name, other, ""})
+					return true
+				}
+				collisions[file.Name] = other
+			} else {
+				present[fold] = file.Name
+			}
+		}
+
+		if p.hardlinks && file.LinkGroup != "" && pulling[file.LinkGroup] {
+			// The file this one should be linked to is being pulled in
+			// this iteration. Leave this one for the next iteration, when
+			// it can be linked to it rather than copied.
+			return true
+		}
+
+		placeholder := p.needsPlaceholder(file)
+		if placeholder && p.hasPlaceholder(file) {
+			// We already have an up to date placeholder for this file, and
+			// there's nothing more to do until it's materialized.
 			return true
 		}
 
@@ -324,29 +564,78 @@ func (p *Puller) pullerIteration(ignores *ignore.Matcher) int {
 			l.Debugln(p, "handling", file.Name)
 		}
 
+		if !file.IsDeleted() {
+			if err := p.checkParent(file.Name); err != nil {
+				l.Infof("Puller (folder %q, file %q): parent directory: %v", p.folder, file.Name, err)
+				p.pullResult(file.Name, err)
+				return true
+			}
+		}
+
 		switch {
 		case file.IsDeleted():
 			// A deleted file, directory or symlink
 			deletions = append(deletions, file)
+			deleting[file.Name] = true
+			if cur, ok := p.model.CurrentFolderFile(p.folder, file.Name); ok && isRenamable(cur) {
+				key := blocksHash(cur.Blocks)
+				renamable[key] = append(renamable[key], cur)
+			}
 		case file.IsDirectory() && !file.IsSymlink():
 			// A new or changed directory
 			p.handleDir(file)
+		case placeholder:
+			// A new or changed file that we only keep a placeholder for
+			p.handlePlaceholder(file)
 		default:
 			// A new or changed file or symlink. This is the only case where we
 			// do stuff concurrently in the background
 			p.queue.Push(file.Name)
+			pulling[file.Name] = true
+		}
+
+		if p.dirMtimes {
+			touched[filepath.Dir(file.Name)] = true
+			if file.IsDirectory() {
+				touched[file.Name] = true
+			}
 		}
 
 		changed++
 		return true
 	})
 
+	if len(p.priorities) > 0 {
+		p.queue.SortByPriority(p.priorities.Priority)
+	}
+
 	for {
 		fileName, ok := p.queue.Pop()
 		if !ok {
 			break
 		}
+		if p.model.folderFrozen(p.folder) {
+			// Files already started are finished, the rest are left for
+			// the next iteration.
+			p.queue.Done(fileName)
+			continue
+		}
 		if f, ok := p.model.CurrentGlobalFile(p.folder, fileName); ok {
+			if source, ok := p.renameFile(f, renamable); ok {
+				renamed[source] = true
+				continue
+			}
+			if p.caseInsensitive {
+				// A file we have, or have just pulled, that differs only
+				// in case would be overwritten; unless it's about to be
+				// deleted, when this is a rename.
+				other, ok := collisions[fileName]
+				if !ok {
+					other = p.diskCaseCollision(fileName, listings)
+					ok = other != "" && !deleting[other]
+				}
+				p.setCaseCollision(fileName, other, ok)
+			}
 			p.handleFile(f, copyChan, finisherChan)
 		} else {
 			// File is no longer in the index. Mark it as done and drop it.
@@ -367,8 +656,29 @@ func (p *Puller) pullerIteration(ignores *ignore.Matcher) int {
 	// Wait for the finisherChan to finish.
 	doneWg.Wait()
 
+	if p.model.folderFrozen(p.folder) {
+		return changed
+	}
+
+	// The quarantine is kept for as long as the file is still needed.
+	p.quarantine.retain(needed)
+
 	for i := range deletions {
 		deletion := deletions[len(deletions)-i-1]
+		if renamed[deletion.Name] {
+			// Already handled, by being moved to a new file.
+			continue
+		}
+		if _, ok := present[strings.ToLower(deletion.Name)]; ok {
+			// The deleted file was renamed to a name differing only in
+			// case, which is the same file on disk. Removing it would
+			// remove the renamed file.
+			if debug {
+				l.Debugln(p, "not removing case renamed", deletion.Name)
+			}
+			p.model.updateLocal(p.folder, deletion)
+			continue
+		}
 		if deletion.IsDirectory() {
 			p.deleteDir(deletion)
 		} else {
@@ -376,9 +686,67 @@ func (p *Puller) pullerIteration(ignores *ignore.Matcher) int {
 		}
 	}
 
+	// Changing the contents of a directory changes its modification time,
+	// so it's set once they're done. The attributes come last, as an
+	// immutable directory can't have its modification time set either.
+	p.restoreDirMtimes(touched)
+	p.setDirAttributes()
+
 	return changed
 }
 
+// restoreDirMtimes sets the modification times of the directories to those
+// we have in the index.
+func (p *Puller) restoreDirMtimes(dirs map[string]bool) {
+	for dir := range dirs {
+		if dir == "." {
+			continue
+		}
+		cur, ok := p.model.CurrentFolderFile(p.folder, dir)
+		if !ok || !cur.IsDirectory() || cur.IsDeleted() || cur.IsInvalid() || cur.Modified == 0 {
+			continue
+		}
+		t := time.Unix(cur.Modified, 0)
+		if err := p.fs().Chtimes(filepath.Join(p.dir, dir), t, t); err != nil {
+			l.Infof("Puller (folder %q, dir %q): restoring modification time: %v", p.folder, dir, err)
+		}
+	}
+}
+
+// checkParent makes sure the directory containing the given item exists,
+// creating any missing parents with the permissions they have in the global
+// index. Directories are normally created before their contents, as needed
+// items are handled in lexicographic order, but a parent may have failed or
+// been removed since it was last scanned. It remains needed in that case,
+// and is completed when handled next.
+func (p *Puller) checkParent(name string) error {
+	parent := filepath.Dir(name)
+	if parent == "." {
+		return nil
+	}
+	realParent := filepath.Join(p.dir, parent)
+	if _, err := p.fs().Lstat(realParent); !os.IsNotExist(err) {
+		// Anything else than a directory is handled, or refused, by
+		// whoever tries to use it.
+		return nil
+	}
+	if err := p.checkParent(parent); err != nil {
+		return err
+	}
+
+	mode := os.FileMode(0755)
+	if f, ok := p.model.CurrentGlobalFile(p.folder, parent); ok && !p.ignorePerms && f.IsDirectory() && !f.IsDeleted() && f.HasPermissionBits() {
+		mode = os.FileMode(f.Flags & 0777)
+	}
+	if debug {
+		l.Debugf("%v creating missing parent %q (%v)", p, parent, mode)
+	}
+	mkdir := func(path string) error {
+		return p.fs().Mkdir(path, mode)
+	}
+	return osutil.InWritableDir(mkdir, realParent)
+}
+
 // handleDir creates or updates the given directory
 func (p *Puller) handleDir(file protocol.FileInfo) {
 	realName := filepath.Join(p.dir, file.Name)
@@ -392,15 +760,16 @@ func (p *Puller) handleDir(file protocol.FileInfo) {
 		l.Debugf("need dir\n\t%v\n\t%v", file, curFile)
 	}
 
-	info, err := os.Lstat(realName)
+	info, err := p.fs().Lstat(realName)
 	switch {
 	// There is already something under that name, but it's a file/link.
 	// Most likely a file/link is getting replaced with a directory.
 	// Remove the file/link and fall through to directory creation.
 	case err == nil && (!info.IsDir() || info.Mode()&os.ModeSymlink != 0):
-		err = osutil.InWritableDir(os.Remove, realName)
+		err = p.removeFile(realName)
 		if err != nil {
 			l.Infof("Puller (folder %q, dir %q): %v", p.folder, file.Name, err)
+			p.pullResult(file.Name, err)
 			return
 		}
 		fallthrough
@@ -411,19 +780,24 @@ func (p *Puller) handleDir(file protocol.FileInfo) {
 		// we can pass it to InWritableDir. We use a regular Mkdir and
 		// not MkdirAll because the parent should already exist.
 		mkdir := func(path string) error {
-			return os.Mkdir(path, mode)
+			return p.fs().Mkdir(path, mode)
 		}
 
+		p.unprotect(realName)
 		if err = osutil.InWritableDir(mkdir, realName); err == nil {
+			p.setMetadata(realName, &file)
+			p.protectLater(file.Name)
 			p.model.updateLocal(p.folder, file)
 		} else {
 			l.Infof("Puller (folder %q, dir %q): %v", p.folder, file.Name, err)
 		}
+		p.pullResult(file.Name, err)
 		return
 	// Weird error when stat()'ing the dir. Probably won't work to do
 	// anything else with it if we can't even stat() it.
 	case err != nil:
 		l.Infof("Puller (folder %q, dir %q): %v", p.folder, file.Name, err)
+		p.pullResult(file.Name, err)
 		return
 	}
 
@@ -431,29 +805,35 @@ func (p *Puller) handleDir(file protocol.FileInfo) {
 	// don't handle modification times on directories, because that sucks...)
 	// It's OK to change mode bits on stuff within non-writable directories.
 
-	if p.ignorePerms {
-		p.model.updateLocal(p.folder, file)
-	} else if err := os.Chmod(realName, mode); err == nil {
+	p.unprotect(realName)
+	p.setMetadata(realName, &file)
+	if !p.ignorePerms {
+		err = p.fs().Chmod(realName, mode)
+	}
+	p.protectLater(file.Name)
+	if err == nil {
 		p.model.updateLocal(p.folder, file)
 	} else {
 		l.Infof("Puller (folder %q, dir %q): %v", p.folder, file.Name, err)
 	}
+	p.pullResult(file.Name, err)
 }
 
 // deleteDir attempts to delete the given directory
 func (p *Puller) deleteDir(file protocol.FileInfo) {
 	realName := filepath.Join(p.dir, file.Name)
 	// Delete any temporary files lying around in the directory
-	dir, _ := os.Open(realName)
+	dir, _ := p.fs().Open(realName)
 	if dir != nil {
 		files, _ := dir.Readdirnames(-1)
 		for _, file := range files {
 			if defTempNamer.IsTemporary(file) {
-				osutil.InWritableDir(os.Remove, filepath.Join(realName, file))
+				osutil.InWritableDir(p.fs().Remove, filepath.Join(realName, file))
 			}
 		}
 	}
-	err := osutil.InWritableDir(os.Remove, realName)
+	p.unprotect(realName)
+	err := osutil.InWritableDir(p.fs().Remove, realName)
 	if err == nil || os.IsNotExist(err) {
 		p.model.updateLocal(p.folder, file)
 	} else {
@@ -465,26 +845,134 @@ func (p *Puller) deleteDir(file protocol.FileInfo) {
 func (p *Puller) deleteFile(file protocol.FileInfo) {
 	realName := filepath.Join(p.dir, file.Name)
 
+	err := p.removeFile(realName)
+	if err != nil && !os.IsNotExist(err) {
+		l.Infof("Puller (folder %q, file %q): delete: %v", p.folder, file.Name, err)
+	} else {
+		p.model.updateLocal(p.folder, file)
+	}
+}
+
+// removeFile removes the file or symlink at the given path on behalf of a
+// remote change. When versioning is enabled the current content is handed
+// to the versioner instead, so that every remote driven deletion can be
+// recovered. A file that is already gone is not an error.
+func (p *Puller) removeFile(realName string) error {
+	p.unprotect(realName)
 	var err error
 	if p.versioner != nil {
 		err = osutil.InWritableDir(p.versioner.Archive, realName)
 	} else {
-		err = osutil.InWritableDir(os.Remove, realName)
+		err = osutil.InWritableDir(p.fs().Remove, realName)
 	}
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
 
-	if err != nil && !os.IsNotExist(err) {
-		l.Infof("Puller (folder %q, file %q): delete: %v", p.folder, file.Name, err)
-	} else {
-		p.model.updateLocal(p.folder, file)
+// needsPlaceholder returns true if the given needed file should be created
+// as a placeholder instead of being pulled. In placeholder mode this is the
+// case for all files that we don't already have the real contents of, unless
+// they have been requested to be materialized.
+func (p *Puller) needsPlaceholder(file protocol.FileInfo) bool {
+	if !p.placeholderMode || file.IsDeleted() || file.IsDirectory() || file.IsSymlink() {
+		return false
+	}
+
+	p.matMut.Lock()
+	_, requested := p.materialize[file.Name]
+	p.matMut.Unlock()
+	if requested {
+		return false
+	}
+
+	curFile, ok := p.model.CurrentFolderFile(p.folder, file.Name)
+	return !ok || curFile.IsDeleted() || isPlaceholder(curFile)
+}
+
+// hasPlaceholder returns true if there is already a placeholder for the
+// given version of the file.
+func (p *Puller) hasPlaceholder(file protocol.FileInfo) bool {
+	curFile, ok := p.model.CurrentFolderFile(p.folder, file.Name)
+	return ok && isPlaceholder(curFile) && curFile.Version == file.Version
+}
+
+// handlePlaceholder creates or updates an empty placeholder for the given
+// file. The placeholder has the correct size, permissions and modification
+// time, but no contents. It is recorded as invalid in the index so that we
+// neither announce it as available nor mistake it for a local change.
+func (p *Puller) handlePlaceholder(file protocol.FileInfo) {
+	realName := filepath.Join(p.dir, file.Name)
+	mode := os.FileMode(file.Flags & 0777)
+	if p.ignorePerms {
+		mode = 0644
 	}
+
+	// If the target path is a symlink or a directory, we cannot create the
+	// placeholder over it, hence remove it before proceeding.
+	stat, err := p.fs().Lstat(realName)
+	if err == nil && (stat.IsDir() || stat.Mode()&os.ModeSymlink != 0) {
+		osutil.InWritableDir(p.fs().Remove, realName)
+	}
+
+	create := func(path string) error {
+		fd, err := p.fs().OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+		if err != nil {
+			return err
+		}
+		// Extending the file by truncation results in a sparse file on
+		// filesystems that support it, so the placeholder takes no space.
+		if err := fd.Truncate(file.Size()); err != nil {
+			fd.Close()
+			return err
+		}
+		return fd.Close()
+	}
+
+	if err := osutil.InWritableDir(create, realName); err != nil {
+		l.Infof("Puller (folder %q, file %q): placeholder: %v", p.folder, file.Name, err)
+		return
+	}
+
+	if !p.ignorePerms {
+		// The file may have existed already, with other permissions.
+		if err := p.fs().Chmod(realName, mode); err != nil {
+			l.Infof("Puller (folder %q, file %q): placeholder: %v", p.folder, file.Name, err)
+			return
+		}
+	}
+
+	t := time.Unix(file.Modified, 0)
+	if err := p.fs().Chtimes(realName, t, t); err != nil {
+		if p.lenientMtimes {
+			l.Infof("Puller (folder %q, file %q): placeholder: %v (continuing anyway as requested)", p.folder, file.Name, err)
+		} else {
+			l.Infof("Puller (folder %q, file %q): placeholder: %v", p.folder, file.Name, err)
+			return
+		}
+	}
+
+	// Keep the blocks, so that the placeholder can be materialized from
+	// them, and mark it, as other files invalid for local reasons keep
+	// theirs too.
+	file.Flags |= protocol.FlagInvalid | protocol.FlagPlaceholder
+	p.model.updateLocal(p.folder, file)
 }
 
 // handleFile queues the copies and pulls as necessary for a single new or
 // changed file.
 func (p *Puller) handleFile(file protocol.FileInfo, copyChan chan<- copyBlocksState, finisherChan chan<- *sharedPullerState) {
+	collision := p.caseCollision(file.Name)
+	if collision == "" && p.hardlinks && p.linkFile(file) {
+		return
+	}
+
 	curFile, ok := p.model.CurrentFolderFile(p.folder, file.Name)
 
-	if ok && len(curFile.Blocks) == len(file.Blocks) && scanner.BlocksEqual(curFile.Blocks, file.Blocks) {
+	// A placeholder has the right blocks in the index but not on disk, so
+	// it can never be shortcut.
+	if ok && collision == "" && !curFile.IsInvalid() && len(curFile.Blocks) == len(file.Blocks) && scanner.BlocksEqual(curFile.Blocks, file.Blocks) {
 		// We are supposed to copy the entire file, and then fetch nothing. We
 		// are only updating metadata, so we don't actually *need* to make the
 		// copy.
@@ -492,26 +980,45 @@ func (p *Puller) handleFile(file protocol.FileInfo, copyChan chan<- copyBlocksSt
 			l.Debugln(p, "taking shortcut on", file.Name)
 		}
 		p.queue.Done(file.Name)
+		var err error
 		if file.IsSymlink() {
-			p.shortcutSymlink(curFile, file)
+			err = p.shortcutSymlink(curFile, file)
 		} else {
-			p.shortcutFile(file)
+			err = p.shortcutFile(file)
 		}
+		p.pullResult(file.Name, err)
 		return
 	}
 
 	scanner.PopulateOffsets(file.Blocks)
 
 	// Figure out the absolute filenames we need once and for all
-	tempName := filepath.Join(p.dir, defTempNamer.TempName(file.Name))
+	tempName := p.tempName(file.Name)
 	realName := filepath.Join(p.dir, file.Name)
+	if collision != "" {
+		// The temporary files would be the same one, too.
+		name := p.conflictName(file.Name)
+		tempName = p.tempName(name)
+		realName = filepath.Join(p.dir, name)
+		if p.conflictDir != "" {
+			if err := p.fs().MkdirAll(filepath.Dir(realName), 0755); err != nil {
+				l.Infof("Puller (folder %q, file %q): conflict directory: %v", p.folder, file.Name, err)
+				p.queue.Done(file.Name)
+				p.pullResult(file.Name, err)
+				return
+			}
+		}
+	}
+	// The temporary file is created in the directory of the real one,
+	// unless kept elsewhere.
+	p.unprotectParent(tempName)
 
 	reused := 0
 	var blocks []protocol.BlockInfo
 
 	// Check for an old temporary file which might have some blocks we could
 	// reuse.
-	tempBlocks, err := scanner.HashFile(tempName, protocol.BlockSize)
+	tempBlocks, err := scanner.HashFile(p.fs(), tempName, protocol.BlockSize)
 	if err == nil {
 		// Check for any reusable blocks in the temp file
 		tempCopyBlocks, _ := scanner.BlockDiff(tempBlocks, file.Blocks)
@@ -537,47 +1044,205 @@ func (p *Puller) handleFile(file protocol.FileInfo, copyChan chan<- copyBlocksSt
 			// Otherwise, discard the file ourselves in order for the
 			// sharedpuller not to panic when it fails to exlusively create a
 			// file which already exists
-			os.Remove(tempName)
+			p.fs().Remove(tempName)
 		}
 	} else {
 		blocks = file.Blocks
 	}
 
+	// A new temporary file is created with the final size, reading as zeros
+	// where nothing has been written. All-zero blocks are left as such holes
+	// instead of being copied or pulled, keeping sparse files sparse.
+	sparse := 0
+	if reused == 0 {
+		needed := make([]protocol.BlockInfo, 0, len(blocks))
+		for _, block := range blocks {
+			if scanner.IsZeroBlock(block) {
+				sparse++
+			} else {
+				needed = append(needed, block)
+			}
+		}
+		blocks = needed
+	}
+
 	s := sharedPullerState{
-		file:       file,
-		folder:     p.folder,
-		tempName:   tempName,
-		realName:   realName,
-		copyTotal:  uint32(len(blocks)),
-		copyNeeded: uint32(len(blocks)),
-		reused:     uint32(reused),
+		file:          file,
+		folder:        p.folder,
+		tempName:      tempName,
+		realName:      realName,
+		caseCollision: collision,
+		filesystem:    p.fs(),
+		copyTotal:     uint32(len(blocks)),
+		copyNeeded:    uint32(len(blocks)),
+		reused:        uint32(reused),
+		sparse:        uint32(sparse),
+		fsync:         p.fsyncMode == config.FsyncAlways,
+		preallocate:   p.preallocate == config.PreallocateAlways || p.preallocate == config.PreallocateAuto && sparse == 0,
 	}
 
 	if debug {
-		l.Debugf("%v need file %s; copy %d, reused %v", p, file.Name, len(blocks), reused)
+		l.Debugf("%v need file %s; copy %d, reused %v, sparse %v", p, file.Name, len(blocks), reused, sparse)
 	}
 
 	cs := copyBlocksState{
 		sharedPullerState: &s,
 		blocks:            blocks,
 	}
+	if ok && !curFile.IsDeleted() && !curFile.IsInvalid() && !curFile.IsDirectory() && !curFile.IsSymlink() {
+		scanner.PopulateOffsets(curFile.Blocks)
+		cs.origin = curFile.Blocks
+	}
 	copyChan <- cs
 }
 
+// linkFile creates the file as a hard link to the file naming its link
+// group, when that has already been synced with the same contents, and
+// returns whether it did so. Otherwise the file is pulled as usual, which is
+// also what happens when hard links aren't supported.
+func (p *Puller) linkFile(file protocol.FileInfo) bool {
+	if file.LinkGroup == "" || file.LinkGroup == file.Name || file.IsSymlink() {
+		return false
+	}
+	target, ok := p.model.CurrentFolderFile(p.folder, file.LinkGroup)
+	if !ok || target.IsDeleted() || target.IsInvalid() || target.IsDirectory() || target.IsSymlink() ||
+		target.LinkGroup != file.LinkGroup || !scanner.BlocksEqual(target.Blocks, file.Blocks) {
+		return false
+	}
+
+	targetName := filepath.Join(p.dir, file.LinkGroup)
+	tempName := p.tempName(file.Name)
+	realName := filepath.Join(p.dir, file.Name)
+
+	// If we are linked already there is nothing to gain.
+	if targetInfo, err := p.fs().Lstat(targetName); err != nil {
+		return false
+	} else if info, err := p.fs().Lstat(realName); err == nil && os.SameFile(info, targetInfo) {
+		return false
+	}
+
+	p.fs().Remove(tempName)
+	if err := p.fs().Link(targetName, tempName); err != nil {
+		if debug {
+			l.Debugln(p, "link", file.Name, "to", file.LinkGroup, err)
+		}
+		return false
+	}
+
+	if debug {
+		l.Debugln(p, "linking", file.Name, "to", file.LinkGroup)
+	}
+	p.queue.Done(file.Name)
+	err := p.performFinish(&sharedPullerState{
+		file:     file,
+		folder:   p.folder,
+		tempName: tempName,
+		realName: realName,
+	})
+	if err != nil {
+		p.fs().Remove(tempName)
+	}
+	p.pullResult(file.Name, err)
+	return true
+}
+
+// renameFile moves a file that is about to be deleted into the place of
+// the new file, when it has the same blocks, and returns whether it did so.
+// This turns a remote rename into a local one instead of copying all the
+// blocks. The file moved is removed from renamable and its name returned.
+func (p *Puller) renameFile(file protocol.FileInfo, renamable map[string][]protocol.FileInfo) (string, bool) {
+	if !isRenamable(file) {
+		return "", false
+	}
+	if cur, ok := p.model.CurrentFolderFile(p.folder, file.Name); ok && !cur.IsDeleted() {
+		// We have a version of the file already, which is better updated
+		// in place.
+		return "", false
+	}
+
+	key := blocksHash(file.Blocks)
+	realName := filepath.Join(p.dir, file.Name)
+	if _, err := p.fs().Lstat(realName); !os.IsNotExist(err) {
+		return "", false
+	}
+
+	for i, source := range renamable[key] {
+		// The source must still be what we scanned, or we would be moving
+		// changes that haven't been scanned yet under the new name.
+		realSource := filepath.Join(p.dir, source.Name)
+		info, err := p.fs().Lstat(realSource)
+		if err != nil || !info.Mode().IsRegular() || info.Size() != source.Size() || info.ModTime().Unix() != source.Modified {
+			continue
+		}
+
+		p.unprotect(realSource)
+		p.unprotect(realName)
+		rename := func(path string) error {
+			return p.fs().Rename(realSource, path)
+		}
+		if err := osutil.InWritableDir(rename, realName); err != nil {
+			if debug {
+				l.Debugln(p, "rename", source.Name, "to", file.Name, err)
+			}
+			continue
+		}
+
+		if debug {
+			l.Debugln(p, "renaming", source.Name, "to", file.Name)
+		}
+		renamable[key] = append(renamable[key][:i], renamable[key][i+1:]...)
+
+		// The source is gone, so its deletion is done.
+		if deletion, ok := p.model.CurrentGlobalFile(p.folder, source.Name); ok && deletion.IsDeleted() {
+			p.model.updateLocal(p.folder, deletion)
+		}
+
+		p.queue.Done(file.Name)
+		err = p.shortcutFile(file)
+		if err == nil {
+			p.syncDirs(realName, realSource)
+		}
+		p.pullResult(file.Name, err)
+		return source.Name, true
+	}
+	return "", false
+}
+
+// syncDirs flushes the directories holding the given files to disk, when the
+// fsync mode asks for it. The files are in place by then, so a failure is
+// logged rather than returned; they are recorded all the same.
+func (p *Puller) syncDirs(names ...string) {
+	if p.fsyncMode != config.FsyncAlways && p.fsyncMode != config.FsyncMetadata {
+		return
+	}
+	synced := make(map[string]bool, len(names))
+	for _, name := range names {
+		dir := filepath.Dir(name)
+		if synced[dir] {
+			continue
+		}
+		synced[dir] = true
+		if err := syncDir(dir); err != nil {
+			l.Warnln("puller: final: syncing directory:", err)
+		}
+	}
+}
+
 // shortcutFile sets file mode and modification time, when that's the only
 // thing that has changed.
-func (p *Puller) shortcutFile(file protocol.FileInfo) {
+func (p *Puller) shortcutFile(file protocol.FileInfo) error {
 	realName := filepath.Join(p.dir, file.Name)
+	p.unprotect(realName)
 	if !p.ignorePerms {
-		err := os.Chmod(realName, os.FileMode(file.Flags&0777))
+		err := p.fs().Chmod(realName, os.FileMode(file.Flags&0777))
 		if err != nil {
 			l.Infof("Puller (folder %q, file %q): shortcut: %v", p.folder, file.Name, err)
-			return
+			return err
 		}
 	}
 
 	t := time.Unix(file.Modified, 0)
-	err := os.Chtimes(realName, t, t)
+	err := p.fs().Chtimes(realName, t, t)
 	if err != nil {
 		if p.lenientMtimes {
 			// We accept the failure with a warning here and allow the sync to
@@ -587,22 +1252,26 @@ func (p *Puller) shortcutFile(file protocol.FileInfo) {
 			l.Infof("Puller (folder %q, file %q): shortcut: %v (continuing anyway as requested)", p.folder, file.Name, err)
 		} else {
 			l.Infof("Puller (folder %q, file %q): shortcut: %v", p.folder, file.Name, err)
-			return
+			return err
 		}
 	}
 
+	p.setMetadata(realName, &file)
+	p.setAttributes(realName, file)
 	p.model.updateLocal(p.folder, file)
+	return nil
 }
 
 // shortcutSymlink changes the symlinks type if necessery.
-func (p *Puller) shortcutSymlink(curFile, file protocol.FileInfo) {
-	err := symlinks.ChangeType(filepath.Join(p.dir, file.Name), file.Flags)
+func (p *Puller) shortcutSymlink(curFile, file protocol.FileInfo) error {
+	err := p.fs().ChangeSymlinkType(filepath.Join(p.dir, file.Name), file.Flags)
 	if err != nil {
 		l.Infof("Puller (folder %q, file %q): symlink shortcut: %v", p.folder, file.Name, err)
-		return
+		return err
 	}
 
 	p.model.updateLocal(p.folder, file)
+	return nil
 }
 
 // copierRoutine reads copierStates until the in channel closes and performs
@@ -632,29 +1301,52 @@ func (p *Puller) copierRoutine(in <-chan copyBlocksState, pullChan chan<- pullBl
 
 		go func() {
 			for item := range evictionChan {
-				item.Value.(*os.File).Close()
+				item.Value.(fs.File).Close()
 			}
 		}()
 
+		// Blocks that are in the current version of the file are copied from
+		// there first, preferably from the same offset.
+		var origin fs.File
+		originOffsets := make(map[string]int64, len(state.origin))
+		for _, block := range state.origin {
+			if _, ok := originOffsets[string(block.Hash)]; !ok {
+				originOffsets[string(block.Hash)] = block.Offset
+			}
+		}
+		if len(originOffsets) > 0 {
+			origin, _ = p.fs().Open(state.realName)
+		}
+
 		folderRoots := make(map[string]string)
 		p.model.fmut.RLock()
 		for folder, cfg := range p.model.folderCfgs {
-			folderRoots[folder] = cfg.Path
+			folderRoots[folder] = cfg.FilesystemPath()
 		}
 		p.model.fmut.RUnlock()
 
 		for _, block := range state.blocks {
+			p.model.folderProgressed(p.folder)
 			buf = buf[:int(block.Size)]
+			if origin != nil && p.copyFromOrigin(origin, state, originOffsets, block, buf, dstFd) {
+				if state.failed() != nil {
+					break
+				}
+				state.copiedFromOrigin()
+				state.copyDone()
+				continue
+			}
+
 			found := p.model.finder.Iterate(block.Hash, func(folder, file string, index uint32) bool {
 				path := filepath.Join(folderRoots[folder], file)
 
-				var fd *os.File
+				var fd fs.File
 
 				fdi := fdCache.Get(path)
 				if fdi != nil {
-					fd = fdi.(*os.File)
+					fd = fdi.(fs.File)
 				} else {
-					fd, err = os.Open(path)
+					fd, err = p.fs().Open(path)
 					if err != nil {
 						return false
 					}
@@ -707,12 +1399,43 @@ func (p *Puller) copierRoutine(in <-chan copyBlocksState, pullChan chan<- pullBl
 				state.copyDone()
 			}
 		}
+		if origin != nil {
+			origin.Close()
+		}
 		fdCache.Evict(fdCache.Len())
 		close(evictionChan)
 		out <- state.sharedPullerState
 	}
 }
 
+// copyFromOrigin copies the block from the current version of the file to
+// the temporary file, if it's found at the same offset or elsewhere in it.
+// The data is verified against the expected hash before being written.
+func (p *Puller) copyFromOrigin(origin fs.File, state copyBlocksState, offsets map[string]int64, block protocol.BlockInfo, buf []byte, dst io.WriterAt) bool {
+	offset, ok := offsets[string(block.Hash)]
+	if idx := int(block.Offset / protocol.BlockSize); idx < len(state.origin) && bytes.Equal(state.origin[idx].Hash, block.Hash) {
+		offset, ok = state.origin[idx].Offset, true
+	}
+	if !ok {
+		return false
+	}
+
+	if _, err := origin.ReadAt(buf, offset); err != nil {
+		return false
+	}
+	if _, err := scanner.VerifyBuffer(buf, block); err != nil {
+		if debug {
+			l.Debugf("Origin block mismatch in %s:%s at %d", p.folder, state.file.Name, offset)
+		}
+		return false
+	}
+
+	if _, err := dst.WriteAt(buf, block.Offset); err != nil {
+		state.fail("dst write", err)
+	}
+	return true
+}
+
 func (p *Puller) pullerRoutine(in <-chan pullBlockState, out chan<- *sharedPullerState) {
 	for state := range in {
 		if state.failed() != nil {
@@ -728,15 +1451,23 @@ func (p *Puller) pullerRoutine(in <-chan pullBlockState, out chan<- *sharedPulle
 		}
 
 		var lastError error
-		potentialDevices := p.model.availability(p.folder, state.file.Name)
+		potentialDevices, quarantined := p.quarantine.filter(state.file, p.model.availability(p.folder, state.file.Name))
 		for {
-			// Select the least busy device to pull the block from. If we found no
-			// feasible device at all, fail the block (and in the long run, the
-			// file).
-			selected := activity.leastBusy(potentialDevices)
+			// Select the least busy device, or the one expected to be fastest
+			// when pulling from multiple sources, to pull the block from. If
+			// we found no feasible device at all, fail the block (and in the
+			// long run, the file).
+			var selected protocol.DeviceID
+			if p.multiSource {
+				selected = activity.fastest(potentialDevices)
+			} else {
+				selected = activity.leastBusy(potentialDevices)
+			}
 			if selected == (protocol.DeviceID{}) {
 				if lastError != nil {
 					state.fail("pull", lastError)
+				} else if quarantined > 0 {
+					state.fail("pull", errQuarantined)
 				} else {
 					state.fail("pull", errNoDevice)
 				}
@@ -747,19 +1478,42 @@ func (p *Puller) pullerRoutine(in <-chan pullBlockState, out chan<- *sharedPulle
 
 			// Fetch the block, while marking the selected device as in use so that
 			// leastBusy can select another device when someone else asks.
+			// A device that has gone away fails the request, and the block is
+			// requested from one of the others.
+			p.model.pullSched.acquire(p.folder)
 			activity.using(selected)
-			buf, lastError := p.model.requestGlobal(selected, p.folder, state.file.Name, state.block.Offset, int(state.block.Size), state.block.Hash)
+			t0 := time.Now()
+			var buf []byte
+			buf, lastError = p.model.requestGlobal(selected, p.folder, state.file.Name, state.block.Offset, int(state.block.Size), state.block.Hash)
 			activity.done(selected)
+			p.model.pullSched.release(p.folder)
+			if lastError == protocol.ErrTimeout {
+				// The device would have taken at least this long, which
+				// makes it less likely to be chosen again.
+				activity.transferred(selected, int(state.block.Size), time.Since(t0))
+			}
 			if lastError != nil {
 				continue
 			}
+			activity.transferred(selected, len(buf), time.Since(t0))
 
 			// Verify that the received block matches the desired hash, if not
-			// try pulling it from another device.
+			// try pulling it from another device. A device that keeps
+			// serving corrupt data isn't asked for the file again.
 			_, lastError = scanner.VerifyBuffer(buf, state.block)
 			if lastError != nil {
+				if p.quarantine.failed(state.file, selected) {
+					l.Warnf("Puller (folder %q, file %q): device %v served %d blocks failing verification; no longer pulling the file from it", p.folder, state.file.Name, selected, quarantineFailures)
+					events.Default.Log(events.SourceQuarantined, map[string]interface{}{
+						"folder": p.folder,
+						"file":   state.file.Name,
+						"device": selected.String(),
+					})
+				}
 				continue
 			}
+			p.quarantine.verified(state.file, selected)
+			p.model.receivedBytes(p.folder, selected, len(buf))
 
 			// Save the block data we got from the cluster
 			_, err = fd.WriteAt(buf, state.block.Offset)
@@ -767,6 +1521,7 @@ func (p *Puller) pullerRoutine(in <-chan pullBlockState, out chan<- *sharedPulle
 				state.fail("save", err)
 			} else {
 				state.pullDone()
+				p.model.folderProgressed(p.folder)
 			}
 			break
 		}
@@ -774,20 +1529,20 @@ func (p *Puller) pullerRoutine(in <-chan pullBlockState, out chan<- *sharedPulle
 	}
 }
 
-func (p *Puller) performFinish(state *sharedPullerState) {
+func (p *Puller) performFinish(state *sharedPullerState) error {
 	var err error
 	// Set the correct permission bits on the new file
 	if !p.ignorePerms {
-		err = os.Chmod(state.tempName, os.FileMode(state.file.Flags&0777))
+		err = p.fs().Chmod(state.tempName, os.FileMode(state.file.Flags&0777))
 		if err != nil {
 			l.Warnln("puller: final:", err)
-			return
+			return err
 		}
 	}
 
 	// Set the correct timestamp on the new file
 	t := time.Unix(state.file.Modified, 0)
-	err = os.Chtimes(state.tempName, t, t)
+	err = p.fs().Chtimes(state.tempName, t, t)
 	if err != nil {
 		if p.lenientMtimes {
 			// We accept the failure with a warning here and allow the sync to
@@ -797,10 +1552,41 @@ func (p *Puller) performFinish(state *sharedPullerState) {
 			l.Infof("Puller (folder %q, file %q): final: %v (continuing anyway as requested)", p.folder, state.file.Name, err)
 		} else {
 			l.Warnln("puller: final:", err)
-			return
+			return err
+		}
+	}
+
+	if !state.file.IsSymlink() {
+		p.setMetadata(state.tempName, &state.file)
+	}
+
+	// Check the complete file once more, as whatever is renamed into place
+	// is seen by the applications using it.
+	if (p.atomicReplace || p.verifyAssembled) && !state.file.IsSymlink() {
+		if err := p.verifyTemp(state); err != nil {
+			l.Infof("Puller (folder %q, file %q): final: %v", p.folder, state.file.Name, err)
+			p.fs().Remove(state.tempName)
+			return err
+		}
+	}
+
+	// Refuse symlinks pointing out of the folder before touching the
+	// existing file.
+	if state.file.IsSymlink() {
+		content, err := p.readFile(state.tempName)
+		if err != nil {
+			l.Warnln("puller: final: reading symlink:", err)
+			return err
+		}
+		if err := checkSymlinkTarget(state.file.Name, string(content), p.absSymlinks); err != nil {
+			l.Infof("Puller (folder %q, file %q): %v", p.folder, state.file.Name, err)
+			p.fs().Remove(state.tempName)
+			return err
 		}
 	}
 
+	p.unprotect(state.realName)
+
 	// If we should use versioning, let the versioner archive the old
 	// file before we replace it. Archiving a non-existent file is not
 	// an error.
@@ -808,61 +1594,454 @@ func (p *Puller) performFinish(state *sharedPullerState) {
 		err = p.versioner.Archive(state.realName)
 		if err != nil {
 			l.Warnln("puller: final:", err)
-			return
+			return err
 		}
 	}
 
 	// If the target path is a symlink or a directory, we cannot copy
 	// over it, hence remove it before proceeding.
-	stat, err := os.Lstat(state.realName)
+	stat, err := p.fs().Lstat(state.realName)
 	if err == nil && (stat.IsDir() || stat.Mode()&os.ModeSymlink != 0) {
-		osutil.InWritableDir(os.Remove, state.realName)
+		osutil.InWritableDir(p.fs().Remove, state.realName)
 	}
 	// Replace the original content with the new one
-	err = osutil.Rename(state.tempName, state.realName)
+	err = p.moveTemp(state)
 	if err != nil {
 		l.Warnln("puller: final:", err)
-		return
+		return err
+	}
+	if !state.file.IsSymlink() {
+		// Windows may hand the file the creation time of the one it
+		// replaced, so it's set again after the rename. The attributes are
+		// set last, as they may keep the file from being renamed.
+		p.setCreationTime(state.realName, &state.file)
+		p.setAttributes(state.realName, state.file)
 	}
 
 	// If it's a symlink, the target of the symlink is inside the file.
 	if state.file.IsSymlink() {
-		content, err := ioutil.ReadFile(state.realName)
+		content, err := p.readFile(state.realName)
 		if err != nil {
 			l.Warnln("puller: final: reading symlink:", err)
-			return
+			return err
 		}
 
 		// Remove the file, and replace it with a symlink.
 		err = osutil.InWritableDir(func(path string) error {
-			os.Remove(path)
-			return symlinks.Create(path, string(content), state.file.Flags)
+			p.fs().Remove(path)
+			return p.fs().CreateSymlink(path, string(content), state.file.Flags)
 		}, state.realName)
 		if err != nil {
 			l.Warnln("puller: final: creating symlink:", err)
-			return
+			return err
+		}
+	}
+
+	// Make the new directory entry durable before we claim to have the file
+	p.syncDirs(state.realName)
+
+	// A conflict copy is found by the next scan as a new file of its own,
+	// unless it's in the conflict directory. The file itself isn't there,
+	// and remains needed.
+	if state.caseCollision != "" {
+		err := &caseCollisionError{state.file.Name, state.caseCollision, filepath.Base(state.realName)}
+		if p.conflictDir != "" {
+			err.conflictName = p.conflictName(state.file.Name)
 		}
+		l.Infof("Puller (folder %q, file %q): %v", p.folder, state.file.Name, err)
+		return err
 	}
 
 	// Record the updated file in the index
 	p.model.updateLocal(p.folder, state.file)
+
+	// If the file was a placeholder it has now been materialized.
+	p.matMut.Lock()
+	delete(p.materialize, state.file.Name)
+	p.matMut.Unlock()
+	return nil
+}
+
+// setMetadata sets the optional attributes of file on path, when we are
+// syncing them. Failing to do so is logged but does not fail the file.
+func (p *Puller) setMetadata(path string, file *protocol.FileInfo) {
+	p.setXattrs(path, file)
+	p.setOwner(path, file)
+	p.setCreationTime(path, file)
+}
+
+func (p *Puller) setXattrs(path string, file *protocol.FileInfo) {
+	if !p.syncXattrs {
+		return
+	}
+
+	err := osutil.SetXattrs(path, file.Xattrs)
+	if err == osutil.ErrXattrsUnsupported {
+		p.xattrsOnce.Do(func() {
+			l.Infof("Puller (folder %q): extended attributes are not supported; not syncing them", p.folder)
+		})
+	} else if err != nil {
+		l.Infof("Puller (folder %q, file %q): setting extended attributes: %v", p.folder, file.Name, err)
+	}
+}
+
+// setOwner changes the owner of path to that of file. When we aren't
+// privileged to, the scanner doesn't look at the owner either and the
+// announced one is kept. When changing it fails, file is given the owner it
+// actually has, so the next scan doesn't see a change that we'd announce.
+func (p *Puller) setOwner(path string, file *protocol.FileInfo) {
+	if !p.syncOwnership || file.Owner == nil {
+		return
+	}
+
+	if !canChown() {
+		p.ownershipOnce.Do(func() {
+			l.Infof("Puller (folder %q): not privileged to change file ownership; not syncing it", p.folder)
+		})
+		return
+	}
+
+	err := p.fs().Lchown(path, int(file.Owner.UID), int(file.Owner.GID))
+	if err != nil {
+		l.Infof("Puller (folder %q, file %q): setting ownership: %v", p.folder, file.Name, err)
+		if info, err := p.fs().Lstat(path); err == nil {
+			file.Owner, _ = osutil.FileOwner(info)
+		}
+	}
+}
+
+func (p *Puller) setCreationTime(path string, file *protocol.FileInfo) {
+	if !p.creationTime || file.Created == 0 {
+		return
+	}
+
+	err := osutil.SetCreationTime(path, file.Created)
+	if err == osutil.ErrCreationTimeUnsupported {
+		p.creationOnce.Do(func() {
+			l.Infof("Puller (folder %q): creation times are not supported; not syncing them", p.folder)
+		})
+	} else if err != nil {
+		l.Infof("Puller (folder %q, file %q): setting creation time: %v", p.folder, file.Name, err)
+	}
+}
+
+// setAttributes sets the file attributes of file on path, when we are
+// syncing them. Those the operating system doesn't keep are ignored. It's
+// called after any other change to the file, as the read only and immutable
+// attributes keep it from being changed.
+func (p *Puller) setAttributes(path string, file protocol.FileInfo) {
+	if !p.attributes {
+		return
+	}
+
+	err := osutil.SetFileAttributes(path, file.Attributes)
+	if err == osutil.ErrAttributesUnsupported {
+		p.attributesOnce.Do(func() {
+			l.Infof("Puller (folder %q): file attributes are not supported; not syncing them", p.folder)
+		})
+	} else if err != nil {
+		p.attributesFailed(path, err)
+	}
+}
+
+// attributesFailed logs the failure to change the attributes of path. Not
+// being permitted to is logged only once, as it's the same for every file
+// with the attribute; on Linux, changing the immutable attribute takes the
+// CAP_LINUX_IMMUTABLE capability.
+func (p *Puller) attributesFailed(path string, err error) {
+	if os.IsPermission(err) {
+		p.attrPermOnce.Do(func() {
+			l.Infof("Puller (folder %q): not permitted to change file attributes: %v", p.folder, err)
+		})
+		return
+	}
+	l.Infof("Puller (folder %q): setting attributes of %q: %v", p.folder, path, err)
+}
+
+// unprotect clears the read only and immutable attributes of the existing
+// file or directory on path, when we are syncing attributes, so that it can
+// be replaced, changed or removed. A synced file has them only if they were
+// set on the other devices, where they have been cleared for the change.
+// As they keep entries from being added to or removed from a directory, the
+// parent directory's are cleared as well, and set again at the end of the
+// iteration.
+func (p *Puller) unprotect(path string) {
+	if !p.attributes {
+		return
+	}
+
+	p.unprotectParent(path)
+	p.clearProtection(path)
+}
+
+// unprotectParent clears the read only and immutable attributes of the
+// directory containing path, if it's in the folder, until the end of the
+// iteration.
+func (p *Puller) unprotectParent(path string) {
+	if !p.attributes {
+		return
+	}
+
+	parent := filepath.Dir(path)
+	if parent == p.dir {
+		return
+	}
+	if rel, err := filepath.Rel(p.dir, parent); err == nil && !strings.HasPrefix(rel, "..") && p.clearProtection(parent) {
+		p.protectLater(rel)
+	}
+}
+
+// clearProtection clears the read only and immutable attributes of path,
+// returning whether it had any. Only files and directories are looked at,
+// never what a symlink points to, which may be outside the folder.
+func (p *Puller) clearProtection(path string) bool {
+	if info, err := p.fs().Lstat(path); err != nil || !info.Mode().IsRegular() && !info.IsDir() {
+		return false
+	}
+	attrs, err := osutil.FileAttributes(path)
+	if err != nil || attrs&(protocol.AttrReadOnly|protocol.AttrImmutable) == 0 {
+		return false
+	}
+	if err := osutil.SetFileAttributes(path, attrs&^(protocol.AttrReadOnly|protocol.AttrImmutable)); err != nil {
+		p.attributesFailed(path, err)
+	}
+	return true
+}
+
+// protectLater records the directory to have its attributes set by
+// setDirAttributes.
+func (p *Puller) protectLater(dir string) {
+	if !p.attributes {
+		return
+	}
+
+	p.protMut.Lock()
+	if p.protect == nil {
+		p.protect = make(map[string]bool)
+	}
+	p.protect[dir] = true
+	p.protMut.Unlock()
+}
+
+// setDirAttributes sets the attributes of the directories created, changed
+// or unprotected during the iteration to those we have in the index. It's
+// done once their contents have been pulled, as the read only and immutable
+// attributes keep entries from being added to or removed from a directory.
+func (p *Puller) setDirAttributes() {
+	p.protMut.Lock()
+	dirs := p.protect
+	p.protect = nil
+	p.protMut.Unlock()
+
+	for dir := range dirs {
+		cur, ok := p.model.CurrentFolderFile(p.folder, dir)
+		if !ok || !cur.IsDirectory() || cur.IsDeleted() || cur.IsInvalid() {
+			continue
+		}
+		p.setAttributes(filepath.Join(p.dir, dir), cur)
+	}
+}
+
+// setTempDir makes the puller keep temporary files in dir, which is created
+// if necessary. Finished files can only be renamed into place from a
+// directory on the same filesystem as the folder, otherwise they are copied.
+func (p *Puller) setTempDir(dir string) {
+	dir, err := osutil.ExpandTilde(dir)
+	if err == nil {
+		err = os.MkdirAll(dir, 0700)
+	}
+	if err != nil {
+		l.Warnf("Folder %q: temporary directory: %v; keeping temporary files in the folder", p.folder, err)
+		return
+	}
+	p.tempDir = dir
+
+	same, err := osutil.SameFilesystem(p.dir, dir)
+	if err != nil {
+		l.Warnf("Folder %q: checking temporary directory: %v; copying finished files into place", p.folder, err)
+	} else if !same {
+		l.Warnf("Folder %q: temporary directory %q is on another filesystem; finished files are copied into place, which is slower and not atomic", p.folder, dir)
+	}
+	p.tempCopy = err != nil || !same
+
+	if p.tempCopy && p.atomicReplace {
+		// Copying into place would write the real file.
+		l.Warnf("Folder %q: atomic replace requires the temporary directory on the same filesystem; keeping temporary files in the folder", p.folder)
+		p.tempDir = ""
+		p.tempCopy = false
+	}
+}
+
+// verifyTemp returns an error unless the temporary file has exactly the
+// blocks of the file.
+func (p *Puller) verifyTemp(state *sharedPullerState) error {
+	blocks, err := scanner.HashFile(p.fs(), state.tempName, protocol.BlockSize)
+	if err != nil {
+		return err
+	}
+	if !scanner.BlocksEqual(blocks, state.file.Blocks) {
+		return errTempMismatch
+	}
+	return nil
+}
+
+// tempName returns the name of the temporary file used while pulling the
+// file. It's next to the file, or in the temporary directory named by the
+// hash of the folder and file name, as files from different directories and
+// folders may share it.
+func (p *Puller) tempName(name string) string {
+	if p.tempDir == "" {
+		return filepath.Join(p.dir, defTempNamer.TempName(name))
+	}
+	hash := sha256.Sum256([]byte(p.folder + "/" + name))
+	return filepath.Join(p.tempDir, defTempNamer.TempName(fmt.Sprintf("%x", hash)))
+}
+
+// moveTemp replaces the real file with the finished temporary file. If the
+// temporary file is on another filesystem it's copied, and the permissions,
+// modification time and metadata set on it are applied again.
+func (p *Puller) moveTemp(state *sharedPullerState) error {
+	if !p.tempCopy {
+		return fs.Rename(p.fs(), state.tempName, state.realName)
+	}
+	defer p.fs().Remove(state.tempName)
+
+	info, err := p.fs().Stat(state.tempName)
+	if err != nil {
+		return err
+	}
+	copyTemp := func(path string) error {
+		src, err := p.fs().Open(state.tempName)
+		if err != nil {
+			return err
+		}
+		defer src.Close()
+		dst, err := p.fs().OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, info.Mode().Perm())
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(dst, src); err != nil {
+			dst.Close()
+			return err
+		}
+		return dst.Close()
+	}
+	if err := osutil.InWritableDir(copyTemp, state.realName); err != nil {
+		return err
+	}
+
+	if !p.ignorePerms {
+		// An existing file keeps its permissions when overwritten
+		if err := p.fs().Chmod(state.realName, info.Mode().Perm()); err != nil {
+			return err
+		}
+	}
+	t := time.Unix(state.file.Modified, 0)
+	if err := p.fs().Chtimes(state.realName, t, t); err != nil && !p.lenientMtimes {
+		return err
+	}
+	if !state.file.IsSymlink() {
+		p.setMetadata(state.realName, &state.file)
+	}
+	return nil
+}
+
+// readFile returns the contents of the file.
+func (p *Puller) readFile(path string) ([]byte, error) {
+	fd, err := p.fs().Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+	return ioutil.ReadAll(fd)
+}
+
+// fs returns the filesystem holding the folder.
+func (p *Puller) fs() fs.Filesystem {
+	if p.filesystem == nil {
+		return fs.DefaultFilesystem
+	}
+	return p.filesystem
+}
+
+// pullResult records the outcome of an attempt at pulling the file, so that
+// files which keep failing are retried progressively less often.
+func (p *Puller) pullResult(file string, err error) {
+	switch err.(type) {
+	case nil:
+		p.queue.Succeeded(file)
+		p.quarantine.clear(file)
+	case *unsafeSymlinkError, *caseCollisionError:
+		// Trying again won't make it any better.
+		p.queue.Rejected(file, err)
+	default:
+		if osutil.IsPathTooLong(err) {
+			err = p.pathTooLong(file, err)
+		}
+		p.queue.Failed(file, err)
+	}
+}
+
+// pathTooLong returns an error explaining that the file can't be synced as
+// its path is too long, and what can be done about it.
+func (p *Puller) pathTooLong(file string, err error) error {
+	path := filepath.Join(p.dir, file)
+	if runtime.GOOS == "windows" && !p.longPaths {
+		return fmt.Errorf("path too long (%d characters): %s; enable long paths for the folder, or shorten the path", len(path), path)
+	}
+	return fmt.Errorf("path or file name too long for the file system (%d characters): %s: %v", len(path), path, err)
+}
+
+// An unsafeSymlinkError is returned for incoming symlinks that would point
+// outside the folder.
+type unsafeSymlinkError struct {
+	target string
+	reason string
+}
+
+func (e *unsafeSymlinkError) Error() string {
+	return fmt.Sprintf("refusing symlink to %q: %s", e.target, e.reason)
+}
+
+// checkSymlinkTarget returns an error if the symlink of the given name in
+// the folder, pointing at target, would lead out of the folder. Absolute
+// targets are refused unless allowed. The check is on the paths only; a
+// relative target may still lead elsewhere through other symlinks.
+func checkSymlinkTarget(name, target string, allowAbsolute bool) error {
+	target = filepath.FromSlash(target)
+	if filepath.IsAbs(target) || filepath.VolumeName(target) != "" || strings.HasPrefix(target, string(filepath.Separator)) {
+		if allowAbsolute {
+			return nil
+		}
+		return &unsafeSymlinkError{target, "absolute symlinks are not allowed in this folder"}
+	}
+
+	resolved := filepath.Join(filepath.Dir(filepath.FromSlash(name)), target)
+	if resolved == ".." || strings.HasPrefix(resolved, ".."+string(filepath.Separator)) {
+		return &unsafeSymlinkError{target, "target is outside the folder"}
+	}
+	return nil
 }
 
 func (p *Puller) finisherRoutine(in <-chan *sharedPullerState) {
 	for state := range in {
+		p.model.folderProgressed(p.folder)
 		if closed, err := state.finalClose(); closed {
 			if debug {
 				l.Debugln(p, "closing", state.file.Name)
 			}
 			if err != nil {
 				l.Warnln("puller: final:", err)
+				p.queue.Failed(state.file.Name, err)
 				continue
 			}
 
 			p.queue.Done(state.file.Name)
-			if state.failed() == nil {
-				p.performFinish(state)
+			err = state.failed()
+			if err == nil {
+				err = p.performFinish(state)
 			}
+			p.pullResult(state.file.Name, err)
 			p.model.receivedFile(p.folder, state.file.Name)
 			if p.progressEmitter != nil {
 				p.progressEmitter.Deregister(state)
@@ -880,6 +2059,23 @@ func (p *Puller) Jobs() ([]string, []string) {
 	return p.queue.Jobs()
 }
 
+// Materialize requests that the contents of the given placeholder file be
+// pulled in full.
+func (p *Puller) Materialize(filename string) {
+	p.matMut.Lock()
+	if p.materialize == nil {
+		p.materialize = make(map[string]struct{})
+	}
+	p.materialize[filename] = struct{}{}
+	p.matMut.Unlock()
+}
+
+func (p *Puller) materializePending() bool {
+	p.matMut.Lock()
+	defer p.matMut.Unlock()
+	return len(p.materialize) > 0
+}
+
 func invalidateFolder(cfg *config.Configuration, folderID string, err error) {
 	for i := range cfg.Folders {
 		folder := &cfg.Folders[i]
@@ -890,6 +2086,30 @@ func invalidateFolder(cfg *config.Configuration, folderID string, err error) {
 	}
 }
 
+// isPlaceholder returns true if the given local file is a placeholder. A
+// placeholder is invalid and retains the block list of the file it stands
+// in for, like local changes to a receive only folder, pinned files and
+// cancelled deletions, but is marked as such.
+func isPlaceholder(f protocol.FileInfo) bool {
+	return f.IsInvalid() && f.IsPlaceholder() && !f.IsDeleted() && !f.IsDirectory() && len(f.Blocks) > 0
+}
+
+// isRenamable returns true if the file is a regular file with contents,
+// which could be moved to a new name instead of being copied.
+func isRenamable(f protocol.FileInfo) bool {
+	return !f.IsDeleted() && !f.IsInvalid() && !f.IsDirectory() && !f.IsSymlink() && len(f.Blocks) > 0
+}
+
+// blocksHash returns a hash identifying the contents of a file by its
+// blocks.
+func blocksHash(blocks []protocol.BlockInfo) string {
+	h := sha256.New()
+	for _, b := range blocks {
+		h.Write(b.Hash)
+	}
+	return string(h.Sum(nil))
+}
+
 func removeDevice(devices []protocol.DeviceID, device protocol.DeviceID) []protocol.DeviceID {
 	for i := range devices {
 		if devices[i] == device {
@@ -899,3 +2119,107 @@ func removeDevice(devices []protocol.DeviceID, device protocol.DeviceID) []proto
 	}
 	return devices
 }
+
+// A caseCollisionError is returned for files whose names differ only in
+// case from another file, on file systems where they would be the same
+// file.
+type caseCollisionError struct {
+	name         string
+	other        string
+	conflictName string // where the file was written instead, if at all
+}
+
+func (e *caseCollisionError) Error() string {
+	if e.conflictName == "" {
+		return fmt.Sprintf("name differs only in case from %q, which is the same file on this file system", e.other)
+	}
+	return fmt.Sprintf("name differs only in case from %q, which is the same file on this file system; saved as %q instead", e.other, e.conflictName)
+}
+
+// caseConflictName returns the name under which a file colliding in case
+// with another is written. It's derived from the whole name, so the copies
+// of different colliding files don't collide in turn.
+func caseConflictName(name string) string {
+	hash := sha256.Sum256([]byte(name))
+	ext := filepath.Ext(name)
+	return fmt.Sprintf("%s.sync-conflict-%x%s", strings.TrimSuffix(name, ext), hash[:4], ext)
+}
+
+// conflictName returns the name, relative to the folder, under which the
+// conflict copy of the file is written.
+func (p *Puller) conflictName(name string) string {
+	return filepath.Join(p.conflictDir, caseConflictName(name))
+}
+
+// inConflictDir returns true if name is the conflict directory or within it.
+func (p *Puller) inConflictDir(name string) bool {
+	if p.conflictDir == "" {
+		return false
+	}
+	return name == p.conflictDir || strings.HasPrefix(name, p.conflictDir+string(filepath.Separator))
+}
+
+// dirListings holds the names in directories of the folder, by directory
+// and lower cased name. It's kept for a puller iteration, so that each
+// directory is only read once.
+type dirListings map[string]map[string][]string
+
+// diskCaseCollision returns the name of an existing file that differs only
+// in case from the given one, or the empty string if there is none.
+func (p *Puller) diskCaseCollision(name string, listings dirListings) string {
+	dir, base := filepath.Split(name)
+	names, ok := listings[dir]
+	if !ok {
+		names = p.listDir(dir)
+		listings[dir] = names
+	}
+	for _, n := range names[strings.ToLower(base)] {
+		if n != base {
+			return filepath.Join(dir, n)
+		}
+	}
+	return ""
+}
+
+// listDir returns the names in the directory by their lower cased names, or
+// nil if it can't be read.
+func (p *Puller) listDir(dir string) map[string][]string {
+	fd, err := p.fs().Open(filepath.Join(p.dir, dir))
+	if err != nil {
+		return nil
+	}
+	defer fd.Close()
+	names, err := fd.Readdirnames(-1)
+	if err != nil {
+		return nil
+	}
+	lower := make(map[string][]string, len(names))
+	for _, n := range names {
+		fold := strings.ToLower(n)
+		lower[fold] = append(lower[fold], n)
+	}
+	return lower
+}
+
+// setCaseCollision records whether the file is to be written as a conflict
+// copy, because it collides with other.
+func (p *Puller) setCaseCollision(name, other string, collides bool) {
+	p.collMut.Lock()
+	defer p.collMut.Unlock()
+	if !collides {
+		delete(p.caseCollisions, name)
+		return
+	}
+	if p.caseCollisions == nil {
+		p.caseCollisions = make(map[string]string)
+	}
+	p.caseCollisions[name] = other
+}
+
+// caseCollision returns the file that the given one collides with, or the
+// empty string.
+func (p *Puller) caseCollision(name string) string {
+	p.collMut.Lock()
+	defer p.collMut.Unlock()
+	return p.caseCollisions[name]
+}
@@ -16,14 +16,24 @@
 package model
 
 import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io/ioutil"
 	"os"
 	"path/filepath"
+	"runtime"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/syncthing/syncthing/internal/config"
+	"github.com/syncthing/syncthing/internal/fs"
+	"github.com/syncthing/syncthing/internal/ignore"
+	"github.com/syncthing/syncthing/internal/osutil"
 	"github.com/syncthing/syncthing/internal/protocol"
 	"github.com/syncthing/syncthing/internal/scanner"
+	"github.com/syncthing/syncthing/internal/versioner"
 
 	"github.com/syndtr/goleveldb/leveldb"
 	"github.com/syndtr/goleveldb/leveldb/storage"
@@ -247,7 +257,7 @@ func TestCopierFinder(t *testing.T) {
 	}
 
 	// Verify that the fetched blocks have actually been written to the temp file
-	blks, err := scanner.HashFile(tempFile, protocol.BlockSize)
+	blks, err := scanner.HashFile(fs.DefaultFilesystem, tempFile, protocol.BlockSize)
 	if err != nil {
 		t.Log(err)
 	}
@@ -551,3 +561,1336 @@ func TestDeregisterOnFailInPull(t *testing.T) {
 		t.Fatal("Didn't get anything to the finisher")
 	}
 }
+
+func TestHandlePlaceholder(t *testing.T) {
+	file := protocol.FileInfo{
+		Name:     "placeholder",
+		Flags:    0644,
+		Modified: 1234567890,
+		Version:  42,
+		Blocks:   blocks[1:3],
+	}
+	realName := filepath.Join("testdata", file.Name)
+	defer os.Remove(realName)
+
+	fcfg := config.FolderConfiguration{ID: "default", Path: "testdata", PlaceholderMode: true}
+	cfg := config.Configuration{Folders: []config.FolderConfiguration{fcfg}}
+
+	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	m := NewModel(config.Wrap("/tmp/test", cfg), "device", "syncthing", "dev", db)
+	m.AddFolder(fcfg)
+
+	p := Puller{
+		folder:          "default",
+		dir:             "testdata",
+		model:           m,
+		placeholderMode: true,
+	}
+
+	if !p.needsPlaceholder(file) {
+		t.Fatal("Unknown file should need a placeholder")
+	}
+	if p.hasPlaceholder(file) {
+		t.Fatal("Unexpected placeholder")
+	}
+
+	p.handlePlaceholder(file)
+
+	info, err := os.Stat(realName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() != file.Size() {
+		t.Errorf("Incorrect placeholder size %d != %d", info.Size(), file.Size())
+	}
+	if info.ModTime().Unix() != file.Modified {
+		t.Errorf("Incorrect placeholder mtime %d != %d", info.ModTime().Unix(), file.Modified)
+	}
+
+	cur, ok := m.CurrentFolderFile("default", file.Name)
+	if !ok || !isPlaceholder(cur) {
+		t.Fatal("Placeholder not recorded in index")
+	}
+	if !p.hasPlaceholder(file) {
+		t.Error("Placeholder should be up to date")
+	}
+
+	// A placeholder must not be used as a block source.
+	if m.finder.Iterate(blocks[1].Hash, func(string, string, uint32) bool { return true }) {
+		t.Error("Placeholder blocks found in block map")
+	}
+
+	// Once requested, the file should be pulled for real.
+	p.Materialize(file.Name)
+	if p.needsPlaceholder(file) {
+		t.Error("Materialized file should not need a placeholder")
+	}
+	if !p.materializePending() {
+		t.Error("Materialization should be pending")
+	}
+
+	// Files invalid for local reasons keep their blocks too, but are no
+	// placeholders: a cancelled deletion is to be restored in full, and a
+	// local change isn't to be replaced by a placeholder.
+	other := file
+	other.Name = "cancelled"
+	other.Flags |= protocol.FlagInvalid
+	m.updateLocal("default", other)
+	other.Flags &^= protocol.FlagInvalid
+	if cur, _ := m.CurrentFolderFile("default", other.Name); isPlaceholder(cur) {
+		t.Error("Invalid file taken for a placeholder")
+	}
+	if p.needsPlaceholder(other) || p.hasPlaceholder(other) {
+		t.Error("Invalid file should be pulled in full")
+	}
+}
+
+func TestHandleFileHardlink(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("hard links are not supported on Windows")
+	}
+
+	target := protocol.FileInfo{
+		Name:      "linktarget",
+		Flags:     0644,
+		Modified:  1234567890,
+		Blocks:    blocks[1:2],
+		LinkGroup: "linktarget",
+	}
+	file := target
+	file.Name = "linkfile"
+
+	targetName := filepath.Join("testdata", target.Name)
+	realName := filepath.Join("testdata", file.Name)
+	if err := ioutil.WriteFile(targetName, []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(targetName)
+	defer os.Remove(realName)
+
+	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	m := NewModel(config.Wrap("/tmp/test", config.Configuration{}), "device", "syncthing", "dev", db)
+	m.AddFolder(config.FolderConfiguration{ID: "default", Path: "testdata"})
+	m.updateLocal("default", target)
+
+	p := Puller{
+		folder:    "default",
+		dir:       "testdata",
+		model:     m,
+		queue:     newJobQueue(),
+		hardlinks: true,
+	}
+
+	// The file should be linked rather than handed to the copiers.
+	p.handleFile(file, nil, nil)
+
+	targetInfo, err := os.Stat(targetName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(realName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !os.SameFile(info, targetInfo) {
+		t.Error("File is not linked to its link group")
+	}
+	if cur, ok := m.CurrentFolderFile("default", file.Name); !ok || cur.LinkGroup != target.Name {
+		t.Errorf("Linked file not recorded in index: %v", cur)
+	}
+
+	// A file with other contents can't be linked and is pulled as usual.
+	other := file
+	other.Name = "linkother"
+	other.Blocks = blocks[2:3]
+	copyChan := make(chan copyBlocksState, 1)
+	p.handleFile(other, copyChan, nil)
+	if cs := <-copyChan; cs.file.Name != other.Name {
+		t.Errorf("Unexpected file %q handed to the copiers", cs.file.Name)
+	}
+}
+
+func TestDeleteArchivesVersion(t *testing.T) {
+	dir, err := ioutil.TempDir("", "syncthing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, name := range []string{"deleted", "replaced"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	m := NewModel(config.Wrap("/tmp/test", config.Configuration{}), "device", "syncthing", "dev", db)
+	m.AddFolder(config.FolderConfiguration{ID: "default", Path: dir})
+
+	p := Puller{
+		folder:    "default",
+		dir:       dir,
+		model:     m,
+		versioner: versioner.NewSimple("default", dir, map[string]string{"keep": "5"}),
+		queue:     newJobQueue(),
+	}
+
+	// A remote delete, a file being replaced by a directory, and a delete
+	// of a file that never existed here.
+	p.deleteFile(protocol.FileInfo{Name: "deleted", Flags: protocol.FlagDeleted, Version: 2})
+	p.handleDir(protocol.FileInfo{Name: "replaced", Flags: protocol.FlagDirectory | 0755, Version: 2})
+	p.deleteFile(protocol.FileInfo{Name: "missing", Flags: protocol.FlagDeleted, Version: 2})
+
+	for _, name := range []string{"deleted", "replaced"} {
+		versions, err := filepath.Glob(filepath.Join(dir, ".stversions", name+"~*"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(versions) != 1 {
+			t.Errorf("Expected one version of %q, got %v", name, versions)
+			continue
+		}
+		if bs, _ := ioutil.ReadFile(versions[0]); string(bs) != name {
+			t.Errorf("Incorrect archived content %q for %q", bs, name)
+		}
+	}
+
+	if info, err := os.Stat(filepath.Join(dir, "replaced")); err != nil || !info.IsDir() {
+		t.Error("File was not replaced by a directory")
+	}
+	if cur, ok := m.CurrentFolderFile("default", "missing"); !ok || !cur.IsDeleted() {
+		t.Error("Delete of a missing file not recorded in index")
+	}
+}
+
+func TestPathTooLong(t *testing.T) {
+	dir, err := ioutil.TempDir("", "syncthing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	m := NewModel(config.Wrap("/tmp/test", config.Configuration{}), "device", "syncthing", "dev", db)
+	m.AddFolder(config.FolderConfiguration{ID: "default", Path: dir})
+
+	p := Puller{
+		folder: "default",
+		dir:    dir,
+		model:  m,
+		queue:  newJobQueue(),
+	}
+	p.queue.SetRetry(time.Minute, 1)
+
+	// No common file system allows a file name this long.
+	name := strings.Repeat("a", 300)
+	p.handleDir(protocol.FileInfo{Name: name, Flags: protocol.FlagDirectory | 0755, Version: 2})
+
+	errs := p.queue.Errors()
+	if len(errs) != 1 {
+		t.Fatalf("Expected one error, got %v", errs)
+	}
+	if errs[0].Name != name {
+		t.Errorf("Incorrect file %q in error", errs[0].Name)
+	}
+	if !strings.Contains(errs[0].Error, "too long") || !strings.Contains(errs[0].Error, filepath.Join(dir, name)) {
+		t.Errorf("Error %q does not explain the path is too long", errs[0].Error)
+	}
+}
+
+func TestCopierOrigin(t *testing.T) {
+	dir, err := ioutil.TempDir("", "syncthing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The current version of the file has the blocks ABCD, and the new one
+	// has a changed block X and two blocks swapped: AXDC.
+	data := make([][]byte, 5)
+	for i := range data {
+		data[i] = make([]byte, protocol.BlockSize)
+		rand.Read(data[i])
+	}
+	hash := func(parts ...int) []protocol.BlockInfo {
+		var buf bytes.Buffer
+		for _, i := range parts {
+			buf.Write(data[i])
+		}
+		blocks, err := scanner.Blocks(&buf, protocol.BlockSize, int64(buf.Len()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return blocks
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "file"), bytes.Join([][]byte{data[0], data[1], data[2], data[3]}, nil), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	m := NewModel(config.Wrap("/tmp/test", config.Configuration{}), "device", "syncthing", "dev", db)
+	m.AddFolder(config.FolderConfiguration{ID: "default", Path: dir})
+
+	current := protocol.FileInfo{Name: "file", Flags: 0644, Version: 1, Blocks: hash(0, 1, 2, 3)}
+	m.updateLocal("default", current)
+
+	// Keep the block finder from knowing about the current version, so that
+	// any block not taken from the file itself has to be pulled.
+	for i, block := range current.Blocks {
+		m.finder.Fix("default", "file", uint32(i), block.Hash, []byte("bogus"))
+	}
+
+	p := Puller{
+		folder: "default",
+		dir:    dir,
+		model:  m,
+	}
+
+	copyChan := make(chan copyBlocksState)
+	pullChan := make(chan pullBlockState, 4)
+	finisherChan := make(chan *sharedPullerState, 1)
+
+	go p.copierRoutine(copyChan, pullChan, finisherChan)
+
+	required := protocol.FileInfo{Name: "file", Flags: 0644, Version: 2, Blocks: hash(0, 4, 3, 2)}
+	p.handleFile(required, copyChan, finisherChan)
+
+	pull := <-pullChan
+	finish := <-finisherChan
+	finish.fd.Close()
+
+	select {
+	case <-pullChan:
+		t.Fatal("More than the changed block was pulled")
+	default:
+	}
+
+	if !bytes.Equal(pull.block.Hash, required.Blocks[1].Hash) || pull.block.Offset != int64(protocol.BlockSize) {
+		t.Errorf("Unexpected block pulled: %v", pull.block)
+	}
+	if finish.copyOrigin != 3 {
+		t.Errorf("Copied %d blocks from the current version, expected 3", finish.copyOrigin)
+	}
+
+	tempBlocks, err := scanner.HashFile(fs.DefaultFilesystem, finish.tempName, protocol.BlockSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, i := range []int{0, 2, 3} {
+		if !bytes.Equal(tempBlocks[i].Hash, required.Blocks[i].Hash) {
+			t.Errorf("Block %d not copied to the temporary file", i)
+		}
+	}
+}
+
+func TestSparseBlocks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "syncthing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// A file with a hole at the start and at the end, and some data in
+	// between.
+	data := make([]byte, 3*protocol.BlockSize+42)
+	rand.Read(data[protocol.BlockSize : 2*protocol.BlockSize])
+	fileBlocks, err := scanner.Blocks(bytes.NewReader(data), protocol.BlockSize, int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	m := NewModel(config.Wrap("/tmp/test", config.Configuration{}), "device", "syncthing", "dev", db)
+	m.AddFolder(config.FolderConfiguration{ID: "default", Path: dir})
+
+	p := Puller{
+		folder: "default",
+		dir:    dir,
+		model:  m,
+	}
+
+	copyChan := make(chan copyBlocksState)
+	pullChan := make(chan pullBlockState, 4)
+	finisherChan := make(chan *sharedPullerState, 1)
+
+	go p.copierRoutine(copyChan, pullChan, finisherChan)
+
+	file := protocol.FileInfo{Name: "sparse", Flags: 0644, Version: 1, Blocks: fileBlocks}
+	p.handleFile(file, copyChan, finisherChan)
+
+	pull := <-pullChan
+	finish := <-finisherChan
+	finish.fd.Close()
+
+	select {
+	case <-pullChan:
+		t.Fatal("A zero block was pulled")
+	default:
+	}
+
+	if pull.block.Offset != protocol.BlockSize {
+		t.Errorf("Unexpected block pulled: %v", pull.block)
+	}
+	if prog := finish.Progress(); prog.Total != 4 || prog.Reused != 3 {
+		t.Errorf("Incorrect progress %+v", prog)
+	}
+
+	info, err := os.Stat(finish.tempName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() != file.Size() {
+		t.Errorf("Temporary file has size %d, expected %d", info.Size(), file.Size())
+	}
+}
+
+func TestTempDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "syncthing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	m := NewModel(config.Wrap("/tmp/test", config.Configuration{}), "device", "syncthing", "dev", db)
+	m.AddFolder(config.FolderConfiguration{ID: "default", Path: filepath.Join(dir, "folder")})
+
+	p := Puller{
+		folder: "default",
+		dir:    filepath.Join(dir, "folder"),
+		model:  m,
+	}
+	if err := os.MkdirAll(filepath.Join(p.dir, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	p.setTempDir(filepath.Join(dir, "temp"))
+	if p.tempDir != filepath.Join(dir, "temp") || p.tempCopy {
+		t.Fatalf("Unexpected temporary directory %q, copy %v", p.tempDir, p.tempCopy)
+	}
+
+	// Files with the same name in different directories get different
+	// temporary files.
+	if tn := p.tempName("sub/file"); filepath.Dir(tn) != p.tempDir || tn == p.tempName("file") {
+		t.Errorf("Unexpected temporary name %q", tn)
+	}
+
+	// Finished files are renamed into place, or copied if the temporary
+	// directory is on another filesystem.
+	for _, tempCopy := range []bool{false, true} {
+		p.tempCopy = tempCopy
+		file := protocol.FileInfo{Name: filepath.Join("sub", "file"), Flags: 0600, Modified: 1234567890, Version: 1}
+		state := &sharedPullerState{
+			file:     file,
+			folder:   "default",
+			tempName: p.tempName(file.Name),
+			realName: filepath.Join(p.dir, file.Name),
+		}
+		if err := ioutil.WriteFile(state.tempName, []byte("data"), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := p.performFinish(state); err != nil {
+			t.Fatal(err)
+		}
+
+		if bs, err := ioutil.ReadFile(state.realName); err != nil || string(bs) != "data" {
+			t.Errorf("Copy %v: unexpected contents %q, %v", tempCopy, bs, err)
+		}
+		if info, err := os.Stat(state.realName); err != nil {
+			t.Fatal(err)
+		} else if info.ModTime().Unix() != file.Modified || (runtime.GOOS != "windows" && info.Mode().Perm() != 0600) {
+			t.Errorf("Copy %v: unexpected mode %v or modification time %v", tempCopy, info.Mode(), info.ModTime())
+		}
+		if _, err := os.Stat(state.tempName); !os.IsNotExist(err) {
+			t.Errorf("Copy %v: temporary file left behind", tempCopy)
+		}
+	}
+}
+
+func TestVerifyAssembledFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "syncthing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	realName := filepath.Join(dir, "file")
+	blocks, _ := scanner.Blocks(strings.NewReader("new"), protocol.BlockSize, 3)
+	file := protocol.FileInfo{Name: "file", Flags: 0644, Modified: 2, Version: 2, Blocks: blocks}
+
+	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	m := NewModel(config.Wrap("/tmp/test", config.Configuration{}), "device", "syncthing", "dev", db)
+	m.AddFolder(config.FolderConfiguration{ID: "default", Path: dir})
+
+	p := Puller{
+		folder:          "default",
+		dir:             dir,
+		model:           m,
+		verifyAssembled: true,
+	}
+	state := &sharedPullerState{
+		file:     file,
+		folder:   "default",
+		tempName: p.tempName(file.Name),
+		realName: realName,
+	}
+
+	// A file that was assembled wrong is discarded, to be pulled again.
+	if err := ioutil.WriteFile(state.tempName, []byte("bad"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.performFinish(state); err != errTempMismatch {
+		t.Errorf("Unexpected error %v != %v", err, errTempMismatch)
+	}
+	if _, err := os.Stat(realName); !os.IsNotExist(err) {
+		t.Error("Mismatching file renamed into place")
+	}
+	if _, err := os.Stat(state.tempName); !os.IsNotExist(err) {
+		t.Error("Mismatching temporary file left behind")
+	}
+
+	if err := ioutil.WriteFile(state.tempName, []byte("new"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.performFinish(state); err != nil {
+		t.Fatal(err)
+	}
+	if bs, _ := ioutil.ReadFile(realName); string(bs) != "new" {
+		t.Errorf("Unexpected file contents %q", bs)
+	}
+}
+
+func TestSyncDirFailure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "syncthing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	defer func(fn func(string) error) { syncDir = fn }(syncDir)
+	syncDir = func(string) error { return errors.New("sync failed") }
+
+	blocks, _ := scanner.Blocks(strings.NewReader("new"), protocol.BlockSize, 3)
+	file := protocol.FileInfo{Name: "file", Flags: 0644, Modified: 2, Version: 2, Blocks: blocks}
+
+	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	m := NewModel(config.Wrap("/tmp/test", config.Configuration{}), "device", "syncthing", "dev", db)
+	m.AddFolder(config.FolderConfiguration{ID: "default", Path: dir})
+
+	p := Puller{
+		folder:    "default",
+		dir:       dir,
+		model:     m,
+		fsyncMode: config.FsyncMetadata,
+	}
+	state := &sharedPullerState{
+		file:     file,
+		folder:   "default",
+		tempName: p.tempName(file.Name),
+		realName: filepath.Join(dir, file.Name),
+	}
+	if err := ioutil.WriteFile(state.tempName, []byte("new"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// The file is in place when the directory fails to sync, and is
+	// recorded as such.
+	if err := p.performFinish(state); err != nil {
+		t.Fatal(err)
+	}
+	if bs, _ := ioutil.ReadFile(state.realName); string(bs) != "new" {
+		t.Errorf("Unexpected file contents %q", bs)
+	}
+	if cur, ok := m.CurrentFolderFile("default", file.Name); !ok || cur.Version != file.Version {
+		t.Errorf("File not recorded after a failed directory sync, got %v", cur)
+	}
+}
+
+func TestAtomicReplace(t *testing.T) {
+	dir, err := ioutil.TempDir("", "syncthing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	realName := filepath.Join(dir, "file")
+	if err := ioutil.WriteFile(realName, []byte("old"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	oldBlocks, _ := scanner.Blocks(strings.NewReader("old"), protocol.BlockSize, 3)
+	newBlocks, _ := scanner.Blocks(strings.NewReader("new"), protocol.BlockSize, 3)
+
+	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	m := NewModel(config.Wrap("/tmp/test", config.Configuration{}), "device", "syncthing", "dev", db)
+	m.AddFolder(config.FolderConfiguration{ID: "default", Path: dir})
+	m.updateLocal("default", protocol.FileInfo{Name: "file", Flags: 0644, Modified: 1, Version: 1, Blocks: oldBlocks})
+
+	p := Puller{
+		folder:        "default",
+		dir:           dir,
+		model:         m,
+		atomicReplace: true,
+	}
+
+	// Blocks may still be copied from the existing file, which is only read.
+	file := protocol.FileInfo{Name: "file", Flags: 0644, Modified: 2, Version: 2, Blocks: newBlocks}
+	copyChan := make(chan copyBlocksState, 1)
+	p.handleFile(file, copyChan, nil)
+	cs := <-copyChan
+	if len(cs.origin) != len(oldBlocks) {
+		t.Errorf("Unexpected origin blocks %v with atomic replace", cs.origin)
+	}
+
+	// A temporary file that isn't what it should be never replaces the file.
+	state := &sharedPullerState{
+		file:     file,
+		folder:   "default",
+		tempName: p.tempName(file.Name),
+		realName: realName,
+	}
+	if err := ioutil.WriteFile(state.tempName, []byte("bad"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.performFinish(state); err != errTempMismatch {
+		t.Errorf("Unexpected error %v != %v", err, errTempMismatch)
+	}
+	if bs, _ := ioutil.ReadFile(realName); string(bs) != "old" {
+		t.Errorf("Existing file changed to %q", bs)
+	}
+	if _, err := os.Stat(state.tempName); !os.IsNotExist(err) {
+		t.Error("Mismatching temporary file left behind")
+	}
+
+	if err := ioutil.WriteFile(state.tempName, []byte("new"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.performFinish(state); err != nil {
+		t.Fatal(err)
+	}
+	if bs, _ := ioutil.ReadFile(realName); string(bs) != "new" {
+		t.Errorf("Unexpected contents %q", bs)
+	}
+}
+
+func TestCheckParent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "syncthing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	m := NewModel(config.Wrap("/tmp/test", config.Configuration{}), "device", "syncthing", "dev", db)
+	m.AddFolder(config.FolderConfiguration{ID: "default", Path: dir})
+	m.updateLocal("default", protocol.FileInfo{Name: "a", Flags: protocol.FlagDirectory | 0700, Version: 1})
+
+	p := Puller{
+		folder: "default",
+		dir:    dir,
+		model:  m,
+		queue:  newJobQueue(),
+	}
+
+	// An empty directory whose parents are missing is created along with
+	// them.
+	if err := p.checkParent(filepath.Join("a", "b", "c")); err != nil {
+		t.Fatal(err)
+	}
+	p.handleDir(protocol.FileInfo{Name: filepath.Join("a", "b", "c"), Flags: protocol.FlagDirectory | 0755, Version: 1})
+	if info, err := os.Lstat(filepath.Join(dir, "a", "b", "c")); err != nil || !info.IsDir() {
+		t.Fatalf("Directory not created: %v", err)
+	}
+	if info, _ := os.Lstat(filepath.Join(dir, "a")); runtime.GOOS != "windows" && info.Mode().Perm() != 0700 {
+		t.Errorf("Unexpected mode %v for parent from the index", info.Mode().Perm())
+	}
+	if info, _ := os.Lstat(filepath.Join(dir, "a", "b")); runtime.GOOS != "windows" && info.Mode().Perm() != 0755 {
+		t.Errorf("Unexpected mode %v for unknown parent", info.Mode().Perm())
+	}
+	if f, ok := m.CurrentFolderFile("default", filepath.Join("a", "b", "c")); !ok || !f.IsDirectory() {
+		t.Error("Created directory not in the index")
+	}
+
+	// Existing parents are left alone.
+	if err := p.checkParent(filepath.Join("a", "file")); err != nil {
+		t.Error(err)
+	}
+	if err := p.checkParent("file"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestPinnedFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "syncthing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, name := range []string{"replaced", "deleted"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte("mine"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, ".stpin"), []byte("replaced\ndeleted\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	fcfg := config.FolderConfiguration{
+		ID:      "default",
+		Path:    dir,
+		Devices: []config.FolderDeviceConfiguration{{DeviceID: device1}},
+	}
+	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	m := NewModel(config.Wrap("/tmp/test", config.Configuration{Folders: []config.FolderConfiguration{fcfg}}), "device", "syncthing", "dev", db)
+	m.AddFolder(fcfg)
+	m.ScanFolder("default")
+
+	m.Index(device1, "default", []protocol.FileInfo{
+		{Name: "replaced", Flags: 0644, Version: 1 << 40, Blocks: []protocol.BlockInfo{{Size: 6, Hash: []byte("theirs")}}},
+		{Name: "deleted", Flags: protocol.FlagDeleted, Version: 1 << 40},
+	})
+
+	p := Puller{
+		folder:    "default",
+		dir:       dir,
+		model:     m,
+		copiers:   1,
+		pullers:   1,
+		versioner: versioner.NewSimple("default", dir, map[string]string{"keep": "5"}),
+		queue:     newJobQueue(),
+	}
+	if changed := p.pullerIteration(ignore.New(false)); changed != 0 {
+		t.Errorf("Pinned files were handled: %d changes", changed)
+	}
+
+	for _, name := range []string{"replaced", "deleted"} {
+		if bs, err := ioutil.ReadFile(filepath.Join(dir, name)); err != nil || string(bs) != "mine" {
+			t.Errorf("Pinned file %q was not kept: %q, %v", name, bs, err)
+		}
+		if cur, ok := m.CurrentFolderFile("default", name); !ok || !cur.IsInvalid() || cur.IsDeleted() {
+			t.Errorf("Pinned file %q should be recorded as invalid, not %v", name, cur)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, ".stversions")); err == nil {
+		t.Error("Pinned files were versioned")
+	}
+}
+
+func TestRenameFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "syncthing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "old"), []byte("contents"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	oldInfo, err := os.Stat(filepath.Join(dir, "old"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fcfg := config.FolderConfiguration{
+		ID:      "default",
+		Path:    dir,
+		Devices: []config.FolderDeviceConfiguration{{DeviceID: device1}},
+	}
+	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	m := NewModel(config.Wrap("/tmp/test", config.Configuration{Folders: []config.FolderConfiguration{fcfg}}), "device", "syncthing", "dev", db)
+	m.AddFolder(fcfg)
+	m.ScanFolder("default")
+
+	old, ok := m.CurrentFolderFile("default", "old")
+	if !ok {
+		t.Fatal("Old file not scanned")
+	}
+	m.Index(device1, "default", []protocol.FileInfo{
+		{Name: "old", Flags: protocol.FlagDeleted, Version: old.Version + 1},
+		{Name: "new", Flags: old.Flags, Modified: old.Modified, Version: old.Version + 1, Blocks: old.Blocks},
+	})
+
+	// There is no connection to pull anything over, so the new file can
+	// only be the old one moved.
+	p := Puller{
+		folder:  "default",
+		dir:     dir,
+		model:   m,
+		copiers: 1,
+		pullers: 1,
+		queue:   newJobQueue(),
+	}
+	p.pullerIteration(ignore.New(false))
+
+	if _, err := os.Lstat(filepath.Join(dir, "old")); !os.IsNotExist(err) {
+		t.Errorf("Old file still exists: %v", err)
+	}
+	newInfo, err := os.Stat(filepath.Join(dir, "new"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !os.SameFile(oldInfo, newInfo) {
+		t.Error("New file is a copy, not the old file renamed")
+	}
+
+	if cur, ok := m.CurrentFolderFile("default", "old"); !ok || !cur.IsDeleted() {
+		t.Errorf("Old file should be recorded as deleted, not %v", cur)
+	}
+	if cur, ok := m.CurrentFolderFile("default", "new"); !ok || cur.IsDeleted() || cur.Version != old.Version+1 {
+		t.Errorf("New file should be recorded, not %v", cur)
+	}
+	if files, _ := m.NeedSize("default"); files != 0 {
+		t.Errorf("Still needing %d files", files)
+	}
+}
+
+func TestCheckSymlinkTarget(t *testing.T) {
+	cases := []struct {
+		name, target string
+		allowAbs     bool
+		ok           bool
+	}{
+		{"link", "file", false, true},
+		{"dir/link", "../file", false, true},
+		{"dir/link", "./sub/../../file", false, true},
+		{"link", "../outside", false, false},
+		{"dir/link", "../../../etc/passwd", false, false},
+		{"dir/link", "sub/../../..", false, false},
+		{"link", "/etc/passwd", false, false},
+		{"link", "/etc/passwd", true, true},
+		{"dir/link", "../../outside", true, false},
+	}
+	for _, tc := range cases {
+		err := checkSymlinkTarget(filepath.FromSlash(tc.name), tc.target, tc.allowAbs)
+		if (err == nil) != tc.ok {
+			t.Errorf("checkSymlinkTarget(%q, %q, %v) = %v, expected ok %v", tc.name, tc.target, tc.allowAbs, err, tc.ok)
+		}
+	}
+}
+
+func TestUnsafeSymlinkRejected(t *testing.T) {
+	dir, err := ioutil.TempDir("", "syncthing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	m := NewModel(config.Wrap("/tmp/test", config.Configuration{}), "device", "syncthing", "dev", db)
+	m.AddFolder(config.FolderConfiguration{ID: "default", Path: dir})
+
+	p := Puller{
+		folder:      "default",
+		dir:         dir,
+		model:       m,
+		queue:       newJobQueue(),
+		ignorePerms: true,
+	}
+	p.queue.SetRetry(time.Minute, 10)
+
+	file := protocol.FileInfo{Name: filepath.Join("sub", "link"), Flags: protocol.FlagSymlink, Modified: 1234567890, Version: 1}
+	if err := os.MkdirAll(filepath.Join(dir, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	state := &sharedPullerState{
+		file:     file,
+		folder:   "default",
+		tempName: p.tempName(file.Name),
+		realName: filepath.Join(dir, file.Name),
+	}
+	if err := ioutil.WriteFile(state.tempName, []byte("../../../etc/passwd"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	err = p.performFinish(state)
+	if _, ok := err.(*unsafeSymlinkError); !ok {
+		t.Fatalf("Unexpected error %v for a symlink out of the folder", err)
+	}
+	if _, err := os.Lstat(state.realName); !os.IsNotExist(err) {
+		t.Error("Symlink should not have been created")
+	}
+
+	p.pullResult(file.Name, err)
+	if errs := p.queue.Errors(); len(errs) != 1 || errs[0].Name != file.Name {
+		t.Errorf("The rejected symlink should be reported at once, got %v", errs)
+	}
+}
+
+func TestCaseInsensitive(t *testing.T) {
+	dir, err := ioutil.TempDir("", "syncthing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, name := range []string{"file", "src"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(name+" contents"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	fcfg := config.FolderConfiguration{
+		ID:      "default",
+		Path:    dir,
+		Devices: []config.FolderDeviceConfiguration{{DeviceID: device1}},
+	}
+	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	m := NewModel(config.Wrap("/tmp/test", config.Configuration{Folders: []config.FolderConfiguration{fcfg}}), "device", "syncthing", "dev", db)
+	m.AddFolder(fcfg)
+	m.ScanFolder("default")
+
+	if _, ok := m.FolderCapabilities("default"); !ok {
+		t.Error("Folder capabilities should have been probed")
+	}
+
+	// The file is renamed to upper case and changed, and two files
+	// differing only in case are added. These have the blocks of another
+	// existing file, so they can be pulled without a connection.
+	old, _ := m.CurrentFolderFile("default", "file")
+	src, _ := m.CurrentFolderFile("default", "src")
+	blocks := []protocol.BlockInfo{{Offset: 0, Size: 9, Hash: []byte("other hash bytes")}}
+	m.Index(device1, "default", []protocol.FileInfo{
+		{Name: "file", Flags: protocol.FlagDeleted, Version: old.Version + 1},
+		{Name: "FILE", Flags: old.Flags, Modified: old.Modified, Version: old.Version + 1, Blocks: blocks},
+		{Name: "Dup", Flags: old.Flags, Modified: old.Modified, Version: old.Version + 1, Blocks: src.Blocks},
+		{Name: "dup", Flags: old.Flags, Modified: old.Modified, Version: old.Version + 1, Blocks: src.Blocks},
+	})
+
+	p := Puller{
+		folder:          "default",
+		dir:             dir,
+		model:           m,
+		copiers:         1,
+		pullers:         1,
+		queue:           newJobQueue(),
+		caseInsensitive: true,
+	}
+	p.pullerIteration(ignore.New(false))
+
+	// On a case insensitive file system the file on disk is FILE, so it
+	// must not be removed, only recorded as deleted.
+	if _, err := os.Lstat(filepath.Join(dir, "file")); err != nil {
+		t.Errorf("Case renamed file was removed: %v", err)
+	}
+	if cur, ok := m.CurrentFolderFile("default", "file"); !ok || !cur.IsDeleted() {
+		t.Errorf("Old name should be recorded as deleted, not %v", cur)
+	}
+
+	// The second of the colliding files is kept as a conflict copy, and
+	// reported.
+	if errs := p.queue.Errors(); len(errs) != 1 || errs[0].Name != "dup" {
+		t.Errorf("Expected the second of the colliding files to be reported, not %v", errs)
+	}
+	for _, name := range []string{"Dup", caseConflictName("dup")} {
+		if bs, err := ioutil.ReadFile(filepath.Join(dir, name)); err != nil || string(bs) != "src contents" {
+			t.Errorf("Expected %s to be pulled, not %q, %v", name, bs, err)
+		}
+	}
+	if cur, ok := m.CurrentFolderFile("default", "dup"); ok {
+		t.Errorf("Conflict copy should not be recorded as the file, not %v", cur)
+	}
+}
+
+func TestConflictDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "syncthing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := os.Mkdir(filepath.Join(dir, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "src"), []byte("src contents"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	fcfg := config.FolderConfiguration{
+		ID:          "default",
+		Path:        dir,
+		Devices:     []config.FolderDeviceConfiguration{{DeviceID: device1}},
+		ConflictDir: ".stconflicts",
+	}
+	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	m := NewModel(config.Wrap("/tmp/test", config.Configuration{Folders: []config.FolderConfiguration{fcfg}}), "device", "syncthing", "dev", db)
+	m.AddFolder(fcfg)
+	m.ScanFolder("default")
+
+	// Two files differing only in case, pulled from an existing file.
+	src, _ := m.CurrentFolderFile("default", "src")
+	sub, _ := m.CurrentFolderFile("default", "sub")
+	m.Index(device1, "default", []protocol.FileInfo{
+		sub,
+		{Name: filepath.Join("sub", "Dup"), Flags: src.Flags, Modified: src.Modified, Version: src.Version + 1, Blocks: src.Blocks},
+		{Name: filepath.Join("sub", "dup"), Flags: src.Flags, Modified: src.Modified, Version: src.Version + 1, Blocks: src.Blocks},
+		{Name: filepath.Join(".stconflicts", "remote"), Flags: src.Flags, Modified: src.Modified, Version: src.Version + 1, Blocks: src.Blocks},
+	})
+
+	p := Puller{
+		folder:          "default",
+		dir:             dir,
+		model:           m,
+		copiers:         1,
+		pullers:         1,
+		queue:           newJobQueue(),
+		caseInsensitive: true,
+		conflictDir:     fcfg.ConflictDir,
+	}
+	p.pullerIteration(ignore.New(false))
+
+	// The conflict copy mirrors the path of the file in the conflict
+	// directory, and isn't beside it.
+	name := filepath.Join(".stconflicts", caseConflictName(filepath.Join("sub", "dup")))
+	if bs, err := ioutil.ReadFile(filepath.Join(dir, name)); err != nil || string(bs) != "src contents" {
+		t.Errorf("Expected %s to be pulled, not %q, %v", name, bs, err)
+	}
+	if _, err := os.Lstat(filepath.Join(dir, caseConflictName(filepath.Join("sub", "dup")))); !os.IsNotExist(err) {
+		t.Error("Conflict copy written beside the file")
+	}
+	if errs := p.queue.Errors(); len(errs) != 1 || !strings.Contains(errs[0].Error, name) {
+		t.Errorf("Expected the conflict copy to be reported, not %v", errs)
+	}
+
+	// The conflict copies of other devices aren't pulled.
+	remote := filepath.Join(".stconflicts", "remote")
+	if _, err := os.Lstat(filepath.Join(dir, remote)); !os.IsNotExist(err) {
+		t.Error("Conflict copy of another device pulled")
+	}
+
+	// It stays local.
+	m.ScanFolder("default")
+	for _, n := range []string{".stconflicts", name, remote} {
+		if _, ok := m.CurrentFolderFile("default", n); ok {
+			t.Errorf("%s should not be scanned", n)
+		}
+	}
+}
+
+func TestSyncDirMtimes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "syncthing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "src"), []byte("src contents"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	fcfg := config.FolderConfiguration{
+		ID:            "default",
+		Path:          dir,
+		Devices:       []config.FolderDeviceConfiguration{{DeviceID: device1}},
+		SyncDirMtimes: true,
+	}
+	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	m := NewModel(config.Wrap("/tmp/test", config.Configuration{Folders: []config.FolderConfiguration{fcfg}}), "device", "syncthing", "dev", db)
+	m.AddFolder(fcfg)
+	m.ScanFolder("default")
+
+	// A directory with a file in it, pulled from an existing file.
+	src, _ := m.CurrentFolderFile("default", "src")
+	mtime := time.Unix(1234567890, 0)
+	m.Index(device1, "default", []protocol.FileInfo{
+		{Name: "dir", Flags: protocol.FlagDirectory | 0755, Modified: mtime.Unix(), Version: src.Version + 1},
+		{Name: filepath.Join("dir", "file"), Flags: src.Flags, Modified: src.Modified, Version: src.Version + 1, Blocks: src.Blocks},
+	})
+
+	p := Puller{
+		folder:    "default",
+		dir:       dir,
+		model:     m,
+		copiers:   1,
+		pullers:   1,
+		queue:     newJobQueue(),
+		dirMtimes: true,
+	}
+	p.pullerIteration(ignore.New(false))
+
+	// The directory has its modification time, not the time the file was
+	// created in it.
+	if bs, err := ioutil.ReadFile(filepath.Join(dir, "dir", "file")); err != nil || string(bs) != "src contents" {
+		t.Fatalf("Expected the file to be pulled, not %q, %v", bs, err)
+	}
+	info, err := os.Stat(filepath.Join(dir, "dir"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.ModTime().Equal(mtime) {
+		t.Errorf("Directory modification time %v, expected %v", info.ModTime(), mtime)
+	}
+
+	// So it's unchanged when scanned.
+	cur, _ := m.CurrentFolderFile("default", "dir")
+	m.ScanFolder("default")
+	if f, _ := m.CurrentFolderFile("default", "dir"); f.Version != cur.Version {
+		t.Errorf("Directory changed by the scan, %v != %v", f, cur)
+	}
+}
+
+func TestOwnershipUnprivileged(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("ownership isn't synced on Windows")
+	}
+
+	defer func(fn func() bool) { canChown = fn }(canChown)
+	canChown = func() bool { return false }
+
+	dir, err := ioutil.TempDir("", "syncthing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "src"), []byte("src contents"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	fcfg := config.FolderConfiguration{
+		ID:            "default",
+		Path:          dir,
+		Devices:       []config.FolderDeviceConfiguration{{DeviceID: device1}},
+		SyncOwnership: true,
+	}
+	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	m := NewModel(config.Wrap("/tmp/test", config.Configuration{Folders: []config.FolderConfiguration{fcfg}}), "device", "syncthing", "dev", db)
+	m.AddFolder(fcfg)
+	m.ScanFolder("default")
+
+	// A file owned by someone else on the remote device.
+	src, _ := m.CurrentFolderFile("default", "src")
+	owner := &protocol.FileOwner{UID: uint32(os.Getuid()) + 1, GID: uint32(os.Getgid()) + 1}
+	m.Index(device1, "default", []protocol.FileInfo{
+		{Name: "file", Flags: src.Flags, Modified: src.Modified, Version: src.Version + 1, Blocks: src.Blocks, Owner: owner},
+	})
+
+	p := Puller{
+		folder:        "default",
+		dir:           dir,
+		model:         m,
+		copiers:       1,
+		pullers:       1,
+		queue:         newJobQueue(),
+		syncOwnership: true,
+	}
+	p.pullerIteration(ignore.New(false))
+
+	cur, ok := m.CurrentFolderFile("default", "file")
+	if !ok {
+		t.Fatal("Expected the file to be pulled")
+	}
+
+	// We can't give the file away, but the scan doesn't announce the owner
+	// it has here as a change.
+	m.ScanFolder("default")
+	if f, _ := m.CurrentFolderFile("default", "file"); f.Version != cur.Version || !scanner.OwnerEqual(f.Owner, owner) {
+		t.Errorf("File changed by the scan, %v != %v", f, cur)
+	}
+}
+
+func TestRemoveSymlinkToProtected(t *testing.T) {
+	if !fs.DefaultFilesystem.SymlinksSupported() {
+		t.Skip("symlinks not supported")
+	}
+	dir, err := ioutil.TempDir("", "syncthing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The target is outside the folder.
+	target := filepath.Join(dir, "target")
+	folder := filepath.Join(dir, "folder")
+	os.Mkdir(folder, 0755)
+	if err := ioutil.WriteFile(target, []byte("target"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	protection := uint32(osutil.SupportedAttributes & (protocol.AttrReadOnly | protocol.AttrImmutable))
+	if protection == 0 {
+		t.Skip("protecting attributes not supported")
+	}
+	if err := osutil.SetFileAttributes(target, protection); err != nil {
+		t.Skip("setting attributes:", err)
+	}
+	defer osutil.SetFileAttributes(target, 0)
+
+	link := filepath.Join(folder, "link")
+	if err := os.Symlink(target, link); err != nil {
+		t.Fatal(err)
+	}
+
+	p := Puller{
+		folder:     "default",
+		dir:        folder,
+		attributes: true,
+	}
+	if err := p.removeFile(link); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Lstat(link); !os.IsNotExist(err) {
+		t.Error("Symlink not removed")
+	}
+	if attrs, err := osutil.FileAttributes(target); err != nil || attrs&protection != protection {
+		t.Errorf("Attributes of the symlink target changed to %x, %v", attrs, err)
+	}
+}
+
+func TestImmutableDirAttributes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "syncthing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer osutil.SetFileAttributes(filepath.Join(dir, "dir"), 0)
+
+	if osutil.SupportedAttributes&protocol.AttrImmutable == 0 {
+		t.Skip("immutable attribute not supported")
+	}
+	probe := filepath.Join(dir, "probe")
+	os.Mkdir(probe, 0755)
+	if err := osutil.SetFileAttributes(probe, protocol.AttrImmutable); err != nil {
+		t.Skip("setting the immutable attribute:", err)
+	}
+	osutil.SetFileAttributes(probe, 0)
+	os.Remove(probe)
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "src"), []byte("src contents"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	fcfg := config.FolderConfiguration{
+		ID:      "default",
+		Path:    dir,
+		Devices: []config.FolderDeviceConfiguration{{DeviceID: device1}},
+	}
+	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	m := NewModel(config.Wrap("/tmp/test", config.Configuration{Folders: []config.FolderConfiguration{fcfg}}), "device", "syncthing", "dev", db)
+	m.AddFolder(fcfg)
+	m.ScanFolder("default")
+
+	// An immutable directory with a file in it, pulled from an existing
+	// file.
+	src, _ := m.CurrentFolderFile("default", "src")
+	m.Index(device1, "default", []protocol.FileInfo{
+		{Name: "dir", Flags: protocol.FlagDirectory | 0755, Modified: src.Modified, Version: src.Version + 1, Attributes: protocol.AttrImmutable},
+		{Name: filepath.Join("dir", "file"), Flags: src.Flags, Modified: src.Modified, Version: src.Version + 1, Blocks: src.Blocks},
+	})
+
+	p := Puller{
+		folder:     "default",
+		dir:        dir,
+		model:      m,
+		copiers:    1,
+		pullers:    1,
+		queue:      newJobQueue(),
+		attributes: true,
+	}
+	check := func(name string) {
+		if bs, err := ioutil.ReadFile(filepath.Join(dir, "dir", name)); err != nil || string(bs) != "src contents" {
+			t.Errorf("Expected %s to be pulled, not %q, %v", name, bs, err)
+		}
+		if attrs, err := osutil.FileAttributes(filepath.Join(dir, "dir")); err != nil || attrs&protocol.AttrImmutable == 0 {
+			t.Errorf("Expected the directory to be immutable, not %x, %v", attrs, err)
+		}
+	}
+	p.pullerIteration(ignore.New(false))
+	check("file")
+
+	// A file added to the directory later on.
+	m.Index(device1, "default", []protocol.FileInfo{
+		{Name: "dir", Flags: protocol.FlagDirectory | 0755, Modified: src.Modified, Version: src.Version + 1, Attributes: protocol.AttrImmutable},
+		{Name: filepath.Join("dir", "file"), Flags: src.Flags, Modified: src.Modified, Version: src.Version + 1, Blocks: src.Blocks},
+		{Name: filepath.Join("dir", "other"), Flags: src.Flags, Modified: src.Modified, Version: src.Version + 1, Blocks: src.Blocks},
+	})
+	p.pullerIteration(ignore.New(false))
+	check("other")
+}
+
+func TestCaseConflictName(t *testing.T) {
+	name := caseConflictName(filepath.Join("dir", "File.txt"))
+	if !strings.HasPrefix(name, filepath.Join("dir", "File.sync-conflict-")) || filepath.Ext(name) != ".txt" {
+		t.Errorf("Unexpected conflict name %q", name)
+	}
+	if name == caseConflictName(filepath.Join("dir", "file.txt")) {
+		t.Error("Conflict names of colliding files should differ")
+	}
+}
+
+func TestDiskCaseCollision(t *testing.T) {
+	dir, err := ioutil.TempDir("", "syncthing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := os.Mkdir(filepath.Join(dir, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "sub", "File"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	p := Puller{dir: dir}
+	listings := make(dirListings)
+	if other := p.diskCaseCollision(filepath.Join("sub", "FILE"), listings); other != filepath.Join("sub", "File") {
+		t.Errorf("Expected collision with sub/File, not %q", other)
+	}
+	for _, name := range []string{filepath.Join("sub", "File"), filepath.Join("sub", "other"), filepath.Join("missing", "file")} {
+		if other := p.diskCaseCollision(name, listings); other != "" {
+			t.Errorf("Unexpected collision of %s with %q", name, other)
+		}
+	}
+
+	// Each directory is read once.
+	if len(listings) != 2 {
+		t.Errorf("Expected the listings of two directories, not %v", listings)
+	}
+	os.Remove(filepath.Join(dir, "sub", "File"))
+	if other := p.diskCaseCollision(filepath.Join("sub", "file"), listings); other != filepath.Join("sub", "File") {
+		t.Errorf("Expected the cached listing to be used, not %q", other)
+	}
+}
+
+func TestQuarantineRetained(t *testing.T) {
+	dir, err := ioutil.TempDir("", "syncthing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fcfg := config.FolderConfiguration{
+		ID:      "default",
+		Path:    dir,
+		Devices: []config.FolderDeviceConfiguration{{DeviceID: device1}},
+	}
+	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	m := NewModel(config.Wrap("/tmp/test", config.Configuration{Folders: []config.FolderConfiguration{fcfg}}), "device", "syncthing", "dev", db)
+	m.AddFolder(fcfg)
+
+	needed := protocol.FileInfo{Name: "needed", Flags: 0644, Version: 1 << 40, Blocks: []protocol.BlockInfo{{Size: 6, Hash: []byte("theirs")}}}
+	m.Index(device1, "default", []protocol.FileInfo{needed})
+
+	p := Puller{
+		folder:  "default",
+		dir:     dir,
+		model:   m,
+		copiers: 1,
+		pullers: 1,
+		queue:   newJobQueue(),
+	}
+	gone := protocol.FileInfo{Name: "gone", Version: 1 << 40}
+	for i := 0; i < quarantineFailures; i++ {
+		p.quarantine.failed(needed, device1)
+		p.quarantine.failed(gone, device1)
+	}
+	p.pullerIteration(ignore.New(false))
+
+	// The file no longer needed is forgotten, while the device stays
+	// quarantined for the one still to be pulled.
+	if _, ok := p.quarantine.files[gone.Name]; ok {
+		t.Error("Quarantine kept for a file no longer needed")
+	}
+	if allowed, _ := p.quarantine.filter(needed, []protocol.DeviceID{device1}); len(allowed) != 0 {
+		t.Error("Quarantine lifted for a file still needed")
+	}
+}
@@ -0,0 +1,116 @@
+// Copyright (C) 2014 The Syncthing Authors.
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for
+// more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package model
+
+import (
+	"sync"
+
+	"github.com/syncthing/syncthing/internal/protocol"
+)
+
+// Consecutive blocks of a file a device may serve that fail verification,
+// before the file is no longer requested from it.
+const quarantineFailures = 3
+
+// A sourceQuarantine counts the blocks failing verification that devices
+// serve for each file. A device that repeatedly serves corrupt data for a
+// file is quarantined for it: the file is pulled from the other devices
+// only, until it's done, or changes. The zero value is ready to use.
+type sourceQuarantine struct {
+	files map[string]quarantinedFile
+	mut   sync.Mutex
+}
+
+type quarantinedFile struct {
+	version  uint64
+	failures map[protocol.DeviceID]int // consecutive failed blocks
+}
+
+// lookup returns the failure counts for the file, or nil if nothing failed
+// for this version of it. Must be called with mut held.
+func (q *sourceQuarantine) lookup(file protocol.FileInfo) map[protocol.DeviceID]int {
+	qf, ok := q.files[file.Name]
+	if !ok || qf.version != file.Version {
+		return nil
+	}
+	return qf.failures
+}
+
+// failed records a block of the file from the device that failed
+// verification. It returns true when the device has just been quarantined
+// for the file.
+func (q *sourceQuarantine) failed(file protocol.FileInfo, device protocol.DeviceID) bool {
+	q.mut.Lock()
+	defer q.mut.Unlock()
+	failures := q.lookup(file)
+	if failures == nil {
+		if q.files == nil {
+			q.files = make(map[string]quarantinedFile)
+		}
+		failures = make(map[protocol.DeviceID]int)
+		q.files[file.Name] = quarantinedFile{file.Version, failures}
+	}
+	failures[device]++
+	return failures[device] == quarantineFailures
+}
+
+// verified records a block of the file from the device that was verified.
+func (q *sourceQuarantine) verified(file protocol.FileInfo, device protocol.DeviceID) {
+	q.mut.Lock()
+	defer q.mut.Unlock()
+	failures := q.lookup(file)
+	if failures == nil || failures[device] >= quarantineFailures {
+		return
+	}
+	delete(failures, device)
+	if len(failures) == 0 {
+		delete(q.files, file.Name)
+	}
+}
+
+// filter returns the devices that aren't quarantined for the file, and the
+// number of those that are.
+func (q *sourceQuarantine) filter(file protocol.FileInfo, devices []protocol.DeviceID) ([]protocol.DeviceID, int) {
+	q.mut.Lock()
+	defer q.mut.Unlock()
+	failures := q.lookup(file)
+	var allowed []protocol.DeviceID
+	for _, device := range devices {
+		if failures[device] < quarantineFailures {
+			allowed = append(allowed, device)
+		}
+	}
+	return allowed, len(devices) - len(allowed)
+}
+
+// clear forgets the file, once it has been pulled.
+func (q *sourceQuarantine) clear(file string) {
+	q.mut.Lock()
+	defer q.mut.Unlock()
+	delete(q.files, file)
+}
+
+// retain forgets the files other than those given, which are no longer
+// needed, such as files since deleted, ignored or pulled by a rescan.
+func (q *sourceQuarantine) retain(needed map[string]bool) {
+	q.mut.Lock()
+	defer q.mut.Unlock()
+	for name := range q.files {
+		if !needed[name] {
+			delete(q.files, name)
+		}
+	}
+}
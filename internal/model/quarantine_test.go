@@ -0,0 +1,75 @@
+// Copyright (C) 2014 The Syncthing Authors.
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for
+// more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package model
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/syncthing/syncthing/internal/protocol"
+)
+
+func TestSourceQuarantine(t *testing.T) {
+	var q sourceQuarantine
+	file := protocol.FileInfo{Name: "file", Version: 1}
+	other := protocol.FileInfo{Name: "other", Version: 1}
+	devices := []protocol.DeviceID{device1, device2}
+
+	// A verified block resets the count of failures.
+	for i := 0; i < quarantineFailures-1; i++ {
+		q.failed(file, device1)
+	}
+	q.verified(file, device1)
+	for i := 0; i < quarantineFailures-1; i++ {
+		if q.failed(file, device1) {
+			t.Fatal("Device quarantined before enough consecutive failures")
+		}
+	}
+	if !q.failed(file, device1) {
+		t.Fatal("Device not quarantined after consecutive failures")
+	}
+	if q.failed(file, device1) {
+		t.Error("Device quarantined more than once")
+	}
+
+	// It's only quarantined for the file, until the file changes or is done.
+	if allowed, n := q.filter(file, devices); !reflect.DeepEqual(allowed, []protocol.DeviceID{device2}) || n != 1 {
+		t.Errorf("Unexpected devices %v, %d quarantined", allowed, n)
+	}
+	q.verified(file, device1)
+	if allowed, _ := q.filter(file, devices); len(allowed) != 1 {
+		t.Error("Quarantine lifted by a verified block")
+	}
+	if allowed, n := q.filter(other, devices); len(allowed) != 2 || n != 0 {
+		t.Error("Device quarantined for another file")
+	}
+	q.verified(other, device2)
+	if _, ok := q.files[other.Name]; ok {
+		t.Error("Entry made for a file without failures")
+	}
+	file.Version++
+	if allowed, _ := q.filter(file, devices); len(allowed) != 2 {
+		t.Error("Device still quarantined for a changed file")
+	}
+
+	for i := 0; i < quarantineFailures; i++ {
+		q.failed(file, device2)
+	}
+	q.clear(file.Name)
+	if allowed, _ := q.filter(file, devices); len(allowed) != 2 {
+		t.Error("Device still quarantined for a pulled file")
+	}
+}
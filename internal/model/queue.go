@@ -15,16 +15,56 @@
 
 package model
 
-import "sync"
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// The longest we wait before retrying a failed file, however many times it
+// has failed.
+const maxRetryBackoff = time.Hour
 
 type jobQueue struct {
 	progress []string
 	queued   []string
 	mut      sync.Mutex
+
+	failures    map[string]pullFailure
+	backoff     time.Duration
+	maxAttempts int
+	reset       bool // failures have been reset since the last RetryRequested
+}
+
+// pullFailure tracks the failed attempts at pulling a file.
+type pullFailure struct {
+	attempts int
+	err      error
+	retry    time.Time // the file is not retried before this time
+	rejected bool      // the file is parked regardless of the attempts
+}
+
+// FileError describes a file that has failed to sync.
+type FileError struct {
+	Name     string
+	Error    string
+	Attempts int
 }
 
 func newJobQueue() *jobQueue {
-	return &jobQueue{}
+	return &jobQueue{
+		failures: make(map[string]pullFailure),
+	}
+}
+
+// SetRetry sets the initial delay before retrying a failed file, and the
+// number of attempts after which the file is parked until the failures are
+// reset. A zero maxAttempts retries forever.
+func (q *jobQueue) SetRetry(backoff time.Duration, maxAttempts int) {
+	q.mut.Lock()
+	q.backoff = backoff
+	q.maxAttempts = maxAttempts
+	q.mut.Unlock()
 }
 
 func (q *jobQueue) Push(file string) {
@@ -80,6 +120,133 @@ func (q *jobQueue) Done(file string) {
 	}
 }
 
+// Failed records a failed attempt at pulling the file. The delay before the
+// next attempt doubles with each failure.
+func (q *jobQueue) Failed(file string, err error) {
+	q.mut.Lock()
+	defer q.mut.Unlock()
+
+	f := q.failures[file]
+	f.attempts++
+	f.err = err
+
+	delay := q.backoff
+	for i := 1; i < f.attempts && delay < maxRetryBackoff; i++ {
+		delay *= 2
+	}
+	if delay > maxRetryBackoff {
+		delay = maxRetryBackoff
+	}
+	f.retry = time.Now().Add(delay)
+
+	q.failures[file] = f
+}
+
+// Rejected records that the file can't be pulled however many times it's
+// attempted, and parks it at once.
+func (q *jobQueue) Rejected(file string, err error) {
+	q.mut.Lock()
+	f := q.failures[file]
+	f.attempts++
+	f.err = err
+	f.rejected = true
+	q.failures[file] = f
+	q.mut.Unlock()
+}
+
+// Succeeded forgets any previous failures of the file.
+func (q *jobQueue) Succeeded(file string) {
+	q.mut.Lock()
+	delete(q.failures, file)
+	q.mut.Unlock()
+}
+
+// Retryable returns whether the file should be attempted now, i.e. it has
+// not failed, or its backoff has expired and it is not parked.
+func (q *jobQueue) Retryable(file string) bool {
+	q.mut.Lock()
+	defer q.mut.Unlock()
+
+	f, ok := q.failures[file]
+	if !ok {
+		return true
+	}
+	return !q.parked(f) && !time.Now().Before(f.retry)
+}
+
+// RetryPending returns whether there are failed files that will be retried
+// once their backoff expires.
+func (q *jobQueue) RetryPending() bool {
+	q.mut.Lock()
+	defer q.mut.Unlock()
+
+	for _, f := range q.failures {
+		if !q.parked(f) {
+			return true
+		}
+	}
+	return false
+}
+
+// Errors returns the parked files, sorted by name.
+func (q *jobQueue) Errors() []FileError {
+	q.mut.Lock()
+	defer q.mut.Unlock()
+
+	var errs []FileError
+	for name, f := range q.failures {
+		if q.parked(f) {
+			errs = append(errs, FileError{
+				Name:     name,
+				Error:    f.err.Error(),
+				Attempts: f.attempts,
+			})
+		}
+	}
+	sort.Sort(fileErrorList(errs))
+	return errs
+}
+
+// ResetParked forgets the failures of the parked files, so that they are
+// attempted again.
+func (q *jobQueue) ResetParked() {
+	q.mut.Lock()
+	defer q.mut.Unlock()
+
+	for name, f := range q.failures {
+		if q.parked(f) {
+			delete(q.failures, name)
+			q.reset = true
+		}
+	}
+}
+
+// ResetFailures forgets all failures, so that the files are attempted again.
+func (q *jobQueue) ResetFailures() {
+	q.mut.Lock()
+	defer q.mut.Unlock()
+
+	if len(q.failures) > 0 {
+		q.failures = make(map[string]pullFailure)
+		q.reset = true
+	}
+}
+
+// RetryRequested returns whether failures have been reset since it was
+// last called.
+func (q *jobQueue) RetryRequested() bool {
+	q.mut.Lock()
+	defer q.mut.Unlock()
+
+	reset := q.reset
+	q.reset = false
+	return reset
+}
+
+func (q *jobQueue) parked(f pullFailure) bool {
+	return f.rejected || q.maxAttempts > 0 && f.attempts >= q.maxAttempts
+}
+
 func (q *jobQueue) Jobs() ([]string, []string) {
 	q.mut.Lock()
 	defer q.mut.Unlock()
@@ -92,3 +259,39 @@ func (q *jobQueue) Jobs() ([]string, []string) {
 
 	return progress, queued
 }
+
+// SortByPriority orders the queued files by descending priority. Files with
+// the same priority keep their relative order.
+func (q *jobQueue) SortByPriority(priority func(string) int) {
+	q.mut.Lock()
+	defer q.mut.Unlock()
+
+	prios := make(map[string]int, len(q.queued))
+	for _, f := range q.queued {
+		prios[f] = priority(f)
+	}
+	sort.Stable(byPriority{q.queued, prios})
+}
+
+type byPriority struct {
+	files []string
+	prios map[string]int
+}
+
+func (b byPriority) Len() int {
+	return len(b.files)
+}
+
+func (b byPriority) Less(i, j int) bool {
+	return b.prios[b.files[i]] > b.prios[b.files[j]]
+}
+
+func (b byPriority) Swap(i, j int) {
+	b.files[i], b.files[j] = b.files[j], b.files[i]
+}
+
+type fileErrorList []FileError
+
+func (l fileErrorList) Len() int           { return len(l) }
+func (l fileErrorList) Less(a, b int) bool { return l[a].Name < l[b].Name }
+func (l fileErrorList) Swap(a, b int)      { l[a], l[b] = l[b], l[a] }
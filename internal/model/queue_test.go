@@ -16,9 +16,13 @@
 package model
 
 import (
+	"errors"
 	"fmt"
 	"reflect"
 	"testing"
+	"time"
+
+	"github.com/syncthing/syncthing/internal/config"
 )
 
 func TestJobQueue(t *testing.T) {
@@ -198,3 +202,98 @@ func BenchmarkJobQueuePushPopDone10k(b *testing.B) {
 	}
 
 }
+
+func TestJobQueuePriority(t *testing.T) {
+	prios := newFilePriorities("default", []config.FolderPriority{
+		{Pattern: "*.go", Priority: 10},
+		{Pattern: "/build", Priority: -10},
+		{Pattern: "*.o", Priority: -5},
+	})
+
+	q := newJobQueue()
+	for _, f := range []string{"a.o", "b.txt", "build/c.go", "d/e.go", "f.o", "build", "g.go"} {
+		q.Push(f)
+	}
+	q.SortByPriority(prios.Priority)
+
+	_, queued := q.Jobs()
+	expected := []string{"build/c.go", "d/e.go", "g.go", "b.txt", "a.o", "f.o", "build"}
+	if !reflect.DeepEqual(queued, expected) {
+		t.Errorf("Incorrect order %v, expected %v", queued, expected)
+	}
+}
+
+func TestJobQueueFailures(t *testing.T) {
+	q := newJobQueue()
+	q.SetRetry(time.Minute, 3)
+	errTest := errors.New("test error")
+
+	if !q.Retryable("f1") {
+		t.Error("file without failures should be retryable")
+	}
+
+	q.Failed("f1", errTest)
+	if q.Retryable("f1") {
+		t.Error("file should be backing off after a failure")
+	}
+	if !q.RetryPending() {
+		t.Error("a retry should be pending")
+	}
+	if errs := q.Errors(); len(errs) != 0 {
+		t.Errorf("unexpected errors %v before parking", errs)
+	}
+
+	// The backoff doubles for each failure
+	q.Failed("f1", errTest)
+	if d := q.failures["f1"].retry.Sub(time.Now()); d < 110*time.Second || d > 2*time.Minute {
+		t.Errorf("unexpected backoff %v after two failures", d)
+	}
+
+	q.Failed("f1", errTest)
+	if q.RetryPending() {
+		t.Error("no retry should be pending for a parked file")
+	}
+	expected := []FileError{{Name: "f1", Error: "test error", Attempts: 3}}
+	if errs := q.Errors(); !reflect.DeepEqual(errs, expected) {
+		t.Errorf("incorrect errors %v != %v", errs, expected)
+	}
+
+	q.Failed("f2", errTest)
+	q.ResetParked()
+	if !q.RetryRequested() || q.RetryRequested() {
+		t.Error("a single retry should be requested after reset")
+	}
+	if !q.Retryable("f1") || q.Retryable("f2") {
+		t.Error("only the parked file should have been reset")
+	}
+
+	q.Succeeded("f2")
+	if !q.Retryable("f2") || q.RetryPending() {
+		t.Error("success should forget the failures")
+	}
+
+	q.Failed("f3", errTest)
+	q.ResetFailures()
+	if !q.Retryable("f3") || !q.RetryRequested() {
+		t.Error("all failures should have been reset")
+	}
+}
+
+func TestJobQueueRejected(t *testing.T) {
+	q := newJobQueue()
+	q.SetRetry(time.Minute, 3)
+
+	q.Rejected("f1", errors.New("test error"))
+	if q.Retryable("f1") || q.RetryPending() {
+		t.Error("a rejected file should not be retried")
+	}
+	expected := []FileError{{Name: "f1", Error: "test error", Attempts: 1}}
+	if errs := q.Errors(); !reflect.DeepEqual(errs, expected) {
+		t.Errorf("incorrect errors %v != %v", errs, expected)
+	}
+
+	q.ResetParked()
+	if !q.Retryable("f1") {
+		t.Error("a rejected file should be retryable after reset")
+	}
+}
@@ -0,0 +1,87 @@
+// Copyright (C) 2014 The Syncthing Authors.
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for
+// more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package model
+
+import (
+	"sync"
+	"time"
+)
+
+// The transfer rate is measured over this many seconds, in buckets of one
+// second each.
+const rateWindowS = 60
+
+// Below this rate, in bytes per second, a transfer is considered stalled
+// and no time of completion is estimated.
+const minETARate = 1024
+
+// rateTracker measures the data transferred over the last rateWindowS
+// seconds. It is safe for use from multiple goroutines.
+type rateTracker struct {
+	bytes [rateWindowS]int64
+	secs  [rateWindowS]int64 // the second each bucket is counting
+	start time.Time          // beginning of the current period of activity
+	last  time.Time
+	mut   sync.Mutex
+}
+
+func (r *rateTracker) add(n int64, now time.Time) {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+
+	sec := now.Unix()
+	i := sec % rateWindowS
+	if r.secs[i] != sec {
+		r.secs[i] = sec
+		r.bytes[i] = 0
+	}
+	r.bytes[i] += n
+
+	// Don't let a transfer that resumes after a pause be averaged over the
+	// time it was idle.
+	if r.start.IsZero() || now.Sub(r.last) > rateWindowS*time.Second {
+		r.start = now
+	}
+	r.last = now
+}
+
+// rate returns the average rate in bytes per second. It's the data
+// transferred during the window, over the part of the window since the
+// transfer started.
+func (r *rateTracker) rate(now time.Time) float64 {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+
+	if r.start.IsZero() {
+		return 0
+	}
+
+	sec := now.Unix()
+	var total int64
+	for i := range r.bytes {
+		if sec-r.secs[i] < rateWindowS {
+			total += r.bytes[i]
+		}
+	}
+
+	span := now.Sub(r.start).Seconds()
+	if span > rateWindowS {
+		span = rateWindowS
+	} else if span < 1 {
+		span = 1
+	}
+	return float64(total) / span
+}
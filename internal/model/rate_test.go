@@ -0,0 +1,57 @@
+// Copyright (C) 2014 The Syncthing Authors.
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for
+// more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package model
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateTracker(t *testing.T) {
+	var r rateTracker
+	now := time.Unix(1000000, 0)
+
+	if rate := r.rate(now); rate != 0 {
+		t.Errorf("Unexpected rate %v without any transfers", rate)
+	}
+
+	// 1000 bytes per second for two minutes
+	for i := 0; i < 120; i++ {
+		r.add(1000, now.Add(time.Duration(i)*time.Second))
+	}
+	now = now.Add(120 * time.Second)
+	if rate := r.rate(now); rate < 980 || rate > 1000 {
+		t.Errorf("Unexpected rate %v, expected about 1000", rate)
+	}
+
+	// Half the rate is reached after half the window without transfers.
+	if rate := r.rate(now.Add(rateWindowS / 2 * time.Second)); rate < 480 || rate > 520 {
+		t.Errorf("Unexpected rate %v after a pause, expected about 500", rate)
+	}
+
+	// A stalled transfer has no rate.
+	now = now.Add(2 * rateWindowS * time.Second)
+	if rate := r.rate(now); rate != 0 {
+		t.Errorf("Unexpected rate %v for a stalled transfer", rate)
+	}
+
+	// A transfer that resumes is not averaged over the idle time.
+	r.add(10000, now)
+	r.add(10000, now.Add(time.Second))
+	if rate := r.rate(now.Add(2 * time.Second)); rate != 10000 {
+		t.Errorf("Unexpected rate %v after resuming, expected 10000", rate)
+	}
+}
@@ -0,0 +1,98 @@
+// Copyright (C) 2014 The Syncthing Authors.
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for
+// more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package model
+
+import (
+	"time"
+
+	"github.com/syncthing/syncthing/internal/files"
+	"github.com/syncthing/syncthing/internal/protocol"
+)
+
+// A scanBudget cuts a scan into bursts of limited duration. Between bursts
+// the scan yields, so that the changes that came in meanwhile are pulled
+// instead of waiting for the end of a long scan.
+type scanBudget struct {
+	budget  time.Duration
+	fn      func()
+	start   time.Time
+	mark    uint64 // local version before the first yield
+	yielded bool
+}
+
+func newScanBudget(budget time.Duration, yield func()) *scanBudget {
+	return &scanBudget{
+		budget: budget,
+		fn:     yield,
+		start:  time.Now(),
+	}
+}
+
+// exceeded returns whether the current burst has used up the budget.
+func (b *scanBudget) exceeded() bool {
+	return b.fn != nil && b.budget > 0 && time.Since(b.start) >= b.budget
+}
+
+// yield lets the pull run and starts the next burst.
+func (b *scanBudget) yield(fs *files.Set) {
+	if !b.yielded {
+		b.mark = fs.LocalVersion(protocol.LocalDeviceID)
+		b.yielded = true
+	}
+	b.fn()
+	b.start = time.Now()
+}
+
+// pulled returns whether the named file has been changed in the index since
+// the scan first yielded. The scan doesn't see any file twice, so a change
+// that is not the scan's own was made by a pull.
+func (b *scanBudget) pulled(fs *files.Set, name string) bool {
+	if !b.yielded {
+		return false
+	}
+	cur, ok := fs.Get(protocol.LocalDeviceID, name)
+	return ok && cur.LocalVersion > b.mark
+}
+
+// scanYielder returns the function the puller's scans yield to. It makes a
+// pull iteration when there are changes to pull since prevVer and the folder
+// may be pulled, without waiting for the scan to complete. The puller's own
+// bookkeeping is left alone; it pulls again once the scan is done.
+func (p *Puller) scanYielder(prevVer *uint64) func() {
+	var synced uint64
+	return func() {
+		curVer := p.model.RemoteLocalVersion(p.folder)
+		if curVer == *prevVer || curVer == synced || p.model.folderFrozen(p.folder) {
+			return
+		}
+		if p.model.connectedDevices(p.folder) < p.model.cfg.Folders()[p.folder].MinConnectedDevices {
+			return
+		}
+
+		p.model.fmut.RLock()
+		curIgnores := p.model.folderIgnores[p.folder]
+		p.model.fmut.RUnlock()
+
+		if debug {
+			l.Debugln(p, "pulling during scan", *prevVer, curVer)
+		}
+		// The scan holds the folder's work lock; we pull under it.
+		p.model.setState(p.folder, FolderSyncing)
+		if p.pullerIteration(curIgnores) == 0 {
+			synced = curVer
+		}
+	}
+}
@@ -0,0 +1,76 @@
+// Copyright (C) 2014 The Syncthing Authors.
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for
+// more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package model
+
+import (
+	"testing"
+	"time"
+
+	"github.com/syncthing/syncthing/internal/files"
+	"github.com/syncthing/syncthing/internal/protocol"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+)
+
+func TestScanBudget(t *testing.T) {
+	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	fs := files.NewSet("default", db)
+	fs.Update(protocol.LocalDeviceID, []protocol.FileInfo{
+		{Name: "scanned", Version: 1},
+		{Name: "pulled", Version: 1},
+	})
+
+	yields := 0
+	b := newScanBudget(time.Millisecond, func() {
+		yields++
+		// What a pull iteration would do to the index.
+		fs.Update(protocol.LocalDeviceID, []protocol.FileInfo{{Name: "pulled", Version: 2}})
+	})
+	if b.pulled(fs, "pulled") {
+		t.Error("file pulled before yielding")
+	}
+	if b.exceeded() {
+		t.Error("budget exceeded at once")
+	}
+
+	time.Sleep(2 * time.Millisecond)
+	if !b.exceeded() {
+		t.Fatal("budget not exceeded")
+	}
+	b.yield(fs)
+	if yields != 1 {
+		t.Errorf("%d yields, expected 1", yields)
+	}
+	if b.exceeded() {
+		t.Error("budget exceeded right after yielding")
+	}
+	if !b.pulled(fs, "pulled") {
+		t.Error("pulled file not detected")
+	}
+	if b.pulled(fs, "scanned") {
+		t.Error("unchanged file taken as pulled")
+	}
+	if b.pulled(fs, "nonexistent") {
+		t.Error("nonexistent file taken as pulled")
+	}
+
+	// Without a function to yield to, the budget is never exceeded.
+	b = newScanBudget(time.Nanosecond, nil)
+	time.Sleep(time.Millisecond)
+	if b.exceeded() {
+		t.Error("budget exceeded without yield function")
+	}
+}
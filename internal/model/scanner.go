@@ -19,11 +19,15 @@ import (
 	"fmt"
 	"math/rand"
 	"time"
+
+	"github.com/syncthing/syncthing/internal/config"
+	"github.com/syncthing/syncthing/internal/cron"
 )
 
 type Scanner struct {
 	folder string
 	intv   time.Duration
+	sched  *cron.Schedule
 	model  *Model
 	stop   chan struct{}
 }
@@ -38,18 +42,34 @@ func (s *Scanner) Serve() {
 	defer timer.Stop()
 
 	initialScanCompleted := false
+	paused := false
+	missing := false
 	for {
 		select {
 		case <-s.stop:
 			return
 
 		case <-timer.C:
+			if s.model.checkPaused(s.folder, &paused) {
+				timer.Reset(time.Second)
+				continue
+			}
+			if s.model.checkDrive(s.folder, &missing) {
+				timer.Reset(time.Second)
+				continue
+			}
+
 			if debug {
 				l.Debugln(s, "rescan")
 			}
 
 			s.model.setState(s.folder, FolderScanning)
-			if err := s.model.ScanFolder(s.folder); err != nil {
+			if err := s.model.ScanFolder(s.folder); err == ErrFrozen || err == errDriveMissing {
+				// Frozen, or the drive went away, since checked above.
+				s.model.setState(s.folder, FolderIdle)
+				timer.Reset(time.Second)
+				continue
+			} else if err != nil {
 				s.model.cfg.InvalidateFolder(s.folder, err.Error())
 				return
 			}
@@ -60,13 +80,16 @@ func (s *Scanner) Serve() {
 				initialScanCompleted = true
 			}
 
-			if s.intv == 0 {
+			intv := nextScanDelay(s.intv, s.sched)
+			if intv == 0 {
 				return
 			}
 
-			// Sleep a random time between 3/4 and 5/4 of the configured interval.
-			sleepNanos := (s.intv.Nanoseconds()*3 + rand.Int63n(2*s.intv.Nanoseconds())) / 4
-			timer.Reset(time.Duration(sleepNanos) * time.Nanosecond)
+			if debug {
+				l.Debugln(s, "next rescan in", intv)
+			}
+			s.model.setNextScan(s.folder, time.Now().Add(intv))
+			timer.Reset(intv)
 		}
 	}
 }
@@ -84,3 +107,36 @@ func (s *Scanner) BringToFront(string) {}
 func (s *Scanner) Jobs() ([]string, []string) {
 	return nil, nil
 }
+
+// scanSchedule returns the parsed rescan schedule of the folder, or nil if it
+// has none or it's invalid. Invalid schedules are warned about when the
+// configuration is loaded.
+func scanSchedule(cfg config.FolderConfiguration) *cron.Schedule {
+	if cfg.RescanSchedule == "" {
+		return nil
+	}
+	sched, err := cron.Parse(cfg.RescanSchedule)
+	if err != nil {
+		return nil
+	}
+	return sched
+}
+
+// nextScanDelay returns the time to wait until the next rescan. With a
+// schedule that's until the next time it matches, otherwise it's a random
+// time between 3/4 and 5/4 of the interval. Zero means no further scans.
+func nextScanDelay(intv time.Duration, sched *cron.Schedule) time.Duration {
+	if sched != nil {
+		now := time.Now()
+		if next := sched.Next(now); !next.IsZero() {
+			return next.Sub(now)
+		}
+		return 0
+	}
+
+	if intv <= 0 {
+		return 0
+	}
+	sleepNanos := (intv.Nanoseconds()*3 + rand.Int63n(2*intv.Nanoseconds())) / 4
+	return time.Duration(sleepNanos) * time.Nanosecond
+}
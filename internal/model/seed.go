@@ -0,0 +1,159 @@
+// Copyright (C) 2014 The Syncthing Authors.
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for
+// more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package model
+
+import (
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/syncthing/syncthing/internal/files"
+	"github.com/syncthing/syncthing/internal/lamport"
+	"github.com/syncthing/syncthing/internal/protocol"
+	"github.com/syncthing/syncthing/internal/scanner"
+)
+
+// The largest index message accepted in an imported index.
+const maxSeedMessageSize = 256 << 20
+
+// seedFiles are the files of an imported index, by name, that the next scan
+// of the folder trusts instead of hashing them.
+type seedFiles map[string]protocol.FileInfo
+
+// Implements scanner.CurrentFiler
+func (s seedFiles) CurrentFile(name string) (protocol.FileInfo, bool) {
+	f, ok := s[name]
+	return f, ok
+}
+
+// ExportIndex writes the local index of the folder to w, for seeding the
+// folder on another device with ImportIndex. It's a gzipped series of index
+// messages, each preceded by its length.
+func (m *Model) ExportIndex(folder string, w io.Writer) error {
+	m.fmut.RLock()
+	fs, ok := m.folderFiles[folder]
+	m.fmut.RUnlock()
+	if !ok {
+		return errors.New("no such folder")
+	}
+
+	gw := gzip.NewWriter(w)
+	var err error
+	batch := make([]protocol.FileInfo, 0, indexBatchSize)
+	write := func() {
+		var bs []byte
+		bs, err = protocol.IndexMessage{Folder: folder, Files: batch}.MarshalXDR()
+		if err != nil {
+			return
+		}
+		var hdr [4]byte
+		binary.BigEndian.PutUint32(hdr[:], uint32(len(bs)))
+		if _, err = gw.Write(hdr[:]); err == nil {
+			_, err = gw.Write(bs)
+		}
+		batch = batch[:0]
+	}
+	fs.WithHave(protocol.LocalDeviceID, func(fi files.FileIntf) bool {
+		f := fi.(protocol.FileInfo)
+		if f.IsDeleted() || f.IsInvalid() {
+			return true
+		}
+		batch = append(batch, f)
+		if len(batch) == indexBatchSize {
+			write()
+		}
+		return err == nil
+	})
+	if err == nil && len(batch) > 0 {
+		write()
+	}
+	if err != nil {
+		return err
+	}
+	return gw.Close()
+}
+
+// ImportIndex reads an index written by ExportIndex on another device and
+// scans the folder against it. Files that aren't in the local index yet, but
+// have the size and modification time they have in the imported index and
+// whose first and last blocks match it, are taken to have its block list
+// rather than hashed in full; they keep their version, so that they're not
+// taken as changes by the other devices. The other files are hashed. A
+// folder seeded this way should be paused when added, and resumed once its
+// index has been imported. The number of files imported is returned.
+func (m *Model) ImportIndex(folder string, r io.Reader) (int, error) {
+	m.fmut.RLock()
+	_, ok := m.folderFiles[folder]
+	m.fmut.RUnlock()
+	if !ok {
+		return 0, errors.New("no such folder")
+	}
+
+	gr, err := gzip.NewReader(r)
+	if err != nil {
+		return 0, err
+	}
+	seeds := make(seedFiles)
+	var hdr [4]byte
+	for {
+		if _, err := io.ReadFull(gr, hdr[:]); err == io.EOF {
+			break
+		} else if err != nil {
+			return 0, err
+		}
+		size := binary.BigEndian.Uint32(hdr[:])
+		if size > maxSeedMessageSize {
+			return 0, fmt.Errorf("index message of %d bytes is too large", size)
+		}
+		bs := make([]byte, size)
+		if _, err := io.ReadFull(gr, bs); err != nil {
+			return 0, err
+		}
+		var im protocol.IndexMessage
+		if err := im.UnmarshalXDR(bs); err != nil {
+			return 0, err
+		}
+		for _, f := range im.Files {
+			if f.IsDeleted() || f.IsDirectory() || f.IsSymlink() || f.IsInvalid() {
+				continue
+			}
+			lamport.Default.Tick(f.Version)
+			seeds[f.Name] = f
+		}
+	}
+
+	l.Infof("Imported index of %d files for folder %q", len(seeds), folder)
+	m.fmut.Lock()
+	m.folderSeeds[folder] = seeds
+	m.fmut.Unlock()
+	return len(seeds), m.ScanFolder(folder)
+}
+
+// seeded returns f with the version of the matching seed, if it's a file
+// that wasn't indexed before and is the same as in the imported index.
+func seeded(seeds seedFiles, fs *files.Set, f protocol.FileInfo) protocol.FileInfo {
+	sf, ok := seeds[f.Name]
+	if !ok || sf.Modified != f.Modified || sf.Flags != f.Flags || !scanner.BlocksEqual(sf.Blocks, f.Blocks) {
+		return f
+	}
+	if _, ok := fs.Get(protocol.LocalDeviceID, f.Name); ok {
+		return f
+	}
+	f.Version = sf.Version
+	return f
+}
@@ -0,0 +1,118 @@
+// Copyright (C) 2014 The Syncthing Authors.
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for
+// more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package model
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/syncthing/syncthing/internal/config"
+	"github.com/syncthing/syncthing/internal/protocol"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+)
+
+func TestExportImportIndex(t *testing.T) {
+	dir, err := ioutil.TempDir("", "seed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	large := bytes.Repeat([]byte("0123456789abcdef"), 3*protocol.BlockSize/16+100)
+	if err := ioutil.WriteFile(filepath.Join(dir, "large"), large, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "changed"), large, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "forged"), large, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	newModel := func() *Model {
+		db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+		m := NewModel(config.Wrap("/tmp/test", config.Configuration{}), "device", "syncthing", "dev", db)
+		m.AddFolder(config.FolderConfiguration{ID: "default", Path: dir})
+		return m
+	}
+
+	src := newModel()
+	src.ScanFolder("default")
+	var buf bytes.Buffer
+	if err := src.ExportIndex("default", &buf); err != nil {
+		t.Fatal(err)
+	}
+
+	// Same size, but a different modification time and contents.
+	mtime := time.Unix(1400000000, 0)
+	large[100] = 'x'
+	if err := ioutil.WriteFile(filepath.Join(dir, "changed"), large, 0644); err != nil {
+		t.Fatal(err)
+	}
+	os.Chtimes(filepath.Join(dir, "changed"), mtime, mtime)
+
+	// Same size and modification time, but different contents in the last
+	// block.
+	info, err := os.Stat(filepath.Join(dir, "forged"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	forged := append([]byte(nil), large...)
+	forged[100] = '0'
+	forged[len(forged)-1] = 'x'
+	if err := ioutil.WriteFile(filepath.Join(dir, "forged"), forged, 0644); err != nil {
+		t.Fatal(err)
+	}
+	os.Chtimes(filepath.Join(dir, "forged"), info.ModTime(), info.ModTime())
+
+	dst := newModel()
+	if n, err := dst.ImportIndex("default", &buf); err != nil || n != 3 {
+		t.Fatalf("Unexpected import result %d, %v", n, err)
+	}
+
+	// The file matching its seed isn't hashed, only the changed ones.
+	stats := dst.ScanStats("default")
+	if stats.FilesHashed != 2 || stats.BytesHashed != 2*int64(len(large)) {
+		t.Errorf("Unexpected hashing of %d files, %d bytes", stats.FilesHashed, stats.BytesHashed)
+	}
+	srcLarge, _ := src.CurrentFolderFile("default", "large")
+	dstLarge, _ := dst.CurrentFolderFile("default", "large")
+	if dstLarge.Version != srcLarge.Version || !reflect.DeepEqual(dstLarge.Blocks, srcLarge.Blocks) {
+		t.Errorf("Seeded file %v differs from %v", dstLarge, srcLarge)
+	}
+	srcChanged, _ := src.CurrentFolderFile("default", "changed")
+	dstChanged, _ := dst.CurrentFolderFile("default", "changed")
+	if dstChanged.Version == srcChanged.Version {
+		t.Error("Changed file should have a new version")
+	}
+	srcForged, _ := src.CurrentFolderFile("default", "forged")
+	dstForged, _ := dst.CurrentFolderFile("default", "forged")
+	if dstForged.Version == srcForged.Version || reflect.DeepEqual(dstForged.Blocks, srcForged.Blocks) {
+		t.Errorf("Forged file %v should have been hashed, not seeded from %v", dstForged, srcForged)
+	}
+	if _, ok := dst.folderSeeds["default"]; ok {
+		t.Error("Seeds should be dropped after the scan")
+	}
+
+	if _, err := dst.ImportIndex("default", bytes.NewBufferString("garbage")); err == nil {
+		t.Error("Unexpected nil error importing garbage")
+	}
+}
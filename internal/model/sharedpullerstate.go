@@ -20,8 +20,11 @@ import (
 	"os"
 	"path/filepath"
 	"sync"
+	"time"
 
 	"github.com/syncthing/syncthing/internal/files"
+	"github.com/syncthing/syncthing/internal/fs"
+	"github.com/syncthing/syncthing/internal/osutil"
 	"github.com/syncthing/syncthing/internal/protocol"
 )
 
@@ -34,10 +37,20 @@ type sharedPullerState struct {
 	tempName string
 	realName string
 	reused   uint32 // Number of blocks reused from temporary file
+	sparse   uint32 // Number of all-zero blocks left as holes in a new temporary file
+	fsync    bool   // Flush the temp file to disk before closing it
+
+	preallocate bool // Allocate the space of a new temp file when it's created
+
+	caseCollision string // The file this one differs from only in case, when written as a conflict copy
+
+	filesystem fs.Filesystem
+
+	rate rateTracker // Blocks copied and pulled recently; has its own lock
 
 	// Mutable, must be locked for access
 	err        error      // The first error we hit
-	fd         *os.File   // The fd of the temp file
+	fd         fs.File    // The fd of the temp file
 	copyTotal  uint32     // Total number of copy actions for the whole job
 	pullTotal  uint32     // Total number of pull actions for the whole job
 	copyOrigin uint32     // Number of blocks copied from the original file
@@ -91,14 +104,14 @@ func (s *sharedPullerState) tempFile() (io.WriterAt, error) {
 	// osutil.InWritableDir except we need to do more stuff so we duplicate it
 	// here.
 	dir := filepath.Dir(s.tempName)
-	if info, err := os.Stat(dir); err != nil {
+	if info, err := s.fs().Stat(dir); err != nil {
 		s.failLocked("dst stat dir", err)
 		return nil, err
 	} else if info.Mode()&0200 == 0 {
-		err := os.Chmod(dir, 0755)
+		err := s.fs().Chmod(dir, 0755)
 		if err == nil {
 			defer func() {
-				err := os.Chmod(dir, info.Mode().Perm())
+				err := s.fs().Chmod(dir, info.Mode().Perm())
 				if err != nil {
 					panic(err)
 				}
@@ -116,18 +129,45 @@ func (s *sharedPullerState) tempFile() (io.WriterAt, error) {
 		// moved it to it's final name. This leaves us with a read only temp
 		// file that we're going to try to reuse. To handle that, we need to
 		// make sure we have write permissions on the file before opening it.
-		err := os.Chmod(s.tempName, 0644)
+		err := s.fs().Chmod(s.tempName, 0644)
 		if err != nil {
 			s.failLocked("dst create chmod", err)
 			return nil, err
 		}
 	}
-	fd, err := os.OpenFile(s.tempName, flags, 0644)
+	fd, err := s.fs().OpenFile(s.tempName, flags, 0644)
 	if err != nil {
 		s.failLocked("dst create", err)
 		return nil, err
 	}
 
+	// Allocate the space of the file up front, so that it's laid out in one
+	// piece and we run out of space now rather than halfway through.
+	if s.preallocate {
+		if osfd, ok := fd.(*os.File); ok {
+			err := osutil.Preallocate(osfd, s.file.Size())
+			if err == osutil.ErrPreallocateUnsupported {
+				if debug {
+					l.Debugf("preallocate %q: %v", s.tempName, err)
+				}
+			} else if err != nil {
+				fd.Close()
+				s.failLocked("dst preallocate", err)
+				return nil, err
+			}
+		}
+	}
+
+	// Extend the new file to the final size up front, so that the blocks we
+	// don't write are holes.
+	if s.sparse > 0 {
+		if err := fd.Truncate(s.file.Size()); err != nil {
+			fd.Close()
+			s.failLocked("dst truncate", err)
+			return nil, err
+		}
+	}
+
 	// Same fd will be used by all writers
 	s.fd = fd
 
@@ -135,7 +175,7 @@ func (s *sharedPullerState) tempFile() (io.WriterAt, error) {
 }
 
 // sourceFile opens the existing source file for reading
-func (s *sharedPullerState) sourceFile() (*os.File, error) {
+func (s *sharedPullerState) sourceFile() (fs.File, error) {
 	s.mut.Lock()
 	defer s.mut.Unlock()
 
@@ -145,7 +185,7 @@ func (s *sharedPullerState) sourceFile() (*os.File, error) {
 	}
 
 	// Attempt to open the existing file
-	fd, err := os.Open(s.realName)
+	fd, err := s.fs().Open(s.realName)
 	if err != nil {
 		s.failLocked("src open", err)
 		return nil, err
@@ -154,6 +194,14 @@ func (s *sharedPullerState) sourceFile() (*os.File, error) {
 	return fd, nil
 }
 
+// fs returns the filesystem holding the files.
+func (s *sharedPullerState) fs() fs.Filesystem {
+	if s.filesystem == nil {
+		return fs.DefaultFilesystem
+	}
+	return s.filesystem
+}
+
 // earlyClose prints a warning message composed of the context and
 // error, and marks the sharedPullerState as failed. Is a no-op when called on
 // an already failed state.
@@ -187,6 +235,7 @@ func (s *sharedPullerState) copyDone() {
 		l.Debugln("sharedPullerState", s.folder, s.file.Name, "copyNeeded ->", s.copyNeeded)
 	}
 	s.mut.Unlock()
+	s.rate.add(protocol.BlockSize, time.Now())
 }
 
 func (s *sharedPullerState) copiedFromOrigin() {
@@ -214,6 +263,7 @@ func (s *sharedPullerState) pullDone() {
 		l.Debugln("sharedPullerState", s.folder, s.file.Name, "pullNeeded done ->", s.pullNeeded)
 	}
 	s.mut.Unlock()
+	s.rate.add(protocol.BlockSize, time.Now())
 }
 
 // finalClose atomically closes and returns closed status of a file. A true
@@ -232,6 +282,12 @@ func (s *sharedPullerState) finalClose() (bool, error) {
 
 	if fd := s.fd; fd != nil {
 		s.fd = nil
+		if s.fsync && s.err == nil {
+			if err := fd.Sync(); err != nil {
+				fd.Close()
+				return true, err
+			}
+		}
 		return true, fd.Close()
 	}
 	return false, nil
@@ -241,11 +297,11 @@ func (s *sharedPullerState) finalClose() (bool, error) {
 func (s *sharedPullerState) Progress() *pullerProgress {
 	s.mut.Lock()
 	defer s.mut.Unlock()
-	total := s.reused + s.copyTotal + s.pullTotal
+	total := s.reused + s.sparse + s.copyTotal + s.pullTotal
 	done := total - s.copyNeeded - s.pullNeeded
 	return &pullerProgress{
 		Total:               total,
-		Reused:              s.reused,
+		Reused:              s.reused + s.sparse,
 		CopiedFromOrigin:    s.copyOrigin,
 		CopiedFromElsewhere: s.copyTotal - s.copyNeeded - s.copyOrigin,
 		Pulled:              s.pullTotal - s.pullNeeded,
@@ -0,0 +1,68 @@
+// Copyright (C) 2014 The Syncthing Authors.
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for
+// more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package model
+
+import (
+	"github.com/syncthing/syncthing/internal/config"
+)
+
+// The number of copiers, pullers and hashers of a folder, and its selected
+// directories, can be changed while it is running. The puller picks up the
+// new copier and puller counts and selection on its next iteration and the
+// scanner uses the new hasher count on its next scan, so the folder isn't
+// restarted.
+
+// Changed implements the config.Handler interface. The model only acts on
+// the specific changes passed to ConfigChanged.
+func (m *Model) Changed(cfg config.Configuration) error {
+	return nil
+}
+
+// ConfigChanged implements the config.ChangeHandler interface.
+func (m *Model) ConfigChanged(cfg config.Configuration, changes config.Changes) error {
+	if len(changes.FoldersTuned) == 0 {
+		return nil
+	}
+
+	tuned := make(map[string]bool, len(changes.FoldersTuned))
+	for _, id := range changes.FoldersTuned {
+		tuned[id] = true
+	}
+
+	m.fmut.Lock()
+	defer m.fmut.Unlock()
+
+	for _, folderCfg := range cfg.Folders {
+		if !tuned[folderCfg.ID] {
+			continue
+		}
+		cur, ok := m.folderCfgs[folderCfg.ID]
+		if !ok {
+			continue
+		}
+		cur.Copiers, cur.Pullers, cur.Hashers = folderCfg.Copiers, folderCfg.Pullers, folderCfg.Hashers
+		cur.SelectedDirs = folderCfg.SelectedDirs
+		m.folderCfgs[folderCfg.ID] = cur
+
+		if p, ok := m.folderRunners[folderCfg.ID].(*Puller); ok {
+			p.setConcurrency(cur.Copiers, cur.Pullers)
+		}
+		if debug {
+			l.Debugf("%v folder %q tuned: %d copiers, %d pullers, %d hashers", m, folderCfg.ID, cur.Copiers, cur.Pullers, cur.Hashers)
+		}
+	}
+	return nil
+}
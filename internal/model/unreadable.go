@@ -0,0 +1,132 @@
+// Copyright (C) 2014 The Syncthing Authors.
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for
+// more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package model
+
+import (
+	"errors"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// An UnreadableFile is a file or directory that was skipped by the last scan
+// as it can't be read for lack of permission. It keeps its previous state in
+// the index, as do the contents of a directory.
+type UnreadableFile struct {
+	Name  string
+	Error string
+	Since time.Time // when it was first found unreadable
+}
+
+// unreadableFiles tracks the unreadable files of a folder across scans.
+// Those that were not found unreadable again by a scan covering them are
+// forgotten at the end of it.
+type unreadableFiles struct {
+	folder string
+	quiet  bool // don't warn about newly unreadable files
+	files  map[string]*UnreadableFile
+	seen   map[string]bool // by the scan in progress
+	mut    sync.Mutex
+}
+
+func newUnreadableFiles(folder string, quiet bool) *unreadableFiles {
+	return &unreadableFiles{
+		folder: folder,
+		quiet:  quiet,
+		files:  make(map[string]*UnreadableFile),
+		seen:   make(map[string]bool),
+	}
+}
+
+func (u *unreadableFiles) Unreadable(name string, err error) {
+	msg := err.Error()
+	if perr, ok := err.(*os.PathError); ok {
+		// The path is known already.
+		msg = perr.Err.Error()
+	}
+
+	u.mut.Lock()
+	defer u.mut.Unlock()
+	u.seen[name] = true
+	if f, ok := u.files[name]; ok {
+		f.Error = msg
+		return
+	}
+	u.files[name] = &UnreadableFile{Name: name, Error: msg, Since: time.Now()}
+	if !u.quiet {
+		l.Warnf("Folder %q: cannot read %q: %s; skipping it", u.folder, name, msg)
+	}
+}
+
+// done forgets the files under sub that were not found unreadable by the
+// scan just completed.
+func (u *unreadableFiles) done(sub string) {
+	u.mut.Lock()
+	defer u.mut.Unlock()
+	for name := range u.files {
+		if !u.seen[name] && isUnder(name, sub) {
+			delete(u.files, name)
+		}
+	}
+	u.seen = make(map[string]bool)
+}
+
+// covers returns whether the file is unreadable, or inside an unreadable
+// directory. Whether it still exists is unknown in that case.
+func (u *unreadableFiles) covers(name string) bool {
+	u.mut.Lock()
+	defer u.mut.Unlock()
+	for unreadable := range u.files {
+		if isUnder(name, unreadable) {
+			return true
+		}
+	}
+	return false
+}
+
+// isUnder returns whether the name is dir or inside it; everything is inside
+// the empty dir.
+func isUnder(name, dir string) bool {
+	return dir == "" || name == dir || strings.HasPrefix(name, dir+string(os.PathSeparator))
+}
+
+// UnreadableFiles returns the files and directories of the folder that were
+// skipped by scans for lack of permission, by name.
+func (m *Model) UnreadableFiles(folder string) ([]UnreadableFile, error) {
+	m.fmut.RLock()
+	u, ok := m.folderDenied[folder]
+	m.fmut.RUnlock()
+	if !ok {
+		return nil, errors.New("no such folder")
+	}
+
+	u.mut.Lock()
+	defer u.mut.Unlock()
+	res := make([]UnreadableFile, 0, len(u.files))
+	for _, f := range u.files {
+		res = append(res, *f)
+	}
+	sort.Sort(unreadableByName(res))
+	return res, nil
+}
+
+type unreadableByName []UnreadableFile
+
+func (l unreadableByName) Len() int           { return len(l) }
+func (l unreadableByName) Less(a, b int) bool { return l[a].Name < l[b].Name }
+func (l unreadableByName) Swap(a, b int)      { l[a], l[b] = l[b], l[a] }
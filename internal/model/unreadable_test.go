@@ -0,0 +1,110 @@
+// Copyright (C) 2014 The Syncthing Authors.
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for
+// more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package model
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/syncthing/syncthing/internal/config"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+)
+
+func TestUnreadableFiles(t *testing.T) {
+	u := newUnreadableFiles("default", true)
+	dir := filepath.Join("a", "secret")
+
+	u.Unreadable(dir, &os.PathError{Op: "open", Path: "/x/a/secret", Err: os.ErrPermission})
+	u.Unreadable("file", errors.New("permission denied"))
+	u.done("")
+
+	for _, name := range []string{dir, filepath.Join(dir, "file"), "file"} {
+		if !u.covers(name) {
+			t.Errorf("%q should be covered", name)
+		}
+	}
+	for _, name := range []string{"a", filepath.Join("a", "secretive"), "file2"} {
+		if u.covers(name) {
+			t.Errorf("%q should not be covered", name)
+		}
+	}
+	if f := u.files[dir]; f.Error != os.ErrPermission.Error() {
+		t.Errorf("Unexpected error %q", f.Error)
+	}
+
+	// A scan of another part of the folder doesn't forget them, one
+	// covering them does unless they're still unreadable.
+	u.done("b")
+	if len(u.files) != 2 {
+		t.Errorf("Unexpected unreadable files %v", u.files)
+	}
+	u.Unreadable(dir, os.ErrPermission)
+	u.done("")
+	if len(u.files) != 1 || u.files[dir] == nil {
+		t.Errorf("Unexpected unreadable files %v", u.files)
+	}
+}
+
+func TestUnreadableNotDeleted(t *testing.T) {
+	if runtime.GOOS == "windows" || os.Getuid() == 0 {
+		t.Skip("permissions are not enforced")
+	}
+
+	dir, err := ioutil.TempDir("", "syncthing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	secret := filepath.Join(dir, "secret")
+	if err := os.Mkdir(secret, 0755); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chmod(secret, 0755)
+	if err := ioutil.WriteFile(filepath.Join(secret, "file"), []byte("contents"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	fcfg := config.FolderConfiguration{ID: "default", Path: dir, SkipUnreadable: true}
+	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	m := NewModel(config.Wrap("/tmp/test", config.Configuration{Folders: []config.FolderConfiguration{fcfg}}), "device", "syncthing", "dev", db)
+	m.AddFolder(fcfg)
+	m.ScanFolder("default")
+
+	if err := os.Chmod(secret, 0); err != nil {
+		t.Fatal(err)
+	}
+	m.ScanFolder("default")
+
+	if cur, ok := m.CurrentFolderFile("default", filepath.Join("secret", "file")); !ok || cur.IsDeleted() {
+		t.Error("File in unreadable directory was taken as deleted")
+	}
+	if files, _ := m.UnreadableFiles("default"); len(files) != 1 || files[0].Name != "secret" {
+		t.Errorf("Unexpected unreadable files %v", files)
+	}
+
+	if err := os.Chmod(secret, 0755); err != nil {
+		t.Fatal(err)
+	}
+	m.ScanFolder("default")
+	if files, _ := m.UnreadableFiles("default"); len(files) != 0 {
+		t.Errorf("Unexpected unreadable files %v after making them readable", files)
+	}
+}
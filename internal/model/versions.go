@@ -0,0 +1,188 @@
+// Copyright (C) 2014 The Syncthing Authors.
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for
+// more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package model
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/syncthing/syncthing/internal/protocol"
+)
+
+// Files are versioned with a Lamport clock rather than version vectors. The
+// copy with the highest version that isn't invalid is the global version,
+// which all devices converge on; there is no separate detection of
+// concurrent changes, as the change made last in logical time wins.
+
+// A FileVersion is the version of a file on one device, and how it compares
+// to the global version.
+type FileVersion struct {
+	Device   string // "local" for this device
+	Version  uint64
+	Modified int64
+	Deleted  bool
+	Invalid  bool
+	Global   bool
+	Reason   string
+}
+
+// FileVersions returns the versions of the file on this and on the other
+// devices sharing the folder, as far as we know them.
+func (m *Model) FileVersions(folder, name string) ([]FileVersion, error) {
+	m.fmut.RLock()
+	fs, ok := m.folderFiles[folder]
+	devices := m.folderDevices[folder]
+	m.fmut.RUnlock()
+
+	if !ok {
+		return nil, errors.New("no such folder")
+	}
+
+	global, hasGlobal := fs.GetGlobal(name)
+
+	var versions []FileVersion
+	add := func(device string, f protocol.FileInfo) {
+		v := FileVersion{
+			Device:   device,
+			Version:  f.Version,
+			Modified: f.Modified,
+			Deleted:  f.IsDeleted(),
+			Invalid:  f.IsInvalid(),
+		}
+		switch {
+		case f.IsInvalid():
+			v.Reason = "invalid, so not considered for the global version"
+		case !hasGlobal:
+			v.Reason = "no global version"
+		case f.Version == global.Version:
+			v.Global = true
+			v.Reason = "the highest valid version, which is the global version"
+		case f.Version > global.Version:
+			v.Reason = fmt.Sprintf("newer than the global version %d, which is not updated yet", global.Version)
+		default:
+			v.Reason = fmt.Sprintf("older than the global version %d, so replaced by it", global.Version)
+		}
+		versions = append(versions, v)
+	}
+
+	if f, ok := fs.Get(protocol.LocalDeviceID, name); ok {
+		add("local", f)
+	}
+	for _, device := range devices {
+		if f, ok := fs.Get(device, name); ok {
+			add(device.String(), f)
+		}
+	}
+
+	if len(versions) == 0 {
+		return nil, errors.New("no such file")
+	}
+	return versions, nil
+}
+
+// The values of NeedReason.Kind.
+const (
+	NeedCreate   = "create"
+	NeedUpdate   = "update"
+	NeedDelete   = "delete"
+	NeedConflict = "conflict" // differs only in case from another file, so pulled as a conflict copy
+)
+
+// A NeedReason tells whether a file is needed, that is going to be pulled,
+// and why.
+type NeedReason struct {
+	Needed        bool
+	Kind          string   // one of the Need* constants, when needed
+	LocalVersion  uint64   // zero when we don't have the file
+	GlobalVersion uint64   // zero when there is no global version
+	Devices       []string // the devices with the global version
+	Reason        string
+}
+
+// WhyNeeded explains whether the file is needed, making the same decision
+// as when the needed files are listed.
+func (m *Model) WhyNeeded(folder, name string) (NeedReason, error) {
+	m.fmut.RLock()
+	fs, ok := m.folderFiles[folder]
+	folderCfg := m.folderCfgs[folder]
+	runner := m.folderRunners[folder]
+	m.fmut.RUnlock()
+
+	if !ok {
+		return NeedReason{}, errors.New("no such folder")
+	}
+
+	local, have := fs.Get(protocol.LocalDeviceID, name)
+	global, hasGlobal := fs.GetGlobal(name)
+	if !have && !hasGlobal {
+		return NeedReason{}, ErrNoSuchFile
+	}
+
+	var r NeedReason
+	if have {
+		r.LocalVersion = local.Version
+	}
+	if !hasGlobal {
+		r.Reason = fmt.Sprintf("not needed: local@%d is invalid and no device has a valid copy", r.LocalVersion)
+		return r, nil
+	}
+	r.GlobalVersion = global.Version
+
+	var names []string
+	for _, device := range fs.Availability(name) {
+		if device == protocol.LocalDeviceID {
+			r.Devices = append(r.Devices, "local")
+			continue
+		}
+		r.Devices = append(r.Devices, device.String())
+		names = append(names, fmt.Sprintf("%s@%d", m.displayName(device), global.Version))
+	}
+
+	switch {
+	case have && local.Version >= global.Version:
+		r.Reason = fmt.Sprintf("not needed: local@%d is the global version", local.Version)
+		return r, nil
+	case !have && global.IsDeleted():
+		r.Reason = fmt.Sprintf("not needed: deleted by %s and not present locally", strings.Join(names, ", "))
+		return r, nil
+	case !folderCfg.Selected(name):
+		r.Reason = "not needed: not in selected directories"
+		return r, nil
+	}
+
+	r.Needed = true
+	switch {
+	case global.IsDeleted():
+		r.Kind = NeedDelete
+	case !have:
+		r.Kind = NeedCreate
+	default:
+		r.Kind = NeedUpdate
+	}
+	if p, ok := runner.(*Puller); ok && !global.IsDeleted() {
+		if p.caseCollision(name) != "" {
+			r.Kind = NeedConflict
+		}
+	}
+
+	if have {
+		r.Reason = fmt.Sprintf("needed because %s > local@%d (%s)", strings.Join(names, ", "), local.Version, r.Kind)
+	} else {
+		r.Reason = fmt.Sprintf("needed because %s and not present locally (%s)", strings.Join(names, ", "), r.Kind)
+	}
+	return r, nil
+}
@@ -0,0 +1,144 @@
+// Copyright (C) 2014 The Syncthing Authors.
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for
+// more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package model
+
+import (
+	"testing"
+
+	"github.com/syncthing/syncthing/internal/config"
+	"github.com/syncthing/syncthing/internal/protocol"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+)
+
+func TestFileVersions(t *testing.T) {
+	fcfg := config.FolderConfiguration{
+		ID:      "default",
+		Path:    "testdata",
+		Devices: []config.FolderDeviceConfiguration{{DeviceID: device1}, {DeviceID: device2}},
+	}
+	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	m := NewModel(config.Wrap("/tmp/test", config.Configuration{Folders: []config.FolderConfiguration{fcfg}}), "device", "syncthing", "dev", db)
+	m.AddFolder(fcfg)
+
+	m.updateLocal("default", protocol.FileInfo{Name: "file", Version: 4})
+	m.Index(device1, "default", []protocol.FileInfo{{Name: "file", Version: 5}})
+	m.Index(device2, "default", []protocol.FileInfo{{Name: "file", Version: 6, Flags: protocol.FlagInvalid}})
+
+	versions, err := m.FileVersions("default", "file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 3 {
+		t.Fatalf("Unexpected versions %+v", versions)
+	}
+
+	expected := []struct {
+		device  string
+		version uint64
+		global  bool
+	}{
+		{"local", 4, false},
+		{device1.String(), 5, true},
+		{device2.String(), 6, false},
+	}
+	for i, e := range expected {
+		v := versions[i]
+		if v.Device != e.device || v.Version != e.version || v.Global != e.global || v.Reason == "" {
+			t.Errorf("Unexpected version %+v, expected %+v", v, e)
+		}
+	}
+	if !versions[2].Invalid {
+		t.Error("Invalid copy not reported as such")
+	}
+
+	if _, err := m.FileVersions("default", "nonexistent"); err == nil {
+		t.Error("Unexpected versions of a nonexistent file")
+	}
+	if _, err := m.FileVersions("nonexistent", "file"); err == nil {
+		t.Error("Unexpected versions in a nonexistent folder")
+	}
+}
+
+func TestWhyNeeded(t *testing.T) {
+	fcfg := config.FolderConfiguration{
+		ID:      "default",
+		Path:    "testdata",
+		Devices: []config.FolderDeviceConfiguration{{DeviceID: device1}, {DeviceID: device2}},
+	}
+	cfg := config.Configuration{
+		Devices: []config.DeviceConfiguration{{DeviceID: device1, Name: "laptop"}, {DeviceID: device2}},
+		Folders: []config.FolderConfiguration{fcfg},
+	}
+	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	m := NewModel(config.Wrap("/tmp/test", cfg), "device", "syncthing", "dev", db)
+	m.AddFolder(fcfg)
+
+	m.updateLocal("default", protocol.FileInfo{Name: "updated", Version: 5})
+	m.updateLocal("default", protocol.FileInfo{Name: "insync", Version: 5})
+	m.updateLocal("default", protocol.FileInfo{Name: "removed", Version: 5})
+	m.Index(device1, "default", []protocol.FileInfo{
+		{Name: "updated", Version: 7},
+		{Name: "insync", Version: 5},
+		{Name: "created", Version: 3},
+		{Name: "removed", Version: 8, Flags: protocol.FlagDeleted},
+		{Name: "gone", Version: 2, Flags: protocol.FlagDeleted},
+	})
+
+	cases := []struct {
+		file   string
+		needed bool
+		kind   string
+		reason string
+	}{
+		{"updated", true, NeedUpdate, "needed because laptop@7 > local@5 (update)"},
+		{"created", true, NeedCreate, "needed because laptop@3 and not present locally (create)"},
+		{"removed", true, NeedDelete, "needed because laptop@8 > local@5 (delete)"},
+		{"insync", false, "", "not needed: local@5 is the global version"},
+		{"gone", false, "", "not needed: deleted by laptop@2 and not present locally"},
+	}
+	for _, tc := range cases {
+		r, err := m.WhyNeeded("default", tc.file)
+		if err != nil {
+			t.Errorf("%s: %v", tc.file, err)
+			continue
+		}
+		if r.Needed != tc.needed || r.Kind != tc.kind || r.Reason != tc.reason {
+			t.Errorf("%s: unexpected reason %+v", tc.file, r)
+		}
+	}
+
+	r, _ := m.WhyNeeded("default", "updated")
+	if r.LocalVersion != 5 || r.GlobalVersion != 7 || len(r.Devices) != 1 || r.Devices[0] != device1.String() {
+		t.Errorf("Unexpected versions %+v", r)
+	}
+
+	m.fmut.Lock()
+	sel := m.folderCfgs["default"]
+	sel.SelectedDirs = []string{"other"}
+	m.folderCfgs["default"] = sel
+	m.fmut.Unlock()
+	if r, _ := m.WhyNeeded("default", "updated"); r.Needed || r.Reason != "not needed: not in selected directories" {
+		t.Errorf("Unexpected reason %+v outside the selected directories", r)
+	}
+
+	if _, err := m.WhyNeeded("default", "nonexistent"); err != ErrNoSuchFile {
+		t.Errorf("Unexpected error %v for a nonexistent file", err)
+	}
+	if _, err := m.WhyNeeded("nonexistent", "file"); err == nil {
+		t.Error("Unexpected reason in a nonexistent folder")
+	}
+}
@@ -0,0 +1,181 @@
+// Copyright (C) 2014 The Syncthing Authors.
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for
+// more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package model
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"time"
+)
+
+// A stallWatchdog looks for folders that are scanning or syncing, but have
+// made no progress for a while, and dumps the stacks of all goroutines so
+// that there is something to file in a bug report.
+type stallWatchdog struct {
+	model   *Model
+	timeout time.Duration
+	dumpDir string // where dumps are written as well as logged; empty for the log only
+	restart bool   // restart stalled folders after dumping
+
+	reported map[string]time.Time // folder -> last progress when reported, so each stall is reported once
+}
+
+// StartStallWatchdog starts watching the folders for stalls longer than the
+// timeout.
+func (m *Model) StartStallWatchdog(timeout time.Duration, dumpDir string, restart bool) {
+	w := &stallWatchdog{
+		model:    m,
+		timeout:  timeout,
+		dumpDir:  dumpDir,
+		restart:  restart,
+		reported: make(map[string]time.Time),
+	}
+	go w.serve()
+}
+
+func (w *stallWatchdog) serve() {
+	for {
+		time.Sleep(w.timeout / 4)
+		if stalled := w.stalled(time.Now()); len(stalled) > 0 {
+			w.dump(stalled, time.Now())
+			if w.restart {
+				for _, folder := range stalled {
+					l.Infof("Restarting stalled folder %q", folder)
+					go w.model.restartFolder(folder)
+				}
+			}
+		}
+	}
+}
+
+// stalled returns the folders, in order, that have work but have made no
+// progress since timeout before now and haven't been reported yet.
+func (w *stallWatchdog) stalled(now time.Time) []string {
+	m := w.model
+
+	m.smut.RLock()
+	var busy []string
+	for folder, state := range m.folderState {
+		switch state {
+		case FolderScanning, FolderSyncing, FolderCleaning:
+			busy = append(busy, folder)
+		}
+	}
+	m.smut.RUnlock()
+
+	var stalled []string
+	m.actMut.Lock()
+	for _, folder := range busy {
+		last := m.folderActivity[folder]
+		if now.Sub(last) > w.timeout && !w.reported[folder].Equal(last) {
+			w.reported[folder] = last
+			stalled = append(stalled, folder)
+		}
+	}
+	m.actMut.Unlock()
+
+	sort.Strings(stalled)
+	return stalled
+}
+
+// dump logs the stacks of all goroutines, and writes them to a file if
+// requested.
+func (w *stallWatchdog) dump(stalled []string, now time.Time) {
+	var buf bytes.Buffer
+	w.model.actMut.Lock()
+	for _, folder := range stalled {
+		fmt.Fprintf(&buf, "Folder %q has made no progress since %v\n", folder, w.model.folderActivity[folder].Format(time.RFC3339))
+	}
+	w.model.actMut.Unlock()
+	buf.WriteString("\n")
+	buf.Write(goroutineStacks())
+
+	l.Warnf("Stalled folders detected; stacks of all goroutines follow\n%s", buf.Bytes())
+
+	if w.dumpDir != "" {
+		name := filepath.Join(w.dumpDir, "stall-"+now.Format("20060102-150405")+".txt")
+		if err := ioutil.WriteFile(name, buf.Bytes(), 0600); err != nil {
+			l.Warnln("Writing stall dump:", err)
+			return
+		}
+		l.Infoln("Stall dump written to", name)
+	}
+}
+
+// goroutineStacks returns the stacks of all goroutines, however many there
+// are.
+func goroutineStacks() []byte {
+	buf := make([]byte, 1<<20)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) {
+			return buf[:n]
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+}
+
+// folderProgressed records that the folder has just made progress scanning
+// or pulling.
+func (m *Model) folderProgressed(folder string) {
+	m.actMut.Lock()
+	m.folderActivity[folder] = time.Now()
+	m.actMut.Unlock()
+}
+
+// restartFolder replaces the runner of the folder with a new one. The old
+// runner is told to stop, and the new one is only started once it has, so
+// that they never work on the folder at the same time. If the old runner is
+// stuck it returns once it gets unstuck; the folder isn't restarted again
+// meanwhile, as the runner has already been told to stop.
+func (m *Model) restartFolder(folder string) {
+	m.fmut.Lock()
+	cfg, ok := m.folderCfgs[folder]
+	runner, running := m.folderRunners[folder]
+	done := m.runnerDone[folder]
+	if !ok || !running || m.restarting[folder] {
+		m.fmut.Unlock()
+		return
+	}
+	m.restarting[folder] = true
+	m.fmut.Unlock()
+
+	runner.Stop()
+	if done != nil {
+		<-done
+	}
+
+	m.fmut.Lock()
+	delete(m.restarting, folder)
+	if m.folderRunners[folder] != runner {
+		// Replaced or removed while stopping.
+		m.fmut.Unlock()
+		return
+	}
+	delete(m.folderRunners, folder)
+	m.fmut.Unlock()
+
+	m.folderProgressed(folder)
+	if !cfg.Pulls() {
+		m.StartFolderRO(folder)
+	} else {
+		m.StartFolderRW(folder)
+	}
+}
@@ -0,0 +1,162 @@
+// Copyright (C) 2014 The Syncthing Authors.
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for
+// more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package model
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/syncthing/syncthing/internal/config"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+)
+
+func TestStallWatchdog(t *testing.T) {
+	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	m := NewModel(config.Wrap("/tmp/test", config.Configuration{}), "device", "syncthing", "dev", db)
+	w := &stallWatchdog{model: m, timeout: time.Minute, reported: make(map[string]time.Time)}
+
+	m.setState("idle", FolderIdle)
+	m.setState("syncing", FolderSyncing)
+	m.setState("scanning", FolderScanning)
+
+	now := time.Now()
+	if stalled := w.stalled(now); len(stalled) != 0 {
+		t.Errorf("Nothing should have stalled yet, not %v", stalled)
+	}
+
+	// Only the folders with work have stalled, and each stall is reported
+	// once.
+	later := now.Add(2 * time.Minute)
+	if stalled := w.stalled(later); len(stalled) != 2 || stalled[0] != "scanning" || stalled[1] != "syncing" {
+		t.Errorf("Expected the scanning and syncing folders to have stalled, not %v", stalled)
+	}
+	if stalled := w.stalled(later); len(stalled) != 0 {
+		t.Errorf("Stalls should be reported once, not again for %v", stalled)
+	}
+
+	// Progress ends the stall, and a new one is reported again.
+	m.folderProgressed("syncing")
+	even := time.Now().Add(4 * time.Minute)
+	if stalled := w.stalled(even); len(stalled) != 1 || stalled[0] != "syncing" {
+		t.Errorf("Expected a new stall of the syncing folder, not %v", stalled)
+	}
+}
+
+func TestStallWatchdogDump(t *testing.T) {
+	dir, err := ioutil.TempDir("", "syncthing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	m := NewModel(config.Wrap("/tmp/test", config.Configuration{}), "device", "syncthing", "dev", db)
+	w := &stallWatchdog{model: m, timeout: time.Minute, dumpDir: dir}
+
+	m.setState("default", FolderSyncing)
+	w.dump([]string{"default"}, time.Date(2015, 3, 4, 5, 6, 7, 0, time.Local))
+
+	bs, err := ioutil.ReadFile(filepath.Join(dir, "stall-20150304-050607.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dump := string(bs); !strings.Contains(dump, `Folder "default" has made no progress`) || !strings.Contains(dump, "TestStallWatchdogDump") {
+		t.Errorf("Dump lacks the folder or the goroutines:\n%s", dump)
+	}
+}
+
+func TestRestartFolder(t *testing.T) {
+	fcfg := config.FolderConfiguration{ID: "default", Path: "testdata", ReadOnly: true}
+	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	m := NewModel(config.Wrap("/tmp/test", config.Configuration{Folders: []config.FolderConfiguration{fcfg}}), "device", "syncthing", "dev", db)
+	m.AddFolder(fcfg)
+	m.StartFolderRO("default")
+
+	m.fmut.RLock()
+	old := m.folderRunners["default"]
+	m.fmut.RUnlock()
+
+	m.restartFolder("default")
+
+	m.fmut.RLock()
+	cur := m.folderRunners["default"]
+	m.fmut.RUnlock()
+	if cur == nil || cur == old {
+		t.Error("Folder should have a new runner")
+	}
+	cur.Stop()
+}
+
+type stuckRunner struct {
+	stopped chan struct{}
+	unstuck chan struct{}
+}
+
+func (r *stuckRunner) Serve()                   { <-r.unstuck }
+func (r *stuckRunner) Stop()                    { close(r.stopped) }
+func (*stuckRunner) Jobs() ([]string, []string) { return nil, nil }
+func (*stuckRunner) BringToFront(string)        {}
+
+func TestRestartStuckFolder(t *testing.T) {
+	fcfg := config.FolderConfiguration{ID: "default", Path: "testdata", ReadOnly: true}
+	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	m := NewModel(config.Wrap("/tmp/test", config.Configuration{Folders: []config.FolderConfiguration{fcfg}}), "device", "syncthing", "dev", db)
+	m.AddFolder(fcfg)
+
+	old := &stuckRunner{stopped: make(chan struct{}), unstuck: make(chan struct{})}
+	m.fmut.Lock()
+	m.folderRunners["default"] = old
+	m.fmut.Unlock()
+	m.serveRunner("default", old)
+
+	restarted := make(chan struct{})
+	go func() {
+		m.restartFolder("default")
+		close(restarted)
+	}()
+
+	// The stuck runner is told to stop, but kept until it does.
+	<-old.stopped
+	select {
+	case <-restarted:
+		t.Fatal("Folder restarted while its runner is stuck")
+	case <-time.After(100 * time.Millisecond):
+	}
+	m.fmut.RLock()
+	cur := m.folderRunners["default"]
+	m.fmut.RUnlock()
+	if cur != old {
+		t.Error("Stuck runner should be kept until it returns")
+	}
+
+	// Stalling again doesn't tell it to stop a second time.
+	m.restartFolder("default")
+
+	close(old.unstuck)
+	<-restarted
+	m.fmut.RLock()
+	cur = m.folderRunners["default"]
+	m.fmut.RUnlock()
+	if cur == nil || cur == old {
+		t.Error("Folder should have a new runner")
+	}
+	cur.Stop()
+}
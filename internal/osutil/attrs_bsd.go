@@ -0,0 +1,102 @@
+// Copyright (C) 2014 The Syncthing Authors.
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for
+// more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program. If not, see <http://www.gnu.org/licenses/>.
+
+// +build darwin freebsd
+
+package osutil
+
+import (
+	"os"
+	"syscall"
+
+	"github.com/syncthing/syncthing/internal/protocol"
+)
+
+// SupportedAttributes are the file attributes kept by the operating system.
+const SupportedAttributes = protocol.AttrHidden | protocol.AttrImmutable
+
+// The user settable file flags, from sys/stat.h.
+const (
+	ufImmutable = 0x00000002
+	ufHidden    = 0x00008000
+)
+
+var bsdAttributes = []struct {
+	attr uint32
+	flag uint32
+}{
+	{protocol.AttrHidden, ufHidden},
+	{protocol.AttrImmutable, ufImmutable},
+}
+
+func fileFlags(path string) (uint32, error) {
+	info, err := os.Lstat(path)
+	if err != nil {
+		return 0, err
+	}
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, ErrAttributesUnsupported
+	}
+	return st.Flags, nil
+}
+
+// FileAttributes returns the supported attributes of the file, or of the
+// symlink itself.
+func FileAttributes(path string) (uint32, error) {
+	flags, err := fileFlags(path)
+	if err != nil {
+		return 0, err
+	}
+
+	var attrs uint32
+	for _, a := range bsdAttributes {
+		if flags&a.flag != 0 {
+			attrs |= a.attr
+		}
+	}
+	return attrs, nil
+}
+
+// SetFileAttributes sets the supported attributes of the file to those in
+// attrs, leaving the others alone. A symlink, and its target, are left
+// alone, as chflags follows it.
+func SetFileAttributes(path string, attrs uint32) error {
+	if info, err := os.Lstat(path); err != nil {
+		return err
+	} else if info.Mode()&os.ModeSymlink != 0 {
+		return nil
+	}
+	flags, err := fileFlags(path)
+	if err != nil {
+		return err
+	}
+
+	newFlags := flags
+	for _, a := range bsdAttributes {
+		if attrs&a.attr != 0 {
+			newFlags |= a.flag
+		} else {
+			newFlags &^= a.flag
+		}
+	}
+	if newFlags == flags {
+		return nil
+	}
+	if err := syscall.Chflags(path, int(newFlags)); err != nil {
+		return &os.PathError{Op: "chflags", Path: path, Err: err}
+	}
+	return nil
+}
@@ -0,0 +1,104 @@
+// Copyright (C) 2014 The Syncthing Authors.
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for
+// more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program. If not, see <http://www.gnu.org/licenses/>.
+
+// +build linux
+
+package osutil
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+
+	"github.com/syncthing/syncthing/internal/protocol"
+)
+
+// SupportedAttributes are the file attributes kept by the operating system.
+const SupportedAttributes = protocol.AttrImmutable
+
+// The inode flag ioctls, from linux/fs.h, as encoded on x86 and ARM. They
+// are defined as taking a long, but the kernel reads and writes an int.
+const (
+	fsIocGetFlags = 0x80006601 | unsafe.Sizeof(uintptr(0))<<16
+	fsIocSetFlags = 0x40006602 | unsafe.Sizeof(uintptr(0))<<16
+	fsImmutableFl = 0x00000010
+)
+
+func inodeFlags(fd *os.File, req uintptr, flags *int32) error {
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd.Fd(), req, uintptr(unsafe.Pointer(flags)))
+	if errno != 0 {
+		if errno == syscall.ENOTTY || errno == syscall.EOPNOTSUPP {
+			// Not a file system keeping the flags.
+			return ErrAttributesUnsupported
+		}
+		return &os.PathError{Op: "ioctl", Path: fd.Name(), Err: errno}
+	}
+	return nil
+}
+
+// openNoFollow opens the file or directory for the inode flag ioctls,
+// returning a nil file for a symlink, which has no flags of its own.
+func openNoFollow(path string) (*os.File, error) {
+	fd, err := os.OpenFile(path, os.O_RDONLY|syscall.O_NONBLOCK|syscall.O_NOFOLLOW, 0)
+	if pe, ok := err.(*os.PathError); ok && pe.Err == syscall.ELOOP {
+		return nil, nil
+	}
+	return fd, err
+}
+
+// FileAttributes returns the supported attributes of the file. A symlink
+// has none; the attributes of its target aren't looked at.
+func FileAttributes(path string) (uint32, error) {
+	fd, err := openNoFollow(path)
+	if fd == nil {
+		return 0, err
+	}
+	defer fd.Close()
+
+	var flags int32
+	if err := inodeFlags(fd, fsIocGetFlags, &flags); err != nil {
+		return 0, err
+	}
+	var attrs uint32
+	if flags&fsImmutableFl != 0 {
+		attrs |= protocol.AttrImmutable
+	}
+	return attrs, nil
+}
+
+// SetFileAttributes sets the supported attributes of the file to those in
+// attrs, leaving the others alone. Changing the immutable attribute takes
+// the CAP_LINUX_IMMUTABLE capability. A symlink, and its target, are left
+// alone.
+func SetFileAttributes(path string, attrs uint32) error {
+	fd, err := openNoFollow(path)
+	if fd == nil {
+		return err
+	}
+	defer fd.Close()
+
+	var flags int32
+	if err := inodeFlags(fd, fsIocGetFlags, &flags); err != nil {
+		return err
+	}
+	newFlags := flags &^ fsImmutableFl
+	if attrs&protocol.AttrImmutable != 0 {
+		newFlags |= fsImmutableFl
+	}
+	if newFlags == flags {
+		return nil
+	}
+	return inodeFlags(fd, fsIocSetFlags, &newFlags)
+}
@@ -0,0 +1,29 @@
+// Copyright (C) 2014 The Syncthing Authors.
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for
+// more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program. If not, see <http://www.gnu.org/licenses/>.
+
+// +build !linux,!darwin,!freebsd,!windows
+
+package osutil
+
+// SupportedAttributes are the file attributes kept by the operating system.
+const SupportedAttributes = 0
+
+func FileAttributes(path string) (uint32, error) {
+	return 0, ErrAttributesUnsupported
+}
+
+func SetFileAttributes(path string, attrs uint32) error {
+	return ErrAttributesUnsupported
+}
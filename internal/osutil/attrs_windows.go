@@ -0,0 +1,78 @@
+// Copyright (C) 2014 The Syncthing Authors.
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for
+// more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program. If not, see <http://www.gnu.org/licenses/>.
+
+// +build windows
+
+package osutil
+
+import (
+	"syscall"
+
+	"github.com/syncthing/syncthing/internal/protocol"
+)
+
+// SupportedAttributes are the file attributes kept by the operating system.
+const SupportedAttributes = protocol.AttrHidden | protocol.AttrSystem | protocol.AttrReadOnly
+
+var winAttributes = []struct {
+	attr uint32
+	win  uint32
+}{
+	{protocol.AttrHidden, syscall.FILE_ATTRIBUTE_HIDDEN},
+	{protocol.AttrSystem, syscall.FILE_ATTRIBUTE_SYSTEM},
+	{protocol.AttrReadOnly, syscall.FILE_ATTRIBUTE_READONLY},
+}
+
+// FileAttributes returns the supported attributes of the file.
+func FileAttributes(path string) (uint32, error) {
+	p, err := syscall.UTF16PtrFromString(path)
+	if err != nil {
+		return 0, err
+	}
+	wattrs, err := syscall.GetFileAttributes(p)
+	if err != nil {
+		return 0, err
+	}
+
+	var attrs uint32
+	for _, a := range winAttributes {
+		if wattrs&a.win != 0 {
+			attrs |= a.attr
+		}
+	}
+	return attrs, nil
+}
+
+// SetFileAttributes sets the supported attributes of the file to those in
+// attrs, leaving the others alone.
+func SetFileAttributes(path string, attrs uint32) error {
+	p, err := syscall.UTF16PtrFromString(path)
+	if err != nil {
+		return err
+	}
+	wattrs, err := syscall.GetFileAttributes(p)
+	if err != nil {
+		return err
+	}
+
+	for _, a := range winAttributes {
+		if attrs&a.attr != 0 {
+			wattrs |= a.win
+		} else {
+			wattrs &^= a.win
+		}
+	}
+	return syscall.SetFileAttributes(p, wattrs)
+}
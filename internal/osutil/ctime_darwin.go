@@ -0,0 +1,70 @@
+// Copyright (C) 2014 The Syncthing Authors.
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for
+// more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package osutil
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+func CreationTime(info os.FileInfo) (int64, bool) {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, false
+	}
+	return syscall.TimespecToNsec(st.Birthtimespec), true
+}
+
+// attrList is struct attrlist from <sys/attr.h>, selecting the attributes
+// to set with setattrlist(2).
+type attrList struct {
+	bitmapCount uint16
+	reserved    uint16
+	commonAttr  uint32
+	volAttr     uint32
+	dirAttr     uint32
+	fileAttr    uint32
+	forkAttr    uint32
+}
+
+const (
+	attrBitMapCount = 5
+	attrCmnCrtime   = 0x00000200
+	fsoptNofollow   = 0x00000001
+)
+
+func SetCreationTime(path string, t int64) error {
+	p, err := syscall.BytePtrFromString(path)
+	if err != nil {
+		return err
+	}
+	attrs := attrList{
+		bitmapCount: attrBitMapCount,
+		commonAttr:  attrCmnCrtime,
+	}
+	ts := syscall.NsecToTimespec(t)
+	_, _, errno := syscall.Syscall6(syscall.SYS_SETATTRLIST, uintptr(unsafe.Pointer(p)), uintptr(unsafe.Pointer(&attrs)),
+		uintptr(unsafe.Pointer(&ts)), unsafe.Sizeof(ts), fsoptNofollow, 0)
+	switch errno {
+	case 0:
+		return nil
+	case syscall.ENOTSUP, syscall.EINVAL:
+		return ErrCreationTimeUnsupported
+	default:
+		return &os.PathError{Op: "setattrlist", Path: path, Err: errno}
+	}
+}
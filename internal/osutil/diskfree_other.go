@@ -0,0 +1,26 @@
+// Copyright (C) 2014 The Syncthing Authors.
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for
+// more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program. If not, see <http://www.gnu.org/licenses/>.
+
+// +build !linux,!darwin,!freebsd,!windows
+
+package osutil
+
+import "errors"
+
+// DiskFree returns the space available to us and the total size, in bytes,
+// of the filesystem holding path. It's not supported on this platform.
+func DiskFree(path string) (free, total uint64, err error) {
+	return 0, 0, errors.New("disk space not available on this platform")
+}
@@ -0,0 +1,38 @@
+// Copyright (C) 2014 The Syncthing Authors.
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for
+// more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program. If not, see <http://www.gnu.org/licenses/>.
+
+// +build !windows
+
+package osutil
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// HardlinkID returns an identifier shared by all hard links to the file
+// described by info, or the empty string if there is only one link to it.
+// The boolean is false if this can't be determined.
+func HardlinkID(info os.FileInfo) (string, bool) {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return "", false
+	}
+	if st.Nlink <= 1 {
+		return "", true
+	}
+	return fmt.Sprintf("%x:%x", uint64(st.Dev), uint64(st.Ino)), true
+}
@@ -0,0 +1,28 @@
+// Copyright (C) 2014 The Syncthing Authors.
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for
+// more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package osutil
+
+// IOPriority is the I/O scheduling priority of a thread.
+type IOPriority int
+
+const (
+	// IOPriorityNormal leaves the priority as it is.
+	IOPriorityNormal IOPriority = iota
+	// IOPriorityLow is the lowest level of the best effort class.
+	IOPriorityLow
+	// IOPriorityIdle only gets disk time when no one else wants it.
+	IOPriorityIdle
+)
@@ -0,0 +1,53 @@
+// Copyright (C) 2014 The Syncthing Authors.
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for
+// more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package osutil
+
+import "syscall"
+
+const (
+	ioprioWhoProcess = 1
+	ioprioClassShift = 13
+	ioprioClassBE    = 2
+	ioprioClassIdle  = 3
+)
+
+// SetIOPriority sets the I/O priority of the calling thread and returns a
+// function setting it back to what it was. The caller must have locked the
+// goroutine to its thread with runtime.LockOSThread.
+func SetIOPriority(p IOPriority) (func(), error) {
+	var prio uintptr
+	switch p {
+	case IOPriorityLow:
+		prio = ioprioClassBE<<ioprioClassShift | 7
+	case IOPriorityIdle:
+		prio = ioprioClassIdle << ioprioClassShift
+	default:
+		return func() {}, nil
+	}
+
+	tid := uintptr(syscall.Gettid())
+	old, _, errno := syscall.Syscall(syscall.SYS_IOPRIO_GET, ioprioWhoProcess, tid, 0)
+	if errno != 0 {
+		return func() {}, errno
+	}
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOPRIO_SET, ioprioWhoProcess, tid, prio); errno != 0 {
+		return func() {}, errno
+	}
+
+	return func() {
+		syscall.Syscall(syscall.SYS_IOPRIO_SET, ioprioWhoProcess, tid, old)
+	}, nil
+}
@@ -0,0 +1,40 @@
+// Copyright (C) 2014 The Syncthing Authors.
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for
+// more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package osutil_test
+
+import (
+	"runtime"
+	"syscall"
+	"testing"
+
+	"github.com/syncthing/syncthing/internal/osutil"
+)
+
+func TestSetIOPriority(t *testing.T) {
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	for _, p := range []osutil.IOPriority{osutil.IOPriorityNormal, osutil.IOPriorityLow, osutil.IOPriorityIdle} {
+		restore, err := osutil.SetIOPriority(p)
+		if err == syscall.EPERM || err == syscall.ENOSYS {
+			t.Skip(err)
+		}
+		if err != nil {
+			t.Fatalf("priority %d: %v", p, err)
+		}
+		restore()
+	}
+}
@@ -0,0 +1,35 @@
+// Copyright (C) 2014 The Syncthing Authors.
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for
+// more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program. If not, see <http://www.gnu.org/licenses/>.
+
+// +build windows
+
+package osutil
+
+import "syscall"
+
+const (
+	errorSharingViolation = syscall.Errno(32) // ERROR_SHARING_VIOLATION
+	errorLockViolation    = syscall.Errno(33) // ERROR_LOCK_VIOLATION
+)
+
+// IsLocked returns whether the error is due to another program having the
+// file open without sharing it, or having locked the part of it being read.
+func IsLocked(err error) bool {
+	switch underlyingError(err) {
+	case errorSharingViolation, errorLockViolation:
+		return true
+	}
+	return false
+}
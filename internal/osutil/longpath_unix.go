@@ -0,0 +1,33 @@
+// Copyright (C) 2014 The Syncthing Authors.
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for
+// more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program. If not, see <http://www.gnu.org/licenses/>.
+
+// +build !windows
+
+package osutil
+
+import "syscall"
+
+// LongPath returns the path in a form that is not subject to the length
+// limit on paths imposed by the operating system. Only Windows has such a
+// limit, so elsewhere the path is returned as is.
+func LongPath(path string) string {
+	return path
+}
+
+// IsPathTooLong returns whether the error is due to a path or file name
+// being longer than the operating system or file system allows.
+func IsPathTooLong(err error) bool {
+	return underlyingError(err) == syscall.ENAMETOOLONG
+}
@@ -0,0 +1,63 @@
+// Copyright (C) 2014 The Syncthing Authors.
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for
+// more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program. If not, see <http://www.gnu.org/licenses/>.
+
+// +build windows
+
+package osutil
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+const (
+	errorPathNotFound       = syscall.Errno(3)   // ERROR_PATH_NOT_FOUND
+	errorFilenameExcedRange = syscall.Errno(206) // ERROR_FILENAME_EXCED_RANGE
+	maxPath                 = 260                // MAX_PATH, including the terminating NUL
+)
+
+// LongPath returns the path in the extended-length form, starting with
+// \\?\, that is not subject to the MAX_PATH limit. The path is made absolute,
+// as the extended-length form can't be relative.
+func LongPath(path string) string {
+	if strings.HasPrefix(path, `\\?\`) {
+		return path
+	}
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return path
+	}
+	if strings.HasPrefix(abs, `\\`) {
+		// A UNC path, \\server\share\...
+		return `\\?\UNC\` + abs[2:]
+	}
+	return `\\?\` + abs
+}
+
+// IsPathTooLong returns whether the error is due to a path or file name
+// being longer than the operating system or file system allows. Paths
+// exceeding MAX_PATH are often reported as not found.
+func IsPathTooLong(err error) bool {
+	switch underlyingError(err) {
+	case errorFilenameExcedRange:
+		return true
+	case errorPathNotFound:
+		pe, ok := err.(*os.PathError)
+		return ok && len(pe.Path) >= maxPath && !strings.HasPrefix(pe.Path, `\\?\`)
+	}
+	return false
+}
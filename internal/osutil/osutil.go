@@ -23,43 +23,51 @@ import (
 	"path/filepath"
 	"runtime"
 	"strings"
-	"sync"
 )
 
 var ErrNoHome = errors.New("No home directory found - set $HOME (or the platform equivalent).")
 
-// Try to keep this entire operation atomic-like. We shouldn't be doing this
-// often enough that there is any contention on this lock.
-var renameLock sync.Mutex
-
-// Rename renames a file, while trying hard to succeed on various systems by
-// temporarily tweaking directory permissions and removing the destination
-// file when necessary. Will make sure to delete the from file if the
-// operation fails, so use only for situations like committing a temp file to
-// it's final location.
-func Rename(from, to string) error {
-	renameLock.Lock()
-	defer renameLock.Unlock()
-
-	// Make sure the destination directory is writeable
-	toDir := filepath.Dir(to)
-	if info, err := os.Stat(toDir); err == nil && info.IsDir() && info.Mode()&0200 == 0 {
-		os.Chmod(toDir, 0755)
-		defer os.Chmod(toDir, info.Mode())
-	}
+// ErrXattrsUnsupported is returned by GetXattrs and SetXattrs when the
+// operating system or file system does not support extended attributes.
+var ErrXattrsUnsupported = errors.New("extended attributes not supported")
+
+// ErrCreationTimeUnsupported is returned by SetCreationTime when the
+// operating system or file system does not keep the creation time of files.
+var ErrCreationTimeUnsupported = errors.New("creation time not supported")
+
+// ErrAttributesUnsupported is returned by FileAttributes and
+// SetFileAttributes when the operating system keeps none of the file
+// attributes we sync.
+var ErrAttributesUnsupported = errors.New("file attributes not supported")
+
+// ErrPreallocateUnsupported is returned by Preallocate when the operating
+// system or file system can't allocate the space of a file up front.
+var ErrPreallocateUnsupported = errors.New("preallocation not supported")
+
+// ErrPowerStatusUnsupported is returned by GetPowerStatus when the operating
+// system doesn't tell, or there is no battery.
+var ErrPowerStatusUnsupported = errors.New("power status not supported")
+
+// A PowerStatus is whether we are running on battery, and how much charge
+// the battery has left.
+type PowerStatus struct {
+	OnBattery bool
+	ChargePct int
+}
 
-	// On Windows, make sure the destination file is writeable (or we can't delete it)
+// SyncDir flushes the entries of the directory to disk, making renames and
+// removals within it durable. Directories can't be synced on Windows, where
+// this does nothing.
+func SyncDir(path string) error {
 	if runtime.GOOS == "windows" {
-		os.Chmod(to, 0666)
-		err := os.Remove(to)
-		if err != nil && !os.IsNotExist(err) {
-			return err
-		}
+		return nil
 	}
-
-	// Don't leave a dangling temp file in case of rename error
-	defer os.Remove(from)
-	return os.Rename(from, to)
+	fd, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+	return fd.Sync()
 }
 
 // InWritableDir calls fn(path), while making sure that the directory
@@ -87,6 +95,21 @@ func InWritableDir(fn func(string) error, path string) error {
 	return fn(path)
 }
 
+// underlyingError returns the error returned by the system call that caused
+// err, if err is one of the errors returned by package os for failed
+// operations on files.
+func underlyingError(err error) error {
+	switch e := err.(type) {
+	case *os.PathError:
+		return e.Err
+	case *os.LinkError:
+		return e.Err
+	case *os.SyscallError:
+		return e.Err
+	}
+	return err
+}
+
 func ExpandTilde(path string) (string, error) {
 	if path == "~" {
 		return getHomeDir()
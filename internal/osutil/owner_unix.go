@@ -0,0 +1,44 @@
+// Copyright (C) 2014 The Syncthing Authors.
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for
+// more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program. If not, see <http://www.gnu.org/licenses/>.
+
+// +build !windows
+
+package osutil
+
+import (
+	"os"
+	"syscall"
+
+	"github.com/syncthing/syncthing/internal/protocol"
+)
+
+// FileOwner returns the numeric user and group id owning the file described
+// by info, if known.
+func FileOwner(info os.FileInfo) (*protocol.FileOwner, bool) {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return nil, false
+	}
+	return &protocol.FileOwner{
+		UID: st.Uid,
+		GID: st.Gid,
+	}, true
+}
+
+// CanChown returns whether we are privileged to give files away to other
+// users.
+func CanChown() bool {
+	return os.Geteuid() == 0
+}
@@ -0,0 +1,77 @@
+// Copyright (C) 2014 The Syncthing Authors.
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for
+// more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program. If not, see <http://www.gnu.org/licenses/>.
+
+// +build linux
+
+package osutil
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// GetPowerStatus returns whether we are running on battery, as told by the
+// power supplies in sysfs.
+func GetPowerStatus() (PowerStatus, error) {
+	return powerStatus("/sys/class/power_supply")
+}
+
+func powerStatus(dir string) (PowerStatus, error) {
+	supplies, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return PowerStatus{}, ErrPowerStatusUnsupported
+	}
+
+	read := func(supply, name string) string {
+		bs, _ := ioutil.ReadFile(filepath.Join(dir, supply, name))
+		return strings.TrimSpace(string(bs))
+	}
+
+	var status PowerStatus
+	var batteries, charge int
+	var mains bool
+	for _, supply := range supplies {
+		switch read(supply.Name(), "type") {
+		case "Mains", "USB":
+			if read(supply.Name(), "online") == "1" {
+				mains = true
+			}
+		case "Battery":
+			// Peripherals such as mice report their batteries too, but
+			// only as in scope of the device.
+			if read(supply.Name(), "scope") == "Device" {
+				continue
+			}
+			pct, err := strconv.Atoi(read(supply.Name(), "capacity"))
+			if err != nil {
+				continue
+			}
+			batteries++
+			charge += pct
+			if read(supply.Name(), "status") == "Discharging" {
+				status.OnBattery = true
+			}
+		}
+	}
+	if batteries == 0 {
+		return PowerStatus{}, ErrPowerStatusUnsupported
+	}
+
+	status.OnBattery = status.OnBattery && !mains
+	status.ChargePct = charge / batteries
+	return status, nil
+}
@@ -0,0 +1,57 @@
+// Copyright (C) 2014 The Syncthing Authors.
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for
+// more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package osutil
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPowerStatus(t *testing.T) {
+	dir, err := ioutil.TempDir("", "syncthing-power")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	supply := func(name string, attrs map[string]string) {
+		os.Mkdir(filepath.Join(dir, name), 0755)
+		for attr, val := range attrs {
+			if err := ioutil.WriteFile(filepath.Join(dir, name, attr), []byte(val+"\n"), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	if _, err := powerStatus(dir); err != ErrPowerStatusUnsupported {
+		t.Errorf("Unexpected error %v without a battery", err)
+	}
+
+	supply("AC", map[string]string{"type": "Mains", "online": "0"})
+	supply("BAT0", map[string]string{"type": "Battery", "capacity": "20", "status": "Discharging"})
+	supply("hidpp_battery_0", map[string]string{"type": "Battery", "scope": "Device", "capacity": "90", "status": "Discharging"})
+	if s, err := powerStatus(dir); err != nil || !s.OnBattery || s.ChargePct != 20 {
+		t.Errorf("Unexpected status %+v, %v on battery", s, err)
+	}
+
+	supply("AC", map[string]string{"online": "1"})
+	supply("BAT0", map[string]string{"status": "Charging"})
+	if s, err := powerStatus(dir); err != nil || s.OnBattery || s.ChargePct != 20 {
+		t.Errorf("Unexpected status %+v, %v on AC", s, err)
+	}
+}
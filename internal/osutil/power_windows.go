@@ -0,0 +1,54 @@
+// Copyright (C) 2014 The Syncthing Authors.
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for
+// more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program. If not, see <http://www.gnu.org/licenses/>.
+
+// +build windows
+
+package osutil
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+var getSystemPowerStatus = syscall.NewLazyDLL("kernel32.dll").NewProc("GetSystemPowerStatus")
+
+// systemPowerStatus is the SYSTEM_POWER_STATUS structure.
+type systemPowerStatus struct {
+	ACLineStatus        byte
+	BatteryFlag         byte
+	BatteryLifePercent  byte
+	SystemStatusFlag    byte
+	BatteryLifeTime     uint32
+	BatteryFullLifeTime uint32
+}
+
+// GetPowerStatus returns whether we are running on battery, as told by
+// GetSystemPowerStatus.
+func GetPowerStatus() (PowerStatus, error) {
+	var s systemPowerStatus
+	ret, _, err := getSystemPowerStatus.Call(uintptr(unsafe.Pointer(&s)))
+	if ret == 0 {
+		return PowerStatus{}, err
+	}
+
+	// 128 is "no system battery", 255 is "unknown status".
+	if s.BatteryFlag == 128 || s.BatteryFlag == 255 || s.BatteryLifePercent > 100 {
+		return PowerStatus{}, ErrPowerStatusUnsupported
+	}
+	return PowerStatus{
+		OnBattery: s.ACLineStatus == 0,
+		ChargePct: int(s.BatteryLifePercent),
+	}, nil
+}
@@ -0,0 +1,61 @@
+// Copyright (C) 2014 The Syncthing Authors.
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for
+// more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program. If not, see <http://www.gnu.org/licenses/>.
+
+// +build darwin
+
+package osutil
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// Preallocate allocates the disk space for the first size bytes of fd,
+// extending the file to size if it's smaller. The space is allocated in one
+// piece if possible.
+func Preallocate(fd *os.File, size int64) error {
+	if size == 0 {
+		return nil
+	}
+	info, err := fd.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() >= size {
+		return nil
+	}
+
+	// F_PREALLOCATE allocates from the current end of the file.
+	fst := syscall.Fstore_t{
+		Flags:   syscall.F_ALLOCATECONTIG | syscall.F_ALLOCATEALL,
+		Posmode: syscall.F_PEOFPOSMODE,
+		Length:  size - info.Size(),
+	}
+	_, _, errno := syscall.Syscall(syscall.SYS_FCNTL, fd.Fd(), syscall.F_PREALLOCATE, uintptr(unsafe.Pointer(&fst)))
+	if errno != 0 {
+		// Retry without insisting on a contiguous allocation.
+		fst.Flags = syscall.F_ALLOCATEALL
+		_, _, errno = syscall.Syscall(syscall.SYS_FCNTL, fd.Fd(), syscall.F_PREALLOCATE, uintptr(unsafe.Pointer(&fst)))
+	}
+	switch errno {
+	case 0:
+	case syscall.ENOTSUP, syscall.EINVAL:
+		return ErrPreallocateUnsupported
+	default:
+		return errno
+	}
+	return fd.Truncate(size)
+}
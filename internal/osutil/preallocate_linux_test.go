@@ -0,0 +1,54 @@
+// Copyright (C) 2014 The Syncthing Authors.
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for
+// more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package osutil_test
+
+import (
+	"io/ioutil"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/syncthing/syncthing/internal/osutil"
+)
+
+func TestPreallocate(t *testing.T) {
+	fd, err := ioutil.TempFile("", "syncthing-preallocate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(fd.Name())
+	defer fd.Close()
+
+	const size = 1 << 20
+	err = osutil.Preallocate(fd, size)
+	if err == osutil.ErrPreallocateUnsupported {
+		t.Skip(err)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := fd.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() != size {
+		t.Errorf("Preallocated file has size %d, expected %d", info.Size(), size)
+	}
+	if blocks := info.Sys().(*syscall.Stat_t).Blocks; blocks*512 < size {
+		t.Errorf("Preallocated file has %d bytes allocated, expected at least %d", blocks*512, size)
+	}
+}
@@ -0,0 +1,36 @@
+// Copyright (C) 2014 The Syncthing Authors.
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for
+// more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program. If not, see <http://www.gnu.org/licenses/>.
+
+// +build windows
+
+package osutil
+
+import "os"
+
+// Preallocate allocates the disk space for the first size bytes of fd,
+// extending the file to size if it's smaller. NTFS allocates the clusters
+// of a file that isn't sparse when it's extended, so this is a truncation.
+// The space is only zeroed as it's written, which SetFileValidData would
+// avoid, but that needs a privilege we don't normally have.
+func Preallocate(fd *os.File, size int64) error {
+	info, err := fd.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() >= size {
+		return nil
+	}
+	return fd.Truncate(size)
+}
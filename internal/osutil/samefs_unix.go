@@ -0,0 +1,62 @@
+// Copyright (C) 2014 The Syncthing Authors.
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for
+// more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program. If not, see <http://www.gnu.org/licenses/>.
+
+// +build !windows
+
+package osutil
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// SameFilesystem returns whether the two paths are on the same filesystem,
+// so that files can be renamed from one to the other.
+func SameFilesystem(a, b string) (bool, error) {
+	ai, err := os.Stat(a)
+	if err != nil {
+		return false, err
+	}
+	bi, err := os.Stat(b)
+	if err != nil {
+		return false, err
+	}
+	as, aok := ai.Sys().(*syscall.Stat_t)
+	bs, bok := bi.Sys().(*syscall.Stat_t)
+	if !aok || !bok {
+		// Can't tell, so assume the worst
+		return false, nil
+	}
+	return as.Dev == bs.Dev, nil
+}
+
+// IsMountpoint returns whether the directory at path is the root of a
+// mounted filesystem, that is on another filesystem than its parent.
+func IsMountpoint(path string) (bool, error) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return false, err
+	}
+	parent := filepath.Dir(path)
+	if parent == path {
+		return true, nil
+	}
+	same, err := SameFilesystem(path, parent)
+	if err != nil {
+		return false, err
+	}
+	return !same, nil
+}
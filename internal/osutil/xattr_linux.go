@@ -0,0 +1,143 @@
+// Copyright (C) 2014 The Syncthing Authors.
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for
+// more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package osutil
+
+import (
+	"bytes"
+	"sort"
+	"strings"
+	"syscall"
+
+	"github.com/syncthing/syncthing/internal/protocol"
+)
+
+// Only attributes in the user namespace are synced. The others (security,
+// system, trusted) are either owned by the system or require privileges to
+// set.
+const xattrNamespace = "user."
+
+// GetXattrs returns the extended attributes of the named file, sorted by
+// name.
+func GetXattrs(path string) ([]protocol.Xattr, error) {
+	names, err := listXattrs(path)
+	if err != nil {
+		return nil, xattrError(err)
+	}
+
+	var xattrs []protocol.Xattr
+	for _, name := range names {
+		if !strings.HasPrefix(name, xattrNamespace) {
+			continue
+		}
+		val, err := getXattr(path, name)
+		if err == syscall.ENODATA {
+			// Removed since we listed it
+			continue
+		} else if err != nil {
+			return nil, xattrError(err)
+		}
+		xattrs = append(xattrs, protocol.Xattr{Name: name, Value: val})
+	}
+
+	sort.Sort(xattrList(xattrs))
+	return xattrs, nil
+}
+
+// SetXattrs sets the extended attributes of the named file to xattrs,
+// removing any existing attributes that are not in the list.
+func SetXattrs(path string, xattrs []protocol.Xattr) error {
+	names, err := listXattrs(path)
+	if err != nil {
+		return xattrError(err)
+	}
+
+	keep := make(map[string]struct{}, len(xattrs))
+	for _, x := range xattrs {
+		keep[x.Name] = struct{}{}
+		if err := syscall.Setxattr(path, x.Name, x.Value, 0); err != nil {
+			return xattrError(err)
+		}
+	}
+
+	for _, name := range names {
+		if !strings.HasPrefix(name, xattrNamespace) {
+			continue
+		}
+		if _, ok := keep[name]; ok {
+			continue
+		}
+		if err := syscall.Removexattr(path, name); err != nil && err != syscall.ENODATA {
+			return xattrError(err)
+		}
+	}
+
+	return nil
+}
+
+func listXattrs(path string) ([]string, error) {
+	for {
+		size, err := syscall.Listxattr(path, nil)
+		if err != nil || size == 0 {
+			return nil, err
+		}
+		buf := make([]byte, size)
+		size, err = syscall.Listxattr(path, buf)
+		if err == syscall.ERANGE {
+			// The list grew between the calls
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		var names []string
+		for _, name := range bytes.Split(buf[:size], []byte{0}) {
+			if len(name) > 0 {
+				names = append(names, string(name))
+			}
+		}
+		return names, nil
+	}
+}
+
+func getXattr(path, name string) ([]byte, error) {
+	for {
+		size, err := syscall.Getxattr(path, name, nil)
+		if err != nil || size == 0 {
+			return nil, err
+		}
+		buf := make([]byte, size)
+		size, err = syscall.Getxattr(path, name, buf)
+		if err == syscall.ERANGE {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		return buf[:size], nil
+	}
+}
+
+func xattrError(err error) error {
+	if err == syscall.ENOTSUP {
+		return ErrXattrsUnsupported
+	}
+	return err
+}
+
+type xattrList []protocol.Xattr
+
+func (l xattrList) Len() int           { return len(l) }
+func (l xattrList) Less(a, b int) bool { return l[a].Name < l[b].Name }
+func (l xattrList) Swap(a, b int)      { l[a], l[b] = l[b], l[a] }
@@ -0,0 +1,67 @@
+// Copyright (C) 2014 The Syncthing Authors.
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for
+// more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package osutil_test
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/syncthing/syncthing/internal/osutil"
+	"github.com/syncthing/syncthing/internal/protocol"
+)
+
+func TestXattrs(t *testing.T) {
+	fd, err := ioutil.TempFile("", "xattrs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fd.Close()
+	defer os.Remove(fd.Name())
+
+	xattrs := []protocol.Xattr{
+		{Name: "user.a", Value: []byte("first")},
+		{Name: "user.b", Value: []byte("second")},
+	}
+	err = osutil.SetXattrs(fd.Name(), xattrs)
+	if err == osutil.ErrXattrsUnsupported {
+		t.Skip(err)
+	} else if err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := osutil.GetXattrs(fd.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(res, xattrs) {
+		t.Errorf("incorrect xattrs %v != %v", res, xattrs)
+	}
+
+	// Setting a shorter list removes the attributes no longer present.
+	err = osutil.SetXattrs(fd.Name(), xattrs[1:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err = osutil.GetXattrs(fd.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(res, xattrs[1:]) {
+		t.Errorf("incorrect xattrs %v != %v", res, xattrs[1:])
+	}
+}
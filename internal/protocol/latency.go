@@ -0,0 +1,114 @@
+// Copyright (C) 2014 The Syncthing Authors.
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for
+// more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package protocol
+
+import (
+	"sync"
+	"time"
+)
+
+// RequestTimeouts bounds how long a connection waits for the response to a
+// request to the peer, counted from when it last received anything. The
+// timeout adapts to the response times measured on the connection, so that
+// a peer that usually answers quickly is given up on quickly when it stalls.
+// A zero Max means requests never time out.
+type RequestTimeouts struct {
+	Min time.Duration // the timeout of a peer with short response times
+	Max time.Duration // the timeout before response times are known, and at most
+}
+
+// DefaultRequestTimeouts is applied to connections created after it is set.
+var DefaultRequestTimeouts RequestTimeouts
+
+// A latencyTracker estimates the response time of the peer and a timeout
+// for requests from it, like TCP does for retransmissions (RFC 6298).
+type latencyTracker struct {
+	timeouts RequestTimeouts
+	srtt     time.Duration // smoothed response time
+	rttvar   time.Duration // its variation
+	measured bool
+	backoff  uint // the timeout is doubled this many times, for consecutive timeouts
+	mut      sync.Mutex
+}
+
+func newLatencyTracker(timeouts RequestTimeouts) *latencyTracker {
+	return &latencyTracker{timeouts: timeouts}
+}
+
+// observe records the response time of a request that was answered.
+func (t *latencyTracker) observe(rtt time.Duration) {
+	t.mut.Lock()
+	defer t.mut.Unlock()
+
+	if !t.measured {
+		t.srtt = rtt
+		t.rttvar = rtt / 2
+		t.measured = true
+	} else {
+		diff := t.srtt - rtt
+		if diff < 0 {
+			diff = -diff
+		}
+		t.rttvar = (3*t.rttvar + diff) / 4
+		t.srtt = (7*t.srtt + rtt) / 8
+	}
+	t.backoff = 0
+}
+
+// timedOut records that a request was given up on. Further timeouts are
+// longer, so that a peer that has become slow is eventually waited for.
+func (t *latencyTracker) timedOut() {
+	t.mut.Lock()
+	if t.timeoutLocked() < t.timeouts.Max {
+		t.backoff++
+	}
+	t.mut.Unlock()
+}
+
+// timeout returns how long to wait for the response to a request, or zero
+// to wait forever.
+func (t *latencyTracker) timeout() time.Duration {
+	t.mut.Lock()
+	defer t.mut.Unlock()
+	return t.timeoutLocked()
+}
+
+func (t *latencyTracker) timeoutLocked() time.Duration {
+	if t.timeouts.Max <= 0 {
+		return 0
+	}
+	if !t.measured {
+		return t.timeouts.Max
+	}
+	d := t.srtt + 4*t.rttvar
+	for i := uint(0); i < t.backoff && d < t.timeouts.Max; i++ {
+		d *= 2
+	}
+	if d < t.timeouts.Min {
+		d = t.timeouts.Min
+	}
+	if d > t.timeouts.Max {
+		d = t.timeouts.Max
+	}
+	return d
+}
+
+// latency returns the smoothed response time, or zero if unknown.
+func (t *latencyTracker) latency() time.Duration {
+	t.mut.Lock()
+	defer t.mut.Unlock()
+	return t.srtt
+}
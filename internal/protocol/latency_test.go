@@ -0,0 +1,152 @@
+// Copyright (C) 2014 The Syncthing Authors.
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for
+// more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package protocol
+
+import (
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+func TestLatencyTracker(t *testing.T) {
+	lt := newLatencyTracker(RequestTimeouts{Min: time.Second, Max: time.Minute})
+	if d := lt.timeout(); d != time.Minute {
+		t.Errorf("Expected the maximum timeout before any response, not %v", d)
+	}
+
+	// A peer answering quickly is given the minimum.
+	for i := 0; i < 20; i++ {
+		lt.observe(10 * time.Millisecond)
+	}
+	if d := lt.timeout(); d != time.Second {
+		t.Errorf("Expected the minimum timeout for a fast peer, not %v", d)
+	}
+	if d := lt.latency(); d != 10*time.Millisecond {
+		t.Errorf("Expected a latency of 10ms, not %v", d)
+	}
+
+	// A slow one something above its response times.
+	for i := 0; i < 50; i++ {
+		lt.observe(5 * time.Second)
+	}
+	if d := lt.timeout(); d < 5*time.Second || d > 6*time.Second {
+		t.Errorf("Expected a timeout just above 5s for a slow peer, not %v", d)
+	}
+
+	// Timeouts back off up to the maximum, until a response arrives.
+	prev := lt.timeout()
+	lt.timedOut()
+	if d := lt.timeout(); d != 2*prev {
+		t.Errorf("Expected the timeout to double to %v, not %v", 2*prev, d)
+	}
+	for i := 0; i < 10; i++ {
+		lt.timedOut()
+	}
+	if d := lt.timeout(); d != time.Minute {
+		t.Errorf("Expected the timeout to back off to the maximum, not %v", d)
+	}
+	lt.observe(5 * time.Second)
+	if d := lt.timeout(); d > 6*time.Second {
+		t.Errorf("Expected the back off to end with a response, not %v", d)
+	}
+
+	if d := newLatencyTracker(RequestTimeouts{}).timeout(); d != 0 {
+		t.Errorf("Expected no timeout without a maximum, not %v", d)
+	}
+}
+
+func TestRequestTimeout(t *testing.T) {
+	ar, _ := io.Pipe()
+	br, bw := io.Pipe()
+	go io.Copy(ioutil.Discard, br)
+
+	// The peer never answers.
+	c := NewConnection(c0ID, ar, bw, newTestModel(), "name", true).(wireFormatConnection).next.(*rawConnection)
+	c.latency = newLatencyTracker(RequestTimeouts{Min: 10 * time.Millisecond, Max: 50 * time.Millisecond})
+
+	t0 := time.Now()
+	if _, err := c.Request("default", "file", 0, 128); err != ErrTimeout {
+		t.Errorf("Expected ErrTimeout, not %v", err)
+	}
+	if d := time.Since(t0); d > time.Second {
+		t.Errorf("Request took %v to time out", d)
+	}
+
+	// Its id stays reserved until the late response arrives, so it isn't
+	// given to another request in the meantime.
+	awaited := func() []int {
+		c.awaitingMut.Lock()
+		defer c.awaitingMut.Unlock()
+		var ids []int
+		for id, ch := range c.awaiting {
+			if ch != nil {
+				ids = append(ids, id)
+			}
+		}
+		return ids
+	}
+	ids := awaited()
+	if len(ids) != 1 {
+		t.Fatalf("Expected the timed out request to keep its id, not %v", ids)
+	}
+	c.handleResponse(ids[0], ResponseMessage{})
+	if ids := awaited(); len(ids) != 0 {
+		t.Errorf("Expected the id to be released by the response, not %v", ids)
+	}
+}
+
+// slowModel serves requests after a delay.
+type slowModel struct {
+	*TestModel
+	delay time.Duration
+}
+
+func (m *slowModel) Request(deviceID DeviceID, folder, name string, offset int64, size int) ([]byte, error) {
+	time.Sleep(m.delay)
+	return []byte("data"), nil
+}
+
+// A request doesn't time out while the peer is sending other data.
+func TestRequestTimeoutFromLastRead(t *testing.T) {
+	ar, aw := io.Pipe()
+	br, bw := io.Pipe()
+	c0 := NewConnection(c0ID, ar, bw, newTestModel(), "requester", false).(wireFormatConnection).next.(*rawConnection)
+	c1 := NewConnection(c1ID, br, aw, &slowModel{newTestModel(), 300 * time.Millisecond}, "server", false).(wireFormatConnection).next.(*rawConnection)
+	c0.latency = newLatencyTracker(RequestTimeouts{Min: 10 * time.Millisecond, Max: 100 * time.Millisecond})
+
+	for _, c := range []*rawConnection{c0, c1} {
+		c.ClusterConfig(ClusterConfigMessage{})
+		c.Index("default", nil)
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case <-time.After(20 * time.Millisecond):
+				c1.ping()
+			}
+		}
+	}()
+
+	if data, err := c0.Request("default", "file", 0, 4); err != nil || string(data) != "data" {
+		t.Errorf("Expected the response, not %q, %v", data, err)
+	}
+}
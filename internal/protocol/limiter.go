@@ -0,0 +1,125 @@
+// Copyright (C) 2014 The Syncthing Authors.
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for
+// more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package protocol
+
+import "sync"
+
+// RequestLimits bounds the requests from the peer that a connection serves
+// at once, so that a peer can't make us hold responses in memory without
+// bound. A zero value means no limit.
+type RequestLimits struct {
+	MaxBytes    int // total size of the requests being served
+	MaxRequests int // number of requests being served
+}
+
+// DefaultRequestLimits is applied to connections created after it is set.
+var DefaultRequestLimits RequestLimits
+
+type requestLimiter struct {
+	limits   RequestLimits
+	bytes    int
+	requests int
+	mut      sync.Mutex
+	cond     *sync.Cond
+}
+
+func newRequestLimiter(limits RequestLimits) *requestLimiter {
+	l := &requestLimiter{limits: limits}
+	l.cond = sync.NewCond(&l.mut)
+	return l
+}
+
+// take blocks until a request of the given size can be served within the
+// limits, and reserves room for it. It returns false without blocking if
+// the request is larger than the byte limit, as it can never be served.
+func (l *requestLimiter) take(size int) bool {
+	if l.limits.MaxBytes > 0 && size > l.limits.MaxBytes {
+		return false
+	}
+
+	l.mut.Lock()
+	defer l.mut.Unlock()
+	for (l.limits.MaxBytes > 0 && l.bytes+size > l.limits.MaxBytes) ||
+		(l.limits.MaxRequests > 0 && l.requests >= l.limits.MaxRequests) {
+		l.cond.Wait()
+	}
+	l.bytes += size
+	l.requests++
+	return true
+}
+
+// give returns the room reserved by take for a request that has been
+// served.
+func (l *requestLimiter) give(size int) {
+	l.mut.Lock()
+	l.bytes -= size
+	l.requests--
+	l.mut.Unlock()
+	l.cond.Broadcast()
+}
+
+// An IndexBuffer bounds the index data being received and processed at
+// once, over all the connections sharing it. A connection that would exceed
+// it stops reading from its peer, which in turn stops sending, until the
+// index messages before it have been processed. A nil IndexBuffer has no
+// limit.
+type IndexBuffer struct {
+	max  int
+	used int
+	mut  sync.Mutex
+	cond *sync.Cond
+}
+
+// NewIndexBuffer returns an IndexBuffer holding at most maxBytes of index
+// messages, or nil for no limit if maxBytes is zero.
+func NewIndexBuffer(maxBytes int) *IndexBuffer {
+	if maxBytes <= 0 {
+		return nil
+	}
+	b := &IndexBuffer{max: maxBytes}
+	b.cond = sync.NewCond(&b.mut)
+	return b
+}
+
+// DefaultIndexBuffer is shared by connections created after it is set.
+var DefaultIndexBuffer *IndexBuffer
+
+// take blocks until an index message of the given size fits in the buffer,
+// and reserves room for it. A message larger than the whole buffer is let
+// through alone once the buffer is empty.
+func (b *IndexBuffer) take(size int) {
+	if b == nil {
+		return
+	}
+	b.mut.Lock()
+	defer b.mut.Unlock()
+	for b.used > 0 && b.used+size > b.max {
+		b.cond.Wait()
+	}
+	b.used += size
+}
+
+// give returns the room reserved by take for a message that has been
+// processed.
+func (b *IndexBuffer) give(size int) {
+	if b == nil {
+		return
+	}
+	b.mut.Lock()
+	b.used -= size
+	b.mut.Unlock()
+	b.cond.Broadcast()
+}
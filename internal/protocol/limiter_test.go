@@ -0,0 +1,312 @@
+// Copyright (C) 2014 The Syncthing Authors.
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for
+// more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package protocol
+
+import (
+	"fmt"
+	"io"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRequestLimiter(t *testing.T) {
+	l := newRequestLimiter(RequestLimits{MaxBytes: 100, MaxRequests: 2})
+
+	if l.take(101) {
+		t.Fatal("request larger than the byte limit should be refused")
+	}
+	if !l.take(60) || !l.take(30) {
+		t.Fatal("requests within the limits should be served")
+	}
+
+	takeAsync := func(size int) chan struct{} {
+		done := make(chan struct{})
+		go func() {
+			l.take(size)
+			close(done)
+		}()
+		return done
+	}
+	expectBlocked := func(done chan struct{}) {
+		select {
+		case <-done:
+			t.Fatal("request served beyond the limits")
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+	expectServed := func(done chan struct{}) {
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatal("request not served after room was given back")
+		}
+	}
+
+	// Two requests are being served, so a third one waits.
+	done := takeAsync(10)
+	expectBlocked(done)
+	l.give(30)
+	expectServed(done)
+
+	// 70 bytes are in use, then 60, so 50 more have to wait.
+	l.give(10)
+	done = takeAsync(50)
+	expectBlocked(done)
+	l.give(60)
+	expectServed(done)
+}
+
+func TestRequestLimiterUnlimited(t *testing.T) {
+	l := newRequestLimiter(RequestLimits{})
+	for i := 0; i < 1000; i++ {
+		if !l.take(1 << 20) {
+			t.Fatal("unlimited limiter refused a request")
+		}
+	}
+}
+
+// blockingModel serves requests once they are released.
+type blockingModel struct {
+	*TestModel
+	release chan struct{}
+}
+
+func (m *blockingModel) Request(deviceID DeviceID, folder, name string, offset int64, size int) ([]byte, error) {
+	<-m.release
+	return []byte("data"), nil
+}
+
+// Requests waiting for the limits don't keep the pings and responses sent
+// after them from being read.
+func TestRequestLimiterKeepsReading(t *testing.T) {
+	defer func(l RequestLimits) { DefaultRequestLimits = l }(DefaultRequestLimits)
+	DefaultRequestLimits = RequestLimits{MaxRequests: 1}
+
+	ar, aw := io.Pipe()
+	br, bw := io.Pipe()
+	m := &blockingModel{TestModel: newTestModel(), release: make(chan struct{})}
+	c0 := NewConnection(c0ID, ar, bw, newTestModel(), "requester", false)
+	c1 := NewConnection(c1ID, br, aw, m, "server", false)
+
+	for _, c := range []Connection{c0, c1} {
+		c.ClusterConfig(ClusterConfigMessage{})
+		c.Index("default", nil)
+	}
+
+	errs := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			_, err := c0.Request("default", "file", 0, 4)
+			errs <- err
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	pong := make(chan bool, 1)
+	go func() {
+		pong <- c0.(wireFormatConnection).next.(*rawConnection).ping()
+	}()
+	select {
+	case ok := <-pong:
+		if !ok {
+			t.Fatal("ping failed")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("ping not answered while a request waits for the limits")
+	}
+
+	close(m.release)
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-errs:
+			if err != nil {
+				t.Fatal(err)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("request not served")
+		}
+	}
+}
+
+// A peer sending many more requests than are served at once has the rest
+// wait in the queue and then in the pipe, not in goroutines of their own.
+func TestRequestLimiterBounded(t *testing.T) {
+	defer func(l RequestLimits) { DefaultRequestLimits = l }(DefaultRequestLimits)
+	DefaultRequestLimits = RequestLimits{MaxRequests: 4}
+
+	ar, aw := io.Pipe()
+	br, bw := io.Pipe()
+	m := &blockingModel{TestModel: newTestModel(), release: make(chan struct{})}
+	c0 := NewConnection(c0ID, ar, bw, newTestModel(), "requester", false)
+	c1 := NewConnection(c1ID, br, aw, m, "server", false)
+
+	for _, c := range []Connection{c0, c1} {
+		c.ClusterConfig(ClusterConfigMessage{})
+		c.Index("default", nil)
+	}
+	time.Sleep(50 * time.Millisecond)
+	before := runtime.NumGoroutine()
+
+	const requests = 1000
+	raw := c0.(wireFormatConnection).next.(*rawConnection)
+	go func() {
+		for i := 0; i < requests; i++ {
+			raw.send(i%4096, messageTypeRequest, RequestMessage{Folder: "default", Name: "file", Size: 4})
+		}
+	}()
+	time.Sleep(200 * time.Millisecond)
+
+	if n := runtime.NumGoroutine() - before; n > 2*DefaultRequestLimits.MaxRequests+4 {
+		t.Errorf("%d goroutines started for %d requests", n, requests)
+	}
+	close(m.release)
+}
+
+func TestIndexBuffer(t *testing.T) {
+	b := NewIndexBuffer(100)
+
+	takeAsync := func(size int) chan struct{} {
+		done := make(chan struct{})
+		go func() {
+			b.take(size)
+			close(done)
+		}()
+		return done
+	}
+	expectBlocked := func(done chan struct{}) {
+		select {
+		case <-done:
+			t.Fatal("index message let through beyond the buffer")
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+	expectTaken := func(done chan struct{}) {
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatal("index message not let through")
+		}
+	}
+
+	b.take(60)
+	done := takeAsync(50)
+	expectBlocked(done)
+	b.give(60)
+	expectTaken(done)
+
+	// A message larger than the buffer waits for it to be empty.
+	done = takeAsync(150)
+	expectBlocked(done)
+	b.give(50)
+	expectTaken(done)
+	b.give(150)
+
+	// Without a limit nothing waits.
+	var unlimited *IndexBuffer
+	if NewIndexBuffer(0) != unlimited {
+		t.Fatal("zero sized index buffer should be unlimited")
+	}
+	unlimited.take(1 << 30)
+	unlimited.give(1 << 30)
+}
+
+// indexTracker records how many index messages it's processing at once.
+type indexTracker struct {
+	*TestModel
+	mut      sync.Mutex
+	current  int
+	max      int
+	received int
+}
+
+func (t *indexTracker) Index(deviceID DeviceID, folder string, files []FileInfo) {
+	t.mut.Lock()
+	t.current++
+	if t.current > t.max {
+		t.max = t.current
+	}
+	t.mut.Unlock()
+
+	time.Sleep(10 * time.Millisecond)
+
+	t.mut.Lock()
+	t.current--
+	t.received++
+	t.mut.Unlock()
+}
+
+func (t *indexTracker) IndexUpdate(deviceID DeviceID, folder string, files []FileInfo) {
+	t.Index(deviceID, folder, files)
+}
+
+// Several devices sending their initial index at once, in batches the size
+// the model sends, have only as many of them decoded and processed at a
+// time as fit in the shared buffer.
+func TestIndexBufferConnections(t *testing.T) {
+	files := make([]FileInfo, 1000)
+	for i := range files {
+		blocks := make([]BlockInfo, 8)
+		for j := range blocks {
+			blocks[j] = BlockInfo{Size: BlockSize, Hash: make([]byte, 32)}
+		}
+		files[i] = FileInfo{Name: fmt.Sprintf("some/dir/file%06d", i), Version: 1, Blocks: blocks}
+	}
+	size := len(indexMessage("default", files).MustMarshalXDR())
+
+	budget := 2*size + size/2
+	defer func(b *IndexBuffer) { DefaultIndexBuffer = b }(DefaultIndexBuffer)
+	DefaultIndexBuffer = NewIndexBuffer(budget)
+
+	const devices, messages = 4, 5
+	m := &indexTracker{TestModel: newTestModel()}
+	var wg sync.WaitGroup
+	for i := 0; i < devices; i++ {
+		ar, aw := io.Pipe()
+		br, bw := io.Pipe()
+		sender := NewConnection(c0ID, ar, bw, nil, "sender", false)
+		NewConnection(c1ID, br, aw, m, "receiver", false)
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sender.ClusterConfig(ClusterConfigMessage{})
+			sender.Index("default", files)
+			for j := 1; j < messages; j++ {
+				sender.IndexUpdate("default", files)
+			}
+		}()
+	}
+	wg.Wait()
+
+	timeout := time.Now().Add(10 * time.Second)
+	for {
+		m.mut.Lock()
+		received, max := m.received, m.max
+		m.mut.Unlock()
+		if received == devices*messages {
+			if max > 2 {
+				t.Errorf("%d index messages of %d bytes processed at once within a buffer of %d bytes", max, size, budget)
+			}
+			return
+		}
+		if time.Now().After(timeout) {
+			t.Fatalf("received %d of %d index messages", received, devices*messages)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
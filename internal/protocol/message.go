@@ -25,6 +25,11 @@ type IndexMessage struct {
 	Files   []FileInfo
 	Flags   uint32
 	Options []Option // max:64
+
+	// Metadata carries the optional attributes of the files in Files. It
+	// comes last so that peers which don't know about it read the message
+	// as if it weren't there.
+	Metadata []FileMetadata
 }
 
 type FileInfo struct {
@@ -34,6 +39,11 @@ type FileInfo struct {
 	Version      uint64
 	LocalVersion uint64
 	Blocks       []BlockInfo
+	Xattrs       []Xattr    // noencode (sent as IndexMessage.Metadata)
+	Owner        *FileOwner // noencode (sent as IndexMessage.Metadata)
+	LinkGroup    string     // noencode (sent as IndexMessage.Metadata)
+	Created      int64      // noencode (sent as IndexMessage.Metadata)
+	Attributes   uint32     // noencode (sent as IndexMessage.Metadata)
 }
 
 func (f FileInfo) String() string {
@@ -59,6 +69,10 @@ func (f FileInfo) IsInvalid() bool {
 	return f.Flags&FlagInvalid != 0
 }
 
+func (f FileInfo) IsPlaceholder() bool {
+	return f.Flags&FlagPlaceholder != 0
+}
+
 func (f FileInfo) IsDirectory() bool {
 	return f.Flags&FlagDirectory != 0
 }
@@ -71,6 +85,32 @@ func (f FileInfo) HasPermissionBits() bool {
 	return f.Flags&FlagNoPermBits == 0
 }
 
+// FileMetadata holds the attributes of the named file that are not part of
+// FileInfo on the wire.
+type FileMetadata struct {
+	Name   string  // max:8192
+	Xattrs []Xattr // max:64
+	Flags  uint32
+	UID    uint32
+	GID    uint32
+
+	// LinkGroup is the name of the first file in the folder that the file
+	// is hard linked with, or empty if it isn't hard linked.
+	LinkGroup string // max:8192
+
+	// Created is the creation time of the file in nanoseconds since the
+	// epoch, or zero if it isn't known.
+	Created int64
+
+	// Attributes are the Attr* attributes of the file.
+	Attributes uint32
+}
+
+type Xattr struct {
+	Name  string // max:255
+	Value []byte // max:65536
+}
+
 type BlockInfo struct {
 	Offset int64 // noencode (cache only)
 	Size   uint32
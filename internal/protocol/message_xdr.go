@@ -38,6 +38,12 @@ IndexMessage Structure:
 \                Zero or more Option Structures                 \
 /                                                               /
 +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+|                      Number of Metadata                       |
++-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+/                                                               /
+\             Zero or more FileMetadata Structures              \
+/                                                               /
++-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
 
 
 struct IndexMessage {
@@ -45,6 +51,7 @@ struct IndexMessage {
 	FileInfo Files<>;
 	unsigned int Flags;
 	Option Options<64>;
+	FileMetadata Metadata<>;
 }
 
 */
@@ -96,6 +103,13 @@ func (o IndexMessage) encodeXDR(xw *xdr.Writer) (int, error) {
 			return xw.Tot(), err
 		}
 	}
+	xw.WriteUint32(uint32(len(o.Metadata)))
+	for i := range o.Metadata {
+		_, err := o.Metadata[i].encodeXDR(xw)
+		if err != nil {
+			return xw.Tot(), err
+		}
+	}
 	return xw.Tot(), xw.Error()
 }
 
@@ -126,6 +140,11 @@ func (o *IndexMessage) decodeXDR(xr *xdr.Reader) error {
 	for i := range o.Options {
 		(&o.Options[i]).decodeXDR(xr)
 	}
+	_MetadataSize := int(xr.ReadUint32())
+	o.Metadata = make([]FileMetadata, _MetadataSize)
+	for i := range o.Metadata {
+		(&o.Metadata[i]).decodeXDR(xr)
+	}
 	return xr.Error()
 }
 
@@ -245,6 +264,220 @@ func (o *FileInfo) decodeXDR(xr *xdr.Reader) error {
 
 /*
 
+FileMetadata Structure:
+
+ 0                   1                   2                   3
+ 0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1
++-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+|                        Length of Name                         |
++-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+/                                                               /
+\                    Name (variable length)                     \
+/                                                               /
++-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+|                       Number of Xattrs                        |
++-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+/                                                               /
+\                 Zero or more Xattr Structures                 \
+/                                                               /
++-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+|                             Flags                             |
++-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+|                              UID                              |
++-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+|                              GID                              |
++-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+|                     Length of Link Group                      |
++-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+/                                                               /
+\                 Link Group (variable length)                  \
+/                                                               /
++-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+|                                                               |
++                       Created (64 bits)                       +
+|                                                               |
++-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+|                          Attributes                           |
++-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+
+
+struct FileMetadata {
+	string Name<8192>;
+	Xattr Xattrs<64>;
+	unsigned int Flags;
+	unsigned int UID;
+	unsigned int GID;
+	string LinkGroup<8192>;
+	hyper Created;
+	unsigned int Attributes;
+}
+
+*/
+
+func (o FileMetadata) EncodeXDR(w io.Writer) (int, error) {
+	var xw = xdr.NewWriter(w)
+	return o.encodeXDR(xw)
+}
+
+func (o FileMetadata) MarshalXDR() ([]byte, error) {
+	return o.AppendXDR(make([]byte, 0, 128))
+}
+
+func (o FileMetadata) MustMarshalXDR() []byte {
+	bs, err := o.MarshalXDR()
+	if err != nil {
+		panic(err)
+	}
+	return bs
+}
+
+func (o FileMetadata) AppendXDR(bs []byte) ([]byte, error) {
+	var aw = xdr.AppendWriter(bs)
+	var xw = xdr.NewWriter(&aw)
+	_, err := o.encodeXDR(xw)
+	return []byte(aw), err
+}
+
+func (o FileMetadata) encodeXDR(xw *xdr.Writer) (int, error) {
+	if l := len(o.Name); l > 8192 {
+		return xw.Tot(), xdr.ElementSizeExceeded("Name", l, 8192)
+	}
+	xw.WriteString(o.Name)
+	if l := len(o.Xattrs); l > 64 {
+		return xw.Tot(), xdr.ElementSizeExceeded("Xattrs", l, 64)
+	}
+	xw.WriteUint32(uint32(len(o.Xattrs)))
+	for i := range o.Xattrs {
+		_, err := o.Xattrs[i].encodeXDR(xw)
+		if err != nil {
+			return xw.Tot(), err
+		}
+	}
+	xw.WriteUint32(o.Flags)
+	xw.WriteUint32(o.UID)
+	xw.WriteUint32(o.GID)
+	if l := len(o.LinkGroup); l > 8192 {
+		return xw.Tot(), xdr.ElementSizeExceeded("LinkGroup", l, 8192)
+	}
+	xw.WriteString(o.LinkGroup)
+	xw.WriteUint64(uint64(o.Created))
+	xw.WriteUint32(o.Attributes)
+	return xw.Tot(), xw.Error()
+}
+
+func (o *FileMetadata) DecodeXDR(r io.Reader) error {
+	xr := xdr.NewReader(r)
+	return o.decodeXDR(xr)
+}
+
+func (o *FileMetadata) UnmarshalXDR(bs []byte) error {
+	var br = bytes.NewReader(bs)
+	var xr = xdr.NewReader(br)
+	return o.decodeXDR(xr)
+}
+
+func (o *FileMetadata) decodeXDR(xr *xdr.Reader) error {
+	o.Name = xr.ReadStringMax(8192)
+	_XattrsSize := int(xr.ReadUint32())
+	if _XattrsSize > 64 {
+		return xdr.ElementSizeExceeded("Xattrs", _XattrsSize, 64)
+	}
+	o.Xattrs = make([]Xattr, _XattrsSize)
+	for i := range o.Xattrs {
+		(&o.Xattrs[i]).decodeXDR(xr)
+	}
+	o.Flags = xr.ReadUint32()
+	o.UID = xr.ReadUint32()
+	o.GID = xr.ReadUint32()
+	o.LinkGroup = xr.ReadStringMax(8192)
+	o.Created = int64(xr.ReadUint64())
+	o.Attributes = xr.ReadUint32()
+	return xr.Error()
+}
+
+/*
+
+Xattr Structure:
+
+ 0                   1                   2                   3
+ 0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1
++-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+|                        Length of Name                         |
++-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+/                                                               /
+\                    Name (variable length)                     \
+/                                                               /
++-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+|                        Length of Value                        |
++-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+/                                                               /
+\                    Value (variable length)                    \
+/                                                               /
++-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+
+
+struct Xattr {
+	string Name<255>;
+	opaque Value<65536>;
+}
+
+*/
+
+func (o Xattr) EncodeXDR(w io.Writer) (int, error) {
+	var xw = xdr.NewWriter(w)
+	return o.encodeXDR(xw)
+}
+
+func (o Xattr) MarshalXDR() ([]byte, error) {
+	return o.AppendXDR(make([]byte, 0, 128))
+}
+
+func (o Xattr) MustMarshalXDR() []byte {
+	bs, err := o.MarshalXDR()
+	if err != nil {
+		panic(err)
+	}
+	return bs
+}
+
+func (o Xattr) AppendXDR(bs []byte) ([]byte, error) {
+	var aw = xdr.AppendWriter(bs)
+	var xw = xdr.NewWriter(&aw)
+	_, err := o.encodeXDR(xw)
+	return []byte(aw), err
+}
+
+func (o Xattr) encodeXDR(xw *xdr.Writer) (int, error) {
+	if l := len(o.Name); l > 255 {
+		return xw.Tot(), xdr.ElementSizeExceeded("Name", l, 255)
+	}
+	xw.WriteString(o.Name)
+	if l := len(o.Value); l > 65536 {
+		return xw.Tot(), xdr.ElementSizeExceeded("Value", l, 65536)
+	}
+	xw.WriteBytes(o.Value)
+	return xw.Tot(), xw.Error()
+}
+
+func (o *Xattr) DecodeXDR(r io.Reader) error {
+	xr := xdr.NewReader(r)
+	return o.decodeXDR(xr)
+}
+
+func (o *Xattr) UnmarshalXDR(bs []byte) error {
+	var br = bytes.NewReader(bs)
+	var xr = xdr.NewReader(br)
+	return o.decodeXDR(xr)
+}
+
+func (o *Xattr) decodeXDR(xr *xdr.Reader) error {
+	o.Name = xr.ReadStringMax(255)
+	o.Value = xr.ReadBytesMax(65536)
+	return xr.Error()
+}
+
+/*
+
 BlockInfo Structure:
 
  0                   1                   2                   3
@@ -0,0 +1,56 @@
+// Copyright (C) 2014 The Syncthing Authors.
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for
+// more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package protocol
+
+// Metadata returns the optional attributes of the file, and whether it has
+// any.
+func (f FileInfo) Metadata() (FileMetadata, bool) {
+	md := FileMetadata{
+		Name:       f.Name,
+		Xattrs:     f.Xattrs,
+		LinkGroup:  f.LinkGroup,
+		Created:    f.Created,
+		Attributes: f.Attributes,
+	}
+	if f.Owner != nil {
+		md.Flags |= FlagMetadataOwner
+		md.UID = f.Owner.UID
+		md.GID = f.Owner.GID
+	}
+	return md, len(md.Xattrs) > 0 || md.Flags != 0 || md.LinkGroup != "" || md.Created != 0 || md.Attributes != 0
+}
+
+// SetMetadata sets the optional attributes of the file from md.
+func (f *FileInfo) SetMetadata(md FileMetadata) {
+	f.Xattrs = md.Xattrs
+	f.LinkGroup = md.LinkGroup
+	f.Created = md.Created
+	f.Attributes = md.Attributes
+	f.Owner = nil
+	if md.Flags&FlagMetadataOwner != 0 {
+		f.Owner = &FileOwner{
+			UID: md.UID,
+			GID: md.GID,
+		}
+	}
+}
+
+// FileOwner is the numeric user and group id owning a file. The ids are
+// used as is; no mapping of user or group names between systems is done.
+type FileOwner struct {
+	UID uint32
+	GID uint32
+}
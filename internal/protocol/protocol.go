@@ -31,6 +31,10 @@ const (
 	BlockSize = 128 * 1024
 )
 
+// Version is the version of the protocol sent in the message headers. Only
+// messages of this version are accepted.
+const Version = 0
+
 const (
 	messageTypeClusterConfig = 0
 	messageTypeIndex         = 1
@@ -56,6 +60,11 @@ const (
 	FlagSymlink                     = 1 << 16
 	FlagSymlinkMissingTarget        = 1 << 17
 
+	// FlagPlaceholder marks a local file that is an empty placeholder for
+	// the contents it's invalid for. It's only set in the local index, and
+	// is cleared from the index sent to other devices.
+	FlagPlaceholder = 1 << 18
+
 	SymlinkTypeMask = FlagDirectory | FlagSymlinkMissingTarget
 )
 
@@ -66,9 +75,23 @@ const (
 	FlagShareBits            = 0x000000ff
 )
 
+const (
+	FlagMetadataOwner uint32 = 1 << 0
+)
+
+// File attributes, as kept by some operating systems. Each is mapped to what
+// comes closest on the systems having it, and ignored on the others.
+const (
+	AttrHidden    uint32 = 1 << 0 // Windows hidden attribute, Mac OS X and FreeBSD hidden flag
+	AttrSystem           = 1 << 1 // Windows system attribute
+	AttrReadOnly         = 1 << 2 // Windows read only attribute; elsewhere the permission bits
+	AttrImmutable        = 1 << 3 // Linux immutable attribute, Mac OS X and FreeBSD user immutable flag
+)
+
 var (
 	ErrClusterHash = fmt.Errorf("configuration error: mismatched cluster hash")
 	ErrClosed      = errors.New("connection closed")
+	ErrTimeout     = errors.New("request timed out")
 )
 
 type Model interface {
@@ -115,6 +138,13 @@ type rawConnection struct {
 
 	compressionThreshold int // compress messages larger than this many bytes
 
+	limiter  *requestLimiter    // bounds the requests from the peer served at once
+	requests chan queuedRequest // requests read from the peer, waiting for the limiter
+	latency  *latencyTracker    // response times of our requests to the peer
+
+	indexBuffer   *IndexBuffer // bounds the index data being processed, shared with other connections
+	indexReserved int          // room taken in indexBuffer by the index message just read
+
 	rdbuf0 []byte // used & reused by readMessage
 	rdbuf1 []byte // used & reused by readMessage
 }
@@ -124,6 +154,11 @@ type asyncResult struct {
 	err error
 }
 
+type queuedRequest struct {
+	msgID int
+	req   RequestMessage
+}
+
 type hdrMsg struct {
 	hdr header
 	msg encodable
@@ -142,6 +177,10 @@ const (
 	pingIdleTime = 60 * time.Second
 )
 
+// Requests read from the peer that may wait for the limiter without a limit
+// on the number of requests; with one, as many as are served at once.
+const defaultRequestQueue = 64
+
 func NewConnection(deviceID DeviceID, reader io.Reader, writer io.Writer, receiver Model, name string, compress bool) Connection {
 	cr := &countingReader{Reader: reader}
 	cw := &countingWriter{Writer: writer}
@@ -161,16 +200,28 @@ func NewConnection(deviceID DeviceID, reader io.Reader, writer io.Writer, receiv
 		nextID:               make(chan int),
 		closed:               make(chan struct{}),
 		compressionThreshold: compThres,
+		limiter:              newRequestLimiter(DefaultRequestLimits),
+		requests:             make(chan queuedRequest, requestQueueLen(DefaultRequestLimits)),
+		latency:              newLatencyTracker(DefaultRequestTimeouts),
+		indexBuffer:          DefaultIndexBuffer,
 	}
 
 	go c.readerLoop()
 	go c.writerLoop()
 	go c.pingerLoop()
 	go c.idGenerator()
+	go c.requestDispatcher()
 
 	return wireFormatConnection{&c}
 }
 
+func requestQueueLen(limits RequestLimits) int {
+	if limits.MaxRequests > 0 {
+		return limits.MaxRequests
+	}
+	return defaultRequestQueue
+}
+
 func (c *rawConnection) ID() DeviceID {
 	return c.id
 }
@@ -187,10 +238,7 @@ func (c *rawConnection) Index(folder string, idx []FileInfo) error {
 	default:
 	}
 	c.idxMut.Lock()
-	c.send(-1, messageTypeIndex, IndexMessage{
-		Folder: folder,
-		Files:  idx,
-	})
+	c.send(-1, messageTypeIndex, indexMessage(folder, idx))
 	c.idxMut.Unlock()
 	return nil
 }
@@ -203,32 +251,20 @@ func (c *rawConnection) IndexUpdate(folder string, idx []FileInfo) error {
 	default:
 	}
 	c.idxMut.Lock()
-	c.send(-1, messageTypeIndexUpdate, IndexMessage{
-		Folder: folder,
-		Files:  idx,
-	})
+	c.send(-1, messageTypeIndexUpdate, indexMessage(folder, idx))
 	c.idxMut.Unlock()
 	return nil
 }
 
 // Request returns the bytes for the specified block after fetching them from the connected peer.
 func (c *rawConnection) Request(folder string, name string, offset int64, size int) ([]byte, error) {
-	var id int
-	select {
-	case id = <-c.nextID:
-	case <-c.closed:
+	id, rc, ok := c.reserveID()
+	if !ok {
 		return nil, ErrClosed
 	}
 
-	c.awaitingMut.Lock()
-	if ch := c.awaiting[id]; ch != nil {
-		panic("id taken")
-	}
-	rc := make(chan asyncResult, 1)
-	c.awaiting[id] = rc
-	c.awaitingMut.Unlock()
-
-	ok := c.send(id, messageTypeRequest, RequestMessage{
+	t0 := time.Now()
+	ok = c.send(id, messageTypeRequest, RequestMessage{
 		Folder: folder,
 		Name:   name,
 		Offset: uint64(offset),
@@ -238,11 +274,65 @@ func (c *rawConnection) Request(folder string, name string, offset int64, size i
 		return nil, ErrClosed
 	}
 
-	res, ok := <-rc
-	if !ok {
-		return nil, ErrClosed
+	// The timeout runs from when we last heard from the peer, not from
+	// when the request was sent, as the response may be queued behind
+	// others on a slow link.
+	var timer *time.Timer
+	var timeout <-chan time.Time
+	d := c.latency.timeout()
+	if d > 0 {
+		timer = time.NewTimer(d)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	for {
+		select {
+		case res, ok := <-rc:
+			if !ok {
+				return nil, ErrClosed
+			}
+			c.latency.observe(time.Since(t0))
+			return res.val, res.err
+
+		case <-timeout:
+			last := c.cr.Last()
+			if last.Before(t0) {
+				last = t0
+			}
+			if wait := d - time.Since(last); wait > 0 {
+				timer.Reset(wait)
+				continue
+			}
+			// The id stays reserved until the response arrives or the
+			// connection is closed, so that a late response isn't taken
+			// for that of another request.
+			c.latency.timedOut()
+			return nil, ErrTimeout
+		}
+	}
+}
+
+// reserveID returns a message id that no response is awaited for, and the
+// channel its response is delivered on.
+func (c *rawConnection) reserveID() (int, chan asyncResult, bool) {
+	for {
+		var id int
+		select {
+		case id = <-c.nextID:
+		case <-c.closed:
+			return 0, nil, false
+		}
+
+		c.awaitingMut.Lock()
+		if c.awaiting[id] == nil {
+			rc := make(chan asyncResult, 1)
+			c.awaiting[id] = rc
+			c.awaitingMut.Unlock()
+			return id, rc, true
+		}
+		c.awaitingMut.Unlock()
 	}
-	return res.val, res.err
 }
 
 // ClusterConfig send the cluster configuration message to the peer and returns any error
@@ -251,19 +341,12 @@ func (c *rawConnection) ClusterConfig(config ClusterConfigMessage) {
 }
 
 func (c *rawConnection) ping() bool {
-	var id int
-	select {
-	case id = <-c.nextID:
-	case <-c.closed:
+	id, rc, ok := c.reserveID()
+	if !ok {
 		return false
 	}
 
-	rc := make(chan asyncResult, 1)
-	c.awaitingMut.Lock()
-	c.awaiting[id] = rc
-	c.awaitingMut.Unlock()
-
-	ok := c.send(id, messageTypePing, nil)
+	ok = c.send(id, messageTypePing, nil)
 	if !ok {
 		return false
 	}
@@ -292,23 +375,35 @@ func (c *rawConnection) readerLoop() (err error) {
 		switch hdr.msgType {
 		case messageTypeIndex:
 			if c.state < stateCCRcvd {
+				c.indexBuffer.give(c.indexReserved)
 				return fmt.Errorf("protocol error: index message in state %d", c.state)
 			}
 			c.handleIndex(msg.(IndexMessage))
+			c.indexBuffer.give(c.indexReserved)
 			c.state = stateIdxRcvd
 
 		case messageTypeIndexUpdate:
 			if c.state < stateIdxRcvd {
+				c.indexBuffer.give(c.indexReserved)
 				return fmt.Errorf("protocol error: index update message in state %d", c.state)
 			}
 			c.handleIndexUpdate(msg.(IndexMessage))
+			c.indexBuffer.give(c.indexReserved)
 
 		case messageTypeRequest:
 			if c.state < stateIdxRcvd {
 				return fmt.Errorf("protocol error: request message in state %d", c.state)
 			}
-			// Requests are handled asynchronously
-			go c.handleRequest(hdr.msgID, msg.(RequestMessage))
+			// Requests are handled asynchronously, but only as many at a
+			// time as the limits allow. A few more wait for their turn
+			// without holding up the messages read after them, as the peer
+			// may not read our responses until we've read its own; beyond
+			// that we stop reading until there's room.
+			select {
+			case c.requests <- queuedRequest{hdr.msgID, msg.(RequestMessage)}:
+			case <-c.closed:
+				return ErrClosed
+			}
 
 		case messageTypeResponse:
 			if c.state < stateIdxRcvd {
@@ -356,7 +451,7 @@ func (c *rawConnection) readMessage() (hdr header, msg encodable, err error) {
 		l.Debugf("read header %v (msglen=%d)", hdr, msglen)
 	}
 
-	if hdr.version != 0 {
+	if hdr.version != Version {
 		err = fmt.Errorf("unknown protocol version 0x%x", hdr.version)
 		return
 	}
@@ -405,11 +500,18 @@ func (c *rawConnection) readMessage() (hdr header, msg encodable, err error) {
 
 	switch hdr.msgType {
 	case messageTypeIndex, messageTypeIndexUpdate:
+		// Wait for room for the message before decoding it, as the decoded
+		// files take a multiple of its size until they've been processed.
+		c.indexReserved = len(msgBuf)
+		c.indexBuffer.take(c.indexReserved)
 		var idx IndexMessage
 		err = idx.UnmarshalXDR(msgBuf)
 		if xdrErr, ok := err.(isEofer); ok && xdrErr.IsEOF() {
 			err = nil
 		}
+		if err != nil {
+			c.indexBuffer.give(c.indexReserved)
+		}
 		msg = idx
 
 	case messageTypeRequest:
@@ -458,6 +560,7 @@ func (c *rawConnection) handleIndex(im IndexMessage) {
 	if debug {
 		l.Debugf("Index(%v, %v, %d files)", c.id, im.Folder, len(im.Files))
 	}
+	applyMetadata(im)
 	c.receiver.Index(c.id, im.Folder, im.Files)
 }
 
@@ -465,10 +568,70 @@ func (c *rawConnection) handleIndexUpdate(im IndexMessage) {
 	if debug {
 		l.Debugf("queueing IndexUpdate(%v, %v, %d files)", c.id, im.Folder, len(im.Files))
 	}
+	applyMetadata(im)
 	c.receiver.IndexUpdate(c.id, im.Folder, im.Files)
 }
 
+// indexMessage returns an index message for the given files, with their
+// optional attributes moved to the trailing metadata list.
+func indexMessage(folder string, idx []FileInfo) IndexMessage {
+	im := IndexMessage{
+		Folder: folder,
+		Files:  idx,
+	}
+	for _, f := range idx {
+		if md, ok := f.Metadata(); ok {
+			im.Metadata = append(im.Metadata, md)
+		}
+	}
+	return im
+}
+
+// applyMetadata sets the optional attributes from the metadata list on the
+// files they belong to. Metadata for files not in the message is ignored.
+func applyMetadata(im IndexMessage) {
+	if len(im.Metadata) == 0 {
+		return
+	}
+	idx := make(map[string]int, len(im.Files))
+	for i, f := range im.Files {
+		idx[f.Name] = i
+	}
+	for _, md := range im.Metadata {
+		if i, ok := idx[md.Name]; ok {
+			im.Files[i].SetMetadata(md)
+		}
+	}
+}
+
+// requestDispatcher serves the queued requests as the limits allow. A
+// request that is larger than all we serve at once gets an empty response.
+func (c *rawConnection) requestDispatcher() {
+	for {
+		select {
+		case qr := <-c.requests:
+			if !c.limiter.take(int(qr.req.Size)) {
+				c.send(qr.msgID, messageTypeResponse, ResponseMessage{})
+				continue
+			}
+			go c.handleRequest(qr.msgID, qr.req)
+		case <-c.closed:
+			return
+		}
+	}
+}
+
+// handleRequest serves a request that room has been taken for in the
+// limiter.
 func (c *rawConnection) handleRequest(msgID int, req RequestMessage) {
+	defer c.limiter.give(int(req.Size))
+
+	select {
+	case <-c.closed:
+		return
+	default:
+	}
+
 	data, _ := c.receiver.Request(c.id, req.Folder, req.Name, int64(req.Offset), int(req.Size))
 
 	c.send(msgID, messageTypeResponse, ResponseMessage{
@@ -507,7 +670,7 @@ func (c *rawConnection) send(msgID int, msgType int, msg encodable) bool {
 	}
 
 	hdr := header{
-		version: 0,
+		version: Version,
 		msgID:   msgID,
 		msgType: msgType,
 	}
@@ -673,15 +836,19 @@ func (c *rawConnection) pingerLoop() {
 }
 
 type Statistics struct {
-	At            time.Time
-	InBytesTotal  uint64
-	OutBytesTotal uint64
+	At              time.Time
+	InBytesTotal    uint64
+	OutBytesTotal   uint64
+	RequestLatencyS float64 // smoothed response time of our requests, in seconds
+	RequestTimeoutS float64 // after which our requests are given up on, in seconds; zero for never
 }
 
 func (c *rawConnection) Statistics() Statistics {
 	return Statistics{
-		At:            time.Now(),
-		InBytesTotal:  c.cr.Tot(),
-		OutBytesTotal: c.cw.Tot(),
+		At:              time.Now(),
+		InBytesTotal:    c.cr.Tot(),
+		OutBytesTotal:   c.cw.Tot(),
+		RequestLatencyS: c.latency.latency().Seconds(),
+		RequestTimeoutS: c.latency.timeout().Seconds(),
 	}
 }
@@ -269,7 +269,12 @@ func TestMarshalIndexMessage(t *testing.T) {
 	}
 
 	f := func(m1 IndexMessage) bool {
-		for _, f := range m1.Files {
+		for j, f := range m1.Files {
+			m1.Files[j].Xattrs = nil
+			m1.Files[j].Owner = nil
+			m1.Files[j].LinkGroup = ""
+			m1.Files[j].Created = 0
+			m1.Files[j].Attributes = 0
 			for i := range f.Blocks {
 				f.Blocks[i].Offset = 0
 				if len(f.Blocks[i].Hash) == 0 {
@@ -277,6 +282,13 @@ func TestMarshalIndexMessage(t *testing.T) {
 				}
 			}
 		}
+		for _, md := range m1.Metadata {
+			for i := range md.Xattrs {
+				if len(md.Xattrs[i].Value) == 0 {
+					md.Xattrs[i].Value = nil
+				}
+			}
+		}
 
 		return testMarshal(t, "index", &m1, &IndexMessage{})
 	}
@@ -286,6 +298,75 @@ func TestMarshalIndexMessage(t *testing.T) {
 	}
 }
 
+func TestIndexMessageMetadata(t *testing.T) {
+	files := []FileInfo{
+		{Name: "a"},
+		{Name: "b", Xattrs: []Xattr{{Name: "user.test", Value: []byte("value")}}},
+		{Name: "c", Owner: &FileOwner{UID: 0, GID: 42}},
+		{Name: "d", LinkGroup: "a"},
+		{Name: "e", Created: 1420070400123456789},
+		{Name: "f", Attributes: AttrHidden | AttrSystem},
+	}
+
+	im := indexMessage("default", files)
+	if len(im.Metadata) != 5 || im.Metadata[0].Name != "b" || im.Metadata[1].Name != "c" || im.Metadata[2].Name != "d" ||
+		im.Metadata[3].Name != "e" || im.Metadata[4].Name != "f" {
+		t.Fatalf("unexpected metadata %v", im.Metadata)
+	}
+
+	bs, err := im.MarshalXDR()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var res IndexMessage
+	if err := res.UnmarshalXDR(bs); err != nil {
+		t.Fatal(err)
+	}
+	if res.Files[1].Xattrs != nil {
+		t.Error("xattrs should not be encoded in the file info")
+	}
+	applyMetadata(res)
+	if res.Files[0].Xattrs != nil {
+		t.Errorf("unexpected xattrs %v on a", res.Files[0].Xattrs)
+	}
+	if !reflect.DeepEqual(res.Files[1].Xattrs, files[1].Xattrs) {
+		t.Errorf("incorrect xattrs %v on b", res.Files[1].Xattrs)
+	}
+	if res.Files[1].Owner != nil {
+		t.Errorf("unexpected owner %v on b", res.Files[1].Owner)
+	}
+	if !reflect.DeepEqual(res.Files[2].Owner, files[2].Owner) {
+		t.Errorf("incorrect owner %v on c", res.Files[2].Owner)
+	}
+	if res.Files[3].LinkGroup != "a" {
+		t.Errorf("incorrect link group %q on d", res.Files[3].LinkGroup)
+	}
+	if res.Files[4].Created != files[4].Created {
+		t.Errorf("incorrect creation time %d on e", res.Files[4].Created)
+	}
+	if res.Files[5].Attributes != files[5].Attributes {
+		t.Errorf("incorrect attributes %d on f", res.Files[5].Attributes)
+	}
+
+	// A message without the metadata list, as sent by an older peer,
+	// decodes with an EOF error that the reader ignores.
+	im.Metadata = nil
+	bs, err = im.MarshalXDR()
+	if err != nil {
+		t.Fatal(err)
+	}
+	bs = bs[:len(bs)-4]
+	res = IndexMessage{}
+	err = res.UnmarshalXDR(bs)
+	if xdrErr, ok := err.(isEofer); !ok || !xdrErr.IsEOF() {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if len(res.Files) != len(files) || len(res.Metadata) != 0 {
+		t.Errorf("unexpected result %v", res)
+	}
+}
+
 func TestMarshalRequestMessage(t *testing.T) {
 	var quickCfg = &quick.Config{MaxCountScale: 10}
 	if testing.Short() {
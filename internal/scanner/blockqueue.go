@@ -16,25 +16,43 @@
 package scanner
 
 import (
+	"bytes"
+	"io"
 	"os"
 	"path/filepath"
+	"runtime"
 	"sync"
+	"sync/atomic"
 
+	"github.com/syncthing/syncthing/internal/fs"
+	"github.com/syncthing/syncthing/internal/osutil"
 	"github.com/syncthing/syncthing/internal/protocol"
 )
 
 // The parallell hasher reads FileInfo structures from the inbox, hashes the
 // file to populate the Blocks element and sends it to the outbox. A number of
 // workers are used in parallel. The outbox will become closed when the inbox
-// is closed and all items handled.
+// is closed and all items handled. Unless prio is IOPriorityNormal, each
+// worker runs on its own thread with the given I/O priority. Files that are
+// locked are recorded in locked, and files that can't be read for lack of
+// permission in unreadable, if not nil.
 
-func newParallelHasher(dir string, blockSize, workers int, outbox, inbox chan protocol.FileInfo) {
+func newParallelHasher(filesystem fs.Filesystem, dir string, blockSize, workers int, outbox, inbox chan protocol.FileInfo, stats *Stats, prio osutil.IOPriority, locked LockedFiles, unreadable UnreadableFiles) {
 	var wg sync.WaitGroup
 	wg.Add(workers)
 
 	for i := 0; i < workers; i++ {
 		go func() {
-			hashFiles(dir, blockSize, outbox, inbox)
+			if prio != osutil.IOPriorityNormal {
+				runtime.LockOSThread()
+				defer runtime.UnlockOSThread()
+				restore, err := osutil.SetIOPriority(prio)
+				if err != nil && debug {
+					l.Debugln("set I/O priority:", err)
+				}
+				defer restore()
+			}
+			hashFiles(filesystem, dir, blockSize, outbox, inbox, stats, locked, unreadable)
 			wg.Done()
 		}()
 	}
@@ -45,8 +63,8 @@ func newParallelHasher(dir string, blockSize, workers int, outbox, inbox chan pr
 	}()
 }
 
-func HashFile(path string, blockSize int) ([]protocol.BlockInfo, error) {
-	fd, err := os.Open(path)
+func HashFile(filesystem fs.Filesystem, path string, blockSize int) ([]protocol.BlockInfo, error) {
+	fd, err := filesystem.Open(path)
 	if err != nil {
 		if debug {
 			l.Debugln("open:", err)
@@ -66,20 +84,112 @@ func HashFile(path string, blockSize int) ([]protocol.BlockInfo, error) {
 	return Blocks(fd, blockSize, fi.Size())
 }
 
-func hashFiles(dir string, blockSize int, outbox, inbox chan protocol.FileInfo) {
+// hashAppended hashes the file at path, which is expected to be the file
+// described by prev with data appended to it. The complete blocks of prev are
+// reused if the last of them is unchanged, in which case only the data after
+// them is read. Otherwise the whole file is hashed. The returned size is the
+// amount of data hashed that was not reused from prev.
+func hashAppended(filesystem fs.Filesystem, path string, blockSize int, prev []protocol.BlockInfo) ([]protocol.BlockInfo, int64, error) {
+	var full int
+	for full < len(prev) && prev[full].Size == uint32(blockSize) && prev[full].Offset == int64(full*blockSize) {
+		full++
+	}
+	if full == 0 {
+		blocks, err := HashFile(filesystem, path, blockSize)
+		return blocks, blocksSize(blocks), err
+	}
+
+	fd, err := filesystem.Open(path)
+	if err != nil {
+		if debug {
+			l.Debugln("open:", err)
+		}
+		return []protocol.BlockInfo{}, 0, err
+	}
+	defer fd.Close()
+
+	fi, err := fd.Stat()
+	if err != nil {
+		if debug {
+			l.Debugln("stat:", err)
+		}
+		return []protocol.BlockInfo{}, 0, err
+	}
+
+	offset := int64(full * blockSize)
+	if fi.Size() >= offset {
+		last := prev[full-1]
+		check, err := Blocks(io.NewSectionReader(fd, last.Offset, int64(last.Size)), blockSize, int64(last.Size))
+		if err == nil && len(check) == 1 && check[0].Size == last.Size && bytes.Equal(check[0].Hash, last.Hash) {
+			tail, err := Blocks(io.NewSectionReader(fd, offset, fi.Size()-offset), blockSize, fi.Size()-offset)
+			if err != nil {
+				return nil, 0, err
+			}
+			blocks := make([]protocol.BlockInfo, full, full+len(tail))
+			copy(blocks, prev)
+			for _, b := range tail {
+				if b.Size == 0 {
+					// Nothing was appended after all
+					break
+				}
+				b.Offset += offset
+				blocks = append(blocks, b)
+			}
+			return blocks, fi.Size() - offset, nil
+		}
+	}
+
+	if debug {
+		l.Debugln("not appended to, rehashing:", path)
+	}
+	blocks, err := Blocks(io.NewSectionReader(fd, 0, fi.Size()), blockSize, fi.Size())
+	return blocks, blocksSize(blocks), err
+}
+
+func blocksSize(blocks []protocol.BlockInfo) int64 {
+	var size int64
+	for _, b := range blocks {
+		size += int64(b.Size)
+	}
+	return size
+}
+
+func hashFiles(filesystem fs.Filesystem, dir string, blockSize int, outbox, inbox chan protocol.FileInfo, stats *Stats, locked LockedFiles, unreadable UnreadableFiles) {
 	for f := range inbox {
 		if f.IsDirectory() || f.IsDeleted() || f.IsSymlink() {
 			outbox <- f
 			continue
 		}
 
-		blocks, err := HashFile(filepath.Join(dir, f.Name), blockSize)
+		var blocks []protocol.BlockInfo
+		var hashed int64
+		var err error
+		if len(f.Blocks) > 0 {
+			blocks, hashed, err = hashAppended(filesystem, filepath.Join(dir, f.Name), blockSize, f.Blocks)
+		} else {
+			blocks, err = HashFile(filesystem, filepath.Join(dir, f.Name), blockSize)
+			hashed = blocksSize(blocks)
+		}
 		if err != nil {
 			if debug {
 				l.Debugln("hash error:", f.Name, err)
 			}
+			if locked != nil && osutil.IsLocked(err) {
+				locked.Locked(f.Name)
+			}
+			if unreadable != nil && os.IsPermission(err) {
+				unreadable.Unreadable(f.Name, err)
+			}
 			continue
 		}
+		if locked != nil {
+			locked.Hashed(f.Name)
+		}
+
+		if stats != nil {
+			atomic.AddInt64(&stats.FilesHashed, 1)
+			atomic.AddInt64(&stats.BytesHashed, hashed)
+		}
 
 		f.Blocks = blocks
 		outbox <- f
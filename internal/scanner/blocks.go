@@ -162,3 +162,20 @@ func BlocksEqual(src, tgt []protocol.BlockInfo) bool {
 	}
 	return true
 }
+
+// sha256OfZeroBlock is the hash of a full size block of zeros.
+var sha256OfZeroBlock = sha256.Sum256(make([]byte, protocol.BlockSize))
+
+// IsZeroBlock returns whether the block consists of only zeros, judging by
+// its hash.
+func IsZeroBlock(block protocol.BlockInfo) bool {
+	switch block.Size {
+	case 0:
+		return false
+	case protocol.BlockSize:
+		return bytes.Equal(block.Hash, sha256OfZeroBlock[:])
+	default:
+		hash := sha256.Sum256(make([]byte, block.Size))
+		return bytes.Equal(block.Hash, hash[:])
+	}
+}
@@ -131,3 +131,23 @@ func TestDiff(t *testing.T) {
 		}
 	}
 }
+
+func TestIsZeroBlock(t *testing.T) {
+	data := make([]byte, 2*protocol.BlockSize+42)
+	data[protocol.BlockSize+1] = 1
+	blocks, err := Blocks(bytes.NewReader(data), protocol.BlockSize, int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, zero := range []bool{true, false, true} {
+		if IsZeroBlock(blocks[i]) != zero {
+			t.Errorf("Block %d: IsZeroBlock != %v", i, zero)
+		}
+	}
+
+	empty, _ := Blocks(bytes.NewReader(nil), protocol.BlockSize, 0)
+	if IsZeroBlock(empty[0]) {
+		t.Error("The block of an empty file is not a zero block")
+	}
+}
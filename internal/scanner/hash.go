@@ -0,0 +1,131 @@
+// Copyright (C) 2014 The Syncthing Authors.
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for
+// more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package scanner
+
+import (
+	"crypto/sha256"
+	"hash"
+	"io/ioutil"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HashPerf is the measured performance of a SHA-256 implementation.
+type HashPerf struct {
+	Implementation string
+	MiBps          float64 // Single threaded throughput
+	CPUExtensions  bool    // The CPU has SHA-256 instructions; whether the implementation uses them depends on the Go version it's built with
+}
+
+var (
+	measuredPerf HashPerf
+	measuredMut  sync.Mutex
+)
+
+// MeasureHash measures the throughput of crypto/sha256, the only SHA-256
+// implementation there is to hash with, and looks for the SHA-256
+// instructions of the CPU.
+func MeasureHash() HashPerf {
+	perf := HashPerf{
+		Implementation: "crypto/sha256",
+		MiBps:          benchHash(sha256.New),
+		CPUExtensions:  cpuHasSHA256(),
+	}
+	if debug {
+		l.Debugf("hash: %s: %.0f MiB/s", perf.Implementation, perf.MiBps)
+	}
+
+	measuredMut.Lock()
+	measuredPerf = perf
+	measuredMut.Unlock()
+	return perf
+}
+
+// MeasuredHash returns the performance measured by MeasureHash, or the zero
+// HashPerf when it hasn't been called.
+func MeasuredHash() HashPerf {
+	measuredMut.Lock()
+	defer measuredMut.Unlock()
+	return measuredPerf
+}
+
+// benchHash returns the best single threaded throughput, in MiB/s, of a few
+// short rounds of hashing.
+func benchHash(newHash func() hash.Hash) float64 {
+	bs := make([]byte, 128<<10)
+	var best float64
+	for i := 0; i < 3; i++ {
+		h := newHash()
+		t0 := time.Now()
+		n := 0
+		for time.Since(t0) < 50*time.Millisecond {
+			h.Write(bs)
+			n += len(bs)
+		}
+		h.Sum(nil)
+		if perf := float64(n) / time.Since(t0).Seconds() / (1 << 20); perf > best {
+			best = perf
+		}
+	}
+	return best
+}
+
+// cpuHasSHA256 returns whether the CPU is known to have SHA-256
+// instructions. Only the CPU flags reported by Linux, and the ARM based
+// Macs, are known.
+func cpuHasSHA256() bool {
+	if runtime.GOOS == "darwin" && runtime.GOARCH == "arm64" {
+		return true
+	}
+	if runtime.GOOS != "linux" {
+		return false
+	}
+	bs, err := ioutil.ReadFile("/proc/cpuinfo")
+	if err != nil {
+		return false
+	}
+	return cpuInfoHasSHA256(string(bs), runtime.GOARCH)
+}
+
+// cpuInfoHasSHA256 returns whether the /proc/cpuinfo contents list the
+// SHA-256 instructions for the architecture.
+func cpuInfoHasSHA256(cpuinfo, arch string) bool {
+	var key, flag string
+	switch arch {
+	case "amd64":
+		key, flag = "flags", "sha_ni"
+	case "arm64":
+		key, flag = "Features", "sha2"
+	default:
+		return false
+	}
+	for _, line := range strings.Split(cpuinfo, "\n") {
+		fields := strings.SplitN(line, ":", 2)
+		if len(fields) != 2 || strings.TrimSpace(fields[0]) != key {
+			continue
+		}
+		for _, f := range strings.Fields(fields[1]) {
+			if f == flag {
+				return true
+			}
+		}
+		// All cores have the same flags.
+		return false
+	}
+	return false
+}
@@ -0,0 +1,49 @@
+// Copyright (C) 2014 The Syncthing Authors.
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for
+// more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package scanner
+
+import "testing"
+
+func TestCPUInfoHasSHA256(t *testing.T) {
+	cases := []struct {
+		cpuinfo string
+		arch    string
+		has     bool
+	}{
+		{"processor\t: 0\nflags\t\t: fpu sse2 sha_ni avx2\n", "amd64", true},
+		{"processor\t: 0\nflags\t\t: fpu sse2 avx2\n", "amd64", false},
+		{"processor\t: 0\nFeatures\t: fp asimd aes sha1 sha2 crc32\n", "arm64", true},
+		{"processor\t: 0\nFeatures\t: fp asimd crc32\n", "arm64", false},
+		{"processor\t: 0\nflags\t\t: sha_ni\n", "arm64", false},
+		{"processor\t: 0\nflags\t\t: sha_ni\n", "386", false},
+		{"processor\t: 0\nflags\t\t: sha_ni\n", "mips", false},
+	}
+	for i, tc := range cases {
+		if has := cpuInfoHasSHA256(tc.cpuinfo, tc.arch); has != tc.has {
+			t.Errorf("%d: %v != expected %v", i, has, tc.has)
+		}
+	}
+}
+
+func TestMeasureHash(t *testing.T) {
+	perf := MeasureHash()
+	if perf.Implementation == "" || perf.MiBps <= 0 {
+		t.Errorf("Unexpected hash performance %+v", perf)
+	}
+	if got := MeasuredHash(); got != perf {
+		t.Errorf("Reported %+v != measured %+v", got, perf)
+	}
+}
@@ -16,17 +16,21 @@
 package scanner
 
 import (
+	"bytes"
 	"errors"
 	"os"
 	"path/filepath"
 	"runtime"
 	"strings"
+	"sync/atomic"
 	"time"
 
+	"github.com/juju/ratelimit"
+	"github.com/syncthing/syncthing/internal/fs"
 	"github.com/syncthing/syncthing/internal/ignore"
 	"github.com/syncthing/syncthing/internal/lamport"
+	"github.com/syncthing/syncthing/internal/osutil"
 	"github.com/syncthing/syncthing/internal/protocol"
-	"github.com/syncthing/syncthing/internal/symlinks"
 	"golang.org/x/text/unicode/norm"
 )
 
@@ -45,12 +49,75 @@ type Walker struct {
 	TempLifetime time.Duration
 	// If CurrentFiler is not nil, it is queried for the current file before rescanning.
 	CurrentFiler CurrentFiler
+	// If Seeds is not nil, files unknown to CurrentFiler that have the size,
+	// modification time and permissions Seeds has for them, and whose first
+	// and last blocks hash as it says, are taken to have its block list
+	// rather than being hashed in full.
+	Seeds CurrentFiler
 	// If IgnorePerms is true, changes to permission bits will not be
 	// detected. Scanned files will get zero permission bits and the
 	// NoPermissionBits flag set.
 	IgnorePerms bool
 	// Number of routines to use for hashing
 	Hashers int
+	// If Xattrs is true, the extended attributes of files and directories
+	// are read and included in the scanned files, and changes to them are
+	// detected.
+	Xattrs bool
+	// If Ownership is true, the numeric owner of files and directories is
+	// included in the scanned files, and changes to it are detected.
+	Ownership bool
+	// If Hardlinks is true, files that are hard linked with each other are
+	// given the same link group in the scanned files.
+	Hardlinks bool
+	// If CreationTime is true, the creation time of files and directories
+	// is included in the scanned files, where the operating system keeps
+	// one, and changes to it are detected.
+	CreationTime bool
+	// If Attributes is true, the file attributes of files and directories
+	// kept by the operating system are included in the scanned files, and
+	// changes to them are detected. Attributes it doesn't keep are kept as
+	// they are in the index.
+	Attributes bool
+	// If AppendOnly is true, files that have grown since the last scan are
+	// assumed to have been appended to. The previously hashed blocks are
+	// kept after checking the last complete one, and only the rest of the
+	// file is hashed.
+	AppendOnly bool
+	// IOPriority is the I/O priority of the threads hashing files. It is
+	// only changed on Linux.
+	IOPriority osutil.IOPriority
+	// If Stats is not nil, the work done by the walk is counted in it.
+	Stats *Stats
+	// Filesystem is used to access the files, or the local file system if
+	// Filesystem is nil.
+	Filesystem fs.Filesystem
+	// If LockedFiles is not nil, files that can't be hashed because another
+	// program has them locked are recorded in it, and aren't tried again
+	// until it says so.
+	LockedFiles LockedFiles
+	// If Unreadable is not nil, files and directories that can't be read
+	// for lack of permission are reported to it. They are skipped, as are
+	// their contents.
+	Unreadable UnreadableFiles
+	// ConflictDir is the directory conflict copies are written to,
+	// relative to Dir, if any. It's skipped along with its contents.
+	ConflictDir string
+	// If FilesPerSecond is above zero, at most this many directory entries
+	// are looked at per second, to limit the load of metadata operations on
+	// the file system.
+	FilesPerSecond int
+	// If DirMtimes is true, changes to the modification times of
+	// directories are detected.
+	DirMtimes bool
+}
+
+// Stats counts the work done by a walk. The counters are updated atomically
+// while the walk is in progress.
+type Stats struct {
+	FilesHashed  int64 // regular files hashed
+	BytesHashed  int64 // data read for hashing
+	FilesSkipped int64 // regular files that were unchanged and not hashed
 }
 
 type TempNamer interface {
@@ -65,6 +132,23 @@ type CurrentFiler interface {
 	CurrentFile(name string) (protocol.FileInfo, bool)
 }
 
+// LockedFiles keeps track of the files that another program had locked
+// when the walker tried to hash them.
+type LockedFiles interface {
+	// Locked records that the file couldn't be hashed as it's locked.
+	Locked(name string)
+	// Hashed records that the file has been hashed.
+	Hashed(name string)
+	// Deferred returns whether the file, found locked before, should be
+	// left alone for now.
+	Deferred(name string) bool
+}
+
+type UnreadableFiles interface {
+	// Unreadable records that the file or directory couldn't be read.
+	Unreadable(name string, err error)
+}
+
 // Walk returns the list of files found in the local folder by scanning the
 // file system. Files are blockwise hashed.
 func (w *Walker) Walk() (chan protocol.FileInfo, error) {
@@ -72,7 +156,11 @@ func (w *Walker) Walk() (chan protocol.FileInfo, error) {
 		l.Debugln("Walk", w.Dir, w.Sub, w.BlockSize, w.Matcher)
 	}
 
-	err := checkDir(w.Dir)
+	if w.Filesystem == nil {
+		w.Filesystem = fs.DefaultFilesystem
+	}
+
+	err := checkDir(w.Filesystem, w.Dir)
 	if err != nil {
 		return nil, err
 	}
@@ -84,24 +172,45 @@ func (w *Walker) Walk() (chan protocol.FileInfo, error) {
 
 	files := make(chan protocol.FileInfo)
 	hashedFiles := make(chan protocol.FileInfo)
-	newParallelHasher(w.Dir, w.BlockSize, workers, hashedFiles, files)
+	newParallelHasher(w.Filesystem, w.Dir, w.BlockSize, workers, hashedFiles, files, w.Stats, w.IOPriority, w.LockedFiles, w.Unreadable)
 
 	go func() {
-		hashFiles := w.walkAndHashFiles(files)
-		filepath.Walk(filepath.Join(w.Dir, w.Sub), hashFiles)
+		hashFiles := w.walkAndHashFiles(files, hashedFiles)
+		w.Filesystem.Walk(filepath.Join(w.Dir, w.Sub), hashFiles)
 		close(files)
 	}()
 
 	return hashedFiles, nil
 }
 
-func (w *Walker) walkAndHashFiles(fchan chan protocol.FileInfo) filepath.WalkFunc {
+// inConflictDir returns true if rn is the conflict directory or within it.
+func (w *Walker) inConflictDir(rn string) bool {
+	if w.ConflictDir == "" {
+		return false
+	}
+	return rn == w.ConflictDir || strings.HasPrefix(rn, w.ConflictDir+string(filepath.Separator))
+}
+
+func (w *Walker) walkAndHashFiles(fchan, seededChan chan protocol.FileInfo) filepath.WalkFunc {
 	now := time.Now()
+	readXattrs := w.xattrReader()
+	linkGroup := w.linkGrouper()
+	var bucket *ratelimit.Bucket
+	if w.FilesPerSecond > 0 {
+		bucket = ratelimit.NewBucketWithRate(float64(w.FilesPerSecond), 1)
+	}
 	return func(p string, info os.FileInfo, err error) error {
+		if bucket != nil {
+			bucket.Wait(1)
+		}
+
 		if err != nil {
 			if debug {
 				l.Debugln("error:", p, info, err)
 			}
+			if rn, rerr := filepath.Rel(w.Dir, p); rerr == nil && w.Unreadable != nil && os.IsPermission(err) {
+				w.Unreadable.Unreadable(rn, err)
+			}
 			return nil
 		}
 
@@ -123,7 +232,7 @@ func (w *Walker) walkAndHashFiles(fchan chan protocol.FileInfo) filepath.WalkFun
 				l.Debugln("temporary:", rn)
 			}
 			if info.Mode().IsRegular() && info.ModTime().Add(w.TempLifetime).Before(now) {
-				os.Remove(p)
+				w.Filesystem.Remove(p)
 				if debug {
 					l.Debugln("removing temporary:", rn, info.ModTime())
 				}
@@ -131,8 +240,8 @@ func (w *Walker) walkAndHashFiles(fchan chan protocol.FileInfo) filepath.WalkFun
 			return nil
 		}
 
-		if sn := filepath.Base(rn); sn == ".stignore" || sn == ".stfolder" ||
-			strings.HasPrefix(rn, ".stversions") || (w.Matcher != nil && w.Matcher.Match(rn)) {
+		if sn := filepath.Base(rn); sn == ".stignore" || sn == ".stpin" || sn == ".stfolder" ||
+			strings.HasPrefix(rn, ".stversions") || w.inConflictDir(rn) || (w.Matcher != nil && w.Matcher.Match(rn)) {
 			// An ignored file
 			if debug {
 				l.Debugln("ignored:", rn)
@@ -162,7 +271,7 @@ func (w *Walker) walkAndHashFiles(fchan chan protocol.FileInfo) filepath.WalkFun
 			}
 
 			// If we don't support symlinks, skip.
-			if !symlinks.Supported {
+			if !w.Filesystem.SymlinksSupported() {
 				return rval
 			}
 
@@ -171,7 +280,7 @@ func (w *Walker) walkAndHashFiles(fchan chan protocol.FileInfo) filepath.WalkFun
 			// checking that their existing blocks match with the blocks in
 			// the index.
 
-			target, flags, err := symlinks.Read(p)
+			target, flags, err := w.Filesystem.ReadSymlink(p)
 			flags = flags & protocol.SymlinkTypeMask
 			if err != nil {
 				if debug {
@@ -220,6 +329,10 @@ func (w *Walker) walkAndHashFiles(fchan chan protocol.FileInfo) filepath.WalkFun
 		}
 
 		if info.Mode().IsDir() {
+			xattrs, xattrsOK := readXattrs(p)
+			owner, ownerOK := w.fileOwner(info)
+			created, createdOK := w.creationTime(info)
+			fattrs, fattrsOK := w.attributes(p)
 			if w.CurrentFiler != nil {
 				// A directory is "unchanged", if it
 				//  - exists
@@ -228,11 +341,31 @@ func (w *Walker) walkAndHashFiles(fchan chan protocol.FileInfo) filepath.WalkFun
 				//  - was a directory previously (not a file or something else)
 				//  - was not a symlink (since it's a directory now)
 				//  - was not invalid (since it looks valid now)
+				//  - has the same extended attributes, if we are syncing them
+				//  - has the same owner, if we are syncing it
+				//  - has the same creation time, if we are syncing it
+				//  - has the same attributes, if we are syncing them
+				//  - has the same modification time, if we are syncing it
 				cf, ok := w.CurrentFiler.CurrentFile(rn)
 				permUnchanged := w.IgnorePerms || !cf.HasPermissionBits() || PermsEqual(cf.Flags, uint32(info.Mode()))
-				if ok && permUnchanged && !cf.IsDeleted() && cf.IsDirectory() && !cf.IsSymlink() && !cf.IsInvalid() {
+				mtimeUnchanged := !w.DirMtimes || cf.Modified == info.ModTime().Unix()
+				if ok && permUnchanged && mtimeUnchanged && !cf.IsDeleted() && cf.IsDirectory() && !cf.IsSymlink() && !cf.IsInvalid() &&
+					(!xattrsOK || XattrsEqual(cf.Xattrs, xattrs)) && (!ownerOK || OwnerEqual(cf.Owner, owner)) &&
+					(!createdOK || CreationTimeEqual(cf.Created, created)) && (!fattrsOK || AttributesEqual(cf.Attributes, fattrs)) {
 					return nil
 				}
+				if ok && !xattrsOK {
+					xattrs = cf.Xattrs
+				}
+				if ok && !ownerOK {
+					owner = cf.Owner
+				}
+				if ok && !createdOK {
+					created = cf.Created
+				}
+				if ok {
+					fattrs = mergeAttributes(cf.Attributes, fattrs, fattrsOK)
+				}
 			}
 
 			flags := uint32(protocol.FlagDirectory)
@@ -242,10 +375,14 @@ func (w *Walker) walkAndHashFiles(fchan chan protocol.FileInfo) filepath.WalkFun
 				flags |= uint32(info.Mode() & os.ModePerm)
 			}
 			f := protocol.FileInfo{
-				Name:     rn,
-				Version:  lamport.Default.Tick(0),
-				Flags:    flags,
-				Modified: info.ModTime().Unix(),
+				Name:       rn,
+				Version:    lamport.Default.Tick(0),
+				Flags:      flags,
+				Modified:   info.ModTime().Unix(),
+				Xattrs:     xattrs,
+				Owner:      owner,
+				Created:    created,
+				Attributes: fattrs,
 			}
 			if debug {
 				l.Debugln("dir:", p, f)
@@ -255,6 +392,13 @@ func (w *Walker) walkAndHashFiles(fchan chan protocol.FileInfo) filepath.WalkFun
 		}
 
 		if info.Mode().IsRegular() {
+			xattrs, xattrsOK := readXattrs(p)
+			owner, ownerOK := w.fileOwner(info)
+			group, groupOK := linkGroup(rn, info)
+			created, createdOK := w.creationTime(info)
+			fattrs, fattrsOK := w.attributes(p)
+			var prevBlocks []protocol.BlockInfo
+			indexed := false
 			if w.CurrentFiler != nil {
 				// A file is "unchanged", if it
 				//  - exists
@@ -265,13 +409,56 @@ func (w *Walker) walkAndHashFiles(fchan chan protocol.FileInfo) filepath.WalkFun
 				//  - was not a symlink (since it's a file now)
 				//  - was not invalid (since it looks valid now)
 				//  - has the same size as previously
+				//  - has the same extended attributes, if we are syncing them
+				//  - has the same owner, if we are syncing it
+				//  - is in the same link group, if we are preserving hard links
+				//  - has the same creation time, if we are syncing it
+				//  - has the same attributes, if we are syncing them
 				cf, ok := w.CurrentFiler.CurrentFile(rn)
+				indexed = ok
 				permUnchanged := w.IgnorePerms || !cf.HasPermissionBits() || PermsEqual(cf.Flags, uint32(info.Mode()))
 				if ok && permUnchanged && !cf.IsDeleted() && cf.Modified == info.ModTime().Unix() && !cf.IsDirectory() &&
-					!cf.IsSymlink() && !cf.IsInvalid() && cf.Size() == info.Size() {
+					!cf.IsSymlink() && !cf.IsInvalid() && cf.Size() == info.Size() &&
+					(!xattrsOK || XattrsEqual(cf.Xattrs, xattrs)) && (!ownerOK || OwnerEqual(cf.Owner, owner)) &&
+					(!groupOK || cf.LinkGroup == group) && (!createdOK || CreationTimeEqual(cf.Created, created)) &&
+					(!fattrsOK || AttributesEqual(cf.Attributes, fattrs)) {
+					w.countSkipped()
+					return nil
+				}
+
+				// A placeholder is an invalid file that retains the block
+				// list of the file it stands in for. It is "unchanged" as
+				// long as the modification time and size are untouched, as
+				// it would otherwise be mistaken for a local change.
+				if ok && cf.IsInvalid() && cf.IsPlaceholder() && !cf.IsDeleted() && len(cf.Blocks) > 0 && cf.Modified == info.ModTime().Unix() &&
+					cf.Size() == info.Size() {
+					w.countSkipped()
 					return nil
 				}
 
+				if ok && !xattrsOK {
+					xattrs = cf.Xattrs
+				}
+				if ok && !ownerOK {
+					owner = cf.Owner
+				}
+				if ok && !groupOK {
+					group = cf.LinkGroup
+				}
+				if ok && !createdOK {
+					created = cf.Created
+				}
+				if ok {
+					fattrs = mergeAttributes(cf.Attributes, fattrs, fattrsOK)
+				}
+
+				// Hand the previous block list to the hasher, to resume
+				// hashing from where it left off.
+				if ok && w.AppendOnly && !cf.IsDeleted() && !cf.IsDirectory() && !cf.IsSymlink() && !cf.IsInvalid() &&
+					info.Size() > cf.Size() {
+					prevBlocks = cf.Blocks
+				}
+
 				if debug {
 					l.Debugln("rescan:", cf, info.ModTime().Unix(), info.Mode()&os.ModePerm)
 				}
@@ -283,10 +470,37 @@ func (w *Walker) walkAndHashFiles(fchan chan protocol.FileInfo) filepath.WalkFun
 			}
 
 			f := protocol.FileInfo{
-				Name:     rn,
-				Version:  lamport.Default.Tick(0),
-				Flags:    flags,
-				Modified: info.ModTime().Unix(),
+				Name:       rn,
+				Version:    lamport.Default.Tick(0),
+				Flags:      flags,
+				Modified:   info.ModTime().Unix(),
+				Xattrs:     xattrs,
+				Owner:      owner,
+				LinkGroup:  group,
+				Created:    created,
+				Attributes: fattrs,
+				Blocks:     prevBlocks,
+			}
+			if w.LockedFiles != nil && w.LockedFiles.Deferred(rn) {
+				// The last change is picked up once it's no longer
+				// locked, or tried again.
+				if debug {
+					l.Debugln("locked, deferred:", rn)
+				}
+				return nil
+			}
+			if !indexed && w.Seeds != nil {
+				sf, ok := w.Seeds.CurrentFile(rn)
+				if ok && !sf.IsDeleted() && !sf.IsDirectory() && !sf.IsSymlink() && !sf.IsInvalid() &&
+					sf.Modified == f.Modified && sf.Size() == info.Size() && (w.IgnorePerms || PermsEqual(sf.Flags, f.Flags)) &&
+					w.seedMatches(p, sf) {
+					f.Blocks = sf.Blocks
+					if debug {
+						l.Debugln("seeded:", p, f)
+					}
+					seededChan <- f
+					return nil
+				}
 			}
 			if debug {
 				l.Debugln("to hash:", p, f)
@@ -298,8 +512,154 @@ func (w *Walker) walkAndHashFiles(fchan chan protocol.FileInfo) filepath.WalkFun
 	}
 }
 
-func checkDir(dir string) error {
-	if info, err := os.Lstat(dir); err != nil {
+// seedMatches returns whether the first and last blocks of the file at path
+// have the hashes the seed has for them. A file with the seed's size and
+// modification time may still differ from it, and must then be hashed.
+func (w *Walker) seedMatches(path string, seed protocol.FileInfo) bool {
+	if len(seed.Blocks) == 0 {
+		return false
+	}
+	fd, err := w.Filesystem.Open(path)
+	if err != nil {
+		return false
+	}
+	defer fd.Close()
+
+	for _, block := range []protocol.BlockInfo{seed.Blocks[0], seed.Blocks[len(seed.Blocks)-1]} {
+		buf := make([]byte, block.Size)
+		if _, err := fd.ReadAt(buf, block.Offset); err != nil {
+			return false
+		}
+		if _, err := VerifyBuffer(buf, block); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+func (w *Walker) countSkipped() {
+	if w.Stats != nil {
+		atomic.AddInt64(&w.Stats.FilesSkipped, 1)
+	}
+}
+
+// Extended attributes larger than the protocol allows are not synced.
+const (
+	maxXattrs         = 64
+	maxXattrNameLen   = 255
+	maxXattrValueSize = 65536
+)
+
+// xattrReader returns a function that reads the extended attributes of a
+// path. The boolean is false when the attributes could not be read, or we
+// are not syncing them, in which case the previously known attributes are
+// kept. A file system that doesn't support extended attributes is logged
+// once and then not asked again.
+func (w *Walker) xattrReader() func(p string) ([]protocol.Xattr, bool) {
+	supported := w.Xattrs
+	return func(p string) ([]protocol.Xattr, bool) {
+		if !supported {
+			return nil, false
+		}
+
+		xattrs, err := osutil.GetXattrs(p)
+		if err == osutil.ErrXattrsUnsupported {
+			l.Infof("Extended attributes are not supported in %q; not syncing them", w.Dir)
+			supported = false
+			return nil, false
+		} else if err != nil {
+			if debug {
+				l.Debugln("xattr error:", p, err)
+			}
+			return nil, false
+		}
+
+		res := xattrs[:0]
+		for _, x := range xattrs {
+			if len(res) == maxXattrs {
+				break
+			}
+			if len(x.Name) > maxXattrNameLen || len(x.Value) > maxXattrValueSize {
+				if debug {
+					l.Debugln("xattr too large:", p, x.Name)
+				}
+				continue
+			}
+			res = append(res, x)
+		}
+		if len(res) == 0 {
+			return nil, true
+		}
+		return res, true
+	}
+}
+
+// fileOwner returns the owner of the file described by info. The boolean is
+// false when the owner is unknown, or we are not syncing it.
+func (w *Walker) fileOwner(info os.FileInfo) (*protocol.FileOwner, bool) {
+	if !w.Ownership {
+		return nil, false
+	}
+	return osutil.FileOwner(info)
+}
+
+// creationTime returns the creation time of the file described by info.
+// The boolean is false when the time is unknown, or we are not syncing it.
+func (w *Walker) creationTime(info os.FileInfo) (int64, bool) {
+	if !w.CreationTime {
+		return 0, false
+	}
+	return osutil.CreationTime(info)
+}
+
+// attributes returns the file attributes of the file at path. The boolean
+// is false when they can't be read, or we are not syncing them.
+func (w *Walker) attributes(path string) (uint32, bool) {
+	if !w.Attributes {
+		return 0, false
+	}
+	attrs, err := osutil.FileAttributes(path)
+	if err != nil {
+		if debug && err != osutil.ErrAttributesUnsupported {
+			l.Debugln("attributes:", err)
+		}
+		return 0, false
+	}
+	return attrs, true
+}
+
+// linkGrouper returns a function that returns the link group of the file
+// rn, described by info. Files that are hard linked with each other are put
+// in the group named after the first of them seen in the walk. When only part
+// of the folder is walked, the first of them seen keeps the group it had, as
+// the file naming it may be outside the walk. The boolean is false when the
+// group is unknown, or we are not preserving hard links.
+func (w *Walker) linkGrouper() func(rn string, info os.FileInfo) (string, bool) {
+	groups := make(map[string]string)
+	return func(rn string, info os.FileInfo) (string, bool) {
+		if !w.Hardlinks {
+			return "", false
+		}
+		id, ok := osutil.HardlinkID(info)
+		if !ok || id == "" {
+			return "", ok
+		}
+		if group, ok := groups[id]; ok {
+			return group, true
+		}
+		group := rn
+		if w.Sub != "" && w.CurrentFiler != nil {
+			if cf, ok := w.CurrentFiler.CurrentFile(rn); ok && cf.LinkGroup != "" {
+				group = cf.LinkGroup
+			}
+		}
+		groups[id] = group
+		return group, true
+	}
+}
+
+func checkDir(filesystem fs.Filesystem, dir string) error {
+	if info, err := filesystem.Lstat(dir); err != nil {
 		return err
 	} else if !info.IsDir() {
 		return errors.New(dir + ": not a directory")
@@ -309,6 +669,54 @@ func checkDir(dir string) error {
 	return nil
 }
 
+// XattrsEqual returns whether two sorted lists of extended attributes are
+// the same.
+func XattrsEqual(a, b []protocol.Xattr) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].Name != b[i].Name || !bytes.Equal(a[i].Value, b[i].Value) {
+			return false
+		}
+	}
+	return true
+}
+
+// OwnerEqual returns whether two file owners are the same.
+func OwnerEqual(a, b *protocol.FileOwner) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+// CreationTimeEqual returns whether two creation times, in nanoseconds, are
+// the same. File systems keep them with differing precision, down to whole
+// seconds, so times within a second of each other are taken as the same;
+// otherwise a time set on one device may never match that scanned on
+// another.
+func CreationTimeEqual(a, b int64) bool {
+	d := a - b
+	return d > -int64(time.Second) && d < int64(time.Second)
+}
+
+// AttributesEqual returns whether the attributes of a file in the index are
+// the scanned ones. Only the attributes kept by the operating system are
+// compared, as the others can't be scanned.
+func AttributesEqual(indexed, scanned uint32) bool {
+	return indexed&osutil.SupportedAttributes == scanned&osutil.SupportedAttributes
+}
+
+// mergeAttributes returns the attributes of a changed file: those scanned,
+// when ok, and those kept by other operating systems from the index.
+func mergeAttributes(indexed, scanned uint32, ok bool) uint32 {
+	if !ok {
+		return indexed
+	}
+	return indexed&^osutil.SupportedAttributes | scanned&osutil.SupportedAttributes
+}
+
 func PermsEqual(a, b uint32) bool {
 	switch runtime.GOOS {
 	case "windows":
@@ -18,13 +18,20 @@ package scanner
 import (
 	"bytes"
 	"fmt"
+	"io/ioutil"
+	"os"
 	"path/filepath"
 	"reflect"
+	"runtime"
 	rdebug "runtime/debug"
 	"sort"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/syncthing/syncthing/internal/fs"
 	"github.com/syncthing/syncthing/internal/ignore"
+	"github.com/syncthing/syncthing/internal/osutil"
 	"github.com/syncthing/syncthing/internal/protocol"
 )
 
@@ -124,6 +131,87 @@ func TestWalk(t *testing.T) {
 	}
 }
 
+func TestWalkIOPriority(t *testing.T) {
+	ignores := ignore.New(false)
+	err := ignores.Load("testdata/.stignore")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := Walker{
+		Dir:        "testdata",
+		BlockSize:  128 * 1024,
+		Matcher:    ignores,
+		IOPriority: osutil.IOPriorityIdle,
+	}
+
+	fchan, err := w.Walk()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var tmp []protocol.FileInfo
+	for f := range fchan {
+		tmp = append(tmp, f)
+	}
+	sort.Sort(fileList(tmp))
+	files := fileList(tmp).testfiles()
+
+	if !reflect.DeepEqual(files, testdata) {
+		t.Errorf("Walk returned unexpected data\nExpected: %v\nActual: %v", testdata, files)
+	}
+}
+
+// A countingFilesystem counts the files opened through it.
+type countingFilesystem struct {
+	*fs.BasicFilesystem
+	opened int32
+}
+
+func (f *countingFilesystem) Open(name string) (fs.File, error) {
+	atomic.AddInt32(&f.opened, 1)
+	return f.BasicFilesystem.Open(name)
+}
+
+func TestWalkFilesystem(t *testing.T) {
+	ignores := ignore.New(false)
+	err := ignores.Load("testdata/.stignore")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	filesystem := &countingFilesystem{BasicFilesystem: fs.NewBasicFilesystem()}
+	w := Walker{
+		Dir:        "testdata",
+		BlockSize:  128 * 1024,
+		Matcher:    ignores,
+		Filesystem: filesystem,
+	}
+
+	fchan, err := w.Walk()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var tmp []protocol.FileInfo
+	var regular int32
+	for f := range fchan {
+		tmp = append(tmp, f)
+		if !f.IsDirectory() && !f.IsSymlink() {
+			regular++
+		}
+	}
+	sort.Sort(fileList(tmp))
+	files := fileList(tmp).testfiles()
+
+	if !reflect.DeepEqual(files, testdata) {
+		t.Errorf("Walk returned unexpected data\nExpected: %v\nActual: %v", testdata, files)
+	}
+	if opened := atomic.LoadInt32(&filesystem.opened); opened != regular {
+		t.Errorf("Opened %d files through the filesystem, expected %d", opened, regular)
+	}
+}
+
 func TestWalkError(t *testing.T) {
 	w := Walker{
 		Dir:       "testdata-missing",
@@ -146,6 +234,466 @@ func TestWalkError(t *testing.T) {
 	}
 }
 
+type fakeCurrentFiler map[string]protocol.FileInfo
+
+func (f fakeCurrentFiler) CurrentFile(name string) (protocol.FileInfo, bool) {
+	cf, ok := f[name]
+	return cf, ok
+}
+
+func TestWalkXattrs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "walkxattrs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	name := filepath.Join(dir, "file")
+	if err := ioutil.WriteFile(name, []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	xattrs := []protocol.Xattr{{Name: "user.test", Value: []byte("value")}}
+	if err := osutil.SetXattrs(name, xattrs); err == osutil.ErrXattrsUnsupported {
+		t.Skip(err)
+	} else if err != nil {
+		t.Fatal(err)
+	}
+
+	walk := func(w Walker) []protocol.FileInfo {
+		fchan, err := w.Walk()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var files []protocol.FileInfo
+		for f := range fchan {
+			files = append(files, f)
+		}
+		return files
+	}
+
+	w := Walker{
+		Dir:       dir,
+		BlockSize: 128 * 1024,
+		Xattrs:    true,
+	}
+	files := walk(w)
+	if len(files) != 1 || !XattrsEqual(files[0].Xattrs, xattrs) {
+		t.Fatalf("unexpected scan result %v", files)
+	}
+
+	// An unchanged file is not rescanned, but a change to the attributes
+	// is detected.
+	cf := fakeCurrentFiler{"file": files[0]}
+	w.CurrentFiler = cf
+	if files := walk(w); len(files) != 0 {
+		t.Errorf("unexpected rescan %v", files)
+	}
+	if err := osutil.SetXattrs(name, nil); err != nil {
+		t.Fatal(err)
+	}
+	if files := walk(w); len(files) != 1 || files[0].Xattrs != nil {
+		t.Errorf("unexpected scan result %v", files)
+	}
+
+	// When not syncing attributes, changes to them are ignored.
+	w.Xattrs = false
+	if files := walk(w); len(files) != 0 {
+		t.Errorf("unexpected rescan %v", files)
+	}
+}
+
+func TestWalkOwnership(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("file ownership is not supported on Windows")
+	}
+
+	dir, err := ioutil.TempDir("", "walkowner")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "file"), []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	w := Walker{
+		Dir:       dir,
+		BlockSize: 128 * 1024,
+		Ownership: true,
+	}
+	fchan, err := w.Walk()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var files []protocol.FileInfo
+	for f := range fchan {
+		files = append(files, f)
+	}
+
+	owner := &protocol.FileOwner{UID: uint32(os.Getuid()), GID: uint32(os.Getgid())}
+	if len(files) != 1 || !OwnerEqual(files[0].Owner, owner) {
+		t.Fatalf("unexpected scan result %v", files)
+	}
+
+	// A file whose owner differs from the index is rescanned.
+	cf := files[0]
+	cf.Owner = &protocol.FileOwner{UID: owner.UID + 1, GID: owner.GID}
+	w.CurrentFiler = fakeCurrentFiler{"file": cf}
+	fchan, err = w.Walk()
+	if err != nil {
+		t.Fatal(err)
+	}
+	files = files[:0]
+	for f := range fchan {
+		files = append(files, f)
+	}
+	if len(files) != 1 || !OwnerEqual(files[0].Owner, owner) {
+		t.Errorf("unexpected scan result %v", files)
+	}
+}
+
+func TestWalkCreationTime(t *testing.T) {
+	dir, err := ioutil.TempDir("", "walkctime")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "file"), []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	w := Walker{
+		Dir:          dir,
+		BlockSize:    128 * 1024,
+		CreationTime: true,
+	}
+	walk := func() []protocol.FileInfo {
+		fchan, err := w.Walk()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var files []protocol.FileInfo
+		for f := range fchan {
+			files = append(files, f)
+		}
+		return files
+	}
+
+	supported := runtime.GOOS == "darwin" || runtime.GOOS == "windows"
+	files := walk()
+	if len(files) != 1 || (files[0].Created != 0) != supported {
+		t.Fatalf("unexpected scan result %v", files)
+	}
+	created := files[0].Created
+
+	// Where the creation time isn't known, that from the index is kept.
+	// Otherwise a file whose creation time differs from the index is
+	// rescanned.
+	cf := files[0]
+	cf.Created = created + int64(2*time.Second)
+	w.CurrentFiler = fakeCurrentFiler{"file": cf}
+	if !supported {
+		future := time.Now().Add(time.Hour)
+		os.Chtimes(filepath.Join(dir, "file"), future, future)
+		created = cf.Created
+	}
+	files = walk()
+	if len(files) != 1 || files[0].Created != created {
+		t.Errorf("unexpected scan result %v", files)
+	}
+
+	if !CreationTimeEqual(created, created+int64(999*time.Millisecond)) || CreationTimeEqual(created, created-int64(time.Second)) {
+		t.Error("unexpected creation time comparison")
+	}
+}
+
+func TestMergeAttributes(t *testing.T) {
+	all := uint32(protocol.AttrHidden | protocol.AttrSystem | protocol.AttrReadOnly | protocol.AttrImmutable)
+	// The attributes of other operating systems are kept, as they can't be
+	// scanned here.
+	other := all &^ osutil.SupportedAttributes
+
+	if !AttributesEqual(other, 0) {
+		t.Error("Attributes of other operating systems taken as changed")
+	}
+	if attrs := mergeAttributes(other, osutil.SupportedAttributes, true); attrs != all {
+		t.Errorf("Merged attributes %x != expected %x", attrs, all)
+	}
+	if attrs := mergeAttributes(all, 0, true); attrs != other {
+		t.Errorf("Merged attributes %x != expected %x", attrs, other)
+	}
+	if attrs := mergeAttributes(all, 0, false); attrs != all {
+		t.Errorf("Attributes %x not kept when they can't be read", attrs)
+	}
+	if osutil.SupportedAttributes != 0 && AttributesEqual(osutil.SupportedAttributes, 0) {
+		t.Error("Changed attributes taken as unchanged")
+	}
+}
+
+func TestWalkHardlinks(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("hard links are not supported on Windows")
+	}
+
+	dir, err := ioutil.TempDir("", "walkhardlinks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, name := range []string{"a", "c"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte("data"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Link(filepath.Join(dir, "a"), filepath.Join(dir, "b")); err != nil {
+		t.Fatal(err)
+	}
+
+	w := Walker{
+		Dir:       dir,
+		BlockSize: 128 * 1024,
+		Hardlinks: true,
+	}
+	fchan, err := w.Walk()
+	if err != nil {
+		t.Fatal(err)
+	}
+	groups := make(map[string]string)
+	for f := range fchan {
+		groups[f.Name] = f.LinkGroup
+	}
+	expected := map[string]string{"a": "a", "b": "a", "c": ""}
+	if !reflect.DeepEqual(groups, expected) {
+		t.Errorf("unexpected link groups %v, expected %v", groups, expected)
+	}
+
+	// Without preserving hard links, no groups are set.
+	w.Hardlinks = false
+	fchan, err = w.Walk()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for f := range fchan {
+		if f.LinkGroup != "" {
+			t.Errorf("unexpected link group %q for %q", f.LinkGroup, f.Name)
+		}
+	}
+}
+
+func TestWalkConflictDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "walkconflictdir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, name := range []string{"a", filepath.Join(".stconflicts", "sub", "a"), ".stconflicts2"} {
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(dir, name)), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte("data"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	w := Walker{
+		Dir:         dir,
+		BlockSize:   128 * 1024,
+		ConflictDir: ".stconflicts",
+	}
+	fchan, err := w.Walk()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for f := range fchan {
+		names = append(names, f.Name)
+	}
+	sort.Strings(names)
+	expected := []string{".stconflicts2", "a"}
+	if !reflect.DeepEqual(names, expected) {
+		t.Errorf("unexpected files %v, expected %v", names, expected)
+	}
+}
+
+func TestWalkFilesPerSecond(t *testing.T) {
+	dir, err := ioutil.TempDir("", "walkfilespersecond")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for i := 0; i < 5; i++ {
+		if err := ioutil.WriteFile(filepath.Join(dir, fmt.Sprintf("file%d", i)), []byte("data"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The folder itself and five files, at twenty per second.
+	w := Walker{
+		Dir:            dir,
+		BlockSize:      128 * 1024,
+		FilesPerSecond: 20,
+	}
+	t0 := time.Now()
+	fchan, err := w.Walk()
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := 0
+	for range fchan {
+		n++
+	}
+	if n != 5 {
+		t.Errorf("unexpected number of files %d", n)
+	}
+	if d := time.Since(t0); d < 200*time.Millisecond {
+		t.Errorf("walk took %v, expected at least 200ms", d)
+	}
+}
+
+func TestWalkDirMtimes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "walkdirmtimes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	sub := filepath.Join(dir, "sub")
+	if err := os.Mkdir(sub, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	walk := func(w Walker) []protocol.FileInfo {
+		fchan, err := w.Walk()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var files []protocol.FileInfo
+		for f := range fchan {
+			files = append(files, f)
+		}
+		return files
+	}
+
+	w := Walker{
+		Dir:       dir,
+		BlockSize: 128 * 1024,
+		DirMtimes: true,
+	}
+	files := walk(w)
+	if len(files) != 1 {
+		t.Fatalf("unexpected scan result %v", files)
+	}
+
+	// An unchanged directory is not rescanned, but a change to its
+	// modification time is detected.
+	w.CurrentFiler = fakeCurrentFiler{"sub": files[0]}
+	if files := walk(w); len(files) != 0 {
+		t.Errorf("unexpected rescan %v", files)
+	}
+	mtime := time.Unix(1234567890, 0)
+	if err := os.Chtimes(sub, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+	if files := walk(w); len(files) != 1 || files[0].Modified != mtime.Unix() {
+		t.Errorf("unexpected scan result %v", files)
+	}
+
+	// When not syncing them, changes to them are ignored.
+	w.DirMtimes = false
+	if files := walk(w); len(files) != 0 {
+		t.Errorf("unexpected rescan %v", files)
+	}
+}
+
+func TestWalkAppendOnly(t *testing.T) {
+	dir, err := ioutil.TempDir("", "walkappend")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	const blockSize = 1024
+	name := filepath.Join(dir, "log")
+	data := bytes.Repeat([]byte("0123456789abcdef"), 3*blockSize/16+10)
+	if err := ioutil.WriteFile(name, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	w := Walker{
+		Dir:        dir,
+		BlockSize:  blockSize,
+		AppendOnly: true,
+	}
+	walk := func() protocol.FileInfo {
+		fchan, err := w.Walk()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var files []protocol.FileInfo
+		for f := range fchan {
+			files = append(files, f)
+		}
+		if len(files) != 1 {
+			t.Fatalf("unexpected scan result %v", files)
+		}
+		return files[0]
+	}
+	appendData := func(f protocol.FileInfo, extra []byte) {
+		fd, err := os.OpenFile(name, os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fd.Write(extra)
+		fd.Close()
+		w.CurrentFiler = fakeCurrentFiler{"log": f}
+	}
+
+	cf := walk()
+	appendData(cf, []byte("appended"))
+	f := walk()
+	expected, err := HashFile(fs.DefaultFilesystem, name, blockSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(f.Blocks, expected) {
+		t.Errorf("incorrect blocks after append\n%v\n%v", f.Blocks, expected)
+	}
+
+	// Data before the last complete block is assumed to be unchanged...
+	fd, err := os.OpenFile(name, os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fd.WriteAt([]byte("X"), 0)
+	fd.Close()
+	appendData(f, []byte("more"))
+	if g := walk(); !bytes.Equal(g.Blocks[0].Hash, f.Blocks[0].Hash) {
+		t.Error("first block unexpectedly rehashed")
+	}
+
+	// ... but a change to the last complete block causes a full rehash.
+	fd, err = os.OpenFile(name, os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fd.WriteAt([]byte("X"), 3*blockSize-1)
+	fd.Close()
+	appendData(f, []byte("again"))
+	f = walk()
+	expected, err = HashFile(fs.DefaultFilesystem, name, blockSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(f.Blocks, expected) {
+		t.Errorf("incorrect blocks after rewrite\n%v\n%v", f.Blocks, expected)
+	}
+}
+
 func TestVerify(t *testing.T) {
 	blocksize := 16
 	// data should be an even multiple of blocksize long
@@ -227,3 +775,27 @@ func (l testfileList) String() string {
 	b.WriteString("}")
 	return b.String()
 }
+
+type fakeLocked map[string]bool
+
+func (l fakeLocked) Locked(name string)        {}
+func (l fakeLocked) Hashed(name string)        {}
+func (l fakeLocked) Deferred(name string) bool { return l[name] }
+
+func TestWalkDeferred(t *testing.T) {
+	w := Walker{
+		Dir:         "testdata",
+		Sub:         "afile",
+		BlockSize:   128 * 1024,
+		LockedFiles: fakeLocked{"afile": true},
+	}
+
+	fchan, err := w.Walk()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for f := range fchan {
+		t.Errorf("Unexpected deferred file %q", f.Name)
+	}
+}
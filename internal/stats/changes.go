@@ -0,0 +1,223 @@
+// Copyright (C) 2014 The Syncthing Authors.
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for
+// more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package stats
+
+import (
+	"encoding/binary"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/syncthing/syncthing/internal/protocol"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// The actions of a DiskChange
+const (
+	DiskChangeModified = "modified"
+	DiskChangeDeleted  = "deleted"
+)
+
+// The types of the item of a DiskChange
+const (
+	DiskChangeFile    = "file"
+	DiskChangeDir     = "dir"
+	DiskChangeSymlink = "symlink"
+)
+
+// A DiskChange is a change to an item in a folder, either made by the puller
+// on behalf of another device or found by the scanner.
+type DiskChange struct {
+	Folder   string
+	Path     string
+	Action   string
+	Type     string
+	Modifier protocol.DeviceID // the device the change came from
+	Time     time.Time
+}
+
+var errDiskChangeTooShort = errors.New("disk change value too short")
+
+func (c DiskChange) MarshalBinary() ([]byte, error) {
+	strs := []string{c.Folder, c.Path, c.Action, c.Type}
+	size := 8 + 32
+	for _, s := range strs {
+		size += 4 + len(s)
+	}
+
+	buf := make([]byte, size)
+	binary.BigEndian.PutUint64(buf, uint64(c.Time.UnixNano()))
+	copy(buf[8:], c.Modifier[:])
+	n := 8 + 32
+	for _, s := range strs {
+		binary.BigEndian.PutUint32(buf[n:], uint32(len(s)))
+		n += 4
+		n += copy(buf[n:], s)
+	}
+	return buf, nil
+}
+
+func (c *DiskChange) UnmarshalBinary(buf []byte) error {
+	if len(buf) < 8+32 {
+		return errDiskChangeTooShort
+	}
+	c.Time = time.Unix(0, int64(binary.BigEndian.Uint64(buf)))
+	copy(c.Modifier[:], buf[8:])
+	buf = buf[8+32:]
+
+	for _, s := range []*string{&c.Folder, &c.Path, &c.Action, &c.Type} {
+		if len(buf) < 4 {
+			return errDiskChangeTooShort
+		}
+		n := int(binary.BigEndian.Uint32(buf))
+		buf = buf[4:]
+		if len(buf) < n {
+			return errDiskChangeTooShort
+		}
+		*s = string(buf[:n])
+		buf = buf[n:]
+	}
+	return nil
+}
+
+// DiskChangeLog keeps the most recent disk changes in the database, in the
+// order they were added. When more than the maximum number of changes are
+// kept, the oldest are discarded.
+type DiskChangeLog struct {
+	db    *leveldb.DB
+	max   int
+	mut   sync.Mutex
+	seq   uint64 // sequence number of the latest change
+	count int    // number of changes kept
+}
+
+func NewDiskChangeLog(db *leveldb.DB, max int) *DiskChangeLog {
+	s := &DiskChangeLog{
+		db:  db,
+		max: max,
+	}
+
+	it := db.NewIterator(util.BytesPrefix([]byte{keyTypeDiskChange}), nil)
+	for it.Next() {
+		s.count++
+	}
+	if it.Last() {
+		s.seq = diskChangeSeq(it.Key())
+	}
+	it.Release()
+
+	return s
+}
+
+func diskChangeKey(seq uint64) []byte {
+	k := make([]byte, 1+8)
+	k[0] = keyTypeDiskChange
+	binary.BigEndian.PutUint64(k[1:], seq)
+	return k
+}
+
+func diskChangeSeq(key []byte) uint64 {
+	if len(key) != 1+8 {
+		return 0
+	}
+	return binary.BigEndian.Uint64(key[1:])
+}
+
+// Add records the changes, discarding the oldest ones as necessary.
+func (s *DiskChangeLog) Add(changes []DiskChange) {
+	if len(changes) > s.max {
+		changes = changes[len(changes)-s.max:]
+	}
+
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	batch := new(leveldb.Batch)
+	for _, c := range changes {
+		value, err := c.MarshalBinary()
+		if err != nil {
+			l.Warnln("DiskChangeLog: Failed serializing change of", c.Path, "in", c.Folder, ":", err)
+			continue
+		}
+		s.seq++
+		batch.Put(diskChangeKey(s.seq), value)
+		s.count++
+	}
+
+	if s.count > s.max {
+		excess := s.count - s.max
+		it := s.db.NewIterator(util.BytesPrefix([]byte{keyTypeDiskChange}), nil)
+		for i := 0; i < excess && it.Next(); i++ {
+			batch.Delete(append([]byte(nil), it.Key()...))
+		}
+		it.Release()
+		s.count = s.max
+	}
+
+	if err := s.db.Write(batch, nil); err != nil {
+		l.Warnln("DiskChangeLog: Failed storing changes:", err)
+	}
+}
+
+// Changes returns at most limit of the changes in the folder, or in all
+// folders if folder is empty, newest first. A limit of zero returns all the
+// changes kept.
+func (s *DiskChangeLog) Changes(folder string, limit int) []DiskChange {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	res := []DiskChange{}
+	it := s.db.NewIterator(util.BytesPrefix([]byte{keyTypeDiskChange}), nil)
+	defer it.Release()
+	for ok := it.Last(); ok && (limit <= 0 || len(res) < limit); ok = it.Prev() {
+		var c DiskChange
+		if err := c.UnmarshalBinary(it.Value()); err != nil {
+			l.Warnln("DiskChangeLog: Failed loading change:", err)
+			continue
+		}
+		if folder == "" || c.Folder == folder {
+			res = append(res, c)
+		}
+	}
+	return res
+}
+
+// Clear discards the changes in the folder, or all changes if folder is
+// empty.
+func (s *DiskChangeLog) Clear(folder string) error {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	batch := new(leveldb.Batch)
+	removed := 0
+	it := s.db.NewIterator(util.BytesPrefix([]byte{keyTypeDiskChange}), nil)
+	for it.Next() {
+		var c DiskChange
+		if folder != "" && c.UnmarshalBinary(it.Value()) == nil && c.Folder != folder {
+			continue
+		}
+		batch.Delete(append([]byte(nil), it.Key()...))
+		removed++
+	}
+	it.Release()
+
+	if err := s.db.Write(batch, nil); err != nil {
+		return err
+	}
+	s.count -= removed
+	return nil
+}
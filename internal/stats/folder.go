@@ -19,19 +19,26 @@ import (
 	"encoding/binary"
 	"time"
 
+	"github.com/syncthing/syncthing/internal/protocol"
 	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
 )
 
 const (
 	folderStatisticTypeLastFile = iota
+	folderStatisticTypeReceivedBytes
+	folderStatisticTypeFirstSynced
 )
 
 var folderStatisticsTypes = []byte{
 	folderStatisticTypeLastFile,
+	folderStatisticTypeFirstSynced,
 }
 
 type FolderStatistics struct {
-	LastFile *LastFile
+	LastFile      *LastFile
+	ReceivedBytes map[string]int64 // device ID -> data pulled from it
+	FirstSynced   *time.Time       // when the folder was first in sync, if it has been
 }
 
 type FolderStatisticsReference struct {
@@ -93,6 +100,86 @@ func (s *FolderStatisticsReference) ReceivedFile(filename string) {
 	}
 }
 
+// GetFirstSynced returns when the folder was first in sync, or the zero
+// time if it hasn't been.
+func (s *FolderStatisticsReference) GetFirstSynced() time.Time {
+	value, err := s.db.Get(s.key(folderStatisticTypeFirstSynced), nil)
+	if err != nil {
+		if err != leveldb.ErrNotFound {
+			l.Warnln("FolderStatisticsReference: Failed loading first synced value for", s.folder, ":", err)
+		}
+		return time.Time{}
+	}
+	if len(value) != 8 {
+		return time.Time{}
+	}
+	return time.Unix(int64(binary.BigEndian.Uint64(value)), 0)
+}
+
+// SetFirstSynced records when the folder was first in sync.
+func (s *FolderStatisticsReference) SetFirstSynced(t time.Time) {
+	if debug {
+		l.Debugln("stats.FolderStatisticsReference.SetFirstSynced:", s.folder, t)
+	}
+
+	value := make([]byte, 8)
+	binary.BigEndian.PutUint64(value, uint64(t.Unix()))
+	err := s.db.Put(s.key(folderStatisticTypeFirstSynced), value, nil)
+	if err != nil {
+		l.Warnln("Failed update first synced value for", s.folder, ":", err)
+	}
+}
+
+// The received bytes are kept per device, under the key of the statistic
+// followed by the device ID.
+func (s *FolderStatisticsReference) receivedBytesKey(device protocol.DeviceID) []byte {
+	return append(s.key(folderStatisticTypeReceivedBytes), device[:]...)
+}
+
+// AddReceivedBytes adds to the amount of data pulled from each device.
+func (s *FolderStatisticsReference) AddReceivedBytes(received map[protocol.DeviceID]int64) {
+	if debug {
+		l.Debugln("stats.FolderStatisticsReference.AddReceivedBytes:", s.folder, received)
+	}
+
+	batch := new(leveldb.Batch)
+	for device, n := range received {
+		key := s.receivedBytesKey(device)
+		value, err := s.db.Get(key, nil)
+		if err != nil && err != leveldb.ErrNotFound {
+			l.Warnln("FolderStatisticsReference: Failed loading received bytes for", s.folder, "from", device, ":", err)
+			continue
+		}
+		var total int64
+		if len(value) == 8 {
+			total = int64(binary.BigEndian.Uint64(value))
+		}
+		value = make([]byte, 8)
+		binary.BigEndian.PutUint64(value, uint64(total+n))
+		batch.Put(key, value)
+	}
+
+	if err := s.db.Write(batch, nil); err != nil {
+		l.Warnln("Failed update received bytes for", s.folder, ":", err)
+	}
+}
+
+func (s *FolderStatisticsReference) GetReceivedBytes() map[string]int64 {
+	res := make(map[string]int64)
+	it := s.db.NewIterator(util.BytesPrefix(s.key(folderStatisticTypeReceivedBytes)), nil)
+	defer it.Release()
+	for it.Next() {
+		key, value := it.Key(), it.Value()
+		if len(key) != 1+1+64+32 || len(value) != 8 {
+			continue
+		}
+		var device protocol.DeviceID
+		copy(device[:], key[1+1+64:])
+		res[device.String()] = int64(binary.BigEndian.Uint64(value))
+	}
+	return res
+}
+
 // Never called, maybe because it's worth while to keep the data
 // or maybe because we have no easy way of knowing that a folder has been removed.
 func (s *FolderStatisticsReference) Delete() error {
@@ -105,13 +192,25 @@ func (s *FolderStatisticsReference) Delete() error {
 			return err
 		}
 	}
-	return nil
+
+	batch := new(leveldb.Batch)
+	it := s.db.NewIterator(util.BytesPrefix(s.key(folderStatisticTypeReceivedBytes)), nil)
+	for it.Next() {
+		batch.Delete(append([]byte(nil), it.Key()...))
+	}
+	it.Release()
+	return s.db.Write(batch, nil)
 }
 
 func (s *FolderStatisticsReference) GetStatistics() FolderStatistics {
-	return FolderStatistics{
-		LastFile: s.GetLastFile(),
+	stats := FolderStatistics{
+		LastFile:      s.GetLastFile(),
+		ReceivedBytes: s.GetReceivedBytes(),
+	}
+	if t := s.GetFirstSynced(); !t.IsZero() {
+		stats.FirstSynced = &t
 	}
+	return stats
 }
 
 type LastFile struct {
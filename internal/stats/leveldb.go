@@ -19,4 +19,8 @@ package stats
 const (
 	keyTypeDeviceStatistic = iota + 30
 	keyTypeFolderStatistic
+	keyTypePendingDevice
+	keyTypePendingFolder
+	keyTypeDiskChange
+	keyTypeOfferedFolder
 )
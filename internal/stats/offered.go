@@ -0,0 +1,92 @@
+// Copyright (C) 2014 The Syncthing Authors.
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for
+// more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package stats
+
+import (
+	"time"
+
+	"github.com/syncthing/syncthing/internal/protocol"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// An OfferedFolder is a folder a device shares with us, as of the last
+// cluster config it sent.
+type OfferedFolder struct {
+	Folder string
+	Time   time.Time
+}
+
+// OfferedReference keeps the folders each device shares with us in the
+// database, whether or not we share them back.
+type OfferedReference struct {
+	db *leveldb.DB
+}
+
+func NewOfferedReference(db *leveldb.DB) *OfferedReference {
+	return &OfferedReference{
+		db: db,
+	}
+}
+
+func offeredDevicePrefix(device protocol.DeviceID) []byte {
+	k := make([]byte, 1+32)
+	k[0] = keyTypeOfferedFolder
+	copy(k[1:], device[:])
+	return k
+}
+
+func offeredFolderKey(device protocol.DeviceID, folder string) []byte {
+	return append(offeredDevicePrefix(device), []byte(folder)...)
+}
+
+// SetFolders replaces the folders offered by the device.
+func (s *OfferedReference) SetFolders(device protocol.DeviceID, folders []string) {
+	if debug {
+		l.Debugln("stats.OfferedReference.SetFolders:", device, folders)
+	}
+
+	batch := new(leveldb.Batch)
+	it := s.db.NewIterator(util.BytesPrefix(offeredDevicePrefix(device)), nil)
+	for it.Next() {
+		batch.Delete(it.Key())
+	}
+	it.Release()
+
+	val := pendingValue(time.Now(), "")
+	for _, folder := range folders {
+		batch.Put(offeredFolderKey(device, folder), val)
+	}
+
+	if err := s.db.Write(batch, nil); err != nil {
+		l.Warnln("OfferedReference: Failed storing folders offered by", device, ":", err)
+	}
+}
+
+// Folders returns the folders offered by the device, sorted by ID.
+func (s *OfferedReference) Folders(device protocol.DeviceID) []OfferedFolder {
+	var res []OfferedFolder
+	prefix := offeredDevicePrefix(device)
+	it := s.db.NewIterator(util.BytesPrefix(prefix), nil)
+	defer it.Release()
+	for it.Next() {
+		var f OfferedFolder
+		f.Folder = string(it.Key()[len(prefix):])
+		f.Time, _ = parsePendingValue(it.Value())
+		res = append(res, f)
+	}
+	return res
+}
@@ -0,0 +1,158 @@
+// Copyright (C) 2014 The Syncthing Authors.
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for
+// more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package stats
+
+import (
+	"encoding/binary"
+	"time"
+
+	"github.com/syncthing/syncthing/internal/protocol"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// A PendingDevice is a device that has tried to connect to us without being
+// configured.
+type PendingDevice struct {
+	DeviceID protocol.DeviceID
+	Address  string
+	Time     time.Time
+}
+
+// A PendingFolder is a folder offered to us by a device it isn't shared with.
+type PendingFolder struct {
+	Folder   string
+	DeviceID protocol.DeviceID
+	Time     time.Time
+}
+
+// PendingReference keeps the pending devices and folders in the database,
+// until they are removed when accepted or dismissed.
+type PendingReference struct {
+	db *leveldb.DB
+}
+
+func NewPendingReference(db *leveldb.DB) *PendingReference {
+	return &PendingReference{
+		db: db,
+	}
+}
+
+func pendingDeviceKey(device protocol.DeviceID) []byte {
+	k := make([]byte, 1+32)
+	k[0] = keyTypePendingDevice
+	copy(k[1:], device[:])
+	return k
+}
+
+func pendingFolderKey(device protocol.DeviceID, folder string) []byte {
+	k := make([]byte, 1+32+len(folder))
+	k[0] = keyTypePendingFolder
+	copy(k[1:], device[:])
+	copy(k[1+32:], []byte(folder))
+	return k
+}
+
+// The value of a pending entry is the time it was last seen, followed by the
+// address the device connected from, for devices.
+func pendingValue(t time.Time, address string) []byte {
+	buf := make([]byte, 8+len(address))
+	binary.BigEndian.PutUint64(buf[:8], uint64(t.Unix()))
+	copy(buf[8:], []byte(address))
+	return buf
+}
+
+func parsePendingValue(buf []byte) (time.Time, string) {
+	if len(buf) < 8 {
+		return time.Unix(0, 0), ""
+	}
+	return time.Unix(int64(binary.BigEndian.Uint64(buf[:8])), 0), string(buf[8:])
+}
+
+// AddDevice records that the device tried to connect from the given address.
+func (s *PendingReference) AddDevice(device protocol.DeviceID, address string) {
+	if debug {
+		l.Debugln("stats.PendingReference.AddDevice:", device, address)
+	}
+	err := s.db.Put(pendingDeviceKey(device), pendingValue(time.Now(), address), nil)
+	if err != nil {
+		l.Warnln("PendingReference: Failed storing pending device", device, ":", err)
+	}
+}
+
+// AddFolder records that the device offered the folder.
+func (s *PendingReference) AddFolder(folder string, device protocol.DeviceID) {
+	if debug {
+		l.Debugln("stats.PendingReference.AddFolder:", folder, device)
+	}
+	err := s.db.Put(pendingFolderKey(device, folder), pendingValue(time.Now(), ""), nil)
+	if err != nil {
+		l.Warnln("PendingReference: Failed storing pending folder", folder, "from", device, ":", err)
+	}
+}
+
+// RemoveDevice forgets about the pending device.
+func (s *PendingReference) RemoveDevice(device protocol.DeviceID) error {
+	if debug {
+		l.Debugln("stats.PendingReference.RemoveDevice:", device)
+	}
+	return s.db.Delete(pendingDeviceKey(device), nil)
+}
+
+// RemoveFolder forgets about the folder being offered by the device.
+func (s *PendingReference) RemoveFolder(folder string, device protocol.DeviceID) error {
+	if debug {
+		l.Debugln("stats.PendingReference.RemoveFolder:", folder, device)
+	}
+	return s.db.Delete(pendingFolderKey(device, folder), nil)
+}
+
+// Devices returns the pending devices.
+func (s *PendingReference) Devices() []PendingDevice {
+	var res []PendingDevice
+	it := s.db.NewIterator(util.BytesPrefix([]byte{keyTypePendingDevice}), nil)
+	defer it.Release()
+	for it.Next() {
+		key := it.Key()
+		if len(key) != 1+32 {
+			continue
+		}
+		var d PendingDevice
+		copy(d.DeviceID[:], key[1:])
+		d.Time, d.Address = parsePendingValue(it.Value())
+		res = append(res, d)
+	}
+	return res
+}
+
+// Folders returns the pending folders.
+func (s *PendingReference) Folders() []PendingFolder {
+	var res []PendingFolder
+	it := s.db.NewIterator(util.BytesPrefix([]byte{keyTypePendingFolder}), nil)
+	defer it.Release()
+	for it.Next() {
+		key := it.Key()
+		if len(key) <= 1+32 {
+			continue
+		}
+		var f PendingFolder
+		copy(f.DeviceID[:], key[1:1+32])
+		f.Folder = string(key[1+32:])
+		f.Time, _ = parsePendingValue(it.Value())
+		res = append(res, f)
+	}
+	return res
+}
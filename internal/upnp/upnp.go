@@ -543,6 +543,23 @@ func (n *IGD) DeletePortMapping(protocol Protocol, externalPort int) error {
 	return nil
 }
 
+// Query the services of the specified InternetGatewayDevice for the external IP address.
+// The address of the first service that knows it is returned.
+func (n *IGD) GetExternalIPAddress() (net.IP, error) {
+	var lastErr error
+	for _, service := range n.services {
+		ip, err := service.GetExternalIPAddress()
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if ip != nil {
+			return ip, nil
+		}
+	}
+	return nil, lastErr
+}
+
 type soapGetExternalIPAddressResponseEnvelope struct {
 	XMLName xml.Name
 	Body    soapGetExternalIPAddressResponseBody `xml:"Body"`
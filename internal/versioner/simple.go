@@ -20,6 +20,7 @@ import (
 	"path/filepath"
 	"strconv"
 
+	"github.com/syncthing/syncthing/internal/fs"
 	"github.com/syncthing/syncthing/internal/osutil"
 )
 
@@ -32,6 +33,7 @@ func init() {
 type Simple struct {
 	keep       int
 	folderPath string
+	filesystem fs.Filesystem
 }
 
 // The constructor function takes a map of parameters and creates the type.
@@ -44,6 +46,7 @@ func NewSimple(folderID, folderPath string, params map[string]string) Versioner
 	s := Simple{
 		keep:       keep,
 		folderPath: folderPath,
+		filesystem: fs.DefaultFilesystem,
 	}
 
 	if debug {
@@ -55,7 +58,7 @@ func NewSimple(folderID, folderPath string, params map[string]string) Versioner
 // Move away the named file to a version archive. If this function returns
 // nil, the named file does not exist any more (has been archived).
 func (v Simple) Archive(filePath string) error {
-	fileInfo, err := os.Lstat(filePath)
+	fileInfo, err := v.filesystem.Lstat(filePath)
 	if err != nil {
 		if os.IsNotExist(err) {
 			if debug {
@@ -67,13 +70,13 @@ func (v Simple) Archive(filePath string) error {
 	}
 
 	versionsDir := filepath.Join(v.folderPath, ".stversions")
-	_, err = os.Stat(versionsDir)
+	_, err = v.filesystem.Stat(versionsDir)
 	if err != nil {
 		if os.IsNotExist(err) {
 			if debug {
 				l.Debugln("creating versions dir", versionsDir)
 			}
-			os.MkdirAll(versionsDir, 0755)
+			v.filesystem.MkdirAll(versionsDir, 0755)
 			osutil.HideFile(versionsDir)
 		} else {
 			return err
@@ -91,7 +94,7 @@ func (v Simple) Archive(filePath string) error {
 	}
 
 	dir := filepath.Join(versionsDir, inFolderPath)
-	err = os.MkdirAll(dir, 0755)
+	err = v.filesystem.MkdirAll(dir, 0755)
 	if err != nil && !os.IsExist(err) {
 		return err
 	}
@@ -101,20 +104,20 @@ func (v Simple) Archive(filePath string) error {
 	if debug {
 		l.Debugln("moving to", dst)
 	}
-	err = osutil.Rename(filePath, dst)
+	err = fs.Rename(v.filesystem, filePath, dst)
 	if err != nil {
 		return err
 	}
 
 	// Glob according to the new file~timestamp.ext pattern.
-	newVersions, err := filepath.Glob(filepath.Join(dir, taggedFilename(file, TimeGlob)))
+	newVersions, err := v.filesystem.Glob(filepath.Join(dir, taggedFilename(file, TimeGlob)))
 	if err != nil {
 		l.Warnln("globbing:", err)
 		return nil
 	}
 
 	// Also according to the old file.ext~timestamp pattern.
-	oldVersions, err := filepath.Glob(filepath.Join(dir, file+"~"+TimeGlob))
+	oldVersions, err := v.filesystem.Glob(filepath.Join(dir, file+"~"+TimeGlob))
 	if err != nil {
 		l.Warnln("globbing:", err)
 		return nil
@@ -129,7 +132,7 @@ func (v Simple) Archive(filePath string) error {
 			if debug {
 				l.Debugln("cleaning out", toRemove)
 			}
-			err = os.Remove(toRemove)
+			err = v.filesystem.Remove(toRemove)
 			if err != nil {
 				l.Warnln("removing old version:", err)
 			}
@@ -23,6 +23,7 @@ import (
 	"sync"
 	"time"
 
+	"github.com/syncthing/syncthing/internal/fs"
 	"github.com/syncthing/syncthing/internal/osutil"
 )
 
@@ -42,12 +43,14 @@ type Staggered struct {
 	cleanInterval int64
 	folderPath    string
 	interval      [4]Interval
+	keep          int // most recent versions of each file not subject to the intervals
 	mutex         *sync.Mutex
+	filesystem    fs.Filesystem
 }
 
 // Rename versions with old version format
 func (v Staggered) renameOld() {
-	err := filepath.Walk(v.versionsPath, func(path string, f os.FileInfo, err error) error {
+	err := v.filesystem.Walk(v.versionsPath, func(path string, f os.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
@@ -57,7 +60,7 @@ func (v Staggered) renameOld() {
 				l.Infoln("Renaming file", path, "from old to new version format")
 				versiondate := time.Unix(versionUnix, 0)
 				name := path[:len(path)-len(filepath.Ext(path))]
-				err = osutil.Rename(path, taggedFilename(name, versiondate.Format(TimeFormat)))
+				err = fs.Rename(v.filesystem, path, taggedFilename(name, versiondate.Format(TimeFormat)))
 				if err != nil {
 					l.Infoln("Error renaming to new format", err)
 				}
@@ -73,6 +76,12 @@ func (v Staggered) renameOld() {
 
 // The constructor function takes a map of parameters and creates the type.
 func NewStaggered(folderID, folderPath string, params map[string]string) Versioner {
+	return newStaggered(folderPath, params, 0)
+}
+
+// newStaggered creates a staggered versioner that leaves the given number
+// of most recent versions of each file alone, and starts its cleaner.
+func newStaggered(folderPath string, params map[string]string, keep int) Staggered {
 	maxAge, err := strconv.ParseInt(params["maxAge"], 10, 0)
 	if err != nil {
 		maxAge = 31536000 // Default: ~1 year
@@ -107,7 +116,9 @@ func NewStaggered(folderID, folderPath string, params map[string]string) Version
 			{86400, 592000},  // next 30 days -> 1 day between versions
 			{604800, maxAge}, // next year -> 1 week between versions
 		},
-		mutex: &mutex,
+		keep:       keep,
+		mutex:      &mutex,
+		filesystem: fs.DefaultFilesystem,
 	}
 
 	if debug {
@@ -137,13 +148,13 @@ func (v Staggered) clean() {
 		l.Debugln("Versioner clean: Cleaning", v.versionsPath)
 	}
 
-	_, err := os.Stat(v.versionsPath)
+	_, err := v.filesystem.Stat(v.versionsPath)
 	if err != nil {
 		if os.IsNotExist(err) {
 			if debug {
 				l.Debugln("creating versions dir", v.versionsPath)
 			}
-			os.MkdirAll(v.versionsPath, 0755)
+			v.filesystem.MkdirAll(v.versionsPath, 0755)
 			osutil.HideFile(v.versionsPath)
 		} else {
 			l.Warnln("Versioner: can't create versions dir", err)
@@ -153,7 +164,7 @@ func (v Staggered) clean() {
 	versionsPerFile := make(map[string][]string)
 	filesPerDir := make(map[string]int)
 
-	err = filepath.Walk(v.versionsPath, func(path string, f os.FileInfo, err error) error {
+	err = v.filesystem.Walk(v.versionsPath, func(path string, f os.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
@@ -202,7 +213,7 @@ func (v Staggered) clean() {
 		if debug {
 			l.Debugln("Cleaner: deleting empty directory", path)
 		}
-		err = os.Remove(path)
+		err = v.filesystem.Remove(path)
 		if err != nil {
 			l.Warnln("Versioner: can't remove directory", path, err)
 		}
@@ -216,10 +227,20 @@ func (v Staggered) expire(versions []string) {
 	if debug {
 		l.Debugln("Versioner: Expiring versions", versions)
 	}
+
+	// The list is sorted oldest first, so the most recent versions to keep
+	// are the last ones.
+	if v.keep > 0 {
+		if len(versions) <= v.keep {
+			return
+		}
+		versions = versions[:len(versions)-v.keep]
+	}
+
 	var prevAge int64
 	firstFile := true
 	for _, file := range versions {
-		fi, err := os.Stat(file)
+		fi, err := v.filesystem.Stat(file)
 		if err != nil {
 			l.Warnln("versioner:", err)
 			continue
@@ -244,7 +265,7 @@ func (v Staggered) expire(versions []string) {
 			if debug {
 				l.Debugln("Versioner: File over maximum age -> delete ", file)
 			}
-			err = os.Remove(file)
+			err = v.filesystem.Remove(file)
 			if err != nil {
 				l.Warnf("Versioner: can't remove %q: %v", file, err)
 			}
@@ -270,7 +291,7 @@ func (v Staggered) expire(versions []string) {
 			if debug {
 				l.Debugln("too many files in step -> delete", file)
 			}
-			err = os.Remove(file)
+			err = v.filesystem.Remove(file)
 			if err != nil {
 				l.Warnf("Versioner: can't remove %q: %v", file, err)
 			}
@@ -290,7 +311,7 @@ func (v Staggered) Archive(filePath string) error {
 	v.mutex.Lock()
 	defer v.mutex.Unlock()
 
-	if _, err := os.Lstat(filePath); err != nil {
+	if _, err := v.filesystem.Lstat(filePath); err != nil {
 		if os.IsNotExist(err) {
 			if debug {
 				l.Debugln("not archiving nonexistent file", filePath)
@@ -300,12 +321,12 @@ func (v Staggered) Archive(filePath string) error {
 		return err
 	}
 
-	if _, err := os.Stat(v.versionsPath); err != nil {
+	if _, err := v.filesystem.Stat(v.versionsPath); err != nil {
 		if os.IsNotExist(err) {
 			if debug {
 				l.Debugln("creating versions dir", v.versionsPath)
 			}
-			os.MkdirAll(v.versionsPath, 0755)
+			v.filesystem.MkdirAll(v.versionsPath, 0755)
 			osutil.HideFile(v.versionsPath)
 		} else {
 			return err
@@ -323,7 +344,7 @@ func (v Staggered) Archive(filePath string) error {
 	}
 
 	dir := filepath.Join(v.versionsPath, inFolderPath)
-	err = os.MkdirAll(dir, 0755)
+	err = v.filesystem.MkdirAll(dir, 0755)
 	if err != nil && !os.IsExist(err) {
 		return err
 	}
@@ -333,20 +354,20 @@ func (v Staggered) Archive(filePath string) error {
 	if debug {
 		l.Debugln("moving to", dst)
 	}
-	err = osutil.Rename(filePath, dst)
+	err = fs.Rename(v.filesystem, filePath, dst)
 	if err != nil {
 		return err
 	}
 
 	// Glob according to the new file~timestamp.ext pattern.
-	newVersions, err := filepath.Glob(filepath.Join(dir, taggedFilename(file, TimeGlob)))
+	newVersions, err := v.filesystem.Glob(filepath.Join(dir, taggedFilename(file, TimeGlob)))
 	if err != nil {
 		l.Warnln("globbing:", err)
 		return nil
 	}
 
 	// Also according to the old file.ext~timestamp pattern.
-	oldVersions, err := filepath.Glob(filepath.Join(dir, file+"~"+TimeGlob))
+	oldVersions, err := v.filesystem.Glob(filepath.Join(dir, file+"~"+TimeGlob))
 	if err != nil {
 		l.Warnln("globbing:", err)
 		return nil
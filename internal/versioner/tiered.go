@@ -0,0 +1,38 @@
+// Copyright (C) 2014 The Syncthing Authors.
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for
+// more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package versioner
+
+import "strconv"
+
+func init() {
+	// Register the constructor for this type of versioner with the name "tiered"
+	Factories["tiered"] = NewTiered
+}
+
+// NewTiered creates a versioner that keeps the most recent versions of each
+// file, like simple versioning, and thins out those older than them, like
+// staggered versioning. It takes the "keep" parameter of the former and the
+// parameters of the latter. Both policies are applied by the same staggered
+// versioner, on archiving and when cleaning, so they never disagree on which
+// versions to remove.
+func NewTiered(folderID, folderPath string, params map[string]string) Versioner {
+	keep, err := strconv.Atoi(params["keep"])
+	if err != nil {
+		keep = 5 // A reasonable default
+	}
+
+	return newStaggered(folderPath, params, keep)
+}
@@ -16,8 +16,14 @@
 package versioner
 
 import (
+	"io/ioutil"
+	"os"
 	"path/filepath"
+	"reflect"
 	"testing"
+	"time"
+
+	"github.com/syncthing/syncthing/internal/fs"
 )
 
 func TestTaggedFilename(t *testing.T) {
@@ -51,3 +57,54 @@ func TestTaggedFilename(t *testing.T) {
 		}
 	}
 }
+
+func TestTieredExpire(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tiered")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	now := time.Now()
+	ages := []time.Duration{
+		240 * time.Hour,
+		239 * time.Hour,
+		238 * time.Hour,
+		10 * time.Second,
+		5 * time.Second,
+	}
+	var versions []string
+	for _, age := range ages {
+		name := taggedFilename(filepath.Join(dir, "file.txt"), now.Add(-age).Format(TimeFormat))
+		if err := ioutil.WriteFile(name, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+		versions = append(versions, name)
+	}
+
+	// Without the cleaner newStaggered would start.
+	v := Staggered{
+		interval: [4]Interval{
+			{30, 3600},
+			{3600, 86400},
+			{86400, 592000},
+			{604800, 31536000},
+		},
+		keep:       2,
+		filesystem: fs.DefaultFilesystem,
+	}
+	v.expire(versions)
+
+	// The two most recent versions are kept even though they are closer
+	// than the staggered intervals allow, the older ones are thinned out.
+	expected := []string{versions[0], versions[3], versions[4]}
+	var remaining []string
+	for _, name := range versions {
+		if _, err := os.Stat(name); err == nil {
+			remaining = append(remaining, name)
+		}
+	}
+	if !reflect.DeepEqual(remaining, expected) {
+		t.Errorf("remaining versions %v, expected %v", remaining, expected)
+	}
+}
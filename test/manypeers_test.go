@@ -25,7 +25,7 @@ import (
 	"time"
 
 	"github.com/syncthing/syncthing/internal/config"
-	"github.com/syncthing/syncthing/internal/osutil"
+	"github.com/syncthing/syncthing/internal/fs"
 	"github.com/syncthing/syncthing/internal/protocol"
 )
 
@@ -74,8 +74,8 @@ func TestManyPeers(t *testing.T) {
 		cfg.Folders[0].Devices = append(cfg.Folders[0].Devices, config.FolderDeviceConfiguration{DeviceID: id})
 	}
 
-	osutil.Rename("h2/config.xml", "h2/config.xml.orig")
-	defer osutil.Rename("h2/config.xml.orig", "h2/config.xml")
+	fs.Rename(fs.DefaultFilesystem, "h2/config.xml", "h2/config.xml.orig")
+	defer fs.Rename(fs.DefaultFilesystem, "h2/config.xml.orig", "h2/config.xml")
 
 	var buf bytes.Buffer
 	json.NewEncoder(&buf).Encode(cfg)